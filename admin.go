@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// AdminAddress is the address the admin server listens on, so that its debug endpoints are only reachable
+// from the host, e.g. through kubectl port-forward
+const AdminAddress = "127.0.0.1"
+
+// runAdminServer serves the debug endpoints on the loopback interface until it fails
+func runAdminServer(config AdminConfig) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(AdminAddress, config.Port))
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("serving the admin endpoints on %s", listener.Addr())
+	return http.Serve(listener, newAdminServeMux())
+}
+
+// newAdminServeMux routes the debug endpoints:
+// /debug/pprof/ for the profiles of net/http/pprof, /debug/vars for expvar and /debug/goroutines
+// for a dump of the stacks of every goroutine
+func newAdminServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", dumpGoroutines)
+	return mux
+}
+
+// dumpGoroutines writes the stacks of every goroutine, in the format of an unrecovered panic
+func dumpGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminServeMux(t *testing.T) {
+	mux := newAdminServeMux()
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/goroutines"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s should have been served, got %d", path, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/goroutines", nil))
+	if !strings.Contains(recorder.Body.String(), "goroutine ") {
+		t.Fatalf("the stacks of the goroutines should have been dumped, got %q", recorder.Body.String())
+	}
+}
+
+func TestServeMuxHasNoDebugEndpoints(t *testing.T) {
+	mux := newServeMux(nil, 0, false)
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("%s shouldn't be served by the API, got %d", path, recorder.Code)
+		}
+	}
+}
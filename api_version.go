@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// the versions of the HTTP API, served side by side under /api/<version>. A breaking change of a request or a
+// response ships under a new version, the previous ones answering as they did until they are removed.
+const (
+	APIVersion1 = "v1"
+	// APIVersion2 answers POST /keys/batch with a result per id, in the order of the ids
+	APIVersion2 = "v2"
+)
+
+// apiVersions are the versions of the HTTP API served, the latest last
+var apiVersions = []string{APIVersion1, APIVersion2}
+
+// latestAPIVersion is the version the deprecated ones link to as their successor
+var latestAPIVersion = apiVersions[len(apiVersions)-1]
+
+// apiVersionDateLayout is the layout of the deprecation and sunset dates of the configuration
+const apiVersionDateLayout = "2006-01-02"
+
+type apiVersionContextKey struct{}
+
+// withAPIVersion returns a copy of ctx carrying the version of the HTTP API its request was routed by, logged as
+// the api_version field
+func withAPIVersion(ctx context.Context, version string) context.Context {
+	ctx = withLogFields(ctx, logger.Fields{"api_version": version})
+	return context.WithValue(ctx, apiVersionContextKey{}, version)
+}
+
+// apiVersionFromContext returns the version of the HTTP API the request of ctx was routed by, v1 when it wasn't
+// routed by version
+func apiVersionFromContext(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionContextKey{}).(string); ok {
+		return version
+	}
+	return APIVersion1
+}
+
+// apiPath is the path of an endpoint of the HTTP API under the given version
+func apiPath(version string, path string) string {
+	return "/api/" + version + path
+}
+
+// isAPIVersion returns whether the HTTP API is served under the given version
+func isAPIVersion(version string) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// apiDeprecationHeaders returns the headers of the responses of the deprecated versions of versions: the
+// Deprecation date (RFC 9745), the Sunset date the version is removed at (RFC 8594), and the Link to its
+// migration guide and to the same endpoint under the latest version, as appended by versioned
+func apiDeprecationHeaders(versions map[string]APIVersionConfig) (map[string]http.Header, error) {
+	headers := make(map[string]http.Header, len(versions))
+	for version, config := range versions {
+		if !isAPIVersion(version) {
+			return nil, fmt.Errorf("unknown API version %q, the versions are %s", version, strings.Join(apiVersions, ", "))
+		}
+		if config.DeprecatedAt == "" {
+			if config.SunsetAt != "" || config.Link != "" {
+				return nil, fmt.Errorf("the sunset date and the link of API version %s require its deprecation date", version)
+			}
+			continue
+		}
+
+		deprecatedAt, err := time.Parse(apiVersionDateLayout, config.DeprecatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("the deprecation date of API version %s (%q) must be a date, e.g. 2027-01-31", version, config.DeprecatedAt)
+		}
+		header := http.Header{"Deprecation": {fmt.Sprintf("@%d", deprecatedAt.Unix())}}
+		if config.SunsetAt != "" {
+			sunsetAt, err := time.Parse(apiVersionDateLayout, config.SunsetAt)
+			if err != nil {
+				return nil, fmt.Errorf("the sunset date of API version %s (%q) must be a date, e.g. 2027-01-31", version, config.SunsetAt)
+			}
+			if sunsetAt.Before(deprecatedAt) {
+				return nil, fmt.Errorf("API version %s can't be sunset before it is deprecated", version)
+			}
+			header.Set("Sunset", sunsetAt.Format(http.TimeFormat))
+		}
+		if config.Link != "" {
+			header.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"; type=\"text/html\"", config.Link))
+		}
+		headers[version] = header
+	}
+	return headers, nil
+}
+
+// versioned gives the requests of handler the version of the HTTP API they were routed by, counting them by
+// version, and answers them with the deprecation headers of the version when it has some
+func versioned(version string, deprecation http.Header, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpAPIVersionRequestsTotal.inc(version)
+		for name, values := range deprecation {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		if deprecation != nil && version != latestAPIVersion {
+			successor := apiPath(latestAPIVersion, strings.TrimPrefix(r.URL.Path, apiPath(version, "")))
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		}
+
+		handler(w, r.WithContext(withAPIVersion(r.Context(), version)))
+	}
+}
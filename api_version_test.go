@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIDeprecationHeaders(t *testing.T) {
+	headers, err := apiDeprecationHeaders(map[string]APIVersionConfig{
+		APIVersion1: {DeprecatedAt: "2026-10-01", SunsetAt: "2027-04-01", Link: "https://example.com/migrating-to-v2"},
+		APIVersion2: {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := headers[APIVersion2]; ok {
+		t.Fatalf("a version without deprecation date shouldn't have been deprecated")
+	}
+	header := headers[APIVersion1]
+	if header.Get("Deprecation") != "@1790812800" || header.Get("Sunset") != "Thu, 01 Apr 2027 00:00:00 GMT" || header.Get("Link") != `<https://example.com/migrating-to-v2>; rel="deprecation"; type="text/html"` {
+		t.Fatalf("the deprecation of v1 should have been told by its headers, got %v", header)
+	}
+
+	invalid := []map[string]APIVersionConfig{
+		{"v0": {DeprecatedAt: "2026-10-01"}},
+		{APIVersion1: {DeprecatedAt: "October 1st"}},
+		{APIVersion1: {SunsetAt: "2027-04-01"}},
+		{APIVersion1: {DeprecatedAt: "2026-10-01", SunsetAt: "2026-09-01"}},
+	}
+	for _, versions := range invalid {
+		if _, err := apiDeprecationHeaders(versions); err == nil {
+			t.Errorf("%v should have been rejected", versions)
+		}
+	}
+}
+
+func TestServeMuxRoutesEveryAPIVersion(t *testing.T) {
+	deprecations, err := apiDeprecationHeaders(map[string]APIVersionConfig{APIVersion1: {DeprecatedAt: "2026-10-01"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newServeMux(deprecations, 0, false)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/keys/team/id/unknown", nil))
+	if recorder.Header().Get("Deprecation") == "" || recorder.Header().Get("Link") != `</api/v2/keys/team/id/unknown>; rel="successor-version"` {
+		t.Fatalf("a request of the deprecated v1 should have been answered with its deprecation, got %v", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v2/keys/team/id/unknown", nil))
+	if recorder.Code != http.StatusNotFound || recorder.Header().Get("Deprecation") != "" {
+		t.Fatalf("the keys of v2 should have been routed without deprecation, got %d: %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestBatchResponseByAPIVersion(t *testing.T) {
+	wrappedDataKeys := map[string]*WrappedDataKey{"id-2": {ID: "id-2", Version: 1, Ciphertexts: map[string]string{"region": "ciphertext"}}}
+	errs := map[string]error{"id-1": IDNotFoundStoreError{ID: "id-1"}}
+	ids := []string{"id-1", "id-2", "id-1"}
+
+	var v1 batchResponse
+	if err := json.Unmarshal([]byte(ConstructBatchWrappedResponse(APIVersion1, ids, wrappedDataKeys, errs)), &v1); err != nil || len(v1.Keys) != 1 || len(v1.Errors) != 1 {
+		t.Fatalf("v1 should have answered the keys and the errors apart, got %+v: %v", v1, err)
+	}
+
+	resp := ConstructBatchWrappedResponse(APIVersion2, ids, wrappedDataKeys, errs)
+	var v2 struct {
+		Results []struct {
+			ID     string          `json:"id"`
+			Status int             `json:"status"`
+			Key    json.RawMessage `json:"key"`
+			Error  *errorResponse  `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(resp), &v2); err != nil || len(v2.Results) != 2 {
+		t.Fatalf("v2 should have answered a result per id, got %s: %v", resp, err)
+	}
+	if v2.Results[0].ID != "id-1" || v2.Results[0].Status != http.StatusNotFound || v2.Results[0].Error == nil || v2.Results[0].Key != nil {
+		t.Fatalf("the error of id-1 should have been its result, got %s", resp)
+	}
+	if v2.Results[1].ID != "id-2" || v2.Results[1].Status != http.StatusOK || !strings.Contains(string(v2.Results[1].Key), `"ciphertexts"`) {
+		t.Fatalf("the key of id-2 should have been its result, got %s", resp)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// the actions of the API which can be put under dual control, see DualControlConfig
+const (
+	ApprovalActionDisable = "disable"
+	ApprovalActionDelete  = "delete"
+	ApprovalActionRewrap  = "rewrap"
+)
+
+var approvalActions = map[string]bool{
+	ApprovalActionDisable: true,
+	ApprovalActionDelete:  true,
+	ApprovalActionRewrap:  true,
+}
+
+// ApprovalRecord is the record the stores persist for an action under dual control until another identity than the
+// one which requested it approves or rejects it: the action, the id it applies to and, for a deletion, its waiting
+// period. ExpiresAt is the unix time the record expires at, the action being requested again after that.
+type ApprovalRecord struct {
+	ApprovalID          string `json:"approval_id"`
+	Action              string `json:"action"`
+	ID                  string `json:"data_key_id"`
+	WaitingPeriodInDays int    `json:"waiting_period_in_days,omitempty"`
+	RequestedBy         string `json:"requested_by"`
+	RequestedAt         int64  `json:"requested_at"`
+	ExpiresAt           int64  `json:"expires_at"`
+}
+
+func (r *ApprovalRecord) expired(now time.Time) bool {
+	return r.ExpiresAt <= now.Unix()
+}
+
+// ApprovalRequiredError is returned for an action under dual control until it is approved, Approval being the
+// pending approval saved for it
+type ApprovalRequiredError struct {
+	Approval *ApprovalRecord
+}
+
+func (e ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("the %s of id %s requires the approval of another identity, approval %s is pending", e.Approval.Action, e.Approval.ID, e.Approval.ApprovalID)
+}
+
+// ApprovalNotFoundError is returned when an approval doesn't exist, or expired, was approved or rejected already
+type ApprovalNotFoundError struct {
+	ApprovalID string
+}
+
+func (e ApprovalNotFoundError) Error() string {
+	return fmt.Sprintf("approval %s not found, it may have expired", e.ApprovalID)
+}
+
+// SelfApprovalError is returned when an identity approves an action it requested itself
+type SelfApprovalError struct {
+	ApprovalID string
+	Identity   string
+}
+
+func (e SelfApprovalError) Error() string {
+	return fmt.Sprintf("approval %s has to be approved by another identity than %s, which requested it", e.ApprovalID, e.Identity)
+}
+
+// ApprovalsNotSupportedError is returned for an action under dual control when the store can't persist the
+// approval records
+type ApprovalsNotSupportedError struct{}
+
+func (e ApprovalsNotSupportedError) Error() string {
+	return "the store does not support the approvals of the actions under dual control"
+}
+
+type approvalContextKey struct{}
+
+// dualControlled tells if the action requires the approval of a second identity for the caller of ctx
+func dualControlled(ctx context.Context, action string) bool {
+	c, ok := ctx.Value(callerContextKey{}).(caller)
+	return ok && c.authenticator.dualControl[action]
+}
+
+// requireApproval returns nil when the action on id can be applied: it isn't under dual control, or it is applied
+// by ApproveAction. Otherwise it saves a pending approval of the action and returns an ApprovalRequiredError.
+func (r *RKMS) requireApproval(ctx context.Context, action string, id string, waitingPeriod time.Duration) error {
+	if !dualControlled(ctx, action) {
+		return nil
+	}
+	if approved, _ := ctx.Value(approvalContextKey{}).(*ApprovalRecord); approved != nil && approved.Action == action && approved.ID == id {
+		return nil
+	}
+
+	//the callers not permitted the action don't get to leave approvals behind
+	if err := authorizeID(ctx, id); err != nil {
+		return err
+	}
+
+	store, ok := r.store.(ApprovalStore)
+	if !ok {
+		return ApprovalsNotSupportedError{}
+	}
+
+	approvalID := make([]byte, 16)
+	if _, err := rand.Read(approvalID); err != nil {
+		return err
+	}
+	c := ctx.Value(callerContextKey{}).(caller)
+	now := time.Now()
+	record := &ApprovalRecord{
+		ApprovalID:          hex.EncodeToString(approvalID),
+		Action:              action,
+		ID:                  id,
+		WaitingPeriodInDays: int(waitingPeriod / (24 * time.Hour)),
+		RequestedBy:         c.identity,
+		RequestedAt:         now.Unix(),
+		ExpiresAt:           now.Add(c.authenticator.approvalWindow).Unix(),
+	}
+	if err := store.SetApprovalRecord(ctx, record); err != nil {
+		contextLogger(ctx).Errorf("failed to save the approval record: %s", err)
+		return err
+	}
+
+	contextLogger(ctx).WithField("approval", record.ApprovalID).Infof("the %s requires the approval of another identity", action)
+	return ApprovalRequiredError{Approval: record}
+}
+
+// ListApprovals returns the pending approvals of the ids the caller of ctx is permitted its operation on, the
+// oldest first
+func (r *RKMS) ListApprovals(ctx context.Context) ([]*ApprovalRecord, error) {
+	store, ok := r.store.(ApprovalStore)
+	if !ok {
+		return nil, ApprovalsNotSupportedError{}
+	}
+
+	records, err := store.ListApprovalRecords(ctx)
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to list the approval records: %s", err)
+		return nil, err
+	}
+
+	approvals := make([]*ApprovalRecord, 0, len(records))
+	for _, record := range records {
+		if authorizeID(ctx, record.ID) == nil {
+			approvals = append(approvals, record)
+		}
+	}
+	sort.Slice(approvals, func(i, j int) bool { return approvals[i].RequestedAt < approvals[j].RequestedAt })
+	return approvals, nil
+}
+
+// ApproveAction applies the action of the given pending approval with the caller of ctx, which has to be another
+// identity than the one which requested it, permitted the action on its id. The approval is dropped before the
+// action is applied, for it to be applied once.
+func (r *RKMS) ApproveAction(ctx context.Context, approvalID string) (*KeyMetadata, error) {
+	record, err := r.takeApproval(ctx, approvalID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = withLogID(ctx, record.ID)
+	contextLogger(ctx).WithField("approval", approvalID).Infof("approved the %s requested by %s", record.Action, record.RequestedBy)
+	ctx = context.WithValue(ctx, approvalContextKey{}, record)
+	switch record.Action {
+	case ApprovalActionDisable:
+		return r.DisableKey(ctx, record.ID)
+	case ApprovalActionDelete:
+		return r.ScheduleKeyDeletion(ctx, record.ID, time.Duration(record.WaitingPeriodInDays)*24*time.Hour)
+	case ApprovalActionRewrap:
+		return r.RewrapKey(ctx, record.ID)
+	}
+	return nil, fmt.Errorf("approval %s is of an unknown action %q", approvalID, record.Action)
+}
+
+// RejectAction drops the given pending approval without applying its action, the identity which requested it being
+// able to withdraw it too
+func (r *RKMS) RejectAction(ctx context.Context, approvalID string) error {
+	record, err := r.takeApproval(ctx, approvalID, false)
+	if err != nil {
+		return err
+	}
+
+	contextLogger(withLogID(ctx, record.ID)).WithField("approval", approvalID).Infof("rejected the %s requested by %s", record.Action, record.RequestedBy)
+	return nil
+}
+
+// takeApproval drops the given pending approval from the store for the caller of ctx and returns it, failing when
+// the caller isn't permitted its id, or requested it itself and approves it
+func (r *RKMS) takeApproval(ctx context.Context, approvalID string, approve bool) (*ApprovalRecord, error) {
+	store, ok := r.store.(ApprovalStore)
+	if !ok {
+		return nil, ApprovalsNotSupportedError{}
+	}
+
+	record, err := store.GetApprovalRecord(ctx, approvalID)
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to read the approval record: %s", err)
+		return nil, err
+	}
+	if record == nil {
+		return nil, ApprovalNotFoundError{ApprovalID: approvalID}
+	}
+
+	if err := authorizeID(ctx, record.ID); err != nil {
+		return nil, err
+	}
+	if identity := identityFromContext(ctx); approve && identity == record.RequestedBy {
+		return nil, SelfApprovalError{ApprovalID: approvalID, Identity: identity}
+	}
+
+	err = store.DeleteApprovalRecord(ctx, approvalID)
+	if _, ok := err.(IDNotFoundStoreError); ok {
+		//approved or rejected by another request in the meantime
+		return nil, ApprovalNotFoundError{ApprovalID: approvalID}
+	}
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to delete the approval record: %s", err)
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type approvalResponse struct {
+	ApprovalID          string `json:"approval_id"`
+	Action              string `json:"action"`
+	ID                  string `json:"id"`
+	WaitingPeriodInDays int    `json:"waiting_period_in_days,omitempty"`
+	RequestedBy         string `json:"requested_by"`
+	RequestedAt         int64  `json:"requested_at"`
+	ExpiresAt           int64  `json:"expires_at"`
+}
+
+type listApprovalsResponse struct {
+	Approvals []approvalResponse `json:"approvals"`
+}
+
+func newApprovalResponse(record *ApprovalRecord) approvalResponse {
+	return approvalResponse{record.ApprovalID, record.Action, record.ID, record.WaitingPeriodInDays, record.RequestedBy, record.RequestedAt, record.ExpiresAt}
+}
+
+// ConstructApprovalResponse creates a server response for the actions under dual control waiting for their
+// approval, requested_at and expires_at being unix times
+func ConstructApprovalResponse(record *ApprovalRecord) string {
+	b, _ := json.Marshal(newApprovalResponse(record))
+	return string(b)
+}
+
+// ConstructListApprovalsResponse creates a server response for GET /approvals endpoint
+func ConstructListApprovalsResponse(records []*ApprovalRecord) string {
+	resp := listApprovalsResponse{Approvals: make([]approvalResponse, 0, len(records))}
+	for _, record := range records {
+		resp.Approvals = append(resp.Approvals, newApprovalResponse(record))
+	}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
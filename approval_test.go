@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func getTestDualControlAuthenticator(t *testing.T) *Authenticator {
+	a, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{
+			{Identity: "alice", KeySHA256: apiKeySHA256("alice-secret")},
+			{Identity: "bob", KeySHA256: apiKeySHA256("bob-secret")},
+			{Identity: "billing", KeySHA256: apiKeySHA256("billing-secret")},
+		},
+		DualControl: DualControlConfig{Actions: []string{ApprovalActionDisable, ApprovalActionDelete}, ApprovalWindowInMinutes: 60},
+		Permissions: []PermissionConfig{
+			{Identity: "alice", Operations: []string{OperationAll}},
+			{Identity: "bob", Operations: []string{OperationAll}},
+			{Identity: "billing", Operations: []string{OperationManageKeys}, IDs: []string{"billing/*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	return a
+}
+
+func TestNewAuthenticatorDualControl(t *testing.T) {
+	if _, err := NewAuthenticator(AuthConfig{DualControl: DualControlConfig{Actions: []string{ApprovalActionDelete}}}); err == nil {
+		t.Fatalf("dual control should have required authentication")
+	}
+
+	config := AuthConfig{
+		APIKeys:     []APIKeyConfig{{Identity: "alice", KeySHA256: apiKeySHA256("secret")}},
+		DualControl: DualControlConfig{Actions: []string{"rotate"}},
+	}
+	if _, err := NewAuthenticator(config); err == nil {
+		t.Fatalf("an unknown dual control action should have been rejected")
+	}
+}
+
+func TestDualControl(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	a := getTestDualControlAuthenticator(t)
+	alice := withCaller(context.Background(), a, "alice", OperationManageKeys)
+	bob := withCaller(context.Background(), a, "bob", OperationManageKeys)
+	if _, err := r.CreateDataKey(alice, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	_, err := r.ScheduleKeyDeletion(alice, "id", 7*24*time.Hour)
+	pending, ok := err.(ApprovalRequiredError)
+	if !ok || pending.Approval.RequestedBy != "alice" || pending.Approval.WaitingPeriodInDays != 7 {
+		t.Fatalf("the deletion should have waited for an approval, got %v", err)
+	}
+	if metadata, err := r.GetKeyMetadata(alice, "id"); err != nil || metadata.State != KeyStateEnabled {
+		t.Fatalf("the deletion shouldn't have been scheduled before its approval, got %+v: %v", metadata, err)
+	}
+
+	if approvals, err := r.ListApprovals(bob); err != nil || len(approvals) != 1 || approvals[0].ApprovalID != pending.Approval.ApprovalID {
+		t.Fatalf("the pending approval should have been listed, got %v: %v", approvals, err)
+	}
+	if approvals, err := r.ListApprovals(withCaller(context.Background(), a, "billing", OperationManageKeys)); err != nil || len(approvals) != 0 {
+		t.Fatalf("the approvals of the ids the caller isn't permitted shouldn't have been listed, got %v: %v", approvals, err)
+	}
+
+	if _, err := r.ApproveAction(alice, pending.Approval.ApprovalID); err == nil {
+		t.Fatalf("the identity which requested the deletion shouldn't have approved it")
+	} else if _, ok := err.(SelfApprovalError); !ok {
+		t.Fatalf("the approval should have failed with SelfApprovalError, got %v", err)
+	}
+
+	metadata, err := r.ApproveAction(bob, pending.Approval.ApprovalID)
+	if err != nil || metadata.State != KeyStatePendingDeletion || time.Until(metadata.DeletionDate) < 6*24*time.Hour {
+		t.Fatalf("the approved deletion should have been scheduled with its waiting period, got %+v: %v", metadata, err)
+	}
+	if _, err := r.ApproveAction(bob, pending.Approval.ApprovalID); err == nil {
+		t.Fatalf("an approval should only have been applied once")
+	} else if _, ok := err.(ApprovalNotFoundError); !ok {
+		t.Fatalf("an applied approval should have failed with ApprovalNotFoundError, got %v", err)
+	}
+
+	if _, err := r.CancelKeyDeletion(alice, "id"); err != nil {
+		t.Fatalf("the actions which aren't under dual control should have been applied right away: %s", err)
+	}
+	if _, err := r.RewrapKey(alice, "id"); err != nil {
+		t.Fatalf("rewrapping isn't under dual control, it should have been applied right away: %s", err)
+	}
+
+	_, err = r.DisableKey(alice, "id")
+	if pending, ok = err.(ApprovalRequiredError); !ok {
+		t.Fatalf("disabling should have waited for an approval, got %v", err)
+	}
+	if err := r.RejectAction(alice, pending.Approval.ApprovalID); err != nil {
+		t.Fatalf("the identity which requested an action should have withdrawn it: %s", err)
+	}
+	if _, err := r.ApproveAction(bob, pending.Approval.ApprovalID); err == nil {
+		t.Fatalf("a rejected approval shouldn't have been approved")
+	}
+
+	if _, err := r.DisableKey(withCaller(context.Background(), a, "billing", OperationManageKeys), "id"); err == nil {
+		t.Fatalf("a caller not permitted the id shouldn't have left an approval")
+	} else if _, ok := err.(IDNotPermittedError); !ok {
+		t.Fatalf("the request should have failed with IDNotPermittedError, got %v", err)
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	a := getTestDualControlAuthenticator(t)
+	a.approvalWindow = -time.Second
+	alice := withCaller(context.Background(), a, "alice", OperationManageKeys)
+
+	_, err := r.DisableKey(alice, "id")
+	pending, ok := err.(ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("disabling should have waited for an approval, got %v", err)
+	}
+	if _, err := r.ApproveAction(withCaller(context.Background(), a, "bob", OperationManageKeys), pending.Approval.ApprovalID); err == nil {
+		t.Fatalf("an expired approval shouldn't have been approved")
+	}
+
+	r.store = &countingStore{Store: r.store}
+	if _, err := r.DisableKey(alice, "id"); err == nil {
+		t.Fatalf("dual control should have failed without a store for the approvals")
+	} else if _, ok := err.(ApprovalsNotSupportedError); !ok {
+		t.Fatalf("the request should have failed with ApprovalsNotSupportedError, got %v", err)
+	}
+}
+
+func TestApprovalIDsAreReserved(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	id := dynamoDBApprovalRecordPrefix + "0123"
+
+	if _, err := r.CreateDataKey(context.Background(), id, 0, nil); err != (ReservedIDError{ID: id, Prefix: dynamoDBApprovalRecordPrefix}) {
+		t.Fatalf("the data key of an id of the approval records shouldn't have been created, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// the name of the sessions of the roles rkms assumes for the regions of KMS and DynamoDB, which CloudTrail shows
+// for the calls made with them
+const assumedRoleSessionName = "rkms"
+
+// assumedRoleExpiryWindow is how long before they expire the credentials of the assumed roles are refreshed, for
+// no call to be signed with credentials expiring on its way
+const assumedRoleExpiryWindow = time.Minute
+
+// assumeRole returns a copy of awsConfig whose clients are authenticated with the credentials of the given role,
+// assumed with the credentials of awsConfig, cached and refreshed before they expire; awsConfig itself when roleARN is
+// empty
+func assumeRole(awsConfig aws.Config, roleARN string) aws.Config {
+	if roleARN == "" {
+		return awsConfig
+	}
+
+	assumed := awsConfig.Copy()
+	assumed.Credentials = aws.NewCredentialsCache(newAssumeRoleProvider(awsConfig, roleARN, assumedRoleSessionName), func(options *aws.CredentialsCacheOptions) {
+		options.ExpiryWindow = assumedRoleExpiryWindow
+	})
+	return assumed
+}
+
+// newAssumeRoleProvider returns the provider of the credentials of the given role, assumed in a session of the given
+// name with the credentials of awsConfig. STS is called on its own endpoint rather than the one configured for the
+// service, with the retries of the SDK as the credentials are shared by every call of the region.
+func newAssumeRoleProvider(awsConfig aws.Config, roleARN string, sessionName string) *stscreds.AssumeRoleProvider {
+	client := sts.NewFromConfig(awsConfig, func(options *sts.Options) {
+		options.BaseEndpoint = nil
+		options.Retryer = retry.NewStandard(func(options *retry.StandardOptions) {
+			options.MaxAttempts = 4
+		})
+	})
+	return stscreds.NewAssumeRoleProvider(client, roleARN, func(options *stscreds.AssumeRoleOptions) {
+		options.RoleSessionName = sessionName
+	})
+}
+
+// verifyRoleARNs checks that the roles to assume are IAM role ARNs, for regions of the given regions
+func verifyRoleARNs(roleARNs map[string]string, regions []string) error {
+	known := make(map[string]bool, len(regions))
+	for _, region := range regions {
+		known[region] = true
+	}
+
+	for region, roleARN := range roleARNs {
+		if !known[region] {
+			return fmt.Errorf("region %s has a role in role_arns but isn't one of the regions", region)
+		}
+		if !roleARNPattern.MatchString(roleARN) {
+			return fmt.Errorf("the role of region %s, %q, isn't the ARN of an IAM role", region, roleARN)
+		}
+	}
+	return nil
+}
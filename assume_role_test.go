@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+func TestAssumeRole(t *testing.T) {
+	awsConfig, err := loadAWSConfig("us-east-1", config.WithBaseEndpoint("http://localhost:8000"))
+	if err != nil {
+		t.Fatalf("failed to load the AWS config: %s", err)
+	}
+
+	if assumeRole(awsConfig, "").Credentials != awsConfig.Credentials {
+		t.Fatalf("the config should have been kept as is without a role")
+	}
+
+	assumed := assumeRole(awsConfig, "arn:aws:iam::123456789012:role/rkms")
+	if assumed.Credentials == awsConfig.Credentials || aws.ToString(assumed.BaseEndpoint) != "http://localhost:8000" || assumed.Region != "us-east-1" {
+		t.Fatalf("the clients of the config should have had the credentials of the role on the endpoint of the config")
+	}
+}
+
+func TestKeySetRoles(t *testing.T) {
+	keyIDs := []string{"alias/rkms-0", "alias/rkms-1", "alias/rkms-2"}
+	kmsConfig := KMSConfig{
+		Regions:  []string{"us-east-1", "us-west-1", "us-west-2"},
+		KeyIds:   map[string]*string{"us-east-1": &keyIDs[0], "us-west-1": &keyIDs[1], "us-west-2": &keyIDs[2]},
+		RoleARNs: map[string]string{"us-east-1": "arn:aws:iam::123456789012:role/rkms"},
+		KeySets: []KeySetConfig{{
+			IDPrefix: "billing/",
+			KeyIds:   map[string]*string{"us-east-1": &keyIDs[0], "us-west-1": &keyIDs[1], "us-west-2": &keyIDs[2]},
+			RoleARNs: map[string]string{"us-west-2": "arn:aws:iam::210987654321:role/rkms-billing"},
+		}},
+	}
+	if err := verifyKMSConfig(kmsConfig); err != nil {
+		t.Fatalf("the roles should have been valid: %s", err)
+	}
+
+	keySets, err := newKeySets(kmsConfig)
+	if err != nil {
+		t.Fatalf("failed to create the key sets: %s", err)
+	}
+	for region, assumed := range map[string]bool{"us-east-1": true, "us-west-1": false, "us-west-2": true} {
+		p := keySets[0].providers[region].(*AWSKMSProvider)
+		if (p.client.(*kms.Client).Options().Credentials != p.awsConfig.Credentials) != assumed {
+			t.Errorf("the key set should have called KMS in %s with the role of the region or its own, or the credentials of rkms", region)
+		}
+	}
+	if len(kmsConfig.RoleARNs) != 1 {
+		t.Fatalf("the roles of the key set shouldn't have changed the ones of the regions")
+	}
+
+	for _, roleARNs := range []map[string]string{
+		{"eu-west-1": "arn:aws:iam::123456789012:role/rkms"},
+		{"us-east-1": "arn:aws:iam::123456789012:user/rkms"},
+	} {
+		kmsConfig.RoleARNs = roleARNs
+		if err := verifyKMSConfig(kmsConfig); err == nil {
+			t.Errorf("the roles %v should have been rejected", roleARNs)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// the operations of the API an identity can be permitted in AuthConfig.Permissions
+const (
+	OperationGetKeys     = "keys:get"
+	OperationDecryptKeys = "keys:decrypt"
+	OperationRotateKeys  = "keys:rotate"
+	OperationManageKeys  = "keys:manage"
+	OperationDeriveKeys  = "keys:derive"
+	OperationEncrypt     = "data:encrypt"
+	OperationDecrypt     = "data:decrypt"
+	OperationGenerateMac = "mac:generate"
+	OperationVerifyMac   = "mac:verify"
+	// OperationCreateGrants permits creating grants of the operations the identity is permitted itself
+	OperationCreateGrants = "grants:create"
+	// OperationAll permits every operation
+	OperationAll = "*"
+)
+
+var operations = map[string]bool{
+	OperationGetKeys:      true,
+	OperationDecryptKeys:  true,
+	OperationRotateKeys:   true,
+	OperationManageKeys:   true,
+	OperationDeriveKeys:   true,
+	OperationEncrypt:      true,
+	OperationDecrypt:      true,
+	OperationGenerateMac:  true,
+	OperationVerifyMac:    true,
+	OperationCreateGrants: true,
+	OperationAll:          true,
+}
+
+// APIKeyHeader is the header a caller gives its API key in
+const APIKeyHeader = "X-API-Key"
+
+// authenticator is nil when the API isn't authenticated
+var authenticator *Authenticator
+
+// AuthenticationError - the credentials of a request are missing or invalid
+type AuthenticationError struct {
+	message string
+}
+
+func (e AuthenticationError) Error() string {
+	return e.message
+}
+
+type apiKey struct {
+	identity string
+	hash     []byte
+}
+
+// Authenticator authenticates the callers of the API by their static API key, JWT bearer token, signed IAM
+// request or grant token, and tells which operations their identity is permitted
+type Authenticator struct {
+	apiKeys []apiKey
+	jwt     *jwtVerifier
+	iam     *iamVerifier
+	grants  *grantSigner
+	// the actions under dual control, and how long their approvals are pending for
+	dualControl    map[string]bool
+	approvalWindow time.Duration
+	// the WWW-Authenticate header of the unauthenticated requests
+	challenge   string
+	permissions map[string][]permissionRule
+	// the tenant of every identity of a tenant
+	tenants map[string]string
+	// the identities of the callers of the Unix domain socket, by their peer credentials
+	peers []PeerConfig
+}
+
+// NewAuthenticator returns the authenticator of the given config, nil when it configures neither API keys, a JWKS
+// URL, IAM authentication nor peers
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if len(config.APIKeys) == 0 && config.JWT.JWKSURL == "" && !config.IAM.Enabled && len(config.Peers) == 0 {
+		if config.Grants.SigningKeyID != "" {
+			return nil, errors.New("grants require API keys, a JWKS URL, IAM authentication or peers, for their grantors to be authenticated")
+		}
+		if len(config.DualControl.Actions) > 0 {
+			return nil, errors.New("dual control requires API keys, a JWKS URL, IAM authentication or peers, to tell the identities apart")
+		}
+		return nil, nil
+	}
+
+	a := &Authenticator{permissions: make(map[string][]permissionRule), challenge: "Bearer"}
+	for _, key := range config.APIKeys {
+		hash, err := hex.DecodeString(key.KeySHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("the API key of %q must be the hexadecimal SHA-256 hash of the key", key.Identity)
+		}
+		if key.Identity == "" {
+			return nil, errors.New("an API key has no identity")
+		}
+		a.apiKeys = append(a.apiKeys, apiKey{key.Identity, hash})
+	}
+
+	for _, peer := range config.Peers {
+		if peer.Identity == "" {
+			return nil, errors.New("a peer has no identity")
+		}
+		if peer.UID == nil && peer.GID == nil {
+			return nil, fmt.Errorf("the peer %q needs a uid or a gid", peer.Identity)
+		}
+		a.peers = append(a.peers, peer)
+	}
+
+	if config.JWT.JWKSURL != "" {
+		a.jwt = newJWTVerifier(config.JWT)
+	}
+
+	if config.IAM.Enabled {
+		a.iam = newIAMVerifier(config.IAM)
+		a.challenge = "Bearer, " + IAMAuthScheme
+	}
+
+	if config.Grants.SigningKeyID != "" {
+		grants, err := newGrantSigner(config.Grants)
+		if err != nil {
+			return nil, err
+		}
+		a.grants = grants
+		a.challenge += ", " + GrantAuthScheme
+	}
+
+	a.dualControl = make(map[string]bool, len(config.DualControl.Actions))
+	for _, action := range config.DualControl.Actions {
+		if !approvalActions[action] {
+			return nil, fmt.Errorf("unknown dual control action %q, the actions are disable, delete and rewrap", action)
+		}
+		a.dualControl[action] = true
+	}
+	a.approvalWindow = time.Duration(config.DualControl.ApprovalWindowInMinutes) * time.Minute
+
+	for _, permission := range config.Permissions {
+		rule := permissionRule{operations: make(map[string]bool), ids: permission.IDs}
+		for _, operation := range permission.Operations {
+			if !operations[operation] {
+				return nil, fmt.Errorf("unknown operation %q permitted to %q", operation, permission.Identity)
+			}
+			rule.operations[operation] = true
+		}
+		a.permissions[permission.Identity] = append(a.permissions[permission.Identity], rule)
+	}
+	return a, nil
+}
+
+// Authenticate returns the identity of the caller of the given credentials: the value of its X-API-Key header,
+// and of its Authorization header
+func (a *Authenticator) Authenticate(ctx context.Context, key string, authorization string) (string, error) {
+	if key != "" {
+		hash := sha256.Sum256([]byte(key))
+		identity := ""
+		//every key is compared, in constant time, not to tell which ones are close through the response time
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare(hash[:], k.hash) == 1 {
+				identity = k.identity
+			}
+		}
+		if identity == "" {
+			return "", AuthenticationError{"invalid API key"}
+		}
+		return identity, nil
+	}
+
+	if authorization == "" {
+		return "", AuthenticationError{"an API key or an Authorization header is required"}
+	}
+
+	var identity string
+	var err error
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	switch {
+	case scheme == "Bearer" && a.jwt != nil:
+		identity, err = a.jwt.verify(ctx, credentials)
+	case scheme == IAMAuthScheme && a.iam != nil:
+		identity, err = a.iam.verify(ctx, credentials)
+	default:
+		return "", AuthenticationError{fmt.Sprintf("the %s authorization scheme isn't accepted", scheme)}
+	}
+	if err != nil {
+		return "", AuthenticationError{err.Error()}
+	}
+	return identity, nil
+}
+
+// authenticatePeer returns the identity of the first peer matching the given credentials of a caller of the Unix
+// domain socket
+func (a *Authenticator) authenticatePeer(credentials *peerCredentials) (string, error) {
+	for _, peer := range a.peers {
+		if (peer.UID == nil || *peer.UID == credentials.UID) && (peer.GID == nil || *peer.GID == credentials.GID) {
+			return peer.Identity, nil
+		}
+	}
+	return "", AuthenticationError{fmt.Sprintf("no peer matches uid %d and gid %d", credentials.UID, credentials.GID)}
+}
+
+// Permitted tells if the given identity is permitted the given operation, on some ids at least
+func (a *Authenticator) Permitted(identity string, operation string) bool {
+	for _, rule := range a.permissions[identity] {
+		if rule.permits(operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermittedID tells if the given identity is permitted the given operation on id. An empty id stands for the
+// operations on no id in particular, such as decrypting an AWS Encryption SDK message, which only the rules
+// without ids permit.
+func (a *Authenticator) PermittedID(identity string, operation string, id string) bool {
+	for _, rule := range a.permissions[identity] {
+		if rule.permits(operation) && rule.permitsID(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// caller - the authenticated caller of a request, its tenant if any, and the operation it requested. The caller of
+// a grant token is its grantor, only permitted the operations of the grant.
+type caller struct {
+	authenticator *Authenticator
+	identity      string
+	tenant        string
+	operation     string
+	grant         *Grant
+}
+
+// permitted tells if the caller is permitted its operation, on some ids at least
+func (c caller) permitted() bool {
+	if c.grant != nil && !c.grant.permits(c.operation) {
+		return false
+	}
+	return c.authenticator.Permitted(c.identity, c.operation)
+}
+
+type callerContextKey struct{}
+
+// withCaller returns a copy of ctx carrying the authenticated identity of its caller, its tenant and the operation
+// it requested, the identity and the tenant being logged as the identity and tenant fields
+func withCaller(ctx context.Context, a *Authenticator, identity string, operation string) context.Context {
+	fields := logger.Fields{"identity": identity}
+	tenant := a.tenants[identity]
+	if tenant != "" {
+		fields["tenant"] = tenant
+	}
+	ctx = withLogFields(ctx, fields)
+	return context.WithValue(ctx, callerContextKey{}, caller{a, identity, tenant, operation, nil})
+}
+
+// withGrantCaller is withCaller for the grantor of the given grant, its id being logged as the grant field
+func withGrantCaller(ctx context.Context, a *Authenticator, grant *Grant, operation string) context.Context {
+	ctx = withCaller(withLogFields(ctx, logger.Fields{"grant": grant.ID}), a, grant.Grantor, operation)
+	c := ctx.Value(callerContextKey{}).(caller)
+	c.grant = grant
+	return context.WithValue(ctx, callerContextKey{}, c)
+}
+
+// authenticateCaller returns a copy of ctx carrying the caller of the given credentials, see Authenticate, and the
+// operation it requested, the grant tokens being accepted in the Authorization header as well. The callers of the
+// Unix domain socket giving no credentials are authenticated by their peer credentials.
+func (a *Authenticator) authenticateCaller(ctx context.Context, key string, authorization string, operation string) (context.Context, error) {
+	if credentials := peerCredentialsFromContext(ctx); credentials != nil && key == "" && authorization == "" && len(a.peers) > 0 {
+		identity, err := a.authenticatePeer(credentials)
+		if err != nil {
+			return ctx, err
+		}
+		return withCaller(ctx, a, identity, operation), nil
+	}
+
+	if scheme, token, _ := strings.Cut(authorization, " "); key == "" && scheme == GrantAuthScheme && a.grants != nil {
+		grant, err := a.grants.verify(token)
+		if err != nil {
+			return ctx, AuthenticationError{err.Error()}
+		}
+		return withGrantCaller(ctx, a, grant, operation), nil
+	}
+
+	identity, err := a.Authenticate(ctx, key, authorization)
+	if err != nil {
+		return ctx, err
+	}
+	return withCaller(ctx, a, identity, operation), nil
+}
+
+// identityFromContext returns the authenticated identity of the caller of ctx, an empty string when the API isn't
+// authenticated
+func identityFromContext(ctx context.Context) string {
+	c, _ := ctx.Value(callerContextKey{}).(caller)
+	return c.identity
+}
+
+// tenantFromContext returns the tenant of the caller of ctx, an empty string when it doesn't belong to one
+func tenantFromContext(ctx context.Context) string {
+	c, _ := ctx.Value(callerContextKey{}).(caller)
+	return c.tenant
+}
+
+// authorize only lets the callers permitted the given operation through to handler, when the API is authenticated
+func authorize(operation string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			handler(w, r)
+			return
+		}
+
+		ctx, err := authenticator.authenticateCaller(r.Context(), r.Header.Get(APIKeyHeader), r.Header.Get("Authorization"), operation)
+		if err != nil {
+			contextLogger(r.Context()).WithField("operation", operation).Warnf("unauthenticated request: %s", err)
+			w.Header().Set("WWW-Authenticate", authenticator.challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			resp := ConstructErrorResponse("Unauthorized", err.Error())
+			fmt.Fprintln(w, resp)
+			return
+		}
+
+		if c := ctx.Value(callerContextKey{}).(caller); !c.permitted() {
+			contextLogger(ctx).WithField("operation", operation).Warn("forbidden request")
+			w.WriteHeader(http.StatusForbidden)
+			resp := ConstructErrorResponse("Forbidden", fmt.Sprintf("%s is not permitted %s", c.identity, operation))
+			fmt.Fprintln(w, resp)
+			return
+		}
+
+		handler(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func apiKeySHA256(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	if a, err := NewAuthenticator(AuthConfig{}); a != nil || err != nil {
+		t.Fatalf("the API shouldn't be authenticated without API keys nor JWKS URL, got %v, %v", a, err)
+	}
+
+	if _, err := NewAuthenticator(AuthConfig{APIKeys: []APIKeyConfig{{Identity: "billing", KeySHA256: "secret"}}}); err == nil {
+		t.Fatalf("an API key which isn't a SHA-256 hash should have been rejected")
+	}
+
+	config := AuthConfig{
+		APIKeys:     []APIKeyConfig{{Identity: "billing", KeySHA256: apiKeySHA256("secret")}},
+		Permissions: []PermissionConfig{{Identity: "billing", Operations: []string{"keys:create"}}},
+	}
+	if _, err := NewAuthenticator(config); err == nil {
+		t.Fatalf("an unknown operation should have been rejected")
+	}
+}
+
+func TestAuthenticatorAPIKeys(t *testing.T) {
+	a, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{
+			{Identity: "billing", KeySHA256: apiKeySHA256("billing-secret")},
+			{Identity: "admin", KeySHA256: apiKeySHA256("admin-secret")},
+		},
+		Permissions: []PermissionConfig{
+			{Identity: "billing", Operations: []string{OperationGetKeys, OperationDecrypt}},
+			{Identity: "admin", Operations: []string{OperationAll}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	ctx := context.Background()
+
+	if identity, err := a.Authenticate(ctx, "billing-secret", ""); err != nil || identity != "billing" {
+		t.Fatalf("the API key of billing should have been authenticated, got %q, %v", identity, err)
+	}
+
+	if _, err := a.Authenticate(ctx, "other-secret", ""); err == nil {
+		t.Fatalf("an unknown API key shouldn't have been authenticated")
+	}
+
+	if _, err := a.Authenticate(ctx, "", "Bearer token"); err == nil {
+		t.Fatalf("a bearer token shouldn't have been authenticated without a JWKS URL")
+	}
+
+	if !a.Permitted("billing", OperationGetKeys) || a.Permitted("billing", OperationRotateKeys) {
+		t.Fatalf("billing should only be permitted its operations")
+	}
+
+	if !a.Permitted("admin", OperationRotateKeys) || a.Permitted("nobody", OperationGetKeys) {
+		t.Fatalf("admin should be permitted every operation, identities without permissions none")
+	}
+}
+
+func TestAuthenticatorJWT(t *testing.T) {
+	jwks := newTestJWKS(t)
+	a, err := NewAuthenticator(AuthConfig{JWT: JWTConfig{JWKSURL: jwks.server.URL, Audience: "rkms"}})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+
+	token := jwks.sign(t, "ES256", "ec", testClaims("payments"))
+	if identity, err := a.Authenticate(context.Background(), "", "Bearer "+token); err != nil || identity != "payments" {
+		t.Fatalf("the token should have been authenticated, got %q, %v", identity, err)
+	}
+
+	if _, err := a.Authenticate(context.Background(), "", token); err == nil {
+		t.Fatalf("a token without the Bearer scheme shouldn't have been authenticated")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer func() { authenticator = nil }()
+	var err error
+	authenticator, err = NewAuthenticator(AuthConfig{
+		APIKeys:     []APIKeyConfig{{Identity: "billing", KeySHA256: apiKeySHA256("billing-secret")}},
+		Permissions: []PermissionConfig{{Identity: "billing", Operations: []string{OperationGetKeys}}},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+
+	var identity string
+	handler := func(operation string) func(http.ResponseWriter, *http.Request) {
+		return authorize(operation, func(w http.ResponseWriter, r *http.Request) {
+			identity = identityFromContext(r.Context())
+		})
+	}
+
+	tests := []struct {
+		operation string
+		key       string
+		status    int
+	}{
+		{OperationGetKeys, "billing-secret", http.StatusOK},
+		{OperationRotateKeys, "billing-secret", http.StatusForbidden},
+		{OperationGetKeys, "", http.StatusUnauthorized},
+		{OperationGetKeys, "other-secret", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		identity = ""
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/key?id=1", nil)
+		if test.key != "" {
+			r.Header.Set(APIKeyHeader, test.key)
+		}
+		w := httptest.NewRecorder()
+		handler(test.operation)(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s with key %q: expected %d, got %d", test.operation, test.key, test.status, w.Code)
+		}
+		if (test.status == http.StatusOK) != (identity == "billing") {
+			t.Errorf("%s with key %q: the handler should only be called for permitted callers", test.operation, test.key)
+		}
+		if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s with key %q: the authentication scheme should have been returned", test.operation, test.key)
+		}
+	}
+
+	authenticator = nil
+	w := httptest.NewRecorder()
+	handler(OperationRotateKeys)(w, httptest.NewRequest(http.MethodPost, "/api/v1/keys/1/rotate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("every request should be let through when the API isn't authenticated, got %d", w.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// loadAWSConfig loads the configuration of the AWS clients of the given region, with the credentials of the default
+// chain unless options set others. The request id of the context of every call is added to its user agent.
+func loadAWSConfig(region string, options ...func(*config.LoadOptions) error) (aws.Config, error) {
+	options = append([]func(*config.LoadOptions) error{config.WithRegion(region)}, options...)
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	awsConfig.APIOptions = append(awsConfig.APIOptions, addRequestIDToUserAgent)
+	return awsConfig, nil
+}
+
+// withoutRetries makes the clients call once, for the calls retried by RKMS with its own retries
+func withoutRetries(options *config.LoadOptions) error {
+	options.Retryer = func() aws.Retryer {
+		return aws.NopRetryer{}
+	}
+	return nil
+}
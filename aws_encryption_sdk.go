@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the messages are of format version 2, with framed content
+const (
+	esdkMessageFormatVersion  byte = 0x02
+	esdkFramedContentType     byte = 0x02
+	esdkFrameLength                = 4096
+	esdkMessageIDSize              = 32
+	esdkIVSize                     = 12
+	esdkTagSize                    = 16
+	esdkKeySize                    = 32
+	esdkFinalFrameSequenceEnd      = 0xFFFFFFFF
+)
+
+// the committing AES-256-GCM algorithm suites, the only ones the SDKs encrypt with by default.
+// Messages are encrypted without signature, and decrypted with or without.
+const (
+	esdkSuiteCommitKey                  uint16 = 0x0478
+	esdkSuiteCommitKeyECDSAP384         uint16 = 0x0578
+	esdkKMSProviderID                          = "aws-kms"
+	esdkPublicKeyEncryptionContextKey          = "aws-crypto-public-key"
+	esdkReservedEncryptionContextPrefix        = "aws-crypto-"
+	esdkFrameContentAAD                        = "AWSKMSEncryptionClient Frame"
+	esdkFinalFrameContentAAD                   = "AWSKMSEncryptionClient Final Frame"
+)
+
+// esdkEncryptedDataKey - an encrypted data key of a message, e.g. the KMS ciphertext of the data key
+// along with the ARN of the KMS key
+type esdkEncryptedDataKey struct {
+	ProviderID   string
+	ProviderInfo string
+	Ciphertext   []byte
+}
+
+// esdkMessage - a parsed message of the AWS Encryption SDK
+type esdkMessage struct {
+	suite             uint16
+	messageID         []byte
+	encryptionContext EncryptionContext
+	encryptedDataKeys []esdkEncryptedDataKey
+	frameLength       uint32
+	commitKey         []byte
+	// the header body, then its authentication tag
+	header []byte
+	tag    []byte
+	// the frames and the footer
+	body []byte
+}
+
+// EncryptESDK encrypts plaintext like Encrypt, in the message format of the AWS Encryption SDK: the message
+// can be decrypted by the SDKs with a KMS keyring of any of the AWS KMS regions, the encryption context being
+// the message encryption context.
+func (r *RKMS) EncryptESDK(ctx context.Context, id string, plaintext []byte, encryptionContext EncryptionContext) ([]byte, *DataKey, error) {
+	ctx = withLogID(ctx, id)
+	for key := range encryptionContext {
+		if strings.HasPrefix(key, esdkReservedEncryptionContextPrefix) {
+			return nil, nil, fmt.Errorf("encryption context keys starting with %s are reserved by the AWS Encryption SDK", esdkReservedEncryptionContextPrefix)
+		}
+	}
+
+	dataKey, err := r.GetDataKey(ctx, id, 0, encryptionContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dataKey.Destroy()
+
+	key := dataKey.Plaintext.Bytes()
+	if len(key) != esdkKeySize {
+		return nil, nil, fmt.Errorf("the AWS Encryption SDK needs %d byte data keys, the data key of id %s has %d bytes", esdkKeySize, id, len(key))
+	}
+
+	encryptedDataKeys, _, err := r.getEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	edks, err := r.esdkEncryptedDataKeys(ctx, r.providersFor(id), splitDataKeyVersions(encryptedDataKeys)[dataKey.Version])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message, err := esdkEncryptMessage(esdkSuiteCommitKey, key, encryptionContext, edks, plaintext, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, dataKey, nil
+}
+
+// esdkEncryptedDataKeys lists the ciphertexts of the AWS KMS regions of the given providers, in the order of the regions
+func (r *RKMS) esdkEncryptedDataKeys(ctx context.Context, providers map[string]KeyProvider, encryptedDataKeys map[string]string) ([]esdkEncryptedDataKey, error) {
+	edks := make([]esdkEncryptedDataKey, 0, len(encryptedDataKeys))
+	for _, region := range r.regions {
+		provider, ok := providers[region].(*AWSKMSProvider)
+		if !ok || encryptedDataKeys[region] == "" {
+			continue
+		}
+
+		wrapped, err := parseWrappedKey(encryptedDataKeys[region])
+		if err != nil {
+			regionLogger(ctx, region, "Decrypt").Errorf("ciphertext value is corrupted in the store: %s", err)
+			continue
+		}
+		if wrapped.Threshold > 0 { //a share of the data key doesn't decrypt the message on its own
+			continue
+		}
+
+		arn, err := provider.keyARN(ctx)
+		if err != nil {
+			regionLogger(ctx, region, "DescribeKey").Errorf("failed to get the ARN of the KMS key: %s", err)
+			continue
+		}
+
+		edks = append(edks, esdkEncryptedDataKey{esdkKMSProviderID, arn, wrapped.blob})
+	}
+
+	if len(edks) == 0 {
+		return nil, fmt.Errorf("no AWS KMS region has a ciphertext of the data key")
+	}
+	return edks, nil
+}
+
+// DecryptESDK decrypts a message of the AWS Encryption SDK, whether encrypted by EncryptESDK or by an SDK,
+// with the first of its encrypted data keys that a KMS key of the AWS KMS regions, of any key set, decrypts.
+// The message encryption context has to contain the given one, and is returned along with the plaintext.
+func (r *RKMS) DecryptESDK(ctx context.Context, message []byte, encryptionContext EncryptionContext) ([]byte, EncryptionContext, error) {
+	//the messages aren't bound to an id
+	if err := authorizeID(ctx, ""); err != nil {
+		return nil, nil, err
+	}
+
+	m, err := parseESDKMessage(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key, value := range encryptionContext {
+		if stored, ok := m.encryptionContext[key]; !ok || stored != value {
+			return nil, nil, InvalidCiphertextError{Reason: "the message encryption context does not contain the given encryption context"}
+		}
+	}
+
+	for _, edk := range m.encryptedDataKeys {
+		if edk.ProviderID != esdkKMSProviderID {
+			continue
+		}
+
+		for _, providers := range r.keyProviderSets() {
+			for _, region := range r.regions {
+				provider, ok := providers[region].(*AWSKMSProvider)
+				if !ok {
+					continue
+				}
+
+				if arn, err := provider.keyARN(ctx); err != nil || arn != edk.ProviderInfo {
+					continue
+				}
+
+				start := time.Now()
+				spanCtx, endSpan := startKeyProviderSpan(ctx, region, "Decrypt")
+				var key []byte
+				err := r.retryKeyProvider(spanCtx, region, "Decrypt", func(ctx context.Context) (err error) {
+					key, err = provider.Decrypt(ctx, edk.Ciphertext, m.encryptionContext)
+					return err
+				})
+				endSpan(err)
+				observeKeyProvider(region, "Decrypt", start, err)
+				if err != nil {
+					regionLogger(ctx, region, "Decrypt").Infof("failed to decrypt the data key of the message: %s", err)
+					continue
+				}
+
+				plaintext, err := m.decrypt(key)
+				zeroBytes(key)
+				if err != nil {
+					return nil, nil, err
+				}
+				delete(m.encryptionContext, esdkPublicKeyEncryptionContextKey)
+				return plaintext, m.encryptionContext, nil
+			}
+		}
+	}
+
+	return nil, nil, InvalidCiphertextError{Reason: "no encrypted data key of the message could be decrypted with the KMS keys of the regions"}
+}
+
+// esdkEncryptMessage serializes a message encrypting plaintext with dataKey, signed by signer for a signing suite
+func esdkEncryptMessage(suite uint16, dataKey []byte, encryptionContext EncryptionContext, edks []esdkEncryptedDataKey, plaintext []byte, signer *ecdsa.PrivateKey) ([]byte, error) {
+	if signer != nil {
+		encryptionContext = copyEncryptionContext(encryptionContext)
+		encryptionContext[esdkPublicKeyEncryptionContextKey] = base64.StdEncoding.EncodeToString(elliptic.MarshalCompressed(elliptic.P384(), signer.X, signer.Y))
+	}
+
+	messageID := make([]byte, esdkMessageIDSize)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, err
+	}
+
+	aead, commitKey, err := esdkDeriveKeys(suite, dataKey, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = append(b, esdkMessageFormatVersion)
+	b = binary.BigEndian.AppendUint16(b, suite)
+	b = append(b, messageID...)
+	aad := esdkSerializeEncryptionContext(encryptionContext)
+	if len(aad) > math.MaxUint16 {
+		return nil, fmt.Errorf("the encryption context is too large for the AWS Encryption SDK")
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(aad)))
+	b = append(b, aad...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(edks)))
+	for _, edk := range edks {
+		b = esdkAppendField(b, []byte(edk.ProviderID))
+		b = esdkAppendField(b, []byte(edk.ProviderInfo))
+		b = esdkAppendField(b, edk.Ciphertext)
+	}
+	b = append(b, esdkFramedContentType)
+	b = binary.BigEndian.AppendUint32(b, esdkFrameLength)
+	b = append(b, commitKey...)
+
+	//the header is authenticated with an empty plaintext and a zero IV
+	b = aead.Seal(b, make([]byte, esdkIVSize), nil, b)
+
+	sequence := uint32(1)
+	for ; len(plaintext) > esdkFrameLength; sequence++ {
+		b = binary.BigEndian.AppendUint32(b, sequence)
+		iv := esdkFrameIV(sequence)
+		b = append(b, iv...)
+		b = aead.Seal(b, iv, plaintext[:esdkFrameLength], esdkFrameAAD(messageID, esdkFrameContentAAD, sequence, esdkFrameLength))
+		plaintext = plaintext[esdkFrameLength:]
+	}
+
+	b = binary.BigEndian.AppendUint32(b, esdkFinalFrameSequenceEnd)
+	b = binary.BigEndian.AppendUint32(b, sequence)
+	iv := esdkFrameIV(sequence)
+	b = append(b, iv...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(plaintext)))
+	b = aead.Seal(b, iv, plaintext, esdkFrameAAD(messageID, esdkFinalFrameContentAAD, sequence, len(plaintext)))
+
+	if signer != nil {
+		digest := sha512.Sum384(b)
+		signature, err := ecdsa.SignASN1(rand.Reader, signer, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		b = esdkAppendField(b, signature)
+	}
+	return b, nil
+}
+
+// parseESDKMessage parses the header of a message, leaving the body to decrypt
+func parseESDKMessage(message []byte) (*esdkMessage, error) {
+	reader := &esdkReader{b: message}
+	m := &esdkMessage{}
+
+	if version := reader.uint8(); version != esdkMessageFormatVersion {
+		return nil, InvalidCiphertextError{Reason: fmt.Sprintf("unsupported message format version %d", version)}
+	}
+
+	m.suite = reader.uint16()
+	if m.suite != esdkSuiteCommitKey && m.suite != esdkSuiteCommitKeyECDSAP384 {
+		return nil, InvalidCiphertextError{Reason: fmt.Sprintf("unsupported algorithm suite 0x%04x", m.suite)}
+	}
+
+	m.messageID = reader.bytes(esdkMessageIDSize)
+	encryptionContext, err := esdkParseEncryptionContext(reader.field())
+	if err != nil {
+		return nil, err
+	}
+	m.encryptionContext = encryptionContext
+
+	count := int(reader.uint16())
+	for i := 0; i < count && reader.err == nil; i++ {
+		edk := esdkEncryptedDataKey{string(reader.field()), string(reader.field()), reader.field()}
+		m.encryptedDataKeys = append(m.encryptedDataKeys, edk)
+	}
+
+	if contentType := reader.uint8(); reader.err == nil && contentType != esdkFramedContentType {
+		return nil, InvalidCiphertextError{Reason: "only framed content is supported"}
+	}
+
+	m.frameLength = reader.uint32()
+	m.commitKey = reader.bytes(esdkKeySize)
+	m.header = message[:reader.offset]
+	m.tag = reader.bytes(esdkTagSize)
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	if m.frameLength == 0 {
+		return nil, InvalidCiphertextError{Reason: "invalid frame length"}
+	}
+
+	m.body = message[reader.offset:]
+	return m, nil
+}
+
+// decrypt authenticates the header and decrypts the frames of the message with its data key,
+// verifying the signature of the footer for a signing suite
+func (m *esdkMessage) decrypt(dataKey []byte) ([]byte, error) {
+	aead, commitKey, err := esdkDeriveKeys(m.suite, dataKey, m.messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(commitKey, m.commitKey) != 1 {
+		return nil, InvalidCiphertextError{Reason: "the key commitment does not match"}
+	}
+
+	if _, err := aead.Open(nil, make([]byte, esdkIVSize), m.tag, m.header); err != nil {
+		return nil, InvalidCiphertextError{Reason: "the header failed authentication"}
+	}
+
+	var plaintext bytes.Buffer
+	reader := &esdkReader{b: m.body}
+	for sequence := uint32(1); ; sequence++ {
+		number := reader.uint32()
+		final := number == esdkFinalFrameSequenceEnd
+		if final {
+			number = reader.uint32()
+		}
+
+		if reader.err != nil {
+			return nil, reader.err
+		}
+
+		if number != sequence {
+			return nil, InvalidCiphertextError{Reason: "the frames are out of sequence"}
+		}
+
+		iv := reader.bytes(esdkIVSize)
+		length, contentAAD := int(m.frameLength), esdkFrameContentAAD
+		if final {
+			length, contentAAD = int(reader.uint32()), esdkFinalFrameContentAAD
+			if length > int(m.frameLength) {
+				return nil, InvalidCiphertextError{Reason: "the final frame is longer than the frame length"}
+			}
+		}
+
+		content := reader.bytes(length + esdkTagSize)
+		if reader.err != nil {
+			return nil, reader.err
+		}
+
+		frame, err := aead.Open(nil, iv, content, esdkFrameAAD(m.messageID, contentAAD, sequence, length))
+		if err != nil {
+			return nil, InvalidCiphertextError{Reason: fmt.Sprintf("frame %d failed authentication", sequence)}
+		}
+		plaintext.Write(frame)
+
+		if final {
+			break
+		}
+
+		if sequence == esdkFinalFrameSequenceEnd-1 {
+			return nil, InvalidCiphertextError{Reason: "too many frames"}
+		}
+	}
+
+	if m.suite == esdkSuiteCommitKeyECDSAP384 {
+		signed := len(m.header) + len(m.tag) + reader.offset
+		if err := m.verifySignature(signed, reader.field()); err != nil || reader.err != nil {
+			return nil, InvalidCiphertextError{Reason: "the signature of the message does not verify"}
+		}
+	}
+
+	if reader.offset != len(m.body) {
+		return nil, InvalidCiphertextError{Reason: "unexpected data after the message"}
+	}
+	return plaintext.Bytes(), nil
+}
+
+// verifySignature verifies the signature of the first signed bytes of the message,
+// with the public key of its encryption context
+func (m *esdkMessage) verifySignature(signed int, signature []byte) error {
+	compressed, err := base64.StdEncoding.DecodeString(m.encryptionContext[esdkPublicKeyEncryptionContextKey])
+	if err != nil {
+		return err
+	}
+
+	x, y := elliptic.UnmarshalCompressed(elliptic.P384(), compressed)
+	if x == nil {
+		return fmt.Errorf("invalid public key")
+	}
+
+	//the header and the body are contiguous in the original message
+	message := make([]byte, 0, signed)
+	message = append(message, m.header...)
+	message = append(message, m.tag...)
+	message = append(message, m.body[:signed-len(m.header)-len(m.tag)]...)
+
+	digest := sha512.Sum384(message)
+	if !ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: elliptic.P384(), X: x, Y: y}, digest[:], signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// esdkDeriveKeys derives the data encryption key and the key commitment of a message from its data key
+func esdkDeriveKeys(suite uint16, dataKey []byte, messageID []byte) (cipher.AEAD, []byte, error) {
+	var suiteID [2]byte
+	binary.BigEndian.PutUint16(suiteID[:], suite)
+
+	encryptionKey, err := hkdf.Key(sha512.New, dataKey, messageID, string(suiteID[:])+"DERIVEKEY", esdkKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commitKey, err := hkdf.Key(sha512.New, dataKey, messageID, "COMMITKEY", esdkKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	return aead, commitKey, err
+}
+
+// esdkFrameIV is the IV of a frame, its sequence number padded to the IV size
+func esdkFrameIV(sequence uint32) []byte {
+	iv := make([]byte, esdkIVSize)
+	binary.BigEndian.PutUint32(iv[esdkIVSize-4:], sequence)
+	return iv
+}
+
+func esdkFrameAAD(messageID []byte, contentAAD string, sequence uint32, length int) []byte {
+	aad := append([]byte{}, messageID...)
+	aad = append(aad, contentAAD...)
+	aad = binary.BigEndian.AppendUint32(aad, sequence)
+	return binary.BigEndian.AppendUint64(aad, uint64(length))
+}
+
+// esdkSerializeEncryptionContext serializes the key/value pairs sorted by key, nothing for an empty context
+func esdkSerializeEncryptionContext(encryptionContext EncryptionContext) []byte {
+	if len(encryptionContext) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(encryptionContext))
+	for key := range encryptionContext {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(keys)))
+	for _, key := range keys {
+		b = esdkAppendField(b, []byte(key))
+		b = esdkAppendField(b, []byte(encryptionContext[key]))
+	}
+	return b
+}
+
+func esdkParseEncryptionContext(aad []byte) (EncryptionContext, error) {
+	encryptionContext := EncryptionContext{}
+	if len(aad) == 0 {
+		return encryptionContext, nil
+	}
+
+	reader := &esdkReader{b: aad}
+	count := int(reader.uint16())
+	for i := 0; i < count && reader.err == nil; i++ {
+		key := string(reader.field())
+		encryptionContext[key] = string(reader.field())
+	}
+
+	if reader.err != nil || reader.offset != len(aad) {
+		return nil, InvalidCiphertextError{Reason: "the encryption context is malformed"}
+	}
+	return encryptionContext, nil
+}
+
+func copyEncryptionContext(encryptionContext EncryptionContext) EncryptionContext {
+	copied := make(EncryptionContext, len(encryptionContext)+1)
+	for key, value := range encryptionContext {
+		copied[key] = value
+	}
+	return copied
+}
+
+// esdkAppendField appends a field prefixed with its length on 2 bytes
+func esdkAppendField(b []byte, field []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(field)))
+	return append(b, field...)
+}
+
+// esdkReader - reads the big endian fields of a message, the first read past its end failing the next ones
+type esdkReader struct {
+	b      []byte
+	offset int
+	err    error
+}
+
+func (r *esdkReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b)-r.offset {
+		r.err = InvalidCiphertextError{Reason: "the message is truncated"}
+		return nil
+	}
+
+	b := r.b[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
+
+func (r *esdkReader) uint8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *esdkReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *esdkReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// field reads a field prefixed with its length on 2 bytes
+func (r *esdkReader) field() []byte {
+	return r.bytes(int(r.uint16()))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// wrappingKMSClient - a KMS client whose ciphertexts are the plaintext with the key id and the encryption context,
+// the encryption context having to match to decrypt
+type wrappingKMSClient struct {
+	kmsAPI
+}
+
+func (c *wrappingKMSClient) GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	plaintext := make([]byte, aws.ToInt32(input.NumberOfBytes))
+	rand.Read(plaintext)
+	output, _ := c.Encrypt(ctx, &kms.EncryptInput{KeyId: input.KeyId, Plaintext: plaintext, EncryptionContext: input.EncryptionContext})
+	return &kms.GenerateDataKeyOutput{KeyId: input.KeyId, Plaintext: plaintext, CiphertextBlob: output.CiphertextBlob}, nil
+}
+
+func (c *wrappingKMSClient) Encrypt(ctx context.Context, input *kms.EncryptInput, opts ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	wrapped := fmt.Sprintf("%s|%v|", aws.ToString(input.KeyId), input.EncryptionContext)
+	return &kms.EncryptOutput{KeyId: input.KeyId, CiphertextBlob: append([]byte(wrapped), input.Plaintext...)}, nil
+}
+
+func (c *wrappingKMSClient) Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	parts := bytes.SplitN(input.CiphertextBlob, []byte("|"), 3)
+	if len(parts) != 3 || string(parts[1]) != fmt.Sprint(input.EncryptionContext) {
+		return nil, fmt.Errorf("InvalidCiphertextException")
+	}
+	keyID := string(parts[0])
+	return &kms.DecryptOutput{KeyId: &keyID, Plaintext: parts[2]}, nil
+}
+
+func getESDKRKMS() *RKMS {
+	regions := []string{"us-east-1", "eu-west-1"}
+	providers := make(map[string]KeyProvider)
+	for _, region := range regions {
+		keyID := "arn:aws:kms:" + region + ":111122223333:key/" + region
+		providers[region] = &AWSKMSProvider{&wrappingKMSClient{}, &keyID, nil, nil}
+	}
+
+	return &RKMS{regions, providers, nil, NewMemoryStore(), esdkKeySize, 0, nil, retryPolicy{}, retryPolicy{}, nil, 0, 0, nil, nil, WrappedKeyFormatBare, 0, 0, nil}
+}
+
+func TestEncryptDecryptESDK(t *testing.T) {
+	r := getESDKRKMS()
+	ctx := context.Background()
+	encryptionContext := EncryptionContext{"tenant": "a"}
+
+	for _, size := range []int{0, 1, esdkFrameLength, 2*esdkFrameLength + 1} {
+		plaintext := bytes.Repeat([]byte{7}, size)
+		message, dataKey, err := r.EncryptESDK(ctx, "id", plaintext, encryptionContext)
+		if err != nil || dataKey.ID != "id" {
+			t.Fatalf("failed to encrypt %d bytes: %v", size, err)
+		}
+
+		if message[0] != esdkMessageFormatVersion || binary.BigEndian.Uint16(message[1:3]) != esdkSuiteCommitKey {
+			t.Fatalf("the message should be of format version 2 with the committing suite, got %x", message[:3])
+		}
+
+		decrypted, messageContext, err := r.DecryptESDK(ctx, message, EncryptionContext{"tenant": "a"})
+		if err != nil || !bytes.Equal(decrypted, plaintext) || !reflect.DeepEqual(messageContext, encryptionContext) {
+			t.Fatalf("failed to decrypt %d bytes: %v", size, err)
+		}
+	}
+
+	message, _, _ := r.EncryptESDK(ctx, "id", []byte("secret"), encryptionContext)
+	if _, _, err := r.DecryptESDK(ctx, message, EncryptionContext{"tenant": "b"}); err == nil {
+		t.Fatalf("decrypting with another encryption context should have failed")
+	}
+
+	tampered := append([]byte{}, message...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := r.DecryptESDK(ctx, tampered, nil); err == nil {
+		t.Fatalf("a tampered message should have failed to decrypt")
+	}
+
+	if _, _, err := r.DecryptESDK(ctx, message[:len(message)-10], nil); err == nil {
+		t.Fatalf("a truncated message should have failed to decrypt")
+	}
+
+	if _, _, err := r.EncryptESDK(ctx, "other", []byte("secret"), EncryptionContext{"aws-crypto-public-key": "a"}); err == nil {
+		t.Fatalf("encrypting with a reserved encryption context key should have failed")
+	}
+}
+
+func TestDecryptSignedESDK(t *testing.T) {
+	r := getESDKRKMS()
+	ctx := context.Background()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the SDKs encrypt the data key with the public key in the encryption context
+	publicKey := base64.StdEncoding.EncodeToString(elliptic.MarshalCompressed(elliptic.P384(), signer.X, signer.Y))
+	kmsEncryptionContext := EncryptionContext{"tenant": "a", esdkPublicKeyEncryptionContextKey: publicKey}
+
+	dataKey := make([]byte, esdkKeySize)
+	rand.Read(dataKey)
+	wrapped, _ := r.providers["eu-west-1"].Encrypt(ctx, dataKey, kmsEncryptionContext)
+	edks := []esdkEncryptedDataKey{
+		{"other-provider", "info", []byte("ciphertext")},
+		{esdkKMSProviderID, "arn:aws:kms:eu-west-1:111122223333:key/eu-west-1", wrapped},
+	}
+
+	message, err := esdkEncryptMessage(esdkSuiteCommitKeyECDSAP384, dataKey, EncryptionContext{"tenant": "a"}, edks, []byte("secret"), signer)
+	if err != nil {
+		t.Fatalf("failed to encrypt a signed message: %s", err)
+	}
+
+	decrypted, messageContext, err := r.DecryptESDK(ctx, message, nil)
+	if err != nil || string(decrypted) != "secret" || !reflect.DeepEqual(messageContext, EncryptionContext{"tenant": "a"}) {
+		t.Fatalf("failed to decrypt a signed message: %v", err)
+	}
+
+	message[len(message)-1] ^= 1
+	if _, _, err := r.DecryptESDK(ctx, message, nil); err == nil {
+		t.Fatalf("a message with an invalid signature should have failed to decrypt")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// maxAssumedRoleClients is the number of roles and session names whose KMS client is kept, with the credentials of
+// the role, for the requests calling KMS on behalf of their caller
+const maxAssumedRoleClients = 1024
+
+// kmsFIPSRegionPattern matches the regions of the commercial and GovCloud partitions, the ones KMS has FIPS endpoints
+// in
+var kmsFIPSRegionPattern = regexp.MustCompile(`^((us|eu|ap|sa|ca|me|af|il|mx)-\w+-\d+|us-gov-\w+-\d+)$`)
+
+// kmsAPI is the subset of the KMS client used by AWSKMSProvider
+type kmsAPI interface {
+	GenerateDataKey(context.Context, *kms.GenerateDataKeyInput, ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Encrypt(context.Context, *kms.EncryptInput, ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(context.Context, *kms.DecryptInput, ...func(*kms.Options)) (*kms.DecryptOutput, error)
+	DescribeKey(context.Context, *kms.DescribeKeyInput, ...func(*kms.Options)) (*kms.DescribeKeyOutput, error)
+}
+
+// AWSKMSProvider - a KeyProvider wrapping data keys with an AWS KMS key, the region being an AWS region
+type AWSKMSProvider struct {
+	client kmsAPI
+	keyID  *string
+
+	// the configuration of the region, with the credentials of rkms rather than the role of the region, the clients
+	// of the roles assumed for the callers of the requests being its clients with their credentials
+	awsConfig   *aws.Config
+	roleClients *lruCache
+}
+
+func init() {
+	RegisterKeyProvider("aws", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		endpoint, err := awsKMSEndpoint(kmsConfig, region)
+		if err != nil {
+			return nil, err
+		}
+		return NewAWSKMSProvider(region, keyID, kmsConfig.RoleARNs[region], endpoint)
+	})
+}
+
+// awsKMSEndpoint returns the endpoint KMS is called on in the given region: the one of the region in the endpoints of
+// kmsConfig, the FIPS endpoint of the region with use_fips_endpoints, "" for the default endpoint of the region
+func awsKMSEndpoint(kmsConfig KMSConfig, region string) (string, error) {
+	if endpoint := kmsConfig.Endpoints[region]; endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return "", fmt.Errorf("the KMS endpoint of region %s, %q, isn't an http(s) URL", region, endpoint)
+		}
+		return endpoint, nil
+	}
+	if !kmsConfig.UseFIPSEndpoints {
+		return "", nil
+	}
+
+	if !kmsFIPSRegionPattern.MatchString(region) {
+		return "", fmt.Errorf("KMS has no FIPS endpoint in region %s", region)
+	}
+	return "https://kms-fips." + region + ".amazonaws.com", nil
+}
+
+// NewAWSKMSProvider creates a new AWSKMSProvider instance for the given key of the given region, calling KMS with
+// the credentials of the given role when it is set, on the given endpoint rather than the one of the region when it
+// is set
+func NewAWSKMSProvider(region string, keyID string, roleARN string, endpoint string) (*AWSKMSProvider, error) {
+	//the calls are retried by RKMS, with the retries of [kms.retry]
+	options := []func(*config.LoadOptions) error{withoutRetries}
+	if endpoint != "" {
+		options = append(options, config.WithBaseEndpoint(endpoint))
+	}
+
+	awsConfig, err := loadAWSConfig(region, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	roleClients := newLRUCache("kms_roles", maxAssumedRoleClients, 0, 0, 0, nil)
+	return &AWSKMSProvider{kms.NewFromConfig(assumeRole(awsConfig, roleARN)), aws.String(keyID), &awsConfig, roleClients}, nil
+}
+
+// attributedClient returns the client the calls of ctx are made with, with the credentials of the role of its
+// KMS attribution, if any, in a session named after its caller, and the grant tokens of its attribution
+func (p *AWSKMSProvider) attributedClient(ctx context.Context) (kmsAPI, []string) {
+	attribution := kmsAttributionFromContext(ctx)
+	if attribution == nil {
+		return p.client, nil
+	}
+
+	grantTokens := attribution.grantTokens
+	if attribution.roleARN == "" || p.awsConfig == nil {
+		return p.client, grantTokens
+	}
+
+	sessionName := roleSessionName(ctx)
+	key := attribution.roleARN + "\x00" + sessionName
+	if client, ok := p.roleClients.Get(key); ok {
+		return client.(kmsAPI), grantTokens
+	}
+
+	//the credentials are refreshed by the client before they expire
+	credentials := aws.NewCredentialsCache(newAssumeRoleProvider(*p.awsConfig, attribution.roleARN, sessionName))
+	client := kms.NewFromConfig(*p.awsConfig, func(options *kms.Options) {
+		options.Credentials = credentials
+	})
+	p.roleClients.Set(key, client, 0)
+	return client, grantTokens
+}
+
+// GenerateDataKey creates a new data key of the given size
+func (p *AWSKMSProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	client, grantTokens := p.attributedClient(ctx)
+	input := &kms.GenerateDataKeyInput{
+		KeyId:             p.keyID,
+		NumberOfBytes:     aws.Int32(int32(sizeInBytes)),
+		EncryptionContext: awsEncryptionContext(encryptionContext),
+		GrantTokens:       grantTokens,
+	}
+
+	result, err := client.GenerateDataKey(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result.Plaintext, result.CiphertextBlob, nil
+}
+
+// Encrypt wraps the given data key
+func (p *AWSKMSProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	client, grantTokens := p.attributedClient(ctx)
+	input := &kms.EncryptInput{
+		KeyId:             p.keyID,
+		Plaintext:         plaintext,
+		EncryptionContext: awsEncryptionContext(encryptionContext),
+		GrantTokens:       grantTokens,
+	}
+
+	result, err := client.Encrypt(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.CiphertextBlob, nil
+}
+
+// Decrypt unwraps the given data key. The key is found in the ciphertext by KMS.
+func (p *AWSKMSProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	client, grantTokens := p.attributedClient(ctx)
+	input := &kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: awsEncryptionContext(encryptionContext),
+		GrantTokens:       grantTokens,
+	}
+
+	result, err := client.Decrypt(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Plaintext, nil
+}
+
+// awsEncryptionContext converts the encryption context to the one of KMS requests, nil when empty
+func awsEncryptionContext(encryptionContext EncryptionContext) map[string]string {
+	if len(encryptionContext) == 0 {
+		return nil
+	}
+	return encryptionContext
+}
+
+// DescribeKey tells about the KMS key
+func (p *AWSKMSProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	result, err := p.client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: p.keyID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyDescription{
+		ID:      aws.ToString(result.KeyMetadata.Arn),
+		Enabled: result.KeyMetadata.Enabled,
+	}, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *AWSKMSProvider) ProviderType() string {
+	return "aws"
+}
+
+// WrappingAlgorithm is the algorithm the symmetric KMS keys wrap with
+func (p *AWSKMSProvider) WrappingAlgorithm() string {
+	return "SYMMETRIC_DEFAULT"
+}
+
+// keyARN returns the ARN of the KMS key, asking KMS for it when the key is configured by id or alias
+func (p *AWSKMSProvider) keyARN(ctx context.Context) (string, error) {
+	keyID := aws.ToString(p.keyID)
+	if strings.HasPrefix(keyID, "arn:") && strings.Contains(keyID, ":key/") {
+		return keyID, nil
+	}
+
+	description, err := p.DescribeKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return description.ID, nil
+}
@@ -0,0 +1,174 @@
+//go:build azurekeyvault
+// +build azurekeyvault
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+// DefaultAzureKeyVaultAlgorithm is the algorithm data keys are wrapped with when none is configured
+const DefaultAzureKeyVaultAlgorithm = azkeys.EncryptionAlgorithmRSAOAEP256
+
+// AzureKeyVaultProvider - a KeyProvider wrapping data keys with a key of an Azure Key Vault or Managed HSM.
+// The key id is the URL of the key (https://<vault>.vault.azure.net/keys/<name>[/<version>]),
+// the region is only a name for it in the redundancy set.
+//
+// Unwrapping needs the version of the key that wrapped, so ciphertexts are the version followed by
+// a colon and the wrapped data key: rotating a versionless key keeps the older data keys readable.
+// Key wrapping has no additional authenticated data, so the encryption context isn't bound to the
+// ciphertexts: it is only enforced by rkms comparing it with the one stored with the data key.
+type AzureKeyVaultProvider struct {
+	client     *azkeys.Client
+	keyName    string
+	keyVersion string
+	algorithm  azkeys.EncryptionAlgorithm
+}
+
+func init() {
+	RegisterKeyProvider("azure", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return NewAzureKeyVaultProvider(keyID, kmsConfig.Azure)
+	})
+}
+
+// NewAzureKeyVaultProvider creates a new AzureKeyVaultProvider instance for the key at the given URL
+func NewAzureKeyVaultProvider(keyURL string, azureConfig AzureKeyVaultConfig) (*AzureKeyVaultProvider, error) {
+	vaultURL, keyName, keyVersion, err := parseAzureKeyURL(keyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var credential azcore.TokenCredential
+	if azureConfig.ClientSecret != "" {
+		credential, err = azidentity.NewClientSecretCredential(azureConfig.TenantID, azureConfig.ClientID, azureConfig.ClientSecret, nil)
+	} else {
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := azkeys.NewClient(vaultURL, credential, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := DefaultAzureKeyVaultAlgorithm
+	if azureConfig.Algorithm != "" {
+		algorithm = azkeys.EncryptionAlgorithm(azureConfig.Algorithm)
+	}
+
+	return &AzureKeyVaultProvider{client, keyName, keyVersion, algorithm}, nil
+}
+
+// parseAzureKeyURL splits the URL of a key into the URL of its vault, its name and its version, if any
+func parseAzureKeyURL(keyURL string) (string, string, string, error) {
+	parsed, err := url.Parse(keyURL)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if parsed.Host == "" || len(segments) < 2 || len(segments) > 3 || segments[0] != "keys" {
+		return "", "", "", fmt.Errorf("%q is not the URL of an Azure Key Vault key", keyURL)
+	}
+
+	keyVersion := ""
+	if len(segments) == 3 {
+		keyVersion = segments[2]
+	}
+
+	return parsed.Scheme + "://" + parsed.Host, segments[1], keyVersion, nil
+}
+
+// GenerateDataKey creates a new data key of the given size.
+// Key Vault doesn't generate data keys, so it is generated locally and wrapped.
+func (p *AzureKeyVaultProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with the configured version of the key, the current one if there is none
+func (p *AzureKeyVaultProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	result, err := p.client.WrapKey(ctx, p.keyName, p.keyVersion, azkeys.KeyOperationParameters{
+		Algorithm: &p.algorithm,
+		Value:     plaintext,
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result.KID == nil {
+		return nil, fmt.Errorf("Azure Key Vault did not tell which version of key %s wrapped the data key", p.keyName)
+	}
+
+	return append([]byte(result.KID.Version()+":"), result.Result...), nil
+}
+
+// Decrypt unwraps the given data key with the version of the key that wrapped it
+func (p *AzureKeyVaultProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	return p.unwrapKey(ctx, p.algorithm, ciphertext)
+}
+
+// DecryptWithAlgorithm unwraps the given data key wrapped with another algorithm, e.g. RSA-OAEP before the
+// algorithm was changed to RSA-OAEP-256
+func (p *AzureKeyVaultProvider) DecryptWithAlgorithm(ctx context.Context, algorithm string, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	return p.unwrapKey(ctx, azkeys.EncryptionAlgorithm(algorithm), ciphertext)
+}
+
+// unwrapKey unwraps the given data key with the version of the key that wrapped it and the given algorithm
+func (p *AzureKeyVaultProvider) unwrapKey(ctx context.Context, algorithm azkeys.EncryptionAlgorithm, ciphertext []byte) ([]byte, error) {
+	separator := bytes.IndexByte(ciphertext, ':')
+	if separator < 0 {
+		return nil, fmt.Errorf("the ciphertext does not start with the version of key %s", p.keyName)
+	}
+
+	result, err := p.client.UnwrapKey(ctx, p.keyName, string(ciphertext[:separator]), azkeys.KeyOperationParameters{
+		Algorithm: &algorithm,
+		Value:     ciphertext[separator+1:],
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Result, nil
+}
+
+// DescribeKey tells about the configured version of the key, the current one if there is none
+func (p *AzureKeyVaultProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	result, err := p.client.GetKey(ctx, p.keyName, p.keyVersion, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	description := &KeyDescription{}
+	if result.Key != nil && result.Key.KID != nil {
+		description.ID = string(*result.Key.KID)
+	}
+
+	if result.Attributes != nil && result.Attributes.Enabled != nil {
+		description.Enabled = *result.Attributes.Enabled
+	}
+
+	return description, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *AzureKeyVaultProvider) ProviderType() string {
+	return "azure"
+}
+
+// WrappingAlgorithm is the algorithm the configured key wrapping algorithm
+func (p *AzureKeyVaultProvider) WrappingAlgorithm() string {
+	return string(p.algorithm)
+}
@@ -0,0 +1,97 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func init() {
+	RegisterExportDestination("s3", newS3ExportWriter)
+	RegisterImportSource("s3", newS3ImportReader)
+}
+
+// s3ExportWriter streams an export to an S3 object with a multipart upload, the object being complete once the
+// writer is closed
+type s3ExportWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// newS3ExportWriter opens the writer of an export to the object of s3://bucket/key, in the region and with the
+// server-side encryption of the [s3] section
+func newS3ExportWriter(ctx context.Context, destination string, config *Configuration) (io.WriteCloser, error) {
+	bucket, key, err := parseS3URL(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig, err := loadAWSConfig(config.S3.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: types.ServerSideEncryption(config.S3.ServerSideEncryption),
+	}
+	if config.S3.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(config.S3.SSEKMSKeyID)
+	}
+
+	reader, writer := io.Pipe()
+	input.Body = reader
+	w := &s3ExportWriter{PipeWriter: writer, done: make(chan error, 1)}
+	go func() {
+		_, err := manager.NewUploader(s3.NewFromConfig(awsConfig)).Upload(ctx, input)
+		reader.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// Close completes the upload of the export, failing if it did
+func (w *s3ExportWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// newS3ImportReader opens the reader of an import from the object of s3://bucket/key, in the region of the [s3]
+// section
+func newS3ImportReader(ctx context.Context, source string, config *Configuration) (io.ReadCloser, error) {
+	bucket, key, err := parseS3URL(source)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig, err := loadAWSConfig(config.S3.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s3.NewFromConfig(awsConfig).GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// parseS3URL returns the bucket and the key of the object of s3://bucket/key
+func parseS3URL(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return "", "", fmt.Errorf("invalid S3 location %q, expected s3://bucket/key", location)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MaxNumberOfBatchIDs is the largest number of ids POST /keys/batch accepts
+const MaxNumberOfBatchIDs = 100
+
+// BatchConcurrency is the number of ids of a batch whose data keys are decrypted or generated at the same time
+const BatchConcurrency = 16
+
+// WrappedDataKey - the ciphertexts of a version of the data key of an id, by region,
+// for the clients that decrypt them with their own access to the key providers
+type WrappedDataKey struct {
+	ID          string
+	Version     int64
+	Ciphertexts map[string]string
+	// the zero time if the key never expires, or if it isn't known
+	ExpiresAt time.Time
+}
+
+// GetDataKeys is GetDataKey for many ids, using the same encryption context: the ids are read from the store
+// in a batch, before their data keys are decrypted, or generated for the missing ones, BatchConcurrency at a time.
+// The data keys and the errors are returned by id.
+func (r *RKMS) GetDataKeys(ctx context.Context, ids []string, encryptionContext EncryptionContext) (map[string]*DataKey, map[string]error) {
+	dataKeys := make(map[string]*DataKey, len(ids))
+	errs := make(map[string]error)
+	var mutex sync.Mutex
+
+	stored := r.getEncryptedDataKeysBatch(ctx, ids)
+	forEachConcurrently(ids, BatchConcurrency, func(id string) {
+		ctx := withLogID(ctx, id)
+		var dataKey *DataKey
+		var err error
+		if encryptedDataKeys, ok := stored[id]; ok {
+			dataKey, err = r.decryptDataKeyVersion(ctx, id, encryptedDataKeys, 0, encryptionContext, time.Time{})
+		} else {
+			dataKey, err = r.GetDataKey(ctx, id, 0, encryptionContext)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errs[id] = err
+			return
+		}
+		dataKeys[id] = dataKey
+	})
+
+	return dataKeys, errs
+}
+
+// GetWrappedDataKeys is GetDataKeys returning the ciphertexts of the data keys rather than decrypting them.
+// The data keys of the missing ids are generated.
+func (r *RKMS) GetWrappedDataKeys(ctx context.Context, ids []string, encryptionContext EncryptionContext) (map[string]*WrappedDataKey, map[string]error) {
+	wrappedDataKeys := make(map[string]*WrappedDataKey, len(ids))
+	errs := make(map[string]error)
+	var mutex sync.Mutex
+
+	stored := r.getEncryptedDataKeysBatch(ctx, ids)
+	forEachConcurrently(ids, BatchConcurrency, func(id string) {
+		var wrappedDataKey *WrappedDataKey
+		var err error
+		if encryptedDataKeys, ok := stored[id]; ok {
+			wrappedDataKey, err = wrapDataKey(id, encryptedDataKeys, 0, encryptionContext, time.Time{})
+		} else {
+			wrappedDataKey, err = r.GetWrappedDataKey(ctx, id, 0, encryptionContext)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errs[id] = err
+			return
+		}
+		wrappedDataKeys[id] = wrappedDataKey
+	})
+
+	return wrappedDataKeys, errs
+}
+
+// GetWrappedDataKey returns the ciphertexts of the latest version of the data key of id without decrypting them,
+// generating the key if there is none like GetDataKey does. The plaintext of an existing key is never read.
+func (r *RKMS) GetWrappedDataKey(ctx context.Context, id string, ttl time.Duration, encryptionContext EncryptionContext) (*WrappedDataKey, error) {
+	ctx = withLogID(ctx, id)
+	for i := 0; i < MaxNumberOfGetPlaintextDataKeyTries; i++ {
+		encryptedDataKeys, expiresAt, err := r.getEncryptedDataKeys(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if encryptedDataKeys != nil {
+			return wrapDataKey(id, encryptedDataKeys, 0, encryptionContext, expiresAt)
+		}
+
+		//the generated key is read back like any other, in case another request generated it first
+		if _, err := r.GetDataKey(ctx, id, ttl, encryptionContext); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, IDNotFoundStoreError{ID: id}
+}
+
+// GetWrappedDataKeyVersion returns the ciphertexts of the given version of the data key of id without decrypting them
+func (r *RKMS) GetWrappedDataKeyVersion(ctx context.Context, id string, version int64, encryptionContext EncryptionContext) (*WrappedDataKey, error) {
+	ctx = withLogID(ctx, id)
+	encryptedDataKeys, expiresAt, err := r.getEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+	return wrapDataKey(id, encryptedDataKeys, version, encryptionContext, expiresAt)
+}
+
+// wrapDataKey picks the ciphertexts of the given version out of the encrypted data keys of id, the latest one for version 0
+func wrapDataKey(id string, encryptedDataKeys map[string]string, version int64, encryptionContext EncryptionContext, expiresAt time.Time) (*WrappedDataKey, error) {
+	if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyState(id, encryptedDataKeys); err != nil {
+		return nil, err
+	}
+
+	versions := splitDataKeyVersions(encryptedDataKeys)
+	if version == 0 {
+		version = latestDataKeyVersion(versions)
+	}
+
+	if _, ok := versions[version]; !ok {
+		return nil, DataKeyVersionNotFoundError{ID: id, Version: version}
+	}
+	//the clients get the ciphertexts of the key providers, e.g. to decrypt them with AWS KMS themselves, which
+	//the shares of a data key can't be on their own
+	ciphertexts := make(map[string]string, len(versions[version]))
+	for region, ciphertext := range versions[version] {
+		if wrapped, err := parseWrappedKey(ciphertext); err == nil && wrapped.Threshold > 0 {
+			continue
+		}
+		ciphertexts[region] = wrappedKeyCiphertext(ciphertext)
+	}
+	if len(ciphertexts) == 0 {
+		return nil, DataKeySplitError{ID: id, Version: version}
+	}
+	return &WrappedDataKey{ID: id, Version: version, Ciphertexts: ciphertexts, ExpiresAt: expiresAt}, nil
+}
+
+// getEncryptedDataKeysBatch reads the encrypted data keys of the ids in a batch, leaving out the missing and
+// deleted ids, and the ones the caller isn't permitted. Nothing is returned if the batch fails, for the ids to be
+// read one by one.
+func (r *RKMS) getEncryptedDataKeysBatch(ctx context.Context, ids []string) map[string]map[string]string {
+	permitted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if authorizeID(ctx, id) == nil {
+			permitted = append(permitted, id)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil
+	}
+	ids = permitted
+
+	//leaves as much time to decrypt the data keys, or to read them one by one
+	budgetCtx, cancel := budgetContext(ctx, 2)
+	defer cancel()
+	storeCtx, endSpan := startSpan(budgetCtx, "store.get_batch", spanAttribute{spanAttributeOperation, "get_batch"})
+	var stored map[string]map[string]string
+	err := r.retryStore(storeCtx, "get_batch", true, func(ctx context.Context) (err error) {
+		stored, err = getEncryptedDataKeysBatch(ctx, r.store, ids)
+		return err
+	})
+	endSpan(err)
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to batch read %d ids, reading them one by one: %s", len(ids), err)
+		return nil
+	}
+	return stored
+}
+
+// forEachConcurrently calls fn for every distinct id, at most concurrency at a time, and waits for them
+func forEachConcurrently(ids []string, concurrency int, fn func(id string)) {
+	semaphore := make(chan struct{}, concurrency)
+	seen := make(map[string]bool, len(ids))
+	var wg sync.WaitGroup
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			fn(id)
+		}(id)
+	}
+
+	wg.Wait()
+}
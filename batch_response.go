@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type batchRequest struct {
+	IDs         []string `json:"ids"`
+	WrappedOnly bool     `json:"wrapped_only"`
+}
+
+type wrappedKeyResponse struct {
+	ID          string            `json:"id"`
+	Version     int64             `json:"version"`
+	Ciphertexts map[string]string `json:"ciphertexts"`
+	ExpiresAt   int64             `json:"expires_at,omitempty"`
+}
+
+type batchErrorResponse struct {
+	ID           string `json:"id"`
+	ErrorType    string `json:"error_type"`
+	ErrorMessage string `json:"error_message"`
+}
+
+type batchResponse struct {
+	Keys   []interface{}        `json:"keys"`
+	Errors []batchErrorResponse `json:"errors"`
+}
+
+// batchResultResponse - the result of an id of POST /keys/batch from API version 2, its key or its error along with
+// the status code it would have been answered with on its own
+type batchResultResponse struct {
+	ID     string         `json:"id"`
+	Status int            `json:"status"`
+	Key    interface{}    `json:"key,omitempty"`
+	Error  *errorResponse `json:"error,omitempty"`
+}
+
+type batchResultsResponse struct {
+	Results []batchResultResponse `json:"results"`
+}
+
+// ConstructBatchResponse creates a server response for POST /keys/batch endpoint of the given API version,
+// with the keys and the errors in the order of the ids
+func ConstructBatchResponse(apiVersion string, ids []string, dataKeys map[string]*DataKey, errs map[string]error) *SecureBytes {
+	var secrets []*SecureBytes
+	resp := constructBatchResponse(apiVersion, ids, errs, func(id string) (interface{}, bool) {
+		if dataKey, ok := dataKeys[id]; ok {
+			secrets = append(secrets, dataKey.Plaintext)
+			return newGetKeyResponse(dataKey, secretRef(len(secrets)-1)), true
+		}
+		return nil, false
+	})
+	return marshalSecretResponse(resp, secrets)
+}
+
+// ConstructBatchWrappedResponse creates a server response for POST /keys/batch endpoint of the given API version
+// with wrapped_only
+func ConstructBatchWrappedResponse(apiVersion string, ids []string, wrappedDataKeys map[string]*WrappedDataKey, errs map[string]error) string {
+	resp := constructBatchResponse(apiVersion, ids, errs, func(id string) (interface{}, bool) {
+		if wrappedDataKey, ok := wrappedDataKeys[id]; ok {
+			return newWrappedKeyResponse(wrappedDataKey), true
+		}
+		return nil, false
+	})
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
+
+// ConstructWrappedKeyResponse creates the response of the ciphertexts of a data key
+func ConstructWrappedKeyResponse(wrappedDataKey *WrappedDataKey) string {
+	b, _ := json.Marshal(newWrappedKeyResponse(wrappedDataKey))
+	return string(b)
+}
+
+func newWrappedKeyResponse(wrappedDataKey *WrappedDataKey) wrappedKeyResponse {
+	resp := wrappedKeyResponse{ID: wrappedDataKey.ID, Version: wrappedDataKey.Version, Ciphertexts: wrappedDataKey.Ciphertexts}
+	if !wrappedDataKey.ExpiresAt.IsZero() {
+		resp.ExpiresAt = wrappedDataKey.ExpiresAt.Unix()
+	}
+	return resp
+}
+
+// constructBatchResponse creates the response of the ids once each, a batchResultsResponse of a result per id from
+// API version 2, and a batchResponse of the keys and of the errors for version 1
+func constructBatchResponse(apiVersion string, ids []string, errs map[string]error, key func(id string) (interface{}, bool)) interface{} {
+	results := make([]batchResultResponse, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if k, ok := key(id); ok {
+			results = append(results, batchResultResponse{ID: id, Status: http.StatusOK, Key: k})
+		} else if err, ok := errs[id]; ok {
+			status, errorType := dataKeyErrorStatus(err)
+			errorsTotal.inc(errorType)
+			results = append(results, batchResultResponse{ID: id, Status: status, Error: &errorResponse{errorType, err.Error()}})
+		}
+	}
+	if apiVersion != APIVersion1 {
+		return batchResultsResponse{results}
+	}
+
+	resp := batchResponse{Keys: make([]interface{}, 0, len(results)), Errors: make([]batchErrorResponse, 0)}
+	for _, result := range results {
+		if result.Error != nil {
+			resp.Errors = append(resp.Errors, batchErrorResponse{result.ID, result.Error.ErrorType, result.Error.ErrorMessage})
+		} else {
+			resp.Keys = append(resp.Keys, result.Key)
+		}
+	}
+	return resp
+}
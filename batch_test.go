@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetDataKeys(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	if _, err := r.GetDataKey(ctx, "existing", 0, nil); err != nil {
+		t.Fatalf("was not able to get plaintext: %s", err)
+	}
+	if _, err := r.GetDataKey(ctx, "bound", 0, EncryptionContext{"tenant": "a"}); err != nil {
+		t.Fatalf("was not able to get plaintext: %s", err)
+	}
+
+	dataKeys, errs := r.GetDataKeys(ctx, []string{"existing", "missing", "bound", "existing"}, nil)
+	if len(dataKeys) != 2 || dataKeys["existing"] == nil || dataKeys["missing"] == nil {
+		t.Fatalf("the existing and the missing ids should have data keys, got %v", dataKeys)
+	}
+
+	if len(errs) != 1 || errs["bound"] != (EncryptionContextMismatchError{ID: "bound"}) {
+		t.Fatalf("the id bound to another encryption context should have failed, got %v", errs)
+	}
+
+	wrappedDataKeys, errs := r.GetWrappedDataKeys(ctx, []string{"existing", "new"}, nil)
+	if len(errs) != 0 || len(wrappedDataKeys["existing"].Ciphertexts) != 3 || len(wrappedDataKeys["new"].Ciphertexts) != 3 {
+		t.Fatalf("the ciphertexts of every region should have been returned, got %v: %v", wrappedDataKeys, errs)
+	}
+}
+
+func TestGetWrappedDataKey(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	if _, err := r.GetWrappedDataKeyVersion(ctx, "id", 1, nil); err != (IDNotFoundStoreError{ID: "id"}) {
+		t.Fatalf("a missing id should have failed with IDNotFoundStoreError, got: %v", err)
+	}
+
+	wrapped, err := r.GetWrappedDataKey(ctx, "id", 0, nil)
+	if err != nil || wrapped.Version != FirstDataKeyVersion || len(wrapped.Ciphertexts) != 3 {
+		t.Fatalf("the data key should have been generated and its ciphertexts returned, got %+v: %v", wrapped, err)
+	}
+
+	if _, err := r.RotateDataKey(ctx, "id", nil); err != nil {
+		t.Fatalf("failed to rotate the data key: %s", err)
+	}
+
+	if wrapped, err := r.GetWrappedDataKey(ctx, "id", 0, nil); err != nil || wrapped.Version != 2 {
+		t.Fatalf("the ciphertexts of the latest version should have been returned, got %+v: %v", wrapped, err)
+	}
+
+	if wrapped, err := r.GetWrappedDataKeyVersion(ctx, "id", 1, nil); err != nil || wrapped.Version != 1 || len(wrapped.Ciphertexts) != 3 {
+		t.Fatalf("the ciphertexts of the first version should have been returned, got %+v: %v", wrapped, err)
+	}
+}
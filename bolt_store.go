@@ -0,0 +1,315 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore - an embedded BoltDB implementation of a key/value store for KMS-related data.
+// The data lives in a single local file, so it only suits single node deployments.
+type BoltStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func init() {
+	RegisterStore("bolt", func(config *Configuration) (Store, error) {
+		return NewBoltStore(config.Bolt)
+	})
+}
+
+// NewBoltStore opens (or creates) the data file and creates a new BoltStore instance.
+// Only one process can have the file open, others wait up to the lock timeout.
+func NewBoltStore(boltConfig BoltConfig) (*BoltStore, error) {
+	db, err := bolt.Open(boltConfig.Path, 0600, &bolt.Options{
+		Timeout: time.Duration(boltConfig.LockTimeoutInSeconds) * time.Second,
+	})
+
+	if err != nil {
+		logStoreError(context.Background(), "bolt", "NewBoltStore", "", err)
+		return nil, err
+	}
+
+	bucket := []byte(boltConfig.Bucket)
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+
+	if err != nil {
+		logStoreError(context.Background(), "bolt", "NewBoltStore", "", err)
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db, bucket}, nil
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *BoltStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *BoltStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	var found *item
+	err := s.db.View(func(tx *bolt.Tx) error {
+		//the value is only valid during the transaction, so it is decoded right away
+		value := tx.Bucket(s.bucket).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		found = &item{}
+		return json.Unmarshal(value, found)
+	})
+
+	if err != nil {
+		logStoreError(ctx, "bolt", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if found == nil {
+		return nil, 0, nil
+	}
+
+	if found.deleted() {
+		return nil, 0, found.deletedError()
+	}
+
+	return found.Keys, found.Version, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *BoltStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	return s.updateItem(id, func(item *item) (bool, error) {
+		if err := checkVersion(id, item, expectedVersion); err != nil {
+			return false, err
+		}
+
+		item.Keys = encryptedKeysMap
+		item.Version++
+		return true, nil
+	})
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids in a single read transaction
+func (s *BoltStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	keys := make(map[string]map[string]string, len(ids))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		for _, id := range ids {
+			value := bucket.Get([]byte(id))
+			if value == nil {
+				continue
+			}
+
+			item := item{}
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+
+			if !item.deleted() {
+				keys[id] = item.Keys
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		logStoreError(ctx, "bolt", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *BoltStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	value, err := json.Marshal(item{ID: id, Keys: encryptedKeysMap})
+	if err != nil {
+		logStoreError(ctx, "bolt", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	//write transactions are serialized, so checking and putting in the same transaction is atomic
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket.Get([]byte(id)) != nil {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		return bucket.Put([]byte(id), value)
+	})
+
+	if err != nil {
+		if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+			logStoreError(ctx, "bolt", "SetEncryptedDataKeysConditionally", id, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// updateItem applies update to the item of the given id within a write transaction.
+// A nil item is passed to update if the id does not exist.
+// update returns false if there is nothing to write.
+func (s *BoltStore) updateItem(id string, update func(item *item) (bool, error)) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+
+		var current *item
+		if value := bucket.Get([]byte(id)); value != nil {
+			current = &item{}
+			if err := json.Unmarshal(value, current); err != nil {
+				return err
+			}
+		}
+
+		write, err := update(current)
+		if err != nil || !write {
+			return err
+		}
+
+		value, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), value)
+	})
+
+	if err != nil {
+		switch err.(type) {
+		case IDNotFoundStoreError, IDDeletedStoreError, VersionMismatchStoreError:
+		default:
+			logStoreError(context.Background(), "bolt", "updateItem", id, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *BoltStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(id, func(item *item) (bool, error) {
+		if item == nil || item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = time.Now().Unix()
+		return true, nil
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *BoltStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(id, func(item *item) (bool, error) {
+		if item == nil {
+			return false, IDNotFoundStoreError{ID: id}
+		}
+
+		if !item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = 0
+		return true, nil
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *BoltStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(id))
+	})
+
+	if err != nil {
+		logStoreError(ctx, "bolt", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids in the bucket that are not deleted, in byte order
+func (s *BoltStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	ids := make([]string, 0, limit)
+	nextCursor := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		key, value := c.Seek([]byte(cursor))
+		if key != nil && string(key) == cursor {
+			key, value = c.Next()
+		}
+
+		for ; key != nil; key, value = c.Next() {
+			item := &item{}
+			if err := json.Unmarshal(value, item); err != nil {
+				return err
+			}
+
+			if item.deleted() {
+				continue
+			}
+
+			if len(ids) == limit {
+				nextCursor = ids[limit-1]
+				return nil
+			}
+			ids = append(ids, string(key))
+		}
+		return nil
+	})
+
+	if err != nil {
+		logStoreError(ctx, "bolt", "ListIDs", "", err)
+		return nil, "", err
+	}
+
+	return ids, nextCursor, nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time, in byte order
+func (s *BoltStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(func(item *item) bool {
+		return item.deletedBefore(deletedBefore)
+	})
+}
+
+func (s *BoltStore) listIDs(include func(item *item) bool) ([]string, error) {
+	ids := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(key, value []byte) error {
+			item := &item{}
+			if err := json.Unmarshal(value, item); err != nil {
+				return err
+			}
+
+			if include(item) {
+				ids = append(ids, string(key))
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		logStoreError(context.Background(), "bolt", "listIDs", "", err)
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,150 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	s, err := NewBoltStore(BoltConfig{Path: filepath.Join(t.TempDir(), "rkms.db"), Bucket: "rkms", LockTimeoutInSeconds: 1})
+	if err != nil {
+		t.Fatalf("failed to open the bolt store: %s", err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	return s
+}
+
+func TestBoltStoreSetConditionally(t *testing.T) {
+	s := newTestBoltStore(t)
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext-0", "region-1": "ciphertext-1"}
+
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", keys); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("second write should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+
+	storedKeys, err := s.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+
+	if !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("first write should have won, got: %v", storedKeys)
+	}
+}
+
+func TestBoltStoreDeleteRestorePurge(t *testing.T) {
+	s := newTestBoltStore(t)
+	ctx := context.Background()
+	s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"})
+
+	if err := s.DeleteEncryptedDataKeys(ctx, "id"); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	if _, err := s.GetEncryptedDataKeys(ctx, "id"); err == nil {
+		t.Fatalf("should not have returned keys of a deleted id")
+	} else if _, ok := err.(IDDeletedStoreError); !ok {
+		t.Fatalf("reading a deleted id should fail with IDDeletedStoreError, got: %v", err)
+	}
+
+	err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("a deleted id should not be recreated, got: %v", err)
+	}
+
+	if err := s.RestoreEncryptedDataKeys(ctx, "id"); err != nil {
+		t.Fatalf("failed to restore encrypted data keys: %s", err)
+	}
+
+	if keys, err := s.GetEncryptedDataKeys(ctx, "id"); err != nil || keys["region-0"] != "ciphertext" {
+		t.Fatalf("restored keys are wrong: %v, %v", keys, err)
+	}
+
+	if _, ok := s.RestoreEncryptedDataKeys(ctx, "missing").(IDNotFoundStoreError); !ok {
+		t.Fatalf("restoring a missing id should fail with IDNotFoundStoreError")
+	}
+
+	if err := s.PurgeEncryptedDataKeys(ctx, "id"); err != nil {
+		t.Fatalf("failed to purge encrypted data keys: %s", err)
+	}
+
+	if keys, err := s.GetEncryptedDataKeys(ctx, "id"); err != nil || keys != nil {
+		t.Fatalf("a purged id should read as missing, got: %v, %v", keys, err)
+	}
+
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "new"}); err != nil {
+		t.Fatalf("a purged id should be set again: %s", err)
+	}
+
+	if err := s.PurgeEncryptedDataKeys(ctx, "missing"); err != nil {
+		t.Fatalf("purging a missing id should not fail: %s", err)
+	}
+}
+
+func TestBoltStoreListIDsPages(t *testing.T) {
+	s := newTestBoltStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"e", "b", "d", "a", "c", "f"} {
+		s.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+	s.DeleteEncryptedDataKeys(ctx, "f")
+
+	ids, cursor, _ := s.ListIDs(ctx, "", 2)
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) || cursor == "" {
+		t.Fatalf("first page is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	first := cursor
+	ids, cursor, _ = s.ListIDs(ctx, first, 2)
+	if !reflect.DeepEqual(ids, []string{"c", "d"}) || cursor == "" {
+		t.Fatalf("second page is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	ids, cursor, _ = s.ListIDs(ctx, cursor, 2)
+	if !reflect.DeepEqual(ids, []string{"e"}) || cursor != "" {
+		t.Fatalf("last page is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	//a full page ending on the last live id is the last page, the deleted ids after it being skipped
+	s.DeleteEncryptedDataKeys(ctx, "e")
+	ids, cursor, _ = s.ListIDs(ctx, first, 2)
+	if !reflect.DeepEqual(ids, []string{"c", "d"}) || cursor != "" {
+		t.Fatalf("page ending on the last live id is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	all := []string{}
+	for cursor := ""; ; {
+		page, next, err := s.ListIDs(ctx, cursor, 1)
+		if err != nil {
+			t.Fatalf("failed to list ids: %s", err)
+		}
+
+		all = append(all, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if fmt.Sprint(all) != "[a b c d]" {
+		t.Fatalf("pages of one id should list every live id once, got: %v", all)
+	}
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	testStoreConformance(t, newTestBoltStore(t))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// cacheInvalidator - propagates the invalidations of the cached ids between the replicas of rkms, for a replica
+// not to serve the encrypted data keys another one rotated, rewrapped or deleted until its cache entry expires
+type cacheInvalidator interface {
+	// publish tells the other replicas the cache entry of id is stale
+	publish(ctx context.Context, id string) error
+
+	// subscribe calls invalidate with the ids the other replicas publish, until ctx is done
+	subscribe(ctx context.Context, invalidate func(id string)) error
+}
+
+// invalidationSender identifies the replica publishing an invalidation, for it not to invalidate its own cache
+// entries again
+var invalidationSender = newInvalidationSender()
+
+func newInvalidationSender() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// invalidationMessage is the message of the invalidation of id, sent by invalidationSender
+func invalidationMessage(id string) string {
+	return invalidationSender + " " + id
+}
+
+// parseInvalidationMessage returns the id a message invalidates, and false for the messages this replica sent
+func parseInvalidationMessage(message string) (string, bool) {
+	sender, id := message, ""
+	if i := strings.IndexByte(message, ' '); i >= 0 {
+		sender, id = message[:i], message[i+1:]
+	}
+	return id, sender != invalidationSender && id != ""
+}
+
+// cacheInvalidationResubscribeDelay is how long a lost subscription to the invalidations waits to subscribe again
+const cacheInvalidationResubscribeDelay = 5 * time.Second
+
+// runCacheInvalidations drops the cache entries of the ids invalidator receives, subscribing again whenever the
+// subscription is lost, until ctx is done
+func runCacheInvalidations(ctx context.Context, invalidator cacheInvalidator, invalidate func(id string)) {
+	for {
+		err := invalidator.subscribe(ctx, invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Errorf("lost the subscription to the cache invalidations of the other replicas, subscribing again in %s: %v", cacheInvalidationResubscribeDelay, err)
+
+		select {
+		case <-time.After(cacheInvalidationResubscribeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
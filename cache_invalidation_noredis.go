@@ -0,0 +1,17 @@
+//go:build !redis
+// +build !redis
+
+package main
+
+import (
+	"fmt"
+)
+
+// newCacheInvalidator fails when the invalidations are to be propagated, as Redis support is only compiled in with
+// the redis build tag
+func newCacheInvalidator(config CacheInvalidationConfig) (cacheInvalidator, error) {
+	if len(config.Redis.Addrs) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cache_invalidation.redis.addrs is set but rkms was built without Redis support, rebuild it with -tags redis")
+}
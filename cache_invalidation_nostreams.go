@@ -0,0 +1,17 @@
+//go:build !streams
+// +build !streams
+
+package main
+
+import (
+	"fmt"
+)
+
+// newStreamsCacheInvalidator fails when the stream of the table is to be consumed, as DynamoDB Streams support is
+// only compiled in with the streams build tag
+func newStreamsCacheInvalidator(config DynamoDBConfig) (cacheInvalidator, error) {
+	if !config.CacheInvalidation.Streams.Enabled {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cache_invalidation.streams.enabled is set but rkms was built without DynamoDB Streams support, rebuild it with -tags streams")
+}
@@ -0,0 +1,70 @@
+//go:build redis
+// +build redis
+
+package main
+
+import (
+	"context"
+
+	"github.com/go-redis/redis"
+)
+
+// redisCacheInvalidator - a cacheInvalidator publishing the invalidations on a Redis pub/sub channel
+type redisCacheInvalidator struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+// newCacheInvalidator creates the cache invalidator config sets, nil when the invalidations aren't propagated
+func newCacheInvalidator(config CacheInvalidationConfig) (cacheInvalidator, error) {
+	if len(config.Redis.Addrs) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig, err := newClientTLSConfig(config.Redis.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      config.Redis.Addrs,
+		MasterName: config.Redis.MasterName,
+		Password:   config.Redis.Password,
+		DB:         config.Redis.DB,
+		TLSConfig:  tlsConfig,
+	})
+	if err := client.Ping().Err(); err != nil {
+		return nil, err
+	}
+
+	return &redisCacheInvalidator{client, config.Channel}, nil
+}
+
+func (i *redisCacheInvalidator) publish(ctx context.Context, id string) error {
+	return i.client.Publish(i.channel, invalidationMessage(id)).Err()
+}
+
+// subscribe receives the invalidations of the channel, the subscription reconnecting when Redis drops it
+func (i *redisCacheInvalidator) subscribe(ctx context.Context, invalidate func(id string)) error {
+	pubsub := i.client.Subscribe(i.channel)
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(); err != nil {
+		return err
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if id, ok := parseInvalidationMessage(message.Payload); ok {
+				invalidate(id)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+//go:build streams
+// +build streams
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// streamsShardRefreshInterval is how often the shards of the stream are listed again, for the shards DynamoDB
+// splits or opens to be read
+const streamsShardRefreshInterval = time.Minute
+
+// dynamoDBStreamsAPI is the subset of the DynamoDB Streams client used by streamsCacheInvalidator
+type dynamoDBStreamsAPI interface {
+	DescribeStream(context.Context, *dynamodbstreams.DescribeStreamInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(context.Context, *dynamodbstreams.GetShardIteratorInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(context.Context, *dynamodbstreams.GetRecordsInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// streamsCacheInvalidator - a cacheInvalidator reading the ids written to the table from its DynamoDB stream, the
+// writes of every replica or command being in the stream without anything being published
+type streamsCacheInvalidator struct {
+	streamARN    *string
+	client       dynamoDBStreamsAPI
+	pollInterval time.Duration
+}
+
+// newStreamsCacheInvalidator creates the consumer of the stream of the table config sets, nil when the stream
+// isn't consumed
+func newStreamsCacheInvalidator(config DynamoDBConfig) (cacheInvalidator, error) {
+	if !config.CacheInvalidation.Streams.Enabled {
+		return nil, nil
+	}
+
+	awsConfig, err := newDynamoDBConfig(config, config.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := dynamodb.NewFromConfig(awsConfig).DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(config.TableName)})
+	if err != nil {
+		return nil, err
+	}
+	if table.Table.LatestStreamArn == nil {
+		return nil, fmt.Errorf("the DynamoDB table %s has no stream, enable one (KEYS_ONLY is enough) to consume it", config.TableName)
+	}
+
+	pollInterval := time.Duration(config.CacheInvalidation.Streams.PollIntervalInMilliseconds) * time.Millisecond
+	return &streamsCacheInvalidator{table.Table.LatestStreamArn, dynamodbstreams.NewFromConfig(awsConfig), pollInterval}, nil
+}
+
+// publish does nothing, the stream having the write of id already
+func (i *streamsCacheInvalidator) publish(ctx context.Context, id string) error {
+	return nil
+}
+
+// subscribe reads the ids of the records of every open shard of the stream, from the latest record of the shards
+// open when it subscribes and from the first record of the shards opened since
+func (i *streamsCacheInvalidator) subscribe(ctx context.Context, invalidate func(id string)) error {
+	iterators := make(map[string]*string)
+	if err := i.refreshShards(ctx, iterators, types.ShardIteratorTypeLatest); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(i.pollInterval)
+	defer ticker.Stop()
+	refreshed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		closed := false
+		for shardID, iterator := range iterators {
+			next, err := i.readShard(ctx, iterator, invalidate)
+			if err != nil {
+				return err
+			}
+
+			iterators[shardID] = next
+			if next == nil {
+				closed = true
+			}
+		}
+
+		if closed || time.Since(refreshed) > streamsShardRefreshInterval {
+			if err := i.refreshShards(ctx, iterators, types.ShardIteratorTypeTrimHorizon); err != nil {
+				return err
+			}
+			refreshed = time.Now()
+		}
+	}
+}
+
+// readShard invalidates the ids of the records of a shard from iterator, returning the iterator of the next records,
+// nil once the shard is closed and read
+func (i *streamsCacheInvalidator) readShard(ctx context.Context, iterator *string, invalidate func(id string)) (*string, error) {
+	if iterator == nil {
+		return nil, nil
+	}
+
+	output, err := i.client.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range output.Records {
+		if record.Dynamodb == nil {
+			continue
+		}
+		if key, ok := record.Dynamodb.Keys["id"].(*types.AttributeValueMemberS); ok {
+			invalidate(key.Value)
+		}
+	}
+	return output.NextShardIterator, nil
+}
+
+// refreshShards lists the shards of the stream, reading the open shards it doesn't read yet from iteratorType and
+// forgetting the closed shards it read to the end
+func (i *streamsCacheInvalidator) refreshShards(ctx context.Context, iterators map[string]*string, iteratorType types.ShardIteratorType) error {
+	for shardID, iterator := range iterators {
+		if iterator == nil {
+			delete(iterators, shardID)
+		}
+	}
+
+	var exclusiveStartShardID *string
+	for {
+		output, err := i.client.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             i.streamARN,
+			ExclusiveStartShardId: exclusiveStartShardID,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range output.StreamDescription.Shards {
+			open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+			if _, read := iterators[*shard.ShardId]; read || !open {
+				continue
+			}
+
+			iterator, err := i.client.GetShardIterator(ctx, &dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         i.streamARN,
+				ShardId:           shard.ShardId,
+				ShardIteratorType: iteratorType,
+			})
+			if err != nil {
+				return err
+			}
+			iterators[*shard.ShardId] = iterator.ShardIterator
+		}
+
+		if output.StreamDescription.LastEvaluatedShardId == nil {
+			return nil
+		}
+		exclusiveStartShardID = output.StreamDescription.LastEvaluatedShardId
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCacheInvalidator is a pub/sub channel of invalidations shared by the stores of the tests
+type memoryCacheInvalidator struct {
+	mutex       sync.Mutex
+	subscribers []func(message string)
+}
+
+func (i *memoryCacheInvalidator) publish(ctx context.Context, id string) error {
+	i.send(invalidationMessage(id))
+	return nil
+}
+
+func (i *memoryCacheInvalidator) send(message string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for _, subscriber := range i.subscribers {
+		subscriber(message)
+	}
+}
+
+func (i *memoryCacheInvalidator) subscribe(ctx context.Context, invalidate func(id string)) error {
+	i.mutex.Lock()
+	i.subscribers = append(i.subscribers, func(message string) {
+		if id, ok := parseInvalidationMessage(message); ok {
+			invalidate(id)
+		}
+	})
+	i.mutex.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (i *memoryCacheInvalidator) subscribed() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return len(i.subscribers) > 0
+}
+
+// otherReplicaInvalidator publishes on a memoryCacheInvalidator as another replica would
+type otherReplicaInvalidator struct {
+	*memoryCacheInvalidator
+}
+
+func (i otherReplicaInvalidator) publish(ctx context.Context, id string) error {
+	i.send("other-replica " + id)
+	return nil
+}
+
+func TestParseInvalidationMessage(t *testing.T) {
+	if id, ok := parseInvalidationMessage("other-replica id 1"); !ok || id != "id 1" {
+		t.Fatalf("the id invalidated by another replica should have been parsed, got %q", id)
+	}
+	if _, ok := parseInvalidationMessage(invalidationMessage("id")); ok {
+		t.Fatalf("the invalidations of this replica should have been ignored")
+	}
+}
+
+func TestDynamoDBStoreInvalidatesOtherReplicas(t *testing.T) {
+	bus := &memoryCacheInvalidator{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replica := getTestDynamoDBStore(&conditionalDynamoDBClient{})
+	replica.keysCache.Set("id", &item{ID: "id", Keys: map[string]string{"region-0": "old"}}, 0)
+	go runCacheInvalidations(ctx, bus, replica.keysCache.Delete)
+	for !bus.subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	s := getTestDynamoDBStore(&conditionalDynamoDBClient{})
+	s.invalidations = otherReplicaInvalidator{bus}
+	s.keysCache.Set("id", &item{ID: "id"}, 0)
+	s.invalidate(context.Background(), "id")
+
+	if _, found := s.keysCache.Get("id"); found {
+		t.Fatalf("the cache entry of the id should have been dropped")
+	}
+	if _, found := replica.keysCache.Get("id"); found {
+		t.Fatalf("the cache entry of the id should have been invalidated in the other replica")
+	}
+}
+
+func TestDynamoDBStoreIgnoresOwnInvalidations(t *testing.T) {
+	bus := &memoryCacheInvalidator{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := getTestDynamoDBStore(&conditionalDynamoDBClient{})
+	s.invalidations = bus
+	go runCacheInvalidations(ctx, bus, s.keysCache.Delete)
+	for !bus.subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	//the replica which created an id keeps it cached
+	s.keysCache.Set("id", &item{ID: "id"}, 0)
+	bus.publish(context.Background(), "id")
+	if _, found := s.keysCache.Get("id"); !found {
+		t.Fatalf("the replica shouldn't have dropped its cache entry on its own invalidation")
+	}
+}
@@ -0,0 +1,300 @@
+//go:build cassandra
+// +build cassandra
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraStore - a Cassandra (or ScyllaDB) implementation of a key/value store for KMS-related data.
+// The conditional write is a lightweight transaction, so with a SERIAL serial consistency
+// the first write wins across every datacenter of the keyspace.
+//
+// The table is expected to exist:
+//
+//	CREATE TABLE rkms_keys (id text PRIMARY KEY, keys map<text, text>, deleted_at timestamp, version bigint);
+//
+// Tables created before soft deletes and updates were supported need the columns added:
+//
+//	ALTER TABLE rkms_keys ADD deleted_at timestamp;
+//	ALTER TABLE rkms_keys ADD version bigint;
+type CassandraStore struct {
+	session   *gocql.Session
+	tableName string
+}
+
+func init() {
+	RegisterStore("cassandra", func(config *Configuration) (Store, error) {
+		return NewCassandraStore(config.Cassandra)
+	})
+}
+
+// NewCassandraStore creates a new CassandraStore instance
+func NewCassandraStore(cassandraConfig CassandraConfig) (*CassandraStore, error) {
+	consistency, err := gocql.ParseConsistencyWrapper(cassandraConfig.Consistency)
+	if err != nil {
+		logStoreError(context.Background(), "cassandra", "NewCassandraStore", "", err)
+		return nil, err
+	}
+
+	cluster := gocql.NewCluster(cassandraConfig.Hosts...)
+	cluster.Keyspace = cassandraConfig.Keyspace
+	cluster.Consistency = consistency
+
+	switch strings.ToUpper(cassandraConfig.SerialConsistency) {
+	case "SERIAL":
+		cluster.SerialConsistency = gocql.Serial
+	case "LOCAL_SERIAL":
+		cluster.SerialConsistency = gocql.LocalSerial
+	default:
+		return nil, fmt.Errorf("invalid cassandra serial consistency %q, must be SERIAL or LOCAL_SERIAL", cassandraConfig.SerialConsistency)
+	}
+
+	if cassandraConfig.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(cassandraConfig.LocalDC))
+	}
+
+	if cassandraConfig.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cassandraConfig.Username,
+			Password: cassandraConfig.Password,
+		}
+	}
+
+	tlsConfig, err := newClientTLSConfig(cassandraConfig.TLS)
+	if err != nil {
+		logStoreError(context.Background(), "cassandra", "NewCassandraStore", "", err)
+		return nil, err
+	}
+	if tlsConfig != nil {
+		cluster.SslOpts = &gocql.SslOptions{Config: tlsConfig, EnableHostVerification: !cassandraConfig.TLS.InsecureSkipVerify}
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		logStoreError(context.Background(), "cassandra", "NewCassandraStore", "", err)
+		return nil, err
+	}
+
+	return &CassandraStore{session, cassandraConfig.TableName}, nil
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *CassandraStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *CassandraStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	keys := make(map[string]string)
+	var deletedAt time.Time
+	//version is null until the first update, which scans as 0
+	var version int64
+	query := fmt.Sprintf("SELECT keys, deleted_at, version FROM %s WHERE id = ?", s.tableName)
+
+	err := s.session.Query(query, id).WithContext(ctx).Scan(&keys, &deletedAt, &version)
+	if err == gocql.ErrNotFound {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "cassandra", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if !deletedAt.IsZero() {
+		return nil, 0, IDDeletedStoreError{ID: id, DeletedAt: deletedAt}
+	}
+
+	return keys, version, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with a single IN query
+func (s *CassandraStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	query := fmt.Sprintf("SELECT id, keys, deleted_at FROM %s WHERE id IN ?", s.tableName)
+	iter := s.session.Query(query, ids).WithContext(ctx).Iter()
+
+	keys := make(map[string]map[string]string, len(ids))
+	var id string
+	var deletedAt time.Time
+	for {
+		encryptedKeys := make(map[string]string)
+		if !iter.Scan(&id, &encryptedKeys, &deletedAt) {
+			break
+		}
+
+		if deletedAt.IsZero() {
+			keys[id] = encryptedKeys
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		logStoreError(ctx, "cassandra", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *CassandraStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	query := fmt.Sprintf("INSERT INTO %s (id, keys) VALUES (?, ?) IF NOT EXISTS", s.tableName)
+
+	applied, err := s.session.Query(query, id, encryptedKeysMap).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		logStoreError(ctx, "cassandra", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	if !applied {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *CassandraStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	versionCondition := "version = ?"
+	args := []interface{}{encryptedKeysMap, expectedVersion + 1, id, expectedVersion}
+	if expectedVersion == 0 {
+		versionCondition = "version = null"
+		args = args[:3]
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET keys = ?, version = ? WHERE id = ? IF keys != null AND deleted_at = null AND %s", s.tableName, versionCondition)
+	applied, err := s.session.Query(query, args...).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		logStoreError(ctx, "cassandra", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if applied {
+		return nil
+	}
+
+	//the row tells why it wasn't updated
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if keys == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *CassandraStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	//writes to the same partition have to be lightweight transactions as well to stay linearizable,
+	//the keys condition keeps the update from creating a row for an unknown id
+	query := fmt.Sprintf("UPDATE %s SET deleted_at = ? WHERE id = ? IF keys != null AND deleted_at = null", s.tableName)
+
+	if _, err := s.session.Query(query, time.Now(), id).WithContext(ctx).MapScanCAS(make(map[string]interface{})); err != nil {
+		logStoreError(ctx, "cassandra", "DeleteEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *CassandraStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s SET deleted_at = null WHERE id = ? IF keys != null", s.tableName)
+
+	applied, err := s.session.Query(query, id).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		logStoreError(ctx, "cassandra", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if !applied {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *CassandraStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = ? IF EXISTS", s.tableName)
+
+	if _, err := s.session.Query(query, id).WithContext(ctx).MapScanCAS(make(map[string]interface{})); err != nil {
+		logStoreError(ctx, "cassandra", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the table that are not deleted, in token order.
+// The cursor is the paging state of the driver, deleted ids are filtered out of the page
+// so it can hold fewer than limit ids.
+func (s *CassandraStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	pageState, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid cassandra cursor %q: %s", cursor, err)
+	}
+
+	query := s.session.Query(fmt.Sprintf("SELECT id, deleted_at FROM %s", s.tableName)).WithContext(ctx)
+	iter := query.PageSize(listIDsLimit(limit)).PageState(pageState).Iter()
+	nextPageState := iter.PageState()
+
+	ids := make([]string, 0)
+	var id string
+	var deletedAt time.Time
+	//setting a page state disables automatic paging, so the iterator stops at the end of the page
+	for iter.Scan(&id, &deletedAt) {
+		if deletedAt.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		logStoreError(ctx, "cassandra", "ListIDs", "", err)
+		return nil, "", err
+	}
+
+	return ids, base64.RawURLEncoding.EncodeToString(nextPageState), nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *CassandraStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(ctx, func(deletedAt time.Time) bool {
+		return !deletedAt.IsZero() && deletedAt.Before(deletedBefore)
+	})
+}
+
+// listIDs filters on the deletion time client side, since filtering on a
+// non-key column would need ALLOW FILTERING anyway
+func (s *CassandraStore) listIDs(ctx context.Context, include func(deletedAt time.Time) bool) ([]string, error) {
+	iter := s.session.Query(fmt.Sprintf("SELECT id, deleted_at FROM %s", s.tableName)).WithContext(ctx).Iter()
+
+	ids := make([]string, 0)
+	var id string
+	var deletedAt time.Time
+	for iter.Scan(&id, &deletedAt) {
+		if include(deletedAt) {
+			ids = append(ids, id)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		logStoreError(ctx, "cassandra", "listIDs", "", err)
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,18 @@
+//go:build cassandra
+// +build cassandra
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCassandraStoreConformance(t *testing.T) {
+	host := testStoreEnv(t, "RKMS_TEST_CASSANDRA_HOST")
+	s, err := NewCassandraStore(CassandraConfig{Hosts: []string{host}, Keyspace: "rkms", TableName: "rkms_keys", Consistency: "LOCAL_QUORUM", SerialConsistency: "SERIAL"})
+	if err != nil {
+		t.Fatalf("failed to create the cassandra store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
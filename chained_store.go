@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// ChainedStore - a read-through chain of stores, ordered from the fastest to the authoritative one
+// (e.g. a local bolt file in front of DynamoDB in a remote region).
+//
+// Reads fall through the chain until the id is found and the keys are then copied to the stores
+// in front of the one they were found in. Writes, deletes and listings are decided by the authoritative
+// store, the last of the chain, and are then propagated to the other stores on a best effort basis.
+type ChainedStore struct {
+	stores []Store
+}
+
+func init() {
+	RegisterStore("chained", func(config *Configuration) (Store, error) {
+		stores, err := newStores(config, config.Chained.Stores, "chained")
+		if err != nil {
+			return nil, err
+		}
+
+		return NewChainedStore(stores)
+	})
+}
+
+// NewChainedStore creates a new ChainedStore instance, the last store being the authoritative one
+func NewChainedStore(stores []Store) (*ChainedStore, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("a chained store needs at least one store")
+	}
+
+	return &ChainedStore{stores}, nil
+}
+
+func (s *ChainedStore) authoritative() Store {
+	return s.stores[len(s.stores)-1]
+}
+
+// fill copies keys to the given stores, which are only acting as caches of the authoritative store
+func (s *ChainedStore) fill(ctx context.Context, stores []Store, id string, keys map[string]string) {
+	for i, store := range stores {
+		err := store.SetEncryptedDataKeysConditionally(ctx, id, keys)
+		if _, ok := err.(IDAlreadyExistsStoreError); err != nil && !ok {
+			contextLogger(ctx).Infof("failed to fill chained store #%d: %s", i, err)
+		}
+	}
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id from the first store that has them.
+// Failures of the stores in front of the authoritative one are logged and skipped.
+func (s *ChainedStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	last := len(s.stores) - 1
+	for i, store := range s.stores {
+		keys, err := store.GetEncryptedDataKeys(ctx, id)
+		if _, ok := err.(IDDeletedStoreError); ok {
+			return nil, err
+		}
+
+		if err != nil {
+			if i == last {
+				contextLogger(ctx).Error(err)
+				return nil, err
+			}
+
+			contextLogger(ctx).Infof("failed to read from chained store #%d: %s", i, err)
+			continue
+		}
+
+		if keys != nil {
+			s.fill(ctx, s.stores[:i], id, keys)
+			return keys, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids from the first store
+// in a batch, ids it doesn't return are read (and filled) one by one through the chain
+func (s *ChainedStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	return getEncryptedDataKeysBatchThenEach(ctx, s, s.stores[0], ids)
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id in the authoritative store
+// only if id does not exist in it already, and then copies them to the other stores.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *ChainedStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	if err := s.authoritative().SetEncryptedDataKeysConditionally(ctx, id, encryptedKeysMap); err != nil {
+		return err
+	}
+
+	s.fill(ctx, s.stores[:len(s.stores)-1], id, encryptedKeysMap)
+	return nil
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+// from the authoritative store, the only one versions are meaningful in
+func (s *ChainedStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	return s.authoritative().GetVersionedEncryptedDataKeys(ctx, id)
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id in the authoritative store
+// if they are at expectedVersion. The stores in front of it drop the id, to be filled again on the next read.
+func (s *ChainedStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	if err := s.authoritative().UpdateEncryptedDataKeys(ctx, id, encryptedKeysMap, expectedVersion); err != nil {
+		return err
+	}
+
+	for i, store := range s.stores[:len(s.stores)-1] {
+		if err := store.PurgeEncryptedDataKeys(ctx, id); err != nil {
+			contextLogger(ctx).Errorf("failed to drop updated keys from chained store #%d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id in every store,
+// starting with the authoritative one
+func (s *ChainedStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.writeThrough("delete", func(store Store) error {
+		return store.DeleteEncryptedDataKeys(ctx, id)
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again in every store,
+// starting with the authoritative one
+func (s *ChainedStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.writeThrough("restore", func(store Store) error {
+		err := store.RestoreEncryptedDataKeys(ctx, id)
+		if _, ok := err.(IDNotFoundStoreError); ok && store != s.authoritative() {
+			//the keys were never copied to this store
+			return nil
+		}
+		return err
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id from every store,
+// starting with the authoritative one
+func (s *ChainedStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.writeThrough("purge", func(store Store) error {
+		return store.PurgeEncryptedDataKeys(ctx, id)
+	})
+}
+
+// writeThrough calls write for the authoritative store and, if it succeeds, for the other stores.
+// Only a failure of the authoritative store is returned.
+func (s *ChainedStore) writeThrough(operation string, write func(store Store) error) error {
+	if err := write(s.authoritative()); err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	for i, store := range s.stores[:len(s.stores)-1] {
+		if err := write(store); err != nil {
+			logger.Errorf("failed to %s in chained store #%d: %s", operation, i, err)
+		}
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids of the authoritative store
+func (s *ChainedStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	return s.authoritative().ListIDs(ctx, cursor, limit)
+}
+
+// ListDeletedIDs returns every id deleted before the given time in the authoritative store
+func (s *ChainedStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.authoritative().ListDeletedIDs(ctx, deletedBefore)
+}
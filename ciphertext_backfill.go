@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// backfillMissingCiphertexts encrypts again, in the regions they are missing, the data keys that were
+// created while some regions were unavailable or before a region was added to the configuration.
+// Data keys are decrypted in a region they have a ciphertext for, encrypted in the missing healthy regions
+// and updated at the version they were read at: a key updated in the meantime is left for the next run.
+// It returns the number of ids that got new ciphertexts.
+func backfillMissingCiphertexts(ctx context.Context, r *RKMS) (int, error) {
+	backfilled := 0
+	cursor := ""
+	for {
+		var ids []string
+		var nextCursor string
+		err := r.retryStore(ctx, "list", true, func(ctx context.Context) (err error) {
+			ids, nextCursor, err = r.store.ListIDs(ctx, cursor, DefaultListIDsLimit)
+			return err
+		})
+		if err != nil {
+			logger.Errorf("failed to list ids to backfill: %s", err)
+			return backfilled, err
+		}
+
+		for _, id := range ids {
+			updated, err := r.backfillID(ctx, id)
+			if err != nil {
+				if ctx.Err() != nil {
+					return backfilled, err
+				}
+				logger.WithField("id", id).Errorf("failed to backfill the missing ciphertexts: %s", err)
+				continue
+			}
+
+			if updated {
+				backfilled++
+			}
+		}
+
+		if nextCursor == "" {
+			return backfilled, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// backfillID encrypts the data key of the given id in the healthy regions it has no ciphertext for
+func (r *RKMS) backfillID(ctx context.Context, id string) (bool, error) {
+	var encryptedDataKeys map[string]string
+	var version int64
+	err := r.retryStore(ctx, "get", true, func(ctx context.Context) (err error) {
+		encryptedDataKeys, version, err = r.store.GetVersionedEncryptedDataKeys(ctx, id)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(IDDeletedStoreError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	//the id was purged or expired since it was listed
+	if encryptedDataKeys == nil {
+		return false, nil
+	}
+
+	encryptionContext, err := storedEncryptionContext(encryptedDataKeys)
+	if err != nil {
+		return false, err
+	}
+
+	backfilled := false
+	versions := splitDataKeyVersions(encryptedDataKeys)
+	for _, regions := range versions {
+		updated, err := r.backfillDataKeyVersion(ctx, r.providersFor(id), regions, encryptionContext)
+		if err != nil {
+			return false, err
+		}
+		backfilled = backfilled || updated
+	}
+
+	if !backfilled {
+		return false, nil
+	}
+
+	backfilledDataKeys := joinDataKeyVersions(versions)
+	copyMetadataEntries(backfilledDataKeys, encryptedDataKeys)
+	err = r.retryStore(ctx, "update", false, func(ctx context.Context) error {
+		return r.store.UpdateEncryptedDataKeys(ctx, id, backfilledDataKeys, version)
+	})
+	if _, ok := err.(VersionMismatchStoreError); ok {
+		logger.Debugf("id %q was updated while being backfilled, leaving it for the next run", id)
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// backfillDataKeyVersion adds to the encrypted data keys of a data key version the ciphertexts of the
+// healthy regions they are missing with the given providers, telling if any was added. A data key split into
+// shares is split again for every region, the shares of two splits not combining.
+func (r *RKMS) backfillDataKeyVersion(ctx context.Context, providers map[string]KeyProvider, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) (bool, error) {
+	missingRegions := make([]string, 0)
+	for _, region := range r.encryptionRegions() {
+		if _, ok := encryptedDataKeys[region]; !ok {
+			missingRegions = append(missingRegions, region)
+		}
+	}
+
+	if len(missingRegions) == 0 {
+		return false, nil
+	}
+
+	plaintextDataKey, err := r.decryptDataKey(ctx, providers, encryptedDataKeys, encryptionContext)
+	if err != nil {
+		return false, err
+	}
+	defer plaintextDataKey.Destroy()
+
+	if r.shamirThreshold > 0 && sharesThreshold(encryptedDataKeys) > 0 {
+		ciphertexts, _ := r.encryptDataKeyVersion(ctx, providers, plaintextDataKey, encryptionContext)
+		for region, ciphertext := range ciphertexts {
+			encryptedDataKeys[region] = ciphertext
+		}
+		return len(ciphertexts) > 0, nil
+	}
+
+	//the regions which fail are left for the next run
+	ciphertexts, _ := r.encryptDataKeyInRegions(ctx, providers, plaintextDataKey, missingRegions, encryptionContext, false)
+	for region, ciphertext := range ciphertexts {
+		encryptedDataKeys[region] = ciphertext
+	}
+
+	return len(ciphertexts) > 0, nil
+}
+
+// runCiphertextBackfill backfills the missing ciphertexts of every id every interval, until ctx is done
+func runCiphertextBackfill(ctx context.Context, r *RKMS, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		backfilled, err := backfillMissingCiphertexts(ctx, r)
+		if err == nil && backfilled > 0 {
+			logger.Infof("backfilled the missing ciphertexts of %d ids", backfilled)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
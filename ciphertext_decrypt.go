@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// DecryptCiphertext decrypts one of the ciphertexts of the data key of id, e.g. one of a WrappedDataKey, in its region,
+// once the data key read from the store is found enabled. If the region fails to, the ciphertexts of the same data
+// key version in the other regions are decrypted instead. A share of a data key split with Shamir's scheme is
+// combined with the other shares of its version. The plaintext is returned, for the caller to destroy, along with the
+// region that decrypted it.
+func (r *RKMS) DecryptCiphertext(ctx context.Context, id string, region string, ciphertext string, encryptionContext EncryptionContext) (*SecureBytes, string, error) {
+	ctx = withLogID(ctx, id)
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, "", err
+	}
+
+	//the state of the data key is checked before its ciphertext is decrypted, its other ciphertexts being the
+	//fallback of the region
+	storeCtx, cancel := budgetContext(ctx, 3)
+	encryptedDataKeys, _, err := r.getEncryptedDataKeys(storeCtx, id)
+	cancel()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, "", IDNotFoundStoreError{ID: id}
+	}
+
+	if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+		return nil, "", err
+	}
+
+	if err := checkKeyState(id, encryptedDataKeys); err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := parseWrappedKey(ciphertext)
+	if err != nil {
+		return nil, "", InvalidCiphertextError{Reason: "the ciphertext isn't a wrapped data key: " + err.Error()}
+	}
+
+	//the ciphertexts of the data key version the given one is of, the saved one telling how it was wrapped when
+	//the given one is bare
+	var versionCiphertexts map[string]string
+	for version, regions := range splitDataKeyVersions(encryptedDataKeys) {
+		if saved, ok := regions[region]; ok && wrappedKeyCiphertext(saved) == wrapped.Ciphertext {
+			if err := r.checkCryptoperiod(id, encryptedDataKeys, version); err != nil {
+				return nil, "", err
+			}
+			versionCiphertexts = regions
+			if parsed, err := parseWrappedKey(saved); err == nil {
+				wrapped = parsed
+			}
+			break
+		}
+	}
+
+	providers := r.providersFor(id)
+	if wrapped.Threshold > 0 && versionCiphertexts != nil {
+		//a share doesn't decrypt the data key on its own, the shares of its version are combined
+		plaintext, decryptedRegion, err := r.decryptDataKeyInRegion(ctx, providers, versionCiphertexts, encryptionContext)
+		if err != nil {
+			contextLogger(ctx).Error(err)
+			return nil, "", err
+		}
+		return plaintext, decryptedRegion, nil
+	}
+
+	if provider, ok := providers[region]; ok && wrapped.Threshold == 0 {
+		//leaves as much time to decrypt the other ciphertexts
+		budgetCtx, cancel := budgetContext(ctx, 2)
+		start := time.Now()
+		spanCtx, endSpan := startKeyProviderSpan(budgetCtx, region, "Decrypt")
+		var plaintext []byte
+		err = r.retryKeyProvider(spanCtx, region, "Decrypt", func(ctx context.Context) (err error) {
+			plaintext, err = wrapped.decrypt(ctx, provider, encryptionContext)
+			return err
+		})
+		endSpan(err)
+		cancel()
+		observeKeyProvider(region, "Decrypt", start, err)
+		if err == nil {
+			return secureBytesOf(plaintext), region, nil
+		}
+		regionLogger(ctx, region, "Decrypt").Infof("failed to decrypt the given ciphertext, falling back to the other regions: %s", err)
+	}
+
+	if versionCiphertexts != nil {
+		siblings := make(map[string]string, len(versionCiphertexts)-1)
+		for sibling, siblingCiphertext := range versionCiphertexts {
+			if sibling != region {
+				siblings[sibling] = siblingCiphertext
+			}
+		}
+
+		plaintext, decryptedRegion, err := r.decryptDataKeyInRegion(ctx, providers, siblings, encryptionContext)
+		if err != nil {
+			contextLogger(ctx).Error(err)
+			return nil, "", err
+		}
+		return plaintext, decryptedRegion, nil
+	}
+
+	return nil, "", InvalidCiphertextError{Reason: "the ciphertext is not one of the data key of id " + id + " in region " + region}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDecryptCiphertextFailsOver(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	wrapped, err := r.GetWrappedDataKey(ctx, "id", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to get the ciphertexts of the data key: %s", err)
+	}
+
+	region := getTestRegionName(0)
+	if _, decryptedRegion, err := r.DecryptCiphertext(ctx, "id", region, wrapped.Ciphertexts[region], nil); err != nil || decryptedRegion != region {
+		t.Fatalf("the ciphertext should have been decrypted in its region, got %s: %v", decryptedRegion, err)
+	}
+
+	keyID := getTestKeyID(region)
+	r.providers[region] = &AWSKMSProvider{&unavailableKMSClient{}, &keyID, nil, nil}
+	plaintext, decryptedRegion, err := r.DecryptCiphertext(ctx, "id", region, wrapped.Ciphertexts[region], nil)
+	if err != nil || plaintext == nil || decryptedRegion == region {
+		t.Fatalf("the ciphertext of another region should have been decrypted, got %s: %v", decryptedRegion, err)
+	}
+
+	if _, _, err := r.DecryptCiphertext(ctx, "id", region, "b3RoZXI=", nil); err == nil {
+		t.Fatalf("a ciphertext that isn't one of the data key should have failed to decrypt")
+	} else if _, ok := err.(InvalidCiphertextError); !ok {
+		t.Fatalf("a ciphertext that isn't one of the data key should have failed with InvalidCiphertextError, got: %v", err)
+	}
+}
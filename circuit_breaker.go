@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// CircuitOpenError is returned instead of calling a dependency whose circuit breaker is open
+type CircuitOpenError struct {
+	Name string
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("the circuit breaker of %s is open, its calls fail fast until it recovers", e.Name)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker - fails the calls to a dependency fast once failureThreshold calls in a row failed, for the
+// dependency not to take the deadline of every request while it is down or browning out. After openDuration a
+// single call probes the dependency (half-open): its success closes the breaker, its failure opens it again.
+// A nil circuitBreaker never opens.
+type circuitBreaker struct {
+	name             string
+	failureThreshold int
+	openDuration     time.Duration
+
+	mutex    sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker creates the circuit breaker of the dependency of the given name, nil when config disables it
+func newCircuitBreaker(name string, config CircuitBreakerConfig) *circuitBreaker {
+	if config.FailureThreshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		name:             name,
+		failureThreshold: config.FailureThreshold,
+		openDuration:     time.Duration(config.OpenDurationInSeconds) * time.Second,
+	}
+}
+
+// call calls f unless the breaker is open, isFailure telling which of its errors are failures of the dependency.
+// The calls cancelled by the caller, e.g. the decryptions of the regions which didn't answer first, are neither
+// failures nor successes, while the calls which ran out of deadline are failures.
+func (b *circuitBreaker) call(ctx context.Context, isFailure func(error) bool, f func() error) error {
+	if b == nil {
+		return f()
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := f()
+	switch {
+	case ctx.Err() == context.Canceled:
+		b.release()
+	case (err != nil && isFailure(err)) || ctx.Err() == context.DeadlineExceeded:
+		b.failed()
+	default:
+		b.succeeded()
+	}
+	return err
+}
+
+// allow tells if a call can be made, moving an open breaker to half-open for a probe once openDuration passed
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return CircuitOpenError{Name: b.name}
+		}
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		//a probe is in flight
+		return CircuitOpenError{Name: b.name}
+	}
+	return nil
+}
+
+func (b *circuitBreaker) succeeded() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitHalfOpen {
+		logger.WithField("breaker", b.name).Infoln("the circuit breaker closed, the probe succeeded")
+	}
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failed() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.failureThreshold) {
+		logger.WithField("breaker", b.name).Warnf("the circuit breaker opened after %d failed calls, failing fast for %s", b.failures, b.openDuration)
+		circuitBreakerOpenedTotal.inc(b.name)
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a call which neither failed nor succeeded, letting another call probe a half-open breaker
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+	}
+}
+
+// open tells if the calls are failing fast, the breaker being open and not yet due for a probe
+func (b *circuitBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.openDuration
+}
+
+// State returns the state of the breaker: closed, open or half-open
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return circuitClosed.String()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+var errTestBrownout = errors.New("brownout")
+
+func isTestBrownout(err error) bool {
+	return err == errTestBrownout
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	b := newCircuitBreaker("test", CircuitBreakerConfig{FailureThreshold: 2, OpenDurationInSeconds: 30})
+	ctx := context.Background()
+	failing := func() error { return errTestBrownout }
+	calls := 0
+	succeeding := func() error {
+		calls++
+		return nil
+	}
+
+	b.call(ctx, isTestBrownout, failing)
+	if b.State() != "closed" {
+		t.Fatalf("the breaker should have stayed closed below the threshold, got %s", b.State())
+	}
+	b.call(ctx, isTestBrownout, failing)
+	if b.State() != "open" || !b.open() {
+		t.Fatalf("the breaker should have opened at the threshold, got %s", b.State())
+	}
+
+	if err := b.call(ctx, isTestBrownout, succeeding); calls != 0 || err != (CircuitOpenError{Name: "test"}) {
+		t.Fatalf("the open breaker should have failed fast, got %d calls and %v", calls, err)
+	}
+
+	//the open duration passed: a failed probe opens the breaker again
+	b.openedAt = time.Now().Add(-time.Minute)
+	b.call(ctx, isTestBrownout, failing)
+	if b.State() != "open" {
+		t.Fatalf("the failed probe should have opened the breaker again, got %s", b.State())
+	}
+
+	b.openedAt = time.Now().Add(-time.Minute)
+	if err := b.call(ctx, isTestBrownout, succeeding); err != nil || calls != 1 || b.State() != "closed" {
+		t.Fatalf("the successful probe should have closed the breaker, got %s and %v", b.State(), err)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newCircuitBreaker("test", CircuitBreakerConfig{FailureThreshold: 1, OpenDurationInSeconds: 30})
+	b.call(context.Background(), isTestBrownout, func() error { return errTestBrownout })
+	b.openedAt = time.Now().Add(-time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := b.call(ctx, isTestBrownout, func() error {
+		if err := b.call(context.Background(), isTestBrownout, func() error { return nil }); err == nil {
+			t.Errorf("only one call should have probed the half-open breaker")
+		}
+		cancel()
+		return ctx.Err()
+	})
+
+	if err != context.Canceled || b.State() != "open" || b.open() {
+		t.Fatalf("the cancelled probe should have let another call probe, got %s and %v", b.State(), err)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("test", CircuitBreakerConfig{})
+	for i := 0; i < 10; i++ {
+		if err := b.call(context.Background(), isTestBrownout, func() error { return errTestBrownout }); err != errTestBrownout {
+			t.Fatalf("the calls should have been made without a breaker, got %v", err)
+		}
+	}
+	if b.State() != "closed" || b.open() {
+		t.Fatalf("a disabled breaker should never open")
+	}
+}
+
+func TestDynamoDBStoreSkipsOpenReplica(t *testing.T) {
+	primary := &throttledDynamoDBClient{}
+	replica := &conditionalDynamoDBClient{}
+	s := getTestDynamoDBStore(primary, replica)
+	s.replicas[0].breaker = newCircuitBreaker("dynamodb:region-0", CircuitBreakerConfig{FailureThreshold: 2, OpenDurationInSeconds: 30})
+
+	for _, id := range []string{"id-0", "id-1", "id-2"} {
+		if _, err := s.GetEncryptedDataKeys(context.Background(), id); err != nil {
+			t.Fatalf("read should have failed over to the replica region: %s", err)
+		}
+	}
+
+	if primary.calls != 2 || replica.calls != 3 {
+		t.Fatalf("the throttled region should have been skipped once its breaker opened, got %d and %d calls", primary.calls, replica.calls)
+	}
+}
+
+func TestEncryptionRegionsLeaveOutOpenBreakers(t *testing.T) {
+	r := getRKMS([]bool{true, true, true})
+	r.kmsBreakers = map[string]*circuitBreaker{"region-1": newCircuitBreaker("kms:region-1", CircuitBreakerConfig{FailureThreshold: 1, OpenDurationInSeconds: 30})}
+	r.kmsBreakers["region-1"].call(context.Background(), isKeyProviderFailure, func() error {
+		return &smithy.GenericAPIError{Code: "KMSInternalException", Message: "internal error"}
+	})
+
+	regions := r.encryptionRegions()
+	if len(regions) != 2 || regions[0] != "region-0" || regions[1] != "region-2" {
+		t.Fatalf("the region of the open breaker should have been left out, got %v", regions)
+	}
+
+	if _, err := r.encryptDataKey(context.Background(), r.providers, secureBytesOf([]byte("data-key")), "region-1", nil); err == nil {
+		t.Fatalf("the calls to the region of the open breaker should have failed fast")
+	}
+}
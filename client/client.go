@@ -0,0 +1,381 @@
+// Package rkms is the Go client of the RKMS HTTP API, imported as
+//
+//	import rkms "github.com/JEEN/rkms/client"
+//
+// It retries the requests failing with a server or network error, and caches the plaintext data keys it gets.
+package rkms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAPIVersion is the API version requests are made to when none is configured
+const DefaultAPIVersion = "v1"
+
+// DefaultMaxRetries is the number of times a failed request is retried when none is configured
+const DefaultMaxRetries = 3
+
+// DefaultRetryBackoff is the wait before the first retry when none is configured, doubled for each next one
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// Config contains the settings of a Client
+type Config struct {
+	// the URL of the service, e.g. https://rkms.internal:8080, http://rkms by default with UnixSocket
+	BaseURL    string
+	APIVersion string
+	// the path of the Unix domain socket the service is served on, e.g. by a sidecar, the requests being sent to it
+	// rather than to the host of BaseURL. It is ignored with an HTTPClient.
+	UnixSocket string
+	// http.DefaultClient when nil, or a client of the UnixSocket
+	HTTPClient *http.Client
+	// a negative number disables retries
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// how long the plaintext data keys are cached for, 0 disabling the cache.
+	// The latest version of a key is cached too, so a rotation by another client is only seen once it expires.
+	CacheTTL time.Duration
+	// sent in the X-API-Key header when the service authenticates its callers with API keys
+	APIKey string
+	// the AWS credentials the requests are authenticated with when the service authenticates its callers by their
+	// IAM identity
+	IAM *IAMAuth
+}
+
+// Client - a client of the RKMS HTTP API, safe for concurrent use
+type Client struct {
+	config Config
+	mutex  sync.Mutex
+	cache  map[string]cachedKey
+}
+
+type cachedKey struct {
+	key       *Key
+	expiresAt time.Time
+}
+
+// Key - a version of the plaintext data key of an id
+type Key struct {
+	ID      string
+	Key     []byte
+	Version int64
+	// the zero time if the key never expires
+	ExpiresAt time.Time
+}
+
+// GetKeyOptions - the optional parameters of GetKey
+type GetKeyOptions struct {
+	// 0 for the latest version
+	Version int64
+	// the TTL of a key generated by the request, 0 for a key that never expires
+	TTL               time.Duration
+	EncryptionContext map[string]string
+}
+
+// Error - an error answered by the service
+type Error struct {
+	StatusCode int
+	// e.g. NotFound or EncryptionContextMismatch
+	Type    string
+	Message string
+	// how long the service asked to wait before retrying, e.g. when rate limited
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rkms answered %d %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+// New creates a new Client instance
+func New(config Config) *Client {
+	if config.BaseURL == "" && config.UnixSocket != "" {
+		config.BaseURL = "http://rkms"
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.APIVersion == "" {
+		config.APIVersion = DefaultAPIVersion
+	}
+	if config.HTTPClient == nil && config.UnixSocket != "" {
+		socket := config.UnixSocket
+		config.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = DefaultRetryBackoff
+	}
+
+	return &Client{config: config, cache: make(map[string]cachedKey)}
+}
+
+type keyResponse struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	Version   int64  `json:"version"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type errorResponse struct {
+	ErrorType    string `json:"error_type"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// GetKey gets the latest data key of id, generated by the service if there is none, or the version of the options
+func (c *Client) GetKey(ctx context.Context, id string, options *GetKeyOptions) (*Key, error) {
+	if options == nil {
+		options = &GetKeyOptions{}
+	}
+
+	query := url.Values{"id": {id}}
+	if options.Version > 0 {
+		query.Set("version", strconv.FormatInt(options.Version, 10))
+	}
+	if options.TTL > 0 {
+		query.Set("ttl", strconv.FormatInt(int64(options.TTL/time.Second), 10))
+	}
+	if err := setEncryptionContext(query, options.EncryptionContext); err != nil {
+		return nil, err
+	}
+
+	cacheKey := query.Encode()
+	if key := c.cachedKey(cacheKey); key != nil {
+		return key, nil
+	}
+
+	var response keyResponse
+	if err := c.do(ctx, http.MethodGet, "/key", query, nil, &response); err != nil {
+		return nil, err
+	}
+
+	key, err := response.key()
+	if err != nil {
+		return nil, err
+	}
+
+	c.cacheKey(cacheKey, key)
+	return key, nil
+}
+
+// RotateKey generates a new version of the data key of an existing id
+func (c *Client) RotateKey(ctx context.Context, id string, encryptionContext map[string]string) (*Key, error) {
+	query := url.Values{}
+	if err := setEncryptionContext(query, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	var response keyResponse
+	if err := c.do(ctx, http.MethodPost, "/keys/"+url.PathEscape(id)+"/rotate", query, nil, &response); err != nil {
+		return nil, err
+	}
+
+	c.invalidate(id)
+	return response.key()
+}
+
+// Encrypt encrypts plaintext server-side with the latest data key of id
+func (c *Client) Encrypt(ctx context.Context, id string, plaintext []byte, encryptionContext map[string]string) ([]byte, error) {
+	query := url.Values{"id": {id}}
+	if err := setEncryptionContext(query, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	body := map[string][]byte{"plaintext": plaintext}
+	if err := c.do(ctx, http.MethodPost, "/encrypt", query, body, &response); err != nil {
+		return nil, err
+	}
+	return response.Ciphertext, nil
+}
+
+// Decrypt decrypts a ciphertext of Encrypt server-side
+func (c *Client) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext map[string]string) ([]byte, error) {
+	query := url.Values{}
+	if err := setEncryptionContext(query, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	body := map[string][]byte{"ciphertext": ciphertext}
+	if err := c.do(ctx, http.MethodPost, "/decrypt", query, body, &response); err != nil {
+		return nil, err
+	}
+	return response.Plaintext, nil
+}
+
+// do sends a request with the given JSON body to the given path of the API and decodes its JSON response,
+// retrying on network errors, 429 and 5xx statuses
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, response interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	requestURL := c.config.BaseURL + "/api/" + c.config.APIVersion + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	backoff := c.config.RetryBackoff
+	var err error
+	for try := 0; ; try++ {
+		var retry bool
+		retry, err = c.try(ctx, method, requestURL, payload, response)
+		if !retry || try >= c.config.MaxRetries {
+			return err
+		}
+
+		wait := backoff
+		if rkmsErr, ok := err.(*Error); ok && rkmsErr.RetryAfter > wait {
+			wait = rkmsErr.RetryAfter
+		}
+
+		select {
+		case <-time.After(wait):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// try sends a request once, telling if it is worth retrying
+func (c *Client) try(ctx context.Context, method string, requestURL string, payload []byte, response interface{}) (bool, error) {
+	request, err := http.NewRequest(method, requestURL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	request = request.WithContext(ctx)
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.APIKey != "" {
+		request.Header.Set("X-API-Key", c.config.APIKey)
+	}
+	if c.config.IAM != nil {
+		authorization, err := c.config.IAM.authorization(ctx)
+		if err != nil {
+			return false, err
+		}
+		request.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.config.HTTPClient.Do(request)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		json.Unmarshal(b, &errResp)
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		rkmsErr := &Error{StatusCode: resp.StatusCode, Type: errResp.ErrorType, Message: errResp.ErrorMessage}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			rkmsErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return retry, rkmsErr
+	}
+
+	return false, json.Unmarshal(b, response)
+}
+
+func (r keyResponse) key() (*Key, error) {
+	plaintext, err := base64.StdEncoding.DecodeString(r.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: r.ID, Key: plaintext, Version: r.Version}
+	if r.ExpiresAt > 0 {
+		key.ExpiresAt = time.Unix(r.ExpiresAt, 0)
+	}
+	return key, nil
+}
+
+func (c *Client) cachedKey(cacheKey string) *Key {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, ok := c.cache[cacheKey]
+	if !ok {
+		return nil
+	}
+
+	if !time.Now().Before(cached.expiresAt) {
+		delete(c.cache, cacheKey)
+		return nil
+	}
+	return cached.key
+}
+
+// cacheKey caches a key for the cache TTL, or until the key expires if it is sooner
+func (c *Client) cacheKey(cacheKey string, key *Key) {
+	if c.config.CacheTTL <= 0 {
+		return
+	}
+
+	expiresAt := time.Now().Add(c.config.CacheTTL)
+	if !key.ExpiresAt.IsZero() && key.ExpiresAt.Before(expiresAt) {
+		expiresAt = key.ExpiresAt
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cache[cacheKey] = cachedKey{key, expiresAt}
+}
+
+// invalidate drops the cached keys of id
+func (c *Client) invalidate(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for cacheKey, cached := range c.cache {
+		if cached.key.ID == id {
+			delete(c.cache, cacheKey)
+		}
+	}
+}
+
+func setEncryptionContext(query url.Values, encryptionContext map[string]string) error {
+	if len(encryptionContext) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(encryptionContext)
+	if err != nil {
+		return err
+	}
+	query.Set("encryption_context", string(b))
+	return nil
+}
@@ -0,0 +1,130 @@
+package rkms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestGetKeyCachesKeys(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/api/v1/key" || r.URL.Query().Get("id") != "id" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		fmt.Fprintln(w, `{"id":"id","key":"a2V5","version":1}`)
+	}))
+	defer server.Close()
+
+	c := New(Config{BaseURL: server.URL, CacheTTL: time.Minute})
+	for i := 0; i < 3; i++ {
+		key, err := c.GetKey(context.Background(), "id", nil)
+		if err != nil || string(key.Key) != "key" || key.Version != 1 {
+			t.Fatalf("failed to get the key, got %+v: %v", key, err)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("the key should have been cached, %d requests were made", requests)
+	}
+}
+
+func TestRequestsAreRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"error_type":"InsufficientRegions","error_message":"unavailable"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"id":"id","key":"a2V5","version":2}`)
+	}))
+	defer server.Close()
+
+	c := New(Config{BaseURL: server.URL, RetryBackoff: time.Millisecond})
+	if key, err := c.RotateKey(context.Background(), "id", nil); err != nil || key.Version != 2 {
+		t.Fatalf("the request should have succeeded once retried, got %+v: %v", key, err)
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, `{"error_type":"EncryptionContextMismatch","error_message":"mismatch"}`)
+	}))
+	defer server.Close()
+
+	c := New(Config{BaseURL: server.URL, RetryBackoff: time.Millisecond})
+	_, err := c.GetKey(context.Background(), "id", &GetKeyOptions{EncryptionContext: map[string]string{"tenant": "a"}})
+	if rkmsErr, ok := err.(*Error); !ok || rkmsErr.StatusCode != http.StatusForbidden || rkmsErr.Type != "EncryptionContextMismatch" {
+		t.Fatalf("the error of the service should have been returned, got: %v", err)
+	}
+
+	if requests != 1 {
+		t.Fatalf("a client error should not have been retried, %d requests were made", requests)
+	}
+}
+
+func TestIAMAuthSignsForTheServer(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprintln(w, `{"id":"id","key":"a2V5","version":1}`)
+	}))
+	defer server.Close()
+
+	iam := &IAMAuth{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", ""), Region: "eu-west-1", ServerID: "rkms.example.com"}
+	c := New(Config{BaseURL: server.URL, IAM: iam})
+	if _, err := c.GetKey(context.Background(), "id", nil); err != nil {
+		t.Fatalf("failed to get the key: %s", err)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "AWS-IAM "))
+	if err != nil {
+		t.Fatalf("the signed request should have been sent with the AWS-IAM scheme, got %q", authorization)
+	}
+	var signed struct {
+		URL     string      `json:"url"`
+		Headers http.Header `json:"headers"`
+	}
+	json.Unmarshal(b, &signed)
+
+	if signed.URL != "https://sts.eu-west-1.amazonaws.com/" || signed.Headers.Get("X-Rkms-Server-Id") != "rkms.example.com" {
+		t.Fatalf("the request should have been signed for the regional STS endpoint and the server, got %+v", signed)
+	}
+	if !strings.Contains(signed.Headers.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-rkms-server-id") {
+		t.Fatalf("the server id should have been signed, got %s", signed.Headers.Get("Authorization"))
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rkms.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("can't listen on a Unix domain socket here: %s", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"id":"id","key":"a2V5","version":1}`)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	c := New(Config{UnixSocket: path})
+	if key, err := c.GetKey(context.Background(), "id", nil); err != nil || string(key.Key) != "key" {
+		t.Fatalf("the key should have been got through the socket, got %+v: %v", key, err)
+	}
+}
@@ -0,0 +1,59 @@
+package rkms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// getCallerIdentityBody is the body of the STS GetCallerIdentity requests rkms authenticates the callers with
+const getCallerIdentityBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+// IAMAuth contains the AWS credentials a Client signs an STS GetCallerIdentity request with for every request,
+// rkms authenticating it by the IAM identity STS answers that request with
+type IAMAuth struct {
+	Credentials aws.CredentialsProvider
+	// the region of the STS endpoint signed for, the global endpoint when empty
+	Region string
+	// the server_id rkms requires the requests to be signed for, if any
+	ServerID string
+}
+
+// authorization returns the Authorization header of a request authenticated with a freshly signed IAM request
+func (a *IAMAuth) authorization(ctx context.Context) (string, error) {
+	endpoint, region := "https://sts.amazonaws.com/", "us-east-1"
+	if a.Region != "" {
+		endpoint, region = "https://sts."+a.Region+".amazonaws.com/", a.Region
+	}
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if a.ServerID != "" {
+		request.Header.Set("X-Rkms-Server-Id", a.ServerID)
+	}
+
+	credentials, err := a.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+	payloadHash := sha256.Sum256([]byte(getCallerIdentityBody))
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, request, hex.EncodeToString(payloadHash[:]), "sts", region, time.Now()); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"url": endpoint, "body": getCallerIdentityBody, "headers": request.Header})
+	if err != nil {
+		return "", err
+	}
+	return "AWS-IAM " + base64.StdEncoding.EncodeToString(b), nil
+}
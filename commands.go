@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// commandOptions are the flags every command takes, before or after its name
+type commandOptions struct {
+	configFile string
+	storeType  string
+}
+
+// command is a subcommand of the rkms binary, e.g. `rkms rewrap`, run with the arguments following its name
+type command struct {
+	summary string
+	run     func(options commandOptions, args []string) error
+}
+
+// commands are the subcommands of the rkms binary, serve being the one run without a command name
+var commands = map[string]command{
+	"serve":        {"serve the HTTP and gRPC APIs (default)", serve},
+	"rewrap":       {"encrypt the data key of every id again with the configured keys", runRewrapCommand},
+	"list":         {"list the ids of the store with their metadata", runListCommand},
+	"export":       {"back the encrypted data keys of every id up as newline-delimited JSON", runExportCommand},
+	"import":       {"restore an export into the store, e.g. to migrate to another store", runImportCommand},
+	"replicate":    {"mirror the store into the replication target store once", runReplicateCommand},
+	"check-config": {"validate the configuration file and exit", runCheckConfigCommand},
+	"openapi":      {"print the OpenAPI specification of the HTTP API", runOpenAPICommand},
+}
+
+func main() {
+	var options commandOptions
+	addCommandFlags(flag.CommandLine, &options)
+	flag.Usage = printUsage
+	flag.Parse()
+
+	name, args := "serve", []string(nil)
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(options, args); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// printUsage lists the commands and the flags they all take
+func printUsage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: %s [flags] [command] [command flags]\n\ncommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-14s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprintln(w, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// addCommandFlags registers the flags every command takes on fs, their defaults being the values of options, for
+// them to be given before or after the name of the command
+func addCommandFlags(fs *flag.FlagSet, options *commandOptions) {
+	configFile, storeType := options.configFile, options.storeType
+	if configFile == "" {
+		configFile = DefaultConfigFile
+	}
+	fs.StringVar(&options.configFile, "config", configFile, "configuration file (toml, yaml or json), its settings being overridden by the RKMS_* environment variables")
+	fs.StringVar(&options.storeType, "store", storeType, "store type to use instead of the one in the configuration file (e.g. memory)")
+}
+
+// newCommandFlagSet creates the flag set of the given command, with the flags every command takes
+func newCommandFlagSet(name string, options *commandOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	addCommandFlags(fs, options)
+	return fs
+}
+
+// loadCommandConfiguration loads and validates the configuration of the options, and sets the logger up with it
+func loadCommandConfiguration(options commandOptions) (*Configuration, error) {
+	config, err := LoadConfiguration(options.configFile)
+	if err != nil {
+		return nil, err
+	}
+	if options.storeType != "" {
+		config.Store.Type = options.storeType
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := setupLogger(config.Logger); err != nil {
+		return nil, err
+	}
+	logger.Infof("loaded the configuration file %s", options.configFile)
+	if config.FIPS.Enabled {
+		module, _ := fipsCryptoModule()
+		logger.Infof("running in FIPS mode with the %s", module)
+	}
+	return config, nil
+}
+
+// openRKMS creates the store and the RKMS of the configuration
+func openRKMS(config *Configuration) (*RKMS, Store, error) {
+	store, err := NewStore(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := NewRKMS(config.KMS, store, config.Store.Retry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, store, nil
+}
+
+// commandContext is the context of the commands but serve, done on SIGTERM and SIGINT
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+}
+
+// runRewrapCommand runs `rkms rewrap`, failing when the data key of an id couldn't be rewrapped for it to be run again
+func runRewrapCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("rewrap", &options)
+	fs.Parse(args)
+
+	config, err := loadCommandConfiguration(options)
+	if err != nil {
+		return err
+	}
+	r, _, err := openRKMS(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	rewrapped, failed, err := rewrapDataKeys(ctx, r)
+	logger.Infof("rewrapped the data keys of %d ids, %d failed", rewrapped, failed)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to rewrap the data keys of %d ids", failed)
+	}
+	return nil
+}
+
+// runListCommand runs `rkms list`, printing the metadata of every id having the labels of -labels
+func runListCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("list", &options)
+	labelsFlag := fs.String("labels", "", "only list the ids having every one of these labels, e.g. team=billing,env=prod")
+	jsonOutput := fs.Bool("json", false, "print the metadata of an id per line in JSON rather than a table")
+	fs.Parse(args)
+
+	labels, err := parseLabels(*labelsFlag)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadCommandConfiguration(options)
+	if err != nil {
+		return err
+	}
+	r, _, err := openRKMS(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	return listKeyMetadata(ctx, r, labels, *jsonOutput, os.Stdout)
+}
+
+// listKeyMetadata writes the metadata of every id having the labels to w, one id per line
+func listKeyMetadata(ctx context.Context, r *RKMS, labels map[string]string, jsonOutput bool, w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if !jsonOutput {
+		fmt.Fprintln(table, "ID\tVERSION\tSTATE\tKEY SPEC\tCREATED AT\tLABELS")
+	}
+
+	cursor := ""
+	for {
+		metadata, next, err := r.ListKeyMetadata(ctx, labels, cursor, DefaultListIDsLimit)
+		if err != nil {
+			return err
+		}
+
+		for _, idMetadata := range metadata {
+			if jsonOutput {
+				fmt.Fprintln(w, ConstructKeyMetadataResponse(idMetadata))
+				continue
+			}
+
+			createdAt := "-"
+			if !idMetadata.CreatedAt.IsZero() {
+				createdAt = idMetadata.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\t%s\n", idMetadata.ID, idMetadata.Version, idMetadata.State, idMetadata.KeySpec, createdAt, formatLabels(idMetadata.Labels))
+		}
+
+		if next == "" {
+			return table.Flush()
+		}
+		cursor = next
+	}
+}
+
+// parseLabels parses the labels of the command line, comma separated key=value pairs
+func parseLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	if value == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid label %q, labels are comma separated key=value pairs", pair)
+		}
+		labels[pair[:i]] = pair[i+1:]
+	}
+	return labels, checkLabels(labels)
+}
+
+// formatLabels formats the labels the way parseLabels parses them, sorted by key
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// runExportCommand runs `rkms export`, writing the encrypted data keys of every id to -output, wrapped with the
+// export key of -export-key-id too when it is given
+func runExportCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("export", &options)
+	output := fs.String("output", "-", "file or s3://bucket/key to write the export to, - for the standard output")
+	exportKeyID := fs.String("export-key-id", "", "key to wrap the data keys with too, e.g. a KMS key of the disaster recovery account")
+	exportKeyRegion := fs.String("export-key-region", "", "region of the export key")
+	exportKeyProvider := fs.String("export-key-provider", DefaultKeyProviderType, "key provider type of the export key")
+	fs.Parse(args)
+
+	config, err := loadCommandConfiguration(options)
+	if err != nil {
+		return err
+	}
+	r, _, err := openRKMS(config)
+	if err != nil {
+		return err
+	}
+
+	var key *exportKey
+	if *exportKeyID != "" {
+		if key, err = newExportKey(*exportKeyProvider, *exportKeyRegion, *exportKeyID, config.KMS); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	w, err := openExportDestination(ctx, *output, config)
+	if err != nil {
+		return err
+	}
+
+	exported, failed, err := exportEncryptedDataKeys(ctx, r, w, key)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	logger.Infof("exported the encrypted data keys of %d ids, %d failed", exported, failed)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to export the data keys of %d ids", failed)
+	}
+	return nil
+}
+
+// runImportCommand runs `rkms import`, writing the ids of the export of -input into the store of the configuration,
+// those it already has being handled as -on-conflict sets
+func runImportCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("import", &options)
+	input := fs.String("input", "-", "file or s3://bucket/key of the export to import, - for the standard input")
+	onConflict := fs.String("on-conflict", ImportConflictFail, "what to do with the ids the store already has: skip, overwrite or fail")
+	exportKeyID := fs.String("export-key-id", "", "export key the export was made with, to encrypt the data keys again with the keys of the regions")
+	exportKeyRegion := fs.String("export-key-region", "", "region of the export key")
+	exportKeyProvider := fs.String("export-key-provider", DefaultKeyProviderType, "key provider type of the export key")
+	fs.Parse(args)
+
+	switch *onConflict {
+	case ImportConflictSkip, ImportConflictOverwrite, ImportConflictFail:
+	default:
+		return fmt.Errorf("invalid -on-conflict %q, expected %s, %s or %s", *onConflict, ImportConflictSkip, ImportConflictOverwrite, ImportConflictFail)
+	}
+
+	config, err := loadCommandConfiguration(options)
+	if err != nil {
+		return err
+	}
+	r, _, err := openRKMS(config)
+	if err != nil {
+		return err
+	}
+
+	var key *exportKey
+	if *exportKeyID != "" {
+		if key, err = newExportKey(*exportKeyProvider, *exportKeyRegion, *exportKeyID, config.KMS); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	reader, err := openImportSource(ctx, *input, config)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	result, err := importEncryptedDataKeys(ctx, r, reader, *onConflict, key)
+	logger.Infof("imported %d ids, %d skipped, %d failed", result.Imported, result.Skipped, result.Failed)
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("failed to import %d ids", result.Failed)
+	}
+	return nil
+}
+
+// runReplicateCommand runs `rkms replicate`, a pass of the replication of the store into the store of -target-config,
+// store.replication.target_config by default
+func runReplicateCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("replicate", &options)
+	targetConfig := fs.String("target-config", "", "configuration file of the store to mirror the store into, instead of store.replication.target_config")
+	fs.Parse(args)
+
+	config, err := loadCommandConfiguration(options)
+	if err != nil {
+		return err
+	}
+	if *targetConfig == "" {
+		*targetConfig = config.Store.Replication.TargetConfig
+	}
+	if *targetConfig == "" {
+		return fmt.Errorf("the target store is set with -target-config or store.replication.target_config")
+	}
+
+	source, err := NewStore(config)
+	if err != nil {
+		return err
+	}
+	target, err := newReplicationTarget(*targetConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	result, err := replicateStore(ctx, source, target)
+	logger.Infof("replicated the store: %d ids created, %d updated, %d deleted, %d failed", result.Created, result.Updated, result.Deleted, result.Failed)
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("failed to replicate %d ids", result.Failed)
+	}
+	return nil
+}
+
+// runCheckConfigCommand runs `rkms check-config`, failing with every problem of the configuration file
+func runCheckConfigCommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("check-config", &options)
+	fs.Parse(args)
+
+	config, err := LoadConfiguration(options.configFile)
+	if err != nil {
+		return err
+	}
+	if options.storeType != "" {
+		config.Store.Type = options.storeType
+	}
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	fmt.Printf("the configuration file %s is valid\n", options.configFile)
+	return nil
+}
+
+// runOpenAPICommand runs `rkms openapi`, printing the OpenAPI specification of the HTTP API of -api-version, the
+// latest by default, e.g. to generate clients from it without a running rkms
+func runOpenAPICommand(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("openapi", &options)
+	apiVersion := fs.String("api-version", latestAPIVersion, "the version of the API, one of "+strings.Join(apiVersions, ", "))
+	fs.Parse(args)
+
+	if !isAPIVersion(*apiVersion) {
+		return fmt.Errorf("unknown API version %q, the versions are %s", *apiVersion, strings.Join(apiVersions, ", "))
+	}
+
+	_, err := fmt.Fprintf(os.Stdout, "%s\n", newOpenAPISpec(*apiVersion))
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("team=billing,env=")
+	if err != nil || len(labels) != 2 || labels["team"] != "billing" || labels["env"] != "" {
+		t.Fatalf("the labels should have been parsed, got %v: %v", labels, err)
+	}
+	if formatted := formatLabels(labels); formatted != "env=,team=billing" {
+		t.Fatalf("the labels should have been formatted sorted by key, got %q", formatted)
+	}
+
+	for _, value := range []string{"team", "=billing", "team=billing,"} {
+		if _, err := parseLabels(value); err == nil {
+			t.Fatalf("%q should have been refused", value)
+		}
+	}
+}
+
+func TestListCommand(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	for id, team := range map[string]string{"id-0": "billing", "id-1": "search"} {
+		if _, err := r.CreateDataKey(ctx, id, 0, nil); err != nil {
+			t.Fatalf("failed to create the data key: %s", err)
+		}
+		if _, err := r.SetKeyLabels(ctx, id, map[string]string{"team": team}); err != nil {
+			t.Fatalf("failed to set the labels: %s", err)
+		}
+	}
+
+	var table bytes.Buffer
+	if err := listKeyMetadata(ctx, r, nil, false, &table); err != nil {
+		t.Fatalf("failed to list the ids: %s", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "id-0") || !strings.Contains(lines[2], "team=search") {
+		t.Fatalf("a header and a line per id should have been printed, got:\n%s", table.String())
+	}
+
+	var lines bytes.Buffer
+	if err := listKeyMetadata(ctx, r, map[string]string{"team": "billing"}, true, &lines); err != nil {
+		t.Fatalf("failed to list the ids: %s", err)
+	}
+	var listed keyMetadataResponse
+	if err := json.Unmarshal(lines.Bytes(), &listed); err != nil || listed.ID != "id-0" || listed.State != KeyStateEnabled {
+		t.Fatalf("the id labelled team=billing should have been printed in JSON, got %q: %v", lines.String(), err)
+	}
+}
+
+func TestCheckConfigCommand(t *testing.T) {
+	if err := runCheckConfigCommand(commandOptions{configFile: DefaultConfigFile}, nil); err != nil {
+		t.Fatalf("the example configuration should have been valid: %s", err)
+	}
+
+	invalid := writeTestConfigFile(t, "config.toml", "[logger]\n  level = \"verbose\"\n")
+	err := runCheckConfigCommand(commandOptions{configFile: DefaultConfigFile}, []string{"-config", invalid})
+	if err == nil || !strings.Contains(err.Error(), "logger.level") {
+		t.Fatalf("the configuration given after the command should have been refused, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type unavailableStore struct {
+	Store
+}
+
+func (s *unavailableStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	return nil, fmt.Errorf("store is unavailable")
+}
+
+func (s *unavailableStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string) error {
+	return fmt.Errorf("store is unavailable")
+}
+
+func (s *unavailableStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return fmt.Errorf("store is unavailable")
+}
+
+func (s *unavailableStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	return nil, "", fmt.Errorf("store is unavailable")
+}
+
+func TestReplicatedStoreWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext"}
+
+	s, _ := NewReplicatedStore([]Store{&unavailableStore{}, NewMemoryStore(), NewMemoryStore()}, 2)
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", keys); err != nil {
+		t.Fatalf("write should have reached the quorum: %s", err)
+	}
+
+	storedKeys, err := s.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to read from replicated store: %s", err)
+	}
+
+	if !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("read keys are wrong: %v", storedKeys)
+	}
+
+	s, _ = NewReplicatedStore([]Store{&unavailableStore{}, NewMemoryStore(), NewMemoryStore()}, 0)
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", keys); err == nil {
+		t.Fatalf("write should have failed without every store acknowledging it")
+	}
+}
+
+func TestReplicatedStoreReadFallsThroughMissingID(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext"}
+
+	second := NewMemoryStore()
+	second.SetEncryptedDataKeysConditionally(ctx, "id", keys)
+
+	s, _ := NewReplicatedStore([]Store{&unavailableStore{}, NewMemoryStore(), second}, 1)
+	storedKeys, err := s.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to read from replicated store: %s", err)
+	}
+
+	if !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("read keys are wrong: %v", storedKeys)
+	}
+}
+
+func TestReplicatedStoreLostWriteRace(t *testing.T) {
+	ctx := context.Background()
+
+	first := NewMemoryStore()
+	second := NewMemoryStore()
+	second.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "winner"})
+
+	s, _ := NewReplicatedStore([]Store{first, second}, 1)
+	err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "loser"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("write should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+
+	if keys, _ := first.GetEncryptedDataKeys(ctx, "id"); keys != nil {
+		t.Fatalf("keys of the losing write should have been removed, got: %v", keys)
+	}
+}
+
+func TestChainedStoreReadThrough(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext"}
+
+	cache := NewMemoryStore()
+	authoritative := NewMemoryStore()
+	authoritative.SetEncryptedDataKeysConditionally(ctx, "id", keys)
+
+	s, _ := NewChainedStore([]Store{cache, authoritative})
+	storedKeys, err := s.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to read from chained store: %s", err)
+	}
+
+	if !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("read keys are wrong: %v", storedKeys)
+	}
+
+	if cachedKeys, _ := cache.GetEncryptedDataKeys(ctx, "id"); !reflect.DeepEqual(cachedKeys, keys) {
+		t.Fatalf("keys should have been copied to the front store, got: %v", cachedKeys)
+	}
+}
+
+func TestChainedStoreAuthoritativeWrite(t *testing.T) {
+	ctx := context.Background()
+
+	s, _ := NewChainedStore([]Store{&unavailableStore{}, NewMemoryStore()})
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"}); err != nil {
+		t.Fatalf("write should only depend on the authoritative store: %s", err)
+	}
+
+	s, _ = NewChainedStore([]Store{NewMemoryStore(), &unavailableStore{}})
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"}); err == nil {
+		t.Fatalf("write should have failed with the authoritative store down")
+	}
+}
+
+func TestChainedStoreGetBatchReadsMissingIDsThroughTheChain(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemoryStore()
+	authoritative := NewMemoryStore()
+	for _, id := range []string{"a", "b", "c"} {
+		authoritative.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+	cache.SetEncryptedDataKeysConditionally(ctx, "a", map[string]string{"region-0": "a"})
+	authoritative.DeleteEncryptedDataKeys(ctx, "c")
+
+	s, _ := NewChainedStore([]Store{cache, authoritative})
+	keys, err := s.GetEncryptedDataKeysBatch(ctx, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("failed to batch read from chained store: %s", err)
+	}
+
+	expected := map[string]map[string]string{"a": {"region-0": "a"}, "b": {"region-0": "b"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("read keys are wrong: %v", keys)
+	}
+
+	if cachedKeys, _ := cache.GetEncryptedDataKeys(ctx, "b"); cachedKeys == nil {
+		t.Fatalf("keys read through the chain should have been copied to the front store")
+	}
+}
+
+func TestReplicatedStoreListIDsPagesThroughEveryStore(t *testing.T) {
+	ctx := context.Background()
+
+	first := NewMemoryStore()
+	second := NewMemoryStore()
+	for _, id := range []string{"a", "b", "c"} {
+		first.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+	//"d" missed the first store, "b" was written to both
+	for _, id := range []string{"b", "d"} {
+		second.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+
+	s, _ := NewReplicatedStore([]Store{first, second}, 1)
+	ids := make([]string, 0)
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, nextCursor, err := s.ListIDs(ctx, cursor, 2)
+		if err != nil {
+			t.Fatalf("failed to list ids: %s", err)
+		}
+
+		if pages > 3 {
+			t.Fatalf("listing should have ended after 3 pages")
+		}
+
+		ids = append(ids, page...)
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(ids, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("every id should have been listed once, got: %v", ids)
+	}
+
+	if _, _, err := s.ListIDs(ctx, "5:a", 2); err == nil {
+		t.Fatalf("a cursor for a store that does not exist should have been rejected")
+	}
+}
+
+func TestReplicatedStoreUpdateCopiesToEveryStore(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext"}
+
+	first := NewMemoryStore()
+	second := NewMemoryStore()
+	first.SetEncryptedDataKeysConditionally(ctx, "id", keys)
+	//the second store is a version ahead of the first one
+	second.SetEncryptedDataKeysConditionally(ctx, "id", keys)
+	second.UpdateEncryptedDataKeys(ctx, "id", keys, 0)
+
+	s, _ := NewReplicatedStore([]Store{first, second}, 2)
+	if err := s.UpdateEncryptedDataKeys(ctx, "id", map[string]string{"region-0": "rewrapped"}, 0); err != nil {
+		t.Fatalf("failed to update replicated store: %s", err)
+	}
+
+	for i, store := range []Store{first, second} {
+		if storedKeys, _ := store.GetEncryptedDataKeys(ctx, "id"); storedKeys["region-0"] != "rewrapped" {
+			t.Fatalf("store #%d should have been updated, got: %v", i, storedKeys)
+		}
+	}
+
+	if _, ok := s.UpdateEncryptedDataKeys(ctx, "id", keys, 0).(VersionMismatchStoreError); !ok {
+		t.Fatalf("the version of the first store should decide")
+	}
+}
+
+func TestChainedStoreUpdateDropsCachedKeys(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemoryStore()
+	authoritative := NewMemoryStore()
+	s, _ := NewChainedStore([]Store{cache, authoritative})
+	s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"})
+
+	if err := s.UpdateEncryptedDataKeys(ctx, "id", map[string]string{"region-0": "rewrapped"}, 0); err != nil {
+		t.Fatalf("failed to update chained store: %s", err)
+	}
+
+	if keys, _ := s.GetEncryptedDataKeys(ctx, "id"); keys["region-0"] != "rewrapped" {
+		t.Fatalf("reads should not be served stale keys, got: %v", keys)
+	}
+}
@@ -2,64 +2,678 @@ package main
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 
-	logger "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // ServerConfig represents the configuration needed for the server
+// On SIGTERM or SIGINT, the in-flight requests are given ShutdownTimeoutInSeconds to complete before rkms exits.
+// The requests of the HTTP API, but the streaming ones, and the gRPC calls are given RequestTimeoutInMilliseconds
+// (0 gives them no deadline), shared between their calls to the store and the key providers.
+// Every version of the HTTP API is served, under /api/<version>, the deprecated ones being listed in APIVersions;
+// APIVersion, the one version earlier releases served, is accepted but ignored.
+// The OpenAPI specification of the HTTP API is served at /openapi.json, and its Swagger UI at /docs with SwaggerUI.
 type ServerConfig struct {
+	Port                         string
+	APIVersion                   string `mapstructure:"api_version"`
+	ShutdownTimeoutInSeconds     int    `mapstructure:"shutdown_timeout_in_seconds"`
+	RequestTimeoutInMilliseconds int    `mapstructure:"request_timeout_in_milliseconds"`
+	SwaggerUI                    bool   `mapstructure:"swagger_ui"`
+	TLS                          TLSServerConfig
+	GRPC                         GRPCConfig
+	Admin                        AdminConfig
+	UnixSocket                   UnixSocketConfig            `mapstructure:"unix_socket"`
+	APIVersions                  map[string]APIVersionConfig `mapstructure:"api_versions"`
+}
+
+// APIVersionConfig contains the deprecation of a version of the HTTP API, whose responses carry a Deprecation
+// header once DeprecatedAt is set, a Sunset one with SunsetAt, the date the version is to be removed at, and a Link
+// to the migration guide of Link. The dates are of the form 2027-01-31.
+type APIVersionConfig struct {
+	DeprecatedAt string `mapstructure:"deprecated_at"`
+	SunsetAt     string `mapstructure:"sunset_at"`
+	Link         string
+}
+
+// UnixSocketConfig contains the configuration of the Unix domain socket the HTTP API is served on when Path is set,
+// alongside the port or instead of it when Port is empty (sidecar mode), its file being given the octal Mode. The
+// callers of the socket can be authenticated by their peer credentials, see AuthConfig.Peers.
+type UnixSocketConfig struct {
+	Path string
+	Mode string
+}
+
+// TLSServerConfig contains the TLS configuration of the HTTP API, served over TLS when CertFile is set.
+// Clients must present a certificate signed by ClientCAFile when it is set (mutual TLS), and have one of
+// AllowedClientCommonNames as common name when the list isn't empty. The files are read again every
+// ReloadIntervalInSeconds when they changed, so that renewed certificates are used without a restart.
+type TLSServerConfig struct {
+	CertFile                 string   `mapstructure:"cert_file"`
+	KeyFile                  string   `mapstructure:"key_file"`
+	ClientCAFile             string   `mapstructure:"client_ca_file"`
+	AllowedClientCommonNames []string `mapstructure:"allowed_client_common_names"`
+	ReloadIntervalInSeconds  int      `mapstructure:"reload_interval_in_seconds"`
+}
+
+// AdminConfig contains the configuration of the admin server of the debug endpoints (pprof, expvar and
+// goroutine dumps), served on the loopback interface only when Port is set
+type AdminConfig struct {
+	Port string
+}
+
+// GRPCConfig contains the configuration of the gRPC API, served alongside the HTTP one when Port is set, and on
+// the AF_VSOCK VsockPort of every CID when it is set, for the Nitro Enclaves of the instance to call it without a
+// network stack. The server uses TLS when a certificate is configured.
+type GRPCConfig struct {
 	Port       string
-	APIVersion string `mapstructure:"api_version"`
+	VsockPort  uint32 `mapstructure:"vsock_port"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	Reflection bool
 }
 
-// LoggerConfig represents the configuration needed for logging
+// LoggerConfig represents the configuration needed for logging.
+// Format is "text" (default) or "json", key material and ciphertexts being redacted from both.
 type LoggerConfig struct {
-	Level string
+	Level  string
+	Format string
+}
+
+// AuthConfig contains the configuration of the authentication of the callers of the API, enabled when
+// API keys, a JWKS URL or peers of the Unix domain socket are configured, and of the operations each identity
+// is permitted.
+type AuthConfig struct {
+	APIKeys     []APIKeyConfig `mapstructure:"api_keys"`
+	Peers       []PeerConfig
+	JWT         JWTConfig
+	IAM         IAMAuthConfig
+	Grants      GrantsConfig
+	DualControl DualControlConfig `mapstructure:"dual_control"`
+	Permissions []PermissionConfig
+}
+
+// APIKeyConfig - a static API key of an identity, configured by its SHA-256 hash (hexadecimal)
+type APIKeyConfig struct {
+	Identity  string
+	KeySHA256 string `mapstructure:"key_sha256"`
+}
+
+// PeerConfig - the identity of the callers of the Unix domain socket running as UID, or in the group GID, as told
+// by their peer credentials, both having to match when both are set
+type PeerConfig struct {
+	Identity string
+	UID      *int
+	GID      *int
+}
+
+// JWTConfig contains the configuration of the JWT bearer tokens, verified with the keys of JWKSURL, read again
+// every JWKSRefreshIntervalInMinutes. The tokens must have been issued by Issuer and for Audience when they are
+// set, the identity of a token being its IdentityClaim ("sub" by default).
+type JWTConfig struct {
+	JWKSURL                      string `mapstructure:"jwks_url"`
+	Issuer                       string
+	Audience                     string
+	IdentityClaim                string `mapstructure:"identity_claim"`
+	JWKSRefreshIntervalInMinutes int    `mapstructure:"jwks_refresh_interval_in_minutes"`
+}
+
+// IAMAuthConfig contains the configuration of the authentication of the callers by their IAM identity, enabled by
+// Enabled. The GetCallerIdentity requests they sign must include the X-Rkms-Server-Id header with ServerID as
+// its value when it is set.
+type IAMAuthConfig struct {
+	Enabled  bool
+	ServerID string `mapstructure:"server_id"`
+}
+
+// GrantsConfig contains the configuration of the grants, the short-lived tokens delegating operations on an id,
+// enabled by SigningKeyID: the 32 bytes key signing the tokens, "env:<VARIABLE>" or "file:<path>" like the local
+// master keys. A grant lasts MaxTTLInMinutes at most.
+type GrantsConfig struct {
+	SigningKeyID    string `mapstructure:"signing_key_id"`
+	MaxTTLInMinutes int    `mapstructure:"max_ttl_in_minutes"`
+}
+
+// DualControlConfig contains the configuration of the two-person rule: the Actions of the API ("disable",
+// "delete" or "rewrap") applied only once another identity approved them, within ApprovalWindowInMinutes.
+type DualControlConfig struct {
+	Actions                 []string
+	ApprovalWindowInMinutes int `mapstructure:"approval_window_in_minutes"`
+}
+
+// PermissionConfig - the operations an identity is permitted, "*" permitting all of them, on the ids matching one
+// of IDs ("*" matching any characters, e.g. "team-a/*"), or on every id when empty
+type PermissionConfig struct {
+	Identity   string
+	Operations []string
+	IDs        []string
+}
+
+// TenantConfig contains the configuration of a tenant of a deployment serving many teams: its identities can only
+// use the ids of its namespace, "<Name>/...", and its requests are rate limited to RequestsPerSecond with bursts of
+// Burst requests, whatever its identities, when it is set
+type TenantConfig struct {
+	Name              string
+	Identities        []string
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int
+}
+
+// RateLimitConfig contains the configuration of the rate limiting of the requests of every client, by its
+// identity or its IP address (By), to RequestsPerSecond with bursts of Burst requests. The requests aren't rate
+// limited when RequestsPerSecond isn't set.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int
+	By                string
+	Identities        []IdentityRateLimitConfig
+}
+
+// IdentityRateLimitConfig - the rate limit of an identity, instead of the one of RateLimitConfig
+type IdentityRateLimitConfig struct {
+	Identity          string
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int
 }
 
-// KMSConfig contains information for KMS services
+// TracingConfig contains the configuration of the OpenTelemetry tracing, in rkms built with the otel build tag.
+// The spans are exported to the OTLP/gRPC collector of Endpoint, without TLS when Insecure is set; nothing is
+// traced when it is empty. SampleRatio is the ratio of the traces started by rkms that are sampled, the traces
+// of incoming traceparent headers following the sampling decision of their parent.
+type TracingConfig struct {
+	Endpoint    string
+	Insecure    bool
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// FIPSConfig - with Enabled, rkms only starts when its cryptographic module operates in FIPS 140 mode, calls AWS
+// KMS on its FIPS endpoints (kms.use_fips_endpoints defaulting to true), and refuses the settings which aren't FIPS
+// compliant
+type FIPSConfig struct {
+	Enabled bool
+}
+
+// KMSConfig contains information for KMS services.
+// Every region of the redundancy set wraps data keys with the key of KeyIds, using the key provider
+// Providers selects for it, "aws" (an AWS region) by default.
+// The provider of every region is health checked every HealthCheckIntervalInSeconds (0 never checks them),
+// and left out of key creation while unhealthy.
+// A new data key is only saved once encrypted in MinSuccessfulRegions regions, 0 requiring every region
+// it is encrypted in to succeed.
+// Every BackfillIntervalInMinutes (0 never does), data keys missing the ciphertext of a region are
+// encrypted in that region.
+// The data keys of the ids of a key set of KeySets are wrapped with its keys instead of the ones of KeyIds.
+// The calls to the key providers failing on throttling or a transient error are retried as Retry sets, and
+// fail fast while the circuit breaker of their region is open.
+// A data key is decrypted in a region, and in the next one every HedgeDelayInMilliseconds until one of them
+// succeeds, 0 decrypting it in every region at once. New data keys are encrypted in EncryptConcurrency regions at
+// the same time, 0 encrypting them in every region at once.
+// The ciphertexts of the new data keys are saved in WrappedKeyFormat, 1 describing how they were wrapped, 0 saving
+// the bare ciphertexts the versions of rkms before it read; every format is read.
+// With a ShamirThreshold, the new data keys are split with Shamir's scheme into a share by region, any
+// ShamirThreshold of which reconstruct them, every region wrapping its share only; 0 wraps them whole in every region.
+// The latest version of a data key generated more than MaxDataKeyAgeInDays ago, or more than the cryptoperiod of its
+// id when shorter, isn't released until it is rotated; 0 releases the data keys of any age.
+// The requests can have their calls to AWS KMS made with the IAM roles matching one of AssumableRoleARNs ("*"
+// matching any characters), for CloudTrail to show their caller.
+// The AWS KMS calls of a region of RoleARNs are made with the credentials of its role, e.g. of the account of
+// its key.
+// AWS KMS is called on the endpoint of a region of Endpoints, e.g. a VPC interface endpoint, and on the FIPS
+// endpoints of the other regions with UseFIPSEndpoints.
 type KMSConfig struct {
-	Regions            []string
-	KeyIds             map[string]*string `mapstructure:"key_ids"`
-	DataKeySizeInBytes int64              `mapstructure:"data_key_size_in_bytes"`
+	Regions                          []string
+	KeyIds                           map[string]*string `mapstructure:"key_ids"`
+	Providers                        map[string]string  `mapstructure:"providers"`
+	DataKeySizeInBytes               int64              `mapstructure:"data_key_size_in_bytes"`
+	HealthCheckIntervalInSeconds     int                `mapstructure:"health_check_interval_in_seconds"`
+	HealthCheckTimeoutInMilliseconds int                `mapstructure:"health_check_timeout_in_milliseconds"`
+	MinSuccessfulRegions             int                `mapstructure:"min_successful_regions"`
+	BackfillIntervalInMinutes        int                `mapstructure:"backfill_interval_in_minutes"`
+	HedgeDelayInMilliseconds         int                `mapstructure:"hedge_delay_in_milliseconds"`
+	EncryptConcurrency               int                `mapstructure:"encrypt_concurrency"`
+	KeySets                          []KeySetConfig     `mapstructure:"key_sets"`
+	WrappedKeyFormat                 int                `mapstructure:"wrapped_key_format"`
+	ShamirThreshold                  int                `mapstructure:"shamir_threshold"`
+	MaxDataKeyAgeInDays              int                `mapstructure:"max_data_key_age_in_days"`
+	AssumableRoleARNs                []string           `mapstructure:"assumable_role_arns"`
+	RoleARNs                         map[string]string  `mapstructure:"role_arns"`
+	Endpoints                        map[string]string  `mapstructure:"endpoints"`
+	UseFIPSEndpoints                 bool               `mapstructure:"use_fips_endpoints"`
+	Retry                            RetryConfig
+	CircuitBreaker                   CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	PlaintextCache                   PlaintextCacheConfig `mapstructure:"plaintext_cache"`
+	GCP                              GCPKMSConfig
+	Azure                            AzureKeyVaultConfig
+	Vault                            VaultTransitConfig
+	PKCS11                           PKCS11Config
+	KMIP                             KMIPConfig
+}
+
+// PlaintextCacheConfig contains the settings of the cache of the plaintext data keys, disabled with a MaxEntries
+// of 0. A cached data key is served for TTLInSeconds, and MaxUses times at most, 0 leaving it unbounded.
+type PlaintextCacheConfig struct {
+	MaxEntries   int `mapstructure:"max_entries"`
+	TTLInSeconds int `mapstructure:"ttl_in_seconds"`
+	MaxUses      int `mapstructure:"max_uses"`
+}
+
+// KeySetConfig contains the keys of every region wrapping the data keys of the ids starting with IDPrefix, or of
+// the ids of the namespace of Tenant, through the key providers of the regions. The AWS KMS calls of a region of
+// RoleARNs are made with its role rather than the one of the region in KMSConfig.
+type KeySetConfig struct {
+	IDPrefix string             `mapstructure:"id_prefix"`
+	Tenant   string             `mapstructure:"tenant"`
+	KeyIds   map[string]*string `mapstructure:"key_ids"`
+	RoleARNs map[string]string  `mapstructure:"role_arns"`
+}
+
+// AzureKeyVaultConfig contains information for the Azure Key Vault / Managed HSM key provider.
+// The default Azure credential chain is used when ClientSecret is empty.
+// Algorithm is the key wrapping algorithm, RSA-OAEP-256 by default (e.g. A256KW for Managed HSM AES keys).
+type AzureKeyVaultConfig struct {
+	TenantID     string `mapstructure:"tenant_id"`
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	Algorithm    string
+}
+
+// VaultTransitConfig contains information for the HashiCorp Vault Transit key provider.
+// Vault is authenticated with Token, or with an AppRole login when RoleID is set.
+type VaultTransitConfig struct {
+	Address      string
+	Namespace    string
+	Mount        string
+	Token        string
+	RoleID       string `mapstructure:"role_id"`
+	SecretID     string `mapstructure:"secret_id"`
+	AppRoleMount string `mapstructure:"approle_mount"`
+	TLS          TLSClientConfig
+}
+
+// PKCS11Config contains information for the PKCS#11 HSM key provider.
+// Module is the path of the PKCS#11 library of the HSM, the keys being looked up in the token labeled TokenLabel.
+type PKCS11Config struct {
+	Module     string
+	TokenLabel string `mapstructure:"token_label"`
+	PIN        string
+}
+
+// KMIPConfig contains information for the KMIP key provider.
+// ProtocolVersion is 1.4 (default) or 2.0, and TLS is always enabled, with the client certificate
+// the key manager authenticates rkms with.
+type KMIPConfig struct {
+	Address         string
+	ProtocolVersion string `mapstructure:"protocol_version"`
+	TLS             TLSClientConfig
 }
 
-// DynamoDBConfig contains information for DynamoDB used for RKMS
+// GCPKMSConfig contains information for the Google Cloud KMS key provider.
+// Application default credentials are used when CredentialsFile is empty.
+type GCPKMSConfig struct {
+	CredentialsFile string `mapstructure:"credentials_file"`
+}
+
+// RetryConfig contains the retries of the calls failing on throttling or a transient error: up to MaxAttempts
+// calls in all (1 never retries), a random backoff of up to InitialBackoffInMilliseconds doubled on every retry,
+// up to MaxBackoffInMilliseconds, being waited before every retry. Every call is given
+// AttemptTimeoutInMilliseconds at most (0 doesn't cap them), before timing out and being retried.
+type RetryConfig struct {
+	MaxAttempts                  int `mapstructure:"max_attempts"`
+	InitialBackoffInMilliseconds int `mapstructure:"initial_backoff_in_milliseconds"`
+	MaxBackoffInMilliseconds     int `mapstructure:"max_backoff_in_milliseconds"`
+	AttemptTimeoutInMilliseconds int `mapstructure:"attempt_timeout_in_milliseconds"`
+}
+
+// CircuitBreakerConfig contains the circuit breakers of the regions of a dependency: once FailureThreshold calls
+// to a region failed in a row (0 never opens), its calls fail fast for OpenDurationInSeconds before a single call
+// probes it again.
+type CircuitBreakerConfig struct {
+	FailureThreshold      int `mapstructure:"failure_threshold"`
+	OpenDurationInSeconds int `mapstructure:"open_duration_in_seconds"`
+}
+
+// StoreConfig selects the key/value store used for the encrypted data keys.
+// Deleted ids are purged once they have been deleted for DeletedRetentionInHours, 0 keeps them forever.
+// Every PurgeIntervalInMinutes, the data keys whose scheduled deletion is due are deleted, and the deleted ids purged.
+// The requests to the store failing on throttling or a transient error are retried as Retry sets.
+// The caches are warmed up on startup as WarmUp sets, and the store is mirrored into another one as Replication sets.
+type StoreConfig struct {
+	Type                    string `mapstructure:"type"`
+	DeletedRetentionInHours int    `mapstructure:"deleted_retention_in_hours"`
+	PurgeIntervalInMinutes  int    `mapstructure:"purge_interval_in_minutes"`
+	Retry                   RetryConfig
+	WarmUp                  CacheWarmUpConfig      `mapstructure:"warm_up"`
+	Replication             StoreReplicationConfig `mapstructure:"replication"`
+}
+
+// StoreReplicationConfig contains the settings of the replication of the store, disabled without TargetConfig.
+// Every IntervalInSeconds, the store is mirrored into the store of the configuration file TargetConfig, e.g. a
+// DynamoDB table of another region or account, only the store settings of that file being used.
+type StoreReplicationConfig struct {
+	TargetConfig      string `mapstructure:"target_config"`
+	IntervalInSeconds int    `mapstructure:"interval_in_seconds"`
+}
+
+// CacheWarmUpConfig contains the settings of the warm-up of the caches on startup, disabled with a MaxIDs of 0.
+// Up to MaxIDs ids are read from the store, and decrypted when the plaintext data keys are cached, before /readyz
+// passes, or TimeoutInSeconds passed. They are the ids the store used most recently, saved to IDsFile on shutdown,
+// or the first ids of the store without IDsFile.
+type CacheWarmUpConfig struct {
+	MaxIDs           int    `mapstructure:"max_ids"`
+	IDsFile          string `mapstructure:"ids_file"`
+	TimeoutInSeconds int    `mapstructure:"timeout_in_seconds"`
+}
+
+// DynamoDBConfig contains information for DynamoDB used for RKMS.
+// ReplicaRegions lists the other regions of a Global Table, in the order the reads are failed over to; the writes
+// are only made to Region, for the conditional ones not to pass in two regions replicating asynchronously.
+// DAXEndpoints are the endpoints of a DAX cluster (in Region) used to serve reads.
+// Endpoint overrides the DynamoDB endpoint of every region, e.g. to target DynamoDB Local or LocalStack,
+// and AccessKeyID/SecretAccessKey replace the default credential chain with static credentials.
+// A region whose circuit breaker is open is failed over to the next one without being called.
+// The items read are cached for CacheExpiration minutes, the cache keeping at most CacheMaxEntries items and an
+// estimate of CacheMaxSizeInMegabytes, 0 leaving either unbounded, and evicting the least recently used ones past them.
+// The ids read as missing are cached as such for NegativeCacheExpirationInSeconds, 0 disabling it.
+// The cache entries are invalidated in the other replicas of rkms as CacheInvalidation sets.
+// ReadConsistency is the consistency of the reads of the ids which aren't cached, eventual or strong, unless a
+// request asks for another one; the versioned reads of the updates are always strongly consistent.
+// The requests to a region of RoleARNs, Region or one of ReplicaRegions, are made with the credentials of its role.
 type DynamoDBConfig struct {
-	Region               string `mapstructure:"region"`
-	TableName            string `mapstructure:"table_name"`
-	CacheExpiration      int    `mapstructure:"cache_expiration_in_minutes"`
-	CacheCleanupInterval int    `mapstructure:"cache_cleanup_internal_in_minutes"`
+	Region                           string                  `mapstructure:"region"`
+	ReplicaRegions                   []string                `mapstructure:"replica_regions"`
+	TableName                        string                  `mapstructure:"table_name"`
+	CreateTableIfMissing             bool                    `mapstructure:"create_table_if_missing"`
+	DAXEndpoints                     []string                `mapstructure:"dax_endpoints"`
+	CacheExpiration                  int                     `mapstructure:"cache_expiration_in_minutes"`
+	CacheCleanupInterval             int                     `mapstructure:"cache_cleanup_internal_in_minutes"`
+	CacheMaxEntries                  int                     `mapstructure:"cache_max_entries"`
+	CacheMaxSizeInMegabytes          int                     `mapstructure:"cache_max_size_in_megabytes"`
+	NegativeCacheExpirationInSeconds int                     `mapstructure:"negative_cache_expiration_in_seconds"`
+	Endpoint                         string                  `mapstructure:"endpoint"`
+	AccessKeyID                      string                  `mapstructure:"access_key_id"`
+	SecretAccessKey                  string                  `mapstructure:"secret_access_key"`
+	CircuitBreaker                   CircuitBreakerConfig    `mapstructure:"circuit_breaker"`
+	CacheInvalidation                CacheInvalidationConfig `mapstructure:"cache_invalidation"`
+	ReadConsistency                  string                  `mapstructure:"read_consistency"`
+	RoleARNs                         map[string]string       `mapstructure:"role_arns"`
+}
+
+// CacheInvalidationConfig contains the settings of the propagation of the cache invalidations between the replicas
+// of rkms, published on the Redis pub/sub Channel, or read from the DynamoDB stream of the table as Streams sets,
+// and disabled without Redis addresses nor Streams enabled
+type CacheInvalidationConfig struct {
+	Redis   RedisConfig
+	Channel string `mapstructure:"channel"`
+	Streams DynamoDBStreamsConfig
+}
+
+// DynamoDBStreamsConfig contains the settings of the consumer of the DynamoDB stream of the table, whose shards are
+// read every PollIntervalInMilliseconds for the ids written by the other replicas or the commands
+type DynamoDBStreamsConfig struct {
+	Enabled                    bool
+	PollIntervalInMilliseconds int `mapstructure:"poll_interval_in_milliseconds"`
+}
+
+// TLSClientConfig contains the TLS settings used when connecting to a store or provider
+type TLSClientConfig struct {
+	Enabled            bool
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// RedisConfig contains information for the Redis store.
+// A single address is a standalone server, several addresses are a Redis Cluster
+// and setting MasterName makes the addresses a list of Sentinels.
+type RedisConfig struct {
+	Addrs      []string
+	MasterName string `mapstructure:"master_name"`
+	Password   string
+	DB         int
+	KeyPrefix  string `mapstructure:"key_prefix"`
+	TLS        TLSClientConfig
+}
+
+// PostgresConfig contains information for the PostgreSQL store
+type PostgresConfig struct {
+	URL                         string
+	TableName                   string `mapstructure:"table_name"`
+	MaxOpenConnections          int    `mapstructure:"max_open_connections"`
+	MaxIdleConnections          int    `mapstructure:"max_idle_connections"`
+	ConnectionLifetimeInMinutes int    `mapstructure:"connection_lifetime_in_minutes"`
+	SkipMigrations              bool   `mapstructure:"skip_migrations"`
+}
+
+// S3Config contains information for the S3 store.
+// ServerSideEncryption is either empty, "AES256" or "aws:kms" (with an optional SSEKMSKeyID).
+type S3Config struct {
+	Region               string
+	Bucket               string
+	Prefix               string
+	ServerSideEncryption string `mapstructure:"server_side_encryption"`
+	SSEKMSKeyID          string `mapstructure:"sse_kms_key_id"`
+}
+
+// EtcdConfig contains information for the etcd v3 store
+type EtcdConfig struct {
+	Endpoints            []string
+	Username             string
+	Password             string
+	DialTimeoutInSeconds int    `mapstructure:"dial_timeout_in_seconds"`
+	KeyPrefix            string `mapstructure:"key_prefix"`
+	TLS                  TLSClientConfig
+}
+
+// CassandraConfig contains information for the Cassandra/ScyllaDB store
+type CassandraConfig struct {
+	Hosts             []string
+	Keyspace          string
+	TableName         string `mapstructure:"table_name"`
+	LocalDC           string `mapstructure:"local_dc"`
+	Consistency       string
+	SerialConsistency string `mapstructure:"serial_consistency"`
+	Username          string
+	Password          string
+	TLS               TLSClientConfig
+}
+
+// MongoDBConfig contains information for the MongoDB store.
+// WriteConcern is "majority" or a number of nodes, ReadPreference is a read preference mode name.
+type MongoDBConfig struct {
+	URI            string
+	Database       string
+	Collection     string
+	WriteConcern   string `mapstructure:"write_concern"`
+	ReadPreference string `mapstructure:"read_preference"`
+}
+
+// BoltConfig contains information for the embedded BoltDB store
+type BoltConfig struct {
+	Path                 string
+	Bucket               string
+	LockTimeoutInSeconds int `mapstructure:"lock_timeout_in_seconds"`
+}
+
+// FirestoreConfig contains information for the Google Cloud Firestore store.
+// Application default credentials are used when CredentialsFile is empty.
+type FirestoreConfig struct {
+	ProjectID       string `mapstructure:"project_id"`
+	Collection      string
+	CredentialsFile string `mapstructure:"credentials_file"`
+}
+
+// CosmosDBConfig contains information for the Azure Cosmos DB (SQL API) store.
+// The container is expected to use /id as its partition key path.
+type CosmosDBConfig struct {
+	Endpoint  string
+	Key       string
+	Database  string
+	Container string
+}
+
+// ReplicatedConfig contains information for the replicated store.
+// Stores are store types, a WriteQuorum of 0 means every store has to acknowledge a write.
+type ReplicatedConfig struct {
+	Stores      []string
+	WriteQuorum int `mapstructure:"write_quorum"`
+}
+
+// ChainedConfig contains information for the chained store.
+// Stores are store types ordered from the fastest to the authoritative (last) one.
+type ChainedConfig struct {
+	Stores []string
 }
 
 // Configuration represents all the configuration information this application needss
 type Configuration struct {
-	Server   ServerConfig
-	Logger   LoggerConfig
-	KMS      KMSConfig
-	DynamoDB DynamoDBConfig
+	Server     ServerConfig
+	Logger     LoggerConfig
+	Tracing    TracingConfig
+	FIPS       FIPSConfig
+	Auth       AuthConfig
+	RateLimit  RateLimitConfig `mapstructure:"rate_limit"`
+	Tenants    []TenantConfig
+	KMS        KMSConfig
+	Store      StoreConfig
+	DynamoDB   DynamoDBConfig
+	Redis      RedisConfig
+	Postgres   PostgresConfig
+	S3         S3Config
+	Etcd       EtcdConfig
+	Cassandra  CassandraConfig
+	MongoDB    MongoDBConfig
+	Bolt       BoltConfig
+	Firestore  FirestoreConfig
+	CosmosDB   CosmosDBConfig
+	Replicated ReplicatedConfig
+	Chained    ChainedConfig
 }
 
-// LoadConfiguration loads config file into memory and creates a Configuration object out of the information
-func LoadConfiguration() *Configuration {
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	viper.SetConfigType("toml")
+// DefaultConfigFile is the configuration file read when none is given, its format being the one of its extension
+// (toml, yaml or json)
+const DefaultConfigFile = "config.toml"
+
+// EnvPrefix prefixes the environment variables overriding the settings of the configuration file, the variable of
+// a setting being its key in upper case with underscores, e.g. RKMS_DYNAMODB_TABLE_NAME for dynamodb.table_name
+const EnvPrefix = "RKMS"
+
+// LoadConfiguration reads the configuration file of the given path, overridden by the environment variables of
+// its settings, into a Configuration. Unknown settings are rejected, for the misspelled ones not to be silently
+// ignored; the Configuration is to be validated with Validate once the command line overrides are applied.
+func LoadConfiguration(path string) (*Configuration, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetDefault("logger.level", "info")
+	v.SetDefault("server.shutdown_timeout_in_seconds", 30)
+	v.SetDefault("server.request_timeout_in_milliseconds", 10000)
+	v.SetDefault("server.tls.reload_interval_in_seconds", 60)
+	v.SetDefault("server.grpc.reflection", true)
+	v.SetDefault("server.unix_socket.mode", "0660")
+	v.SetDefault("tracing.service_name", "rkms")
+	v.SetDefault("auth.jwt.identity_claim", "sub")
+	v.SetDefault("auth.jwt.jwks_refresh_interval_in_minutes", 60)
+	v.SetDefault("auth.grants.max_ttl_in_minutes", 60)
+	v.SetDefault("auth.dual_control.approval_window_in_minutes", 60)
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetDefault("store.type", DefaultStoreType)
+	v.SetDefault("store.deleted_retention_in_hours", 30*24)
+	v.SetDefault("store.purge_interval_in_minutes", 60)
+	v.SetDefault("store.replication.interval_in_seconds", 300)
+	v.SetDefault("store.retry.max_attempts", 3)
+	v.SetDefault("store.retry.initial_backoff_in_milliseconds", 50)
+	v.SetDefault("store.retry.max_backoff_in_milliseconds", 1000)
+	v.SetDefault("store.retry.attempt_timeout_in_milliseconds", 1000)
+	v.SetDefault("redis.key_prefix", "rkms:")
+	v.SetDefault("postgres.table_name", "rkms_keys")
+	v.SetDefault("postgres.max_open_connections", 10)
+	v.SetDefault("postgres.max_idle_connections", 5)
+	v.SetDefault("postgres.connection_lifetime_in_minutes", 30)
+	v.SetDefault("etcd.dial_timeout_in_seconds", 5)
+	v.SetDefault("etcd.key_prefix", "/rkms/keys/")
+	v.SetDefault("cassandra.table_name", "rkms_keys")
+	v.SetDefault("cassandra.consistency", "LOCAL_QUORUM")
+	v.SetDefault("cassandra.serial_consistency", "SERIAL")
+	v.SetDefault("mongodb.database", "rkms")
+	v.SetDefault("mongodb.collection", "keys")
+	v.SetDefault("mongodb.write_concern", "majority")
+	v.SetDefault("mongodb.read_preference", "primary")
+	v.SetDefault("bolt.path", "rkms.db")
+	v.SetDefault("bolt.bucket", "keys")
+	v.SetDefault("bolt.lock_timeout_in_seconds", 5)
+	v.SetDefault("firestore.collection", "rkms_keys")
+	v.SetDefault("cosmosdb.database", "rkms")
+	v.SetDefault("cosmosdb.container", "keys")
+	v.SetDefault("kms.data_key_size_in_bytes", 32)
+	v.SetDefault("kms.health_check_interval_in_seconds", 30)
+	v.SetDefault("kms.health_check_timeout_in_milliseconds", 2000)
+	v.SetDefault("kms.backfill_interval_in_minutes", 60)
+	v.SetDefault("kms.hedge_delay_in_milliseconds", 100)
+	v.SetDefault("kms.wrapped_key_format", LatestWrappedKeyFormat)
+	v.SetDefault("kms.retry.max_attempts", 3)
+	v.SetDefault("kms.retry.initial_backoff_in_milliseconds", 50)
+	v.SetDefault("kms.retry.max_backoff_in_milliseconds", 1000)
+	v.SetDefault("kms.retry.attempt_timeout_in_milliseconds", 2000)
+	v.SetDefault("kms.circuit_breaker.failure_threshold", 5)
+	v.SetDefault("kms.circuit_breaker.open_duration_in_seconds", 30)
+	v.SetDefault("kms.plaintext_cache.ttl_in_seconds", 60)
+	v.SetDefault("store.warm_up.timeout_in_seconds", 60)
+	v.SetDefault("dynamodb.cache_max_entries", 100000)
+	v.SetDefault("dynamodb.cache_max_size_in_megabytes", 64)
+	v.SetDefault("dynamodb.negative_cache_expiration_in_seconds", 5)
+	v.SetDefault("dynamodb.read_consistency", ReadConsistencyEventual)
+	v.SetDefault("dynamodb.cache_invalidation.channel", "rkms:invalidations")
+	v.SetDefault("dynamodb.cache_invalidation.streams.poll_interval_in_milliseconds", 1000)
+	v.SetDefault("dynamodb.circuit_breaker.failure_threshold", 5)
+	v.SetDefault("dynamodb.circuit_breaker.open_duration_in_seconds", 30)
+	v.SetDefault("kms.vault.mount", "transit")
+	v.SetDefault("kms.vault.approle_mount", "approle")
+
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnvs(v, "", reflect.TypeOf(Configuration{}))
 
-	if err := viper.ReadInConfig(); err != nil {
-		logger.Fatalf("fatal error while reading config file: %s", err)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("was not able to read the configuration file %s: %s", path, err)
 	}
 
 	config := new(Configuration)
-	viper.Unmarshal(&config)
-	logger.Infof("loaded configuration: %+v\n", *config)
-
-	if err := verifyKMSConfig(config.KMS); err != nil {
-		logger.Fatal(err)
+	if err := v.UnmarshalExact(config); err != nil {
+		return nil, fmt.Errorf("was not able to load the configuration file %s: %s", path, err)
+	}
+	if config.FIPS.Enabled && !v.IsSet("kms.use_fips_endpoints") {
+		config.KMS.UseFIPSEndpoints = true
 	}
+	return config, nil
+}
 
-	return config
+// bindEnvs binds the settings of the fields of t, and of its nested structs, to their environment variable, viper
+// only reading the variables of the settings set in the file or with a default otherwise. The settings of maps
+// and lists of structs can only be set in the file.
+func bindEnvs(v *viper.Viper, prefix string, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("mapstructure")
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		key = prefix + key
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			bindEnvs(v, key+".", field.Type)
+		case reflect.Map:
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.String {
+				v.BindEnv(key)
+			}
+		default:
+			v.BindEnv(key)
+		}
+	}
 }
 
 func verifyKMSConfig(kmsConfig KMSConfig) error {
@@ -72,10 +686,69 @@ func verifyKMSConfig(kmsConfig KMSConfig) error {
 	}
 
 	for _, region := range kmsConfig.Regions {
+		if strings.Contains(region, dataKeyVersionSeparator) {
+			return fmt.Errorf("KMS region %s can't contain %q, it separates regions from data key versions in the store", region, dataKeyVersionSeparator)
+		}
+
 		if kmsConfig.KeyIds[region] == nil {
 			return fmt.Errorf("region %s exists in KMS regions array but not in the KMS KeyIds map", region)
 		}
 	}
 
+	if kmsConfig.MinSuccessfulRegions < 0 || kmsConfig.MinSuccessfulRegions > len(kmsConfig.Regions) {
+		return fmt.Errorf("KMS min_successful_regions (%d) must be between 0 and the number of KMS regions (%d)", kmsConfig.MinSuccessfulRegions, len(kmsConfig.Regions))
+	}
+
+	if err := verifyRoleARNs(kmsConfig.RoleARNs, kmsConfig.Regions); err != nil {
+		return err
+	}
+
+	for region := range kmsConfig.Endpoints {
+		if kmsConfig.KeyIds[region] == nil {
+			return fmt.Errorf("region %s exists in KMS Endpoints map but not in the KMS regions array", region)
+		}
+		if providerType := kmsConfig.Providers[region]; providerType != "" && providerType != DefaultKeyProviderType {
+			return fmt.Errorf("region %s has a KMS endpoint but its provider is %q, not %q", region, providerType, DefaultKeyProviderType)
+		}
+	}
+	for _, region := range kmsConfig.Regions {
+		if providerType := kmsConfig.Providers[region]; providerType == "" || providerType == DefaultKeyProviderType {
+			if _, err := awsKMSEndpoint(kmsConfig, region); err != nil {
+				return err
+			}
+		}
+	}
+
+	for region := range kmsConfig.Providers {
+		if kmsConfig.KeyIds[region] == nil {
+			return fmt.Errorf("region %s exists in KMS Providers map but not in the KMS regions array", region)
+		}
+	}
+
+	prefixes := make(map[string]bool, len(kmsConfig.KeySets))
+	for _, keySet := range kmsConfig.KeySets {
+		if (keySet.IDPrefix == "") == (keySet.Tenant == "") {
+			return fmt.Errorf("a KMS key set must have either an id_prefix or a tenant, got %q and %q", keySet.IDPrefix, keySet.Tenant)
+		}
+
+		prefix := keySet.prefix()
+		if prefixes[prefix] {
+			return fmt.Errorf("more than one KMS key set is for the ids starting with %q", prefix)
+		}
+		prefixes[prefix] = true
+
+		if len(keySet.KeyIds) != len(kmsConfig.Regions) {
+			return fmt.Errorf("the KMS key set of %q has %d keyIds, one per KMS region (%d) is required", prefix, len(keySet.KeyIds), len(kmsConfig.Regions))
+		}
+		for _, region := range kmsConfig.Regions {
+			if keySet.KeyIds[region] == nil {
+				return fmt.Errorf("region %s exists in KMS regions array but not in the KeyIds map of the KMS key set of %q", region, prefix)
+			}
+		}
+		if err := verifyRoleARNs(keySet.RoleARNs, kmsConfig.Regions); err != nil {
+			return fmt.Errorf("the KMS key set of %q: %s", prefix, err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("was not able to write the configuration file: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigurationExample(t *testing.T) {
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("the example configuration should be valid: %s", err)
+	}
+}
+
+func TestLoadConfigurationEnvOverrides(t *testing.T) {
+	t.Setenv("RKMS_DYNAMODB_TABLE_NAME", "rkms_keys_staging")
+	t.Setenv("RKMS_SERVER_GRPC_PORT", "9090")
+	t.Setenv("RKMS_KMS_REGIONS", "us-east-1,us-east-2,us-west-1")
+
+	config, err := LoadConfiguration(writeTestConfigFile(t, "config.toml", `
+[server]
+  port = "8080"
+
+[dynamodb]
+  table_name = "rkms_keys"
+`))
+	if err != nil {
+		t.Fatalf("was not able to load the configuration: %s", err)
+	}
+
+	if config.DynamoDB.TableName != "rkms_keys_staging" {
+		t.Fatalf("the setting of the file should have been overridden, got %q", config.DynamoDB.TableName)
+	}
+	if config.Server.GRPC.Port != "9090" || len(config.KMS.Regions) != 3 {
+		t.Fatalf("the settings missing from the file should have been set, got %q and %v", config.Server.GRPC.Port, config.KMS.Regions)
+	}
+	if config.Server.Port != "8080" || config.Server.ShutdownTimeoutInSeconds != 30 {
+		t.Fatalf("the settings of the file and the defaults should have been kept, got %+v", config.Server)
+	}
+}
+
+func TestLoadConfigurationFormats(t *testing.T) {
+	config, err := LoadConfiguration(writeTestConfigFile(t, "config.yaml", "server:\n  port: \"8080\"\n"))
+	if err != nil || config.Server.Port != "8080" {
+		t.Fatalf("the YAML configuration should have been loaded, got %v", err)
+	}
+
+	if _, err := LoadConfiguration(writeTestConfigFile(t, "config.toml", "[server]\n  prot = \"8080\"\n")); err == nil {
+		t.Fatalf("the misspelled setting should have been rejected")
+	}
+
+	if _, err := LoadConfiguration(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Fatalf("a missing configuration file should have been an error")
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+	config.Server.Port = ""
+	config.Server.TLS.CertFile = "server.pem"
+	config.Store.Type = "replicated"
+	config.Replicated.Stores = []string{"dynamodb", "does-not-exist"}
+	config.Replicated.WriteQuorum = 3
+	config.DynamoDB.TableName = ""
+	config.Logger.Level = "verbose"
+
+	err = config.Validate()
+	configErr, ok := err.(ConfigurationError)
+	if !ok {
+		t.Fatalf("expected a ConfigurationError, got %v", err)
+	}
+
+	for _, expected := range []string{"server.port", "server.tls.key_file", "replicated.write_quorum", "dynamodb.table_name", "\"does-not-exist\"", "logger.level"} {
+		if !strings.Contains(configErr.Error(), expected) {
+			t.Errorf("the problems should have included %s, got: %s", expected, configErr)
+		}
+	}
+}
+
+func TestValidateStreamsCacheInvalidation(t *testing.T) {
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+	config.DynamoDB.CacheInvalidation.Streams.Enabled = true
+	config.DynamoDB.CacheInvalidation.Redis.Addrs = []string{"localhost:6379"}
+
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "can't be set together") {
+		t.Fatalf("the stream and Redis shouldn't have been accepted together, got %v", err)
+	}
+
+	config.DynamoDB.CacheInvalidation.Redis.Addrs = nil
+	if err := config.Validate(); err != nil {
+		t.Fatalf("the stream should have been accepted alone: %s", err)
+	}
+}
+
+func TestValidateAPIVersion(t *testing.T) {
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+
+	config.Server.APIVersion = "v3"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "server.api_version") {
+		t.Fatalf("an API version that isn't served shouldn't have been accepted, got %v", err)
+	}
+
+	config.Server.APIVersion = APIVersion1
+	config.Server.APIVersions = map[string]APIVersionConfig{"v3": {DeprecatedAt: "2026-10-01"}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "server.api_versions") {
+		t.Fatalf("the deprecation of a version that isn't served shouldn't have been accepted, got %v", err)
+	}
+
+	config.Server.APIVersions = nil
+	if err := config.Validate(); err != nil {
+		t.Fatalf("a served API version should have been accepted: %s", err)
+	}
+}
+
+func TestFIPSMode(t *testing.T) {
+	defer func() { fipsCryptoModule = cryptoModule }()
+	fipsCryptoModule = func() (string, bool) { return "test module", false }
+	t.Setenv("RKMS_FIPS_ENABLED", "true")
+
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+	if !config.FIPS.Enabled || !config.KMS.UseFIPSEndpoints {
+		t.Fatalf("the FIPS mode should have called KMS on its FIPS endpoints")
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "fips140=on") {
+		t.Fatalf("the FIPS mode shouldn't have been accepted without a FIPS module, got %v", err)
+	}
+
+	fipsCryptoModule = func() (string, bool) { return "test module", true }
+	if err := config.Validate(); err != nil {
+		t.Fatalf("the FIPS mode should have been accepted with a FIPS module: %s", err)
+	}
+
+	config.KMS.UseFIPSEndpoints = false
+	config.KMS.Endpoints = map[string]string{config.KMS.Regions[0]: "https://vpce-0123456789abcdef0-abcdefgh.kms." + config.KMS.Regions[0] + ".vpce.amazonaws.com"}
+	config.KMS.ShamirThreshold = 2
+	config.DynamoDB.Endpoint = "http://localhost:8000"
+	err = config.Validate()
+	for _, expected := range []string{"kms.use_fips_endpoints", "kms.endpoints", "kms.shamir_threshold", "dynamodb.endpoint"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("the problems should have included %s, got: %v", expected, err)
+		}
+	}
+}
+
+func TestValidateShamirThreshold(t *testing.T) {
+	config, err := LoadConfiguration(DefaultConfigFile)
+	if err != nil {
+		t.Fatalf("was not able to load the example configuration: %s", err)
+	}
+
+	config.KMS.ShamirThreshold = len(config.KMS.Regions) + 1
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "kms.shamir_threshold") {
+		t.Fatalf("a threshold above the number of regions shouldn't have been accepted, got %v", err)
+	}
+
+	config.KMS.ShamirThreshold = len(config.KMS.Regions)
+	config.KMS.WrappedKeyFormat = WrappedKeyFormatBare
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "kms.wrapped_key_format") {
+		t.Fatalf("the shares shouldn't have been accepted bare, got %v", err)
+	}
+
+	config.KMS.WrappedKeyFormat = WrappedKeyFormatDescribed
+	if err := config.Validate(); err != nil {
+		t.Fatalf("a threshold of every region should have been accepted: %s", err)
+	}
+}
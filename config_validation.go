@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// ConfigurationError lists every problem of a configuration, for all of them to be fixed at once rather than
+// one restart at a time
+type ConfigurationError struct {
+	Problems []string
+}
+
+func (e ConfigurationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// requiredSetting - a setting, by its configuration key, and whether it is set
+type requiredSetting struct {
+	name string
+	set  bool
+}
+
+// requiredStoreSettings lists the settings every store type can't be created without
+var requiredStoreSettings = map[string]func(config *Configuration) []requiredSetting{
+	"dynamodb": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"dynamodb.region", config.DynamoDB.Region != ""}, {"dynamodb.table_name", config.DynamoDB.TableName != ""}}
+	},
+	"redis": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"redis.addrs", len(config.Redis.Addrs) > 0}}
+	},
+	"postgres": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"postgres.url", config.Postgres.URL != ""}}
+	},
+	"s3": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"s3.region", config.S3.Region != ""}, {"s3.bucket", config.S3.Bucket != ""}}
+	},
+	"etcd": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"etcd.endpoints", len(config.Etcd.Endpoints) > 0}}
+	},
+	"cassandra": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"cassandra.hosts", len(config.Cassandra.Hosts) > 0}, {"cassandra.keyspace", config.Cassandra.Keyspace != ""}}
+	},
+	"mongodb": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"mongodb.uri", config.MongoDB.URI != ""}}
+	},
+	"bolt": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"bolt.path", config.Bolt.Path != ""}}
+	},
+	"firestore": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"firestore.project_id", config.Firestore.ProjectID != ""}}
+	},
+	"cosmosdb": func(config *Configuration) []requiredSetting {
+		return []requiredSetting{{"cosmosdb.endpoint", config.CosmosDB.Endpoint != ""}}
+	},
+}
+
+// Validate checks the configuration as a whole, returning a ConfigurationError listing all of its missing and
+// inconsistent settings
+func (c *Configuration) Validate() error {
+	problems := make([]string, 0)
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	c.validateServer(problemf)
+	c.validateFIPS(problemf)
+
+	if _, err := logger.ParseLevel(c.Logger.Level); err != nil {
+		problemf("logger.level: %s", err)
+	}
+	if _, err := newLogFormatter(c.Logger.Format); err != nil {
+		problemf("logger.format: %s", err)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problemf("tracing.sample_ratio (%g) must be between 0 and 1", c.Tracing.SampleRatio)
+	}
+
+	if err := verifyKMSConfig(c.KMS); err != nil {
+		problemf("kms: %s", err)
+	} else if err := verifyKeySetTenants(c.KMS, c.Tenants); err != nil {
+		problemf("kms: %s", err)
+	}
+	if c.KMS.DataKeySizeInBytes <= 0 {
+		problemf("kms.data_key_size_in_bytes must be greater than 0")
+	}
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"kms.health_check_interval_in_seconds", c.KMS.HealthCheckIntervalInSeconds},
+		{"kms.backfill_interval_in_minutes", c.KMS.BackfillIntervalInMinutes},
+		{"kms.hedge_delay_in_milliseconds", c.KMS.HedgeDelayInMilliseconds},
+		{"kms.encrypt_concurrency", c.KMS.EncryptConcurrency},
+		{"store.deleted_retention_in_hours", c.Store.DeletedRetentionInHours},
+		{"dynamodb.cache_expiration_in_minutes", c.DynamoDB.CacheExpiration},
+		{"dynamodb.cache_cleanup_internal_in_minutes", c.DynamoDB.CacheCleanupInterval},
+		{"dynamodb.cache_max_entries", c.DynamoDB.CacheMaxEntries},
+		{"dynamodb.cache_max_size_in_megabytes", c.DynamoDB.CacheMaxSizeInMegabytes},
+		{"dynamodb.negative_cache_expiration_in_seconds", c.DynamoDB.NegativeCacheExpirationInSeconds},
+		{"dynamodb.cache_invalidation.streams.poll_interval_in_milliseconds", c.DynamoDB.CacheInvalidation.Streams.PollIntervalInMilliseconds},
+		{"server.request_timeout_in_milliseconds", c.Server.RequestTimeoutInMilliseconds},
+		{"kms.retry.initial_backoff_in_milliseconds", c.KMS.Retry.InitialBackoffInMilliseconds},
+		{"kms.retry.max_backoff_in_milliseconds", c.KMS.Retry.MaxBackoffInMilliseconds},
+		{"store.retry.initial_backoff_in_milliseconds", c.Store.Retry.InitialBackoffInMilliseconds},
+		{"store.retry.max_backoff_in_milliseconds", c.Store.Retry.MaxBackoffInMilliseconds},
+		{"kms.retry.attempt_timeout_in_milliseconds", c.KMS.Retry.AttemptTimeoutInMilliseconds},
+		{"store.retry.attempt_timeout_in_milliseconds", c.Store.Retry.AttemptTimeoutInMilliseconds},
+		{"kms.circuit_breaker.failure_threshold", c.KMS.CircuitBreaker.FailureThreshold},
+		{"dynamodb.circuit_breaker.failure_threshold", c.DynamoDB.CircuitBreaker.FailureThreshold},
+		{"kms.plaintext_cache.max_entries", c.KMS.PlaintextCache.MaxEntries},
+		{"kms.plaintext_cache.max_uses", c.KMS.PlaintextCache.MaxUses},
+		{"store.warm_up.max_ids", c.Store.WarmUp.MaxIDs},
+	} {
+		if setting.value < 0 {
+			problemf("%s (%d) can't be negative", setting.name, setting.value)
+		}
+	}
+	if c.KMS.HealthCheckIntervalInSeconds > 0 && c.KMS.HealthCheckTimeoutInMilliseconds <= 0 {
+		problemf("kms.health_check_timeout_in_milliseconds must be greater than 0 when the providers are health checked")
+	}
+	if c.KMS.WrappedKeyFormat < WrappedKeyFormatBare || c.KMS.WrappedKeyFormat > LatestWrappedKeyFormat {
+		problemf("kms.wrapped_key_format (%d) must be between %d and %d", c.KMS.WrappedKeyFormat, WrappedKeyFormatBare, LatestWrappedKeyFormat)
+	}
+	if c.KMS.MaxDataKeyAgeInDays < 0 {
+		problemf("kms.max_data_key_age_in_days (%d) can't be negative", c.KMS.MaxDataKeyAgeInDays)
+	}
+	if threshold := c.KMS.ShamirThreshold; threshold != 0 {
+		if threshold < 2 || threshold > len(c.KMS.Regions) {
+			problemf("kms.shamir_threshold (%d) must be 0, or between 2 and the number of KMS regions (%d)", threshold, len(c.KMS.Regions))
+		}
+		if c.KMS.WrappedKeyFormat < WrappedKeyFormatDescribed {
+			problemf("kms.shamir_threshold needs kms.wrapped_key_format %d for the shares to be told from the whole data keys", WrappedKeyFormatDescribed)
+		}
+		if len(c.KMS.Regions) > MaxShamirShares {
+			problemf("a data key can't be split into a share for every one of the %d KMS regions, %d at most", len(c.KMS.Regions), MaxShamirShares)
+		}
+	}
+	if c.KMS.Retry.MaxAttempts < 1 {
+		problemf("kms.retry.max_attempts (%d) must be at least 1", c.KMS.Retry.MaxAttempts)
+	}
+	if c.Store.Retry.MaxAttempts < 1 {
+		problemf("store.retry.max_attempts (%d) must be at least 1", c.Store.Retry.MaxAttempts)
+	}
+	for _, breaker := range []struct {
+		name   string
+		config CircuitBreakerConfig
+	}{
+		{"kms", c.KMS.CircuitBreaker},
+		{"dynamodb", c.DynamoDB.CircuitBreaker},
+	} {
+		if breaker.config.FailureThreshold > 0 && breaker.config.OpenDurationInSeconds <= 0 {
+			problemf("%s.circuit_breaker.open_duration_in_seconds must be greater than 0 when the circuit breakers are enabled", breaker.name)
+		}
+	}
+
+	if cache := c.KMS.PlaintextCache; cache.MaxEntries > 0 && (cache.TTLInSeconds <= 0 || cache.TTLInSeconds > MaxPlaintextCacheTTLInSeconds) {
+		problemf("kms.plaintext_cache.ttl_in_seconds (%d) must be between 1 and %d when the plaintext data keys are cached", cache.TTLInSeconds, MaxPlaintextCacheTTLInSeconds)
+	}
+
+	if invalidation := c.DynamoDB.CacheInvalidation; invalidation.Streams.Enabled {
+		if len(invalidation.Redis.Addrs) > 0 {
+			problemf("dynamodb.cache_invalidation.streams.enabled and dynamodb.cache_invalidation.redis.addrs can't be set together")
+		}
+		if invalidation.Streams.PollIntervalInMilliseconds == 0 {
+			problemf("dynamodb.cache_invalidation.streams.poll_interval_in_milliseconds must be greater than 0 when the stream is consumed")
+		}
+	}
+
+	if err := verifyRoleARNs(c.DynamoDB.RoleARNs, append([]string{c.DynamoDB.Region}, c.DynamoDB.ReplicaRegions...)); err != nil {
+		problemf("dynamodb: %s", err)
+	}
+
+	if !validReadConsistency(c.DynamoDB.ReadConsistency) {
+		problemf("dynamodb.read_consistency (%q) must be %s or %s", c.DynamoDB.ReadConsistency, ReadConsistencyEventual, ReadConsistencyStrong)
+	}
+
+	if c.Store.WarmUp.MaxIDs > 0 && c.Store.WarmUp.TimeoutInSeconds <= 0 {
+		problemf("store.warm_up.timeout_in_seconds must be greater than 0 when the caches are warmed up")
+	}
+
+	c.validateStore(problemf)
+	if replication := c.Store.Replication; replication.TargetConfig != "" {
+		if replication.IntervalInSeconds <= 0 {
+			problemf("store.replication.interval_in_seconds must be greater than 0 when the store is replicated")
+		}
+		if _, err := loadReplicationTargetConfiguration(replication.TargetConfig); err != nil {
+			problemf("store.replication.target_config: %s", err)
+		}
+	}
+
+	if _, err := NewTenantAuthenticator(c.Auth, c.Tenants); err != nil {
+		problemf("auth: %s", err)
+	}
+	if (c.Auth.JWT.Issuer != "" || c.Auth.JWT.Audience != "") && c.Auth.JWT.JWKSURL == "" {
+		problemf("auth.jwt.issuer and auth.jwt.audience require auth.jwt.jwks_url")
+	}
+	if c.Auth.Grants.SigningKeyID != "" && c.Auth.Grants.MaxTTLInMinutes <= 0 {
+		problemf("auth.grants.max_ttl_in_minutes must be greater than 0 when grants are enabled")
+	}
+	if len(c.Auth.DualControl.Actions) > 0 && c.Auth.DualControl.ApprovalWindowInMinutes <= 0 {
+		problemf("auth.dual_control.approval_window_in_minutes must be greater than 0 when actions are under dual control")
+	}
+
+	if _, err := NewRateLimiter(c.RateLimit, c.Tenants); err != nil {
+		problemf("rate_limit: %s", err)
+	}
+
+	if len(problems) > 0 {
+		return ConfigurationError{problems}
+	}
+	return nil
+}
+
+func (c *Configuration) validateServer(problemf func(format string, args ...interface{})) {
+	ports := map[string]string{"server.port": c.Server.Port, "server.grpc.port": c.Server.GRPC.Port, "server.admin.port": c.Server.Admin.Port}
+	used := make(map[string]string, len(ports))
+	for _, name := range []string{"server.port", "server.grpc.port", "server.admin.port"} {
+		port := ports[name]
+		if port == "" {
+			if name == "server.port" && c.Server.UnixSocket.Path == "" {
+				problemf("server.port is required, unless the API is served on server.unix_socket.path")
+			}
+			continue
+		}
+
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			problemf("%s (%q) must be a port number between 1 and 65535", name, port)
+		} else if other, ok := used[port]; ok {
+			problemf("%s and %s are both %s", other, name, port)
+		}
+		used[port] = name
+	}
+
+	if c.Server.APIVersion != "" && !isAPIVersion(c.Server.APIVersion) {
+		problemf("server.api_version (%q) must be one of %s, which are all served", c.Server.APIVersion, strings.Join(apiVersions, ", "))
+	}
+	if _, err := apiDeprecationHeaders(c.Server.APIVersions); err != nil {
+		problemf("server.api_versions: %s", err)
+	}
+
+	if c.Server.ShutdownTimeoutInSeconds < 0 {
+		problemf("server.shutdown_timeout_in_seconds (%d) can't be negative", c.Server.ShutdownTimeoutInSeconds)
+	}
+
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		problemf("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	if tls.ClientCAFile != "" && tls.CertFile == "" {
+		problemf("server.tls.client_ca_file requires the API to be served over TLS, with server.tls.cert_file")
+	}
+	if len(tls.AllowedClientCommonNames) > 0 && tls.ClientCAFile == "" {
+		problemf("server.tls.allowed_client_common_names requires server.tls.client_ca_file")
+	}
+
+	if (c.Server.GRPC.CertFile == "") != (c.Server.GRPC.KeyFile == "") {
+		problemf("server.grpc.cert_file and server.grpc.key_file must be set together")
+	}
+
+	if c.Server.UnixSocket.Path != "" {
+		if _, err := parseUnixSocketMode(c.Server.UnixSocket.Mode); err != nil {
+			problemf("server.unix_socket.mode (%q) must be an octal file mode, e.g. 0660", c.Server.UnixSocket.Mode)
+		}
+	}
+	if len(c.Auth.Peers) > 0 && c.Server.UnixSocket.Path == "" {
+		problemf("auth.peers requires the API to be served on server.unix_socket.path")
+	}
+}
+
+func (c *Configuration) validateStore(problemf func(format string, args ...interface{})) {
+	storeTypes := []string{c.Store.Type}
+	switch c.Store.Type {
+	case "replicated":
+		storeTypes = append(storeTypes, c.Replicated.Stores...)
+		if len(c.Replicated.Stores) == 0 {
+			problemf("replicated.stores must list at least one store")
+		}
+		if c.Replicated.WriteQuorum < 0 || c.Replicated.WriteQuorum > len(c.Replicated.Stores) {
+			problemf("replicated.write_quorum (%d) must be between 0 and the number of stores (%d)", c.Replicated.WriteQuorum, len(c.Replicated.Stores))
+		}
+	case "chained":
+		storeTypes = append(storeTypes, c.Chained.Stores...)
+		if len(c.Chained.Stores) == 0 {
+			problemf("chained.stores must list at least one store")
+		}
+	}
+
+	checked := make(map[string]bool, len(storeTypes))
+	for i, storeType := range storeTypes {
+		if i > 0 && storeType == c.Store.Type {
+			problemf("a %s store can't be composed of another %s store", storeType, storeType)
+		}
+
+		if checked[storeType] {
+			continue
+		}
+		checked[storeType] = true
+
+		if _, ok := storeFactories[storeType]; !ok {
+			problemf("unknown store type %q, available store types are: %s", storeType, strings.Join(RegisteredStoreTypes(), ", "))
+			continue
+		}
+
+		if required, ok := requiredStoreSettings[storeType]; ok {
+			for _, setting := range required(c) {
+				if !setting.set {
+					problemf("%s is required by the %s store", setting.name, storeType)
+				}
+			}
+		}
+	}
+
+	if c.Store.DeletedRetentionInHours > 0 && c.Store.PurgeIntervalInMinutes <= 0 {
+		problemf("store.purge_interval_in_minutes must be greater than 0 when the deleted ids are purged")
+	}
+}
@@ -0,0 +1,347 @@
+//go:build cosmosdb
+// +build cosmosdb
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// CosmosDBStore - an Azure Cosmos DB (SQL API) implementation of a key/value store for KMS-related data.
+// Every id is its own item and logical partition, created with conditional-create semantics.
+type CosmosDBStore struct {
+	container *azcosmos.ContainerClient
+}
+
+type cosmosDBDocument struct {
+	ID        string            `json:"id"`
+	Keys      map[string]string `json:"keys"`
+	DeletedAt int64             `json:"deleted_at,omitempty"`
+	Version   int64             `json:"version,omitempty"`
+}
+
+func init() {
+	RegisterStore("cosmosdb", func(config *Configuration) (Store, error) {
+		return NewCosmosDBStore(config.CosmosDB)
+	})
+}
+
+// NewCosmosDBStore creates a new CosmosDBStore instance
+func NewCosmosDBStore(cosmosDBConfig CosmosDBConfig) (*CosmosDBStore, error) {
+	credential, err := azcosmos.NewKeyCredential(cosmosDBConfig.Key)
+	if err != nil {
+		logStoreError(context.Background(), "cosmosdb", "NewCosmosDBStore", "", err)
+		return nil, err
+	}
+
+	client, err := azcosmos.NewClientWithKey(cosmosDBConfig.Endpoint, credential, nil)
+	if err != nil {
+		logStoreError(context.Background(), "cosmosdb", "NewCosmosDBStore", "", err)
+		return nil, err
+	}
+
+	container, err := client.NewContainer(cosmosDBConfig.Database, cosmosDBConfig.Container)
+	if err != nil {
+		logStoreError(context.Background(), "cosmosdb", "NewCosmosDBStore", "", err)
+		return nil, err
+	}
+
+	return &CosmosDBStore{container}, nil
+}
+
+// itemID escapes id since Cosmos DB item ids can't contain '/', '\', '?' or '#'
+func itemID(id string) (string, azcosmos.PartitionKey) {
+	escapedID := url.PathEscape(id)
+	return escapedID, azcosmos.NewPartitionKeyString(escapedID)
+}
+
+func hasStatusCode(err error, statusCode int) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == statusCode
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *CosmosDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *CosmosDBStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	escapedID, partitionKey := itemID(id)
+	resp, err := s.container.ReadItem(ctx, partitionKey, escapedID, nil)
+	if hasStatusCode(err, http.StatusNotFound) {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "cosmosdb", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	document := cosmosDBDocument{}
+	if err := json.Unmarshal(resp.Value, &document); err != nil {
+		logStoreError(ctx, "cosmosdb", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if document.DeletedAt != 0 {
+		return nil, 0, IDDeletedStoreError{ID: id, DeletedAt: time.Unix(document.DeletedAt, 0)}
+	}
+
+	return document.Keys, document.Version, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with a cross-partition query,
+// azcosmos only having ReadManyItems since 1.3.0
+func (s *CosmosDBStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	escapedIDs := make([]string, len(ids))
+	for i, id := range ids {
+		escapedIDs[i], _ = itemID(id)
+	}
+
+	query := "SELECT * FROM c WHERE ARRAY_CONTAINS(@ids, c.id) AND NOT IS_DEFINED(c.deleted_at)"
+	queryOptions := &azcosmos.QueryOptions{QueryParameters: []azcosmos.QueryParameter{
+		{Name: "@ids", Value: escapedIDs},
+	}}
+
+	pager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), queryOptions)
+
+	keys := make(map[string]map[string]string, len(ids))
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			logStoreError(ctx, "cosmosdb", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+
+		for _, value := range page.Items {
+			document := cosmosDBDocument{}
+			if err := json.Unmarshal(value, &document); err != nil {
+				logStoreError(ctx, "cosmosdb", "GetEncryptedDataKeysBatch", "", err)
+				return nil, err
+			}
+
+			id, err := url.PathUnescape(document.ID)
+			if err != nil {
+				logStoreError(ctx, "cosmosdb", "GetEncryptedDataKeysBatch", "", err)
+				return nil, err
+			}
+			keys[id] = document.Keys
+		}
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *CosmosDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	escapedID, partitionKey := itemID(id)
+	value, err := json.Marshal(cosmosDBDocument{ID: escapedID, Keys: encryptedKeysMap})
+	if err != nil {
+		logStoreError(ctx, "cosmosdb", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	//CreateItem fails with 409 Conflict if an item with the same id exists in the partition
+	if _, err := s.container.CreateItem(ctx, partitionKey, value, nil); err != nil {
+		if hasStatusCode(err, http.StatusConflict) {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "cosmosdb", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// updateDocument applies update to the document of the given id, retrying when the item
+// is modified concurrently. A nil document is passed to update if the item does not exist.
+// update returns false if there is nothing to write.
+func (s *CosmosDBStore) updateDocument(ctx context.Context, id string, update func(document *cosmosDBDocument) (bool, error)) error {
+	escapedID, partitionKey := itemID(id)
+	for {
+		var current *cosmosDBDocument
+		resp, err := s.container.ReadItem(ctx, partitionKey, escapedID, nil)
+		if err != nil && !hasStatusCode(err, http.StatusNotFound) {
+			logStoreError(ctx, "cosmosdb", "updateDocument", id, err)
+			return err
+		}
+
+		if err == nil {
+			current = &cosmosDBDocument{}
+			if err := json.Unmarshal(resp.Value, current); err != nil {
+				logStoreError(ctx, "cosmosdb", "updateDocument", id, err)
+				return err
+			}
+		}
+
+		write, err := update(current)
+		if err != nil || !write {
+			return err
+		}
+
+		value, err := json.Marshal(current)
+		if err != nil {
+			logStoreError(ctx, "cosmosdb", "updateDocument", id, err)
+			return err
+		}
+
+		_, err = s.container.ReplaceItem(ctx, partitionKey, escapedID, value, &azcosmos.ItemOptions{IfMatchEtag: &resp.ETag})
+		if hasStatusCode(err, http.StatusPreconditionFailed) {
+			continue
+		}
+
+		if err != nil {
+			logStoreError(ctx, "cosmosdb", "updateDocument", id, err)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *CosmosDBStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	return s.updateDocument(ctx, id, func(document *cosmosDBDocument) (bool, error) {
+		var current *item
+		if document != nil {
+			current = &item{ID: id, Keys: document.Keys, DeletedAt: document.DeletedAt, Version: document.Version}
+		}
+
+		if err := checkVersion(id, current, expectedVersion); err != nil {
+			return false, err
+		}
+
+		document.Keys = encryptedKeysMap
+		document.Version++
+		return true, nil
+	})
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *CosmosDBStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateDocument(ctx, id, func(document *cosmosDBDocument) (bool, error) {
+		if document == nil || document.DeletedAt != 0 {
+			return false, nil
+		}
+
+		document.DeletedAt = time.Now().Unix()
+		return true, nil
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *CosmosDBStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateDocument(ctx, id, func(document *cosmosDBDocument) (bool, error) {
+		if document == nil {
+			return false, IDNotFoundStoreError{ID: id}
+		}
+
+		if document.DeletedAt == 0 {
+			return false, nil
+		}
+
+		document.DeletedAt = 0
+		return true, nil
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *CosmosDBStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	escapedID, partitionKey := itemID(id)
+	_, err := s.container.DeleteItem(ctx, partitionKey, escapedID, nil)
+	if err != nil && !hasStatusCode(err, http.StatusNotFound) {
+		logStoreError(ctx, "cosmosdb", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the container that are not deleted.
+// The cursor is the continuation token of the query.
+func (s *CosmosDBStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	queryOptions := &azcosmos.QueryOptions{PageSizeHint: int32(listIDsLimit(limit))}
+	if cursor != "" {
+		queryOptions.ContinuationToken = &cursor
+	}
+
+	pager := s.container.NewQueryItemsPager("SELECT c.id FROM c WHERE NOT IS_DEFINED(c.deleted_at)", azcosmos.NewPartitionKey(), queryOptions)
+	page, err := pager.NextPage(ctx)
+	if err != nil {
+		logStoreError(ctx, "cosmosdb", "ListIDs", "", err)
+		return nil, "", err
+	}
+
+	ids, err := cosmosDBIDs(page.Items)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if page.ContinuationToken != nil {
+		nextCursor = *page.ContinuationToken
+	}
+
+	return ids, nextCursor, nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *CosmosDBStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	query := "SELECT c.id FROM c WHERE c.deleted_at < @deletedBefore"
+	queryOptions := &azcosmos.QueryOptions{QueryParameters: []azcosmos.QueryParameter{
+		{Name: "@deletedBefore", Value: deletedBefore.Unix()},
+	}}
+
+	pager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), queryOptions)
+
+	ids := make([]string, 0)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			logStoreError(ctx, "cosmosdb", "ListDeletedIDs", "", err)
+			return nil, err
+		}
+
+		pageIDs, err := cosmosDBIDs(page.Items)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, pageIDs...)
+	}
+
+	return ids, nil
+}
+
+// cosmosDBIDs decodes the ids of the items returned by a query
+func cosmosDBIDs(items [][]byte) ([]string, error) {
+	ids := make([]string, 0, len(items))
+	for _, value := range items {
+		document := cosmosDBDocument{}
+		if err := json.Unmarshal(value, &document); err != nil {
+			logStoreError(context.Background(), "cosmosdb", "cosmosDBIDs", "", err)
+			return nil, err
+		}
+
+		id, err := url.PathUnescape(document.ID)
+		if err != nil {
+			logStoreError(context.Background(), "cosmosdb", "cosmosDBIDs", "", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
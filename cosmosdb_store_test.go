@@ -0,0 +1,19 @@
+//go:build cosmosdb
+// +build cosmosdb
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCosmosDBStoreConformance(t *testing.T) {
+	endpoint := testStoreEnv(t, "RKMS_TEST_COSMOSDB_ENDPOINT")
+	s, err := NewCosmosDBStore(CosmosDBConfig{Endpoint: endpoint, Key: os.Getenv("RKMS_TEST_COSMOSDB_KEY"), Database: "rkms", Container: "keys"})
+	if err != nil {
+		t.Fatalf("failed to create the cosmosdb store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
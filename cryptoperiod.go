@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CryptoperiodExpiredError is returned when the plaintext of the latest version of a data key is requested once it
+// is older than its cryptoperiod, the data key having to be rotated first
+type CryptoperiodExpiredError struct {
+	ID          string
+	Version     int64
+	GeneratedAt time.Time
+	MaxAge      time.Duration
+}
+
+func (e CryptoperiodExpiredError) Error() string {
+	return fmt.Sprintf("version %d of the data key of id %s was generated at %s, more than its cryptoperiod of %d days ago: rotate it first",
+		e.Version, e.ID, e.GeneratedAt.UTC().Format(time.RFC3339), int(e.MaxAge/(24*time.Hour)))
+}
+
+// InvalidCryptoperiodError is returned when an id is given a negative cryptoperiod
+type InvalidCryptoperiodError struct {
+	MaxAgeInDays int
+}
+
+func (e InvalidCryptoperiodError) Error() string {
+	return fmt.Sprintf("the cryptoperiod of an id can't be negative, got %d days", e.MaxAgeInDays)
+}
+
+// cryptoperiod is the cryptoperiod of the id of the metadata: the shortest of maxAge and of the one of the id that
+// are set, 0 when neither is
+func cryptoperiod(maxAge time.Duration, metadata *KeyMetadata) time.Duration {
+	idMaxAge := time.Duration(metadata.MaxAgeInDays) * 24 * time.Hour
+	if maxAge == 0 || (idMaxAge > 0 && idMaxAge < maxAge) {
+		return idMaxAge
+	}
+	return maxAge
+}
+
+// checkCryptoperiod verifies the given version of the encrypted data keys of id, the latest one for version 0, is
+// within its cryptoperiod. Only the latest version, the one data is encrypted with, expires: the older versions
+// keep decrypting the data encrypted before the rotation. The ids created before their metadata was saved have no
+// known age and never expire.
+func (r *RKMS) checkCryptoperiod(id string, encryptedDataKeys map[string]string, version int64) error {
+	metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+	if err != nil {
+		return err
+	}
+
+	maxAge := cryptoperiod(r.maxDataKeyAge, metadata)
+	if maxAge == 0 || (version != 0 && version != metadata.Version) {
+		return nil
+	}
+
+	generatedAt := metadata.RotatedAt
+	if generatedAt.IsZero() {
+		generatedAt = metadata.CreatedAt
+	}
+	if generatedAt.IsZero() || time.Since(generatedAt) <= maxAge {
+		return nil
+	}
+	return CryptoperiodExpiredError{ID: id, Version: metadata.Version, GeneratedAt: generatedAt, MaxAge: maxAge}
+}
+
+// SetKeyCryptoperiod sets the cryptoperiod of the data key of the given id, in days, returning its updated metadata.
+// The shortest of it and of the cryptoperiod of the configuration applies, 0 leaving the latter alone.
+func (r *RKMS) SetKeyCryptoperiod(ctx context.Context, id string, maxAgeInDays int) (*KeyMetadata, error) {
+	if maxAgeInDays < 0 {
+		return nil, InvalidCryptoperiodError{maxAgeInDays}
+	}
+
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		metadata.MaxAgeInDays = maxAgeInDays
+		return nil
+	})
+}
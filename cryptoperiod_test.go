@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// ageDataKey makes the latest version of the data key of id look generated the given time ago
+func ageDataKey(t *testing.T, r *RKMS, id string, age time.Duration) {
+	ctx := context.Background()
+	encryptedDataKeys, version, err := r.store.GetVersionedEncryptedDataKeys(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to read the encrypted data keys: %s", err)
+	}
+	metadata, _ := storedKeyMetadata(id, encryptedDataKeys)
+	metadata.CreatedAt = time.Now().Add(-age)
+	if !metadata.RotatedAt.IsZero() {
+		metadata.RotatedAt = metadata.CreatedAt
+	}
+	setMetadataEntry(encryptedDataKeys, metadata)
+	if err := r.store.UpdateEncryptedDataKeys(ctx, id, encryptedDataKeys, version); err != nil {
+		t.Fatalf("failed to age the data key: %s", err)
+	}
+}
+
+func TestCryptoperiod(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	r.maxDataKeyAge = 90 * 24 * time.Hour
+	ctx := context.Background()
+
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+	ageDataKey(t, r, "id", 91*24*time.Hour)
+
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("a data key older than its cryptoperiod shouldn't have been released")
+	} else if _, ok := err.(CryptoperiodExpiredError); !ok {
+		t.Fatalf("a data key older than its cryptoperiod should have failed with CryptoperiodExpiredError, got %v", err)
+	}
+	if _, err := r.GetDataKeyVersion(ctx, "id", FirstDataKeyVersion, nil); err == nil {
+		t.Fatalf("the latest version shouldn't have been released by its number either")
+	}
+
+	rotated, err := r.RotateDataKey(ctx, "id", nil)
+	if err != nil {
+		t.Fatalf("failed to rotate the data key: %s", err)
+	}
+	if dataKey, err := r.GetDataKey(ctx, "id", 0, nil); err != nil || !dataKey.Plaintext.Equal(rotated.Plaintext) {
+		t.Fatalf("the rotated version should have been released, got %v", err)
+	}
+	if _, err := r.GetDataKeyVersion(ctx, "id", FirstDataKeyVersion, nil); err != nil {
+		t.Fatalf("the older version should have been released to decrypt the older data: %s", err)
+	}
+}
+
+func TestKeyCryptoperiod(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+	ageDataKey(t, r, "id", 10*24*time.Hour)
+
+	if _, err := r.SetKeyCryptoperiod(ctx, "id", -1); err == nil {
+		t.Fatalf("a negative cryptoperiod should have failed")
+	}
+	metadata, err := r.SetKeyCryptoperiod(ctx, "id", 7)
+	if err != nil || metadata.MaxAgeInDays != 7 {
+		t.Fatalf("failed to set the cryptoperiod of the id: %v", err)
+	}
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("the cryptoperiod of the id should have applied without one configured")
+	}
+
+	r.maxDataKeyAge = 30 * 24 * time.Hour
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("the shortest cryptoperiod should have applied")
+	}
+
+	if _, err := r.SetKeyCryptoperiod(ctx, "id", 0); err != nil {
+		t.Fatalf("failed to remove the cryptoperiod of the id: %s", err)
+	}
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("the configured cryptoperiod alone should have applied: %s", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// FirstDataKeyVersion is the version of the data key generated for a new id
+const FirstDataKeyVersion = 1
+
+// dataKeyVersionSeparator separates the region from the version in the entries of the encrypted data keys
+// of versions after the first one, e.g. "us-east-1#2". The first version keeps its entries under the bare
+// regions, so ids created before data keys had versions read as their first version.
+const dataKeyVersionSeparator = "#"
+
+// DataKey - a version of the plaintext data key assosicated with an id, which its owner destroys once done with it
+type DataKey struct {
+	ID        string
+	Plaintext *SecureBytes
+	Version   int64
+	// the zero time if the key never expires
+	ExpiresAt time.Time
+}
+
+// Destroy zeroes the plaintext of the data key, if there is a data key
+func (k *DataKey) Destroy() {
+	if k != nil {
+		k.Plaintext.Destroy()
+	}
+}
+
+// DataKeyVersionNotFoundError is returned when a version of the data key of an id doesn't exist
+type DataKeyVersionNotFoundError struct {
+	ID      string
+	Version int64
+}
+
+func (e DataKeyVersionNotFoundError) Error() string {
+	return fmt.Sprintf("id %s has no data key version %d", e.ID, e.Version)
+}
+
+// splitDataKeyVersions groups the encrypted data keys of an id by data key version, leaving out the metadata entries
+func splitDataKeyVersions(encryptedDataKeys map[string]string) map[int64]map[string]string {
+	versions := make(map[int64]map[string]string)
+	for entry, ciphertext := range encryptedDataKeys {
+		if isMetadataEntry(entry) {
+			continue
+		}
+
+		region, version := entry, int64(FirstDataKeyVersion)
+		if i := strings.LastIndex(entry, dataKeyVersionSeparator); i >= 0 {
+			parsed, err := strconv.ParseInt(entry[i+1:], 10, 64)
+			if err != nil {
+				logger.Errorf("ignoring encrypted data key %q with an invalid version", entry)
+				continue
+			}
+			region, version = entry[:i], parsed
+		}
+
+		if versions[version] == nil {
+			versions[version] = make(map[string]string)
+		}
+		versions[version][region] = ciphertext
+	}
+
+	return versions
+}
+
+// joinDataKeyVersions is the reverse of splitDataKeyVersions
+func joinDataKeyVersions(versions map[int64]map[string]string) map[string]string {
+	encryptedDataKeys := make(map[string]string)
+	for version, regions := range versions {
+		for region, ciphertext := range regions {
+			if version == FirstDataKeyVersion {
+				encryptedDataKeys[region] = ciphertext
+			} else {
+				encryptedDataKeys[region+dataKeyVersionSeparator+strconv.FormatInt(version, 10)] = ciphertext
+			}
+		}
+	}
+
+	return encryptedDataKeys
+}
+
+func latestDataKeyVersion(versions map[int64]map[string]string) int64 {
+	latest := int64(0)
+	for version := range versions {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// GetDataKeyVersion retrieves the given version of the key assosicated with the given id,
+// e.g. to decrypt data encrypted before the key was rotated. Unlike GetDataKey, it never generates a key.
+func (r *RKMS) GetDataKeyVersion(ctx context.Context, id string, version int64, encryptionContext EncryptionContext) (*DataKey, error) {
+	ctx = withLogID(ctx, id)
+	dataKey, err := r.lookInStoreForDataKey(ctx, id, version, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataKey == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+	return dataKey, nil
+}
+
+// RotateDataKey generates a new version of the key assosicated with the given id, keeping the older versions
+// to decrypt the data encrypted with them. The id has to exist, and to have been created with the given encryption context.
+func (r *RKMS) RotateDataKey(ctx context.Context, id string, encryptionContext EncryptionContext) (*DataKey, error) {
+	ctx = withLogID(ctx, id)
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfGetPlaintextDataKeyTries; i++ {
+		var encryptedDataKeys map[string]string
+		var storeVersion int64
+		//the read, the encryption of the new version and the update share the time left
+		budgetCtx, cancel := budgetContext(ctx, 3)
+		storeCtx, endSpan := startStoreSpan(budgetCtx, "get", id)
+		err = r.retryStore(storeCtx, "get", true, func(ctx context.Context) (err error) {
+			encryptedDataKeys, storeVersion, err = r.store.GetVersionedEncryptedDataKeys(ctx, id)
+			return err
+		})
+		endSpan(err)
+		cancel()
+		if err != nil {
+			contextLogger(ctx).Error(err)
+			return nil, err
+		}
+
+		if encryptedDataKeys == nil {
+			return nil, IDNotFoundStoreError{ID: id}
+		}
+
+		if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+			return nil, err
+		}
+
+		if err := checkKeyState(id, encryptedDataKeys); err != nil {
+			return nil, err
+		}
+
+		//a data key pair is replaced by the pair of a new id rather than rotated
+		if err := checkSymmetricDataKey(id, encryptedDataKeys); err != nil {
+			return nil, err
+		}
+
+		budgetCtx, cancel = budgetContext(ctx, 2)
+		plaintextDataKey, newEncryptedDataKeys, err := r.encryptNewDataKey(budgetCtx, r.providersFor(id), encryptionContext)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		versions := splitDataKeyVersions(encryptedDataKeys)
+		version := latestDataKeyVersion(versions) + 1
+		versions[version] = newEncryptedDataKeys
+		rotatedDataKeys := joinDataKeyVersions(versions)
+		copyMetadataEntries(rotatedDataKeys, encryptedDataKeys)
+		//the cryptoperiod of the data key starts over with its new version
+		metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+		if err != nil {
+			plaintextDataKey.Destroy()
+			return nil, err
+		}
+		metadata.RotatedAt = time.Now()
+		setMetadataEntry(rotatedDataKeys, metadata)
+
+		storeCtx, endSpan = startStoreSpan(ctx, "update", id)
+		err = r.retryStore(storeCtx, "update", false, func(ctx context.Context) error {
+			return r.store.UpdateEncryptedDataKeys(ctx, id, rotatedDataKeys, storeVersion)
+		})
+		endSpan(err)
+		if err != nil {
+			plaintextDataKey.Destroy()
+		}
+		if _, ok := err.(VersionMismatchStoreError); ok {
+			//rotated or rewrapped at the same time, the new version is generated again on top of it
+			contextLogger(ctx).Debugf("id %q was updated while being rotated, retrying", id)
+			continue
+		}
+
+		if err != nil {
+			contextLogger(ctx).Errorf("failed to save the rotated data key in key/value store: %s", err)
+			return nil, err
+		}
+
+		contextLogger(ctx).Debugf("rotated the data key of id %q to version %d", id, version)
+		dataKey := &DataKey{ID: id, Plaintext: plaintextDataKey, Version: version}
+		if _, expiresAt, err := r.getEncryptedDataKeys(ctx, id); err == nil {
+			dataKey.ExpiresAt = expiresAt
+		}
+		return dataKey, nil
+	}
+
+	return nil, err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// publicKeyEntry is the entry of the encrypted data keys the public key of a data key pair is saved under in clear,
+// the ciphertexts of the id being those of its private key
+const publicKeyEntry = dataKeyVersionSeparator + "public_key"
+
+// the specs of the data key pairs, named the way KMS names them
+const (
+	KeyPairSpecRSA2048     = "RSA_2048"
+	KeyPairSpecRSA3072     = "RSA_3072"
+	KeyPairSpecRSA4096     = "RSA_4096"
+	KeyPairSpecECCNISTP256 = "ECC_NIST_P256"
+	KeyPairSpecECCNISTP384 = "ECC_NIST_P384"
+	KeyPairSpecECCNISTP521 = "ECC_NIST_P521"
+)
+
+// DefaultKeyPairSpec is the spec of the data key pairs created without one
+const DefaultKeyPairSpec = KeyPairSpecRSA2048
+
+var keyPairGenerators = map[string]func() (crypto.Signer, error){
+	KeyPairSpecRSA2048:     func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	KeyPairSpecRSA3072:     func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 3072) },
+	KeyPairSpecRSA4096:     func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) },
+	KeyPairSpecECCNISTP256: func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	KeyPairSpecECCNISTP384: func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+	KeyPairSpecECCNISTP521: func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P521(), rand.Reader) },
+}
+
+// DataKeyPair - the asymmetric data key pair of an id, e.g. to sign JWTs with. PublicKey is the base64 DER
+// SubjectPublicKeyInfo of the pair, and PrivateKey its DER PKCS #8 private key, nil unless it was unwrapped, which
+// its owner destroys once done with it.
+type DataKeyPair struct {
+	ID         string
+	KeySpec    string
+	PublicKey  string
+	PrivateKey *SecureBytes
+}
+
+// Destroy zeroes the private key of the pair, if there is a pair
+func (p *DataKeyPair) Destroy() {
+	if p != nil {
+		p.PrivateKey.Destroy()
+	}
+}
+
+// InvalidKeyPairSpecError is returned when a data key pair is requested with a spec which isn't one of the specs of
+// the data key pairs
+type InvalidKeyPairSpecError struct {
+	Spec string
+}
+
+func (e InvalidKeyPairSpecError) Error() string {
+	specs := make([]string, 0, len(keyPairGenerators))
+	for spec := range keyPairGenerators {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	return fmt.Sprintf("unknown key pair spec %q, the key pair specs are %s", e.Spec, strings.Join(specs, ", "))
+}
+
+// isDataKeyPair tells if the encrypted data keys are those of the private key of a data key pair
+func isDataKeyPair(encryptedDataKeys map[string]string) bool {
+	_, ok := encryptedDataKeys[publicKeyEntry]
+	return ok
+}
+
+// generateKeyPair generates a data key pair of the given spec, returning the DER of its private and public keys
+func generateKeyPair(spec string) ([]byte, []byte, error) {
+	generate, ok := keyPairGenerators[spec]
+	if !ok {
+		return nil, nil, InvalidKeyPairSpecError{spec}
+	}
+
+	key, err := generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		zeroBytes(privateKey)
+		return nil, nil, err
+	}
+	return privateKey, publicKey, nil
+}
+
+// GetDataKeyPair retrieves the public key of the data key pair of the given id, generating a pair of the given spec,
+// DefaultKeyPairSpec when empty, if the id doesn't exist yet. Its private key is wrapped by every region the way
+// the data keys are, and only unwrapped by UnwrapDataKeyPair.
+func (r *RKMS) GetDataKeyPair(ctx context.Context, id string, spec string, encryptionContext EncryptionContext) (*DataKeyPair, error) {
+	ctx = withLogID(ctx, id)
+	if spec != "" {
+		if _, ok := keyPairGenerators[spec]; !ok {
+			return nil, InvalidKeyPairSpecError{spec}
+		}
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfGetPlaintextDataKeyTries; i++ {
+		var dataKeyPair *DataKeyPair
+		dataKeyPair, err = r.lookInStoreForDataKeyPair(ctx, id, spec, encryptionContext)
+		if err != nil || dataKeyPair != nil {
+			return dataKeyPair, err
+		}
+
+		createdSpec := spec
+		if createdSpec == "" {
+			createdSpec = DefaultKeyPairSpec
+		}
+		dataKeyPair, err = r.createDataKeyPairForID(ctx, id, createdSpec, encryptionContext)
+		if _, ok := err.(IDAlreadyExistsStoreError); ok {
+			//another request created the id first, its pair is read back strongly for the read to see it
+			contextLogger(ctx).Debugln("the id was created by another request first, reading it back")
+			ctx = withReadConsistency(ctx, ReadConsistencyStrong)
+			continue
+		}
+		return dataKeyPair, err
+	}
+
+	return nil, err
+}
+
+// lookInStoreForDataKeyPair reads the public key of the data key pair of id, nil if the id doesn't exist
+func (r *RKMS) lookInStoreForDataKeyPair(ctx context.Context, id string, spec string, encryptionContext EncryptionContext) (*DataKeyPair, error) {
+	storeCtx, cancel := budgetContext(ctx, 2)
+	encryptedDataKeys, _, err := r.getEncryptedDataKeys(storeCtx, id)
+	cancel()
+	if err != nil {
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, nil
+	}
+
+	dataKeyPair, err := storedDataKeyPair(id, encryptedDataKeys, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	if spec != "" && dataKeyPair.KeySpec != spec {
+		return nil, InvalidKeyUsageError{ID: id, Reason: fmt.Sprintf("has a data key pair of spec %s, not %s", dataKeyPair.KeySpec, spec)}
+	}
+	return dataKeyPair, nil
+}
+
+// storedDataKeyPair reads the data key pair saved with the encrypted data keys of id, without its private key
+func storedDataKeyPair(id string, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) (*DataKeyPair, error) {
+	if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyState(id, encryptedDataKeys); err != nil {
+		return nil, err
+	}
+
+	if !isDataKeyPair(encryptedDataKeys) {
+		return nil, InvalidKeyUsageError{ID: id, Reason: "has another kind of key than a data key pair"}
+	}
+
+	metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKeyPair{ID: id, KeySpec: metadata.KeySpec, PublicKey: encryptedDataKeys[publicKeyEntry]}, nil
+}
+
+// createDataKeyPairForID generates a data key pair of the given spec and saves it as the key of the id, its private
+// key wrapped in every region and its public key in clear, failing with IDAlreadyExistsStoreError if the id exists
+func (r *RKMS) createDataKeyPairForID(ctx context.Context, id string, spec string, encryptionContext EncryptionContext) (*DataKeyPair, error) {
+	contextLogger(ctx).Debugf("creating a %s data key pair...", spec)
+	privateKey, publicKey, err := generateKeyPair(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(privateKey)
+
+	entries := map[string]string{publicKeyEntry: base64.StdEncoding.EncodeToString(publicKey)}
+	if err := r.createGeneratedKeyForID(ctx, id, privateKey, spec, entries, encryptionContext); err != nil {
+		return nil, err
+	}
+	return &DataKeyPair{ID: id, KeySpec: spec, PublicKey: entries[publicKeyEntry]}, nil
+}
+
+// UnwrapDataKeyPair retrieves the data key pair of the given id along with its private key, decrypted in the first
+// region that succeeds to. Unlike GetDataKeyPair, it never generates a pair, and a pair older than its cryptoperiod
+// fails with a CryptoperiodExpiredError, its public key still being read by GetDataKeyPair.
+func (r *RKMS) UnwrapDataKeyPair(ctx context.Context, id string, encryptionContext EncryptionContext) (*DataKeyPair, error) {
+	ctx = withLogID(ctx, id)
+	storeCtx, cancel := budgetContext(ctx, 2)
+	encryptedDataKeys, _, err := r.getEncryptedDataKeys(storeCtx, id)
+	cancel()
+	if err != nil {
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+
+	dataKeyPair, err := storedDataKeyPair(id, encryptedDataKeys, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+
+	//the private key, signing and decrypting with the pair, is released within the cryptoperiod of the pair only
+	if err := r.checkCryptoperiod(id, encryptedDataKeys, 0); err != nil {
+		return nil, err
+	}
+
+	versions := splitDataKeyVersions(encryptedDataKeys)
+	privateKey, err := r.decryptDataKey(ctx, r.providersFor(id), versions[FirstDataKeyVersion], encryptionContext)
+	if err != nil {
+		err := fmt.Errorf("failed to decrypt the private key in every region: %s", err)
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+
+	dataKeyPair.PrivateKey = privateKey
+	return dataKeyPair, nil
+}
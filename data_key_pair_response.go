@@ -0,0 +1,18 @@
+package main
+
+type dataKeyPairResponse struct {
+	ID         string     `json:"id"`
+	KeySpec    string     `json:"key_spec"`
+	PublicKey  string     `json:"public_key"`
+	PrivateKey *secretRef `json:"private_key,omitempty"`
+}
+
+// ConstructDataKeyPairResponse creates a server response for GET /key-pair and POST /key-pair/decrypt endpoints,
+// private_key being left out unless the private key was unwrapped
+func ConstructDataKeyPairResponse(dataKeyPair *DataKeyPair) *SecureBytes {
+	resp := dataKeyPairResponse{ID: dataKeyPair.ID, KeySpec: dataKeyPair.KeySpec, PublicKey: dataKeyPair.PublicKey}
+	if dataKeyPair.PrivateKey != nil {
+		resp.PrivateKey = new(secretRef)
+	}
+	return marshalSecretResponse(resp, []*SecureBytes{dataKeyPair.PrivateKey})
+}
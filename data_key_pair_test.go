@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestDataKeyPair(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	dataKeyPair, err := r.GetDataKeyPair(ctx, "signer", KeyPairSpecECCNISTP256, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key pair: %s", err)
+	}
+	if dataKeyPair.KeySpec != KeyPairSpecECCNISTP256 || dataKeyPair.PrivateKey != nil {
+		t.Fatalf("only the public key of the pair should have been returned, got %+v", dataKeyPair)
+	}
+
+	read, err := r.GetDataKeyPair(ctx, "signer", "", nil)
+	if err != nil || read.PublicKey != dataKeyPair.PublicKey {
+		t.Fatalf("the public key of the existing pair should have been returned, got %v", err)
+	}
+
+	unwrapped, err := r.UnwrapDataKeyPair(ctx, "signer", nil)
+	if err != nil {
+		t.Fatalf("failed to unwrap the private key: %s", err)
+	}
+	der := unwrapped.PrivateKey.Bytes()
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		t.Fatalf("the private key should have been of PKCS #8: %s", err)
+	}
+	privateKey := parsed.(*ecdsa.PrivateKey)
+	der, _ = base64.StdEncoding.DecodeString(dataKeyPair.PublicKey)
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatalf("the public key should have been a SubjectPublicKeyInfo: %s", err)
+	}
+
+	digest := sha256.Sum256([]byte("claims"))
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+	if err != nil || !ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		t.Fatalf("the private key should have matched the public key")
+	}
+
+	encryptedDataKeys, _ := r.store.GetEncryptedDataKeys(ctx, "signer")
+	if metadata, err := storedKeyMetadata("signer", encryptedDataKeys); err != nil || metadata.KeySpec != KeyPairSpecECCNISTP256 {
+		t.Fatalf("the metadata should have had the spec of the pair, got %v", err)
+	}
+}
+
+func TestDataKeyPairUsage(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	if _, err := r.GetDataKeyPair(ctx, "signer", "DSA_1024", nil); err == nil {
+		t.Fatalf("an unknown spec should have failed")
+	} else if _, ok := err.(InvalidKeyPairSpecError); !ok {
+		t.Fatalf("an unknown spec should have failed with InvalidKeyPairSpecError, got %v", err)
+	}
+
+	if _, err := r.GetDataKeyPair(ctx, "signer", KeyPairSpecECCNISTP256, nil); err != nil {
+		t.Fatalf("failed to create the data key pair: %s", err)
+	}
+	if _, err := r.GetDataKey(ctx, "symmetric", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	for name, call := range map[string]func() error{
+		"a data key of a pair": func() error { _, err := r.GetDataKey(ctx, "signer", 0, nil); return err },
+		"a rotation of a pair": func() error { _, err := r.RotateDataKey(ctx, "signer", nil); return err },
+		"a pair of another spec": func() error {
+			_, err := r.GetDataKeyPair(ctx, "signer", KeyPairSpecECCNISTP384, nil)
+			return err
+		},
+		"a pair of a data key":            func() error { _, err := r.GetDataKeyPair(ctx, "symmetric", "", nil); return err },
+		"an unwrapped pair of a data key": func() error { _, err := r.UnwrapDataKeyPair(ctx, "symmetric", nil); return err },
+	} {
+		if _, ok := call().(InvalidKeyUsageError); !ok {
+			t.Fatalf("%s should have failed with InvalidKeyUsageError", name)
+		}
+	}
+
+	if _, err := r.UnwrapDataKeyPair(ctx, "missing", nil); err == nil {
+		t.Fatalf("a missing id shouldn't have been created by the unwrap")
+	}
+}
+
+func TestDataKeyPairCryptoperiod(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	r.maxDataKeyAge = 90 * 24 * time.Hour
+	ctx := context.Background()
+
+	if _, err := r.GetDataKeyPair(ctx, "signer", KeyPairSpecECCNISTP256, nil); err != nil {
+		t.Fatalf("failed to create the data key pair: %s", err)
+	}
+	ageDataKey(t, r, "signer", 91*24*time.Hour)
+
+	if _, err := r.UnwrapDataKeyPair(ctx, "signer", nil); err == nil {
+		t.Fatalf("the private key of a pair older than its cryptoperiod shouldn't have been released")
+	} else if _, ok := err.(CryptoperiodExpiredError); !ok {
+		t.Fatalf("a pair older than its cryptoperiod should have failed with CryptoperiodExpiredError, got %v", err)
+	}
+	if _, err := r.GetDataKeyPair(ctx, "signer", "", nil); err != nil {
+		t.Fatalf("the public key of an expired pair should have been read still: %s", err)
+	}
+}
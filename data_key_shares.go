@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// DataKeySplitError is returned when the ciphertexts of a data key version are of the shares of its data key, which
+// the clients can't decrypt with the key providers themselves
+type DataKeySplitError struct {
+	ID      string
+	Version int64
+}
+
+func (e DataKeySplitError) Error() string {
+	return fmt.Sprintf("version %d of the data key of id %s is split into shares, which don't decrypt on their own", e.Version, e.ID)
+}
+
+// encryptNewDataKeyShares generates a data key and splits it into a share by region, encrypting the share of
+// every encryption region with its provider under the given encryption context, so that no region can decrypt
+// the data key on its own
+func (r *RKMS) encryptNewDataKeyShares(ctx context.Context, providers map[string]KeyProvider, encryptionContext EncryptionContext) (*SecureBytes, map[string]string, error) {
+	contextLogger(ctx).Debugln("creating data key split into shares...")
+	dataKey := newSecureBytes(int(r.dataKeySizeInBytes))
+	if _, err := rand.Read(dataKey.Bytes()); err != nil {
+		dataKey.Destroy()
+		return nil, nil, err
+	}
+
+	encryptedDataKeys, err := r.encryptGeneratedDataKey(ctx, providers, dataKey.Bytes(), encryptionContext)
+	if err != nil {
+		dataKey.Destroy()
+		return nil, nil, err
+	}
+	return dataKey, encryptedDataKeys, nil
+}
+
+// encryptDataKeyShares splits the data key into a share by region of r, the x coordinate of the share of a region
+// being its index in the regions plus one, and encrypts the shares of the given regions with their providers
+func (r *RKMS) encryptDataKeyShares(ctx context.Context, providers map[string]KeyProvider, dataKey []byte, regions []string, encryptionContext EncryptionContext, failFast bool) (map[string]string, map[string]error) {
+	shares, err := shamirSplit(dataKey, len(r.regions), r.shamirThreshold)
+	if err != nil {
+		errs := make(map[string]error, len(regions))
+		for _, region := range regions {
+			errs[region] = err
+		}
+		return map[string]string{}, errs
+	}
+	defer func() {
+		for _, share := range shares {
+			zeroBytes(share)
+		}
+	}()
+
+	xs := make(map[string]int, len(r.regions))
+	for i, region := range r.regions {
+		xs[region] = i + 1
+	}
+
+	return r.encryptInRegions(ctx, regions, failFast, func(ctx context.Context, region string) (*string, error) {
+		share := shares[xs[region]-1]
+		ciphertextBlob, err := r.encryptInRegion(ctx, providers, share, region, encryptionContext)
+		if err != nil {
+			return nil, err
+		}
+
+		//the shares have to describe themselves to be told from the whole data keys
+		wrapped := newWrappedKey(WrappedKeyFormatDescribed, providers[region], len(share), ciphertextBlob)
+		wrapped.Share, wrapped.Threshold = xs[region], r.shamirThreshold
+		ciphertext := wrapped.String()
+		return &ciphertext, nil
+	})
+}
+
+// encryptDataKeyVersion encrypts the data key of a data key version again in every region of r the way a new data
+// key is: split into shares with a shamirThreshold, whole otherwise. It returns the ciphertexts to save and the
+// regions which failed to, the shares being only returned when every region encrypted its own, as the shares of two
+// splits don't combine.
+func (r *RKMS) encryptDataKeyVersion(ctx context.Context, providers map[string]KeyProvider, dataKey *SecureBytes, encryptionContext EncryptionContext) (map[string]string, []string) {
+	var ciphertexts map[string]string
+	var errs map[string]error
+	if r.shamirThreshold > 0 {
+		ciphertexts, errs = r.encryptDataKeyShares(ctx, providers, dataKey.Bytes(), r.regions, encryptionContext, true)
+	} else {
+		ciphertexts, errs = r.encryptDataKeyInRegions(ctx, providers, dataKey, r.regions, encryptionContext, false)
+	}
+
+	failedRegions := make([]string, 0)
+	for _, region := range r.regions {
+		if _, ok := ciphertexts[region]; !ok {
+			failedRegions = append(failedRegions, region)
+		}
+	}
+
+	if r.shamirThreshold > 0 && (len(errs) > 0 || len(failedRegions) > 0) {
+		return map[string]string{}, r.regions
+	}
+	return ciphertexts, failedRegions
+}
+
+// sharesThreshold is the number of shares reconstructing the data key of a data key version split into shares, 0
+// when one of its ciphertexts is of the whole data key
+func sharesThreshold(encryptedDataKeys map[string]string) int {
+	threshold := 0
+	for _, ciphertext := range encryptedDataKeys {
+		wrapped, err := parseWrappedKey(ciphertext)
+		if err != nil {
+			continue
+		}
+		if wrapped.Threshold == 0 {
+			return 0
+		}
+		threshold = wrapped.Threshold
+	}
+	return threshold
+}
+
+// combineDataKeyShares reconstructs the data key of its decrypted shares, returning it with the regions of the
+// shares separated by commas. The shares are left to the caller to destroy.
+func combineDataKeyShares(shares []decryptDataKeyResult) (*SecureBytes, string, error) {
+	xs := make([]byte, len(shares))
+	ys := make([][]byte, len(shares))
+	regions := make([]string, len(shares))
+	for i, share := range shares {
+		xs[i], ys[i], regions[i] = share.share, share.plaintext.Bytes(), share.region
+	}
+
+	plaintext, err := shamirCombine(xs, ys)
+	if err != nil {
+		return nil, "", err
+	}
+	return secureBytesOf(plaintext), strings.Join(regions, ","), nil
+}
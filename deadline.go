@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// budgetContext returns the context of the first of the given number of sequential calls left to make before the
+// deadline of ctx: its deadline leaves each of the calls after it as much time, for a slow dependency not to take
+// the whole deadline of the request. The time a call doesn't use is left to the calls after it. Without a deadline,
+// or for the last call, the deadline of ctx is kept.
+func budgetContext(ctx context.Context, calls int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || calls <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(calls))
+}
+
+// detachedContext returns a copy of ctx which isn't cancelled with it but keeps its deadline, for a call to go on
+// once its caller went away
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
+}
+
+// attemptContext returns the context of a single call, given timeout at most, 0 keeping the deadline of ctx
+func attemptContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// withDeadline gives the request timeout to complete, its budget being shared out between its calls to the store
+// and the key providers. A timeout of 0 gives it no deadline.
+func withDeadline(timeout time.Duration, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if timeout <= 0 {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// hangingKeyProvider answers none of its calls before their deadline
+type hangingKeyProvider struct {
+	KeyProvider
+}
+
+func (p *hangingKeyProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestBudgetContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	budgetCtx, cancelBudget := budgetContext(ctx, 4)
+	defer cancelBudget()
+	deadline, _ := budgetCtx.Deadline()
+	if budget := time.Until(deadline); budget > 250*time.Millisecond || budget < 200*time.Millisecond {
+		t.Fatalf("the first of 4 calls should have been given a quarter of the deadline, got %s", budget)
+	}
+
+	lastCtx, cancelLast := budgetContext(ctx, 1)
+	defer cancelLast()
+	requestDeadline, _ := ctx.Deadline()
+	if lastDeadline, _ := lastCtx.Deadline(); !lastDeadline.Equal(requestDeadline) {
+		t.Fatalf("the last call should have been given the whole deadline left")
+	}
+
+	noDeadlineCtx, cancelNoDeadline := budgetContext(context.Background(), 4)
+	defer cancelNoDeadline()
+	if _, ok := noDeadlineCtx.Deadline(); ok {
+		t.Fatalf("a request without a deadline shouldn't have been given one")
+	}
+}
+
+func TestWithDeadline(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	handler := withDeadline(time.Second, func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/key?id=user-1", nil))
+
+	if !ok || time.Until(deadline) > time.Second {
+		t.Fatalf("the request should have been given a deadline of a second, got %s", deadline)
+	}
+}
+
+func TestRetryPolicyRetriesTimedOutAttempt(t *testing.T) {
+	p := retryPolicy{maxAttempts: 2, attemptTimeout: 10 * time.Millisecond}
+	calls := 0
+	err := p.do(context.Background(), true, func() {}, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			<-ctx.Done()
+			return &smithy.CanceledError{Err: ctx.Err()}
+		}
+		return nil
+	})
+
+	if err != nil || calls != 2 {
+		t.Fatalf("the attempt which timed out should have been retried, got %d calls and %v", calls, err)
+	}
+}
+
+func TestRetryPolicyStopsBeforeDeadline(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3, initialBackoff: 24 * time.Hour, maxBackoff: 24 * time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := p.do(ctx, true, func() {}, func(context.Context) error {
+		calls++
+		return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	})
+
+	//a backoff of up to a day is all but never below 50ms
+	if calls != 1 || err == nil || time.Since(start) > 40*time.Millisecond {
+		t.Fatalf("no retry should have been made past the deadline, got %d calls in %s", calls, time.Since(start))
+	}
+}
+
+func TestCreateDataKeyBudgetsRegions(t *testing.T) {
+	t.Setenv("RKMS_TEST_BUDGET_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, LocalMasterKeySize)))
+	local, err := NewLocalKeyProvider("env:RKMS_TEST_BUDGET_KEY")
+	if err != nil {
+		t.Fatalf("failed to create local key provider: %s", err)
+	}
+
+	r := getRKMS([]bool{true, true})
+	r.providers = map[string]KeyProvider{"region-0": &hangingKeyProvider{}, "region-1": local}
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	region, _, _, err := r.createDataKey(ctx, r.providers, r.regions, nil)
+	if err != nil || *region != "region-1" {
+		t.Fatalf("the data key should have been generated in the second region before the deadline, got %v", err)
+	}
+}
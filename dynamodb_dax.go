@@ -0,0 +1,24 @@
+//go:build dax
+// +build dax
+
+package main
+
+import (
+	"github.com/aws/aws-dax-go-v2/dax"
+)
+
+// newDAXClient creates a client for the DAX cluster in front of the DynamoDB table, with the credentials of the
+// DynamoDB clients of its region
+func newDAXClient(dynamoDBConfig DynamoDBConfig) (dynamoDBAPI, error) {
+	awsConfig, err := newDynamoDBConfig(dynamoDBConfig, dynamoDBConfig.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	config := dax.DefaultConfig()
+	config.HostPorts = dynamoDBConfig.DAXEndpoints
+	config.Region = dynamoDBConfig.Region
+	config.Credentials = awsConfig.Credentials
+
+	return dax.New(config)
+}
@@ -0,0 +1,13 @@
+//go:build !dax
+// +build !dax
+
+package main
+
+import (
+	"fmt"
+)
+
+// newDAXClient fails as DAX support is only compiled in with the dax build tag
+func newDAXClient(dynamoDBConfig DynamoDBConfig) (dynamoDBAPI, error) {
+	return nil, fmt.Errorf("dax_endpoints is set but rkms was built without DAX support, rebuild it with -tags dax")
+}
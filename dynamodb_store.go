@@ -2,109 +2,1108 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	cache "github.com/patrickmn/go-cache"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	logger "github.com/sirupsen/logrus"
 )
 
-// DynamoDBStore - a DynamoDB implementation of a key/value store for KMS-related data
+// DynamoDBStore - a DynamoDB implementation of a key/value store for KMS-related data.
+//
+// When replica regions of a Global Table are configured, reads fail over to the next region
+// whenever a region is throttling or returning server errors, or right away while its circuit breaker is open
+// after failing in a row. Writes are only made to the first region: Global Tables replicate asynchronously, so
+// two conditional writes accepted by different replicas would both pass, and replication would silently drop one.
+//
+// With a DAX cluster configured, reads are first served (eventually consistent) by DAX.
+// Items are only updated to rewrap the same data keys, so DAX can only be behind with keys that still
+// decrypt, or for ids that were just created or deleted: misses, expired items and DAX failures fall back
+// to a consistent read from DynamoDB.
+//
+// The ids read as missing are cached as such for negativeCacheExpiration, 0 disabling it, so the hot lookups of ids
+// which don't exist don't make a consistent read each. A conditional write failing because the id was created since
+// drops the entry, for the id to be read again.
+//
+// With invalidations set, the ids this replica of rkms updates, deletes or creates are invalidated in the caches
+// of the other replicas, and the ids they invalidate are dropped from its cache. With the DynamoDB stream of the
+// table as invalidations, nothing is published: every write to the table, whoever made it, drops the id.
+//
+// The ids which aren't cached are read consistently with consistentReads, eventually otherwise, unless the context
+// asks for a read consistency. A strong read asked for by the context bypasses the cache and DAX as well, for an id
+// created or updated by another replica to be read as it is.
 type DynamoDBStore struct {
-	tableName *string
-	client    *dynamodb.DynamoDB
-	keysCache *cache.Cache
+	tableName               *string
+	replicas                []dynamoDBReplica
+	dax                     dynamoDBAPI
+	keysCache               *lruCache
+	negativeCacheExpiration time.Duration
+	invalidations           cacheInvalidator
+	consistentReads         bool
 }
 
-type item struct {
-	ID   string            `json:"id"`
-	Keys map[string]string `json:"keys"`
+// missingItem is the cache entry of an id read as missing
+type missingItem struct{}
+
+// dynamoDBAPI is the subset of the DynamoDB client used by DynamoDBStore
+type dynamoDBAPI interface {
+	GetItem(context.Context, *dynamodb.GetItemInput, ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	BatchGetItem(context.Context, *dynamodb.BatchGetItemInput, ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	PutItem(context.Context, *dynamodb.PutItemInput, ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(context.Context, *dynamodb.UpdateItemInput, ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(context.Context, *dynamodb.DeleteItemInput, ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Scan(context.Context, *dynamodb.ScanInput, ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// dynamoDBBatchGetItemLimit is the maximum number of keys a BatchGetItem request can read
+const dynamoDBBatchGetItemLimit = 100
+
+// dynamoDBUnprocessedKeysRetries bounds how many times the unprocessed keys of a
+// BatchGetItem request are retried before giving up
+const dynamoDBUnprocessedKeysRetries = 8
+
+type dynamoDBReplica struct {
+	region  string
+	client  dynamoDBAPI
+	breaker *circuitBreaker
+}
+
+// dynamoDBFailoverErrorCodes are the error codes for which the next replica region is tried
+var dynamoDBFailoverErrorCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"InternalServerError":                    true,
+	"RequestLimitExceeded":                   true,
+	"ThrottlingException":                    true,
+	"ServiceUnavailable":                     true,
+}
+
+func init() {
+	RegisterStore("dynamodb", func(config *Configuration) (Store, error) {
+		return NewDynamoDBStore(config.DynamoDB)
+	})
 }
 
 // NewDynamoDBStore creates a new DynamoDBStore instance
 func NewDynamoDBStore(dynamoDBConfig DynamoDBConfig) (*DynamoDBStore, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(dynamoDBConfig.Region),
-	})
+	regions := append([]string{dynamoDBConfig.Region}, dynamoDBConfig.ReplicaRegions...)
+	replicas := make([]dynamoDBReplica, 0, len(regions))
+
+	for i, region := range regions {
+		awsConfig, err := newDynamoDBConfig(dynamoDBConfig, region)
+
+		if err != nil {
+			logStoreError(context.Background(), "dynamodb", "NewDynamoDBStore", "", err)
+			return nil, err
+		}
 
+		client := dynamodb.NewFromConfig(awsConfig)
+		if i == 0 && dynamoDBConfig.CreateTableIfMissing {
+			if err := ensureDynamoDBTable(context.Background(), client, aws.String(dynamoDBConfig.TableName), dynamoDBConfig.CacheInvalidation.Streams.Enabled); err != nil {
+				logger.Errorf("failed to create DynamoDB table %s: %s", dynamoDBConfig.TableName, err)
+				return nil, err
+			}
+		}
+
+		replicas = append(replicas, dynamoDBReplica{region, client, newCircuitBreaker("dynamodb:"+region, dynamoDBConfig.CircuitBreaker)})
+	}
+
+	var dax dynamoDBAPI
+	if len(dynamoDBConfig.DAXEndpoints) > 0 {
+		var err error
+		if dax, err = newDAXClient(dynamoDBConfig); err != nil {
+			logStoreError(context.Background(), "dynamodb", "NewDynamoDBStore", "", err)
+			return nil, err
+		}
+	}
+
+	keysCache := newLRUCache("dynamodb", dynamoDBConfig.CacheMaxEntries, dynamoDBConfig.CacheMaxSizeInMegabytes<<20,
+		time.Duration(dynamoDBConfig.CacheExpiration)*time.Minute, time.Duration(dynamoDBConfig.CacheCleanupInterval)*time.Minute, cachedItemSize)
+	invalidations, err := newCacheInvalidator(dynamoDBConfig.CacheInvalidation)
+	if err == nil && invalidations == nil {
+		invalidations, err = newStreamsCacheInvalidator(dynamoDBConfig)
+	}
 	if err != nil {
-		logger.Print(err)
+		logStoreError(context.Background(), "dynamodb", "NewDynamoDBStore", "", err)
 		return nil, err
 	}
 
-	client := dynamodb.New(sess)
-	keysCache := cache.New(time.Duration(dynamoDBConfig.CacheExpiration)*time.Minute, time.Duration(dynamoDBConfig.CacheCleanupInterval)*time.Minute)
-	return &DynamoDBStore{aws.String(dynamoDBConfig.TableName), client, keysCache}, nil
+	negativeCacheExpiration := time.Duration(dynamoDBConfig.NegativeCacheExpirationInSeconds) * time.Second
+	consistentReads := dynamoDBConfig.ReadConsistency == ReadConsistencyStrong
+	s := &DynamoDBStore{aws.String(dynamoDBConfig.TableName), replicas, dax, keysCache, negativeCacheExpiration, invalidations, consistentReads}
+	if invalidations != nil {
+		//the store lives as long as the process
+		go runCacheInvalidations(context.Background(), invalidations, s.keysCache.Delete)
+	}
+	return s, nil
+}
+
+// newDynamoDBConfig loads the configuration of the DynamoDB clients of the given region, with the credentials of the
+// role of the region when it has one
+func newDynamoDBConfig(dynamoDBConfig DynamoDBConfig, region string) (aws.Config, error) {
+	awsConfig, err := loadAWSConfig(region, dynamoDBAWSConfig(dynamoDBConfig)...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	return assumeRole(awsConfig, dynamoDBConfig.RoleARNs[region]), nil
+}
+
+// dynamoDBAWSConfig is the configuration of the DynamoDB clients, on top of the default one of their region
+func dynamoDBAWSConfig(dynamoDBConfig DynamoDBConfig) []func(*config.LoadOptions) error {
+	//the requests are retried by RKMS, with the retries of [store.retry]
+	options := []func(*config.LoadOptions) error{withoutRetries}
+
+	if dynamoDBConfig.Endpoint != "" {
+		options = append(options, config.WithBaseEndpoint(dynamoDBConfig.Endpoint))
+	}
+
+	if dynamoDBConfig.AccessKeyID != "" {
+		options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(dynamoDBConfig.AccessKeyID, dynamoDBConfig.SecretAccessKey, "")))
+	}
+
+	return options
+}
+
+// shouldFailover is true for errors that another replica region may not be having
+func shouldFailover(err error) bool {
+	if awsStatusCode(err) >= 500 || isAWSRequestError(err) {
+		return true
+	}
+
+	return dynamoDBFailoverErrorCodes[awsErrorCode(err)]
+}
+
+// withFailover calls fn with the client of every replica region, in order, until one of them
+// succeeds or fails with an error that isn't worth failing over for. The regions whose circuit
+// breaker is open are skipped. The latency of every call is recorded under the given operation.
+// Only the reads fail over, the writes are made with withPrimary.
+func (s *DynamoDBStore) withFailover(ctx context.Context, operation string, fn func(client dynamoDBAPI) error) error {
+	var err error
+	for i, replica := range s.replicas {
+		err = s.callReplica(ctx, replica, operation, fn)
+
+		_, open := err.(CircuitOpenError)
+		if err == nil || !(open || shouldFailover(err)) || ctx.Err() != nil {
+			return err
+		}
+
+		if i < len(s.replicas)-1 {
+			contextLogger(ctx).WithFields(logger.Fields{"store": "dynamodb", "region": replica.region, "operation": operation}).Infof("DynamoDB failed, failing over to %s region: %s", s.replicas[i+1].region, err)
+		}
+	}
+
+	return err
+}
+
+// withPrimary calls fn with the client of the first region, whose latency is recorded under the given operation.
+// The writes aren't failed over to the replica regions, for the conditional ones to keep their first writer wins.
+func (s *DynamoDBStore) withPrimary(ctx context.Context, operation string, fn func(client dynamoDBAPI) error) error {
+	return s.callReplica(ctx, s.replicas[0], operation, fn)
+}
+
+// callReplica calls fn with the client of replica through its circuit breaker, recording the latency of the call
+// under the given operation unless the breaker is open
+func (s *DynamoDBStore) callReplica(ctx context.Context, replica dynamoDBReplica, operation string, fn func(client dynamoDBAPI) error) error {
+	start := time.Now()
+	err := replica.breaker.call(ctx, shouldFailover, func() error {
+		return fn(replica.client)
+	})
+
+	if _, open := err.(CircuitOpenError); !open {
+		observeStore("dynamodb", replica.region, operation, start, err)
+	}
+	return err
 }
 
 // GetEncryptedDataKeys retrieves the encrypted data keys for the given id
 func (s *DynamoDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetExpiringEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetExpiringEncryptedDataKeys retrieves the encrypted data keys for the given id along with the time they expire at
+func (s *DynamoDBStore) GetExpiringEncryptedDataKeys(ctx context.Context, id string) (map[string]string, time.Time, error) {
+	strong := readConsistencyFromContext(ctx) == ReadConsistencyStrong
+
 	//check if id is cached
-	if keys, found := s.keysCache.Get(id); found {
-		return *keys.(*map[string]string), nil
+	if item, found := s.cachedItem(id); found && !strong {
+		if item == nil {
+			return nil, time.Time{}, nil
+		}
+		return item.Keys, item.expiresAt(), nil
+	}
+
+	var item *item
+	if !strong {
+		item = s.getItemFromDAX(ctx, id)
+	}
+	if item == nil {
+		var err error
+		if item, err = s.getItem(ctx, id, s.consistentRead(ctx)); err != nil {
+			return nil, time.Time{}, err
+		}
+		if item == nil {
+			s.cacheMissingItem(id)
+			return nil, time.Time{}, nil
+		}
+	}
+
+	if item.deleted() {
+		return nil, time.Time{}, item.deletedError()
+	}
+
+	s.keysCache.Set(id, item, 0)
+	return item.Keys, item.expiresAt(), nil
+}
+
+// consistentRead tells if the reads made with ctx are strongly consistent, as its read consistency asks or else as
+// the store is configured
+func (s *DynamoDBStore) consistentRead(ctx context.Context) bool {
+	switch readConsistencyFromContext(ctx) {
+	case ReadConsistencyStrong:
+		return true
+	case ReadConsistencyEventual:
+		return false
+	}
+	return s.consistentReads
+}
+
+// cachedItem returns the cached item of the given id and whether it was found in the cache, the item being nil
+// when the id is cached as missing. An item which has expired isn't found.
+func (s *DynamoDBStore) cachedItem(id string) (*item, bool) {
+	cached, found := s.keysCache.Get(id)
+	if !found {
+		observeCache("dynamodb", false)
+		return nil, false
+	}
+
+	if _, missing := cached.(missingItem); missing {
+		observeCache("dynamodb", true)
+		return nil, true
+	}
+
+	item := cached.(*item)
+	if item.expired(time.Now()) {
+		s.keysCache.Delete(id)
+		observeCache("dynamodb", false)
+		return nil, false
+	}
+
+	observeCache("dynamodb", true)
+	return item, true
+}
+
+// cachedItemSize estimates the size in bytes of a cached item, or of an id cached as missing
+func cachedItemSize(id string, value interface{}) int {
+	item, ok := value.(*item)
+	if !ok {
+		return 0
+	}
+
+	//the fields of the item, and the overhead of an entry of the map of its keys
+	size := len(item.ID) + 64
+	for region, ciphertext := range item.Keys {
+		size += len(region) + len(ciphertext) + 48
+	}
+	return size
+}
+
+// invalidate drops the cache entry of id, in this replica and in the other ones
+func (s *DynamoDBStore) invalidate(ctx context.Context, id string) {
+	s.keysCache.Delete(id)
+	s.publishInvalidation(ctx, id)
+}
+
+// publishInvalidation invalidates the cache entry of id in the other replicas, if they are told about them. The
+// replicas which don't get it serve the entry until it expires.
+func (s *DynamoDBStore) publishInvalidation(ctx context.Context, id string) {
+	if s.invalidations == nil {
+		return
+	}
+
+	if err := s.invalidations.publish(ctx, id); err != nil {
+		cacheInvalidationFailuresTotal.inc("dynamodb")
+		contextLogger(ctx).Warnf("failed to invalidate the cache entry of the id in the other replicas: %s", err)
+	}
+}
+
+// RecentIDs returns up to limit ids of the cached items, the most recently used first
+func (s *DynamoDBStore) RecentIDs(limit int) []string {
+	return s.keysCache.Keys(limit, func(value interface{}) bool {
+		_, missing := value.(missingItem)
+		return !missing
+	})
+}
+
+// cacheMissingItem caches the given id as missing, unless the negative cache is disabled
+func (s *DynamoDBStore) cacheMissingItem(id string) {
+	if s.negativeCacheExpiration > 0 {
+		s.keysCache.Set(id, missingItem{}, s.negativeCacheExpiration)
+	}
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with
+// BatchGetItem requests. Unlike GetEncryptedDataKeys, it doesn't read through DAX.
+func (s *DynamoDBStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	keys := make(map[string]map[string]string, len(ids))
+	requested := make(map[string]bool, len(ids))
+	requestKeys := make([]map[string]types.AttributeValue, 0, len(ids))
+	strong := readConsistencyFromContext(ctx) == ReadConsistencyStrong
+
+	for _, id := range ids {
+		//BatchGetItem rejects requests with duplicate keys
+		if requested[id] {
+			continue
+		}
+		requested[id] = true
+
+		if item, found := s.cachedItem(id); found && !strong {
+			if item != nil {
+				keys[id] = item.Keys
+			}
+			continue
+		}
+
+		requestKeys = append(requestKeys, dynamoDBKey(id))
+	}
+
+	for start := 0; start < len(requestKeys); start += dynamoDBBatchGetItemLimit {
+		end := start + dynamoDBBatchGetItemLimit
+		if end > len(requestKeys) {
+			end = len(requestKeys)
+		}
+
+		if err := s.batchGetItems(ctx, requestKeys[start:end], keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// batchGetItems reads the items of up to dynamoDBBatchGetItemLimit keys into keys,
+// retrying with a backoff the keys DynamoDB left unprocessed
+func (s *DynamoDBStore) batchGetItems(ctx context.Context, requestKeys []map[string]types.AttributeValue, keys map[string]map[string]string) error {
+	for retry := 0; len(requestKeys) > 0; retry++ {
+		if retry > dynamoDBUnprocessedKeysRetries {
+			err := fmt.Errorf("DynamoDB left %d keys unprocessed after %d retries", len(requestKeys), dynamoDBUnprocessedKeysRetries)
+			logStoreError(ctx, "dynamodb", "batchGetItems", "", err)
+			return err
+		}
+
+		if retry > 0 {
+			select {
+			case <-time.After(time.Duration(1<<uint(retry-1)) * 50 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		input := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{
+				*s.tableName: {
+					Keys:           requestKeys,
+					ConsistentRead: aws.Bool(s.consistentRead(ctx)),
+				},
+			},
+		}
+
+		var result *dynamodb.BatchGetItemOutput
+		err := s.withFailover(ctx, "BatchGetItem", func(client dynamoDBAPI) (err error) {
+			result, err = client.BatchGetItem(ctx, input)
+			return err
+		})
+
+		if err != nil {
+			logStoreError(ctx, "dynamodb", "batchGetItems", "", err)
+			return err
+		}
+
+		now := time.Now()
+		for _, attributes := range result.Responses[*s.tableName] {
+			item := &item{}
+			if err := unmarshalDynamoDBItem(attributes, item); err != nil {
+				logStoreError(ctx, "dynamodb", "batchGetItems", "", err)
+				return err
+			}
+
+			if item.deleted() || item.expired(now) {
+				continue
+			}
+
+			s.keysCache.Set(item.ID, item, 0)
+			keys[item.ID] = item.Keys
+		}
+
+		requestKeys = nil
+		if unprocessed, ok := result.UnprocessedKeys[*s.tableName]; ok {
+			requestKeys = unprocessed.Keys
+		}
+	}
+
+	return nil
+}
+
+// getItemFromDAX reads the item through the DAX cluster, if there is one.
+// It returns nil when the cluster fails, misses the item or has it expired, for the caller to
+// read from DynamoDB instead: an expired item may have been set again since DAX cached it.
+func (s *DynamoDBStore) getItemFromDAX(ctx context.Context, id string) *item {
+	if s.dax == nil {
+		return nil
 	}
 
 	input := &dynamodb.GetItemInput{
 		TableName: s.tableName,
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(id),
-			},
-		},
-		ConsistentRead: aws.Bool(true),
+		Key:       dynamoDBKey(id),
 	}
 
-	result, err := s.client.GetItemWithContext(ctx, input)
+	start := time.Now()
+	result, err := s.dax.GetItem(ctx, input)
+	observeStore("dax", s.replicas[0].region, "GetItem", start, err)
 	if err != nil {
-		logger.Print(err)
-		return nil, err
+		contextLogger(ctx).Infof("failed to read from DAX, reading from DynamoDB instead: %s", err)
+		return nil
 	}
 
 	if result.Item == nil {
-		return nil, nil
+		return nil
 	}
 
-	item := item{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
-	if err != nil {
-		logger.Print(err)
-		return nil, err
+	item := &item{}
+	if err := unmarshalDynamoDBItem(result.Item, item); err != nil {
+		contextLogger(ctx).Infof("failed to read from DAX, reading from DynamoDB instead: %s", err)
+		return nil
+	}
+
+	if item.expired(time.Now()) {
+		return nil
 	}
 
-	s.keysCache.Set(id, &item.Keys, cache.DefaultExpiration)
-	return item.Keys, nil
+	return item
 }
 
 // SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
 // only if id does not exist in the store already.
 // If the id already exists, an error is returned.
 func (s *DynamoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
-	item := item{ID: id, Keys: encryptedKeysMap}
-	marshalledItem, err := dynamodbattribute.MarshalMap(item)
+	return s.putItemConditionally(ctx, &item{ID: id, Keys: encryptedKeysMap})
+}
+
+// SetExpiringEncryptedDataKeysConditionally sets the encrypted data keys for the given id, expiring at expiresAt,
+// only if id does not exist in the store already or has expired.
+// The table needs TTL enabled on the expires_at attribute for DynamoDB to delete the expired items.
+func (s *DynamoDBStore) SetExpiringEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string, expiresAt time.Time) error {
+	return s.putItemConditionally(ctx, &item{ID: id, Keys: encryptedKeysMap, ExpiresAt: expiresAt.Unix()})
+}
+
+func (s *DynamoDBStore) putItemConditionally(ctx context.Context, item *item) error {
+	marshalledItem, err := marshalDynamoDBItem(item)
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "putItemConditionally", "", err)
+		return err
+	}
 
-	conditionExpression := "attribute_not_exists(id)"
+	//expired items may not have been deleted by DynamoDB yet
+	conditionExpression := "attribute_not_exists(id) OR expires_at <= :now"
 	input := &dynamodb.PutItemInput{
 		TableName:           s.tableName,
 		Item:                marshalledItem,
 		ConditionExpression: aws.String(conditionExpression),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	err = s.withPrimary(ctx, "PutItem", func(client dynamoDBAPI) error {
+		_, err := client.PutItem(ctx, input)
+		return err
+	})
+
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			//the id may be cached as missing, while it was created since
+			s.keysCache.Delete(item.ID)
+			return IDAlreadyExistsStoreError{ID: item.ID}
+		}
+
+		logStoreError(ctx, "dynamodb", "putItemConditionally", "", err)
+		return err
+	}
+
+	s.keysCache.Set(item.ID, item, 0)
+	//the other replicas may have the id cached as missing
+	s.publishInvalidation(ctx, item.ID)
+	return nil
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version.
+// It always reads consistently from DynamoDB, bypassing the cache and DAX.
+func (s *DynamoDBStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	item, err := s.getItem(ctx, id, true)
+	if err != nil || item == nil {
+		return nil, 0, err
+	}
+
+	if item.deleted() {
+		return nil, 0, item.deletedError()
 	}
 
-	_, err = s.client.PutItemWithContext(ctx, input)
+	return item.Keys, item.Version, nil
+}
+
+// getItem reads the item of the given id, consistently or not, nil if it does not exist or has expired.
+// DynamoDB deletes expired items within a couple of days, until then they are filtered out.
+func (s *DynamoDBStore) getItem(ctx context.Context, id string, consistent bool) (*item, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      s.tableName,
+		Key:            dynamoDBKey(id),
+		ConsistentRead: aws.Bool(consistent),
+	}
+
+	var result *dynamodb.GetItemOutput
+	err := s.withFailover(ctx, "GetItem", func(client dynamoDBAPI) (err error) {
+		result, err = client.GetItem(ctx, input)
+		return err
+	})
+
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-				return IDAlreadyExistsStoreError{ID: id}
+		logStoreError(ctx, "dynamodb", "getItem", id, err)
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	item := &item{}
+	if err := unmarshalDynamoDBItem(result.Item, item); err != nil {
+		logStoreError(ctx, "dynamodb", "getItem", id, err)
+		return nil, err
+	}
+
+	if item.expired(time.Now()) {
+		return nil, nil
+	}
+
+	return item, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *DynamoDBStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	keys, err := attributevalue.Marshal(encryptedKeysMap)
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	//items that were never updated have no version attribute
+	versionCondition := "#version = :expectedVersion"
+	if expectedVersion == 0 {
+		versionCondition = "attribute_not_exists(#version)"
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           s.tableName,
+		Key:                 dynamoDBKey(id),
+		UpdateExpression:    aws.String("SET #keys = :keys, #version = :version"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(deleted_at) AND " + dynamoDBNotExpiredCondition + " AND " + versionCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#keys":    "keys",
+			"#version": "version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":keys":    keys,
+			":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion+1, 10)},
+			":now":     dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	if expectedVersion != 0 {
+		input.ExpressionAttributeValues[":expectedVersion"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion, 10)}
+	}
+
+	err = s.updateItem(ctx, input)
+	if err != nil {
+		if !isConditionalCheckFailed(err) {
+			logStoreError(ctx, "dynamodb", "UpdateEncryptedDataKeys", id, err)
+			return err
+		}
+
+		//the condition doesn't tell which part of it failed, the current item does
+		current, err := s.getItem(ctx, id, true)
+		if err != nil {
+			return err
+		}
+
+		if err := checkVersion(id, current, expectedVersion); err != nil {
+			return err
+		}
+
+		return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+	}
+
+	//the update leaves expires_at as it was, the next read caches it again
+	s.invalidate(ctx, id)
+	return nil
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *DynamoDBStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           s.tableName,
+		Key:                 dynamoDBKey(id),
+		UpdateExpression:    aws.String("SET deleted_at = :now"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(deleted_at)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	err := s.updateItem(ctx, input)
+	if err != nil && !isConditionalCheckFailed(err) {
+		logStoreError(ctx, "dynamodb", "DeleteEncryptedDataKeys", id, err)
+		return err
+	}
+
+	s.invalidate(ctx, id)
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *DynamoDBStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           s.tableName,
+		Key:                 dynamoDBKey(id),
+		UpdateExpression:    aws.String("REMOVE deleted_at"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	}
+
+	err := s.updateItem(ctx, input)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return IDNotFoundStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "dynamodb", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *DynamoDBStore) updateItem(ctx context.Context, input *dynamodb.UpdateItemInput) error {
+	return s.withPrimary(ctx, "UpdateItem", func(client dynamoDBAPI) error {
+		_, err := client.UpdateItem(ctx, input)
+		return err
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *DynamoDBStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: s.tableName,
+		Key:       dynamoDBKey(id),
+	}
+
+	err := s.withPrimary(ctx, "DeleteItem", func(client dynamoDBAPI) error {
+		_, err := client.DeleteItem(ctx, input)
+		return err
+	})
+
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	s.invalidate(ctx, id)
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the table that are neither deleted nor expired, the idempotency
+// and approval records left out.
+// The cursor is the id the scan stopped at, so a listing can go on in another replica region.
+func (s *DynamoDBStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	input := &dynamodb.ScanInput{
+		TableName:            s.tableName,
+		ProjectionExpression: aws.String("id"),
+		FilterExpression:     aws.String("attribute_not_exists(deleted_at) AND attribute_not_exists(fingerprint) AND attribute_not_exists(requested_by) AND " + dynamoDBNotExpiredCondition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	ids := make([]string, 0, limit)
+	//the limit applies before the filter, so scanning goes on until the page is full or the table is scanned
+	for {
+		if cursor != "" {
+			input.ExclusiveStartKey = dynamoDBKey(cursor)
+		}
+		input.Limit = aws.Int32(int32(limit - len(ids)))
+
+		var result *dynamodb.ScanOutput
+		err := s.withFailover(ctx, "Scan", func(client dynamoDBAPI) (err error) {
+			result, err = client.Scan(ctx, input)
+			return err
+		})
+
+		if err != nil {
+			logStoreError(ctx, "dynamodb", "ListIDs", "", err)
+			return nil, "", err
+		}
+
+		ids = append(ids, dynamoDBIDs(result.Items)...)
+
+		cursor = ""
+		if id, ok := result.LastEvaluatedKey["id"].(*types.AttributeValueMemberS); ok {
+			cursor = id.Value
+		}
+
+		if cursor == "" || len(ids) >= limit {
+			return ids, cursor, nil
+		}
+	}
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *DynamoDBStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.scanIDs(ctx, &dynamodb.ScanInput{
+		TableName:            s.tableName,
+		ProjectionExpression: aws.String("id"),
+		FilterExpression:     aws.String("deleted_at < :deletedBefore"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deletedBefore": dynamoDBUnixTime(deletedBefore),
+		},
+	})
+}
+
+func (s *DynamoDBStore) scanIDs(ctx context.Context, input *dynamodb.ScanInput) ([]string, error) {
+	var ids []string
+	err := s.withFailover(ctx, "Scan", func(client dynamoDBAPI) error {
+		//a failed over scan starts from scratch in the next region
+		ids = make([]string, 0)
+		pages := dynamodb.NewScanPaginator(client, input)
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return err
 			}
+			ids = append(ids, dynamoDBIDs(page.Items)...)
 		}
+		return nil
+	})
+
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "scanIDs", "", err)
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// dynamoDBIdempotencyRecordPrefix prefixes the id of the items of the idempotency records, which share the table
+// with the encrypted data keys and are told apart by their fingerprint attribute. The prefix is reserved, see
+// checkReservedID, and the records are written on the condition of the fingerprint for an item saved before it was
+// not to be overwritten.
+const dynamoDBIdempotencyRecordPrefix = "idempotency#"
+
+// dynamoDBIdempotencyRecordCondition is the condition of the writes of the idempotency records, not to replace the
+// encrypted data keys of an id
+const dynamoDBIdempotencyRecordCondition = "(attribute_not_exists(id) OR attribute_exists(fingerprint))"
+
+// SetIdempotencyRecordConditionally saves the given record only if its key has no unexpired record yet.
+// The records expire through the TTL of the table.
+func (s *DynamoDBStore) SetIdempotencyRecordConditionally(ctx context.Context, record *IdempotencyRecord) error {
+	err := s.putIdempotencyRecord(ctx, record, "attribute_not_exists(id) OR (attribute_exists(fingerprint) AND expires_at <= :now)", map[string]types.AttributeValue{
+		":now": dynamoDBUnixTime(time.Now()),
+	})
+	if isConditionalCheckFailed(err) {
+		return IDAlreadyExistsStoreError{ID: record.Key}
+	}
+	return err
+}
+
+// SetIdempotencyRecord saves the given record, replacing the record of its key
+func (s *DynamoDBStore) SetIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error {
+	err := s.putIdempotencyRecord(ctx, record, dynamoDBIdempotencyRecordCondition, nil)
+	if isConditionalCheckFailed(err) {
+		return IDAlreadyExistsStoreError{ID: record.Key}
+	}
+	return err
+}
 
-		logger.Print(err)
+func (s *DynamoDBStore) putIdempotencyRecord(ctx context.Context, record *IdempotencyRecord, conditionExpression string, expressionAttributeValues map[string]types.AttributeValue) error {
+	marshalledRecord, err := marshalDynamoDBItem(record)
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "putIdempotencyRecord", "", err)
+		return err
+	}
+	marshalledRecord["id"] = &types.AttributeValueMemberS{Value: dynamoDBIdempotencyRecordPrefix + record.Key}
+
+	input := &dynamodb.PutItemInput{
+		TableName:                 s.tableName,
+		Item:                      marshalledRecord,
+		ConditionExpression:       aws.String(conditionExpression),
+		ExpressionAttributeValues: expressionAttributeValues,
+	}
+
+	err = s.withPrimary(ctx, "PutItem", func(client dynamoDBAPI) error {
+		_, err := client.PutItem(ctx, input)
+		return err
+	})
+
+	if err != nil && !isConditionalCheckFailed(err) {
+		logStoreError(ctx, "dynamodb", "putIdempotencyRecord", "", err)
+	}
+	return err
+}
+
+// GetIdempotencyRecord retrieves the unexpired record of the given key, reading consistently from DynamoDB
+func (s *DynamoDBStore) GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      s.tableName,
+		Key:            dynamoDBKey(dynamoDBIdempotencyRecordPrefix + key),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	var result *dynamodb.GetItemOutput
+	err := s.withFailover(ctx, "GetItem", func(client dynamoDBAPI) (err error) {
+		result, err = client.GetItem(ctx, input)
+		return err
+	})
+
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "GetIdempotencyRecord", "", err)
+		return nil, err
+	}
+
+	//an item without fingerprint is the data key of an id saved before the prefix was reserved
+	if result.Item == nil || result.Item["fingerprint"] == nil {
+		return nil, nil
+	}
+
+	record := &IdempotencyRecord{}
+	if err := unmarshalDynamoDBItem(result.Item, record); err != nil {
+		logStoreError(ctx, "dynamodb", "GetIdempotencyRecord", "", err)
+		return nil, err
+	}
+
+	if record.expired(time.Now()) {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+// DeleteIdempotencyRecord removes the record of the given key
+func (s *DynamoDBStore) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName:           s.tableName,
+		Key:                 dynamoDBKey(dynamoDBIdempotencyRecordPrefix + key),
+		ConditionExpression: aws.String(dynamoDBIdempotencyRecordCondition),
+	}
+
+	err := s.withPrimary(ctx, "DeleteItem", func(client dynamoDBAPI) error {
+		_, err := client.DeleteItem(ctx, input)
+		return err
+	})
+
+	//the item is the data key of an id rather than a record, there is no record to delete
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "DeleteIdempotencyRecord", "", err)
 		return err
 	}
 
-	s.keysCache.Set(id, &encryptedKeysMap, cache.DefaultExpiration)
 	return nil
 }
+
+// dynamoDBApprovalRecordPrefix prefixes the id of the items of the approval records, which share the table with the
+// encrypted data keys and are told apart by their requested_by attribute. Like dynamoDBIdempotencyRecordPrefix, the
+// prefix is reserved and the records are written on the condition of their requested_by attribute.
+const dynamoDBApprovalRecordPrefix = "approval#"
+
+// SetApprovalRecord saves the given record under its approval id, the records expiring through the TTL of the table
+func (s *DynamoDBStore) SetApprovalRecord(ctx context.Context, record *ApprovalRecord) error {
+	marshalledRecord, err := marshalDynamoDBItem(record)
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "SetApprovalRecord", "", err)
+		return err
+	}
+	marshalledRecord["id"] = &types.AttributeValueMemberS{Value: dynamoDBApprovalRecordPrefix + record.ApprovalID}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           s.tableName,
+		Item:                marshalledRecord,
+		ConditionExpression: aws.String("attribute_not_exists(id) OR attribute_exists(requested_by)"),
+	}
+
+	err = s.withPrimary(ctx, "PutItem", func(client dynamoDBAPI) error {
+		_, err := client.PutItem(ctx, input)
+		return err
+	})
+
+	//not to replace the encrypted data keys of an id saved before the prefix was reserved
+	if isConditionalCheckFailed(err) {
+		return IDAlreadyExistsStoreError{ID: record.ApprovalID}
+	}
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "SetApprovalRecord", "", err)
+		return err
+	}
+	return nil
+}
+
+// GetApprovalRecord retrieves the unexpired record of the given approval id, reading consistently from DynamoDB
+func (s *DynamoDBStore) GetApprovalRecord(ctx context.Context, approvalID string) (*ApprovalRecord, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      s.tableName,
+		Key:            dynamoDBKey(dynamoDBApprovalRecordPrefix + approvalID),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	var result *dynamodb.GetItemOutput
+	err := s.withFailover(ctx, "GetItem", func(client dynamoDBAPI) (err error) {
+		result, err = client.GetItem(ctx, input)
+		return err
+	})
+
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "GetApprovalRecord", "", err)
+		return nil, err
+	}
+
+	if result.Item == nil || result.Item["requested_by"] == nil {
+		return nil, nil
+	}
+
+	record := &ApprovalRecord{}
+	if err := unmarshalDynamoDBItem(result.Item, record); err != nil {
+		logStoreError(ctx, "dynamodb", "GetApprovalRecord", "", err)
+		return nil, err
+	}
+
+	if record.expired(time.Now()) {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+// ListApprovalRecords scans the table for every unexpired approval record
+func (s *DynamoDBStore) ListApprovalRecords(ctx context.Context) ([]*ApprovalRecord, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        s.tableName,
+		FilterExpression: aws.String("begins_with(id, :prefix) AND attribute_exists(requested_by) AND expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: dynamoDBApprovalRecordPrefix},
+			":now":    dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	var records []*ApprovalRecord
+	err := s.withFailover(ctx, "Scan", func(client dynamoDBAPI) error {
+		//a failed over scan starts from scratch in the next region
+		records = make([]*ApprovalRecord, 0)
+		pages := dynamodb.NewScanPaginator(client, input)
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, attributes := range page.Items {
+				record := &ApprovalRecord{}
+				if err := unmarshalDynamoDBItem(attributes, record); err == nil {
+					records = append(records, record)
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "ListApprovalRecords", "", err)
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// DeleteApprovalRecord removes the unexpired record of the given approval id, conditionally for two requests not to
+// both take it
+func (s *DynamoDBStore) DeleteApprovalRecord(ctx context.Context, approvalID string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName:           s.tableName,
+		Key:                 dynamoDBKey(dynamoDBApprovalRecordPrefix + approvalID),
+		ConditionExpression: aws.String("attribute_exists(requested_by) AND expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": dynamoDBUnixTime(time.Now()),
+		},
+	}
+
+	err := s.withPrimary(ctx, "DeleteItem", func(client dynamoDBAPI) error {
+		_, err := client.DeleteItem(ctx, input)
+		return err
+	})
+
+	if isConditionalCheckFailed(err) {
+		return IDNotFoundStoreError{ID: approvalID}
+	}
+	if err != nil {
+		logStoreError(ctx, "dynamodb", "DeleteApprovalRecord", "", err)
+		return err
+	}
+
+	return nil
+}
+
+func dynamoDBKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// dynamoDBIDs returns the ids of the given items
+func dynamoDBIDs(items []map[string]types.AttributeValue) []string {
+	ids := make([]string, 0, len(items))
+	for _, attributes := range items {
+		if id, ok := attributes["id"].(*types.AttributeValueMemberS); ok {
+			ids = append(ids, id.Value)
+		}
+	}
+	return ids
+}
+
+// marshalDynamoDBItem marshals an item or a record into the attributes of the table, named after the json tags of
+// its fields
+func marshalDynamoDBItem(in interface{}) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMapWithOptions(in, func(options *attributevalue.EncoderOptions) {
+		options.TagKey = "json"
+	})
+}
+
+// unmarshalDynamoDBItem unmarshals the attributes of an item into out, as marshalled by marshalDynamoDBItem
+func unmarshalDynamoDBItem(attributes map[string]types.AttributeValue, out interface{}) error {
+	return attributevalue.UnmarshalMapWithOptions(attributes, out, func(options *attributevalue.DecoderOptions) {
+		options.TagKey = "json"
+	})
+}
+
+// dynamoDBNotExpiredCondition matches the items that never expire or haven't expired by :now
+const dynamoDBNotExpiredCondition = "(attribute_not_exists(expires_at) OR expires_at > :now)"
+
+func dynamoDBUnixTime(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	return awsErrorCode(err) == "ConditionalCheckFailedException"
+}
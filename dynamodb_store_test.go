@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type throttledDynamoDBClient struct {
+	dynamoDBAPI
+	calls int
+}
+
+func (c *throttledDynamoDBClient) GetItem(context.Context, *dynamodb.GetItemInput, ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.calls++
+	return nil, newTestAWSResponseError("ProvisionedThroughputExceededException", http.StatusBadRequest)
+}
+
+func (c *throttledDynamoDBClient) PutItem(context.Context, *dynamodb.PutItemInput, ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.calls++
+	return nil, newTestAWSResponseError("InternalFailure", http.StatusInternalServerError)
+}
+
+type conditionalDynamoDBClient struct {
+	dynamoDBAPI
+	calls int
+}
+
+func (c *conditionalDynamoDBClient) GetItem(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.calls++
+	return &dynamodb.GetItemOutput{
+		Item: map[string]types.AttributeValue{
+			"id":   input.Key["id"],
+			"keys": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"region-0": &types.AttributeValueMemberS{Value: "ciphertext"}}},
+		},
+	}, nil
+}
+
+func (c *conditionalDynamoDBClient) PutItem(context.Context, *dynamodb.PutItemInput, ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.calls++
+	return nil, newTestAWSResponseError("ConditionalCheckFailedException", http.StatusBadRequest)
+}
+
+func getTestDynamoDBStore(clients ...dynamoDBAPI) *DynamoDBStore {
+	replicas := make([]dynamoDBReplica, len(clients))
+	for i, client := range clients {
+		replicas[i] = dynamoDBReplica{getTestRegionName(i), client, nil}
+	}
+
+	return &DynamoDBStore{aws.String("table"), replicas, nil, newLRUCache("dynamodb", 0, 0, time.Minute, time.Minute, cachedItemSize), 0, nil, false}
+}
+
+func TestDynamoDBStoreFailsOverWhenThrottled(t *testing.T) {
+	primary := &throttledDynamoDBClient{}
+	replica := &conditionalDynamoDBClient{}
+	s := getTestDynamoDBStore(primary, replica)
+
+	keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+	if err != nil {
+		t.Fatalf("read should have failed over to the replica region: %s", err)
+	}
+
+	if keys["region-0"] != "ciphertext" || primary.calls != 1 || replica.calls != 1 {
+		t.Fatalf("read did not go through both regions, keys: %v", keys)
+	}
+}
+
+func TestDynamoDBStoreDoesNotFailOverConditionalCheck(t *testing.T) {
+	primary := &conditionalDynamoDBClient{}
+	replica := &conditionalDynamoDBClient{}
+	s := getTestDynamoDBStore(primary, replica)
+
+	err := s.SetEncryptedDataKeysConditionally(context.Background(), "id", map[string]string{"region-0": "ciphertext"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("write should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+
+	if replica.calls != 0 {
+		t.Fatalf("a failed condition should not be retried in the replica region")
+	}
+}
+
+func TestDynamoDBStoreIdempotencyRecordsDoNotReplaceDataKeys(t *testing.T) {
+	s := getTestDynamoDBStore(&conditionalDynamoDBClient{})
+	ctx := context.Background()
+
+	//the client answers the item of a data key, without fingerprint, and fails the conditional writes
+	record, err := s.GetIdempotencyRecord(ctx, "key")
+	if err != nil || record != nil {
+		t.Fatalf("the data key under the id of a record should have read as no record, got %+v: %v", record, err)
+	}
+
+	if err := s.SetIdempotencyRecord(ctx, &IdempotencyRecord{Key: "key", Fingerprint: "fingerprint"}); err != (IDAlreadyExistsStoreError{ID: "key"}) {
+		t.Fatalf("a record shouldn't have replaced the data key under its id, got %v", err)
+	}
+}
+
+func TestDynamoDBStoreApprovalRecordsDoNotReplaceDataKeys(t *testing.T) {
+	s := getTestDynamoDBStore(&conditionalDynamoDBClient{})
+	ctx := context.Background()
+
+	record, err := s.GetApprovalRecord(ctx, "approval")
+	if err != nil || record != nil {
+		t.Fatalf("the data key under the id of an approval should have read as no approval, got %+v: %v", record, err)
+	}
+
+	if err := s.SetApprovalRecord(ctx, &ApprovalRecord{ApprovalID: "approval", RequestedBy: "alice"}); err != (IDAlreadyExistsStoreError{ID: "approval"}) {
+		t.Fatalf("an approval shouldn't have replaced the data key under its id, got %v", err)
+	}
+}
+
+func TestDynamoDBStoreDoesNotFailOverWrites(t *testing.T) {
+	primary := &throttledDynamoDBClient{}
+	replica := &throttledDynamoDBClient{}
+	s := getTestDynamoDBStore(primary, replica)
+
+	err := s.SetEncryptedDataKeysConditionally(context.Background(), "id", map[string]string{"region-0": "ciphertext"})
+	if err == nil {
+		t.Fatalf("write should have failed in the first region")
+	}
+
+	if primary.calls != 1 || replica.calls != 0 {
+		t.Fatalf("a conditional write shouldn't have been made to the replica region, which may not have the id yet")
+	}
+}
+
+type missingItemDynamoDBClient struct {
+	dynamoDBAPI
+	reads           int
+	consistentReads int
+}
+
+func (c *missingItemDynamoDBClient) GetItem(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.reads++
+	if input.ConsistentRead != nil && *input.ConsistentRead {
+		c.consistentReads++
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func TestDynamoDBStoreDAXMissFallsBackToConsistentRead(t *testing.T) {
+	dynamoDB := &conditionalDynamoDBClient{}
+	dax := &missingItemDynamoDBClient{}
+	s := getTestDynamoDBStore(dynamoDB)
+	s.dax = dax
+
+	keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+	if err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+
+	if keys == nil || dynamoDB.calls != 1 {
+		t.Fatalf("a DAX miss should have been read from DynamoDB")
+	}
+
+	if dax.consistentReads != 0 {
+		t.Fatalf("reads through DAX should be eventually consistent to be cached")
+	}
+}
+
+type unprocessedKeysDynamoDBClient struct {
+	dynamoDBAPI
+	calls int
+}
+
+// BatchGetItem only processes the first key of every request
+func (c *unprocessedKeysDynamoDBClient) BatchGetItem(ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	c.calls++
+	requestKeys := input.RequestItems["table"].Keys
+
+	output := &dynamodb.BatchGetItemOutput{
+		Responses: map[string][]map[string]types.AttributeValue{
+			"table": {{
+				"id":   requestKeys[0]["id"],
+				"keys": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"region-0": &types.AttributeValueMemberS{Value: "ciphertext"}}},
+			}},
+		},
+	}
+
+	if len(requestKeys) > 1 {
+		output.UnprocessedKeys = map[string]types.KeysAndAttributes{
+			"table": {Keys: requestKeys[1:], ConsistentRead: aws.Bool(true)},
+		}
+	}
+
+	return output, nil
+}
+
+func TestDynamoDBStoreGetBatchRetriesUnprocessedKeys(t *testing.T) {
+	client := &unprocessedKeysDynamoDBClient{}
+	s := getTestDynamoDBStore(client)
+
+	keys, err := s.GetEncryptedDataKeysBatch(context.Background(), []string{"a", "b", "a", "c"})
+	if err != nil {
+		t.Fatalf("failed to batch get encrypted data keys: %s", err)
+	}
+
+	if len(keys) != 3 || client.calls != 3 {
+		t.Fatalf("every unique id should have been read once, got %d ids in %d calls", len(keys), client.calls)
+	}
+
+	if _, err := s.GetEncryptedDataKeysBatch(context.Background(), []string{"a", "b", "c"}); err != nil || client.calls != 3 {
+		t.Fatalf("ids read in a batch should have been cached")
+	}
+}
+
+type scanDynamoDBClient struct {
+	dynamoDBAPI
+	ids []string
+}
+
+// Scan scans the ids in order, filtering out every other one as if it was deleted
+func (c *scanDynamoDBClient) Scan(ctx context.Context, input *dynamodb.ScanInput, opts ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		for i, id := range c.ids {
+			if id == input.ExclusiveStartKey["id"].(*types.AttributeValueMemberS).Value {
+				start = i + 1
+			}
+		}
+	}
+
+	end := start + int(*input.Limit)
+	if end > len(c.ids) {
+		end = len(c.ids)
+	}
+
+	output := &dynamodb.ScanOutput{}
+	for i := start; i < end; i++ {
+		if i%2 == 0 {
+			output.Items = append(output.Items, dynamoDBKey(c.ids[i]))
+		}
+	}
+
+	if end < len(c.ids) {
+		output.LastEvaluatedKey = dynamoDBKey(c.ids[end-1])
+	}
+
+	return output, nil
+}
+
+func TestDynamoDBStoreListIDsFillsFilteredPages(t *testing.T) {
+	s := getTestDynamoDBStore(&scanDynamoDBClient{ids: []string{"a", "b", "c", "d", "e", "f", "g"}})
+
+	ids, cursor, err := s.ListIDs(context.Background(), "", 3)
+	if err != nil {
+		t.Fatalf("failed to list ids: %s", err)
+	}
+
+	if len(ids) != 3 || cursor != "e" {
+		t.Fatalf("the scan should have gone on until the page was full, got %v (cursor %q)", ids, cursor)
+	}
+
+	ids, cursor, _ = s.ListIDs(context.Background(), cursor, 3)
+	if len(ids) != 1 || ids[0] != "g" || cursor != "" {
+		t.Fatalf("last page is wrong: %v (cursor %q)", ids, cursor)
+	}
+}
+
+type expiredItemDynamoDBClient struct {
+	dynamoDBAPI
+}
+
+func (c *expiredItemDynamoDBClient) GetItem(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{
+		Item: map[string]types.AttributeValue{
+			"id":         input.Key["id"],
+			"keys":       &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"region-0": &types.AttributeValueMemberS{Value: "ciphertext"}}},
+			"expires_at": dynamoDBUnixTime(time.Now().Add(-time.Minute)),
+		},
+	}, nil
+}
+
+func TestDynamoDBStoreExpiredItemsReadAsMissing(t *testing.T) {
+	s := getTestDynamoDBStore(&expiredItemDynamoDBClient{})
+
+	keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+	if err != nil || keys != nil {
+		t.Fatalf("an item DynamoDB hasn't deleted yet past its expires_at should read as missing, got %v: %v", keys, err)
+	}
+
+	if _, found := s.keysCache.Get("id"); found {
+		t.Fatalf("expired items should not be cached")
+	}
+}
+
+func TestDynamoDBAWSConfigEndpointOverride(t *testing.T) {
+	awsConfig, err := newDynamoDBConfig(DynamoDBConfig{Endpoint: "http://localhost:8000", AccessKeyID: "local", SecretAccessKey: "secret"}, "us-east-1")
+	if err != nil {
+		t.Fatalf("failed to load the AWS config: %s", err)
+	}
+	if aws.ToString(awsConfig.BaseEndpoint) != "http://localhost:8000" {
+		t.Fatalf("the endpoint should have been overridden, got: %v", awsConfig.BaseEndpoint)
+	}
+
+	value, err := awsConfig.Credentials.Retrieve(context.Background())
+	if err != nil || value.AccessKeyID != "local" || value.SecretAccessKey != "secret" {
+		t.Fatalf("static credentials should have been used, got %v: %v", value, err)
+	}
+
+	awsConfig, err = newDynamoDBConfig(DynamoDBConfig{}, "us-east-1")
+	if err != nil || awsConfig.BaseEndpoint != nil {
+		t.Fatalf("the default endpoint should have been used, got %v: %v", awsConfig.BaseEndpoint, err)
+	}
+}
+
+func TestDynamoDBStoreCachesMissingIDs(t *testing.T) {
+	client := &missingItemDynamoDBClient{}
+	s := getTestDynamoDBStore(client)
+	s.negativeCacheExpiration = time.Minute
+
+	for i := 0; i < 3; i++ {
+		keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+		if err != nil || keys != nil {
+			t.Fatalf("the id should have read as missing, got %v: %v", keys, err)
+		}
+	}
+	if client.reads != 1 {
+		t.Fatalf("the missing id should have been read once, got %d reads", client.reads)
+	}
+}
+
+func TestDynamoDBStoreConditionalCheckDropsMissingID(t *testing.T) {
+	client := &conditionalDynamoDBClient{}
+	s := getTestDynamoDBStore(client)
+	s.negativeCacheExpiration = time.Minute
+	s.cacheMissingItem("id")
+
+	err := s.SetEncryptedDataKeysConditionally(context.Background(), "id", map[string]string{"region-0": "ciphertext"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("the conditional write should have failed, got %v", err)
+	}
+
+	keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+	if err != nil || keys == nil {
+		t.Fatalf("the id created since it was cached as missing should have been read again, got %v: %v", keys, err)
+	}
+}
+
+func TestDynamoDBStoreReadConsistency(t *testing.T) {
+	client := &missingItemDynamoDBClient{}
+	s := getTestDynamoDBStore(client)
+	s.negativeCacheExpiration = time.Minute
+
+	if _, err := s.GetEncryptedDataKeys(context.Background(), "id"); err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+	if client.reads != 1 || client.consistentReads != 0 {
+		t.Fatalf("the id should have been read eventually by default, got %d reads, %d consistent", client.reads, client.consistentReads)
+	}
+
+	//the strong reads bypass the id cached as missing
+	strongCtx := withReadConsistency(context.Background(), ReadConsistencyStrong)
+	if _, err := s.GetEncryptedDataKeys(strongCtx, "id"); err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+	if client.reads != 2 || client.consistentReads != 1 {
+		t.Fatalf("the id should have been read consistently, got %d reads, %d consistent", client.reads, client.consistentReads)
+	}
+
+	s.consistentReads = true
+	s.keysCache.Delete("id")
+	eventualCtx := withReadConsistency(context.Background(), ReadConsistencyEventual)
+	if _, err := s.GetEncryptedDataKeys(eventualCtx, "id"); err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+	if client.reads != 3 || client.consistentReads != 1 {
+		t.Fatalf("the request should have overridden the consistent reads of the store, got %d reads, %d consistent", client.reads, client.consistentReads)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	logger "github.com/sirupsen/logrus"
+)
+
+// MaxNumberOfEnablePITRTries is the number of attempts to enable point-in-time recovery on a new table,
+// as continuous backups only become available a little while after the table is active
+const MaxNumberOfEnablePITRTries = 10
+
+// dynamoDBTableCreationTimeout is how long a new table is waited for to become active
+const dynamoDBTableCreationTimeout = 10 * time.Minute
+
+// ensureDynamoDBTable creates the table used by DynamoDBStore if it doesn't exist yet:
+// partition key "id", on-demand (PAY_PER_REQUEST) billing, point-in-time recovery enabled
+// and TTL enabled on the "expires_at" attribute, with a KEYS_ONLY stream when streamEnabled.
+// A table that already exists is left untouched.
+func ensureDynamoDBTable(ctx context.Context, client *dynamodb.Client, tableName *string, streamEnabled bool) error {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: tableName})
+	if err == nil {
+		return nil
+	}
+
+	if awsErrorCode(err) != "ResourceNotFoundException" {
+		return err
+	}
+
+	logger.Infof("creating DynamoDB table %s...", *tableName)
+	input := &dynamodb.CreateTableInput{
+		TableName: tableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+
+	if streamEnabled {
+		input.StreamSpecification = &types.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: types.StreamViewTypeKeysOnly,
+		}
+	}
+
+	_, err = client.CreateTable(ctx, input)
+	if err != nil {
+		//another rkms server is creating the table at the same time
+		if awsErrorCode(err) != "ResourceInUseException" {
+			return err
+		}
+	}
+
+	if err := dynamodb.NewTableExistsWaiter(client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: tableName}, dynamoDBTableCreationTimeout); err != nil {
+		return err
+	}
+
+	if err := enablePointInTimeRecovery(ctx, client, tableName); err != nil {
+		return err
+	}
+
+	return enableTimeToLive(ctx, client, tableName)
+}
+
+// enableTimeToLive lets DynamoDB delete the items once their expires_at time has passed
+func enableTimeToLive(ctx context.Context, client *dynamodb.Client, tableName *string) error {
+	_, err := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: tableName,
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expires_at"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+
+	//another rkms server enabled it first
+	if awsErrorCode(err) == "ValidationException" {
+		logger.Debugln("TTL is already enabled")
+		return nil
+	}
+
+	return err
+}
+
+func enablePointInTimeRecovery(ctx context.Context, client *dynamodb.Client, tableName *string) error {
+	input := &dynamodb.UpdateContinuousBackupsInput{
+		TableName: tableName,
+		PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfEnablePITRTries; i++ {
+		_, err = client.UpdateContinuousBackups(ctx, input)
+		if awsErrorCode(err) != "ContinuousBackupsUnavailableException" {
+			return err
+		}
+
+		logger.Debugln("continuous backups are not available yet, retrying...")
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
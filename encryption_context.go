@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// encryptionContextEntry is the entry of the encrypted data keys the encryption context of an id is saved under,
+// so that every store keeps it without knowing about it. Entries starting with the separator of data key
+// versions can't be mistaken for regions.
+const encryptionContextEntry = dataKeyVersionSeparator + "encryption_context"
+
+// EncryptionContextMismatchError is returned when a data key is requested with another encryption context
+// than the one it was created with
+type EncryptionContextMismatchError struct {
+	ID string
+}
+
+func (e EncryptionContextMismatchError) Error() string {
+	return fmt.Sprintf("the encryption context does not match the one of id %s", e.ID)
+}
+
+// isMetadataEntry tells if an entry of the encrypted data keys holds metadata rather than a ciphertext
+func isMetadataEntry(entry string) bool {
+	return strings.HasPrefix(entry, dataKeyVersionSeparator)
+}
+
+// storedEncryptionContext reads the encryption context saved with the encrypted data keys, empty if there is none
+func storedEncryptionContext(encryptedDataKeys map[string]string) (EncryptionContext, error) {
+	encryptionContext := EncryptionContext{}
+	if entry, ok := encryptedDataKeys[encryptionContextEntry]; ok {
+		if err := json.Unmarshal([]byte(entry), &encryptionContext); err != nil {
+			return nil, fmt.Errorf("the encryption context is corrupted in the store: %s", err)
+		}
+	}
+	return encryptionContext, nil
+}
+
+// setEncryptionContextEntry saves the encryption context with the encrypted data keys, if it isn't empty
+func setEncryptionContextEntry(encryptedDataKeys map[string]string, encryptionContext EncryptionContext) {
+	if aad := encryptionContext.AAD(); aad != nil {
+		encryptedDataKeys[encryptionContextEntry] = string(aad)
+	}
+}
+
+// checkEncryptionContext verifies the encryption context given for id is the one saved with its encrypted data keys
+func checkEncryptionContext(id string, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) error {
+	stored, err := storedEncryptionContext(encryptedDataKeys)
+	if err != nil {
+		return err
+	}
+
+	if len(stored) == 0 && len(encryptionContext) == 0 {
+		return nil
+	}
+
+	if !reflect.DeepEqual(stored, encryptionContext) {
+		return EncryptionContextMismatchError{ID: id}
+	}
+	return nil
+}
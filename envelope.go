@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// EnvelopeFormatVersion is the first byte of the ciphertexts of POST /encrypt
+const EnvelopeFormatVersion byte = 1
+
+// MaxEnvelopePlaintextSizeInBytes is the largest plaintext POST /encrypt accepts
+const MaxEnvelopePlaintextSizeInBytes = 4 << 20
+
+// envelopeKeySizeInBytes is the size of the data keys server-side encryption needs, for AES-256-GCM
+const envelopeKeySizeInBytes = 32
+
+const envelopeNonceSize = 12
+
+// InvalidCiphertextError is returned when a ciphertext given to decrypt is malformed or fails authentication
+type InvalidCiphertextError struct {
+	Reason string
+}
+
+func (e InvalidCiphertextError) Error() string {
+	return fmt.Sprintf("invalid ciphertext: %s", e.Reason)
+}
+
+// envelopeHeader - the self-describing start of a server-side ciphertext:
+// the format version, the id length (2 bytes), the id, the data key version (8 bytes) and the nonce,
+// all big endian. The header is authenticated along with the encrypted data.
+type envelopeHeader struct {
+	Format     byte
+	ID         string
+	KeyVersion int64
+	Nonce      []byte
+}
+
+func (h envelopeHeader) marshal() []byte {
+	b := make([]byte, 0, 1+2+len(h.ID)+8+len(h.Nonce))
+	b = append(b, h.Format)
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(h.ID)))
+	b = append(b, length[:]...)
+	b = append(b, h.ID...)
+
+	var version [8]byte
+	binary.BigEndian.PutUint64(version[:], uint64(h.KeyVersion))
+	b = append(b, version[:]...)
+	return append(b, h.Nonce...)
+}
+
+// envelopeHeaderSize is the size of a header with the given nonce size and id length
+func envelopeHeaderSize(nonceSize int, idLength int) int {
+	return 3 + idLength + 8 + nonceSize
+}
+
+// parseEnvelopeHeader reads the header of a ciphertext of the given format, returning it along with its size
+func parseEnvelopeHeader(ciphertext []byte, format byte, nonceSize int) (*envelopeHeader, int, error) {
+	if len(ciphertext) < 3 {
+		return nil, 0, InvalidCiphertextError{Reason: "too short"}
+	}
+
+	if ciphertext[0] != format {
+		return nil, 0, InvalidCiphertextError{Reason: fmt.Sprintf("unknown format version %d", ciphertext[0])}
+	}
+
+	idLength := int(binary.BigEndian.Uint16(ciphertext[1:3]))
+	size := envelopeHeaderSize(nonceSize, idLength)
+	if len(ciphertext) < size {
+		return nil, 0, InvalidCiphertextError{Reason: "too short"}
+	}
+
+	header := &envelopeHeader{Format: format, ID: string(ciphertext[3 : 3+idLength])}
+	version := binary.BigEndian.Uint64(ciphertext[3+idLength : 3+idLength+8])
+	if version == 0 || version > math.MaxInt64 {
+		return nil, 0, InvalidCiphertextError{Reason: "invalid data key version"}
+	}
+	header.KeyVersion = int64(version)
+	header.Nonce = ciphertext[3+idLength+8 : size]
+	return header, size, nil
+}
+
+// newEnvelopeAEAD creates the AES-GCM cipher of a data key, destroying its plaintext once the cipher is keyed
+func newEnvelopeAEAD(dataKey *DataKey) (cipher.AEAD, error) {
+	defer dataKey.Destroy()
+	key := dataKey.Plaintext.Bytes()
+	if len(key) != envelopeKeySizeInBytes {
+		return nil, fmt.Errorf("server-side encryption needs %d byte data keys, the data key of id %s has %d bytes", envelopeKeySizeInBytes, dataKey.ID, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts plaintext with AES-256-GCM under the latest version of the data key of id, generating it
+// if there is none. The ciphertext starts with a header telling the id and the data key version it was encrypted with,
+// so that Decrypt needs nothing else.
+func (r *RKMS) Encrypt(ctx context.Context, id string, plaintext []byte, encryptionContext EncryptionContext) ([]byte, *DataKey, error) {
+	ctx = withLogID(ctx, id)
+	if len(id) > math.MaxUint16 {
+		return nil, nil, fmt.Errorf("ids of more than %d bytes can't be used for server-side encryption", math.MaxUint16)
+	}
+
+	dataKey, err := r.GetDataKey(ctx, id, 0, encryptionContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, envelopeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	header := envelopeHeader{Format: EnvelopeFormatVersion, ID: id, KeyVersion: dataKey.Version, Nonce: nonce}.marshal()
+	return aead.Seal(header, nonce, plaintext, header), dataKey, nil
+}
+
+// Decrypt decrypts a ciphertext of Encrypt with the data key version it names
+func (r *RKMS) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, *DataKey, error) {
+	header, size, err := parseEnvelopeHeader(ciphertext, EnvelopeFormatVersion, envelopeNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := r.GetDataKeyVersion(ctx, header.ID, header.KeyVersion, encryptionContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := aead.Open(nil, header.Nonce, ciphertext[size:], ciphertext[:size])
+	if err != nil {
+		return nil, nil, InvalidCiphertextError{Reason: "authentication failed"}
+	}
+	return plaintext, dataKey, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type encryptRequest struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+type decryptRequest struct {
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type encryptResponse struct {
+	ID         string `json:"id"`
+	Version    int64  `json:"version"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type decryptResponse struct {
+	ID        string `json:"id"`
+	Version   int64  `json:"version"`
+	Plaintext []byte `json:"plaintext"`
+}
+
+type decryptESDKResponse struct {
+	Plaintext         []byte            `json:"plaintext"`
+	EncryptionContext EncryptionContext `json:"encryption_context"`
+}
+
+// ConstructEncryptResponse creates a server response for POST /encrypt endpoint, the ciphertext being base64
+func ConstructEncryptResponse(dataKey *DataKey, ciphertext []byte) string {
+	b, _ := json.Marshal(encryptResponse{dataKey.ID, dataKey.Version, ciphertext})
+	return string(b)
+}
+
+// ConstructDecryptResponse creates a server response for POST /decrypt endpoint, the plaintext being base64
+func ConstructDecryptResponse(dataKey *DataKey, plaintext []byte) string {
+	b, _ := json.Marshal(decryptResponse{dataKey.ID, dataKey.Version, plaintext})
+	return string(b)
+}
+
+// ConstructDecryptESDKResponse creates a server response for POST /decrypt endpoint with the aws-encryption-sdk format,
+// the message naming no id
+func ConstructDecryptESDKResponse(plaintext []byte, encryptionContext EncryptionContext) string {
+	b, _ := json.Marshal(decryptESDKResponse{plaintext, encryptionContext})
+	return string(b)
+}
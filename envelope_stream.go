@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// StreamFormatVersion is the first byte of the ciphertexts of POST /encrypt/stream
+const StreamFormatVersion byte = 2
+
+// StreamSegmentSizeInBytes is the size of the plaintext segments streamed ciphertexts are made of
+const StreamSegmentSizeInBytes = 64 << 10
+
+// the nonce of a segment is the nonce prefix of the header, the segment number (4 bytes) and
+// a last segment flag, so that segments can't be reordered, and streams can't be truncated
+const streamNoncePrefixSize = envelopeNonceSize - 5
+
+const streamTagSize = 16
+
+// StreamEncrypter - encrypts a stream with a data key, as a header followed by segments of
+// StreamSegmentSizeInBytes plaintext bytes, the last one possibly shorter or empty, each encrypted with AES-256-GCM
+type StreamEncrypter struct {
+	DataKey *DataKey
+	aead    cipher.AEAD
+	header  envelopeHeader
+}
+
+// StreamDecrypter - decrypts a stream of a StreamEncrypter, whose header it has read
+type StreamDecrypter struct {
+	DataKey *DataKey
+	aead    cipher.AEAD
+	header  envelopeHeader
+	src     io.Reader
+}
+
+// NewStreamEncrypter gets the latest version of the data key of id to stream encrypt with, generating it if there is none
+func (r *RKMS) NewStreamEncrypter(ctx context.Context, id string, encryptionContext EncryptionContext) (*StreamEncrypter, error) {
+	ctx = withLogID(ctx, id)
+	if len(id) > math.MaxUint16 {
+		return nil, fmt.Errorf("ids of more than %d bytes can't be used for server-side encryption", math.MaxUint16)
+	}
+
+	dataKey, err := r.GetDataKey(ctx, id, 0, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	noncePrefix := make([]byte, streamNoncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeader{Format: StreamFormatVersion, ID: id, KeyVersion: dataKey.Version, Nonce: noncePrefix}
+	return &StreamEncrypter{dataKey, aead, header}, nil
+}
+
+// Encrypt writes to dst the encryption of everything read from src, one segment at a time
+func (e *StreamEncrypter) Encrypt(dst io.Writer, src io.Reader) error {
+	header := e.header.marshal()
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	//one byte more than a segment tells if there is another segment after it
+	buf := make([]byte, StreamSegmentSizeInBytes+1)
+	out := make([]byte, 0, StreamSegmentSizeInBytes+streamTagSize)
+	n, err := io.ReadFull(src, buf)
+	for segment := uint32(0); ; segment++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		size := StreamSegmentSizeInBytes
+		if last {
+			size = n
+		}
+
+		out = e.aead.Seal(out[:0], streamSegmentNonce(e.header.Nonce, segment, last), buf[:size], header)
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		if segment == math.MaxUint32 {
+			return fmt.Errorf("streams of more than %d segments can't be encrypted", uint64(math.MaxUint32))
+		}
+
+		buf[0] = buf[StreamSegmentSizeInBytes]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// NewStreamDecrypter reads the header of the stream of src, getting the data key version it names
+func (r *RKMS) NewStreamDecrypter(ctx context.Context, src io.Reader, encryptionContext EncryptionContext) (*StreamDecrypter, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(src, b); err != nil {
+		return nil, InvalidCiphertextError{Reason: "too short"}
+	}
+
+	idLength := int(binary.BigEndian.Uint16(b[1:3]))
+	b = append(b, make([]byte, envelopeHeaderSize(streamNoncePrefixSize, idLength)-3)...)
+	if _, err := io.ReadFull(src, b[3:]); err != nil {
+		return nil, InvalidCiphertextError{Reason: "too short"}
+	}
+
+	header, _, err := parseEnvelopeHeader(b, StreamFormatVersion, streamNoncePrefixSize)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := r.GetDataKeyVersion(ctx, header.ID, header.KeyVersion, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamDecrypter{dataKey, aead, *header, src}, nil
+}
+
+// Decrypt writes to dst the decryption of the rest of the stream, one authenticated segment at a time.
+// A stream failing authentication midway has had its previous segments written already.
+func (d *StreamDecrypter) Decrypt(dst io.Writer) error {
+	header := d.header.marshal()
+	segmentSize := StreamSegmentSizeInBytes + streamTagSize
+
+	buf := make([]byte, segmentSize+1)
+	out := make([]byte, 0, StreamSegmentSizeInBytes)
+	n, err := io.ReadFull(d.src, buf)
+	for segment := uint32(0); ; segment++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		size := segmentSize
+		if last {
+			size = n
+		}
+
+		out, err = d.aead.Open(out[:0], streamSegmentNonce(d.header.Nonce, segment, last), buf[:size], header)
+		if err != nil {
+			return InvalidCiphertextError{Reason: fmt.Sprintf("segment %d failed authentication", segment)}
+		}
+
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		if segment == math.MaxUint32 {
+			return InvalidCiphertextError{Reason: "too many segments"}
+		}
+
+		buf[0] = buf[segmentSize]
+		n, err = io.ReadFull(d.src, buf[1:])
+		n++
+	}
+}
+
+func streamSegmentNonce(noncePrefix []byte, segment uint32, last bool) []byte {
+	nonce := make([]byte, envelopeNonceSize)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], segment)
+	if last {
+		nonce[envelopeNonceSize-1] = 1
+	}
+	return nonce
+}
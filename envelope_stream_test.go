@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, StreamSegmentSizeInBytes, StreamSegmentSizeInBytes + 1, 3*StreamSegmentSizeInBytes + 5} {
+		plaintext := bytes.Repeat([]byte{7}, size)
+
+		encrypter, err := r.NewStreamEncrypter(ctx, "id", nil)
+		if err != nil {
+			t.Fatalf("failed to create a stream encrypter: %s", err)
+		}
+
+		var ciphertext bytes.Buffer
+		if err := encrypter.Encrypt(&ciphertext, bytes.NewReader(plaintext)); err != nil {
+			t.Fatalf("failed to encrypt a stream of %d bytes: %s", size, err)
+		}
+
+		decrypter, err := r.NewStreamDecrypter(ctx, bytes.NewReader(ciphertext.Bytes()), nil)
+		if err != nil {
+			t.Fatalf("failed to read the header of a stream of %d bytes: %s", size, err)
+		}
+
+		var decrypted bytes.Buffer
+		if err := decrypter.Decrypt(&decrypted); err != nil || !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("failed to decrypt a stream of %d bytes: %v", size, err)
+		}
+	}
+}
+
+func TestStreamDecryptDetectsTruncation(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	encrypter, err := r.NewStreamEncrypter(ctx, "id", nil)
+	if err != nil {
+		t.Fatalf("failed to create a stream encrypter: %s", err)
+	}
+
+	var ciphertext bytes.Buffer
+	if err := encrypter.Encrypt(&ciphertext, bytes.NewReader(make([]byte, 2*StreamSegmentSizeInBytes+1))); err != nil {
+		t.Fatalf("failed to encrypt the stream: %s", err)
+	}
+
+	//drops the last segment, leaving two complete ones
+	truncated := ciphertext.Bytes()[:ciphertext.Len()-(1+streamTagSize)]
+	decrypter, err := r.NewStreamDecrypter(ctx, bytes.NewReader(truncated), nil)
+	if err != nil {
+		t.Fatalf("failed to read the header of the stream: %s", err)
+	}
+
+	var decrypted bytes.Buffer
+	if err := decrypter.Decrypt(&decrypted); err == nil {
+		t.Fatalf("a truncated stream should have failed to decrypt")
+	} else if _, ok := err.(InvalidCiphertextError); !ok {
+		t.Fatalf("a truncated stream should have failed with InvalidCiphertextError, got: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+func getEnvelopeRKMS(t *testing.T) *RKMS {
+	os.Setenv("RKMS_TEST_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, LocalMasterKeySize)))
+	defer os.Unsetenv("RKMS_TEST_MASTER_KEY")
+
+	provider, err := NewLocalKeyProvider("env:RKMS_TEST_MASTER_KEY")
+	if err != nil {
+		t.Fatalf("failed to create local key provider: %s", err)
+	}
+
+	return &RKMS{[]string{"local"}, map[string]KeyProvider{"local": provider}, nil, NewMemoryStore(), envelopeKeySizeInBytes, 0, nil, retryPolicy{}, retryPolicy{}, nil, 0, 0, nil, nil, WrappedKeyFormatBare, 0, 0, nil}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	encryptionContext := EncryptionContext{"tenant": "a"}
+
+	ciphertext, dataKey, err := r.Encrypt(ctx, "id", []byte("secret"), encryptionContext)
+	if err != nil || dataKey.Version != FirstDataKeyVersion {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	if _, err := r.RotateDataKey(ctx, "id", encryptionContext); err != nil {
+		t.Fatalf("failed to rotate the data key: %s", err)
+	}
+
+	plaintext, dataKey, err := r.Decrypt(ctx, ciphertext, encryptionContext)
+	if err != nil || string(plaintext) != "secret" || dataKey.ID != "id" || dataKey.Version != FirstDataKeyVersion {
+		t.Fatalf("the ciphertext should have been decrypted with the first data key version, got %q %+v: %v", plaintext, dataKey, err)
+	}
+
+	if _, _, err := r.Decrypt(ctx, ciphertext, nil); err != (EncryptionContextMismatchError{ID: "id"}) {
+		t.Fatalf("decrypting with another encryption context should have failed with EncryptionContextMismatchError, got: %v", err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := r.Decrypt(ctx, tampered, encryptionContext); err != (InvalidCiphertextError{Reason: "authentication failed"}) {
+		t.Fatalf("a tampered ciphertext should have failed authentication, got: %v", err)
+	}
+
+	for _, malformed := range [][]byte{nil, {2, 0, 0}, ciphertext[:10]} {
+		if _, _, err := r.Decrypt(ctx, malformed, encryptionContext); err == nil {
+			t.Fatalf("the malformed ciphertext %v should have failed to decrypt", malformed)
+		} else if _, ok := err.(InvalidCiphertextError); !ok {
+			t.Fatalf("the malformed ciphertext %v should have failed with InvalidCiphertextError, got: %v", malformed, err)
+		}
+	}
+}
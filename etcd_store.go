@@ -0,0 +1,333 @@
+//go:build etcd
+// +build etcd
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdStore - an etcd v3 implementation of a key/value store for KMS-related data
+type EtcdStore struct {
+	client    *clientv3.Client
+	keyPrefix string
+}
+
+func init() {
+	RegisterStore("etcd", func(config *Configuration) (Store, error) {
+		return NewEtcdStore(config.Etcd)
+	})
+}
+
+// NewEtcdStore creates a new EtcdStore instance
+func NewEtcdStore(etcdConfig EtcdConfig) (*EtcdStore, error) {
+	tlsConfig, err := newClientTLSConfig(etcdConfig.TLS)
+	if err != nil {
+		logStoreError(context.Background(), "etcd", "NewEtcdStore", "", err)
+		return nil, err
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdConfig.Endpoints,
+		Username:    etcdConfig.Username,
+		Password:    etcdConfig.Password,
+		DialTimeout: time.Duration(etcdConfig.DialTimeoutInSeconds) * time.Second,
+		TLS:         tlsConfig,
+	})
+
+	if err != nil {
+		logStoreError(context.Background(), "etcd", "NewEtcdStore", "", err)
+		return nil, err
+	}
+
+	return &EtcdStore{client, etcdConfig.KeyPrefix}, nil
+}
+
+func (s *EtcdStore) key(id string) string {
+	return s.keyPrefix + id
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *EtcdStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *EtcdStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	resp, err := s.client.Get(ctx, s.key(id))
+	if err != nil {
+		logStoreError(ctx, "etcd", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	item := item{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &item); err != nil {
+		logStoreError(ctx, "etcd", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if item.deleted() {
+		return nil, 0, item.deletedError()
+	}
+
+	return item.Keys, item.Version, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *EtcdStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if err := checkVersion(id, item, expectedVersion); err != nil {
+			return false, err
+		}
+
+		item.Keys = encryptedKeysMap
+		item.Version++
+		return true, nil
+	})
+}
+
+// etcdMaxTxnOps is the default limit of operations in an etcd transaction (--max-txn-ops)
+const etcdMaxTxnOps = 128
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids,
+// reading up to etcdMaxTxnOps ids per transaction
+func (s *EtcdStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	keys := make(map[string]map[string]string, len(ids))
+	for start := 0; start < len(ids); start += etcdMaxTxnOps {
+		end := start + etcdMaxTxnOps
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, id := range ids[start:end] {
+			ops = append(ops, clientv3.OpGet(s.key(id)))
+		}
+
+		resp, err := s.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			logStoreError(ctx, "etcd", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+
+		for i, opResp := range resp.Responses {
+			kvs := opResp.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				continue
+			}
+
+			item := item{}
+			if err := json.Unmarshal(kvs[0].Value, &item); err != nil {
+				logStoreError(ctx, "etcd", "GetEncryptedDataKeysBatch", "", err)
+				return nil, err
+			}
+
+			if !item.deleted() {
+				keys[ids[start+i]] = item.Keys
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *EtcdStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	value, err := json.Marshal(item{ID: id, Keys: encryptedKeysMap})
+	if err != nil {
+		logStoreError(ctx, "etcd", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	key := s.key(id)
+	//a version of 0 means the key has never been written (or was purged)
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+
+	if err != nil {
+		logStoreError(ctx, "etcd", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	if !resp.Succeeded {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// updateItem applies update to the item of the given id, retrying when the key
+// is modified concurrently. A nil item is passed to update if the key does not exist.
+// update returns false if there is nothing to write.
+func (s *EtcdStore) updateItem(ctx context.Context, id string, update func(item *item) (bool, error)) error {
+	key := s.key(id)
+	for {
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			logStoreError(ctx, "etcd", "updateItem", id, err)
+			return err
+		}
+
+		var current *item
+		var revision int64
+		if len(resp.Kvs) > 0 {
+			current = &item{}
+			if err := json.Unmarshal(resp.Kvs[0].Value, current); err != nil {
+				logStoreError(ctx, "etcd", "updateItem", id, err)
+				return err
+			}
+			revision = resp.Kvs[0].ModRevision
+		}
+
+		write, err := update(current)
+		if err != nil || !write {
+			return err
+		}
+
+		value, err := json.Marshal(current)
+		if err != nil {
+			logStoreError(ctx, "etcd", "updateItem", id, err)
+			return err
+		}
+
+		txnResp, err := s.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+
+		if err != nil {
+			logStoreError(ctx, "etcd", "updateItem", id, err)
+			return err
+		}
+
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *EtcdStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if item == nil || item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = time.Now().Unix()
+		return true, nil
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *EtcdStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if item == nil {
+			return false, IDNotFoundStoreError{ID: id}
+		}
+
+		if !item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = 0
+		return true, nil
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *EtcdStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	if _, err := s.client.Delete(ctx, s.key(id)); err != nil {
+		logStoreError(ctx, "etcd", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored under the configured key prefix that are not deleted, in key order
+func (s *EtcdStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	ids := make([]string, 0, limit)
+	rangeEnd := clientv3.GetPrefixRangeEnd(s.keyPrefix)
+
+	from := s.keyPrefix
+	if cursor != "" {
+		//the first key following the cursor
+		from = s.key(cursor) + "\x00"
+	}
+
+	for {
+		//the deleted ids are only known once read, so ranges are read until the page is full
+		resp, err := s.client.Get(ctx, from, clientv3.WithRange(rangeEnd), clientv3.WithLimit(int64(limit+1-len(ids))))
+		if err != nil {
+			logStoreError(ctx, "etcd", "ListIDs", "", err)
+			return nil, "", err
+		}
+
+		for _, kv := range resp.Kvs {
+			item := &item{}
+			if err := json.Unmarshal(kv.Value, item); err != nil {
+				logStoreError(ctx, "etcd", "ListIDs", "", err)
+				return nil, "", err
+			}
+
+			if item.deleted() {
+				continue
+			}
+
+			if len(ids) == limit {
+				return ids, ids[limit-1], nil
+			}
+			ids = append(ids, strings.TrimPrefix(string(kv.Key), s.keyPrefix))
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return ids, "", nil
+		}
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *EtcdStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(ctx, func(item *item) bool {
+		return item.deletedBefore(deletedBefore)
+	})
+}
+
+func (s *EtcdStore) listIDs(ctx context.Context, include func(item *item) bool) ([]string, error) {
+	resp, err := s.client.Get(ctx, s.keyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logStoreError(ctx, "etcd", "listIDs", "", err)
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		item := &item{}
+		if err := json.Unmarshal(kv.Value, item); err != nil {
+			logStoreError(ctx, "etcd", "listIDs", "", err)
+			return nil, err
+		}
+
+		if include(item) {
+			ids = append(ids, strings.TrimPrefix(string(kv.Key), s.keyPrefix))
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,18 @@
+//go:build etcd
+// +build etcd
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEtcdStoreConformance(t *testing.T) {
+	endpoint := testStoreEnv(t, "RKMS_TEST_ETCD_ENDPOINT")
+	s, err := NewEtcdStore(EtcdConfig{Endpoints: []string{endpoint}, DialTimeoutInSeconds: 5, KeyPrefix: "/rkms-test/keys/"})
+	if err != nil {
+		t.Fatalf("failed to create the etcd store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
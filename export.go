@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// exportedItem is a line of an export, the encrypted data keys of an id as the store keeps them, with every version
+// of its data key, its encryption context and its metadata, for the id to be restored as it was. With an export key,
+// ExportedDataKeys is every version of the data key wrapped with it, under the encryption context of the id, for the
+// export to be decrypted without the keys of the regions.
+type exportedItem struct {
+	ID                string            `json:"id"`
+	EncryptedDataKeys map[string]string `json:"encrypted_data_keys"`
+	ExportKeyID       string            `json:"export_key_id,omitempty"`
+	ExportedDataKeys  map[string]string `json:"exported_data_keys,omitempty"`
+}
+
+// exportKey is the key an export wraps the data keys with, e.g. a KMS key of the disaster recovery account
+type exportKey struct {
+	ID       string
+	provider KeyProvider
+}
+
+// ExportDestinationFactory opens the writer of an export to the destination of the given URL, e.g. s3://bucket/key,
+// the export being complete once the writer is closed without error
+type ExportDestinationFactory func(ctx context.Context, destination string, config *Configuration) (io.WriteCloser, error)
+
+var exportDestinationFactories = make(map[string]ExportDestinationFactory)
+
+// RegisterExportDestination makes the export destinations of the given URL scheme available to `rkms export`.
+// It is meant to be called from the init function of the file implementing the destination.
+func RegisterExportDestination(scheme string, factory ExportDestinationFactory) {
+	if factory == nil {
+		panic("RegisterExportDestination: factory is nil")
+	}
+
+	if _, exists := exportDestinationFactories[scheme]; exists {
+		panic(fmt.Sprintf("RegisterExportDestination: export destination %q is registered twice", scheme))
+	}
+
+	exportDestinationFactories[scheme] = factory
+}
+
+// nopWriteCloser is the standard output as the destination of an export, left open once the export is written
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openExportDestination opens the writer of an export to the given destination: - for the standard output, a URL
+// of a registered scheme (e.g. s3://bucket/key) or the path of a file, created or truncated
+func openExportDestination(ctx context.Context, destination string, config *Configuration) (io.WriteCloser, error) {
+	if destination == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	if i := strings.Index(destination, "://"); i > 0 {
+		factory, ok := exportDestinationFactories[destination[:i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown export destination %q, the binary may have to be built with -tags %s", destination, destination[:i])
+		}
+		return factory(ctx, destination, config)
+	}
+
+	return os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// exportEncryptedDataKeys writes the encrypted data keys of every id of the store of r to w as newline-delimited
+// JSON, one id per line, the deleted ids being left out. Without export key nothing is decrypted: the export is only
+// of use with access to the keys of the regions. With one, the data keys are decrypted and wrapped with it, the ids
+// that fail to being left out and counted as failed.
+// It returns the number of ids exported and the number of ids that failed.
+func exportEncryptedDataKeys(ctx context.Context, r *RKMS, w io.Writer, key *exportKey) (int, int, error) {
+	encoder := json.NewEncoder(w)
+	exported, failed := 0, 0
+	cursor := ""
+	for {
+		var ids []string
+		var next string
+		err := r.retryStore(ctx, "list", true, func(ctx context.Context) (err error) {
+			ids, next, err = r.store.ListIDs(ctx, cursor, DefaultListIDsLimit)
+			return err
+		})
+		if err != nil {
+			logger.Errorf("failed to list ids to export: %s", err)
+			return exported, failed, err
+		}
+
+		var keys map[string]map[string]string
+		err = r.retryStore(ctx, "get_batch", true, func(ctx context.Context) (err error) {
+			keys, err = getEncryptedDataKeysBatch(ctx, r.store, ids)
+			return err
+		})
+		if err != nil {
+			logger.Errorf("failed to read the ids to export: %s", err)
+			return exported, failed, err
+		}
+
+		for _, id := range ids {
+			encryptedDataKeys, ok := keys[id]
+			if !ok {
+				continue
+			}
+
+			item := exportedItem{ID: id, EncryptedDataKeys: encryptedDataKeys}
+			if key != nil {
+				if item.ExportedDataKeys, err = r.wrapWithExportKey(ctx, id, encryptedDataKeys, key); err != nil {
+					if ctx.Err() != nil {
+						return exported, failed, err
+					}
+
+					logger.WithField("id", id).Errorf("failed to wrap the data key with the export key: %s", err)
+					failed++
+					continue
+				}
+				item.ExportKeyID = key.ID
+			}
+
+			if err := encoder.Encode(item); err != nil {
+				return exported, failed, fmt.Errorf("failed to write the export: %s", err)
+			}
+			exported++
+		}
+
+		if next == "" {
+			return exported, failed, nil
+		}
+		cursor = next
+	}
+}
+
+// wrapWithExportKey decrypts every version of the data key of id and wraps it with the export key, under the
+// encryption context of the id, returning the base64 ciphertexts by version
+func (r *RKMS) wrapWithExportKey(ctx context.Context, id string, encryptedDataKeys map[string]string, key *exportKey) (map[string]string, error) {
+	encryptionContext, err := storedEncryptionContext(encryptedDataKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make(map[string]string)
+	for version, regions := range splitDataKeyVersions(encryptedDataKeys) {
+		plaintextDataKey, err := r.decryptDataKey(ctx, r.providersFor(id), regions, encryptionContext)
+		if err != nil {
+			return nil, err
+		}
+
+		ciphertext, err := key.provider.Encrypt(ctx, plaintextDataKey.Bytes(), encryptionContext)
+		plaintextDataKey.Destroy()
+		if err != nil {
+			return nil, err
+		}
+		exported[strconv.FormatInt(version, 10)] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return exported, nil
+}
+
+// newExportKey creates the export key of the given key id, used through a key provider of the given type and region
+func newExportKey(providerType string, region string, keyID string, kmsConfig KMSConfig) (*exportKey, error) {
+	factory, ok := keyProviderFactories[providerType]
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider type %q for the export key, available key provider types are: %s", providerType, strings.Join(RegisteredKeyProviderTypes(), ", "))
+	}
+
+	provider, err := factory(region, keyID, kmsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &exportKey{ID: keyID, provider: provider}, nil
+}
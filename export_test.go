@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportEncryptedDataKeys(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	for _, id := range []string{"id-0", "id-1", "deleted"} {
+		if _, err := r.CreateDataKey(ctx, id, 0, EncryptionContext{"tenant": "a"}); err != nil {
+			t.Fatalf("failed to create the data key: %s", err)
+		}
+	}
+	if err := r.store.DeleteEncryptedDataKeys(ctx, "deleted"); err != nil {
+		t.Fatalf("failed to delete the id: %s", err)
+	}
+
+	var export bytes.Buffer
+	exported, failed, err := exportEncryptedDataKeys(ctx, r, &export, nil)
+	if err != nil || exported != 2 || failed != 0 {
+		t.Fatalf("the ids but the deleted one should have been exported, got %d and %d failed: %v", exported, failed, err)
+	}
+
+	decoder := json.NewDecoder(&export)
+	for _, id := range []string{"id-0", "id-1"} {
+		var item exportedItem
+		if err := decoder.Decode(&item); err != nil || item.ID != id || item.ExportedDataKeys != nil {
+			t.Fatalf("a line should have been written for %s, got %+v: %v", id, item, err)
+		}
+
+		stored, _ := r.store.GetEncryptedDataKeys(ctx, id)
+		if len(item.EncryptedDataKeys) != len(stored) || item.EncryptedDataKeys[metadataEntry] == "" || item.EncryptedDataKeys[encryptionContextEntry] == "" {
+			t.Fatalf("the encrypted data keys of %s should have been exported as stored, got %v", id, item.EncryptedDataKeys)
+		}
+	}
+}
+
+func TestExportWithExportKey(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	encryptionContext := EncryptionContext{"tenant": "a"}
+	created, err := r.CreateDataKey(ctx, "id", 0, encryptionContext)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+	rotated, err := r.RotateDataKey(ctx, "id", encryptionContext)
+	if err != nil {
+		t.Fatalf("failed to rotate the data key: %s", err)
+	}
+
+	t.Setenv("RKMS_TEST_EXPORT_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, LocalMasterKeySize)))
+	key, err := newExportKey("local", "", "env:RKMS_TEST_EXPORT_KEY", KMSConfig{})
+	if err != nil {
+		t.Fatalf("failed to create the export key: %s", err)
+	}
+
+	var export bytes.Buffer
+	if exported, failed, err := exportEncryptedDataKeys(ctx, r, &export, key); err != nil || exported != 1 || failed != 0 {
+		t.Fatalf("the id should have been exported, got %d and %d failed: %v", exported, failed, err)
+	}
+
+	var item exportedItem
+	if err := json.Unmarshal(export.Bytes(), &item); err != nil || item.ExportKeyID != "env:RKMS_TEST_EXPORT_KEY" || len(item.ExportedDataKeys) != 2 {
+		t.Fatalf("every version should have been wrapped with the export key, got %+v: %v", item, err)
+	}
+
+	for version, dataKey := range map[string]*DataKey{"1": created, "2": rotated} {
+		ciphertext, _ := base64.StdEncoding.DecodeString(item.ExportedDataKeys[version])
+		plaintext, err := key.provider.Decrypt(ctx, ciphertext, encryptionContext)
+		if err != nil || !bytes.Equal(plaintext, dataKey.Plaintext.Bytes()) {
+			t.Fatalf("version %s should have been decrypted with the export key under the encryption context: %v", version, err)
+		}
+	}
+}
+
+func TestOpenExportDestination(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.ndjson")
+	w, err := openExportDestination(context.Background(), path, &Configuration{})
+	if err != nil {
+		t.Fatalf("failed to open the export file: %s", err)
+	}
+	w.Write([]byte("{}\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close the export file: %s", err)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "{}\n" {
+		t.Fatalf("the export should have been written to the file, got %q: %v", b, err)
+	}
+
+	if _, err := openExportDestination(context.Background(), "gs://bucket/export", &Configuration{}); err == nil {
+		t.Fatalf("an unknown scheme should have been refused")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// fipsCryptoModule returns the name of the cryptographic module of the binary and whether it operates in FIPS 140
+// mode, a variable for the tests to run in FIPS mode
+var fipsCryptoModule = cryptoModule
+
+// validateFIPS checks, in FIPS mode, that every local cryptographic operation goes through a FIPS 140 validated
+// module and that no setting makes rkms use an algorithm or an endpoint which isn't FIPS compliant
+func (c *Configuration) validateFIPS(problemf func(format string, args ...interface{})) {
+	if !c.FIPS.Enabled {
+		return
+	}
+
+	if module, enabled := fipsCryptoModule(); !enabled {
+		problemf("fips.enabled requires the %s to operate in FIPS 140 mode: run rkms with GODEBUG=fips140=on, or build it with GOEXPERIMENT=boringcrypto", module)
+	}
+
+	if !c.KMS.UseFIPSEndpoints {
+		problemf("fips.enabled requires kms.use_fips_endpoints")
+	}
+	for region, endpoint := range c.KMS.Endpoints {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || !strings.Contains(u.Host, "kms-fips.") {
+			problemf("kms.endpoints: %q, the endpoint of region %s, isn't a FIPS endpoint of KMS over https", endpoint, region)
+		}
+	}
+
+	//the shares of Shamir's scheme aren't a FIPS approved way to protect the data keys
+	if c.KMS.ShamirThreshold != 0 {
+		problemf("kms.shamir_threshold can't be set with fips.enabled, Shamir's secret sharing isn't FIPS approved")
+	}
+
+	if strings.HasPrefix(c.DynamoDB.Endpoint, "http://") {
+		problemf("dynamodb.endpoint can't be plain http with fips.enabled")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+)
+
+// cryptoModule returns the name of the cryptographic module of Go+BoringCrypto and whether BoringCrypto handles
+// the cryptographic operations
+func cryptoModule() (string, bool) {
+	return "BoringCrypto module", boring.Enabled()
+}
@@ -0,0 +1,14 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package main
+
+import (
+	"crypto/fips140"
+)
+
+// cryptoModule returns the name of the Go Cryptographic Module and whether it operates in FIPS 140-3 mode, as
+// GODEBUG=fips140=on sets
+func cryptoModule() (string, bool) {
+	return "Go Cryptographic Module " + fips140.Version(), fips140.Enabled()
+}
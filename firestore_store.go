@@ -0,0 +1,313 @@
+//go:build firestore
+// +build firestore
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FirestoreStore - a Google Cloud Firestore implementation of a key/value store for KMS-related data.
+// Every id is a document of the configured collection, created with fail-if-exists semantics.
+type FirestoreStore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+}
+
+type firestoreDocument struct {
+	ID        string            `firestore:"id"`
+	Keys      map[string]string `firestore:"keys"`
+	DeletedAt int64             `firestore:"deleted_at,omitempty"`
+	Version   int64             `firestore:"version,omitempty"`
+}
+
+func init() {
+	RegisterStore("firestore", func(config *Configuration) (Store, error) {
+		return NewFirestoreStore(config.Firestore)
+	})
+}
+
+// NewFirestoreStore creates a new FirestoreStore instance
+func NewFirestoreStore(firestoreConfig FirestoreConfig) (*FirestoreStore, error) {
+	options := make([]option.ClientOption, 0)
+	if firestoreConfig.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(firestoreConfig.CredentialsFile))
+	}
+
+	client, err := firestore.NewClient(context.Background(), firestoreConfig.ProjectID, options...)
+	if err != nil {
+		logStoreError(context.Background(), "firestore", "NewFirestoreStore", "", err)
+		return nil, err
+	}
+
+	return &FirestoreStore{client, client.Collection(firestoreConfig.Collection)}, nil
+}
+
+// document returns the document for id. Document names can't contain slashes, so the id is escaped.
+func (s *FirestoreStore) document(id string) *firestore.DocumentRef {
+	return s.collection.Doc(url.PathEscape(id))
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *FirestoreStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *FirestoreStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	document, _, err := s.getDocument(ctx, id)
+	if err != nil || document == nil {
+		return nil, 0, err
+	}
+
+	if document.DeletedAt != 0 {
+		return nil, 0, IDDeletedStoreError{ID: id, DeletedAt: time.Unix(document.DeletedAt, 0)}
+	}
+
+	return document.Keys, document.Version, nil
+}
+
+// getDocument reads the document of the given id along with its update time, nil if it does not exist
+func (s *FirestoreStore) getDocument(ctx context.Context, id string) (*firestoreDocument, time.Time, error) {
+	snapshot, err := s.document(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, time.Time{}, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "firestore", "getDocument", id, err)
+		return nil, time.Time{}, err
+	}
+
+	document := &firestoreDocument{}
+	if err := snapshot.DataTo(document); err != nil {
+		logStoreError(ctx, "firestore", "getDocument", id, err)
+		return nil, time.Time{}, err
+	}
+
+	return document, snapshot.UpdateTime, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with a single GetAll call
+func (s *FirestoreStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	documents := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		documents[i] = s.document(id)
+	}
+
+	snapshots, err := s.client.GetAll(ctx, documents)
+	if err != nil {
+		logStoreError(ctx, "firestore", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+
+	keys := make(map[string]map[string]string, len(ids))
+	for i, snapshot := range snapshots {
+		if !snapshot.Exists() {
+			continue
+		}
+
+		document := firestoreDocument{}
+		if err := snapshot.DataTo(&document); err != nil {
+			logStoreError(ctx, "firestore", "GetEncryptedDataKeysBatch", ids[i], err)
+			return nil, err
+		}
+
+		if document.DeletedAt == 0 {
+			keys[ids[i]] = document.Keys
+		}
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *FirestoreStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	_, err := s.document(id).Create(ctx, firestoreDocument{ID: id, Keys: encryptedKeysMap})
+	if err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "firestore", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *FirestoreStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	for {
+		document, updateTime, err := s.getDocument(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		var current *item
+		if document != nil {
+			current = &item{ID: id, Keys: document.Keys, DeletedAt: document.DeletedAt, Version: document.Version}
+		}
+
+		if err := checkVersion(id, current, expectedVersion); err != nil {
+			return err
+		}
+
+		//the precondition makes a concurrent update fail one of the two, which then compares the versions again
+		updates := []firestore.Update{
+			{Path: "keys", Value: encryptedKeysMap},
+			{Path: "version", Value: expectedVersion + 1},
+		}
+		_, err = s.document(id).Update(ctx, updates, firestore.LastUpdateTime(updateTime))
+		if status.Code(err) == codes.FailedPrecondition || status.Code(err) == codes.NotFound {
+			continue
+		}
+
+		if err != nil {
+			logStoreError(ctx, "firestore", "UpdateEncryptedDataKeys", id, err)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *FirestoreStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	for {
+		snapshot, err := s.document(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+
+		if err != nil {
+			logStoreError(ctx, "firestore", "DeleteEncryptedDataKeys", id, err)
+			return err
+		}
+
+		if deletedAt, err := snapshot.DataAt("deleted_at"); err == nil && deletedAt != nil {
+			return nil
+		}
+
+		//the precondition keeps a concurrent delete from moving the deletion time forward
+		updates := []firestore.Update{{Path: "deleted_at", Value: time.Now().Unix()}}
+		_, err = s.document(id).Update(ctx, updates, firestore.LastUpdateTime(snapshot.UpdateTime))
+		if status.Code(err) == codes.FailedPrecondition {
+			continue
+		}
+
+		if err != nil && status.Code(err) != codes.NotFound {
+			logStoreError(ctx, "firestore", "DeleteEncryptedDataKeys", id, err)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *FirestoreStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	_, err := s.document(id).Update(ctx, []firestore.Update{{Path: "deleted_at", Value: firestore.Delete}})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return IDNotFoundStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "firestore", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *FirestoreStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	if _, err := s.document(id).Delete(ctx); err != nil {
+		logStoreError(ctx, "firestore", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the collection that are not deleted, in document id order
+func (s *FirestoreStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	query := s.collection.OrderBy(firestore.DocumentID, firestore.Asc)
+	if cursor != "" {
+		query = query.StartAfter(url.PathEscape(cursor))
+	}
+
+	//documents without a deleted_at field can't be matched by a query, so they are filtered here,
+	//and one more id than the limit is read to know whether there is a next page
+	ids, err := s.listIDs(ctx, query, limit+1, func(document *firestoreDocument) bool {
+		return document.DeletedAt == 0
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) > limit {
+		return ids[:limit], ids[limit-1], nil
+	}
+
+	return ids, "", nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *FirestoreStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	query := s.collection.Where("deleted_at", "<", deletedBefore.Unix())
+	return s.listIDs(ctx, query, 0, func(document *firestoreDocument) bool {
+		return true
+	})
+}
+
+// listIDs iterates over the documents of the query until max ids are included, or every document if max is 0
+func (s *FirestoreStore) listIDs(ctx context.Context, query firestore.Query, max int, include func(document *firestoreDocument) bool) ([]string, error) {
+	iter := query.Select("id", "deleted_at").Documents(ctx)
+	defer iter.Stop()
+
+	ids := make([]string, 0)
+	for len(ids) != max {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			logStoreError(ctx, "firestore", "listIDs", "", err)
+			return nil, err
+		}
+
+		document := &firestoreDocument{}
+		if err := snapshot.DataTo(document); err != nil {
+			logStoreError(ctx, "firestore", "listIDs", "", err)
+			return nil, err
+		}
+
+		if !include(document) {
+			continue
+		}
+
+		id, err := url.PathUnescape(snapshot.Ref.ID)
+		if err != nil {
+			logStoreError(ctx, "firestore", "listIDs", "", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,18 @@
+//go:build firestore
+// +build firestore
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFirestoreStoreConformance(t *testing.T) {
+	projectID := testStoreEnv(t, "RKMS_TEST_FIRESTORE_PROJECT_ID")
+	s, err := NewFirestoreStore(FirestoreConfig{ProjectID: projectID, Collection: "rkms_test_keys"})
+	if err != nil {
+		t.Fatalf("failed to create the firestore store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
@@ -0,0 +1,99 @@
+//go:build gcpkms
+// +build gcpkms
+
+package main
+
+import (
+	"context"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// GCPKMSProvider - a KeyProvider wrapping data keys with a Google Cloud KMS symmetric key.
+// The key id is the resource name of the CryptoKey (projects/*/locations/*/keyRings/*/cryptoKeys/*),
+// the region is only a name for it in the redundancy set.
+type GCPKMSProvider struct {
+	client  *kms.KeyManagementClient
+	keyName string
+}
+
+func init() {
+	RegisterKeyProvider("gcp", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return NewGCPKMSProvider(keyID, kmsConfig.GCP)
+	})
+}
+
+// NewGCPKMSProvider creates a new GCPKMSProvider instance for the given CryptoKey
+func NewGCPKMSProvider(keyName string, gcpConfig GCPKMSConfig) (*GCPKMSProvider, error) {
+	options := make([]option.ClientOption, 0)
+	if gcpConfig.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(gcpConfig.CredentialsFile))
+	}
+
+	client, err := kms.NewKeyManagementClient(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCPKMSProvider{client, keyName}, nil
+}
+
+// GenerateDataKey creates a new data key of the given size.
+// Cloud KMS doesn't generate data keys, so it is generated locally and encrypted.
+func (p *GCPKMSProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with the primary version of the CryptoKey,
+// the encryption context being its additional authenticated data
+func (p *GCPKMSProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	result, err := p.client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:                        p.keyName,
+		Plaintext:                   plaintext,
+		AdditionalAuthenticatedData: encryptionContext.AAD(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Ciphertext, nil
+}
+
+// Decrypt unwraps the given data key. The CryptoKey version is found in the ciphertext by Cloud KMS.
+func (p *GCPKMSProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	result, err := p.client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:                        p.keyName,
+		Ciphertext:                  ciphertext,
+		AdditionalAuthenticatedData: encryptionContext.AAD(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Plaintext, nil
+}
+
+// DescribeKey tells about the CryptoKey, which is enabled as long as its primary version is
+func (p *GCPKMSProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	key, err := p.client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: p.keyName})
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := key.Primary != nil && key.Primary.State == kmspb.CryptoKeyVersion_ENABLED
+	return &KeyDescription{ID: key.Name, Enabled: enabled}, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *GCPKMSProvider) ProviderType() string {
+	return "gcp"
+}
+
+// WrappingAlgorithm is the algorithm the symmetric Cloud KMS keys wrap with
+func (p *GCPKMSProvider) WrappingAlgorithm() string {
+	return "GOOGLE_SYMMETRIC_ENCRYPTION"
+}
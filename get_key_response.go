@@ -1,17 +1,49 @@
 package main
 
-import (
-	"encoding/json"
-)
-
 type getKeyResponse struct {
-	ID  string `json:"id"`
-	Key string `json:"key"`
+	ID        string    `json:"id"`
+	Key       secretRef `json:"key"`
+	Version   int64     `json:"version"`
+	ExpiresAt int64     `json:"expires_at,omitempty"`
+}
+
+// ConstructGetKeyResponse creates a server response for GET /key, POST /keys/{id}/rotate and POST /keys/{id}/derive
+// endpoints, serialized in SecureBytes for the handler to destroy once written.
+// expires_at is the unix time the key expires at, left out for keys that never expire.
+func ConstructGetKeyResponse(dataKey *DataKey) *SecureBytes {
+	return marshalSecretResponse(newGetKeyResponse(dataKey, 0), []*SecureBytes{dataKey.Plaintext})
+}
+
+// newGetKeyResponse is the response of the data key, whose plaintext is the given secret of the response
+func newGetKeyResponse(dataKey *DataKey, key secretRef) getKeyResponse {
+	resp := getKeyResponse{ID: dataKey.ID, Key: key, Version: dataKey.Version}
+	if !dataKey.ExpiresAt.IsZero() {
+		resp.ExpiresAt = dataKey.ExpiresAt.Unix()
+	}
+	return resp
+}
+
+type deriveKeyRequest struct {
+	Info        string `json:"info"`
+	Salt        []byte `json:"salt"`
+	SizeInBytes int    `json:"size_in_bytes"`
+	Version     int64  `json:"version"`
+}
+
+type decryptKeyRequest struct {
+	ID         string `json:"id"`
+	Region     string `json:"region"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type decryptKeyResponse struct {
+	ID     string    `json:"id"`
+	Key    secretRef `json:"key"`
+	Region string    `json:"region"`
 }
 
-// ConstructGetKeyResponse creates a server response for GET /key endpoint
-func ConstructGetKeyResponse(id string, key string) string {
-	resp := getKeyResponse{id, key}
-	b, _ := json.Marshal(resp)
-	return string(b)
+// ConstructDecryptKeyResponse creates a server response for POST /key/decrypt endpoint,
+// region being the one that decrypted the key
+func ConstructDecryptKeyResponse(id string, plaintext *SecureBytes, region string) *SecureBytes {
+	return marshalSecretResponse(decryptKeyResponse{id, 0, region}, []*SecureBytes{plaintext})
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GrantAuthScheme is the scheme of the Authorization header a grant token is presented with
+const GrantAuthScheme = "Grant"
+
+// grantTokenPrefix starts every grant token, for them not to be mistaken for other tokens in the logs
+const grantTokenPrefix = "rkms-grant."
+
+// Grant - the operations on an id an identity, its grantor, delegates to whoever presents the token of the grant
+// until it expires, e.g. to let a batch job decrypt the data key of one id without credentials of its own. The
+// grantor has to be permitted the operations on the id when the grant is created, and whenever it is used, so that
+// taking a permission away from the grantor revokes its grants too.
+type Grant struct {
+	ID         string   `json:"jti"`
+	Grantor    string   `json:"grantor"`
+	KeyID      string   `json:"id"`
+	Operations []string `json:"operations"`
+	IssuedAt   int64    `json:"iat"`
+	ExpiresAt  int64    `json:"exp"`
+}
+
+// InvalidGrantError is returned when a grant is requested for operations or a lifetime it can't have
+type InvalidGrantError struct {
+	Reason string
+}
+
+func (e InvalidGrantError) Error() string {
+	return "invalid grant: " + e.Reason
+}
+
+// GrantsNotEnabledError is returned when a grant is requested from a deployment without a grant signing key
+type GrantsNotEnabledError struct{}
+
+func (e GrantsNotEnabledError) Error() string {
+	return "grants aren't enabled, they need an authenticated API and auth.grants.signing_key_id"
+}
+
+// permits tells if the grant delegates the given operation
+func (g *Grant) permits(operation string) bool {
+	for _, granted := range g.Operations {
+		if granted == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// grantSigner signs and verifies the grant tokens with HMAC-SHA256, their lifetime being maxTTL at most
+type grantSigner struct {
+	key    []byte
+	maxTTL time.Duration
+}
+
+func newGrantSigner(config GrantsConfig) (*grantSigner, error) {
+	key, err := loadLocalMasterKey(config.SigningKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the grant signing key: %s", err)
+	}
+	return &grantSigner{key, time.Duration(config.MaxTTLInMinutes) * time.Minute}, nil
+}
+
+func (s *grantSigner) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(grantTokenPrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the token of the grant, its base64url JSON and signature after grantTokenPrefix
+func (s *grantSigner) sign(grant *Grant) string {
+	b, _ := json.Marshal(grant)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return grantTokenPrefix + payload + "." + s.signature(payload)
+}
+
+// verify returns the grant of a token signed by s, failing when it is forged or expired
+func (s *grantSigner) verify(token string) (*Grant, error) {
+	payload, signature, ok := strings.Cut(strings.TrimPrefix(token, grantTokenPrefix), ".")
+	if !ok || !strings.HasPrefix(token, grantTokenPrefix) {
+		return nil, errors.New("malformed grant token")
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.signature(payload))) {
+		return nil, errors.New("invalid grant token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("malformed grant token")
+	}
+	var grant Grant
+	if err := json.Unmarshal(b, &grant); err != nil || grant.Grantor == "" || grant.KeyID == "" {
+		return nil, errors.New("malformed grant token")
+	}
+	if time.Now().Unix() >= grant.ExpiresAt {
+		return nil, errors.New("the grant token expired")
+	}
+	return &grant, nil
+}
+
+// CreateGrant creates a grant of the given operations on id to the caller of ctx, for ttl, the longest lifetime of
+// the grants when 0, returning its token. The caller has to be permitted every operation on id itself, and can't
+// be using a grant: the grants don't delegate further.
+func (a *Authenticator) CreateGrant(ctx context.Context, id string, grantedOperations []string, ttl time.Duration) (*Grant, string, error) {
+	if a == nil || a.grants == nil {
+		return nil, "", GrantsNotEnabledError{}
+	}
+
+	c, _ := ctx.Value(callerContextKey{}).(caller)
+	if c.grant != nil {
+		return nil, "", IDNotPermittedError{Identity: c.identity, Operation: OperationCreateGrants, ID: id}
+	}
+
+	if id == "" || len(grantedOperations) == 0 {
+		return nil, "", InvalidGrantError{"a grant needs an id and operations"}
+	}
+	if ttl == 0 {
+		ttl = a.grants.maxTTL
+	}
+	if ttl < 0 || ttl > a.grants.maxTTL {
+		return nil, "", InvalidGrantError{fmt.Sprintf("the lifetime of a grant can't be longer than %s", a.grants.maxTTL)}
+	}
+
+	for _, operation := range grantedOperations {
+		if !operations[operation] || operation == OperationAll || operation == OperationCreateGrants {
+			return nil, "", InvalidGrantError{fmt.Sprintf("operation %q can't be granted", operation)}
+		}
+		if c.tenant != "" && !inTenantNamespace(c.tenant, id) {
+			return nil, "", IDNotPermittedError{Identity: c.identity, Operation: operation, ID: id}
+		}
+		if !a.PermittedID(c.identity, operation, id) {
+			return nil, "", IDNotPermittedError{Identity: c.identity, Operation: operation, ID: id}
+		}
+	}
+
+	grantID := make([]byte, 16)
+	if _, err := rand.Read(grantID); err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	grant := &Grant{
+		ID:         hex.EncodeToString(grantID),
+		Grantor:    c.identity,
+		KeyID:      id,
+		Operations: grantedOperations,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+	}
+	contextLogger(ctx).WithField("grant", grant.ID).Infof("granted %s on %s until %s", strings.Join(grantedOperations, ", "), id, now.Add(ttl).UTC().Format(time.RFC3339))
+	return grant, a.grants.sign(grant), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type createGrantRequest struct {
+	ID           string   `json:"id"`
+	Operations   []string `json:"operations"`
+	TTLInSeconds int64    `json:"ttl_in_seconds"`
+}
+
+type grantResponse struct {
+	GrantID    string   `json:"grant_id"`
+	GrantToken string   `json:"grant_token"`
+	ID         string   `json:"id"`
+	Operations []string `json:"operations"`
+	ExpiresAt  string   `json:"expires_at"`
+}
+
+// ConstructGrantResponse creates a server response for POST /grants endpoint
+func ConstructGrantResponse(grant *Grant, token string) string {
+	expiresAt := time.Unix(grant.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(grantResponse{grant.ID, token, grant.KeyID, grant.Operations, expiresAt})
+	return string(b)
+}
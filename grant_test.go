@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTestGrantAuthenticator(t *testing.T) *Authenticator {
+	os.Setenv("RKMS_TEST_GRANT_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, LocalMasterKeySize)))
+	defer os.Unsetenv("RKMS_TEST_GRANT_KEY")
+	a, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{
+			{Identity: "billing", KeySHA256: apiKeySHA256("billing-secret")},
+			{Identity: "admin", KeySHA256: apiKeySHA256("admin-secret")},
+		},
+		Grants: GrantsConfig{SigningKeyID: "env:RKMS_TEST_GRANT_KEY", MaxTTLInMinutes: 60},
+		Permissions: []PermissionConfig{
+			{Identity: "billing", Operations: []string{OperationGetKeys, OperationDecryptKeys, OperationCreateGrants}, IDs: []string{"billing/*"}},
+			{Identity: "admin", Operations: []string{OperationAll}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	return a
+}
+
+func TestCreateGrant(t *testing.T) {
+	a := getTestGrantAuthenticator(t)
+	billing := withCaller(context.Background(), a, "billing", OperationCreateGrants)
+
+	grant, token, err := a.CreateGrant(billing, "billing/1", []string{OperationDecryptKeys}, 10*time.Minute)
+	if err != nil || grant.Grantor != "billing" || grant.KeyID != "billing/1" || !strings.HasPrefix(token, grantTokenPrefix) {
+		t.Fatalf("the grant should have been created, got %v, %v", grant, err)
+	}
+	if expiresIn := time.Until(time.Unix(grant.ExpiresAt, 0)); expiresIn > 10*time.Minute || expiresIn < 9*time.Minute {
+		t.Fatalf("the grant should have expired in 10 minutes, not %s", expiresIn)
+	}
+
+	tests := []struct {
+		id         string
+		operations []string
+		ttl        time.Duration
+	}{
+		{"billing/1", []string{OperationRotateKeys}, 0},
+		{"shared/1", []string{OperationDecryptKeys}, 0},
+		{"billing/1", []string{OperationAll}, 0},
+		{"billing/1", []string{OperationCreateGrants}, 0},
+		{"billing/1", nil, 0},
+		{"billing/1", []string{OperationDecryptKeys}, 2 * time.Hour},
+	}
+	for _, test := range tests {
+		if _, _, err := a.CreateGrant(billing, test.id, test.operations, test.ttl); err == nil {
+			t.Errorf("a grant of %v on %s for %s should have been refused", test.operations, test.id, test.ttl)
+		}
+	}
+
+	granted, err := a.authenticateCaller(context.Background(), "", GrantAuthScheme+" "+token, OperationCreateGrants)
+	if err != nil {
+		t.Fatalf("the grant token should have been authenticated: %s", err)
+	}
+	if _, _, err := a.CreateGrant(granted, "billing/1", []string{OperationDecryptKeys}, 0); err == nil {
+		t.Fatalf("a grant shouldn't have created grants")
+	}
+
+	if _, _, err := (*Authenticator)(nil).CreateGrant(billing, "billing/1", []string{OperationDecryptKeys}, 0); err == nil {
+		t.Fatalf("grants shouldn't have been created without a signing key")
+	} else if _, ok := err.(GrantsNotEnabledError); !ok {
+		t.Fatalf("the grants should have failed with GrantsNotEnabledError, got %v", err)
+	}
+}
+
+func TestGrantToken(t *testing.T) {
+	a := getTestGrantAuthenticator(t)
+	admin := withCaller(context.Background(), a, "admin", OperationCreateGrants)
+	_, token, err := a.CreateGrant(admin, "billing/1", []string{OperationGetKeys, OperationDecryptKeys}, 0)
+	if err != nil {
+		t.Fatalf("failed to create the grant: %s", err)
+	}
+
+	ctx, err := a.authenticateCaller(context.Background(), "", GrantAuthScheme+" "+token, OperationDecryptKeys)
+	if err != nil || identityFromContext(ctx) != "admin" {
+		t.Fatalf("the caller of the grant should have been its grantor, got %q, %v", identityFromContext(ctx), err)
+	}
+	if c := ctx.Value(callerContextKey{}).(caller); !c.permitted() {
+		t.Fatalf("the granted operation should have been permitted")
+	}
+	if err := authorizeID(ctx, "billing/1"); err != nil {
+		t.Fatalf("the granted id should have been permitted: %s", err)
+	}
+	if err := authorizeID(ctx, "billing/2"); err == nil {
+		t.Fatalf("another id than the granted one shouldn't have been permitted")
+	}
+
+	rotate, _ := a.authenticateCaller(context.Background(), "", GrantAuthScheme+" "+token, OperationRotateKeys)
+	if c := rotate.Value(callerContextKey{}).(caller); c.permitted() || authorizeID(rotate, "billing/1") == nil {
+		t.Fatalf("an operation the grant doesn't delegate shouldn't have been permitted")
+	}
+
+	payload, signature, _ := strings.Cut(strings.TrimPrefix(token, grantTokenPrefix), ".")
+	forged := strings.Replace(string(mustDecodeBase64URL(t, payload)), "billing/1", "billing/2", 1)
+	for _, invalid := range []string{
+		grantTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + signature,
+		grantTokenPrefix + payload,
+		"Bearer " + token,
+	} {
+		if _, err := a.authenticateCaller(context.Background(), "", GrantAuthScheme+" "+invalid, OperationDecryptKeys); err == nil {
+			t.Errorf("the token %q should have been refused", invalid)
+		}
+	}
+
+	expired := a.grants.sign(&Grant{ID: "1", Grantor: "admin", KeyID: "billing/1", Operations: []string{OperationDecryptKeys}, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if _, err := a.authenticateCaller(context.Background(), "", GrantAuthScheme+" "+expired, OperationDecryptKeys); err == nil {
+		t.Fatalf("an expired grant token should have been refused")
+	}
+
+	//the grants only last as long as the permissions of their grantor
+	delete(a.permissions, "admin")
+	if c := ctx.Value(callerContextKey{}).(caller); c.permitted() || authorizeID(ctx, "billing/1") == nil {
+		t.Fatalf("the grants of a grantor who lost its permissions shouldn't have been permitted")
+	}
+}
+
+func TestAuthorizeGrant(t *testing.T) {
+	defer func() { authenticator = nil }()
+	authenticator = getTestGrantAuthenticator(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/grants", strings.NewReader(`{"id": "billing/1", "operations": ["keys:decrypt"], "ttl_in_seconds": 60}`))
+	r.Header.Set(APIKeyHeader, "billing-secret")
+	w := httptest.NewRecorder()
+	authorize(OperationCreateGrants, createGrant)(w, r)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"grant_token":"`+grantTokenPrefix) {
+		t.Fatalf("the grant should have been created, got %d: %s", w.Code, w.Body)
+	}
+	_, token, _ := strings.Cut(w.Body.String(), `"grant_token":"`)
+	token, _, _ = strings.Cut(token, `"`)
+
+	var identity string
+	handler := authorize(OperationDecryptKeys, func(w http.ResponseWriter, r *http.Request) {
+		identity = identityFromContext(r.Context())
+	})
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/key/decrypt?id=billing/1", nil)
+	r.Header.Set("Authorization", GrantAuthScheme+" "+token)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || identity != "billing" {
+		t.Fatalf("the grant token should have been authorized, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/key/decrypt?id=billing/1", nil)
+	r.Header.Set("Authorization", GrantAuthScheme+" "+token+"x")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), GrantAuthScheme) {
+		t.Fatalf("an invalid grant token should have been unauthorized, got %d", w.Code)
+	}
+}
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %s", s, err)
+	}
+	return b
+}
@@ -0,0 +1,16 @@
+//go:build !grpc
+// +build !grpc
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// runGRPCServer fails as gRPC support is only compiled in with the grpc build tag
+func runGRPCServer(ctx context.Context, config GRPCConfig, r *atomic.Pointer[RKMS], requestTimeout time.Duration, shutdownTimeout time.Duration) error {
+	return fmt.Errorf("server.grpc.port or server.grpc.vsock_port is set but rkms was built without gRPC support, rebuild it with -tags grpc")
+}
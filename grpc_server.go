@@ -0,0 +1,441 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/JEEN/rkms/rkmspb"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer - serves the key operations of RKMS over gRPC, as defined by api/rkms.proto, with the RKMS of the
+// current configuration
+type grpcServer struct {
+	rkmspb.UnimplementedRKMSServer
+	rkms *atomic.Pointer[RKMS]
+}
+
+// runGRPCServer serves the gRPC API on the configured port and vsock port until one of them fails or ctx is done.
+// The calls are given requestTimeout at most, when their deadline is later. The in-flight calls are given
+// shutdownTimeout to complete before being cancelled.
+func runGRPCServer(ctx context.Context, config GRPCConfig, r *atomic.Pointer[RKMS], requestTimeout time.Duration, shutdownTimeout time.Duration) error {
+	options := []grpc.ServerOption{grpc.ChainUnaryInterceptor(requestIDInterceptor, readConsistencyInterceptor, kmsAttributionInterceptor, responseRecipientInterceptor, deadlineInterceptor(requestTimeout), authInterceptor, rateLimitInterceptor)}
+	if config.CertFile != "" || config.KeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(options...)
+	rkmspb.RegisterRKMSServer(server, &grpcServer{rkms: r})
+	if config.Reflection {
+		reflection.Register(server)
+	}
+
+	var listeners []net.Listener
+	if config.Port != "" {
+		listener, err := net.Listen("tcp", ":"+config.Port)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if config.VsockPort != 0 {
+		listener, err := listenVsock(config.VsockPort)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			logger.Infof("gRPC calls still in flight after %s, cancelling them", shutdownTimeout)
+			server.Stop()
+		}
+	}()
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		logger.Infof("serving gRPC on %s %s", listener.Addr().Network(), listener.Addr())
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	//Serve returns nil once the server is stopped, the other listeners being closed when one fails
+	if err := <-errs; err != nil {
+		server.Stop()
+		return err
+	}
+	return nil
+}
+
+// GetKey returns the latest data key of an id, generating it if there is none, or the given version
+func (s *grpcServer) GetKey(ctx context.Context, request *rkmspb.GetKeyRequest) (*rkmspb.Key, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := checkReservedID(request.Id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if request.Version < 0 || request.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "version and ttl_seconds can't be negative")
+	}
+
+	var dataKey *DataKey
+	var err error
+	if request.Version > 0 {
+		dataKey, err = s.rkms.Load().GetDataKeyVersion(ctx, request.Id, request.Version, request.EncryptionContext)
+	} else {
+		dataKey, err = s.rkms.Load().GetDataKey(ctx, request.Id, time.Duration(request.TtlSeconds)*time.Second, request.EncryptionContext)
+	}
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcKey(ctx, dataKey)
+}
+
+// CreateKey generates the data key of a new id
+func (s *grpcServer) CreateKey(ctx context.Context, request *rkmspb.CreateKeyRequest) (*rkmspb.Key, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := checkReservedID(request.Id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if request.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds can't be negative")
+	}
+
+	idempotencyKey, err := grpcIdempotencyKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.rkms.Load().CreateDataKeyIdempotently(ctx, idempotencyKey, request.Id, time.Duration(request.TtlSeconds)*time.Second, request.EncryptionContext)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcKey(ctx, dataKey)
+}
+
+// RotateKey generates a new version of the data key of an existing id
+func (s *grpcServer) RotateKey(ctx context.Context, request *rkmspb.RotateKeyRequest) (*rkmspb.Key, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := checkReservedID(request.Id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	idempotencyKey, err := grpcIdempotencyKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.rkms.Load().RotateDataKeyIdempotently(ctx, idempotencyKey, request.Id, request.EncryptionContext)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcKey(ctx, dataKey)
+}
+
+// Encrypt encrypts data server-side with the latest data key of an id
+func (s *grpcServer) Encrypt(ctx context.Context, request *rkmspb.EncryptRequest) (*rkmspb.EncryptResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := checkReservedID(request.Id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var ciphertext []byte
+	var dataKey *DataKey
+	var err error
+	switch request.Format {
+	case rkmspb.CiphertextFormat_CIPHERTEXT_FORMAT_RKMS:
+		ciphertext, dataKey, err = s.rkms.Load().Encrypt(ctx, request.Id, request.Plaintext, request.EncryptionContext)
+	case rkmspb.CiphertextFormat_CIPHERTEXT_FORMAT_AWS_ENCRYPTION_SDK:
+		ciphertext, dataKey, err = s.rkms.Load().EncryptESDK(ctx, request.Id, request.Plaintext, request.EncryptionContext)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unknown ciphertext format")
+	}
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &rkmspb.EncryptResponse{Id: dataKey.ID, Version: dataKey.Version, Ciphertext: ciphertext}, nil
+}
+
+// Decrypt decrypts data encrypted by Encrypt
+func (s *grpcServer) Decrypt(ctx context.Context, request *rkmspb.DecryptRequest) (*rkmspb.DecryptResponse, error) {
+	switch request.Format {
+	case rkmspb.CiphertextFormat_CIPHERTEXT_FORMAT_RKMS:
+		plaintext, dataKey, err := s.rkms.Load().Decrypt(ctx, request.Ciphertext, request.EncryptionContext)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return &rkmspb.DecryptResponse{Id: dataKey.ID, Version: dataKey.Version, Plaintext: plaintext}, nil
+	case rkmspb.CiphertextFormat_CIPHERTEXT_FORMAT_AWS_ENCRYPTION_SDK:
+		plaintext, messageContext, err := s.rkms.Load().DecryptESDK(ctx, request.Ciphertext, request.EncryptionContext)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return &rkmspb.DecryptResponse{Plaintext: plaintext, EncryptionContext: messageContext}, nil
+	}
+
+	return nil, status.Error(codes.InvalidArgument, "unknown ciphertext format")
+}
+
+// requestIDInterceptor gives every call the request id of its x-request-id metadata if valid, a generated one
+// otherwise, returned in the x-request-id header like the X-Request-ID header of the HTTP API
+func requestIDInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var requestID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-request-id"); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+	return handler(withRequestID(ctx, requestID), request)
+}
+
+// readConsistencyInterceptor gives the reads of every call the consistency of its x-read-consistency metadata, like
+// the X-Read-Consistency header of the HTTP API
+func readConsistencyInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return handler(ctx, request)
+	}
+
+	values := md.Get("x-read-consistency")
+	if len(values) == 0 || values[0] == "" {
+		return handler(ctx, request)
+	}
+	if !validReadConsistency(values[0]) {
+		return nil, status.Error(codes.InvalidArgument, InvalidReadConsistencyError{values[0]}.Error())
+	}
+	return handler(withReadConsistency(ctx, values[0]), request)
+}
+
+// kmsAttributionInterceptor gives the calls to AWS KMS of every call the grant tokens and the role of its
+// x-kms-grant-tokens and x-kms-assume-role-arn metadata, like the X-KMS-Grant-Tokens and X-KMS-Assume-Role-Arn
+// headers of the HTTP API
+func kmsAttributionInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return handler(ctx, request)
+	}
+
+	var grantTokens, roleARN string
+	if values := md.Get("x-kms-grant-tokens"); len(values) > 0 {
+		grantTokens = strings.Join(values, ",")
+	}
+	if values := md.Get("x-kms-assume-role-arn"); len(values) > 0 {
+		roleARN = values[0]
+	}
+
+	attribution, err := rkmsHandler.Load().parseKMSAttribution(grantTokens, roleARN)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if attribution == nil {
+		return handler(ctx, request)
+	}
+	return handler(withKMSAttribution(ctx, attribution), request)
+}
+
+// responseRecipientInterceptor encrypts the keys of the response of every call to the public key of its
+// x-rkms-recipient-public-key metadata, like the X-RKMS-Recipient-Public-Key header of the HTTP API
+func responseRecipientInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return handler(ctx, request)
+	}
+
+	values := md.Get("x-rkms-recipient-public-key")
+	if len(values) == 0 {
+		return handler(ctx, request)
+	}
+	recipient, err := parseResponseRecipient(values[0])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if recipient == nil {
+		return handler(ctx, request)
+	}
+	return handler(withResponseRecipient(ctx, recipient), request)
+}
+
+// grpcOperations are the operations of the methods of the gRPC API, checked against the permissions of the callers
+var grpcOperations = map[string]string{
+	"/rkms.v1.RKMS/GetKey":    OperationGetKeys,
+	"/rkms.v1.RKMS/CreateKey": OperationGetKeys,
+	"/rkms.v1.RKMS/RotateKey": OperationRotateKeys,
+	"/rkms.v1.RKMS/Encrypt":   OperationEncrypt,
+	"/rkms.v1.RKMS/Decrypt":   OperationDecrypt,
+}
+
+// authInterceptor authenticates the callers by their x-api-key or authorization metadata, like authorize does
+// with the headers of the HTTP API, when the API is authenticated
+func authInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if authenticator == nil {
+		return handler(ctx, request)
+	}
+
+	var key, authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			key = values[0]
+		}
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+
+	operation, ok := grpcOperations[info.FullMethod]
+	ctx, err := authenticator.authenticateCaller(ctx, key, authorization, operation)
+	if err != nil {
+		contextLogger(ctx).WithField("method", info.FullMethod).Warnf("unauthenticated call: %s", err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if c := ctx.Value(callerContextKey{}).(caller); !ok || !c.permitted() {
+		contextLogger(ctx).WithField("method", info.FullMethod).Warn("forbidden call")
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not permitted %s", c.identity, info.FullMethod)
+	}
+	return handler(ctx, request)
+}
+
+// deadlineInterceptor gives the unary calls timeout at most, the deadline of the client being kept when it is
+// earlier, for the budget of the call to be shared out between its calls to the store and the key providers
+func deadlineInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if timeout <= 0 {
+			return handler(ctx, request)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, request)
+	}
+}
+
+// rateLimitInterceptor answers ResourceExhausted to the clients above their rate limit, with the seconds they have
+// to wait in the retry-after header, like limitRate does for the HTTP API
+func rateLimitInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	limiter := rateLimiter.Load()
+	if limiter == nil {
+		return handler(ctx, request)
+	}
+
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = remoteIP(p.Addr.String())
+	}
+
+	if allowed, retryAfter := limiter.allowRequest(ctx, ip); !allowed {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))))
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return handler(ctx, request)
+}
+
+// grpcKey is the message of the data key, which is destroyed: the message holds a copy of its plaintext, which gRPC
+// serializes out of the locked memory and which isn't zeroed. The key is encrypted to the recipient of the call when
+// it gave one, the x-rkms-key-encryption-algorithm header metadata telling the algorithm.
+func grpcKey(ctx context.Context, dataKey *DataKey) (*rkmspb.Key, error) {
+	defer dataKey.Destroy()
+	if recipient := responseRecipientFromContext(ctx); recipient != nil {
+		grpc.SetHeader(ctx, metadata.Pairs("x-rkms-key-encryption-algorithm", recipient.algorithm))
+	}
+	if err := sealResponseKey(ctx, dataKey.ID, &dataKey.Plaintext); err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &rkmspb.Key{Id: dataKey.ID, Key: append([]byte(nil), dataKey.Plaintext.Bytes()...), Version: dataKey.Version}
+	if !dataKey.ExpiresAt.IsZero() {
+		response.ExpiresAt = dataKey.ExpiresAt.Unix()
+	}
+	return response, nil
+}
+
+// grpcIdempotencyKey reads the idempotency-key metadata of a call, the Idempotency-Key header of the HTTP API
+func grpcIdempotencyKey(ctx context.Context) (string, error) {
+	var idempotencyKey string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("idempotency-key"); len(values) > 0 {
+			idempotencyKey = values[0]
+		}
+	}
+
+	if len(idempotencyKey) > MaxIdempotencyKeyLength {
+		return "", status.Errorf(codes.InvalidArgument, "idempotency-key can't be longer than %d characters", MaxIdempotencyKeyLength)
+	}
+	return idempotencyKey, nil
+}
+
+// grpcError converts an error of RKMS to the status matching it, like writeDataKeyError does for HTTP
+func grpcError(err error) error {
+	code := codes.Internal
+	switch err.(type) {
+	case TTLNotSupportedError, InvalidCiphertextError, InvalidKeyPairSpecError, InvalidHMACKeySpecError, InvalidMacError, InvalidDerivationError, InvalidCryptoperiodError, InvalidGrantError, ReservedIDError:
+		code = codes.InvalidArgument
+	case IDNotFoundStoreError, DataKeyVersionNotFoundError:
+		code = codes.NotFound
+	case IDAlreadyExistsStoreError:
+		code = codes.AlreadyExists
+	case GrantsNotEnabledError:
+		code = codes.Unimplemented
+	case IDDeletedStoreError, KeyStateError, DataKeySplitError, InvalidKeyUsageError, CryptoperiodExpiredError:
+		code = codes.FailedPrecondition
+	case EncryptionContextMismatchError, IDNotPermittedError:
+		code = codes.PermissionDenied
+	case InsufficientRegionsError, CircuitOpenError:
+		code = codes.Unavailable
+	case IdempotencyKeyReusedError:
+		code = codes.InvalidArgument
+	case IdempotencyKeyInProgressError:
+		code = codes.Aborted
+	case IdempotencyNotSupportedError:
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
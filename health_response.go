@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type livenessResponse struct {
+	Status string `json:"status"`
+}
+
+type readinessResponse struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// ConstructLivenessResponse creates a server response for GET /healthz endpoint
+func ConstructLivenessResponse() string {
+	b, _ := json.Marshal(livenessResponse{"ok"})
+	return string(b)
+}
+
+// ConstructReadinessResponse creates a server response for GET /readyz endpoint
+func ConstructReadinessResponse(ready bool, checks []ReadinessCheck) string {
+	b, _ := json.Marshal(readinessResponse{ready, checks})
+	return string(b)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// macAlgorithmEntry is the entry of the encrypted data keys the MAC algorithm of an HMAC key is saved under, the
+// ciphertexts of the id being those of the HMAC key
+const macAlgorithmEntry = dataKeyVersionSeparator + "mac_algorithm"
+
+// the specs of the HMAC keys, named the way KMS names them, the key being as long as its hash
+const (
+	HMACKeySpec224 = "HMAC_224"
+	HMACKeySpec256 = "HMAC_256"
+	HMACKeySpec384 = "HMAC_384"
+	HMACKeySpec512 = "HMAC_512"
+)
+
+// DefaultHMACKeySpec is the spec of the HMAC keys created without one
+const DefaultHMACKeySpec = HMACKeySpec256
+
+// MaxMacMessageSizeInBytes is the largest message a MAC is generated or verified for, as with KMS
+const MaxMacMessageSizeInBytes = 4096
+
+type hmacKeySpec struct {
+	algorithm   string
+	sizeInBytes int
+	hash        func() hash.Hash
+}
+
+var hmacKeySpecs = map[string]hmacKeySpec{
+	HMACKeySpec224: {"HMAC_SHA_224", 28, sha256.New224},
+	HMACKeySpec256: {"HMAC_SHA_256", 32, sha256.New},
+	HMACKeySpec384: {"HMAC_SHA_384", 48, sha512.New384},
+	HMACKeySpec512: {"HMAC_SHA_512", 64, sha512.New},
+}
+
+// Mac - a MAC of a message generated with the HMAC key of an id, Mac being base64
+type Mac struct {
+	ID           string
+	KeySpec      string
+	MacAlgorithm string
+	Mac          string
+}
+
+// InvalidHMACKeySpecError is returned when an HMAC key is requested with a spec which isn't one of the specs of the
+// HMAC keys
+type InvalidHMACKeySpecError struct {
+	Spec string
+}
+
+func (e InvalidHMACKeySpecError) Error() string {
+	specs := make([]string, 0, len(hmacKeySpecs))
+	for spec := range hmacKeySpecs {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	return fmt.Sprintf("unknown HMAC key spec %q, the HMAC key specs are %s", e.Spec, strings.Join(specs, ", "))
+}
+
+// InvalidMacError is returned when a MAC isn't the one the HMAC key of its id generates for its message
+type InvalidMacError struct {
+	ID string
+}
+
+func (e InvalidMacError) Error() string {
+	return fmt.Sprintf("the MAC isn't the one of the message with the HMAC key of id %s", e.ID)
+}
+
+// isHMACKey tells if the encrypted data keys are those of an HMAC key
+func isHMACKey(encryptedDataKeys map[string]string) bool {
+	_, ok := encryptedDataKeys[macAlgorithmEntry]
+	return ok
+}
+
+// hmacKey - the decrypted HMAC key of an id
+type hmacKey struct {
+	id   string
+	spec string
+	key  *SecureBytes
+}
+
+func (k *hmacKey) mac(message []byte) []byte {
+	mac := hmac.New(hmacKeySpecs[k.spec].hash, k.key.Bytes())
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// GenerateMac generates the MAC of the message with the HMAC key of the given id, generating a key of the given
+// spec, DefaultHMACKeySpec when empty, if the id doesn't exist yet. The HMAC key is wrapped by every region the way
+// the data keys are, and never leaves rkms.
+func (r *RKMS) GenerateMac(ctx context.Context, id string, spec string, message []byte, encryptionContext EncryptionContext) (*Mac, error) {
+	ctx = withLogID(ctx, id)
+	if spec != "" {
+		if _, ok := hmacKeySpecs[spec]; !ok {
+			return nil, InvalidHMACKeySpecError{spec}
+		}
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfGetPlaintextDataKeyTries; i++ {
+		var key *hmacKey
+		key, err = r.lookInStoreForHMACKey(ctx, id, spec, encryptionContext)
+		if err == nil && key == nil {
+			createdSpec := spec
+			if createdSpec == "" {
+				createdSpec = DefaultHMACKeySpec
+			}
+			key, err = r.createHMACKeyForID(ctx, id, createdSpec, encryptionContext)
+			if _, ok := err.(IDAlreadyExistsStoreError); ok {
+				//another request created the id first, its key is read back strongly for the read to see it
+				contextLogger(ctx).Debugln("the id was created by another request first, reading it back")
+				ctx = withReadConsistency(ctx, ReadConsistencyStrong)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		mac := base64.StdEncoding.EncodeToString(key.mac(message))
+		key.key.Destroy()
+		return &Mac{ID: id, KeySpec: key.spec, MacAlgorithm: hmacKeySpecs[key.spec].algorithm, Mac: mac}, nil
+	}
+
+	return nil, err
+}
+
+// VerifyMac verifies the MAC is the one the HMAC key of the given id generates for the message, failing with an
+// InvalidMacError if it isn't. Unlike GenerateMac, it never generates a key.
+func (r *RKMS) VerifyMac(ctx context.Context, id string, message []byte, mac []byte, encryptionContext EncryptionContext) error {
+	ctx = withLogID(ctx, id)
+	key, err := r.lookInStoreForHMACKey(ctx, id, "", encryptionContext)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	valid := hmac.Equal(key.mac(message), mac)
+	key.key.Destroy()
+	if !valid {
+		return InvalidMacError{ID: id}
+	}
+	return nil
+}
+
+// lookInStoreForHMACKey decrypts the HMAC key of id, nil if the id doesn't exist
+func (r *RKMS) lookInStoreForHMACKey(ctx context.Context, id string, spec string, encryptionContext EncryptionContext) (*hmacKey, error) {
+	storeCtx, cancel := budgetContext(ctx, 2)
+	encryptedDataKeys, expiresAt, err := r.getEncryptedDataKeys(storeCtx, id)
+	cancel()
+	if err != nil {
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, nil
+	}
+
+	if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyState(id, encryptedDataKeys); err != nil {
+		return nil, err
+	}
+
+	if !isHMACKey(encryptedDataKeys) {
+		return nil, InvalidKeyUsageError{ID: id, Reason: "has another kind of key than an HMAC key"}
+	}
+
+	metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := hmacKeySpecs[metadata.KeySpec]; !ok {
+		return nil, fmt.Errorf("the HMAC key of id %s is of an unknown spec %q", id, metadata.KeySpec)
+	}
+	if spec != "" && metadata.KeySpec != spec {
+		return nil, InvalidKeyUsageError{ID: id, Reason: fmt.Sprintf("has an HMAC key of spec %s, not %s", metadata.KeySpec, spec)}
+	}
+
+	dataKey, err := r.decryptCheckedDataKeyVersion(ctx, id, encryptedDataKeys, FirstDataKeyVersion, encryptionContext, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hmacKey{id, metadata.KeySpec, dataKey.Plaintext}, nil
+}
+
+// createHMACKeyForID generates an HMAC key of the given spec and saves it as the key of the id, wrapped in every
+// region, failing with IDAlreadyExistsStoreError if the id exists
+func (r *RKMS) createHMACKeyForID(ctx context.Context, id string, spec string, encryptionContext EncryptionContext) (*hmacKey, error) {
+	contextLogger(ctx).Debugf("creating a %s key...", spec)
+	key := newSecureBytes(hmacKeySpecs[spec].sizeInBytes)
+	if _, err := rand.Read(key.Bytes()); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	entries := map[string]string{macAlgorithmEntry: hmacKeySpecs[spec].algorithm}
+	if err := r.createGeneratedKeyForID(ctx, id, key.Bytes(), spec, entries, encryptionContext); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return &hmacKey{id, spec, key}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+)
+
+func TestGenerateVerifyMac(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	message := []byte("POST /orders")
+
+	mac, err := r.GenerateMac(ctx, "signing", HMACKeySpec512, message, nil)
+	if err != nil {
+		t.Fatalf("failed to generate the MAC: %s", err)
+	}
+	if mac.KeySpec != HMACKeySpec512 || mac.MacAlgorithm != "HMAC_SHA_512" {
+		t.Fatalf("the MAC should have been generated with HMAC_SHA_512, got %+v", mac)
+	}
+
+	again, err := r.GenerateMac(ctx, "signing", "", message, nil)
+	if err != nil || again.Mac != mac.Mac {
+		t.Fatalf("the HMAC key of the id should have been reused, got %v", err)
+	}
+
+	//the MAC is the HMAC of the key saved wrapped for the id
+	key, err := r.lookInStoreForHMACKey(ctx, "signing", "", nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt the HMAC key: %s", err)
+	}
+	expected := hmac.New(sha512.New, key.key.Bytes())
+	expected.Write(message)
+	if base64.StdEncoding.EncodeToString(expected.Sum(nil)) != mac.Mac || key.key.Len() != 64 {
+		t.Fatalf("the MAC should have been the HMAC-SHA-512 of a 64 bytes key")
+	}
+
+	decoded, _ := base64.StdEncoding.DecodeString(mac.Mac)
+	if err := r.VerifyMac(ctx, "signing", message, decoded, nil); err != nil {
+		t.Fatalf("the MAC should have been verified: %s", err)
+	}
+	if err := r.VerifyMac(ctx, "signing", []byte("POST /refunds"), decoded, nil); err == nil {
+		t.Fatalf("the MAC of another message shouldn't have been verified")
+	} else if _, ok := err.(InvalidMacError); !ok {
+		t.Fatalf("the MAC of another message should have failed with InvalidMacError, got %v", err)
+	}
+	if err := r.VerifyMac(ctx, "missing", message, decoded, nil); err == nil {
+		t.Fatalf("a missing id shouldn't have been created by the verification")
+	}
+}
+
+func TestHMACKeyUsage(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	if _, err := r.GenerateMac(ctx, "signing", "HMAC_128", []byte("m"), nil); err == nil {
+		t.Fatalf("an unknown spec should have failed")
+	} else if _, ok := err.(InvalidHMACKeySpecError); !ok {
+		t.Fatalf("an unknown spec should have failed with InvalidHMACKeySpecError, got %v", err)
+	}
+
+	if _, err := r.GenerateMac(ctx, "signing", "", []byte("m"), nil); err != nil {
+		t.Fatalf("failed to generate the MAC: %s", err)
+	}
+	if _, err := r.GetDataKey(ctx, "symmetric", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	for name, call := range map[string]func() error{
+		"the data key of an HMAC key":   func() error { _, err := r.GetDataKey(ctx, "signing", 0, nil); return err },
+		"the pair of an HMAC key":       func() error { _, err := r.GetDataKeyPair(ctx, "signing", "", nil); return err },
+		"a MAC of another spec":         func() error { _, err := r.GenerateMac(ctx, "signing", HMACKeySpec384, []byte("m"), nil); return err },
+		"a MAC of a symmetric data key": func() error { _, err := r.GenerateMac(ctx, "symmetric", "", []byte("m"), nil); return err },
+	} {
+		if _, ok := call().(InvalidKeyUsageError); !ok {
+			t.Fatalf("%s should have failed with InvalidKeyUsageError", name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IAMAuthScheme is the scheme of the Authorization header of the callers authenticated by their IAM identity,
+// followed by the base64 of the JSON of the GetCallerIdentity request they signed (see IAMRequest)
+const IAMAuthScheme = "AWS-IAM"
+
+// IAMServerIDHeader is the header of the GetCallerIdentity requests naming the rkms it is signed for, so that a
+// request signed for another service can't be replayed to rkms
+const IAMServerIDHeader = "X-Rkms-Server-Id"
+
+// IAMIdentityCacheTTL is how long the identity of a signed request is cached, not to call STS for every request
+// of a caller reusing its signature. STS only accepts a signature for 15 minutes.
+const IAMIdentityCacheTTL = 5 * time.Minute
+
+// maxIAMIdentities is the number of cached identities above which the expired ones are purged
+const maxIAMIdentities = 10000
+
+// stsHost matches the hosts of the STS endpoints the signed requests can be sent to, so that rkms can't be made
+// to send them anywhere else
+var stsHost = regexp.MustCompile(`^sts(\.[a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+// IAMRequest - an STS GetCallerIdentity request signed with SigV4 by a caller, which rkms sends to STS to learn its
+// IAM identity, the way Vault's AWS auth method does
+type IAMRequest struct {
+	URL     string      `json:"url"`
+	Body    string      `json:"body"`
+	Headers http.Header `json:"headers"`
+}
+
+type getCallerIdentityResponse struct {
+	Arn string `xml:"GetCallerIdentityResult>Arn"`
+}
+
+type cachedIAMIdentity struct {
+	arn       string
+	expiresAt time.Time
+}
+
+// iamVerifier authenticates the callers by the IAM identity STS answers their signed requests with
+type iamVerifier struct {
+	serverID string
+	client   *http.Client
+	mutex    sync.Mutex
+	cache    map[string]cachedIAMIdentity
+}
+
+func newIAMVerifier(config IAMAuthConfig) *iamVerifier {
+	return &iamVerifier{
+		serverID: config.ServerID,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    make(map[string]cachedIAMIdentity),
+	}
+}
+
+// verify returns the IAM identity of the caller of the given signed request, encoded as in its Authorization header
+func (v *iamVerifier) verify(ctx context.Context, encoded string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed IAM request")
+	}
+	var iamRequest IAMRequest
+	if err := json.Unmarshal(b, &iamRequest); err != nil {
+		return "", errors.New("malformed IAM request")
+	}
+	if err := v.check(iamRequest); err != nil {
+		return "", err
+	}
+
+	signature := sha256.Sum256([]byte(iamRequest.Headers.Get("Authorization")))
+	cacheKey := string(signature[:])
+	now := time.Now()
+	v.mutex.Lock()
+	cached, ok := v.cache[cacheKey]
+	v.mutex.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.arn, nil
+	}
+
+	arn, err := v.getCallerIdentity(ctx, iamRequest)
+	if err != nil {
+		return "", err
+	}
+	identity := iamIdentity(arn)
+
+	v.mutex.Lock()
+	if len(v.cache) >= maxIAMIdentities {
+		for key, cached := range v.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(v.cache, key)
+			}
+		}
+	}
+	v.cache[cacheKey] = cachedIAMIdentity{identity, now.Add(IAMIdentityCacheTTL)}
+	v.mutex.Unlock()
+	return identity, nil
+}
+
+// check tells if a signed request is a GetCallerIdentity request to STS, signed for this rkms
+func (v *iamVerifier) check(iamRequest IAMRequest) error {
+	u, err := url.Parse(iamRequest.URL)
+	if err != nil || u.Scheme != "https" || !stsHost.MatchString(u.Host) || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return errors.New("the IAM request must be sent to an STS endpoint")
+	}
+
+	query, err := url.ParseQuery(iamRequest.Body)
+	if err != nil || len(query) != 2 || query.Get("Action") != "GetCallerIdentity" || query.Get("Version") == "" {
+		return errors.New("the IAM request must be a GetCallerIdentity request")
+	}
+
+	authorization := iamRequest.Headers.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return errors.New("the IAM request must be signed with SigV4")
+	}
+
+	if v.serverID != "" {
+		if iamRequest.Headers.Get(IAMServerIDHeader) != v.serverID || !signedHeader(authorization, IAMServerIDHeader) {
+			return fmt.Errorf("the IAM request must be signed with the %s header of this rkms", IAMServerIDHeader)
+		}
+	}
+	return nil
+}
+
+// signedHeader tells if the SignedHeaders of a SigV4 Authorization header include the given header
+func signedHeader(authorization string, header string) bool {
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "SignedHeaders=") {
+			for _, name := range strings.Split(strings.TrimPrefix(part, "SignedHeaders="), ";") {
+				if name == strings.ToLower(header) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// getCallerIdentity sends a signed request to STS, returning the ARN of the identity which signed it
+func (v *iamVerifier) getCallerIdentity(ctx context.Context, iamRequest IAMRequest) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, iamRequest.URL, strings.NewReader(iamRequest.Body))
+	if err != nil {
+		return "", err
+	}
+	for name, values := range iamRequest.Headers {
+		if strings.EqualFold(name, "Host") {
+			request.Host = values[0]
+			continue
+		}
+		request.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	request.Header.Set("Accept", "application/xml")
+
+	resp, err := v.client.Do(request)
+	if err != nil {
+		contextLogger(ctx).WithField("url", iamRequest.URL).Errorf("was not able to reach STS: %s", err)
+		return "", errors.New("was not able to verify the IAM request")
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.New("was not able to verify the IAM request")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("STS rejected the IAM request with status %d", resp.StatusCode)
+	}
+
+	var identity getCallerIdentityResponse
+	if err := xml.Unmarshal(b, &identity); err != nil || identity.Arn == "" {
+		return "", errors.New("unexpected STS response")
+	}
+	return identity.Arn, nil
+}
+
+// iamIdentity returns the identity permissions are configured for of an ARN: the role of an assumed role
+// session (arn:aws:iam::<account>:role/<role>), the ARN itself for users
+func iamIdentity(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return arn
+	}
+
+	role := strings.Split(strings.TrimPrefix(parts[5], "assumed-role/"), "/")[0]
+	return strings.Join([]string{parts[0], parts[1], "iam", "", parts[4], "role/" + role}, ":")
+}
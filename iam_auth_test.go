@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+const testGetCallerIdentityBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+// signTestIAMRequest returns the credentials of an Authorization header with the AWS-IAM scheme, signed with the
+// given access key for the given STS endpoint
+func signTestIAMRequest(t *testing.T, endpoint string, serverID string, accessKeyID string) string {
+	request, _ := http.NewRequest(http.MethodPost, endpoint, nil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if serverID != "" {
+		request.Header.Set(IAMServerIDHeader, serverID)
+	}
+
+	payloadHash := sha256.Sum256([]byte(testGetCallerIdentityBody))
+	credentials := aws.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: "secret"}
+	if err := v4.NewSigner().SignHTTP(context.Background(), credentials, request, hex.EncodeToString(payloadHash[:]), "sts", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("was not able to sign the request: %s", err)
+	}
+
+	b, _ := json.Marshal(IAMRequest{URL: endpoint, Body: testGetCallerIdentityBody, Headers: request.Header})
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// newTestSTS serves GetCallerIdentity, answering the requests signed with AKIDBILLING with an assumed role of billing
+func newTestSTS(t *testing.T, calls *int32) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != testGetCallerIdentityBody || !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDBILLING/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:sts::123456789012:assumed-role/billing/i-0123456789</Arn>
+    <UserId>AROAEXAMPLE:i-0123456789</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`)
+	}))
+	t.Cleanup(server.Close)
+
+	host := stsHost
+	stsHost = regexp.MustCompile("^" + regexp.QuoteMeta(strings.TrimPrefix(server.URL, "https://")) + "$")
+	t.Cleanup(func() { stsHost = host })
+	return server
+}
+
+func TestIAMVerifier(t *testing.T) {
+	var calls int32
+	sts := newTestSTS(t, &calls)
+	verifier := newIAMVerifier(IAMAuthConfig{Enabled: true, ServerID: "rkms.example.com"})
+	verifier.client = sts.Client()
+	ctx := context.Background()
+
+	signed := signTestIAMRequest(t, sts.URL+"/", "rkms.example.com", "AKIDBILLING")
+	for i := 0; i < 2; i++ {
+		identity, err := verifier.verify(ctx, signed)
+		if err != nil || identity != "arn:aws:iam::123456789012:role/billing" {
+			t.Fatalf("the signed request should have been verified as the billing role, got %q, %v", identity, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("the identity of a signature should have been cached, STS was called %d times", calls)
+	}
+
+	if _, err := verifier.verify(ctx, signTestIAMRequest(t, sts.URL+"/", "rkms.example.com", "AKIDOTHER")); err == nil {
+		t.Fatalf("a request rejected by STS shouldn't have been verified")
+	}
+
+	if _, err := verifier.verify(ctx, signTestIAMRequest(t, sts.URL+"/", "other.example.com", "AKIDBILLING")); err == nil {
+		t.Fatalf("a request signed for another server shouldn't have been verified")
+	}
+
+	if _, err := verifier.verify(ctx, signTestIAMRequest(t, "https://attacker.example.com/", "rkms.example.com", "AKIDBILLING")); err == nil {
+		t.Fatalf("a request to another host than STS shouldn't have been sent")
+	}
+	if calls != 2 {
+		t.Fatalf("only the request to STS should have been sent, STS was called %d times", calls)
+	}
+}
+
+func TestIAMAuthentication(t *testing.T) {
+	var calls int32
+	sts := newTestSTS(t, &calls)
+	a, err := NewAuthenticator(AuthConfig{
+		IAM:         IAMAuthConfig{Enabled: true},
+		Permissions: []PermissionConfig{{Identity: "arn:aws:iam::123456789012:role/billing", Operations: []string{OperationGetKeys}}},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	a.iam.client = sts.Client()
+
+	identity, err := a.Authenticate(context.Background(), "", IAMAuthScheme+" "+signTestIAMRequest(t, sts.URL, "", "AKIDBILLING"))
+	if err != nil || !a.Permitted(identity, OperationGetKeys) || a.Permitted(identity, OperationRotateKeys) {
+		t.Fatalf("the billing role should be permitted its operations only, got %q, %v", identity, err)
+	}
+}
+
+func TestIAMIdentity(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:sts::123456789012:assumed-role/billing/session": "arn:aws:iam::123456789012:role/billing",
+		"arn:aws:iam::123456789012:user/alice":                   "arn:aws:iam::123456789012:user/alice",
+		"arn:aws-cn:sts::123456789012:assumed-role/billing/s":    "arn:aws-cn:iam::123456789012:role/billing",
+		"arn:aws:sts::123456789012:federated-user/bob":           "arn:aws:sts::123456789012:federated-user/bob",
+	}
+
+	for arn, expected := range tests {
+		if identity := iamIdentity(arn); identity != expected {
+			t.Errorf("expected %s to be %s, got %s", arn, expected, identity)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header a write request is given a key with by its client, for the retries of the
+// request to be answered with the outcome of the first one rather than to be applied again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// MaxIdempotencyKeyLength is the length an idempotency key can't exceed
+const MaxIdempotencyKeyLength = 255
+
+// IdempotencyRecordRetention is how long the outcome of a request given an idempotency key is kept for its retries
+const IdempotencyRecordRetention = 24 * time.Hour
+
+// IdempotencyInProgressExpiration is how long the record of a request still being applied is kept, for a server
+// going away halfway not to leave its key in progress until IdempotencyRecordRetention
+const IdempotencyInProgressExpiration = time.Minute
+
+// IdempotencyRecord is the record the stores persist for an idempotency key: a fingerprint of the request it was
+// first given with and, once the request succeeded, the version of the data key it resulted in, 0 until then.
+// The plaintext data key isn't part of it, a retry decrypts the version again.
+// ExpiresAt is the unix time the record expires at.
+type IdempotencyRecord struct {
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	ID          string `json:"data_key_id"`
+	Version     int64  `json:"version,omitempty"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+func (r *IdempotencyRecord) done() bool {
+	return r.Version != 0
+}
+
+func (r *IdempotencyRecord) expired(now time.Time) bool {
+	return r.ExpiresAt <= now.Unix()
+}
+
+// IdempotencyNotSupportedError is returned for a request given an idempotency key when the store can't persist
+// idempotency records
+type IdempotencyNotSupportedError struct{}
+
+func (e IdempotencyNotSupportedError) Error() string {
+	return "the store doesn't support idempotency keys"
+}
+
+// IdempotencyKeyReusedError is returned when an idempotency key is given again with another request
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (e IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("idempotency key %q was used for another request", e.Key)
+}
+
+// IdempotencyKeyInProgressError is returned when the request first given an idempotency key is still being applied
+type IdempotencyKeyInProgressError struct {
+	Key string
+}
+
+func (e IdempotencyKeyInProgressError) Error() string {
+	return fmt.Sprintf("the request of idempotency key %q is still in progress", e.Key)
+}
+
+// idempotencyRecordKey is the key the record of an idempotency key is stored under, the idempotency keys of the
+// callers being apart from each other
+func idempotencyRecordKey(ctx context.Context, idempotencyKey string) string {
+	digest := sha256.Sum256([]byte(identityFromContext(ctx) + "\x00" + idempotencyKey))
+	return hex.EncodeToString(digest[:])
+}
+
+// idempotencyFingerprint identifies the request of an idempotency key, for the key not to be given to another one
+func idempotencyFingerprint(operation string, id string, ttl time.Duration, encryptionContext EncryptionContext) string {
+	digest := sha256.New()
+	digest.Write([]byte(operation + "\x00" + id + "\x00" + strconv.FormatInt(int64(ttl), 10) + "\x00"))
+	digest.Write(encryptionContext.AAD())
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// CreateDataKeyIdempotently is CreateDataKey, the retries of a creation given idempotencyKey returning the data key
+// it created rather than failing on the id that now exists. An empty idempotencyKey is a plain CreateDataKey.
+func (r *RKMS) CreateDataKeyIdempotently(ctx context.Context, idempotencyKey string, id string, ttl time.Duration, encryptionContext EncryptionContext) (*DataKey, error) {
+	fingerprint := idempotencyFingerprint("create", id, ttl, encryptionContext)
+	return r.idempotently(ctx, idempotencyKey, fingerprint, id, encryptionContext, func(ctx context.Context) (*DataKey, error) {
+		return r.CreateDataKey(ctx, id, ttl, encryptionContext)
+	})
+}
+
+// RotateDataKeyIdempotently is RotateDataKey, the retries of a rotation given idempotencyKey returning the version it
+// generated rather than rotating the data key again. An empty idempotencyKey is a plain RotateDataKey.
+func (r *RKMS) RotateDataKeyIdempotently(ctx context.Context, idempotencyKey string, id string, encryptionContext EncryptionContext) (*DataKey, error) {
+	fingerprint := idempotencyFingerprint("rotate", id, 0, encryptionContext)
+	return r.idempotently(ctx, idempotencyKey, fingerprint, id, encryptionContext, func(ctx context.Context) (*DataKey, error) {
+		return r.RotateDataKey(ctx, id, encryptionContext)
+	})
+}
+
+// idempotently applies the request of the given fingerprint once per idempotency key: the first request saves an
+// idempotency record and applies it, the retries return the version of the data key of id it resulted in.
+// The request is applied until its deadline whether its caller goes away or not, for its retries to find its outcome, and a failed
+// request drops its record, for the retries to apply it again.
+func (r *RKMS) idempotently(ctx context.Context, idempotencyKey string, fingerprint string, id string, encryptionContext EncryptionContext, apply func(ctx context.Context) (*DataKey, error)) (*DataKey, error) {
+	if idempotencyKey == "" {
+		return apply(ctx)
+	}
+
+	store, ok := r.store.(IdempotencyStore)
+	if !ok {
+		return nil, IdempotencyNotSupportedError{}
+	}
+
+	ctx = withLogID(ctx, id)
+	record := &IdempotencyRecord{
+		Key:         idempotencyRecordKey(ctx, idempotencyKey),
+		Fingerprint: fingerprint,
+		ID:          id,
+		ExpiresAt:   time.Now().Add(IdempotencyInProgressExpiration).Unix(),
+	}
+	err := store.SetIdempotencyRecordConditionally(ctx, record)
+	if _, exists := err.(IDAlreadyExistsStoreError); exists {
+		dataKey, found, replayErr := r.replay(ctx, store, idempotencyKey, record, encryptionContext)
+		if found || replayErr != nil {
+			return dataKey, replayErr
+		}
+
+		//the first request failed since, this one applies it again
+		err = store.SetIdempotencyRecordConditionally(ctx, record)
+		if _, exists := err.(IDAlreadyExistsStoreError); exists {
+			return nil, IdempotencyKeyInProgressError{Key: idempotencyKey}
+		}
+	}
+
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to save the idempotency record: %s", err)
+		return nil, err
+	}
+
+	ctx, cancel := detachedContext(ctx)
+	defer cancel()
+	dataKey, err := apply(ctx)
+	if err != nil {
+		if err := store.DeleteIdempotencyRecord(ctx, record.Key); err != nil {
+			contextLogger(ctx).Warnf("failed to delete the idempotency record of a failed request: %s", err)
+		}
+		return nil, err
+	}
+
+	record.Version = dataKey.Version
+	record.ExpiresAt = time.Now().Add(IdempotencyRecordRetention).Unix()
+	if err := store.SetIdempotencyRecord(ctx, record); err != nil {
+		//the retries get IdempotencyKeyInProgressError until the record expires
+		contextLogger(ctx).Errorf("failed to save the outcome of the request in its idempotency record: %s", err)
+	}
+	return dataKey, nil
+}
+
+// replay returns the data key the request of the record of an idempotency key already in the store resulted in,
+// and whether the store still has that record
+func (r *RKMS) replay(ctx context.Context, store IdempotencyStore, idempotencyKey string, record *IdempotencyRecord, encryptionContext EncryptionContext) (*DataKey, bool, error) {
+	first, err := store.GetIdempotencyRecord(ctx, record.Key)
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to read the idempotency record: %s", err)
+		return nil, false, err
+	}
+
+	if first == nil {
+		return nil, false, nil
+	}
+
+	if first.Fingerprint != record.Fingerprint {
+		return nil, true, IdempotencyKeyReusedError{Key: idempotencyKey}
+	}
+
+	if !first.done() {
+		return nil, true, IdempotencyKeyInProgressError{Key: idempotencyKey}
+	}
+
+	contextLogger(ctx).Debugf("replaying the request of idempotency key %q", idempotencyKey)
+	dataKey, err := r.GetDataKeyVersion(ctx, first.ID, first.Version, encryptionContext)
+	return dataKey, true, err
+}
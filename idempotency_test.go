@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRotateDataKeyIdempotently(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	encryptionContext := EncryptionContext{"tenant": "a"}
+	if _, err := r.CreateDataKey(ctx, "id", 0, encryptionContext); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	rotated, err := r.RotateDataKeyIdempotently(ctx, "rotation-1", "id", encryptionContext)
+	if err != nil || rotated.Version != 2 {
+		t.Fatalf("the data key should have been rotated, got %+v: %v", rotated, err)
+	}
+
+	//a retry returns the version of the first rotation rather than rotating again
+	retried, err := r.RotateDataKeyIdempotently(ctx, "rotation-1", "id", encryptionContext)
+	if err != nil || retried.Version != 2 || !retried.Plaintext.Equal(rotated.Plaintext) {
+		t.Fatalf("the retry should have returned the rotated data key, got %+v: %v", retried, err)
+	}
+
+	if rotated, err := r.RotateDataKeyIdempotently(ctx, "rotation-2", "id", encryptionContext); err != nil || rotated.Version != 3 {
+		t.Fatalf("another idempotency key should have rotated the data key again, got %+v: %v", rotated, err)
+	}
+
+	if _, err := r.RotateDataKeyIdempotently(ctx, "rotation-1", "other-id", encryptionContext); err != (IdempotencyKeyReusedError{Key: "rotation-1"}) {
+		t.Fatalf("the idempotency key given with another request should have failed, got %v", err)
+	}
+}
+
+func TestCreateDataKeyIdempotently(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	created, err := r.CreateDataKeyIdempotently(ctx, "creation", "id", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	if retried, err := r.CreateDataKeyIdempotently(ctx, "creation", "id", 0, nil); err != nil || !retried.Plaintext.Equal(created.Plaintext) {
+		t.Fatalf("the retry should have returned the created data key rather than failing on the existing id, got %v", err)
+	}
+
+	if _, err := r.CreateDataKeyIdempotently(ctx, "", "id", 0, nil); err != (IDAlreadyExistsStoreError{ID: "id"}) {
+		t.Fatalf("a creation without idempotency key should have failed on the existing id, got %v", err)
+	}
+}
+
+func TestIdempotentRequestFailureDropsRecord(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	if _, err := r.RotateDataKeyIdempotently(ctx, "rotation", "id", nil); err != (IDNotFoundStoreError{ID: "id"}) {
+		t.Fatalf("rotating a missing id should have failed, got %v", err)
+	}
+
+	//the retry applies the request again once the id exists
+	if _, err := r.CreateDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+	if rotated, err := r.RotateDataKeyIdempotently(ctx, "rotation", "id", nil); err != nil || rotated.Version != 2 {
+		t.Fatalf("the retry of the failed rotation should have rotated the data key, got %+v: %v", rotated, err)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	store := r.store.(*MemoryStore)
+
+	record := &IdempotencyRecord{
+		Key:         idempotencyRecordKey(ctx, "rotation"),
+		Fingerprint: idempotencyFingerprint("rotate", "id", 0, nil),
+		ID:          "id",
+		ExpiresAt:   4102444800,
+	}
+	store.SetIdempotencyRecord(ctx, record)
+
+	if _, err := r.RotateDataKeyIdempotently(ctx, "rotation", "id", nil); err != (IdempotencyKeyInProgressError{Key: "rotation"}) {
+		t.Fatalf("the retry of a request still in progress should have failed, got %v", err)
+	}
+}
+
+func TestIdempotencyNotSupported(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	r.store = &countingStore{Store: r.store}
+
+	if _, err := r.RotateDataKeyIdempotently(context.Background(), "rotation", "id", nil); err != (IdempotencyNotSupportedError{}) {
+		t.Fatalf("an idempotency key should have been refused by a store without idempotency records, got %v", err)
+	}
+}
+
+func TestReservedIDsAreRejected(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	id := dynamoDBIdempotencyRecordPrefix + "0123"
+	reserved := ReservedIDError{ID: id, Prefix: dynamoDBIdempotencyRecordPrefix}
+
+	if _, err := r.GetDataKey(ctx, id, 0, nil); err != reserved {
+		t.Fatalf("the data key of a reserved id shouldn't have been read, got %v", err)
+	}
+	if _, err := r.CreateDataKey(ctx, id, 0, nil); err != reserved {
+		t.Fatalf("the data key of a reserved id shouldn't have been created, got %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	getKey(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/key?id="+url.QueryEscape(id), nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("a request of a reserved id should have been a bad request, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// the ways an import handles the ids the store already has, deleted or not
+const (
+	ImportConflictSkip      = "skip"
+	ImportConflictOverwrite = "overwrite"
+	ImportConflictFail      = "fail"
+)
+
+// MaxNumberOfImportTries is the number of attempts to overwrite an id updated concurrently
+const MaxNumberOfImportTries = 3
+
+// MaxImportLineSize is the size of the longest line of an export an import reads
+const MaxImportLineSize = 16 * 1024 * 1024
+
+// ImportConflictError is returned when an import meets an id the store already has, on the fail conflict handling
+type ImportConflictError struct {
+	ID string
+}
+
+func (e ImportConflictError) Error() string {
+	return fmt.Sprintf("id %q already exists in the store", e.ID)
+}
+
+// ImportSourceFactory opens the reader of an import from the source of the given URL, e.g. s3://bucket/key
+type ImportSourceFactory func(ctx context.Context, source string, config *Configuration) (io.ReadCloser, error)
+
+var importSourceFactories = make(map[string]ImportSourceFactory)
+
+// RegisterImportSource makes the import sources of the given URL scheme available to `rkms import`.
+// It is meant to be called from the init function of the file implementing the source.
+func RegisterImportSource(scheme string, factory ImportSourceFactory) {
+	if factory == nil {
+		panic("RegisterImportSource: factory is nil")
+	}
+
+	if _, exists := importSourceFactories[scheme]; exists {
+		panic(fmt.Sprintf("RegisterImportSource: import source %q is registered twice", scheme))
+	}
+
+	importSourceFactories[scheme] = factory
+}
+
+// openImportSource opens the reader of an import from the given source: - for the standard input, a URL of a
+// registered scheme (e.g. s3://bucket/key) or the path of a file
+func openImportSource(ctx context.Context, source string, config *Configuration) (io.ReadCloser, error) {
+	if source == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+
+	if i := strings.Index(source, "://"); i > 0 {
+		factory, ok := importSourceFactories[source[:i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown import source %q, the binary may have to be built with -tags %s", source, source[:i])
+		}
+		return factory(ctx, source, config)
+	}
+
+	return os.Open(source)
+}
+
+// importResult counts what an import did with the ids it read
+type importResult struct {
+	Imported int
+	Skipped  int
+	Failed   int
+}
+
+// importEncryptedDataKeys writes the ids of an export read from reader into the store of r, the ids the store already
+// has being skipped, overwritten or failing the import as onConflict sets. With the export key the export was made
+// with, the data keys are decrypted with it and encrypted again with the keys of the regions of r, e.g. for the
+// store of another account, the ids that fail to being counted as failed.
+func importEncryptedDataKeys(ctx context.Context, r *RKMS, reader io.Reader, onConflict string, key *exportKey) (importResult, error) {
+	var result importResult
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxImportLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var item exportedItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil || item.ID == "" || len(item.EncryptedDataKeys) == 0 {
+			return result, fmt.Errorf("line %d is not an id of an export", line)
+		}
+
+		encryptedDataKeys := item.EncryptedDataKeys
+		if key != nil {
+			var err error
+			if encryptedDataKeys, err = r.unwrapFromExportKey(ctx, &item, key); err != nil {
+				if ctx.Err() != nil {
+					return result, err
+				}
+
+				logger.WithField("id", item.ID).Errorf("failed to encrypt the data key with the keys of the regions: %s", err)
+				result.Failed++
+				continue
+			}
+		}
+
+		imported, err := r.importID(ctx, item.ID, encryptedDataKeys, onConflict)
+		if err != nil {
+			if _, ok := err.(ImportConflictError); ok || ctx.Err() != nil {
+				return result, err
+			}
+
+			logger.WithField("id", item.ID).Errorf("failed to import the id: %s", err)
+			result.Failed++
+			continue
+		}
+
+		if imported {
+			result.Imported++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read the export: %s", err)
+	}
+	return result, nil
+}
+
+// importID saves the encrypted data keys of id in the store, telling if they were saved or skipped as the id exists
+func (r *RKMS) importID(ctx context.Context, id string, encryptedDataKeys map[string]string, onConflict string) (bool, error) {
+	if err := checkReservedID(id); err != nil {
+		return false, err
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfImportTries; i++ {
+		err = r.retryStore(ctx, "set", false, func(ctx context.Context) error {
+			return r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
+		})
+		if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+			return err == nil, err
+		}
+
+		switch onConflict {
+		case ImportConflictSkip:
+			return false, nil
+		case ImportConflictFail:
+			return false, ImportConflictError{ID: id}
+		}
+
+		var existing map[string]string
+		var version int64
+		err = r.retryStore(ctx, "get", true, func(ctx context.Context) (err error) {
+			existing, version, err = r.store.GetVersionedEncryptedDataKeys(ctx, id)
+			return err
+		})
+		if _, ok := err.(IDDeletedStoreError); ok {
+			//a deleted id is restored to be overwritten, rather than waiting for its purge
+			if err = r.store.RestoreEncryptedDataKeys(ctx, id); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if existing == nil {
+			//purged or expired since, set again
+			continue
+		}
+
+		err = r.retryStore(ctx, "update", false, func(ctx context.Context) error {
+			return r.store.UpdateEncryptedDataKeys(ctx, id, encryptedDataKeys, version)
+		})
+		if _, ok := err.(VersionMismatchStoreError); ok {
+			logger.Debugf("id %q was updated while being imported, retrying", id)
+			continue
+		}
+		return err == nil, err
+	}
+
+	return false, err
+}
+
+// unwrapFromExportKey decrypts every version of the data key of the item with the export key and encrypts it with
+// the keys of the regions of r, returning the encrypted data keys to save, with the metadata entries of the item
+func (r *RKMS) unwrapFromExportKey(ctx context.Context, item *exportedItem, key *exportKey) (map[string]string, error) {
+	if item.ExportKeyID != key.ID {
+		return nil, fmt.Errorf("the data key was exported with the export key %q rather than %q", item.ExportKeyID, key.ID)
+	}
+
+	encryptionContext, err := storedEncryptionContext(item.EncryptedDataKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := splitDataKeyVersions(item.EncryptedDataKeys)
+	rewrapped := make(map[int64]map[string]string, len(versions))
+	for version := range versions {
+		ciphertext, err := base64.StdEncoding.DecodeString(item.ExportedDataKeys[fmt.Sprint(version)])
+		if err != nil || len(ciphertext) == 0 {
+			return nil, fmt.Errorf("version %d of the data key wasn't exported with the export key", version)
+		}
+
+		plaintext, err := key.provider.Decrypt(ctx, ciphertext, encryptionContext)
+		if err != nil {
+			return nil, err
+		}
+
+		plaintextDataKey := secureBytesOf(plaintext)
+		ciphertexts, failedRegions := r.encryptDataKeyVersion(ctx, r.providersFor(item.ID), plaintextDataKey, encryptionContext)
+		plaintextDataKey.Destroy()
+		if len(failedRegions) > 0 {
+			return nil, fmt.Errorf("failed to encrypt version %d of the data key in regions %v", version, failedRegions)
+		}
+		rewrapped[version] = ciphertexts
+	}
+
+	encryptedDataKeys := joinDataKeyVersions(rewrapped)
+	copyMetadataEntries(encryptedDataKeys, item.EncryptedDataKeys)
+	return encryptedDataKeys, nil
+}
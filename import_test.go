@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func exportTestIDs(t *testing.T, r *RKMS, key *exportKey, ids ...string) *bytes.Buffer {
+	ctx := context.Background()
+	for _, id := range ids {
+		if _, err := r.CreateDataKey(ctx, id, 0, EncryptionContext{"tenant": "a"}); err != nil {
+			t.Fatalf("failed to create the data key: %s", err)
+		}
+	}
+
+	var export bytes.Buffer
+	if _, _, err := exportEncryptedDataKeys(ctx, r, &export, key); err != nil {
+		t.Fatalf("failed to export the ids: %s", err)
+	}
+	return &export
+}
+
+func TestImportEncryptedDataKeys(t *testing.T) {
+	source := getEnvelopeRKMS(t)
+	export := exportTestIDs(t, source, nil, "id-0", "id-1")
+
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	existing, err := r.CreateDataKey(ctx, "id-1", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	if _, err := importEncryptedDataKeys(ctx, r, bytes.NewReader(export.Bytes()), ImportConflictFail, nil); err != (ImportConflictError{ID: "id-1"}) {
+		t.Fatalf("the import should have failed on the existing id, got %v", err)
+	}
+
+	result, err := importEncryptedDataKeys(ctx, r, bytes.NewReader(export.Bytes()), ImportConflictSkip, nil)
+	if err != nil || result != (importResult{Skipped: 2}) {
+		t.Fatalf("the existing ids should have been skipped, got %+v: %v", result, err)
+	}
+	if dataKey, err := r.GetDataKey(ctx, "id-1", 0, nil); err != nil || !dataKey.Plaintext.Equal(existing.Plaintext) {
+		t.Fatalf("the skipped id should have been kept as it was, got %v", err)
+	}
+
+	result, err = importEncryptedDataKeys(ctx, r, bytes.NewReader(export.Bytes()), ImportConflictOverwrite, nil)
+	if err != nil || result != (importResult{Imported: 2}) {
+		t.Fatalf("the existing id should have been overwritten, got %+v: %v", result, err)
+	}
+
+	for _, id := range []string{"id-0", "id-1"} {
+		imported, err := r.GetDataKey(ctx, id, 0, EncryptionContext{"tenant": "a"})
+		if err != nil {
+			t.Fatalf("the imported id %s should have been served: %s", id, err)
+		}
+		if exported, _ := source.GetDataKey(ctx, id, 0, EncryptionContext{"tenant": "a"}); !exported.Plaintext.Equal(imported.Plaintext) {
+			t.Fatalf("the data key of %s should have been imported as it was exported", id)
+		}
+	}
+
+	if _, err := importEncryptedDataKeys(ctx, r, strings.NewReader("{\"id\": \"id\"}\n"), ImportConflictFail, nil); err == nil {
+		t.Fatalf("a line without encrypted data keys should have been refused")
+	}
+}
+
+func TestImportWithExportKey(t *testing.T) {
+	t.Setenv("RKMS_TEST_EXPORT_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, LocalMasterKeySize)))
+	key, err := newExportKey("local", "", "env:RKMS_TEST_EXPORT_KEY", KMSConfig{})
+	if err != nil {
+		t.Fatalf("failed to create the export key: %s", err)
+	}
+
+	source := getEnvelopeRKMS(t)
+	export := exportTestIDs(t, source, key, "id")
+
+	//the store of another account, whose regions have keys of their own
+	t.Setenv("RKMS_TEST_OTHER_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, LocalMasterKeySize)))
+	provider, err := NewLocalKeyProvider("env:RKMS_TEST_OTHER_MASTER_KEY")
+	if err != nil {
+		t.Fatalf("failed to create local key provider: %s", err)
+	}
+	r := getEnvelopeRKMS(t)
+	r.providers = map[string]KeyProvider{"local": provider}
+
+	ctx := context.Background()
+	if result, err := importEncryptedDataKeys(ctx, r, export, ImportConflictFail, key); err != nil || result != (importResult{Imported: 1}) {
+		t.Fatalf("the id should have been imported, got %+v: %v", result, err)
+	}
+
+	imported, err := r.GetDataKey(ctx, "id", 0, EncryptionContext{"tenant": "a"})
+	if err != nil {
+		t.Fatalf("the imported data key should have been decrypted with the keys of the regions: %s", err)
+	}
+	if exported, _ := source.GetDataKey(ctx, "id", 0, EncryptionContext{"tenant": "a"}); !exported.Plaintext.Equal(imported.Plaintext) {
+		t.Fatalf("the data key should have been imported as it was exported")
+	}
+	if metadata, err := r.GetKeyMetadata(ctx, "id"); err != nil || metadata.KeySpec != "AES_256" {
+		t.Fatalf("the metadata should have been imported with the data key, got %+v: %v", metadata, err)
+	}
+}
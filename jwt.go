@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTLeeway is the clock skew tolerated when checking the exp and nbf claims of a token
+const JWTLeeway = time.Minute
+
+// JWKSMinRefreshInterval is how often at most the JWKS is read again for a token signed by an unknown key,
+// so that tokens with made up key ids can't have rkms hammer the JWKS URL
+const JWKSMinRefreshInterval = time.Minute
+
+// jwtAlgorithm - a signature algorithm of JWS accepted for the tokens, symmetric and "none" ones never being
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	// curve is nil for RSA algorithms
+	curve elliptic.Curve
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {crypto.SHA256, nil},
+	"RS384": {crypto.SHA384, nil},
+	"RS512": {crypto.SHA512, nil},
+	"ES256": {crypto.SHA256, elliptic.P256()},
+	"ES384": {crypto.SHA384, elliptic.P384()},
+	"ES512": {crypto.SHA512, elliptic.P521()},
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// jwtVerifier verifies the JWT bearer tokens with the public keys of a JWKS, cached by key id and read again
+// every refresh interval, or sooner for a token signed by a key it doesn't know yet
+type jwtVerifier struct {
+	config          JWTConfig
+	client          *http.Client
+	refreshInterval time.Duration
+	mutex           sync.Mutex
+	keys            map[string]crypto.PublicKey
+	fetchedAt       time.Time
+	attemptedAt     time.Time
+}
+
+func newJWTVerifier(config JWTConfig) *jwtVerifier {
+	refreshInterval := time.Duration(config.JWKSRefreshIntervalInMinutes) * time.Minute
+	if refreshInterval <= 0 {
+		refreshInterval = time.Hour
+	}
+	if config.IdentityClaim == "" {
+		config.IdentityClaim = "sub"
+	}
+
+	return &jwtVerifier{
+		config:          config,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: refreshInterval,
+	}
+}
+
+// verify checks the signature and the claims of a token, returning the identity of its identity claim
+func (v *jwtVerifier) verify(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed token header: %s", err)
+	}
+
+	algorithm, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported token algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token signature")
+	}
+
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return "", err
+	}
+
+	h := algorithm.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(algorithm, key, h.Sum(nil), signature) {
+		return "", errors.New("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed token claims: %s", err)
+	}
+	return v.checkClaims(claims, time.Now())
+}
+
+// checkClaims checks the expiry, the issuer and the audience of a token at the given time
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) (string, error) {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", errors.New("the token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(JWTLeeway)) {
+		return "", errors.New("the token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(JWTLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("the token is not valid yet")
+	}
+
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return "", errors.New("the token was issued by another issuer")
+	}
+
+	if v.config.Audience != "" && !jwtAudienceContains(claims["aud"], v.config.Audience) {
+		return "", errors.New("the token was issued for another audience")
+	}
+
+	identity, _ := claims[v.config.IdentityClaim].(string)
+	if identity == "" {
+		return "", fmt.Errorf("the token has no %s claim", v.config.IdentityClaim)
+	}
+	return identity, nil
+}
+
+// jwtAudienceContains tells if the aud claim, a string or an array of strings, contains audience
+func jwtAudienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(algorithm jwtAlgorithm, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	if algorithm.curve == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, algorithm.hash, digest, signature) == nil
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	size := (algorithm.curve.Params().BitSize + 7) / 8
+	if !ok || ecKey.Curve != algorithm.curve || len(signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return ecdsa.Verify(ecKey, digest, r, s)
+}
+
+// key returns the public key of the given key id, reading the JWKS again when it is due or doesn't have it,
+// at most every JWKSMinRefreshInterval
+func (v *jwtVerifier) key(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	key, ok := v.keys[keyID]
+	if ok && time.Since(v.fetchedAt) < v.refreshInterval {
+		return key, nil
+	}
+
+	if time.Since(v.attemptedAt) >= JWKSMinRefreshInterval {
+		v.attemptedAt = time.Now()
+		keys, err := v.fetchKeys(ctx)
+		if err != nil {
+			//the cached keys are kept while the JWKS URL can't be read, rather than failing every request
+			contextLogger(ctx).WithField("jwks_url", v.config.JWKSURL).Errorf("was not able to read the JWKS: %s", err)
+		} else {
+			v.keys, v.fetchedAt = keys, v.attemptedAt
+			key, ok = keys[keyID]
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", keyID)
+	}
+	return key, nil
+}
+
+// fetchKeys reads the RSA and EC signature keys of the JWKS
+func (v *jwtVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", k.KeyID, err)
+		}
+		if key != nil {
+			keys[k.KeyID] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of an RSA or EC JWK, nil for other key types
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		curve, ok := jwkCurves[k.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	}
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testJWKS struct {
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int32
+	server  *httptest.Server
+}
+
+// newTestJWKS serves the JWKS of an RSA key ("rsa") and a P-256 key ("ec") generated for the test
+func newTestJWKS(t *testing.T) *testJWKS {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("was not able to generate a key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("was not able to generate a key: %s", err)
+	}
+
+	jwks := &testJWKS{rsaKey: rsaKey, ecKey: ecKey}
+	encode := base64.RawURLEncoding.EncodeToString
+	point, _ := ecKey.PublicKey.Bytes()
+	keys := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(point[1:33]), "y": encode(point[33:])},
+	}}
+
+	jwks.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&jwks.fetches, 1)
+		json.NewEncoder(w).Encode(keys)
+	}))
+	t.Cleanup(jwks.server.Close)
+	return jwks
+}
+
+// sign returns a token of the given claims, signed by the key of the given key id with the given algorithm
+func (j *testJWKS) sign(t *testing.T, algorithm string, keyID string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch algorithm {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, j.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, j.ecKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatalf("was not able to sign the token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(subject string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": subject,
+		"iss": "https://issuer.example.com",
+		"aud": []string{"rkms", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	jwks := newTestJWKS(t)
+	verifier := newJWTVerifier(JWTConfig{JWKSURL: jwks.server.URL, Issuer: "https://issuer.example.com", Audience: "rkms"})
+	ctx := context.Background()
+
+	for _, algorithm := range []string{"RS256", "ES256"} {
+		keyID := map[string]string{"RS256": "rsa", "ES256": "ec"}[algorithm]
+		identity, err := verifier.verify(ctx, jwks.sign(t, algorithm, keyID, testClaims("billing")))
+		if err != nil || identity != "billing" {
+			t.Fatalf("a valid %s token should have been verified, got %q, %v", algorithm, identity, err)
+		}
+	}
+
+	token := jwks.sign(t, "RS256", "rsa", testClaims("billing"))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(testClaims("admin"))
+	if _, err := verifier.verify(ctx, parts[0]+"."+base64.RawURLEncoding.EncodeToString(forged)+"."+parts[2]); err == nil {
+		t.Fatalf("a token with forged claims shouldn't have been verified")
+	}
+
+	none, _ := json.Marshal(map[string]string{"alg": "none"})
+	if _, err := verifier.verify(ctx, base64.RawURLEncoding.EncodeToString(none)+"."+parts[1]+"."); err == nil {
+		t.Fatalf("an unsigned token shouldn't have been verified")
+	}
+
+	if _, err := verifier.verify(ctx, jwks.sign(t, "ES256", "rsa", testClaims("billing"))); err == nil {
+		t.Fatalf("a token signed with an algorithm not matching its key shouldn't have been verified")
+	}
+
+	if fetches := atomic.LoadInt32(&jwks.fetches); fetches != 1 {
+		t.Fatalf("the JWKS should have been read once, read %d times", fetches)
+	}
+
+	if _, err := verifier.verify(ctx, jwks.sign(t, "RS256", "unknown", testClaims("billing"))); err == nil {
+		t.Fatalf("a token signed by an unknown key shouldn't have been verified")
+	}
+	if fetches := atomic.LoadInt32(&jwks.fetches); fetches != 1 {
+		t.Fatalf("the JWKS shouldn't have been read again so soon for an unknown key, read %d times", fetches)
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	verifier := newJWTVerifier(JWTConfig{Issuer: "https://issuer.example.com", Audience: "rkms"})
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+		valid bool
+	}{
+		{"valid", "sub", "billing", true},
+		{"expired within the leeway", "exp", now.Add(-30 * time.Second).Unix(), true},
+		{"expired", "exp", now.Add(-time.Hour).Unix(), false},
+		{"without expiry", "exp", nil, false},
+		{"not valid yet", "nbf", now.Add(time.Hour).Unix(), false},
+		{"other issuer", "iss", "https://other.example.com", false},
+		{"single audience", "aud", "rkms", true},
+		{"other audience", "aud", []string{"other"}, false},
+		{"without subject", "sub", nil, false},
+	}
+
+	for _, test := range tests {
+		claims := testClaims("billing")
+		claims[test.claim] = test.value
+		if test.value == nil {
+			delete(claims, test.claim)
+		}
+
+		//the claims go through JSON like the ones of a token
+		b, _ := json.Marshal(claims)
+		var decoded map[string]interface{}
+		json.Unmarshal(b, &decoded)
+
+		if _, err := verifier.checkClaims(decoded, now); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
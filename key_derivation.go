@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+)
+
+// the bounds of the sub-keys derived from a data key, and of the info they are derived for
+const (
+	MinDerivedKeySizeInBytes = 16
+	MaxDerivedKeySizeInBytes = 64
+	MaxDerivationInfoLength  = 256
+)
+
+// DefaultDerivedKeySizeInBytes is the size of the sub-keys derived without one
+const DefaultDerivedKeySizeInBytes = 32
+
+// InvalidDerivationError is returned when a sub-key is requested for an info, a salt or a size out of their bounds
+type InvalidDerivationError struct {
+	Reason string
+}
+
+func (e InvalidDerivationError) Error() string {
+	return "invalid key derivation: " + e.Reason
+}
+
+// checkDerivation verifies a sub-key is requested for an info and a size within their bounds
+func checkDerivation(info string, sizeInBytes int) error {
+	if info == "" || len(info) > MaxDerivationInfoLength {
+		return InvalidDerivationError{fmt.Sprintf("the info must be of 1 to %d characters", MaxDerivationInfoLength)}
+	}
+	if sizeInBytes < MinDerivedKeySizeInBytes || sizeInBytes > MaxDerivedKeySizeInBytes {
+		return InvalidDerivationError{fmt.Sprintf("the size must be of %d to %d bytes", MinDerivedKeySizeInBytes, MaxDerivedKeySizeInBytes)}
+	}
+	return nil
+}
+
+// DeriveDataKey derives a sub-key of the given size from the given version of the data key of id, the latest
+// one for version 0, with HKDF-SHA256 of the info and the salt, empty by default, so that one data key serves
+// purposes isolated from each other, e.g. an "indexing" and an "encryption" key. The same data key, info and salt
+// always derive the same sub-key, which is returned in place of the data key. Like GetDataKey, it generates the
+// data key of an id which has none when the latest version is requested.
+func (r *RKMS) DeriveDataKey(ctx context.Context, id string, version int64, info string, salt []byte, sizeInBytes int, encryptionContext EncryptionContext) (*DataKey, error) {
+	if err := checkDerivation(info, sizeInBytes); err != nil {
+		return nil, err
+	}
+
+	var dataKey *DataKey
+	var err error
+	if version > 0 {
+		dataKey, err = r.GetDataKeyVersion(ctx, id, version, encryptionContext)
+	} else {
+		dataKey, err = r.GetDataKey(ctx, id, 0, encryptionContext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subKey, err := hkdf.Key(sha256.New, dataKey.Plaintext.Bytes(), salt, info, sizeInBytes)
+	dataKey.Destroy()
+	if err != nil {
+		return nil, err
+	}
+
+	derived := *dataKey
+	derived.Plaintext = secureBytesOf(subKey)
+	return &derived, nil
+}
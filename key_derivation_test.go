@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestDeriveDataKey(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+
+	indexing, err := r.DeriveDataKey(ctx, "id", 0, "indexing", nil, DefaultDerivedKeySizeInBytes, nil)
+	if err != nil {
+		t.Fatalf("failed to derive the sub-key: %s", err)
+	}
+
+	dataKey, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil {
+		t.Fatalf("the data key should have been created by the derivation: %s", err)
+	}
+	secret := dataKey.Plaintext.Bytes()
+	expected, _ := hkdf.Key(sha256.New, secret, nil, "indexing", DefaultDerivedKeySizeInBytes)
+	if !bytes.Equal(indexing.Plaintext.Bytes(), expected) || indexing.Version != dataKey.Version {
+		t.Fatalf("the sub-key should have been the HKDF-SHA256 of the data key")
+	}
+
+	again, err := r.DeriveDataKey(ctx, "id", FirstDataKeyVersion, "indexing", nil, DefaultDerivedKeySizeInBytes, nil)
+	if err != nil || !again.Plaintext.Equal(indexing.Plaintext) {
+		t.Fatalf("the derivation should have been deterministic, got %v", err)
+	}
+
+	for _, other := range []struct {
+		info string
+		salt []byte
+	}{{"encryption", nil}, {"indexing", []byte("tenant-a")}} {
+		derived, err := r.DeriveDataKey(ctx, "id", 0, other.info, other.salt, DefaultDerivedKeySizeInBytes, nil)
+		if err != nil || derived.Plaintext.Equal(indexing.Plaintext) || derived.Plaintext.Equal(dataKey.Plaintext) {
+			t.Fatalf("another info or salt should have derived another sub-key, got %v", err)
+		}
+	}
+
+	for _, invalid := range []struct {
+		info string
+		size int
+	}{{"", 32}, {"indexing", 8}, {"indexing", 65}} {
+		if _, err := r.DeriveDataKey(ctx, "id", 0, invalid.info, nil, invalid.size, nil); err == nil {
+			t.Fatalf("%+v should have failed", invalid)
+		} else if _, ok := err.(InvalidDerivationError); !ok {
+			t.Fatalf("%+v should have failed with InvalidDerivationError, got %v", invalid, err)
+		}
+	}
+}
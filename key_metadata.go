@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// metadataEntry is the entry of the encrypted data keys the metadata of an id is saved under, like its encryption
+// context, so that every store keeps it without knowing about it
+const metadataEntry = dataKeyVersionSeparator + "metadata"
+
+// the bounds of the labels of an id
+const (
+	MaxLabels           = 50
+	MaxLabelKeyLength   = 128
+	MaxLabelValueLength = 256
+)
+
+// DefaultListKeysLimit is the page size of ListKeyMetadata when no limit is given
+const DefaultListKeysLimit = 100
+
+// KeyMetadata - the metadata of the data key of an id: when and by which identity it was created, the labels it was
+// given, the spec of its data key and its lifecycle state, along with its latest version. The ids created before
+// their metadata was saved have a zero CreatedAt and no CreatedBy nor KeySpec. DeletionDate is the time the data key
+// is deleted at while it is pending deletion, the zero time otherwise. RotatedAt is the time the latest version was
+// generated at, the zero time until the data key is rotated, and MaxAgeInDays the cryptoperiod of the id, 0 when
+// only the one of the configuration applies.
+type KeyMetadata struct {
+	ID           string
+	CreatedAt    time.Time
+	CreatedBy    string
+	Labels       map[string]string
+	KeySpec      string
+	State        string
+	DeletionDate time.Time
+	RotatedAt    time.Time
+	MaxAgeInDays int
+	Version      int64
+}
+
+// storedMetadata is the metadata entry of the encrypted data keys, the ID and Version of KeyMetadata being those of
+// the entries. CreatedAt, DeletionDate and RotatedAt are unix times, and State is left out for the enabled data keys.
+type storedMetadata struct {
+	CreatedAt    int64             `json:"created_at,omitempty"`
+	CreatedBy    string            `json:"created_by,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	KeySpec      string            `json:"key_spec,omitempty"`
+	State        string            `json:"state,omitempty"`
+	DeletionDate int64             `json:"deletion_date,omitempty"`
+	RotatedAt    int64             `json:"rotated_at,omitempty"`
+	MaxAgeInDays int               `json:"max_age_in_days,omitempty"`
+}
+
+// InvalidLabelsError is returned when the labels given to an id exceed their bounds
+type InvalidLabelsError struct {
+	Reason string
+}
+
+func (e InvalidLabelsError) Error() string {
+	return "invalid labels: " + e.Reason
+}
+
+// keySpec names the data keys of the given size the way KMS does, e.g. AES_256 for the default 32 bytes
+func keySpec(dataKeySizeInBytes int64) string {
+	switch dataKeySizeInBytes {
+	case 16, 24, 32:
+		return fmt.Sprintf("AES_%d", dataKeySizeInBytes*8)
+	}
+	return fmt.Sprintf("BYTES_%d", dataKeySizeInBytes)
+}
+
+// storedKeyMetadata reads the metadata saved with the encrypted data keys of id
+func storedKeyMetadata(id string, encryptedDataKeys map[string]string) (*KeyMetadata, error) {
+	var stored storedMetadata
+	if entry, ok := encryptedDataKeys[metadataEntry]; ok {
+		if err := json.Unmarshal([]byte(entry), &stored); err != nil {
+			return nil, fmt.Errorf("the metadata is corrupted in the store: %s", err)
+		}
+	}
+
+	metadata := &KeyMetadata{
+		ID:           id,
+		CreatedBy:    stored.CreatedBy,
+		Labels:       stored.Labels,
+		KeySpec:      stored.KeySpec,
+		State:        stored.State,
+		MaxAgeInDays: stored.MaxAgeInDays,
+		Version:      latestDataKeyVersion(splitDataKeyVersions(encryptedDataKeys)),
+	}
+	if metadata.State == "" {
+		metadata.State = KeyStateEnabled
+	}
+	if stored.CreatedAt != 0 {
+		metadata.CreatedAt = time.Unix(stored.CreatedAt, 0)
+	}
+	if stored.DeletionDate != 0 {
+		metadata.DeletionDate = time.Unix(stored.DeletionDate, 0)
+	}
+	if stored.RotatedAt != 0 {
+		metadata.RotatedAt = time.Unix(stored.RotatedAt, 0)
+	}
+	if metadata.Labels == nil {
+		metadata.Labels = map[string]string{}
+	}
+	return metadata, nil
+}
+
+// setMetadataEntry saves the given metadata with the encrypted data keys
+func setMetadataEntry(encryptedDataKeys map[string]string, metadata *KeyMetadata) {
+	stored := storedMetadata{CreatedBy: metadata.CreatedBy, Labels: metadata.Labels, KeySpec: metadata.KeySpec, MaxAgeInDays: metadata.MaxAgeInDays}
+	if metadata.State != KeyStateEnabled {
+		stored.State = metadata.State
+	}
+	if !metadata.CreatedAt.IsZero() {
+		stored.CreatedAt = metadata.CreatedAt.Unix()
+	}
+	if !metadata.DeletionDate.IsZero() {
+		stored.DeletionDate = metadata.DeletionDate.Unix()
+	}
+	if !metadata.RotatedAt.IsZero() {
+		stored.RotatedAt = metadata.RotatedAt.Unix()
+	}
+	if len(stored.Labels) == 0 {
+		stored.Labels = nil
+	}
+	b, _ := json.Marshal(stored)
+	encryptedDataKeys[metadataEntry] = string(b)
+}
+
+// copyMetadataEntries copies the metadata entries of the encrypted data keys from to the ones rebuilt out of them
+func copyMetadataEntries(to map[string]string, from map[string]string) {
+	for entry, value := range from {
+		if isMetadataEntry(entry) {
+			to[entry] = value
+		}
+	}
+}
+
+// checkLabels verifies the labels given to an id are within their bounds
+func checkLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return InvalidLabelsError{fmt.Sprintf("an id can't have more than %d labels", MaxLabels)}
+	}
+
+	for key, value := range labels {
+		if key == "" || len(key) > MaxLabelKeyLength {
+			return InvalidLabelsError{fmt.Sprintf("the keys of the labels must have from 1 to %d characters", MaxLabelKeyLength)}
+		}
+		if len(value) > MaxLabelValueLength {
+			return InvalidLabelsError{fmt.Sprintf("the values of the labels can't be longer than %d characters", MaxLabelValueLength)}
+		}
+	}
+	return nil
+}
+
+// hasLabels tells if the metadata has every one of the given labels
+func (m *KeyMetadata) hasLabels(labels map[string]string) bool {
+	for key, value := range labels {
+		if label, ok := m.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// GetKeyMetadata retrieves the metadata of the data key of the given id, which doesn't need its encryption context
+func (r *RKMS) GetKeyMetadata(ctx context.Context, id string) (*KeyMetadata, error) {
+	ctx = withLogID(ctx, id)
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	encryptedDataKeys, _, err := r.getEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptedDataKeys == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+	return storedKeyMetadata(id, encryptedDataKeys)
+}
+
+// SetKeyLabels replaces the labels of the data key of the given id, returning its updated metadata
+func (r *RKMS) SetKeyLabels(ctx context.Context, id string, labels map[string]string) (*KeyMetadata, error) {
+	if err := checkLabels(labels); err != nil {
+		return nil, err
+	}
+
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		metadata.Labels = labels
+		return nil
+	})
+}
+
+// updateKeyMetadata saves the metadata of the data key of the given id as update changes it, update failing leaving
+// it as it was. It is updated again when the id is updated at the same time.
+func (r *RKMS) updateKeyMetadata(ctx context.Context, id string, update func(metadata *KeyMetadata) error) (*KeyMetadata, error) {
+	ctx = withLogID(ctx, id)
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for i := 0; i < MaxNumberOfGetPlaintextDataKeyTries; i++ {
+		var encryptedDataKeys map[string]string
+		var storeVersion int64
+		err = r.retryStore(ctx, "get", true, func(ctx context.Context) (err error) {
+			encryptedDataKeys, storeVersion, err = r.store.GetVersionedEncryptedDataKeys(ctx, id)
+			return err
+		})
+		if err != nil {
+			contextLogger(ctx).Error(err)
+			return nil, err
+		}
+
+		if encryptedDataKeys == nil {
+			return nil, IDNotFoundStoreError{ID: id}
+		}
+
+		var metadata *KeyMetadata
+		if metadata, err = storedKeyMetadata(id, encryptedDataKeys); err != nil {
+			return nil, err
+		}
+		if err = update(metadata); err != nil {
+			return nil, err
+		}
+		setMetadataEntry(encryptedDataKeys, metadata)
+
+		err = r.retryStore(ctx, "update", false, func(ctx context.Context) error {
+			return r.store.UpdateEncryptedDataKeys(ctx, id, encryptedDataKeys, storeVersion)
+		})
+		if _, ok := err.(VersionMismatchStoreError); ok {
+			contextLogger(ctx).Debugf("id %q was updated while its metadata was, retrying", id)
+			continue
+		}
+
+		if err != nil {
+			contextLogger(ctx).Errorf("failed to save the metadata in key/value store: %s", err)
+			return nil, err
+		}
+		return metadata, nil
+	}
+
+	return nil, err
+}
+
+// ListKeyMetadata returns the metadata of the ids of a page of up to limit ids of the store that have every one of
+// the given labels, the ids the caller isn't permitted being left out. The page starts after cursor, "" being the
+// beginning, and the returned cursor is the one of the next page, "" after the last page. As the labels are filtered
+// out of the pages of the store, a page may hold fewer than limit ids, or none, before the last one.
+func (r *RKMS) ListKeyMetadata(ctx context.Context, labels map[string]string, cursor string, limit int) ([]*KeyMetadata, string, error) {
+	if limit <= 0 {
+		limit = DefaultListKeysLimit
+	}
+
+	var ids []string
+	var next string
+	err := r.retryStore(ctx, "list", true, func(ctx context.Context) (err error) {
+		ids, next, err = r.store.ListIDs(ctx, cursor, limit)
+		return err
+	})
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to list the ids of the key/value store: %s", err)
+		return nil, "", err
+	}
+
+	permitted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if authorizeID(ctx, id) == nil {
+			permitted = append(permitted, id)
+		}
+	}
+
+	stored := r.getEncryptedDataKeysBatch(ctx, permitted)
+	metadata := make([]*KeyMetadata, 0, len(stored))
+	for _, id := range permitted {
+		encryptedDataKeys, ok := stored[id]
+		if !ok {
+			continue
+		}
+
+		idMetadata, err := storedKeyMetadata(id, encryptedDataKeys)
+		if err != nil {
+			contextLogger(withLogID(ctx, id)).Warn(err)
+			continue
+		}
+		if idMetadata.hasLabels(labels) {
+			metadata = append(metadata, idMetadata)
+		}
+	}
+	return metadata, next, nil
+}
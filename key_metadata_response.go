@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type setKeyLabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+type setKeyCryptoperiodRequest struct {
+	MaxAgeInDays int `json:"max_age_in_days"`
+}
+
+type keyMetadataResponse struct {
+	ID           string            `json:"id"`
+	CreatedAt    int64             `json:"created_at,omitempty"`
+	CreatedBy    string            `json:"created_by,omitempty"`
+	Labels       map[string]string `json:"labels"`
+	KeySpec      string            `json:"key_spec,omitempty"`
+	State        string            `json:"state"`
+	DeletionDate int64             `json:"deletion_date,omitempty"`
+	RotatedAt    int64             `json:"rotated_at,omitempty"`
+	MaxAgeInDays int               `json:"max_age_in_days,omitempty"`
+	Version      int64             `json:"version"`
+}
+
+type listKeysResponse struct {
+	Keys   []keyMetadataResponse `json:"keys"`
+	Cursor string                `json:"cursor,omitempty"`
+}
+
+func newKeyMetadataResponse(metadata *KeyMetadata) keyMetadataResponse {
+	resp := keyMetadataResponse{ID: metadata.ID, CreatedBy: metadata.CreatedBy, Labels: metadata.Labels, KeySpec: metadata.KeySpec, State: metadata.State, MaxAgeInDays: metadata.MaxAgeInDays, Version: metadata.Version}
+	if !metadata.CreatedAt.IsZero() {
+		resp.CreatedAt = metadata.CreatedAt.Unix()
+	}
+	if !metadata.DeletionDate.IsZero() {
+		resp.DeletionDate = metadata.DeletionDate.Unix()
+	}
+	if !metadata.RotatedAt.IsZero() {
+		resp.RotatedAt = metadata.RotatedAt.Unix()
+	}
+	return resp
+}
+
+// ConstructKeyMetadataResponse creates a server response for GET /keys/{id}/metadata and the endpoints changing the
+// metadata of a key. created_at is the unix time the key was created at, left out with created_by and key_spec for
+// the keys created before their metadata was saved, deletion_date the unix time a key pending deletion is deleted at,
+// and rotated_at the unix time its latest version was generated at, left out until it is rotated.
+func ConstructKeyMetadataResponse(metadata *KeyMetadata) string {
+	b, _ := json.Marshal(newKeyMetadataResponse(metadata))
+	return string(b)
+}
+
+// ConstructListKeysResponse creates a server response for GET /keys endpoint, cursor being left out after the last page
+func ConstructListKeysResponse(metadata []*KeyMetadata, cursor string) string {
+	resp := listKeysResponse{Keys: make([]keyMetadataResponse, 0, len(metadata)), Cursor: cursor}
+	for _, idMetadata := range metadata {
+		resp.Keys = append(resp.Keys, newKeyMetadataResponse(idMetadata))
+	}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyMetadataOfNewID(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	a, err := NewAuthenticator(AuthConfig{
+		APIKeys:     []APIKeyConfig{{Identity: "billing", KeySHA256: apiKeySHA256("secret")}},
+		Permissions: []PermissionConfig{{Identity: "billing", Operations: []string{OperationAll}}},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	ctx := withCaller(context.Background(), a, "billing", OperationGetKeys)
+
+	before := time.Now().Add(-time.Second)
+	if _, err := r.GetDataKey(ctx, "id", 0, EncryptionContext{"tenant": "a"}); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	metadata, err := r.GetKeyMetadata(ctx, "id")
+	if err != nil || metadata.CreatedBy != "billing" || metadata.KeySpec != "AES_256" || metadata.Version != FirstDataKeyVersion || metadata.CreatedAt.Before(before) {
+		t.Fatalf("the metadata of the new id should have been saved with it, got %+v: %v", metadata, err)
+	}
+
+	if _, err := r.GetKeyMetadata(ctx, "missing"); err != (IDNotFoundStoreError{ID: "missing"}) {
+		t.Fatalf("a missing id should have failed with IDNotFoundStoreError, got %v", err)
+	}
+}
+
+func TestKeyLabelsAreKeptByRotations(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	if _, err := r.CreateDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	if _, err := r.SetKeyLabels(ctx, "id", map[string]string{"team": "billing"}); err != nil {
+		t.Fatalf("failed to set the labels: %s", err)
+	}
+	if _, err := r.RotateDataKey(ctx, "id", nil); err != nil {
+		t.Fatalf("failed to rotate the data key: %s", err)
+	}
+
+	metadata, err := r.GetKeyMetadata(ctx, "id")
+	if err != nil || metadata.Labels["team"] != "billing" || metadata.Version != 2 || metadata.KeySpec != "AES_256" {
+		t.Fatalf("the rotation should have kept the metadata, got %+v: %v", metadata, err)
+	}
+
+	if _, err := r.SetKeyLabels(ctx, "id", map[string]string{"": "empty"}); err == nil {
+		t.Fatalf("a label without key should have been refused")
+	}
+}
+
+func TestListKeyMetadataByLabels(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	for id, team := range map[string]string{"id-0": "billing", "id-1": "search", "id-2": "billing"} {
+		if _, err := r.CreateDataKey(ctx, id, 0, nil); err != nil {
+			t.Fatalf("failed to create the data key: %s", err)
+		}
+		if _, err := r.SetKeyLabels(ctx, id, map[string]string{"team": team}); err != nil {
+			t.Fatalf("failed to set the labels: %s", err)
+		}
+	}
+
+	metadata, cursor, err := r.ListKeyMetadata(ctx, map[string]string{"team": "billing"}, "", 0)
+	if err != nil || cursor != "" || len(metadata) != 2 || metadata[0].ID != "id-0" || metadata[1].ID != "id-2" {
+		t.Fatalf("the ids labelled team=billing should have been listed, got %v: %v", metadata, err)
+	}
+
+	metadata, cursor, err = r.ListKeyMetadata(ctx, nil, "", 2)
+	if err != nil || cursor == "" || len(metadata) != 2 {
+		t.Fatalf("a page of every id should have been listed, got %v with cursor %q: %v", metadata, cursor, err)
+	}
+}
+
+func TestRouteKeys(t *testing.T) {
+	var routed string
+	var deleted string
+	handler := routeKeys(func(w http.ResponseWriter, r *http.Request) { deleted = r.URL.Path }, map[string]http.HandlerFunc{
+		"rotate": func(w http.ResponseWriter, r *http.Request) { routed = keyPathID(r) },
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/keys/team-a/id/rotate", nil))
+	if routed != "team-a/id" {
+		t.Fatalf("the request should have been routed with the id of its path, got %q", routed)
+	}
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/v1/keys/team-a/id/rotate", nil))
+	if deleted != "/api/v1/keys/team-a/id/rotate" {
+		t.Fatalf("a DELETE should have been routed to the deletion of the key, got %q", deleted)
+	}
+
+	for _, path := range []string{"/api/v1/keys/rotate", "/api/v1/keys/id/unknown"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s should have answered 404, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultKeyProviderType is the key provider used for the regions that don't select one
+const DefaultKeyProviderType = "aws"
+
+// KeyProvider - wraps and unwraps data keys with the key of one region of the redundancy set.
+// Ciphertexts are only ever decrypted by the provider of the region that encrypted them.
+//
+// Data keys are wrapped under an encryption context, which has to be the same to unwrap them.
+// Providers bind it to the ciphertext cryptographically when their service supports it.
+// The plaintexts they return are copied into SecureBytes and zeroed, so they must not share their memory.
+type KeyProvider interface {
+	// GenerateDataKey creates a new data key of the given size, returned in plaintext and wrapped
+	GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) (plaintext []byte, ciphertext []byte, err error)
+
+	// Encrypt wraps the given data key
+	Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error)
+
+	// Decrypt unwraps a data key wrapped by Encrypt or GenerateDataKey under the same encryption context
+	Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error)
+
+	// DescribeKey tells about the wrapping key, e.g. to check it is usable
+	DescribeKey(ctx context.Context) (*KeyDescription, error)
+}
+
+// EncryptionContext - the key/value pairs a data key is bound to, e.g. what the key encrypts. Empty for no context.
+type EncryptionContext map[string]string
+
+// AAD returns the canonical encoding of the encryption context, for the providers that bind it
+// as additional authenticated data. It is nil for an empty context.
+func (c EncryptionContext) AAD() []byte {
+	if len(c) == 0 {
+		return nil
+	}
+
+	//maps are marshalled with sorted keys
+	aad, _ := json.Marshal(map[string]string(c))
+	return aad
+}
+
+// KeyDescription - what a KeyProvider knows about its wrapping key
+type KeyDescription struct {
+	ID      string
+	Enabled bool
+}
+
+// KeyProviderFactory creates the KeyProvider of a region, wrapping with the key keyID
+type KeyProviderFactory func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error)
+
+var keyProviderFactories = make(map[string]KeyProviderFactory)
+
+// RegisterKeyProvider makes a KeyProvider implementation selectable per region through the kms.providers config value.
+// It is meant to be called from the init function of the file implementing the provider.
+func RegisterKeyProvider(providerType string, factory KeyProviderFactory) {
+	if factory == nil {
+		panic("RegisterKeyProvider: factory is nil")
+	}
+
+	if _, exists := keyProviderFactories[providerType]; exists {
+		panic(fmt.Sprintf("RegisterKeyProvider: key provider type %q is registered twice", providerType))
+	}
+
+	keyProviderFactories[providerType] = factory
+}
+
+// RegisteredKeyProviderTypes returns the sorted names of every key provider compiled into the binary
+func RegisteredKeyProviderTypes() []string {
+	providerTypes := make([]string, 0, len(keyProviderFactories))
+	for providerType := range keyProviderFactories {
+		providerTypes = append(providerTypes, providerType)
+	}
+
+	sort.Strings(providerTypes)
+	return providerTypes
+}
+
+// NewKeyProviders creates the KeyProvider of every region, of the type selected for it in kms.providers
+func NewKeyProviders(kmsConfig KMSConfig) (map[string]KeyProvider, error) {
+	providers := make(map[string]KeyProvider, len(kmsConfig.Regions))
+	for _, region := range kmsConfig.Regions {
+		providerType := kmsConfig.Providers[region]
+		if providerType == "" {
+			providerType = DefaultKeyProviderType
+		}
+
+		factory, ok := keyProviderFactories[providerType]
+		if !ok {
+			return nil, fmt.Errorf("unknown key provider type %q for region %s, available key provider types are: %s", providerType, region, strings.Join(RegisteredKeyProviderTypes(), ", "))
+		}
+
+		provider, err := factory(region, *kmsConfig.KeyIds[region], kmsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		providers[region] = provider
+	}
+
+	return providers, nil
+}
+
+// generateDataKey creates a random data key of the given size and wraps it with the provider,
+// for the providers that can't generate data keys themselves
+func generateDataKey(ctx context.Context, provider KeyProvider, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	plaintext := make([]byte, sizeInBytes)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext, err := provider.Encrypt(ctx, plaintext, encryptionContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, ciphertext, nil
+}
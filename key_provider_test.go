@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+type nopKeyProvider struct {
+	KeyProvider
+	keyID string
+}
+
+func TestNewKeyProvidersMixesProviderTypes(t *testing.T) {
+	RegisterKeyProvider("nop-test", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return &nopKeyProvider{keyID: keyID}, nil
+	})
+	defer delete(keyProviderFactories, "nop-test")
+
+	keyIDs := []string{"alias/rkms-us-east-1", "nop-key"}
+	kmsConfig := KMSConfig{
+		Regions:   []string{"us-east-1", "nop-region"},
+		KeyIds:    map[string]*string{"us-east-1": &keyIDs[0], "nop-region": &keyIDs[1]},
+		Providers: map[string]string{"nop-region": "nop-test"},
+	}
+
+	providers, err := NewKeyProviders(kmsConfig)
+	if err != nil {
+		t.Fatalf("failed to create key providers: %s", err)
+	}
+
+	if _, ok := providers["us-east-1"].(*AWSKMSProvider); !ok {
+		t.Fatalf("regions without a provider type should use AWS KMS, got: %T", providers["us-east-1"])
+	}
+
+	if provider, ok := providers["nop-region"].(*nopKeyProvider); !ok || provider.keyID != "nop-key" {
+		t.Fatalf("the registered provider should have been created with the region's key, got: %T", providers["nop-region"])
+	}
+}
+
+func TestNewKeyProvidersUnknownType(t *testing.T) {
+	keyID := "key"
+	kmsConfig := KMSConfig{
+		Regions:   []string{"region-0"},
+		KeyIds:    map[string]*string{"region-0": &keyID},
+		Providers: map[string]string{"region-0": "does-not-exist"},
+	}
+
+	if _, err := NewKeyProviders(kmsConfig); err == nil {
+		t.Fatalf("should not have created a key provider for an unknown type")
+	}
+}
+
+func TestAWSKMSEndpoints(t *testing.T) {
+	keyIDs := []string{"alias/rkms-0", "alias/rkms-1", "alias/rkms-2"}
+	kmsConfig := KMSConfig{
+		Regions:          []string{"us-gov-west-1", "us-east-1", "local-region"},
+		KeyIds:           map[string]*string{"us-gov-west-1": &keyIDs[0], "us-east-1": &keyIDs[1], "local-region": &keyIDs[2]},
+		Providers:        map[string]string{"local-region": "local"},
+		Endpoints:        map[string]string{"us-east-1": "https://vpce-0123456789abcdef0-abcdefgh.kms.us-east-1.vpce.amazonaws.com"},
+		UseFIPSEndpoints: true,
+	}
+	if err := verifyKMSConfig(kmsConfig); err != nil {
+		t.Fatalf("the KMS endpoints should have been valid: %s", err)
+	}
+
+	for region, expected := range map[string]string{
+		"us-gov-west-1": "https://kms-fips.us-gov-west-1.amazonaws.com",
+		"us-east-1":     kmsConfig.Endpoints["us-east-1"],
+	} {
+		if endpoint, err := awsKMSEndpoint(kmsConfig, region); err != nil || endpoint != expected {
+			t.Errorf("KMS should have been called on %s in %s, got %q: %v", expected, region, endpoint, err)
+		}
+	}
+
+	provider, err := NewAWSKMSProvider("us-east-1", keyIDs[1], "", kmsConfig.Endpoints["us-east-1"])
+	if err != nil || aws.ToString(provider.client.(*kms.Client).Options().BaseEndpoint) != kmsConfig.Endpoints["us-east-1"] {
+		t.Fatalf("the provider should have called KMS on the endpoint of its region, got %v", err)
+	}
+
+	for _, endpoints := range []map[string]string{
+		{"us-west-2": "https://kms.us-west-2.amazonaws.com"},
+		{"us-east-1": "kms.us-east-1.amazonaws.com"},
+		{"local-region": "https://localhost:8443"},
+	} {
+		kmsConfig.Endpoints = endpoints
+		if err := verifyKMSConfig(kmsConfig); err == nil {
+			t.Errorf("the KMS endpoints %v should have been rejected", endpoints)
+		}
+	}
+
+	kmsConfig.Endpoints = nil
+	kmsConfig.Regions[1] = "cn-north-1"
+	kmsConfig.KeyIds = map[string]*string{"us-gov-west-1": &keyIDs[0], "cn-north-1": &keyIDs[1], "local-region": &keyIDs[2]}
+	if err := verifyKMSConfig(kmsConfig); err == nil {
+		t.Fatalf("a region without a FIPS endpoint should have been rejected")
+	}
+}
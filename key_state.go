@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the lifecycle states of the data key of an id, those of a KMS key: only an enabled data key is served, encrypted
+// with or decrypted, a disabled one can be enabled again, and one pending deletion is deleted once its waiting
+// period is over
+const (
+	KeyStateEnabled         = "enabled"
+	KeyStateDisabled        = "disabled"
+	KeyStatePendingDeletion = "pending_deletion"
+)
+
+// the waiting period of a scheduled deletion, in days, during which the deletion can be cancelled
+const (
+	MinDeletionWaitingPeriodInDays     = 7
+	MaxDeletionWaitingPeriodInDays     = 30
+	DefaultDeletionWaitingPeriodInDays = 30
+)
+
+// KeyStateError is returned when the data key of an id is requested while it isn't enabled
+type KeyStateError struct {
+	ID    string
+	State string
+}
+
+func (e KeyStateError) Error() string {
+	return fmt.Sprintf("the data key of id %s is %s", e.ID, strings.ReplaceAll(e.State, "_", " "))
+}
+
+// KeyStateTransitionError is returned when the data key of an id can't go from its state to the one requested,
+// e.g. when a data key pending deletion is enabled rather than having its deletion cancelled
+type KeyStateTransitionError struct {
+	ID   string
+	From string
+	To   string
+}
+
+func (e KeyStateTransitionError) Error() string {
+	return fmt.Sprintf("the data key of id %s can't go from %s to %s", e.ID, e.From, e.To)
+}
+
+// keyStateTransitions are the states the data key of an id can go to from each state, a data key pending deletion
+// only leaving it by having its deletion cancelled
+var keyStateTransitions = map[string][]string{
+	KeyStateEnabled:  {KeyStateDisabled, KeyStatePendingDeletion},
+	KeyStateDisabled: {KeyStateEnabled, KeyStatePendingDeletion},
+}
+
+// transition moves the metadata to the given state, if its current state can go to it. Going to the current state
+// is not an error.
+func (m *KeyMetadata) transition(state string) error {
+	if m.State == state {
+		return nil
+	}
+
+	for _, next := range keyStateTransitions[m.State] {
+		if next == state {
+			m.State = state
+			return nil
+		}
+	}
+	return KeyStateTransitionError{ID: m.ID, From: m.State, To: state}
+}
+
+// checkKeyState verifies the data key of id is enabled, according to the metadata saved with its encrypted data keys
+func checkKeyState(id string, encryptedDataKeys map[string]string) error {
+	metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+	if err != nil {
+		return err
+	}
+
+	if metadata.State != KeyStateEnabled {
+		return KeyStateError{ID: id, State: metadata.State}
+	}
+	return nil
+}
+
+// DisableKey disables the data key of the given id, until it is enabled again, once approved when disabling is
+// under dual control
+func (r *RKMS) DisableKey(ctx context.Context, id string) (*KeyMetadata, error) {
+	if err := r.requireApproval(ctx, ApprovalActionDisable, id, 0); err != nil {
+		return nil, err
+	}
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		return metadata.transition(KeyStateDisabled)
+	})
+}
+
+// EnableKey enables the data key of the given id again
+func (r *RKMS) EnableKey(ctx context.Context, id string) (*KeyMetadata, error) {
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		return metadata.transition(KeyStateEnabled)
+	})
+}
+
+// ScheduleKeyDeletion schedules the deletion of the data key of the given id once waitingPeriod is over, the data
+// key being pending deletion until then. Scheduling the deletion of a data key already pending deletion leaves its
+// deletion date as it was. The deletion is scheduled once approved when deleting is under dual control.
+func (r *RKMS) ScheduleKeyDeletion(ctx context.Context, id string, waitingPeriod time.Duration) (*KeyMetadata, error) {
+	if err := r.requireApproval(ctx, ApprovalActionDelete, id, waitingPeriod); err != nil {
+		return nil, err
+	}
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		if metadata.State == KeyStatePendingDeletion {
+			return nil
+		}
+
+		if err := metadata.transition(KeyStatePendingDeletion); err != nil {
+			return err
+		}
+		metadata.DeletionDate = time.Now().Add(waitingPeriod).Truncate(time.Second)
+		return nil
+	})
+}
+
+// CancelKeyDeletion cancels the scheduled deletion of the data key of the given id, which is left disabled
+func (r *RKMS) CancelKeyDeletion(ctx context.Context, id string) (*KeyMetadata, error) {
+	return r.updateKeyMetadata(ctx, id, func(metadata *KeyMetadata) error {
+		if metadata.State != KeyStatePendingDeletion {
+			return KeyStateTransitionError{ID: id, From: metadata.State, To: KeyStateDisabled}
+		}
+
+		metadata.State = KeyStateDisabled
+		metadata.DeletionDate = time.Time{}
+		return nil
+	})
+}
+
+// deletionDue tells if the scheduled deletion of the data key of the encrypted data keys is due at now
+func deletionDue(id string, encryptedDataKeys map[string]string, now time.Time) bool {
+	metadata, err := storedKeyMetadata(id, encryptedDataKeys)
+	return err == nil && metadata.State == KeyStatePendingDeletion && !metadata.DeletionDate.After(now)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDisabledKeyIsNotServed(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	wrapped, err := r.GetWrappedDataKey(ctx, "id", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	if metadata, err := r.DisableKey(ctx, "id"); err != nil || metadata.State != KeyStateDisabled {
+		t.Fatalf("failed to disable the data key, got %+v: %v", metadata, err)
+	}
+
+	disabled := KeyStateError{ID: "id", State: KeyStateDisabled}
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != disabled {
+		t.Fatalf("getting a disabled data key should have failed with %v, got %v", disabled, err)
+	}
+	if _, err := r.GetWrappedDataKey(ctx, "id", 0, nil); err != disabled {
+		t.Fatalf("getting the ciphertexts of a disabled data key should have failed with %v, got %v", disabled, err)
+	}
+	region := getTestRegionName(0)
+	if _, _, err := r.DecryptCiphertext(ctx, "id", region, wrapped.Ciphertexts[region], nil); err != disabled {
+		t.Fatalf("decrypting a ciphertext of a disabled data key should have failed with %v, got %v", disabled, err)
+	}
+	if _, err := r.RotateDataKey(ctx, "id", nil); err != disabled {
+		t.Fatalf("rotating a disabled data key should have failed with %v, got %v", disabled, err)
+	}
+
+	if metadata, err := r.GetKeyMetadata(ctx, "id"); err != nil || metadata.State != KeyStateDisabled {
+		t.Fatalf("the metadata of a disabled data key should have been read, got %+v: %v", metadata, err)
+	}
+
+	if _, err := r.EnableKey(ctx, "id"); err != nil {
+		t.Fatalf("failed to enable the data key: %s", err)
+	}
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("the enabled data key should have been served: %s", err)
+	}
+}
+
+func TestKeyStateTransitions(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	if _, err := r.CreateDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	if _, err := r.EnableKey(ctx, "id"); err != nil {
+		t.Fatalf("enabling an enabled data key should have been a no-op: %s", err)
+	}
+
+	if _, err := r.ScheduleKeyDeletion(ctx, "id", time.Hour); err != nil {
+		t.Fatalf("failed to schedule the deletion of the data key: %s", err)
+	}
+
+	transition := KeyStateTransitionError{ID: "id", From: KeyStatePendingDeletion, To: KeyStateEnabled}
+	if _, err := r.EnableKey(ctx, "id"); err != transition {
+		t.Fatalf("enabling a data key pending deletion should have failed with %v, got %v", transition, err)
+	}
+
+	transition = KeyStateTransitionError{ID: "id", From: KeyStatePendingDeletion, To: KeyStateDisabled}
+	if _, err := r.DisableKey(ctx, "id"); err != transition {
+		t.Fatalf("disabling a data key pending deletion should have failed with %v, got %v", transition, err)
+	}
+}
+
+func TestCancelKeyDeletion(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	if _, err := r.CreateDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	scheduled, err := r.ScheduleKeyDeletion(ctx, "id", 7*24*time.Hour)
+	if err != nil || scheduled.State != KeyStatePendingDeletion || scheduled.DeletionDate.IsZero() {
+		t.Fatalf("the deletion of the data key should have been scheduled, got %+v: %v", scheduled, err)
+	}
+
+	//scheduling the deletion again keeps the first deletion date
+	if again, err := r.ScheduleKeyDeletion(ctx, "id", time.Hour); err != nil || !again.DeletionDate.Equal(scheduled.DeletionDate) {
+		t.Fatalf("the deletion date should have been kept, got %+v: %v", again, err)
+	}
+
+	cancelled, err := r.CancelKeyDeletion(ctx, "id")
+	if err != nil || cancelled.State != KeyStateDisabled || !cancelled.DeletionDate.IsZero() {
+		t.Fatalf("the deletion should have been cancelled, leaving the data key disabled, got %+v: %v", cancelled, err)
+	}
+
+	transition := KeyStateTransitionError{ID: "id", From: KeyStateDisabled, To: KeyStateDisabled}
+	if _, err := r.CancelKeyDeletion(ctx, "id"); err != transition {
+		t.Fatalf("cancelling the deletion of a data key not pending deletion should have failed with %v, got %v", transition, err)
+	}
+}
+
+func TestDeleteScheduledKeys(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	ctx := context.Background()
+	for _, id := range []string{"due", "later", "kept"} {
+		if _, err := r.CreateDataKey(ctx, id, 0, nil); err != nil {
+			t.Fatalf("failed to create the data key: %s", err)
+		}
+	}
+	if _, err := r.ScheduleKeyDeletion(ctx, "due", 0); err != nil {
+		t.Fatalf("failed to schedule the deletion of the data key: %s", err)
+	}
+	if _, err := r.ScheduleKeyDeletion(ctx, "later", 7*24*time.Hour); err != nil {
+		t.Fatalf("failed to schedule the deletion of the data key: %s", err)
+	}
+
+	deleted, err := deleteScheduledKeys(ctx, r.store, time.Now().Add(time.Second))
+	if err != nil || deleted != 1 {
+		t.Fatalf("the data key whose deletion is due should have been deleted, got %d: %v", deleted, err)
+	}
+
+	if _, err := r.store.GetEncryptedDataKeys(ctx, "due"); err == nil {
+		t.Fatalf("the data key whose deletion is due should have been deleted")
+	} else if _, ok := err.(IDDeletedStoreError); !ok {
+		t.Fatalf("the data key whose deletion is due should have been deleted, got %v", err)
+	}
+	for _, id := range []string{"later", "kept"} {
+		if keys, err := r.store.GetEncryptedDataKeys(ctx, id); err != nil || keys == nil {
+			t.Fatalf("the data key of %s should have been kept: %v", id, err)
+		}
+	}
+}
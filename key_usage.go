@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+)
+
+// InvalidKeyUsageError is returned when the key of an id is used another way than the one it was created for: the
+// symmetric data key of an id of a data key pair or of an HMAC key, the pair or the HMAC key of an id of another
+// kind of key, or a key of another spec than the one of its id
+type InvalidKeyUsageError struct {
+	ID     string
+	Reason string
+}
+
+func (e InvalidKeyUsageError) Error() string {
+	return fmt.Sprintf("id %s %s", e.ID, e.Reason)
+}
+
+// checkSymmetricDataKey verifies the encrypted data keys of id are those of a symmetric data key, for the private
+// key of a data key pair to only be unwrapped through UnwrapDataKeyPair, and an HMAC key to never leave rkms
+func checkSymmetricDataKey(id string, encryptedDataKeys map[string]string) error {
+	if isDataKeyPair(encryptedDataKeys) {
+		return InvalidKeyUsageError{ID: id, Reason: "has a data key pair, whose private key is unwrapped through the key pair endpoints"}
+	}
+	if isHMACKey(encryptedDataKeys) {
+		return InvalidKeyUsageError{ID: id, Reason: "has an HMAC key, which only generates and verifies MACs"}
+	}
+	return nil
+}
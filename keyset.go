@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keySet - the key providers wrapping the data keys of the ids starting with prefix, e.g. with the CMKs of a
+// business unit, so that their use is logged and governed by key policies of their own
+type keySet struct {
+	prefix    string
+	providers map[string]KeyProvider
+}
+
+// prefix returns the prefix of the ids of the key set, the namespace of its tenant for a tenant key set
+func (c KeySetConfig) prefix() string {
+	if c.Tenant != "" {
+		return c.Tenant + TenantNamespaceSeparator
+	}
+	return c.IDPrefix
+}
+
+// newKeySets creates the providers of every key set of the config, with the key provider types of the regions
+// and the keys of the key set, and its roles in place of the ones of the regions, the longest prefixes first
+func newKeySets(kmsConfig KMSConfig) ([]keySet, error) {
+	keySets := make([]keySet, 0, len(kmsConfig.KeySets))
+	for _, keySetConfig := range kmsConfig.KeySets {
+		config := kmsConfig
+		config.KeyIds = keySetConfig.KeyIds
+		config.RoleARNs = make(map[string]string, len(kmsConfig.RoleARNs)+len(keySetConfig.RoleARNs))
+		for _, roleARNs := range []map[string]string{kmsConfig.RoleARNs, keySetConfig.RoleARNs} {
+			for region, roleARN := range roleARNs {
+				config.RoleARNs[region] = roleARN
+			}
+		}
+		providers, err := NewKeyProviders(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the key providers of the key set of %q: %s", keySetConfig.prefix(), err)
+		}
+		keySets = append(keySets, keySet{keySetConfig.prefix(), providers})
+	}
+
+	sort.SliceStable(keySets, func(i, j int) bool { return len(keySets[i].prefix) > len(keySets[j].prefix) })
+	return keySets, nil
+}
+
+// verifyKeySetTenants checks that the tenants of the key sets are configured, an id of a misspelled tenant being
+// silently wrapped with the default keys otherwise
+func verifyKeySetTenants(kmsConfig KMSConfig, tenants []TenantConfig) error {
+	names := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		names[tenant.Name] = true
+	}
+
+	for _, keySet := range kmsConfig.KeySets {
+		if keySet.Tenant != "" && !names[keySet.Tenant] {
+			return fmt.Errorf("the KMS key set of tenant %q is for a tenant which isn't configured", keySet.Tenant)
+		}
+	}
+	return nil
+}
+
+// providersFor returns the providers wrapping the data keys of id: the ones of the key set with the longest
+// prefix of id, the default ones when no key set is for id
+func (r *RKMS) providersFor(id string) map[string]KeyProvider {
+	for _, keySet := range r.keySets {
+		if strings.HasPrefix(id, keySet.prefix) {
+			return keySet.providers
+		}
+	}
+	return r.providers
+}
+
+// keyProviderSets returns the default providers followed by the ones of every key set
+func (r *RKMS) keyProviderSets() []map[string]KeyProvider {
+	sets := make([]map[string]KeyProvider, 0, len(r.keySets)+1)
+	sets = append(sets, r.providers)
+	for _, keySet := range r.keySets {
+		sets = append(sets, keySet.providers)
+	}
+	return sets
+}
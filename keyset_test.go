@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+func getTestKeySetRKMS(t *testing.T) *RKMS {
+	for i, variable := range []string{"RKMS_TEST_DEFAULT_KEY", "RKMS_TEST_TEAM_A_KEY"} {
+		os.Setenv(variable, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, LocalMasterKeySize)))
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("RKMS_TEST_DEFAULT_KEY")
+		os.Unsetenv("RKMS_TEST_TEAM_A_KEY")
+	})
+
+	defaultKey, teamAKey := "env:RKMS_TEST_DEFAULT_KEY", "env:RKMS_TEST_TEAM_A_KEY"
+	r, err := NewRKMS(KMSConfig{
+		Regions:            []string{"local"},
+		KeyIds:             map[string]*string{"local": &defaultKey},
+		Providers:          map[string]string{"local": "local"},
+		DataKeySizeInBytes: 32,
+		KeySets: []KeySetConfig{
+			{Tenant: "team-a", KeyIds: map[string]*string{"local": &teamAKey}},
+			{IDPrefix: "team-a/shared/", KeyIds: map[string]*string{"local": &defaultKey}},
+		},
+	}, NewMemoryStore(), RetryConfig{})
+	if err != nil {
+		t.Fatalf("was not able to create the RKMS: %s", err)
+	}
+	return r
+}
+
+func TestKeySetProviders(t *testing.T) {
+	r := getTestKeySetRKMS(t)
+	teamAKey, _ := NewLocalKeyProvider("env:RKMS_TEST_TEAM_A_KEY")
+	ctx := context.Background()
+
+	if _, err := r.GetDataKey(ctx, "team-a/user-1", 0, nil); err != nil {
+		t.Fatalf("was not able to create the key of team-a: %s", err)
+	}
+	encryptedDataKeys, _ := r.store.GetEncryptedDataKeys(ctx, "team-a/user-1")
+	ciphertext, _ := base64.StdEncoding.DecodeString(encryptedDataKeys["local"])
+	if _, err := teamAKey.Decrypt(ctx, ciphertext, nil); err != nil {
+		t.Fatalf("the data key of team-a should have been wrapped with the key of its key set: %s", err)
+	}
+
+	if _, err := r.GetDataKey(ctx, "team-a/shared/1", 0, nil); err != nil {
+		t.Fatalf("was not able to create the shared key: %s", err)
+	}
+	encryptedDataKeys, _ = r.store.GetEncryptedDataKeys(ctx, "team-a/shared/1")
+	ciphertext, _ = base64.StdEncoding.DecodeString(encryptedDataKeys["local"])
+	if _, err := teamAKey.Decrypt(ctx, ciphertext, nil); err == nil {
+		t.Fatalf("the key set with the longest prefix should have wrapped the shared key")
+	}
+
+	if r.providersFor("team-ab/user-1")["local"] != r.providers["local"] {
+		t.Fatalf("an id out of the namespace of team-a should use the default keys")
+	}
+}
+
+func TestVerifyKeySetConfig(t *testing.T) {
+	keyIDs := []string{"alias/rkms-0", "alias/rkms-1", "alias/rkms-2"}
+	kmsConfig := KMSConfig{
+		Regions: []string{"region-0", "region-1", "region-2"},
+		KeyIds:  map[string]*string{"region-0": &keyIDs[0], "region-1": &keyIDs[1], "region-2": &keyIDs[2]},
+	}
+
+	keySets := [][]KeySetConfig{
+		{{IDPrefix: "billing/", Tenant: "team-a", KeyIds: kmsConfig.KeyIds}},
+		{{KeyIds: kmsConfig.KeyIds}},
+		{{IDPrefix: "billing/", KeyIds: map[string]*string{"region-0": &keyIDs[0]}}},
+		{{IDPrefix: "team-a/", KeyIds: kmsConfig.KeyIds}, {Tenant: "team-a", KeyIds: kmsConfig.KeyIds}},
+	}
+	for _, keySet := range keySets {
+		kmsConfig.KeySets = keySet
+		if err := verifyKMSConfig(kmsConfig); err == nil {
+			t.Errorf("the key sets %+v should have been rejected", keySet)
+		}
+	}
+
+	kmsConfig.KeySets = []KeySetConfig{{Tenant: "team-a", KeyIds: kmsConfig.KeyIds}}
+	if err := verifyKMSConfig(kmsConfig); err != nil {
+		t.Fatalf("the key set of team-a should have been valid: %s", err)
+	}
+	if err := verifyKeySetTenants(kmsConfig, []TenantConfig{{Name: "team-b"}}); err == nil {
+		t.Fatalf("the key set of a tenant which isn't configured should have been rejected")
+	}
+}
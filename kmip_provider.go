@@ -0,0 +1,322 @@
+//go:build kmip
+// +build kmip
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gemalto/kmip-go"
+	"github.com/gemalto/kmip-go/kmip14"
+	"github.com/gemalto/kmip-go/ttlv"
+)
+
+// kmipGCMNonceSize and kmipGCMTagSize are the AES-GCM parameters data keys are wrapped with
+const (
+	kmipGCMNonceSize = 12
+	kmipGCMTagSize   = 16
+)
+
+// KMIPProvider - a KeyProvider wrapping data keys with a symmetric key of a KMIP key manager
+// (Thales CipherTrust, Fortanix DSM...). The key id is the unique identifier of the key in the key manager,
+// the region is only a name for it in the redundancy set.
+//
+// Data keys are encrypted by the key manager with AES-GCM, the ciphertexts being the nonce,
+// then the authentication tag, then the encrypted key, and the encryption context being the
+// additional authenticated data. Every operation is a request on a new
+// mutually authenticated TLS connection.
+type KMIPProvider struct {
+	address   string
+	tlsConfig *tls.Config
+	version   kmip.ProtocolVersion
+	keyID     string
+}
+
+type kmipEncryptRequestPayload struct {
+	UniqueIdentifier                      string
+	CryptographicParameters               kmip.CryptographicParameters
+	Data                                  []byte
+	IVCounterNonce                        []byte
+	AuthenticatedEncryptionAdditionalData []byte `ttlv:",omitempty"`
+}
+
+type kmipEncryptResponsePayload struct {
+	UniqueIdentifier           string
+	Data                       []byte
+	IVCounterNonce             []byte `ttlv:",omitempty"`
+	AuthenticatedEncryptionTag []byte `ttlv:",omitempty"`
+}
+
+type kmipDecryptRequestPayload struct {
+	UniqueIdentifier                      string
+	CryptographicParameters               kmip.CryptographicParameters
+	Data                                  []byte
+	IVCounterNonce                        []byte
+	AuthenticatedEncryptionAdditionalData []byte `ttlv:",omitempty"`
+	AuthenticatedEncryptionTag            []byte
+}
+
+type kmipDecryptResponsePayload struct {
+	UniqueIdentifier string
+	Data             []byte
+}
+
+type kmipGetAttributesRequestPayload struct {
+	UniqueIdentifier string
+	AttributeName    []string
+}
+
+type kmipGetAttributesResponsePayload struct {
+	UniqueIdentifier string
+	Attribute        []kmip.Attribute
+}
+
+// KMIP 2.0 references the attributes to get by their tag, and returns them in an Attributes structure.
+// kmip14 doesn't register the Attribute Reference (0x42013B) and Attributes (0x420125) tags.
+type kmip20GetAttributesRequestPayload struct {
+	UniqueIdentifier   string
+	AttributeReference []ttlv.Tag `ttlv:"0x42013B,enum"`
+}
+
+type kmip20GetAttributesResponsePayload struct {
+	UniqueIdentifier string
+	Attributes       kmip20Attributes `ttlv:"0x420125"`
+}
+
+type kmip20Attributes struct {
+	State kmip14.State `ttlv:",omitempty"`
+}
+
+func init() {
+	RegisterKeyProvider("kmip", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return NewKMIPProvider(keyID, kmsConfig.KMIP)
+	})
+}
+
+// NewKMIPProvider creates a new KMIPProvider instance for the key with the given unique identifier
+func NewKMIPProvider(keyID string, kmipConfig KMIPConfig) (*KMIPProvider, error) {
+	version := kmip.ProtocolVersion{ProtocolVersionMajor: 1, ProtocolVersionMinor: 4}
+	switch kmipConfig.ProtocolVersion {
+	case "", "1.4":
+	case "2.0":
+		version = kmip.ProtocolVersion{ProtocolVersionMajor: 2, ProtocolVersionMinor: 0}
+	default:
+		return nil, fmt.Errorf("unsupported KMIP protocol version %q, supported versions are 1.4 and 2.0", kmipConfig.ProtocolVersion)
+	}
+
+	//key managers authenticate their clients with certificates
+	kmipConfig.TLS.Enabled = true
+	tlsConfig, err := newClientTLSConfig(kmipConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KMIPProvider{kmipConfig.Address, tlsConfig, version, keyID}, nil
+}
+
+func (p *KMIPProvider) cryptographicParameters() kmip.CryptographicParameters {
+	return kmip.CryptographicParameters{
+		CryptographicAlgorithm: kmip14.CryptographicAlgorithmAES,
+		BlockCipherMode:        kmip14.BlockCipherModeGCM,
+		TagLength:              kmipGCMTagSize,
+	}
+}
+
+// GenerateDataKey creates a new data key of the given size.
+// The data key is generated locally and encrypted, as it has to leave the key manager anyway.
+func (p *KMIPProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with AES-GCM in the key manager
+func (p *KMIPProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	nonce := make([]byte, kmipGCMNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	response := kmipEncryptResponsePayload{}
+	err := p.send(ctx, kmip14.OperationEncrypt, kmipEncryptRequestPayload{
+		UniqueIdentifier:                      p.keyID,
+		CryptographicParameters:               p.cryptographicParameters(),
+		Data:                                  plaintext,
+		IVCounterNonce:                        nonce,
+		AuthenticatedEncryptionAdditionalData: encryptionContext.AAD(),
+	}, &response)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.AuthenticatedEncryptionTag) != kmipGCMTagSize {
+		return nil, fmt.Errorf("KMIP key %s returned a %d bytes authentication tag instead of %d", p.keyID, len(response.AuthenticatedEncryptionTag), kmipGCMTagSize)
+	}
+
+	ciphertext := append(nonce, response.AuthenticatedEncryptionTag...)
+	return append(ciphertext, response.Data...), nil
+}
+
+// Decrypt unwraps the given data key with AES-GCM in the key manager
+func (p *KMIPProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	if len(ciphertext) < kmipGCMNonceSize+kmipGCMTagSize {
+		return nil, fmt.Errorf("the ciphertext is too short to have been encrypted by KMIP key %s", p.keyID)
+	}
+
+	response := kmipDecryptResponsePayload{}
+	err := p.send(ctx, kmip14.OperationDecrypt, kmipDecryptRequestPayload{
+		UniqueIdentifier:                      p.keyID,
+		CryptographicParameters:               p.cryptographicParameters(),
+		IVCounterNonce:                        ciphertext[:kmipGCMNonceSize],
+		AuthenticatedEncryptionTag:            ciphertext[kmipGCMNonceSize : kmipGCMNonceSize+kmipGCMTagSize],
+		AuthenticatedEncryptionAdditionalData: encryptionContext.AAD(),
+		Data:                                  ciphertext[kmipGCMNonceSize+kmipGCMTagSize:],
+	}, &response)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data, nil
+}
+
+// DescribeKey tells about the key, which is enabled as long as it is in the Active state
+func (p *KMIPProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	state, err := p.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyDescription{ID: p.keyID, Enabled: state == kmip14.StateActive}, nil
+}
+
+// state gets the State attribute of the key with the Get Attributes payloads of the configured protocol version
+func (p *KMIPProvider) state(ctx context.Context) (kmip14.State, error) {
+	if p.version.ProtocolVersionMajor >= 2 {
+		response := kmip20GetAttributesResponsePayload{}
+		err := p.send(ctx, kmip14.OperationGetAttributes, kmip20GetAttributesRequestPayload{
+			UniqueIdentifier:   p.keyID,
+			AttributeReference: []ttlv.Tag{kmip14.TagState},
+		}, &response)
+
+		return response.Attributes.State, err
+	}
+
+	response := kmipGetAttributesResponsePayload{}
+	err := p.send(ctx, kmip14.OperationGetAttributes, kmipGetAttributesRequestPayload{
+		UniqueIdentifier: p.keyID,
+		AttributeName:    []string{"State"},
+	}, &response)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return kmipState(response.Attribute), nil
+}
+
+// kmipState finds the State among KMIP 1.x attributes, the zero state when it is missing
+func kmipState(attributes []kmip.Attribute) kmip14.State {
+	for _, attribute := range attributes {
+		if attribute.AttributeName != "State" {
+			continue
+		}
+
+		//an attribute value decodes as a ttlv.EnumValue, the kmip14 enum is only there when it was built locally
+		switch state := attribute.AttributeValue.(type) {
+		case kmip14.State:
+			return state
+		case ttlv.EnumValue:
+			return kmip14.State(state)
+		case uint32:
+			return kmip14.State(state)
+		}
+	}
+
+	return 0
+}
+
+// ProviderType is the type the provider is registered as
+func (p *KMIPProvider) ProviderType() string {
+	return "kmip"
+}
+
+// WrappingAlgorithm is the algorithm the key manager wraps with
+func (p *KMIPProvider) WrappingAlgorithm() string {
+	return "AES_GCM"
+}
+
+// send sends a request with a single batch item for the operation and decodes its response payload
+func (p *KMIPProvider) send(ctx context.Context, operation kmip14.Operation, requestPayload interface{}, responsePayload interface{}) error {
+	request, err := kmipRequest(p.version, operation, requestPayload)
+	if err != nil {
+		return err
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{}, Config: p.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response, err := ttlv.NewDecoder(bufio.NewReader(conn)).NextTTLV()
+	if err != nil {
+		return err
+	}
+
+	return kmipResponsePayload(operation, response, responsePayload)
+}
+
+// kmipRequest encodes a request message with a single batch item for the operation
+func kmipRequest(version kmip.ProtocolVersion, operation kmip14.Operation, requestPayload interface{}) ([]byte, error) {
+	return ttlv.Marshal(kmip.RequestMessage{
+		RequestHeader: kmip.RequestHeader{
+			ProtocolVersion: version,
+			BatchCount:      1,
+		},
+		BatchItem: []kmip.RequestBatchItem{{
+			Operation:      operation,
+			RequestPayload: requestPayload,
+		}},
+	})
+}
+
+// kmipResponsePayload decodes the payload of the single batch item of a successful response message
+func kmipResponsePayload(operation kmip14.Operation, response ttlv.TTLV, responsePayload interface{}) error {
+	message := kmip.ResponseMessage{}
+	if err := ttlv.Unmarshal(response, &message); err != nil {
+		return err
+	}
+
+	if len(message.BatchItem) != 1 {
+		return fmt.Errorf("KMIP %s response has %d batch items instead of one", operation, len(message.BatchItem))
+	}
+
+	item := message.BatchItem[0]
+	if item.ResultStatus != kmip14.ResultStatusSuccess {
+		return fmt.Errorf("KMIP %s failed with %s (%s): %s", operation, item.ResultStatus, item.ResultReason, item.ResultMessage)
+	}
+
+	payload, ok := item.ResponsePayload.(ttlv.TTLV)
+	if !ok {
+		return fmt.Errorf("KMIP %s response has no payload", operation)
+	}
+
+	return ttlv.Unmarshal(payload, responsePayload)
+}
@@ -0,0 +1,200 @@
+//go:build kmip
+// +build kmip
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gemalto/kmip-go"
+	"github.com/gemalto/kmip-go/kmip14"
+	"github.com/gemalto/kmip-go/ttlv"
+)
+
+var kmipTestVersions = []kmip.ProtocolVersion{
+	{ProtocolVersionMajor: 1, ProtocolVersionMinor: 4},
+	{ProtocolVersionMajor: 2, ProtocolVersionMinor: 0},
+}
+
+// kmipDecodeRequest decodes a request message encoded by kmipRequest, returning the TTLV of its payload
+func kmipDecodeRequest(t *testing.T, version kmip.ProtocolVersion, operation kmip14.Operation, request []byte, requestPayload interface{}) ttlv.TTLV {
+	message := kmip.RequestMessage{}
+	if err := ttlv.Unmarshal(request, &message); err != nil {
+		t.Fatalf("failed to decode the KMIP %d.%d %s request: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, operation, err)
+	}
+
+	if message.RequestHeader.ProtocolVersion != version || len(message.BatchItem) != 1 || message.BatchItem[0].Operation != operation {
+		t.Fatalf("unexpected KMIP %d.%d %s request: %+v", version.ProtocolVersionMajor, version.ProtocolVersionMinor, operation, message)
+	}
+
+	payload := message.BatchItem[0].RequestPayload.(ttlv.TTLV)
+	if err := ttlv.Unmarshal(payload, requestPayload); err != nil {
+		t.Fatalf("failed to decode the KMIP %d.%d %s request payload: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, operation, err)
+	}
+
+	return payload
+}
+
+// kmipTestResponse encodes the response message a key manager answers with
+func kmipTestResponse(t *testing.T, version kmip.ProtocolVersion, operation kmip14.Operation, responsePayload interface{}) ttlv.TTLV {
+	response, err := ttlv.Marshal(kmip.ResponseMessage{
+		ResponseHeader: kmip.ResponseHeader{
+			ProtocolVersion: version,
+			TimeStamp:       time.Now().Truncate(time.Second),
+			BatchCount:      1,
+		},
+		BatchItem: []kmip.ResponseBatchItem{{
+			Operation:       operation,
+			ResultStatus:    kmip14.ResultStatusSuccess,
+			ResponsePayload: responsePayload,
+		}},
+	})
+
+	if err != nil {
+		t.Fatalf("failed to encode the KMIP %d.%d %s response: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, operation, err)
+	}
+
+	return response
+}
+
+func TestKMIPEncryptDecryptPayloads(t *testing.T) {
+	for _, version := range kmipTestVersions {
+		p := &KMIPProvider{version: version, keyID: "key"}
+
+		encrypt := kmipEncryptRequestPayload{
+			UniqueIdentifier:                      "key",
+			CryptographicParameters:               p.cryptographicParameters(),
+			Data:                                  []byte("plaintext"),
+			IVCounterNonce:                        make([]byte, kmipGCMNonceSize),
+			AuthenticatedEncryptionAdditionalData: []byte("aad"),
+		}
+
+		request, err := kmipRequest(version, kmip14.OperationEncrypt, encrypt)
+		if err != nil {
+			t.Fatalf("failed to encode the KMIP %d.%d encrypt request: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, err)
+		}
+
+		decodedEncrypt := kmipEncryptRequestPayload{}
+		kmipDecodeRequest(t, version, kmip14.OperationEncrypt, request, &decodedEncrypt)
+		if !reflect.DeepEqual(decodedEncrypt, encrypt) {
+			t.Fatalf("KMIP %d.%d encrypt request payload %+v decoded as %+v", version.ProtocolVersionMajor, version.ProtocolVersionMinor, encrypt, decodedEncrypt)
+		}
+
+		encrypted := kmipEncryptResponsePayload{UniqueIdentifier: "key", Data: []byte("ciphertext"), AuthenticatedEncryptionTag: make([]byte, kmipGCMTagSize)}
+		decodedEncrypted := kmipEncryptResponsePayload{}
+		if err := kmipResponsePayload(kmip14.OperationEncrypt, kmipTestResponse(t, version, kmip14.OperationEncrypt, encrypted), &decodedEncrypted); err != nil {
+			t.Fatalf("failed to decode the KMIP %d.%d encrypt response: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, err)
+		}
+
+		if !reflect.DeepEqual(decodedEncrypted, encrypted) {
+			t.Fatalf("KMIP %d.%d encrypt response payload %+v decoded as %+v", version.ProtocolVersionMajor, version.ProtocolVersionMinor, encrypted, decodedEncrypted)
+		}
+
+		decrypt := kmipDecryptRequestPayload{
+			UniqueIdentifier:                      "key",
+			CryptographicParameters:               p.cryptographicParameters(),
+			Data:                                  []byte("ciphertext"),
+			IVCounterNonce:                        make([]byte, kmipGCMNonceSize),
+			AuthenticatedEncryptionAdditionalData: []byte("aad"),
+			AuthenticatedEncryptionTag:            make([]byte, kmipGCMTagSize),
+		}
+
+		request, err = kmipRequest(version, kmip14.OperationDecrypt, decrypt)
+		if err != nil {
+			t.Fatalf("failed to encode the KMIP %d.%d decrypt request: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, err)
+		}
+
+		decodedDecrypt := kmipDecryptRequestPayload{}
+		kmipDecodeRequest(t, version, kmip14.OperationDecrypt, request, &decodedDecrypt)
+		if !reflect.DeepEqual(decodedDecrypt, decrypt) {
+			t.Fatalf("KMIP %d.%d decrypt request payload %+v decoded as %+v", version.ProtocolVersionMajor, version.ProtocolVersionMinor, decrypt, decodedDecrypt)
+		}
+
+		decrypted := kmipDecryptResponsePayload{UniqueIdentifier: "key", Data: []byte("plaintext")}
+		decodedDecrypted := kmipDecryptResponsePayload{}
+		if err := kmipResponsePayload(kmip14.OperationDecrypt, kmipTestResponse(t, version, kmip14.OperationDecrypt, decrypted), &decodedDecrypted); err != nil {
+			t.Fatalf("failed to decode the KMIP %d.%d decrypt response: %s", version.ProtocolVersionMajor, version.ProtocolVersionMinor, err)
+		}
+
+		if !reflect.DeepEqual(decodedDecrypted, decrypted) {
+			t.Fatalf("KMIP %d.%d decrypt response payload %+v decoded as %+v", version.ProtocolVersionMajor, version.ProtocolVersionMinor, decrypted, decodedDecrypted)
+		}
+	}
+}
+
+func TestKMIP14GetAttributesPayloads(t *testing.T) {
+	version := kmipTestVersions[0]
+	getAttributes := kmipGetAttributesRequestPayload{UniqueIdentifier: "key", AttributeName: []string{"State"}}
+
+	request, err := kmipRequest(version, kmip14.OperationGetAttributes, getAttributes)
+	if err != nil {
+		t.Fatalf("failed to encode the KMIP 1.4 get attributes request: %s", err)
+	}
+
+	decoded := kmipGetAttributesRequestPayload{}
+	kmipDecodeRequest(t, version, kmip14.OperationGetAttributes, request, &decoded)
+	if !reflect.DeepEqual(decoded, getAttributes) {
+		t.Fatalf("KMIP 1.4 get attributes request payload %+v decoded as %+v", getAttributes, decoded)
+	}
+
+	attributes := kmipGetAttributesResponsePayload{
+		UniqueIdentifier: "key",
+		Attribute:        []kmip.Attribute{{AttributeName: "State", AttributeValue: kmip14.StateActive}},
+	}
+
+	decodedAttributes := kmipGetAttributesResponsePayload{}
+	if err := kmipResponsePayload(kmip14.OperationGetAttributes, kmipTestResponse(t, version, kmip14.OperationGetAttributes, attributes), &decodedAttributes); err != nil {
+		t.Fatalf("failed to decode the KMIP 1.4 get attributes response: %s", err)
+	}
+
+	if state := kmipState(decodedAttributes.Attribute); state != kmip14.StateActive {
+		t.Fatalf("KMIP 1.4 get attributes response should have the Active state, got: %v", state)
+	}
+}
+
+func TestKMIP20GetAttributesPayloads(t *testing.T) {
+	version := kmipTestVersions[1]
+	getAttributes := kmip20GetAttributesRequestPayload{UniqueIdentifier: "key", AttributeReference: []ttlv.Tag{kmip14.TagState}}
+
+	request, err := kmipRequest(version, kmip14.OperationGetAttributes, getAttributes)
+	if err != nil {
+		t.Fatalf("failed to encode the KMIP 2.0 get attributes request: %s", err)
+	}
+
+	decoded := kmip20GetAttributesRequestPayload{}
+	payload := kmipDecodeRequest(t, version, kmip14.OperationGetAttributes, request, &decoded)
+	if !reflect.DeepEqual(decoded, getAttributes) {
+		t.Fatalf("KMIP 2.0 get attributes request payload %+v decoded as %+v", getAttributes, decoded)
+	}
+
+	//the attribute is referenced by an Attribute Reference enumeration of its tag, not by an Attribute Name
+	reference := payload.ValueStructure().Next()
+	if reference.Tag() != ttlv.Tag(0x42013B) || reference.Type() != ttlv.TypeEnumeration || ttlv.Tag(reference.ValueEnumeration()) != kmip14.TagState {
+		t.Fatalf("KMIP 2.0 get attributes request should reference the State tag, got: %s", reference)
+	}
+
+	attributes := kmip20GetAttributesResponsePayload{UniqueIdentifier: "key", Attributes: kmip20Attributes{State: kmip14.StateActive}}
+	response := kmipTestResponse(t, version, kmip14.OperationGetAttributes, attributes)
+
+	decodedAttributes := kmip20GetAttributesResponsePayload{}
+	if err := kmipResponsePayload(kmip14.OperationGetAttributes, response, &decodedAttributes); err != nil {
+		t.Fatalf("failed to decode the KMIP 2.0 get attributes response: %s", err)
+	}
+
+	if decodedAttributes.Attributes.State != kmip14.StateActive {
+		t.Fatalf("KMIP 2.0 get attributes response should have the Active state, got: %v", decodedAttributes.Attributes.State)
+	}
+
+	//a key manager answering without the attribute leaves the key disabled
+	missing := kmip20GetAttributesResponsePayload{UniqueIdentifier: "key"}
+	decodedAttributes = kmip20GetAttributesResponsePayload{}
+	if err := kmipResponsePayload(kmip14.OperationGetAttributes, kmipTestResponse(t, version, kmip14.OperationGetAttributes, missing), &decodedAttributes); err != nil {
+		t.Fatalf("failed to decode the KMIP 2.0 get attributes response without a state: %s", err)
+	}
+
+	if decodedAttributes.Attributes.State == kmip14.StateActive {
+		t.Fatalf("KMIP 2.0 get attributes response without a state should not be Active")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// the headers a request gives the KMS grant tokens and the IAM role the calls to AWS KMS are made with on behalf
+// of its caller, the grant tokens being separated by commas
+const (
+	KMSGrantTokensHeader   = "X-KMS-Grant-Tokens"
+	KMSAssumeRoleARNHeader = "X-KMS-Assume-Role-Arn"
+)
+
+// MaxKMSGrantTokens is the number of grant tokens a KMS request takes at most
+const MaxKMSGrantTokens = 10
+
+var roleARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/[\w+=,.@/-]+$`)
+
+// kmsAttribution - the KMS grant tokens and the IAM role the calls of a request to AWS KMS are made with, for
+// CloudTrail to show their caller rather than the role of rkms
+type kmsAttribution struct {
+	grantTokens []string
+	roleARN     string
+}
+
+// InvalidKMSAttributionError is returned when a request gives grant tokens or a role to call KMS with which aren't
+// accepted
+type InvalidKMSAttributionError struct {
+	Reason string
+}
+
+func (e InvalidKMSAttributionError) Error() string {
+	return "invalid KMS attribution: " + e.Reason
+}
+
+type kmsAttributionContextKey struct{}
+
+// withKMSAttribution returns a copy of ctx whose calls to AWS KMS are made with the given grant tokens and role
+func withKMSAttribution(ctx context.Context, attribution *kmsAttribution) context.Context {
+	return context.WithValue(ctx, kmsAttributionContextKey{}, attribution)
+}
+
+// kmsAttributionFromContext returns the KMS attribution of ctx, nil when the calls to KMS are made with the
+// credentials of rkms alone
+func kmsAttributionFromContext(ctx context.Context) *kmsAttribution {
+	attribution, _ := ctx.Value(kmsAttributionContextKey{}).(*kmsAttribution)
+	return attribution
+}
+
+// parseKMSAttribution returns the KMS attribution of the given grant tokens, separated by commas, and role ARN,
+// nil when both are empty. The role has to match one of the assumable role ARNs of r.
+func (r *RKMS) parseKMSAttribution(grantTokens string, roleARN string) (*kmsAttribution, error) {
+	if grantTokens == "" && roleARN == "" {
+		return nil, nil
+	}
+
+	attribution := &kmsAttribution{roleARN: roleARN}
+	if grantTokens != "" {
+		for _, token := range strings.Split(grantTokens, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				attribution.grantTokens = append(attribution.grantTokens, token)
+			}
+		}
+		if len(attribution.grantTokens) > MaxKMSGrantTokens {
+			return nil, InvalidKMSAttributionError{fmt.Sprintf("at most %d grant tokens are given to KMS", MaxKMSGrantTokens)}
+		}
+	}
+
+	if roleARN != "" {
+		if !roleARNPattern.MatchString(roleARN) {
+			return nil, InvalidKMSAttributionError{fmt.Sprintf("%q isn't the ARN of an IAM role", roleARN)}
+		}
+		if r == nil || !r.assumableRole(roleARN) {
+			return nil, InvalidKMSAttributionError{fmt.Sprintf("role %s isn't one of kms.assumable_role_arns", roleARN)}
+		}
+	}
+	return attribution, nil
+}
+
+// assumableRole tells if the given role matches one of the assumable role ARNs, "*" matching any characters
+func (r *RKMS) assumableRole(roleARN string) bool {
+	for _, pattern := range r.assumableRoleARNs {
+		if matchIDPattern(pattern, roleARN) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestWithKMSAttribution returns the request with the KMS attribution of its X-KMS-Grant-Tokens and
+// X-KMS-Assume-Role-Arn headers in its context, the request as is when it has neither
+func requestWithKMSAttribution(r *http.Request) (*http.Request, error) {
+	attribution, err := rkmsHandler.Load().parseKMSAttribution(r.Header.Get(KMSGrantTokensHeader), r.Header.Get(KMSAssumeRoleARNHeader))
+	if err != nil || attribution == nil {
+		return r, err
+	}
+	return r.WithContext(withKMSAttribution(r.Context(), attribution)), nil
+}
+
+// roleSessionName is the name of the sessions of the roles assumed for the caller of ctx, its identity with the
+// characters STS doesn't take replaced, "rkms" when the API isn't authenticated
+func roleSessionName(ctx context.Context) string {
+	identity := identityFromContext(ctx)
+	if identity == "" {
+		return "rkms"
+	}
+
+	name := strings.Map(func(c rune) rune {
+		if c < 128 && (c == '_' || c == '+' || c == '=' || c == ',' || c == '.' || c == '@' || c == '-' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return c
+		}
+		return '-'
+	}, identity)
+	if len(name) < 2 {
+		name = "rkms-" + name
+	}
+	if len(name) > 64 {
+		//the end of the identity, e.g. the name of an IAM role, tells more than its start
+		name = name[len(name)-64:]
+	}
+	return name
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+func TestParseKMSAttribution(t *testing.T) {
+	r := getRKMS([]bool{true})
+	r.assumableRoleARNs = []string{"arn:aws:iam::123456789012:role/billing-*"}
+
+	if attribution, err := r.parseKMSAttribution("", ""); attribution != nil || err != nil {
+		t.Fatalf("a request without grant tokens nor role shouldn't have had an attribution, got %v, %v", attribution, err)
+	}
+
+	attribution, err := r.parseKMSAttribution("token-a, token-b", "arn:aws:iam::123456789012:role/billing-job")
+	if err != nil || len(attribution.grantTokens) != 2 || attribution.grantTokens[1] != "token-b" || attribution.roleARN != "arn:aws:iam::123456789012:role/billing-job" {
+		t.Fatalf("the grant tokens and the role should have been parsed, got %+v, %v", attribution, err)
+	}
+
+	tests := []struct {
+		grantTokens string
+		roleARN     string
+	}{
+		{strings.Repeat("token,", MaxKMSGrantTokens+1), ""},
+		{"", "billing-job"},
+		{"", "arn:aws:iam::123456789012:user/billing-job"},
+		{"", "arn:aws:iam::123456789012:role/payments-job"},
+	}
+	for _, test := range tests {
+		if _, err := r.parseKMSAttribution(test.grantTokens, test.roleARN); err == nil {
+			t.Errorf("grant tokens %q and role %q should have been refused", test.grantTokens, test.roleARN)
+		}
+	}
+
+	if _, err := (*RKMS)(nil).parseKMSAttribution("", "arn:aws:iam::123456789012:role/billing-job"); err == nil {
+		t.Fatalf("a role shouldn't have been assumed without assumable roles")
+	}
+}
+
+func TestRoleSessionName(t *testing.T) {
+	a := getTestGrantAuthenticator(t)
+	tests := []struct {
+		identity string
+		name     string
+	}{
+		{"", "rkms"},
+		{"billing", "billing"},
+		{"arn:aws:iam::123456789012:role/billing job", "arn-aws-iam--123456789012-role-billing-job"},
+		{"a", "rkms-a"},
+		{strings.Repeat("x", 60) + "/billing", strings.Repeat("x", 56) + "-billing"},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.identity != "" {
+			ctx = withCaller(ctx, a, test.identity, OperationGetKeys)
+		}
+		if name := roleSessionName(ctx); name != test.name {
+			t.Errorf("the session of %q should have been named %q, got %q", test.identity, test.name, name)
+		}
+	}
+}
+
+// grantTokensKMSClient records the grant tokens of the decryptions
+type grantTokensKMSClient struct {
+	availableKMSClient
+	decryptions [][]string
+}
+
+func (c *grantTokensKMSClient) Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	c.decryptions = append(c.decryptions, input.GrantTokens)
+	return c.availableKMSClient.Decrypt(ctx, input, opts...)
+}
+
+func TestKMSAttributionGrantTokens(t *testing.T) {
+	r, _ := getPlaintextCachingRKMS(PlaintextCacheConfig{MaxEntries: 10, TTLInSeconds: 60})
+	defer r.purgePlaintextCache()
+	client := &grantTokensKMSClient{}
+	keyID := getTestKeyID("region-0")
+	r.providers["region-0"] = &AWSKMSProvider{client, &keyID, nil, nil}
+
+	if _, err := r.GetDataKey(context.Background(), "id", 0, nil); err != nil {
+		t.Fatalf("failed to get the data key: %s", err)
+	}
+	if len(client.decryptions) != 1 || client.decryptions[0] != nil {
+		t.Fatalf("the data key should have been decrypted without grant tokens, got %v", client.decryptions)
+	}
+
+	//the cached plaintext isn't served to the requests calling KMS on behalf of their caller
+	ctx := withKMSAttribution(context.Background(), &kmsAttribution{grantTokens: []string{"token-a"}})
+	for i := 0; i < 2; i++ {
+		if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+			t.Fatalf("failed to get the data key with grant tokens: %s", err)
+		}
+	}
+	if len(client.decryptions) != 3 || client.decryptions[2][0] != "token-a" {
+		t.Fatalf("the data key should have been decrypted by KMS with the grant tokens every time, got %v", client.decryptions)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// LocalMasterKeySize is the size of the AES-256 master keys of LocalKeyProvider
+const LocalMasterKeySize = 32
+
+// LocalKeyProvider - a KeyProvider wrapping data keys with an AES-256 master key held by the process,
+// for tests, local development and air-gapped labs. It is INSECURE FOR PRODUCTION: the master key
+// lives in a file or an environment variable and in memory instead of a key management service.
+//
+// The key id tells where the master key is: "file:<path>" for a file holding the 32 bytes of the key,
+// raw or base64 encoded, or "env:<variable>" for an environment variable holding the base64 encoded key.
+// Data keys are encrypted with AES-GCM, the ciphertexts being the nonce followed by the encrypted key,
+// and the encryption context being the additional authenticated data.
+type LocalKeyProvider struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+func init() {
+	RegisterKeyProvider("local", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		logger.Warnf("region %s wraps data keys with a local master key, which is insecure for production", region)
+		return NewLocalKeyProvider(keyID)
+	})
+}
+
+// NewLocalKeyProvider creates a new LocalKeyProvider instance with the master key the key id points to
+func NewLocalKeyProvider(keyID string) (*LocalKeyProvider, error) {
+	masterKey, err := loadLocalMasterKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalKeyProvider{keyID, aead}, nil
+}
+
+func loadLocalMasterKey(keyID string) ([]byte, error) {
+	var encoded []byte
+	switch {
+	case strings.HasPrefix(keyID, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(keyID, "file:"))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(content) == LocalMasterKeySize {
+			return content, nil
+		}
+		encoded = content
+	case strings.HasPrefix(keyID, "env:"):
+		encoded = []byte(os.Getenv(strings.TrimPrefix(keyID, "env:")))
+	default:
+		return nil, fmt.Errorf("the id of a local master key must start with file: or env:, got %q", keyID)
+	}
+
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("the local master key %s is not base64 encoded: %s", keyID, err)
+	}
+
+	if len(masterKey) != LocalMasterKeySize {
+		return nil, fmt.Errorf("the local master key %s is %d bytes long instead of %d", keyID, len(masterKey), LocalMasterKeySize)
+	}
+
+	return masterKey, nil
+}
+
+// GenerateDataKey creates a new data key of the given size
+func (p *LocalKeyProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with AES-GCM
+func (p *LocalKeyProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return p.aead.Seal(nonce, nonce, plaintext, encryptionContext.AAD()), nil
+}
+
+// Decrypt unwraps the given data key with AES-GCM
+func (p *LocalKeyProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	nonceSize := p.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("the ciphertext is too short to have been encrypted with local master key %s", p.keyID)
+	}
+
+	return p.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], encryptionContext.AAD())
+}
+
+// DescribeKey tells about the master key, which is always enabled
+func (p *LocalKeyProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	return &KeyDescription{ID: p.keyID, Enabled: true}, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *LocalKeyProvider) ProviderType() string {
+	return "local"
+}
+
+// WrappingAlgorithm is the algorithm the master key wraps with
+func (p *LocalKeyProvider) WrappingAlgorithm() string {
+	return "AES_GCM"
+}
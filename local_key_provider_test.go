@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalKeyProviderRoundTrip(t *testing.T) {
+	os.Setenv("RKMS_TEST_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, LocalMasterKeySize)))
+	defer os.Unsetenv("RKMS_TEST_MASTER_KEY")
+
+	p, err := NewLocalKeyProvider("env:RKMS_TEST_MASTER_KEY")
+	if err != nil {
+		t.Fatalf("failed to create local key provider: %s", err)
+	}
+
+	ctx := context.Background()
+	plaintext, ciphertext, err := p.GenerateDataKey(ctx, 32, nil)
+	if err != nil {
+		t.Fatalf("failed to generate a data key: %s", err)
+	}
+
+	decrypted, err := p.Decrypt(ctx, ciphertext, nil)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("failed to decrypt the data key: %v", err)
+	}
+
+	encryptionContext := EncryptionContext{"purpose": "test"}
+	bound, err := p.Encrypt(ctx, plaintext, encryptionContext)
+	if err != nil {
+		t.Fatalf("failed to encrypt the data key under an encryption context: %s", err)
+	}
+
+	if _, err := p.Decrypt(ctx, bound, EncryptionContext{"purpose": "other"}); err == nil {
+		t.Fatalf("a data key should not decrypt under another encryption context")
+	}
+
+	if decrypted, err := p.Decrypt(ctx, bound, encryptionContext); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("failed to decrypt the data key under its encryption context: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rkms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "master.key")
+	ioutil.WriteFile(path, bytes.Repeat([]byte{2}, LocalMasterKeySize), 0600)
+	other, err := NewLocalKeyProvider("file:" + path)
+	if err != nil {
+		t.Fatalf("failed to create local key provider from a raw key file: %s", err)
+	}
+
+	if _, err := other.Decrypt(ctx, ciphertext, nil); err == nil {
+		t.Fatalf("a data key should not decrypt with another master key")
+	}
+}
+
+func TestLocalKeyProviderRejectsInvalidKeys(t *testing.T) {
+	os.Setenv("RKMS_TEST_MASTER_KEY", base64.StdEncoding.EncodeToString([]byte("too short")))
+	defer os.Unsetenv("RKMS_TEST_MASTER_KEY")
+
+	for _, keyID := range []string{"env:RKMS_TEST_MASTER_KEY", "env:RKMS_TEST_MISSING_MASTER_KEY", "master.key"} {
+		if _, err := NewLocalKeyProvider(keyID); err == nil {
+			t.Fatalf("should not have created a local key provider for %s", keyID)
+		}
+	}
+}
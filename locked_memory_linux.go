@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// allocLockedBytes allocates size bytes out of the Go heap, for the garbage collector not to leave copies of them
+// behind, locked in memory for them never to be swapped to disk
+func allocLockedBytes(size int) ([]byte, error) {
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// freeLockedBytes zeroes and frees bytes allocated by allocLockedBytes
+func freeLockedBytes(b []byte) {
+	zeroBytes(b)
+	unix.Munlock(b)
+	unix.Munmap(b)
+}
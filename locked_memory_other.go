@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// allocLockedBytes allocates size bytes. Memory can only be locked on Linux: elsewhere they are allocated on the heap,
+// and only zeroed when freed.
+func allocLockedBytes(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+// freeLockedBytes zeroes bytes allocated by allocLockedBytes
+func freeLockedBytes(b []byte) {
+	zeroBytes(b)
+}
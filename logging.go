@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// the log formats of LoggerConfig.Format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// RedactedValue replaces the key material and ciphertexts in the log lines
+const RedactedValue = "[REDACTED]"
+
+// redactedFields are the fields whose values are always redacted, whatever they look like
+var redactedFields = map[string]bool{
+	"key":        true,
+	"plaintext":  true,
+	"ciphertext": true,
+}
+
+// base64Run matches the base64 strings long enough to be key material or a ciphertext: a 32 bytes data key is
+// 44 characters long in base64, 64 in hexadecimal. Ids, regions, key ids and request ids are shorter, or
+// broken up by characters out of the base64 alphabet.
+var base64Run = regexp.MustCompile(`[A-Za-z0-9+/]{40,}={0,2}`)
+
+// redactingFormatter - a logrus formatter redacting the key material and ciphertexts of the messages and fields
+// before formatting them with the wrapped formatter
+type redactingFormatter struct {
+	logger.Formatter
+}
+
+// Format redacts a copy of the entry and formats it, the entry itself being shared with the other hooks
+func (f *redactingFormatter) Format(entry *logger.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = redact(entry.Message)
+	redacted.Data = make(logger.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if redactedFields[key] {
+			redacted.Data[key] = RedactedValue
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			redacted.Data[key] = redact(v)
+		case error:
+			redacted.Data[key] = redact(v.Error())
+		case fmt.Stringer:
+			redacted.Data[key] = redact(v.String())
+		default:
+			redacted.Data[key] = value
+		}
+	}
+
+	return f.Formatter.Format(&redacted)
+}
+
+// redact replaces the runs of base64 looking like key material or a ciphertext with RedactedValue
+func redact(s string) string {
+	return base64Run.ReplaceAllString(s, RedactedValue)
+}
+
+// setupLogger sets the level and the format of the log lines, every format redacting them
+func setupLogger(config LoggerConfig) error {
+	level, err := logger.ParseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+
+	formatter, err := newLogFormatter(config.Format)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(level)
+	logger.SetFormatter(&redactingFormatter{formatter})
+	return nil
+}
+
+// newLogFormatter returns the formatter of the given log format
+func newLogFormatter(format string) (logger.Formatter, error) {
+	switch format {
+	case "", LogFormatText:
+		return &logger.TextFormatter{}, nil
+	case LogFormatJSON:
+		return &logger.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+type logFieldsContextKey struct{}
+
+// withLogFields returns a copy of ctx whose log lines have the given fields, on top of the fields ctx already has
+func withLogFields(ctx context.Context, fields logger.Fields) context.Context {
+	merged := make(logger.Fields)
+	if parent, ok := ctx.Value(logFieldsContextKey{}).(logger.Fields); ok {
+		for key, value := range parent {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, logFieldsContextKey{}, merged)
+}
+
+// withLogID returns a copy of ctx whose log lines have the given id as the id field
+func withLogID(ctx context.Context, id string) context.Context {
+	return withLogFields(ctx, logger.Fields{"id": id})
+}
+
+// contextLogger is the logger of the log lines of a request, with the fields of ctx and its request id as the
+// request_id field
+func contextLogger(ctx context.Context) *logger.Entry {
+	entry := logger.NewEntry(logger.StandardLogger())
+	if fields, ok := ctx.Value(logFieldsContextKey{}).(logger.Fields); ok {
+		entry = entry.WithFields(fields)
+	}
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		entry = entry.WithField("request_id", requestID)
+	}
+	return entry
+}
+
+// regionLogger is contextLogger with the region and the operation of a call to a key provider as fields
+func regionLogger(ctx context.Context, region string, operation string) *logger.Entry {
+	return contextLogger(ctx).WithFields(logger.Fields{"region": region, "operation": operation})
+}
+
+// logStoreError logs an error of a store backend with the store, the operation and the id (if any) as fields
+func logStoreError(ctx context.Context, store string, operation string, id string, err error) {
+	fields := logger.Fields{"store": store, "operation": operation}
+	if id != "" {
+		fields["id"] = id
+	}
+	contextLogger(ctx).WithFields(fields).Error(err)
+}
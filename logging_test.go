@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+func TestRedactingFormatter(t *testing.T) {
+	dataKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xab}, 32))
+	ciphertext := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xcd}, 184))
+
+	var b bytes.Buffer
+	log := logger.New()
+	log.Out = &b
+	log.Formatter = &redactingFormatter{&logger.JSONFormatter{}}
+
+	log.WithFields(logger.Fields{
+		"id":         "tenant-1/user-42",
+		"region":     "us-east-1",
+		"plaintext":  "short",
+		"ciphertext": ciphertext,
+		"error":      errors.New("invalid ciphertext " + ciphertext),
+	}).Errorf("failed to decrypt %s in alias/rkms-us-east-1", dataKey)
+
+	var line map[string]string
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("the log line should be JSON: %s", err)
+	}
+
+	if strings.Contains(b.String(), dataKey) || strings.Contains(b.String(), ciphertext) {
+		t.Fatalf("the key material should have been redacted: %s", b.String())
+	}
+
+	if line["msg"] != "failed to decrypt "+RedactedValue+" in alias/rkms-us-east-1" {
+		t.Fatalf("unexpected message %q", line["msg"])
+	}
+
+	if line["plaintext"] != RedactedValue || line["ciphertext"] != RedactedValue || line["error"] != "invalid ciphertext "+RedactedValue {
+		t.Fatalf("the key material fields should have been redacted: %s", b.String())
+	}
+
+	if line["id"] != "tenant-1/user-42" || line["region"] != "us-east-1" {
+		t.Fatalf("the other fields should have been kept: %s", b.String())
+	}
+}
+
+func TestSetupLogger(t *testing.T) {
+	level := logger.GetLevel()
+	defer logger.SetLevel(level)
+	defer logger.SetFormatter(&logger.TextFormatter{})
+
+	if err := setupLogger(LoggerConfig{Level: "info", Format: "xml"}); err == nil {
+		t.Fatalf("an unknown format should have failed")
+	}
+
+	if err := setupLogger(LoggerConfig{Level: "debug", Format: LogFormatJSON}); err != nil {
+		t.Fatalf("was not able to set up the logger: %s", err)
+	}
+
+	formatter, ok := logger.StandardLogger().Formatter.(*redactingFormatter)
+	if !ok {
+		t.Fatalf("the log lines should be redacted")
+	}
+	if _, ok := formatter.Formatter.(*logger.JSONFormatter); !ok {
+		t.Fatalf("the log lines should be JSON")
+	}
+}
+
+func TestContextLoggerFields(t *testing.T) {
+	ctx := withLogFields(withRequestID(context.Background(), "request"), logger.Fields{"region": "us-east-1"})
+	ctx = withLogID(ctx, "id")
+
+	data := contextLogger(ctx).Data
+	if data["id"] != "id" || data["region"] != "us-east-1" || data["request_id"] != "request" {
+		t.Fatalf("the fields of the context should have been logged, got %v", data)
+	}
+}
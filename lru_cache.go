@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCacheEntryOverhead is the estimated size in bytes of a cache entry besides its key and value: the element of
+// the list, the entry of the map and their pointers
+const lruCacheEntryOverhead = 128
+
+// lruCache - a cache bounded to maxEntries entries and to an estimate of maxBytes bytes, 0 leaving either unbounded,
+// evicting the least recently used entries past them. Entries expire after their expiration, and the expired
+// entries are dropped when read and, every cleanupInterval, when an entry is set. The evictions are counted by
+// rkms_cache_evictions_total under name, and onEvict, if set, is called with the entries evicted or deleted.
+type lruCache struct {
+	name              string
+	maxEntries        int
+	maxBytes          int
+	defaultExpiration time.Duration
+	cleanupInterval   time.Duration
+	size              func(key string, value interface{}) int
+	onEvict           func(key string, value interface{})
+
+	mutex       sync.Mutex
+	entries     map[string]*list.Element
+	order       *list.List
+	bytes       int
+	lastCleanup time.Time
+}
+
+type lruCacheEntry struct {
+	key       string
+	value     interface{}
+	size      int
+	expiresAt time.Time
+}
+
+// newLRUCache creates a cache whose entries expire after defaultExpiration, 0 never, the size of its values being
+// estimated by size
+func newLRUCache(name string, maxEntries int, maxBytes int, defaultExpiration time.Duration, cleanupInterval time.Duration, size func(key string, value interface{}) int) *lruCache {
+	return &lruCache{
+		name:              name,
+		maxEntries:        maxEntries,
+		maxBytes:          maxBytes,
+		defaultExpiration: defaultExpiration,
+		cleanupInterval:   cleanupInterval,
+		size:              size,
+		entries:           map[string]*list.Element{},
+		order:             list.New(),
+		lastCleanup:       time.Now(),
+	}
+}
+
+// Get returns the value cached for key, making it the most recently used entry
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruCacheEntry)
+	if entry.expired(time.Now()) {
+		c.remove(element, "expired")
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set caches value for key, expiring after expiration or, when it is 0, after the default expiration of the cache
+func (c *lruCache) Set(key string, value interface{}, expiration time.Duration) {
+	if expiration == 0 {
+		expiration = c.defaultExpiration
+	}
+
+	entry := &lruCacheEntry{key: key, value: value, size: len(key) + lruCacheEntryOverhead}
+	if c.size != nil {
+		entry.size += c.size(key, value)
+	}
+	now := time.Now()
+	if expiration > 0 {
+		entry.expiresAt = now.Add(expiration)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element, "")
+	}
+	if c.cleanupInterval > 0 && now.Sub(c.lastCleanup) >= c.cleanupInterval {
+		c.removeExpired(now)
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += entry.size
+	for c.order.Len() > 1 && ((c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.remove(c.order.Back(), "size")
+	}
+}
+
+// Delete removes the entry of key, if it is cached
+func (c *lruCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element, "")
+	}
+}
+
+// Len returns the number of entries cached, including the expired ones not dropped yet
+func (c *lruCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// Keys returns up to limit keys of the entries which haven't expired and whose value include accepts, the most
+// recently used first
+func (c *lruCache) Keys(limit int, include func(value interface{}) bool) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0)
+	for element := c.order.Front(); element != nil && len(keys) < limit; element = element.Next() {
+		entry := element.Value.(*lruCacheEntry)
+		if !entry.expired(now) && (include == nil || include(entry.value)) {
+			keys = append(keys, entry.key)
+		}
+	}
+	return keys
+}
+
+// Purge removes every entry
+func (c *lruCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for element := c.order.Back(); element != nil; element = c.order.Back() {
+		c.remove(element, "")
+	}
+}
+
+func (c *lruCache) removeExpired(now time.Time) {
+	c.lastCleanup = now
+	for element := c.order.Back(); element != nil; {
+		previous := element.Prev()
+		if element.Value.(*lruCacheEntry).expired(now) {
+			c.remove(element, "expired")
+		}
+		element = previous
+	}
+}
+
+// remove drops the entry of element, counting it as evicted for the given reason unless it is empty
+func (c *lruCache) remove(element *list.Element, reason string) {
+	entry := c.order.Remove(element).(*lruCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+
+	if reason != "" {
+		cacheEvictionsTotal.inc(c.name, reason)
+	}
+	if c.onEvict != nil {
+		c.onEvict(entry.key, entry.value)
+	}
+}
+
+func (e *lruCacheEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache("test-entries", 2, 0, 0, 0, nil)
+	c.Set("id-0", 0, 0)
+	c.Set("id-1", 1, 0)
+	c.Get("id-0")
+	c.Set("id-2", 2, 0)
+
+	if _, found := c.Get("id-1"); found {
+		t.Fatalf("the least recently used entry should have been evicted")
+	}
+	if _, found := c.Get("id-0"); !found || c.Len() != 2 {
+		t.Fatalf("the entries used since should have been kept, got %d entries", c.Len())
+	}
+	if evictions := cacheEvictionsTotal.value([]string{"test-entries", "size"}).count; evictions != 1 {
+		t.Fatalf("the eviction should have been counted, got %v", evictions)
+	}
+}
+
+func TestLRUCacheBoundsSize(t *testing.T) {
+	size := func(key string, value interface{}) int { return len(value.(string)) }
+	c := newLRUCache("test-bytes", 0, 3*lruCacheEntryOverhead+1000, 0, 0, size)
+	for _, id := range []string{"id-0", "id-1", "id-2"} {
+		c.Set(id, string(make([]byte, 400)), 0)
+	}
+
+	if _, found := c.Get("id-0"); found || c.Len() != 2 {
+		t.Fatalf("the entries past the size of the cache should have been evicted, got %d entries", c.Len())
+	}
+
+	//replacing an entry doesn't count its previous size
+	c.Set("id-2", "", 0)
+	c.Set("id-3", string(make([]byte, 400)), 0)
+	if c.Len() != 3 {
+		t.Fatalf("the smaller entry should have made room, got %d entries", c.Len())
+	}
+}
+
+func TestLRUCacheExpiresEntries(t *testing.T) {
+	c := newLRUCache("test-expired", 0, 0, time.Minute, time.Millisecond, nil)
+	c.Set("id-0", 0, time.Millisecond)
+	c.Set("id-1", 1, time.Millisecond)
+	c.Set("id-2", 2, 0)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.Get("id-0"); found {
+		t.Fatalf("the expired entry should not have been found")
+	}
+
+	c.Set("id-3", 3, 0)
+	if c.Len() != 2 {
+		t.Fatalf("the expired entries should have been cleaned up, got %d entries", c.Len())
+	}
+	if _, found := c.Get("id-2"); !found {
+		t.Fatalf("the entry of the default expiration should not have expired")
+	}
+}
+
+func TestLRUCacheCallsOnEvict(t *testing.T) {
+	evicted := []string{}
+	c := newLRUCache("test-on-evict", 1, 0, 0, 0, nil)
+	c.onEvict = func(key string, value interface{}) { evicted = append(evicted, key) }
+	c.Set("id-0", 0, 0)
+	c.Set("id-1", 1, 0)
+	c.Delete("id-1")
+
+	if len(evicted) != 2 || evicted[0] != "id-0" || evicted[1] != "id-1" {
+		t.Fatalf("the evicted and deleted entries should have been passed to onEvict, got %v", evicted)
+	}
+}
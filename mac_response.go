@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type macRequest struct {
+	Message []byte `json:"message"`
+	Mac     []byte `json:"mac"`
+}
+
+type macResponse struct {
+	ID           string `json:"id"`
+	KeySpec      string `json:"key_spec"`
+	MacAlgorithm string `json:"mac_algorithm"`
+	Mac          string `json:"mac"`
+}
+
+type verifyMacResponse struct {
+	ID       string `json:"id"`
+	MacValid bool   `json:"mac_valid"`
+}
+
+// ConstructMacResponse creates a server response for POST /keys/{id}/mac endpoint
+func ConstructMacResponse(mac *Mac) string {
+	b, _ := json.Marshal(macResponse{mac.ID, mac.KeySpec, mac.MacAlgorithm, mac.Mac})
+	return string(b)
+}
+
+// ConstructVerifyMacResponse creates a server response for POST /keys/{id}/verify endpoint, which only answers the
+// valid MACs
+func ConstructVerifyMacResponse(id string) string {
+	b, _ := json.Marshal(verifyMacResponse{id, true})
+	return string(b)
+}
@@ -1,36 +1,231 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	logger "github.com/sirupsen/logrus"
 )
 
-var rkmsHandler *RKMS
+// rkmsHandler is the RKMS of the current configuration, replaced when the configuration is reloaded
+var rkmsHandler atomic.Pointer[RKMS]
 
-func main() {
-	config := LoadConfiguration()
+// healthChecksEnabled is true when the key providers are health checked, for /readyz to wait for the first checks
+var healthChecksEnabled atomic.Bool
 
-	level, err := logger.ParseLevel(config.Logger.Level)
+// warmingUp is true while the caches are warmed up on startup, for /readyz to wait for them
+var warmingUp atomic.Bool
+
+// serve runs `rkms serve`, the HTTP API and the gRPC and admin servers once configured, until SIGTERM or SIGINT
+func serve(options commandOptions, args []string) error {
+	fs := newCommandFlagSet("serve", &options)
+	fs.Parse(args)
+
+	config, err := loadCommandConfiguration(options)
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+
+	if config.Server.APIVersion != "" {
+		logger.Warnf("server.api_version is ignored, the HTTP API is served under every version: %s", strings.Join(apiVersions, ", "))
+	}
+	deprecations, err := apiDeprecationHeaders(config.Server.APIVersions)
+	if err != nil {
+		return fmt.Errorf("API versions: %s", err)
 	}
-	logger.SetLevel(level)
 
-	rkms, err := NewRKMSWithDynamoDB(config.KMS, config.DynamoDB)
+	shutdownTracing, err := setupTracing(config.Tracing)
 	if err != nil {
 		logger.Fatal(err)
-		return
 	}
-	rkmsHandler = rkms
+	defer shutdownTracing(context.Background())
 
-	path := "/api/" + config.Server.APIVersion + "/key"
-	http.HandleFunc(path, decorator(getKey))
-	err = http.ListenAndServe(":"+config.Server.Port, nil)
+	rkms, store, err := openRKMS(config)
 	if err != nil {
-		logger.Fatal("ListenAndServe: ", err)
+		return err
+	}
+	rkmsHandler.Store(rkms)
+
+	authenticator, err = NewTenantAuthenticator(config.Auth, config.Tenants)
+	if err != nil {
+		logger.Fatal("auth: ", err)
+	}
+
+	limiter, err := NewRateLimiter(config.RateLimit, config.Tenants)
+	if err != nil {
+		logger.Fatal("rate limit: ", err)
+	}
+	rateLimiter.Store(limiter)
+
+	//SIGTERM and SIGINT stop the background jobs and drain the servers before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if config.Store.WarmUp.MaxIDs > 0 {
+		warmingUp.Store(true)
+		go runCacheWarmUp(ctx, rkms, config.Store.WarmUp)
+	}
+
+	if config.Store.DeletedRetentionInHours > 0 {
+		retention := time.Duration(config.Store.DeletedRetentionInHours) * time.Hour
+		interval := time.Duration(config.Store.PurgeIntervalInMinutes) * time.Minute
+		go runDeletedEncryptedDataKeysPurger(ctx, store, retention, interval)
+	}
+
+	if config.Store.PurgeIntervalInMinutes > 0 {
+		go runScheduledKeyDeletions(ctx, store, time.Duration(config.Store.PurgeIntervalInMinutes)*time.Minute)
+	}
+
+	if replication := config.Store.Replication; replication.TargetConfig != "" {
+		target, err := newReplicationTarget(replication.TargetConfig)
+		if err != nil {
+			logger.Fatal("store replication: ", err)
+		}
+		go runStoreReplication(ctx, store, target, time.Duration(replication.IntervalInSeconds)*time.Second)
+	}
+
+	//SIGHUP reloads the configuration, replacing the RKMS and its background jobs
+	reloader := &configReloader{path: options.configFile, storeType: options.storeType, store: store, config: config}
+	reloader.stopJobs = startKMSJobs(ctx, rkms, config.KMS)
+	go runConfigReloads(ctx, reloader)
+
+	shutdownTimeout := time.Duration(config.Server.ShutdownTimeoutInSeconds) * time.Second
+	requestTimeout := time.Duration(config.Server.RequestTimeoutInMilliseconds) * time.Millisecond
+	var servers sync.WaitGroup
+	if config.Server.GRPC.Port != "" || config.Server.GRPC.VsockPort != 0 {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			if err := runGRPCServer(ctx, config.Server.GRPC, &rkmsHandler, requestTimeout, shutdownTimeout); err != nil {
+				logger.Fatal("gRPC server: ", err)
+			}
+		}()
+	}
+
+	if config.Server.Admin.Port != "" {
+		go func() {
+			if err := runAdminServer(config.Server.Admin); err != nil {
+				logger.Fatal("admin server: ", err)
+			}
+		}()
+	}
+
+	mux := newServeMux(deprecations, requestTimeout, config.Server.SwaggerUI)
+	if config.Server.UnixSocket.Path != "" {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			if err := serveUnixSocket(ctx, config.Server.UnixSocket, mux, shutdownTimeout); err != nil {
+				logger.Fatal("Unix domain socket: ", err)
+			}
+		}()
+	}
+
+	//in sidecar mode, the API is only served on the Unix domain socket
+	if config.Server.Port != "" {
+		listener, err := net.Listen("tcp", ":"+config.Server.Port)
+		if err != nil {
+			logger.Fatal("ListenAndServe: ", err)
+		}
+
+		tlsConfig, certificates, err := newServerTLSConfig(config.Server.TLS)
+		if err != nil {
+			logger.Fatal("TLS: ", err)
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+			if config.Server.TLS.ReloadIntervalInSeconds > 0 {
+				interval := time.Duration(config.Server.TLS.ReloadIntervalInSeconds) * time.Second
+				go runCertificateReloads(ctx, certificates, interval)
+			}
+		}
+
+		server := &http.Server{Handler: mux}
+		if err := serveUntilDone(ctx, server, listener, shutdownTimeout); err != nil {
+			logger.Fatal("ListenAndServe: ", err)
+		}
+	}
+
+	servers.Wait()
+	if config.Store.WarmUp.MaxIDs > 0 {
+		if err := saveWarmUpIDs(store, config.Store.WarmUp); err != nil {
+			logger.Warnf("failed to save the ids to warm the caches up with on the next start: %s", err)
+		}
+	}
+	logger.Infoln("shut down")
+	return nil
+}
+
+// newServeMux routes every version of the HTTP API under /api/<version>, the requests but the streaming ones being
+// given requestTimeout and the ones of the deprecated versions being answered with their deprecation headers, along
+// with their OpenAPI specifications, and the Swagger UI of the latest one with swaggerUI. It is a mux of its own
+// rather than http.DefaultServeMux, which the debug endpoints of the admin server register themselves on. The
+// endpoints routed here are described by apiEndpoints.
+func newServeMux(deprecations map[string]http.Header, requestTimeout time.Duration, swaggerUI bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, version := range apiVersions {
+		handleAPIVersion(mux, version, deprecations[version], requestTimeout)
+	}
+	mux.HandleFunc("/healthz", instrument("healthz", decorator(getLiveness)))
+	mux.HandleFunc("/readyz", instrument("readyz", decorator(getReadiness)))
+	mux.HandleFunc("/healthz/providers", instrument("healthz/providers", decorator(getProviderHealth)))
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc(OpenAPIPath, instrument("openapi", decorator(serveOpenAPISpec(latestAPIVersion))))
+	if swaggerUI {
+		mux.HandleFunc(SwaggerUIPath, instrument("docs", serveSwaggerUI))
 	}
+	return mux
+}
+
+// handleAPIVersion routes the endpoints of the HTTP API under the given version, see newServeMux. The handlers
+// answering differently by version tell them apart with apiVersionFromContext.
+func handleAPIVersion(mux *http.ServeMux, version string, deprecation http.Header, requestTimeout time.Duration) {
+	handle := func(path string, endpoint string, handler func(http.ResponseWriter, *http.Request)) {
+		mux.HandleFunc(apiPath(version, path), instrument(endpoint, versioned(version, deprecation, handler)))
+	}
+
+	handle("/key", "key", decorator(withDeadline(requestTimeout, authorize(OperationGetKeys, limitRate(getKey)))))
+	handle("/key/decrypt", "key/decrypt", decorator(withDeadline(requestTimeout, authorize(OperationDecryptKeys, limitRate(decryptKey)))))
+	handle("/key-pair", "key-pair", decorator(withDeadline(requestTimeout, authorize(OperationGetKeys, limitRate(getKeyPair)))))
+	handle("/key-pair/decrypt", "key-pair/decrypt", decorator(withDeadline(requestTimeout, authorize(OperationDecryptKeys, limitRate(decryptKeyPair)))))
+	deleteKeyHandler := instrument("keys/delete", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(deleteKey)))))
+	mux.HandleFunc(apiPath(version, "/keys/"), versioned(version, deprecation, routeKeys(deleteKeyHandler, map[string]http.HandlerFunc{
+		"rotate":          instrument("keys/rotate", decorator(withDeadline(requestTimeout, authorize(OperationRotateKeys, limitRate(rotateKey))))),
+		"metadata":        instrument("keys/metadata", decorator(withDeadline(requestTimeout, authorize(OperationGetKeys, limitRate(getKeyMetadata))))),
+		"labels":          instrument("keys/labels", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(setKeyLabels))))),
+		"cryptoperiod":    instrument("keys/cryptoperiod", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(setKeyCryptoperiod))))),
+		"disable":         instrument("keys/disable", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(disableKey))))),
+		"enable":          instrument("keys/enable", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(enableKey))))),
+		"rewrap":          instrument("keys/rewrap", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(rewrapKey))))),
+		"cancel-deletion": instrument("keys/cancel-deletion", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(cancelKeyDeletion))))),
+		"derive":          instrument("keys/derive", decorator(withDeadline(requestTimeout, authorize(OperationDeriveKeys, limitRate(deriveKey))))),
+		"mac":             instrument("keys/mac", decorator(withDeadline(requestTimeout, authorize(OperationGenerateMac, limitRate(generateMac))))),
+		"verify":          instrument("keys/verify", decorator(withDeadline(requestTimeout, authorize(OperationVerifyMac, limitRate(verifyMac))))),
+	})))
+	handle("/keys/batch", "keys/batch", decorator(withDeadline(requestTimeout, authorize(OperationGetKeys, limitRate(getKeysBatch)))))
+	handle("/keys", "keys", decorator(withDeadline(requestTimeout, authorize(OperationGetKeys, limitRate(listKeys)))))
+	handle("/encrypt", "encrypt", decorator(withDeadline(requestTimeout, authorize(OperationEncrypt, limitRate(encrypt)))))
+	handle("/decrypt", "decrypt", decorator(withDeadline(requestTimeout, authorize(OperationDecrypt, limitRate(decrypt)))))
+	handle("/encrypt/stream", "encrypt/stream", decorator(authorize(OperationEncrypt, limitRate(encryptStream))))
+	handle("/decrypt/stream", "decrypt/stream", decorator(authorize(OperationDecrypt, limitRate(decryptStream))))
+	handle("/grants", "grants", decorator(withDeadline(requestTimeout, authorize(OperationCreateGrants, limitRate(createGrant)))))
+	handle("/approvals", "approvals", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(listApprovals)))))
+	handle("/approvals/", "approvals/decide", decorator(withDeadline(requestTimeout, authorize(OperationManageKeys, limitRate(decideApproval)))))
+	handle(OpenAPIPath, "openapi", decorator(serveOpenAPISpec(version)))
 }
 
 func decorator(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -38,6 +233,23 @@ func decorator(handler func(http.ResponseWriter, *http.Request)) func(http.Respo
 		//we will always return in JSON
 		w.Header().Set("Content-Type", "application/json")
 
+		r, requestID := requestWithID(r)
+		w.Header().Set(RequestIDHeader, requestID)
+
+		r, err := requestWithReadConsistency(r)
+		if err == nil {
+			r, err = requestWithKMSAttribution(r)
+		}
+		if err == nil {
+			r, err = requestWithResponseRecipient(r)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", err.Error())
+			fmt.Fprintln(w, resp)
+			return
+		}
+
 		handler(w, r)
 	}
 }
@@ -50,18 +262,1076 @@ func getKey(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, resp)
 		return
 	}
+	if !checkRequestIDs(w, id) {
+		return
+	}
+
+	var ttl time.Duration
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "ttl query parameter must be a positive number of seconds")
+			fmt.Fprintln(w, resp)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	var version int64
+	if value := r.URL.Query().Get("version"); value != "" {
+		var err error
+		if version, err = strconv.ParseInt(value, 10, 64); err != nil || version <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "version query parameter must be a positive number")
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
 
 	ctx := r.Context()
-	plaintextDataKey, err := rkmsHandler.GetPlaintextDataKey(ctx, id)
+	if wrapped, _ := strconv.ParseBool(r.URL.Query().Get("wrapped")); wrapped {
+		var wrappedDataKey *WrappedDataKey
+		var err error
+		if version > 0 {
+			wrappedDataKey, err = rkmsHandler.Load().GetWrappedDataKeyVersion(ctx, id, version, encryptionContext)
+		} else {
+			wrappedDataKey, err = rkmsHandler.Load().GetWrappedDataKey(ctx, id, ttl, encryptionContext)
+		}
+
+		if err != nil {
+			writeDataKeyError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		resp := ConstructWrappedKeyResponse(wrappedDataKey)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	var dataKey *DataKey
+	var err error
+	if version > 0 {
+		dataKey, err = rkmsHandler.Load().GetDataKeyVersion(ctx, id, version, encryptionContext)
+	} else {
+		dataKey, err = rkmsHandler.Load().GetDataKey(ctx, id, ttl, encryptionContext)
+	}
+
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer dataKey.Destroy()
+	if err := sealHTTPResponseKey(w, r, dataKey.ID, &dataKey.Plaintext); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructGetKeyResponse(dataKey))
+}
+
+// routeKeys serves the /keys/{id}/<action> endpoints with the handler of their action, and DELETE /keys/{id} with
+// deleteHandler, ids being able to contain slashes
+func routeKeys(deleteHandler http.HandlerFunc, handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, keysPathPrefix(r))
+		if r.Method == http.MethodDelete && path != "" {
+			if checkRequestIDs(w, path) {
+				deleteHandler(w, r)
+			}
+			return
+		}
+
+		if i := strings.LastIndex(path, "/"); i > 0 {
+			if handler, ok := handlers[path[i+1:]]; ok {
+				if checkRequestIDs(w, path[:i]) {
+					handler(w, r)
+				}
+				return
+			}
+		}
+
+		actions := make([]string, 0, len(handlers))
+		for action := range handlers {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		resp := ConstructErrorResponse("NotFound", "the path must be /keys/{id}/<action>, the action being one of "+strings.Join(actions, ", "))
+		fmt.Fprintln(w, resp)
+	}
+}
+
+// keysPathPrefix is the path of the /keys/{id}/... endpoints up to the id, under the API version of the request
+func keysPathPrefix(r *http.Request) string {
+	return apiPath(apiVersionFromContext(r.Context()), "/keys/")
+}
+
+// keyPathID is the id of the path of a /keys/{id}/<action> endpoint
+func keyPathID(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, keysPathPrefix(r))
+	return path[:strings.LastIndex(path, "/")]
+}
+
+// rotateKey serves POST /keys/{id}/rotate
+func rotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "keys are rotated with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	id := keyPathID(r)
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	idempotencyKey, ok := parseIdempotencyKey(w, r)
+	if !ok {
+		return
+	}
+
+	dataKey, err := rkmsHandler.Load().RotateDataKeyIdempotently(r.Context(), idempotencyKey, id, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer dataKey.Destroy()
+	if err := sealHTTPResponseKey(w, r, dataKey.ID, &dataKey.Plaintext); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructGetKeyResponse(dataKey))
+}
+
+// getKeyMetadata serves GET /keys/{id}/metadata
+func getKeyMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "the metadata of keys is read with GET")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	metadata, err := rkmsHandler.Load().GetKeyMetadata(r.Context(), keyPathID(r))
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// setKeyLabels serves PUT /keys/{id}/labels, replacing the labels of the key with those of the JSON body
+func setKeyLabels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "the labels of keys are set with PUT")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	var body setKeyLabelsRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "the body must be a JSON object with the labels object of strings")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	metadata, err := rkmsHandler.Load().SetKeyLabels(r.Context(), keyPathID(r), body.Labels)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// setKeyCryptoperiod serves PUT /keys/{id}/cryptoperiod, setting the cryptoperiod of the key to the max_age_in_days of
+// the JSON body
+func setKeyCryptoperiod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "the cryptoperiods of keys are set with PUT")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	var body setKeyCryptoperiodRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "the body must be a JSON object with the max_age_in_days number")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	metadata, err := rkmsHandler.Load().SetKeyCryptoperiod(r.Context(), keyPathID(r), body.MaxAgeInDays)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// createGrant serves POST /grants, creating a grant of operations on an id to the caller
+func createGrant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "grants are created with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	var body createGrantRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "the body must be a JSON object with the id and the operations of the grant")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, body.ID) {
+		return
+	}
+
+	grant, token, err := authenticator.CreateGrant(r.Context(), body.ID, body.Operations, time.Duration(body.TTLInSeconds)*time.Second)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, ConstructGrantResponse(grant, token))
+}
+
+// disableKey serves POST /keys/{id}/disable
+func disableKey(w http.ResponseWriter, r *http.Request) {
+	changeKeyState(w, r, rkmsHandler.Load().DisableKey)
+}
+
+// enableKey serves POST /keys/{id}/enable
+func enableKey(w http.ResponseWriter, r *http.Request) {
+	changeKeyState(w, r, rkmsHandler.Load().EnableKey)
+}
+
+// deleteKey serves DELETE /keys/{id}, scheduling the deletion of the key once the waiting_period_in_days query
+// parameter is over
+func deleteKey(w http.ResponseWriter, r *http.Request) {
+	days := DefaultDeletionWaitingPeriodInDays
+	if value := r.URL.Query().Get("waiting_period_in_days"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days < MinDeletionWaitingPeriodInDays || days > MaxDeletionWaitingPeriodInDays {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("waiting_period_in_days query parameter must be a number from %d to %d", MinDeletionWaitingPeriodInDays, MaxDeletionWaitingPeriodInDays))
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, keysPathPrefix(r))
+	metadata, err := rkmsHandler.Load().ScheduleKeyDeletion(r.Context(), id, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// rewrapKey serves POST /keys/{id}/rewrap
+func rewrapKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "keys are rewrapped with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	metadata, err := rkmsHandler.Load().RewrapKey(r.Context(), keyPathID(r))
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// listApprovals serves GET /approvals, listing the pending approvals of the actions under dual control
+func listApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "approvals are listed with GET")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	approvals, err := rkmsHandler.Load().ListApprovals(r.Context())
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructListApprovalsResponse(approvals))
+}
+
+// decideApproval serves POST /approvals/{approval_id}/approve, applying the action of the approval and answering
+// with the metadata of its key, and POST /approvals/{approval_id}/reject
+func decideApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "approvals are approved or rejected with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	path := r.URL.Path[strings.Index(r.URL.Path, "/approvals/")+len("/approvals/"):]
+	approvalID, decision, _ := strings.Cut(path, "/")
+	switch {
+	case approvalID != "" && decision == "approve":
+		metadata, err := rkmsHandler.Load().ApproveAction(r.Context(), approvalID)
+		if err != nil {
+			writeDataKeyError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+	case approvalID != "" && decision == "reject":
+		if err := rkmsHandler.Load().RejectAction(r.Context(), approvalID); err != nil {
+			writeDataKeyError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		resp := ConstructErrorResponse("NotFound", "the path must be /approvals/{approval_id}/approve or /approvals/{approval_id}/reject")
+		fmt.Fprintln(w, resp)
+	}
+}
+
+// cancelKeyDeletion serves POST /keys/{id}/cancel-deletion
+func cancelKeyDeletion(w http.ResponseWriter, r *http.Request) {
+	changeKeyState(w, r, rkmsHandler.Load().CancelKeyDeletion)
+}
+
+// changeKeyState moves the key of the path to another state with change, answering with its metadata
+func changeKeyState(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, id string) (*KeyMetadata, error)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "the state of keys is changed with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	metadata, err := change(r.Context(), keyPathID(r))
 	if err != nil {
-		//TODO: do a better error handling based on the type of error
-		w.WriteHeader(http.StatusInternalServerError)
-		resp := ConstructErrorResponse("InternalServerError", err.Error())
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructKeyMetadataResponse(metadata))
+}
+
+// listKeys serves GET /keys, listing the metadata of a page of the ids having the labels of the labels query
+// parameter, a JSON object of strings, from the cursor query parameter on
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "keys are listed with GET")
 		fmt.Fprintln(w, resp)
 		return
 	}
 
+	var labels map[string]string
+	if value := r.URL.Query().Get("labels"); value != "" {
+		if err := json.Unmarshal([]byte(value), &labels); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "labels query parameter must be a JSON object of strings")
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	var limit int
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > DefaultListIDsLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("limit query parameter must be a number from 1 to %d", DefaultListIDsLimit))
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	metadata, cursor, err := rkmsHandler.Load().ListKeyMetadata(r.Context(), labels, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	resp := ConstructGetKeyResponse(id, *plaintextDataKey)
+	fmt.Fprintln(w, ConstructListKeysResponse(metadata, cursor))
+}
+
+// decryptKey serves POST /key/decrypt, decrypting the ciphertext of a data key given with its id and region,
+// failing over to the ciphertexts of the other regions
+func decryptKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "ciphertexts are decrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	var body decryptKeyRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" || body.Region == "" || body.Ciphertext == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "the body must be a JSON object with an id, a region and a base64 ciphertext")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, body.ID) {
+		return
+	}
+
+	plaintext, region, err := rkmsHandler.Load().DecryptCiphertext(r.Context(), body.ID, body.Region, body.Ciphertext, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer func() { plaintext.Destroy() }()
+	if err := sealHTTPResponseKey(w, r, body.ID, &plaintext); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructDecryptKeyResponse(body.ID, plaintext, region))
+}
+
+// deriveKey serves POST /keys/{id}/derive, answering the sub-key of the data key of the id derived for the info of
+// the JSON body
+func deriveKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "keys are derived with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	var body deriveKeyRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Version < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "the body must be a JSON object with an info, and optionally a base64 salt, a size_in_bytes and a positive version")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if body.SizeInBytes == 0 {
+		body.SizeInBytes = DefaultDerivedKeySizeInBytes
+	}
+
+	dataKey, err := rkmsHandler.Load().DeriveDataKey(r.Context(), keyPathID(r), body.Version, body.Info, body.Salt, body.SizeInBytes, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer dataKey.Destroy()
+	if err := sealHTTPResponseKey(w, r, dataKey.ID, &dataKey.Plaintext); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructGetKeyResponse(dataKey))
+}
+
+// generateMac serves POST /keys/{id}/mac, answering the MAC of the message of the JSON body
+func generateMac(w http.ResponseWriter, r *http.Request) {
+	body, encryptionContext, ok := parseMacRequest(w, r, "MACs are generated with POST")
+	if !ok {
+		return
+	}
+
+	mac, err := rkmsHandler.Load().GenerateMac(r.Context(), keyPathID(r), r.URL.Query().Get("spec"), body.Message, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructMacResponse(mac)
+	fmt.Fprintln(w, resp)
+}
+
+// verifyMac serves POST /keys/{id}/verify, answering if the mac of the JSON body is the one of its message
+func verifyMac(w http.ResponseWriter, r *http.Request) {
+	body, encryptionContext, ok := parseMacRequest(w, r, "MACs are verified with POST")
+	if !ok {
+		return
+	}
+
+	id := keyPathID(r)
+	if err := rkmsHandler.Load().VerifyMac(r.Context(), id, body.Message, body.Mac, encryptionContext); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructVerifyMacResponse(id)
+	fmt.Fprintln(w, resp)
+}
+
+// parseMacRequest reads the JSON body of a MAC request along with its encryption context, answering the request
+// itself when it is invalid
+func parseMacRequest(w http.ResponseWriter, r *http.Request, methodNotAllowed string) (*macRequest, EncryptionContext, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", methodNotAllowed)
+		fmt.Fprintln(w, resp)
+		return nil, nil, false
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var body macRequest
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(MaxMacMessageSizeInBytes)+1024))
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Message) == 0 || len(body.Message) > MaxMacMessageSizeInBytes {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("the body must be a JSON object with a base64 message of 1 to %d bytes", MaxMacMessageSizeInBytes))
+		fmt.Fprintln(w, resp)
+		return nil, nil, false
+	}
+	return &body, encryptionContext, true
+}
+
+// getKeyPair serves GET /key-pair, answering the public key of the data key pair of the id
+func getKeyPair(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, id) {
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	dataKeyPair, err := rkmsHandler.Load().GetDataKeyPair(r.Context(), id, r.URL.Query().Get("spec"), encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer dataKeyPair.Destroy()
+	if err := sealHTTPResponseKey(w, r, dataKeyPair.ID, &dataKeyPair.PrivateKey); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructDataKeyPairResponse(dataKeyPair))
+}
+
+// decryptKeyPair serves POST /key-pair/decrypt, answering the data key pair of the id along with its private key
+func decryptKeyPair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "private keys are decrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, id) {
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	dataKeyPair, err := rkmsHandler.Load().UnwrapDataKeyPair(r.Context(), id, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	defer dataKeyPair.Destroy()
+	if err := sealHTTPResponseKey(w, r, dataKeyPair.ID, &dataKeyPair.PrivateKey); err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructDataKeyPairResponse(dataKeyPair))
+}
+
+// getKeysBatch serves POST /keys/batch, getting the data keys of the ids of the JSON body, or their ciphertexts
+// with wrapped_only, and generating the missing ones
+func getKeysBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "keys are batch read with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	var body batchRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.IDs) == 0 || len(body.IDs) > MaxNumberOfBatchIDs {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("the body must be a JSON object with from 1 to %d ids", MaxNumberOfBatchIDs))
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	for _, id := range body.IDs {
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "ids can't be empty")
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+	if !checkRequestIDs(w, body.IDs...) {
+		return
+	}
+
+	if body.WrappedOnly {
+		wrappedDataKeys, errs := rkmsHandler.Load().GetWrappedDataKeys(r.Context(), body.IDs, encryptionContext)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, ConstructBatchWrappedResponse(apiVersionFromContext(r.Context()), body.IDs, wrappedDataKeys, errs))
+		return
+	}
+
+	dataKeys, errs := rkmsHandler.Load().GetDataKeys(r.Context(), body.IDs, encryptionContext)
+	defer func() {
+		for _, dataKey := range dataKeys {
+			dataKey.Destroy()
+		}
+	}()
+	for id, dataKey := range dataKeys {
+		if err := sealHTTPResponseKey(w, r, id, &dataKey.Plaintext); err != nil {
+			errs[id] = err
+			dataKey.Destroy()
+			delete(dataKeys, id)
+		}
+	}
+	writeSecretResponse(w, http.StatusOK, ConstructBatchResponse(apiVersionFromContext(r.Context()), body.IDs, dataKeys, errs))
+}
+
+// encrypt serves POST /encrypt?id=<id>, encrypting the base64 plaintext of the JSON body with the data key of id
+func encrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "data is encrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, id) {
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	esdk, ok := parseCiphertextFormat(w, r)
+	if !ok {
+		return
+	}
+
+	var body encryptRequest
+	if !parseEnvelopeRequest(w, r, &body) {
+		return
+	}
+
+	var ciphertext []byte
+	var dataKey *DataKey
+	var err error
+	if esdk {
+		ciphertext, dataKey, err = rkmsHandler.Load().EncryptESDK(r.Context(), id, body.Plaintext, encryptionContext)
+	} else {
+		ciphertext, dataKey, err = rkmsHandler.Load().Encrypt(r.Context(), id, body.Plaintext, encryptionContext)
+	}
+
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructEncryptResponse(dataKey, ciphertext)
+	fmt.Fprintln(w, resp)
+}
+
+// decrypt serves POST /decrypt, decrypting the base64 ciphertext of the JSON body with the data key it names
+func decrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "data is decrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	esdk, ok := parseCiphertextFormat(w, r)
+	if !ok {
+		return
+	}
+
+	var body decryptRequest
+	if !parseEnvelopeRequest(w, r, &body) {
+		return
+	}
+
+	if esdk {
+		plaintext, messageContext, err := rkmsHandler.Load().DecryptESDK(r.Context(), body.Ciphertext, encryptionContext)
+		if err != nil {
+			writeDataKeyError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		resp := ConstructDecryptESDKResponse(plaintext, messageContext)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	plaintext, dataKey, err := rkmsHandler.Load().Decrypt(r.Context(), body.Ciphertext, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructDecryptResponse(dataKey, plaintext)
+	fmt.Fprintln(w, resp)
+}
+
+// encryptStream serves POST /encrypt/stream?id=<id>, streaming the encryption of the raw body with the data key of id
+func encryptStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "data is encrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required")
+		fmt.Fprintln(w, resp)
+		return
+	}
+	if !checkRequestIDs(w, id) {
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	encrypter, err := rkmsHandler.Load().NewStreamEncrypter(r.Context(), id, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	startStream(w, encrypter.DataKey)
+	if err := encrypter.Encrypt(w, r.Body); err != nil {
+		abortStream(err)
+	}
+}
+
+// decryptStream serves POST /decrypt/stream, streaming the decryption of the raw body with the data key it names
+func decryptStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", "data is decrypted with POST")
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	encryptionContext, ok := parseEncryptionContext(w, r)
+	if !ok {
+		return
+	}
+
+	decrypter, err := rkmsHandler.Load().NewStreamDecrypter(r.Context(), r.Body, encryptionContext)
+	if err != nil {
+		writeDataKeyError(w, err)
+		return
+	}
+
+	startStream(w, decrypter.DataKey)
+	if err := decrypter.Decrypt(w); err != nil {
+		abortStream(err)
+	}
+}
+
+// startStream answers with the raw stream, while the rest of the body is being read
+func startStream(w http.ResponseWriter, dataKey *DataKey) {
+	//HTTP/1.x stops reading the body once the response starts otherwise
+	http.NewResponseController(w).EnableFullDuplex()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-RKMS-Key-ID", dataKey.ID)
+	w.Header().Set("X-RKMS-Key-Version", strconv.FormatInt(dataKey.Version, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// abortStream breaks the connection of a stream that failed after its status was sent, so that the client
+// can't take the truncated body for a complete one
+func abortStream(err error) {
+	logger.Errorf("aborting the stream: %s", err)
+	panic(http.ErrAbortHandler)
+}
+
+// parseCiphertextFormat reads the format query parameter of POST /encrypt and /decrypt, telling if the ciphertexts
+// are messages of the AWS Encryption SDK, and answers with a bad request for an unknown format
+func parseCiphertextFormat(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.URL.Query().Get("format") {
+	case "", "rkms":
+		return false, true
+	case "aws-encryption-sdk":
+		return true, true
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	resp := ConstructErrorResponse("BadRequest", "format query parameter must be rkms or aws-encryption-sdk")
+	fmt.Fprintln(w, resp)
+	return false, false
+}
+
+// parseEnvelopeRequest reads the JSON body of POST /encrypt and /decrypt, answering with a bad request if it isn't valid
+func parseEnvelopeRequest(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	//base64 makes the data a third larger, plus some room for the rest of the JSON
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(MaxEnvelopePlaintextSizeInBytes)+1024))
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("the body must be a JSON object with base64 data of at most %d bytes: %s", MaxEnvelopePlaintextSizeInBytes, err))
+		fmt.Fprintln(w, resp)
+		return false
+	}
+	return true
+}
+
+// parseEncryptionContext reads the encryption_context query parameter, a JSON object of strings,
+// answering with a bad request if it isn't one
+func parseEncryptionContext(w http.ResponseWriter, r *http.Request) (EncryptionContext, bool) {
+	value := r.URL.Query().Get("encryption_context")
+	if value == "" {
+		return nil, true
+	}
+
+	var encryptionContext EncryptionContext
+	if err := json.Unmarshal([]byte(value), &encryptionContext); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "encryption_context query parameter must be a JSON object of strings")
+		fmt.Fprintln(w, resp)
+		return nil, false
+	}
+	return encryptionContext, true
+}
+
+// parseIdempotencyKey reads the Idempotency-Key header, answering with a bad request if it is too long
+func parseIdempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	if len(idempotencyKey) > MaxIdempotencyKeyLength {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("%s header can't be longer than %d characters", IdempotencyKeyHeader, MaxIdempotencyKeyLength))
+		fmt.Fprintln(w, resp)
+		return "", false
+	}
+	return idempotencyKey, true
+}
+
+// checkRequestIDs answers a bad request when one of the ids of a request is reserved, see checkReservedID, telling
+// if none is
+func checkRequestIDs(w http.ResponseWriter, ids ...string) bool {
+	for _, id := range ids {
+		if err := checkReservedID(id); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", err.Error())
+			fmt.Fprintln(w, resp)
+			return false
+		}
+	}
+	return true
+}
+
+// writeDataKeyError answers with the status matching an error of RKMS
+func writeDataKeyError(w http.ResponseWriter, err error) {
+	//an action under dual control isn't failing, it waits for its approval
+	if pending, ok := err.(ApprovalRequiredError); ok {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, ConstructApprovalResponse(pending.Approval))
+		return
+	}
+
+	status, errorType := dataKeyErrorStatus(err)
+	errorsTotal.inc(errorType)
+	w.WriteHeader(status)
+	resp := ConstructErrorResponse(errorType, err.Error())
+	fmt.Fprintln(w, resp)
+}
+
+// dataKeyErrorStatus is the status and the error type matching an error of RKMS
+func dataKeyErrorStatus(err error) (int, string) {
+	status, errorType := http.StatusInternalServerError, "InternalServerError"
+	switch err.(type) {
+	case TTLNotSupportedError, ReservedIDError:
+		status, errorType = http.StatusBadRequest, "BadRequest"
+	case InvalidCiphertextError:
+		status, errorType = http.StatusBadRequest, "InvalidCiphertext"
+	case IDNotFoundStoreError, DataKeyVersionNotFoundError:
+		status, errorType = http.StatusNotFound, "NotFound"
+	case IDDeletedStoreError:
+		status, errorType = http.StatusGone, "Deleted"
+	case EncryptionContextMismatchError:
+		status, errorType = http.StatusForbidden, "EncryptionContextMismatch"
+	case IDNotPermittedError:
+		status, errorType = http.StatusForbidden, "Forbidden"
+	case InsufficientRegionsError:
+		status, errorType = http.StatusServiceUnavailable, "InsufficientRegions"
+	case CircuitOpenError:
+		status, errorType = http.StatusServiceUnavailable, "CircuitOpen"
+	case KeyStateError:
+		status, errorType = http.StatusForbidden, "InvalidKeyState"
+	case DataKeySplitError:
+		status, errorType = http.StatusConflict, "DataKeySplit"
+	case InvalidKeyPairSpecError, InvalidHMACKeySpecError, InvalidDerivationError:
+		status, errorType = http.StatusBadRequest, "BadRequest"
+	case InvalidMacError:
+		status, errorType = http.StatusBadRequest, "InvalidMac"
+	case InvalidKeyUsageError:
+		status, errorType = http.StatusConflict, "InvalidKeyUsage"
+	case CryptoperiodExpiredError:
+		status, errorType = http.StatusForbidden, "CryptoperiodExpired"
+	case InvalidCryptoperiodError:
+		status, errorType = http.StatusBadRequest, "BadRequest"
+	case KeyStateTransitionError:
+		status, errorType = http.StatusConflict, "InvalidKeyStateTransition"
+	case InvalidLabelsError:
+		status, errorType = http.StatusBadRequest, "BadRequest"
+	case IdempotencyKeyReusedError:
+		status, errorType = http.StatusUnprocessableEntity, "IdempotencyKeyReused"
+	case IdempotencyKeyInProgressError:
+		status, errorType = http.StatusConflict, "IdempotencyKeyInProgress"
+	case IdempotencyNotSupportedError:
+		status, errorType = http.StatusNotImplemented, "IdempotencyNotSupported"
+	case InvalidGrantError:
+		status, errorType = http.StatusBadRequest, "BadRequest"
+	case GrantsNotEnabledError:
+		status, errorType = http.StatusNotImplemented, "GrantsNotEnabled"
+	case ApprovalNotFoundError:
+		status, errorType = http.StatusNotFound, "NotFound"
+	case SelfApprovalError:
+		status, errorType = http.StatusForbidden, "SelfApproval"
+	case ApprovalsNotSupportedError:
+		status, errorType = http.StatusNotImplemented, "ApprovalsNotSupported"
+	}
+	return status, errorType
+}
+
+// getLiveness answers as long as the process serves requests, whatever the state of its dependencies
+func getLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, ConstructLivenessResponse())
+}
+
+// getReadiness answers 503 Service Unavailable while rkms can't serve data keys, with the outcome of every check
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	ready, checks := rkmsHandler.Load().Readiness(r.Context(), healthChecksEnabled.Load(), warmingUp.Load())
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+	resp := ConstructReadinessResponse(ready, checks)
+	fmt.Fprintln(w, resp)
+}
+
+func getProviderHealth(w http.ResponseWriter, r *http.Request) {
+	health := rkmsHandler.Load().ProviderHealth()
+
+	status := http.StatusOK
+	for _, provider := range health {
+		if !provider.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.WriteHeader(status)
+	resp := ConstructProviderHealthResponse(health)
 	fmt.Fprintln(w, resp)
 }
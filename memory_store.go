@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore - an in-memory implementation of a key/value store for KMS-related data.
+// Everything is lost when the process exits, so it is only meant for tests and local development.
+type MemoryStore struct {
+	mutex              sync.RWMutex
+	items              map[string]*item
+	idempotencyRecords map[string]*IdempotencyRecord
+	approvalRecords    map[string]*ApprovalRecord
+}
+
+func init() {
+	RegisterStore("memory", func(config *Configuration) (Store, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
+// NewMemoryStore creates a new, empty MemoryStore instance
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]*item), idempotencyRecords: make(map[string]*IdempotencyRecord), approvalRecords: make(map[string]*ApprovalRecord)}
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *MemoryStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetExpiringEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetExpiringEncryptedDataKeys retrieves the encrypted data keys for the given id along with the time they expire at
+func (s *MemoryStore) GetExpiringEncryptedDataKeys(ctx context.Context, id string) (map[string]string, time.Time, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	item := s.item(id)
+	if item == nil {
+		return nil, time.Time{}, nil
+	}
+
+	if item.deleted() {
+		return nil, time.Time{}, item.deletedError()
+	}
+
+	return copyKeys(item.Keys), item.expiresAt(), nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids
+func (s *MemoryStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make(map[string]map[string]string, len(ids))
+	for _, id := range ids {
+		if item := s.item(id); item != nil && !item.deleted() {
+			keys[id] = copyKeys(item.Keys)
+		}
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *MemoryStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	return s.setEncryptedDataKeysConditionally(id, &item{ID: id, Keys: copyKeys(encryptedKeysMap)})
+}
+
+// SetExpiringEncryptedDataKeysConditionally sets the encrypted data keys for the given id, expiring at expiresAt,
+// only if id does not exist in the store already or has expired
+func (s *MemoryStore) SetExpiringEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string, expiresAt time.Time) error {
+	return s.setEncryptedDataKeysConditionally(id, &item{ID: id, Keys: copyKeys(encryptedKeysMap), ExpiresAt: expiresAt.Unix()})
+}
+
+func (s *MemoryStore) setEncryptedDataKeysConditionally(id string, newItem *item) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.item(id) != nil {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	s.items[id] = newItem
+	return nil
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *MemoryStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	item := s.item(id)
+	if item == nil {
+		return nil, 0, nil
+	}
+
+	if item.deleted() {
+		return nil, 0, item.deletedError()
+	}
+
+	return copyKeys(item.Keys), item.Version, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *MemoryStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := s.item(id)
+	if err := checkVersion(id, item, expectedVersion); err != nil {
+		return err
+	}
+
+	item.Keys = copyKeys(encryptedKeysMap)
+	item.Version++
+	return nil
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *MemoryStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item := s.item(id); item != nil && !item.deleted() {
+		item.DeletedAt = time.Now().Unix()
+	}
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *MemoryStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := s.item(id)
+	if item == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	item.DeletedAt = 0
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *MemoryStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.items, id)
+	return nil
+}
+
+// ListIDs returns a page of the sorted ids in the store that are not deleted
+func (s *MemoryStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	ids, nextCursor := pageSortedIDs(s.listIDs(func(item *item) bool {
+		return !item.deleted()
+	}), cursor, limit)
+
+	return ids, nextCursor, nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time, sorted
+func (s *MemoryStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(func(item *item) bool {
+		return item.deletedBefore(deletedBefore)
+	}), nil
+}
+
+func (s *MemoryStore) listIDs(include func(item *item) bool) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	ids := make([]string, 0, len(s.items))
+	for id, item := range s.items {
+		if !item.expired(now) && include(item) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// SetIdempotencyRecordConditionally saves the given record only if its key has no unexpired record yet
+func (s *MemoryStore) SetIdempotencyRecordConditionally(ctx context.Context, record *IdempotencyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if current, found := s.idempotencyRecords[record.Key]; found && !current.expired(time.Now()) {
+		return IDAlreadyExistsStoreError{ID: record.Key}
+	}
+
+	copied := *record
+	s.idempotencyRecords[record.Key] = &copied
+	return nil
+}
+
+// SetIdempotencyRecord saves the given record, replacing the record of its key
+func (s *MemoryStore) SetIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *record
+	s.idempotencyRecords[record.Key] = &copied
+	return nil
+}
+
+// GetIdempotencyRecord retrieves the unexpired record of the given key
+func (s *MemoryStore) GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	record, found := s.idempotencyRecords[key]
+	if !found || record.expired(time.Now()) {
+		return nil, nil
+	}
+
+	copied := *record
+	return &copied, nil
+}
+
+// DeleteIdempotencyRecord removes the record of the given key
+func (s *MemoryStore) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.idempotencyRecords, key)
+	return nil
+}
+
+// SetApprovalRecord saves the given record under its approval id
+func (s *MemoryStore) SetApprovalRecord(ctx context.Context, record *ApprovalRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *record
+	s.approvalRecords[record.ApprovalID] = &copied
+	return nil
+}
+
+// GetApprovalRecord retrieves the unexpired record of the given approval id
+func (s *MemoryStore) GetApprovalRecord(ctx context.Context, approvalID string) (*ApprovalRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	record, found := s.approvalRecords[approvalID]
+	if !found || record.expired(time.Now()) {
+		return nil, nil
+	}
+
+	copied := *record
+	return &copied, nil
+}
+
+// ListApprovalRecords retrieves every unexpired approval record
+func (s *MemoryStore) ListApprovalRecords(ctx context.Context) ([]*ApprovalRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	records := make([]*ApprovalRecord, 0, len(s.approvalRecords))
+	for _, record := range s.approvalRecords {
+		if !record.expired(now) {
+			copied := *record
+			records = append(records, &copied)
+		}
+	}
+	return records, nil
+}
+
+// DeleteApprovalRecord removes the unexpired record of the given approval id
+func (s *MemoryStore) DeleteApprovalRecord(ctx context.Context, approvalID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, found := s.approvalRecords[approvalID]
+	delete(s.approvalRecords, approvalID)
+	if !found || record.expired(time.Now()) {
+		return IDNotFoundStoreError{ID: approvalID}
+	}
+	return nil
+}
+
+// item returns the item stored for id, nil if there is none or it has expired.
+// Expired items are left in place until they are set again or purged.
+func (s *MemoryStore) item(id string) *item {
+	item, found := s.items[id]
+	if !found || item.expired(time.Now()) {
+		return nil
+	}
+	return item
+}
+
+// copyKeys makes sure callers can't modify the maps held by the store
+func copyKeys(keys map[string]string) map[string]string {
+	copied := make(map[string]string, len(keys))
+	for region, ciphertext := range keys {
+		copied[region] = ciphertext
+	}
+	return copied
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreGetMissingID(t *testing.T) {
+	s := NewMemoryStore()
+
+	keys, err := s.GetEncryptedDataKeys(context.Background(), "id")
+	if err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+
+	if keys != nil {
+		t.Fatalf("should not have found keys for a missing id: %v", keys)
+	}
+}
+
+func TestMemoryStoreSetConditionally(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext-0", "region-1": "ciphertext-1"}
+
+	if err := s.SetEncryptedDataKeysConditionally(ctx, "id", keys); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("second write should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+
+	storedKeys, err := s.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+
+	if !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("first write should have won, got: %v", storedKeys)
+	}
+
+	storedKeys["region-0"] = "modified"
+	if storedKeys, _ = s.GetEncryptedDataKeys(ctx, "id"); storedKeys["region-0"] != "ciphertext-0" {
+		t.Fatalf("modifying a returned map should not change the store")
+	}
+}
+
+func TestMemoryStoreDeleteAndList(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	for _, id := range []string{"b", "a", "c"} {
+		if err := s.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id}); err != nil {
+			t.Fatalf("failed to set encrypted data keys: %s", err)
+		}
+	}
+
+	if err := s.DeleteEncryptedDataKeys(ctx, "b"); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	ids, cursor, err := s.ListIDs(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("failed to list ids: %s", err)
+	}
+
+	if !reflect.DeepEqual(ids, []string{"a", "c"}) || cursor != "" {
+		t.Fatalf("listed ids are wrong: %v (cursor %q)", ids, cursor)
+	}
+}
+
+func TestMemoryStoreListIDsPages(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	for _, id := range []string{"e", "b", "d", "a", "c"} {
+		s.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+
+	ids, cursor, _ := s.ListIDs(ctx, "", 2)
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) || cursor != "b" {
+		t.Fatalf("first page is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	ids, cursor, _ = s.ListIDs(ctx, cursor, 2)
+	if !reflect.DeepEqual(ids, []string{"c", "d"}) || cursor != "d" {
+		t.Fatalf("second page is wrong: %v (cursor %q)", ids, cursor)
+	}
+
+	ids, cursor, _ = s.ListIDs(ctx, cursor, 2)
+	if !reflect.DeepEqual(ids, []string{"e"}) || cursor != "" {
+		t.Fatalf("last page is wrong: %v (cursor %q)", ids, cursor)
+	}
+}
+
+func TestMemoryStoreSoftDelete(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"})
+
+	if err := s.DeleteEncryptedDataKeys(ctx, "id"); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	if _, err := s.GetEncryptedDataKeys(ctx, "id"); err == nil {
+		t.Fatalf("should not have returned keys of a deleted id")
+	} else if _, ok := err.(IDDeletedStoreError); !ok {
+		t.Fatalf("reading a deleted id should fail with IDDeletedStoreError, got: %v", err)
+	}
+
+	err := s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("a deleted id should not be recreated, got: %v", err)
+	}
+
+	if err := s.RestoreEncryptedDataKeys(ctx, "id"); err != nil {
+		t.Fatalf("failed to restore encrypted data keys: %s", err)
+	}
+
+	if keys, err := s.GetEncryptedDataKeys(ctx, "id"); err != nil || keys["region-0"] != "ciphertext" {
+		t.Fatalf("restored keys are wrong: %v, %v", keys, err)
+	}
+
+	if _, ok := s.RestoreEncryptedDataKeys(ctx, "missing").(IDNotFoundStoreError); !ok {
+		t.Fatalf("restoring a missing id should fail with IDNotFoundStoreError")
+	}
+}
+
+func TestPurgeDeletedEncryptedDataKeys(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	for _, id := range []string{"old", "recent", "live"} {
+		s.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+
+	s.DeleteEncryptedDataKeys(ctx, "old")
+	s.DeleteEncryptedDataKeys(ctx, "recent")
+	s.items["old"].DeletedAt = time.Now().Add(-48 * time.Hour).Unix()
+
+	purged, err := purgeDeletedEncryptedDataKeys(ctx, s, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to purge deleted ids: %s", err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("only the id deleted before the retention window should have been purged, purged: %d", purged)
+	}
+
+	if _, found := s.items["old"]; found {
+		t.Fatalf("old id should have been purged")
+	}
+
+	if _, found := s.items["recent"]; !found {
+		t.Fatalf("recently deleted id should still be restorable")
+	}
+}
+
+func TestMemoryStoreGetBatch(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c"} {
+		s.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id})
+	}
+	s.DeleteEncryptedDataKeys(ctx, "b")
+
+	keys, err := getEncryptedDataKeysBatch(ctx, s, []string{"a", "b", "c", "missing"})
+	if err != nil {
+		t.Fatalf("failed to batch get encrypted data keys: %s", err)
+	}
+
+	expected := map[string]map[string]string{"a": {"region-0": "a"}, "c": {"region-0": "c"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("deleted and missing ids should have been left out, got: %v", keys)
+	}
+}
+
+func TestMemoryStoreUpdateWithVersion(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	if err := s.UpdateEncryptedDataKeys(ctx, "id", map[string]string{"region-0": "rewrapped"}, 0); err == nil {
+		t.Fatalf("updating a missing id should have failed")
+	}
+
+	s.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"})
+	keys, version, err := s.GetVersionedEncryptedDataKeys(ctx, "id")
+	if err != nil || keys == nil || version != 0 {
+		t.Fatalf("new keys should be at version 0, got %d: %v", version, err)
+	}
+
+	if err := s.UpdateEncryptedDataKeys(ctx, "id", map[string]string{"region-0": "rewrapped"}, version); err != nil {
+		t.Fatalf("failed to update encrypted data keys: %s", err)
+	}
+
+	err = s.UpdateEncryptedDataKeys(ctx, "id", map[string]string{"region-0": "clobbered"}, version)
+	if _, ok := err.(VersionMismatchStoreError); !ok {
+		t.Fatalf("a stale update should have failed with VersionMismatchStoreError, got: %v", err)
+	}
+
+	keys, version, _ = s.GetVersionedEncryptedDataKeys(ctx, "id")
+	if keys["region-0"] != "rewrapped" || version != 1 {
+		t.Fatalf("the first update should have won, got %v at version %d", keys, version)
+	}
+
+	s.DeleteEncryptedDataKeys(ctx, "id")
+	if _, ok := s.UpdateEncryptedDataKeys(ctx, "id", keys, version).(IDDeletedStoreError); !ok {
+		t.Fatalf("updating a deleted id should have failed with IDDeletedStoreError")
+	}
+}
+
+func TestMemoryStoreExpiredKeysReadAsMissing(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(-time.Second)
+	if err := s.SetExpiringEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "expired"}, expiresAt); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	if keys, err := s.GetEncryptedDataKeys(ctx, "id"); err != nil || keys != nil {
+		t.Fatalf("expired keys should read as missing, got %v: %v", keys, err)
+	}
+
+	if ids, _, _ := s.ListIDs(ctx, "", 0); len(ids) != 0 {
+		t.Fatalf("expired ids should not be listed, got: %v", ids)
+	}
+
+	expiresAt = time.Now().Add(time.Hour)
+	if err := s.SetExpiringEncryptedDataKeysConditionally(ctx, "id", map[string]string{"region-0": "ciphertext"}, expiresAt); err != nil {
+		t.Fatalf("an expired id should be set again: %s", err)
+	}
+
+	keys, storedExpiresAt, err := s.GetExpiringEncryptedDataKeys(ctx, "id")
+	if err != nil || keys["region-0"] != "ciphertext" || storedExpiresAt.Unix() != expiresAt.Unix() {
+		t.Fatalf("keys should have been set to expire at %s, got %v expiring at %s: %v", expiresAt, keys, storedExpiresAt, err)
+	}
+}
+
+func TestMemoryStoreIdempotencyRecords(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	expired := &IdempotencyRecord{Key: "key", Fingerprint: "first", ExpiresAt: time.Now().Add(-time.Second).Unix()}
+	if err := s.SetIdempotencyRecordConditionally(ctx, expired); err != nil {
+		t.Fatalf("failed to set the idempotency record: %s", err)
+	}
+
+	if record, err := s.GetIdempotencyRecord(ctx, "key"); err != nil || record != nil {
+		t.Fatalf("an expired record should read as missing, got %v: %v", record, err)
+	}
+
+	record := &IdempotencyRecord{Key: "key", Fingerprint: "second", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	if err := s.SetIdempotencyRecordConditionally(ctx, record); err != nil {
+		t.Fatalf("the key of an expired record should be set again: %s", err)
+	}
+
+	if err := s.SetIdempotencyRecordConditionally(ctx, record); err != (IDAlreadyExistsStoreError{ID: "key"}) {
+		t.Fatalf("the key of an unexpired record should not be set again, got %v", err)
+	}
+
+	if ids, _, _ := s.ListIDs(ctx, "", 0); len(ids) != 0 {
+		t.Fatalf("the idempotency records should not be listed as ids, got: %v", ids)
+	}
+
+	s.DeleteIdempotencyRecord(ctx, "key")
+	if record, _ := s.GetIdempotencyRecord(ctx, "key"); record != nil {
+		t.Fatalf("the deleted record should read as missing, got %v", record)
+	}
+}
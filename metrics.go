@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLatencyBuckets are the upper bounds in seconds of the buckets of the latency histograms
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequestsTotal = newCounter("rkms_http_requests_total",
+		"Number of HTTP requests by endpoint and status code.", "endpoint", "code")
+	httpAPIVersionRequestsTotal = newCounter("rkms_http_api_version_requests_total",
+		"Number of HTTP API requests by API version, e.g. to follow the migration off a deprecated version.", "version")
+	httpRequestDuration = newHistogram("rkms_http_request_duration_seconds",
+		"Latency of the HTTP requests by endpoint.", defaultLatencyBuckets, "endpoint")
+	keyProviderRequestDuration = newHistogram("rkms_key_provider_request_duration_seconds",
+		"Latency of the calls to the key providers by region and operation.", defaultLatencyBuckets, "region", "operation")
+	keyProviderErrorsTotal = newCounter("rkms_key_provider_errors_total",
+		"Number of failed calls to the key providers by region and operation.", "region", "operation")
+	keyProviderRetriesTotal = newCounter("rkms_key_provider_retries_total",
+		"Number of retries of the calls to the key providers by region and operation.", "region", "operation")
+	hedgedDecryptsTotal = newCounter("rkms_hedged_decrypts_total",
+		"Number of decryptions hedged to a region, the previous regions not having answered within the hedge delay.", "region")
+	circuitBreakerOpenedTotal = newCounter("rkms_circuit_breaker_opened_total",
+		"Number of times the circuit breakers opened, by breaker.", "breaker")
+	storeRequestDuration = newHistogram("rkms_store_request_duration_seconds",
+		"Latency of the requests to the store backends by store, region and operation.", defaultLatencyBuckets, "store", "region", "operation")
+	storeErrorsTotal = newCounter("rkms_store_errors_total",
+		"Number of failed requests to the store backends by store, region and operation.", "store", "region", "operation")
+	storeRetriesTotal = newCounter("rkms_store_retries_total",
+		"Number of retries of the requests to the store by operation.", "operation")
+	cacheRequestsTotal = newCounter("rkms_cache_requests_total",
+		"Number of cache lookups by cache and result (hit or miss).", "cache", "result")
+	cacheEvictionsTotal = newCounter("rkms_cache_evictions_total",
+		"Number of cache entries evicted by cache and reason (size, expired or max_uses).", "cache", "reason")
+	cacheInvalidationFailuresTotal = newCounter("rkms_cache_invalidation_failures_total",
+		"Number of cache invalidations which failed to be published to the other replicas, by cache.", "cache")
+	errorsTotal = newCounter("rkms_errors_total",
+		"Number of errors answered by error type.", "class")
+	rateLimitedTotal = newCounter("rkms_rate_limited_requests_total",
+		"Number of requests rejected by the rate limiter, by the key they were limited by (identity, ip or tenant).", "by")
+	storeReplicatedIDsTotal = newCounter("rkms_store_replicated_ids_total",
+		"Number of ids mirrored into the replication target store, by operation (create, update, delete or failed).", "operation")
+	storeReplicationDuration = newHistogram("rkms_store_replication_duration_seconds",
+		"Duration of the passes replicating the store into the replication target store.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800})
+)
+
+// registeredMetrics are the metrics served on /metrics, in order
+var registeredMetrics []*metricVec
+
+// metricVec - a counter or histogram in the Prometheus text exposition format, with a value per set of label values
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	// the value of a counter, the number of observations of a histogram
+	count        float64
+	sum          float64
+	bucketCounts []uint64
+}
+
+func newCounter(name string, help string, labelNames ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, kind: "counter", labelNames: labelNames})
+}
+
+func newHistogram(name string, help string, buckets []float64, labelNames ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, kind: "histogram", labelNames: labelNames, buckets: buckets})
+}
+
+func registerMetric(m *metricVec) *metricVec {
+	m.values = make(map[string]*metricValue)
+	registeredMetrics = append(registeredMetrics, m)
+	return m
+}
+
+// value returns the value of the given label values, creating it the first time
+func (m *metricVec) value(labelValues []string) *metricValue {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, %d values given", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labelValues: labelValues, bucketCounts: make([]uint64, len(m.buckets))}
+		m.values[key] = v
+	}
+	return v
+}
+
+// inc adds one to a counter
+func (m *metricVec) inc(labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.value(labelValues).count++
+}
+
+// observe adds an observation to a histogram
+func (m *metricVec) observe(observation float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	v := m.value(labelValues)
+	v.count++
+	v.sum += observation
+	for i, bucket := range m.buckets {
+		if observation <= bucket {
+			v.bucketCounts[i]++
+		}
+	}
+}
+
+// write writes the metric in the Prometheus text exposition format, its values sorted by label values
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := m.values[key]
+		labels := m.formatLabels(v.labelValues, "")
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(v.count))
+			continue
+		}
+
+		for i, bucket := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(v.labelValues, formatFloat(bucket)), v.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, m.formatLabels(v.labelValues, "+Inf"), formatFloat(v.count))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, labels, formatFloat(v.count))
+	}
+}
+
+// formatLabels formats the label values, with the le label of a histogram bucket when le isn't empty
+func (m *metricVec) formatLabels(labelValues []string, le string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, m.labelNames[i]+`="`+escapeLabelValue(value)+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serveMetrics serves GET /metrics, every metric in the Prometheus text exposition format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registeredMetrics {
+		m.write(w)
+	}
+}
+
+// observeKeyProvider records the latency and the outcome of a call to the key provider of a region
+func observeKeyProvider(region string, operation string, start time.Time, err error) {
+	keyProviderRequestDuration.observe(time.Since(start).Seconds(), region, operation)
+	if err != nil {
+		keyProviderErrorsTotal.inc(region, operation)
+	}
+}
+
+// observeStore records the latency and the outcome of a request to a store backend
+func observeStore(store string, region string, operation string, start time.Time, err error) {
+	storeRequestDuration.observe(time.Since(start).Seconds(), store, region, operation)
+	if err != nil {
+		storeErrorsTotal.inc(store, region, operation)
+	}
+}
+
+// observeCache counts a cache lookup as a hit or a miss
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequestsTotal.inc(cache, result)
+}
+
+// statusRecorder - a http.ResponseWriter remembering the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts the requests of a handler by status code and records their latency, under the given endpoint.
+// Every request is traced in a span of its own.
+func instrument(endpoint string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, endSpan := startHTTPSpan(r, endpoint)
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			httpRequestsTotal.inc(endpoint, strconv.Itoa(status))
+			httpRequestDuration.observe(time.Since(start).Seconds(), endpoint)
+			endSpan(status)
+		}()
+
+		handler(recorder, r)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := &metricVec{name: "test_total", help: "Test counter.", kind: "counter", labelNames: []string{"class"}, values: make(map[string]*metricValue)}
+	counter.inc("b")
+	counter.inc(`a"\`)
+	counter.inc("b")
+
+	var b bytes.Buffer
+	counter.write(&b)
+	expected := "# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+		`test_total{class="a\"\\"} 1` + "\n" +
+		`test_total{class="b"} 2` + "\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected counter exposition:\n%s", b.String())
+	}
+
+	histogram := &metricVec{name: "test_seconds", help: "Test histogram.", kind: "histogram", labelNames: []string{"region"},
+		buckets: []float64{0.1, 1}, values: make(map[string]*metricValue)}
+	histogram.observe(0.05, "r1")
+	histogram.observe(0.5, "r1")
+	histogram.observe(2, "r1")
+
+	b.Reset()
+	histogram.write(&b)
+	expected = "# HELP test_seconds Test histogram.\n# TYPE test_seconds histogram\n" +
+		`test_seconds_bucket{region="r1",le="0.1"} 1` + "\n" +
+		`test_seconds_bucket{region="r1",le="1"} 2` + "\n" +
+		`test_seconds_bucket{region="r1",le="+Inf"} 3` + "\n" +
+		`test_seconds_sum{region="r1"} 2.55` + "\n" +
+		`test_seconds_count{region="r1"} 3` + "\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected histogram exposition:\n%s", b.String())
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	handler := instrument("test/instrument", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	recorder := httptest.NewRecorder()
+	serveMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `rkms_http_requests_total{endpoint="test/instrument",code="404"} 1`) {
+		t.Fatalf("the request should have been counted with its status code:\n%s", recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), `rkms_http_request_duration_seconds_count{endpoint="test/instrument"} 1`) {
+		t.Fatalf("the latency of the request should have been recorded:\n%s", recorder.Body.String())
+	}
+}
+
+func TestKeyProviderMetrics(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+	wrappedDataKey, err := r.GetWrappedDataKey(ctx, "metrics", 0, nil)
+	if err != nil {
+		t.Fatalf("was not able to get the ciphertexts: %s", err)
+	}
+
+	generated := []string{getTestRegionName(0), "GenerateDataKey"}
+	if value := keyProviderRequestDuration.values[strings.Join(generated, "\xff")]; value == nil || value.count < 1 {
+		t.Fatalf("the latency of the call generating the data key should have been recorded")
+	}
+
+	region := getTestRegionName(0)
+	keyID := getTestKeyID(region)
+	r.providers[region] = &AWSKMSProvider{&unavailableKMSClient{}, &keyID, nil, nil}
+	if _, _, err := r.DecryptCiphertext(ctx, "metrics", region, wrappedDataKey.Ciphertexts[region], nil); err != nil {
+		t.Fatalf("the ciphertext should have been decrypted in another region: %s", err)
+	}
+
+	failed := []string{region, "Decrypt"}
+	if value := keyProviderErrorsTotal.values[strings.Join(failed, "\xff")]; value == nil || value.count < 1 {
+		t.Fatalf("the failed call to the unavailable region should have been counted")
+	}
+}
@@ -0,0 +1,255 @@
+//go:build mongodb
+// +build mongodb
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MongoDBStore - a MongoDB implementation of a key/value store for KMS-related data.
+// The id is the document's _id, so the unique _id index makes the first write win.
+type MongoDBStore struct {
+	collection *mongo.Collection
+}
+
+type mongoDBDocument struct {
+	ID        string            `bson:"_id"`
+	Keys      map[string]string `bson:"keys"`
+	DeletedAt int64             `bson:"deleted_at,omitempty"`
+	Version   int64             `bson:"version,omitempty"`
+}
+
+func init() {
+	RegisterStore("mongodb", func(config *Configuration) (Store, error) {
+		return NewMongoDBStore(config.MongoDB)
+	})
+}
+
+// NewMongoDBStore creates a new MongoDBStore instance
+func NewMongoDBStore(mongoDBConfig MongoDBConfig) (*MongoDBStore, error) {
+	mode, err := readpref.ModeFromString(mongoDBConfig.ReadPreference)
+	if err != nil {
+		logStoreError(context.Background(), "mongodb", "NewMongoDBStore", "", err)
+		return nil, err
+	}
+
+	readPreference, err := readpref.New(mode)
+	if err != nil {
+		logStoreError(context.Background(), "mongodb", "NewMongoDBStore", "", err)
+		return nil, err
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(mongoDBConfig.URI).
+		SetReadPreference(readPreference).
+		SetWriteConcern(newMongoDBWriteConcern(mongoDBConfig.WriteConcern))
+
+	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		logStoreError(context.Background(), "mongodb", "NewMongoDBStore", "", err)
+		return nil, err
+	}
+
+	collection := client.Database(mongoDBConfig.Database).Collection(mongoDBConfig.Collection)
+	return &MongoDBStore{collection}, nil
+}
+
+func newMongoDBWriteConcern(writeConcern string) *writeconcern.WriteConcern {
+	if nodes, err := strconv.Atoi(writeConcern); err == nil {
+		return writeconcern.New(writeconcern.W(nodes), writeconcern.J(true))
+	}
+
+	return writeconcern.New(writeconcern.WTagSet(writeConcern), writeconcern.J(true))
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *MongoDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *MongoDBStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	document := mongoDBDocument{}
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "mongodb", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if document.DeletedAt != 0 {
+		return nil, 0, IDDeletedStoreError{ID: id, DeletedAt: time.Unix(document.DeletedAt, 0)}
+	}
+
+	return document.Keys, document.Version, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with a single query
+func (s *MongoDBStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	filter := bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$exists": false}}
+	cursor, err := s.collection.Find(ctx, filter)
+	if err != nil {
+		logStoreError(ctx, "mongodb", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := make(map[string]map[string]string, len(ids))
+	for cursor.Next(ctx) {
+		document := mongoDBDocument{}
+		if err := cursor.Decode(&document); err != nil {
+			logStoreError(ctx, "mongodb", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+		keys[document.ID] = document.Keys
+	}
+
+	return keys, cursor.Err()
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *MongoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	_, err := s.collection.InsertOne(ctx, mongoDBDocument{ID: id, Keys: encryptedKeysMap})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "mongodb", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *MongoDBStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	//documents that were never updated have no version field
+	var version interface{} = expectedVersion
+	if expectedVersion == 0 {
+		version = bson.M{"$exists": false}
+	}
+
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}, "version": version}
+	update := bson.M{"$set": bson.M{"keys": encryptedKeysMap}, "$inc": bson.M{"version": 1}}
+
+	result, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logStoreError(ctx, "mongodb", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	//the document tells why it wasn't updated
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if keys == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *MongoDBStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"deleted_at": time.Now().Unix()}}
+
+	if _, err := s.collection.UpdateOne(ctx, filter, update); err != nil {
+		logStoreError(ctx, "mongodb", "DeleteEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *MongoDBStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		logStoreError(ctx, "mongodb", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *MongoDBStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	if _, err := s.collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		logStoreError(ctx, "mongodb", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the collection that are not deleted, in id order
+func (s *MongoDBStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	filter := bson.M{"_id": bson.M{"$gt": cursor}, "deleted_at": bson.M{"$exists": false}}
+	//one more id than the limit is read to know whether there is a next page
+	findOptions := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit + 1))
+
+	ids, err := s.listIDs(ctx, filter, findOptions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) > limit {
+		return ids[:limit], ids[limit-1], nil
+	}
+
+	return ids, "", nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *MongoDBStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(ctx, bson.M{"deleted_at": bson.M{"$lt": deletedBefore.Unix()}}, options.Find())
+}
+
+func (s *MongoDBStore) listIDs(ctx context.Context, filter bson.M, findOptions *options.FindOptions) ([]string, error) {
+	cursor, err := s.collection.Find(ctx, filter, findOptions.SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		logStoreError(ctx, "mongodb", "listIDs", "", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ids := make([]string, 0)
+	for cursor.Next(ctx) {
+		document := mongoDBDocument{}
+		if err := cursor.Decode(&document); err != nil {
+			logStoreError(ctx, "mongodb", "listIDs", "", err)
+			return nil, err
+		}
+		ids = append(ids, document.ID)
+	}
+
+	return ids, cursor.Err()
+}
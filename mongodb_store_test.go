@@ -0,0 +1,18 @@
+//go:build mongodb
+// +build mongodb
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMongoDBStoreConformance(t *testing.T) {
+	uri := testStoreEnv(t, "RKMS_TEST_MONGODB_URI")
+	s, err := NewMongoDBStore(MongoDBConfig{URI: uri, Database: "rkms_test", Collection: "keys", WriteConcern: "majority", ReadPreference: "primary"})
+	if err != nil {
+		t.Fatalf("failed to create the mongodb store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
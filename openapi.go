@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the paths the OpenAPI specification of the HTTP API and its Swagger UI are served at
+const (
+	OpenAPIPath   = "/openapi.json"
+	SwaggerUIPath = "/docs"
+)
+
+// apiEndpoint - an endpoint of the HTTP API, as its OpenAPI specification describes it. The JSON bodies of its
+// request and of its responses are described by the fields of the types its handler decodes and encodes.
+type apiEndpoint struct {
+	method string
+	// relative to /api/<version> unless absolute, {id} standing for an id, which can contain slashes
+	path        string
+	absolute    bool
+	operationID string
+	summary     string
+	// the operation the caller has to be permitted, none for the probes
+	operation  string
+	parameters []apiParameter
+	request    interface{}
+	// the alternative bodies of its successful response, none for a 204 No Content
+	responses []interface{}
+	status    int
+	// the bodies are raw bytes, e.g. the streams
+	stream bool
+	// the response carries plaintext keys, which can be encrypted to the recipient public key of the request
+	secret bool
+	// the action can be under dual control, answering 202 Accepted with its pending approval
+	dualControl bool
+	// the bodies of its successful response under the API versions answering others than responses
+	versionResponses map[string][]interface{}
+}
+
+// apiParameter - a query, path or header parameter of an endpoint
+type apiParameter struct {
+	name        string
+	in          string
+	schema      string
+	description string
+	required    bool
+}
+
+// the parameters many endpoints share
+var (
+	idQueryParameter                = apiParameter{"id", "query", "string", "the id of the key", true}
+	idPathParameter                 = apiParameter{"id", "path", "string", "the id of the key, which can contain slashes", true}
+	encryptionContextQueryParameter = apiParameter{"encryption_context", "query", "string", "the encryption context, a JSON object of strings, the keys are bound to", false}
+	formatQueryParameter            = apiParameter{"format", "query", "string", "the format of the ciphertexts, rkms (default) or aws-encryption-sdk", false}
+)
+
+// apiEndpoints are the endpoints of the HTTP API, as routed by newServeMux
+var apiEndpoints = []apiEndpoint{
+	{method: http.MethodGet, path: "/key", operationID: "getKey", summary: "Get the latest data key of an id, created if there is none, or one of its versions",
+		operation: OperationGetKeys, secret: true, responses: []interface{}{getKeyResponse{}, wrappedKeyResponse{}},
+		parameters: []apiParameter{idQueryParameter,
+			{"ttl", "query", "integer", "the seconds the data key of a new id expires after", false},
+			{"version", "query", "integer", "the version of the data key, the latest by default", false},
+			{"wrapped", "query", "boolean", "answer the ciphertexts of the data key rather than its plaintext", false},
+			encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/key/decrypt", operationID: "decryptKey", summary: "Decrypt a ciphertext of a data key, e.g. of a wrapped key",
+		operation: OperationDecryptKeys, secret: true, request: decryptKeyRequest{}, responses: []interface{}{decryptKeyResponse{}},
+		parameters: []apiParameter{encryptionContextQueryParameter}},
+	{method: http.MethodGet, path: "/key-pair", operationID: "getKeyPair", summary: "Get the data key pair of an id, created if there is none, without its private key",
+		operation: OperationGetKeys, responses: []interface{}{dataKeyPairResponse{}},
+		parameters: []apiParameter{idQueryParameter, {"spec", "query", "string", "the key spec of a new key pair, e.g. ECC_NIST_P256", false}, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/key-pair/decrypt", operationID: "decryptKeyPair", summary: "Get the data key pair of an id along with its private key",
+		operation: OperationDecryptKeys, secret: true, responses: []interface{}{dataKeyPairResponse{}},
+		parameters: []apiParameter{idQueryParameter, encryptionContextQueryParameter}},
+	{method: http.MethodGet, path: "/keys", operationID: "listKeys", summary: "List the metadata of the keys, a page at a time",
+		operation: OperationGetKeys, responses: []interface{}{listKeysResponse{}},
+		parameters: []apiParameter{
+			{"labels", "query", "string", "only list the keys with these labels, a JSON object of strings", false},
+			{"limit", "query", "integer", "the number of keys of the page", false},
+			{"cursor", "query", "string", "the cursor of the previous page", false}}},
+	{method: http.MethodPost, path: "/keys/batch", operationID: "getKeysBatch", summary: "Get the data keys of many ids, or their ciphertexts with wrapped_only",
+		operation: OperationGetKeys, secret: true, request: batchRequest{}, responses: []interface{}{batchResultsResponse{}},
+		parameters: []apiParameter{encryptionContextQueryParameter}, versionResponses: map[string][]interface{}{APIVersion1: {batchResponse{}}}},
+	{method: http.MethodDelete, path: "/keys/{id}", operationID: "deleteKey", summary: "Schedule the deletion of a key once its waiting period is over",
+		operation: OperationManageKeys, dualControl: true, responses: []interface{}{keyMetadataResponse{}},
+		parameters: []apiParameter{idPathParameter, {"waiting_period_in_days", "query", "integer", "the days before the key is deleted", false}}},
+	{method: http.MethodPost, path: "/keys/{id}/rotate", operationID: "rotateKey", summary: "Generate a new version of the data key of an id",
+		operation: OperationRotateKeys, secret: true, responses: []interface{}{getKeyResponse{}},
+		parameters: []apiParameter{idPathParameter, encryptionContextQueryParameter,
+			{IdempotencyKeyHeader, "header", "string", "retries with the same key answer the same rotation", false}}},
+	{method: http.MethodGet, path: "/keys/{id}/metadata", operationID: "getKeyMetadata", summary: "Get the metadata of a key",
+		operation: OperationGetKeys, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPut, path: "/keys/{id}/labels", operationID: "setKeyLabels", summary: "Replace the labels of a key",
+		operation: OperationManageKeys, request: setKeyLabelsRequest{}, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPut, path: "/keys/{id}/cryptoperiod", operationID: "setKeyCryptoperiod", summary: "Set the cryptoperiod of a key",
+		operation: OperationManageKeys, request: setKeyCryptoperiodRequest{}, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/disable", operationID: "disableKey", summary: "Disable a key",
+		operation: OperationManageKeys, dualControl: true, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/enable", operationID: "enableKey", summary: "Enable a disabled key",
+		operation: OperationManageKeys, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/rewrap", operationID: "rewrapKey", summary: "Encrypt the data keys of a key again with the configured keys",
+		operation: OperationManageKeys, dualControl: true, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/cancel-deletion", operationID: "cancelKeyDeletion", summary: "Cancel the scheduled deletion of a key",
+		operation: OperationManageKeys, responses: []interface{}{keyMetadataResponse{}}, parameters: []apiParameter{idPathParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/derive", operationID: "deriveKey", summary: "Derive a sub-key of the data key of an id",
+		operation: OperationDeriveKeys, secret: true, request: deriveKeyRequest{}, responses: []interface{}{getKeyResponse{}},
+		parameters: []apiParameter{idPathParameter, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/mac", operationID: "generateMac", summary: "Generate the MAC of a message with the HMAC key of an id",
+		operation: OperationGenerateMac, request: macRequest{}, responses: []interface{}{macResponse{}},
+		parameters: []apiParameter{idPathParameter, {"spec", "query", "string", "the key spec of a new HMAC key, e.g. HMAC_256", false}, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/keys/{id}/verify", operationID: "verifyMac", summary: "Verify the MAC of a message with the HMAC key of an id",
+		operation: OperationVerifyMac, request: macRequest{}, responses: []interface{}{verifyMacResponse{}},
+		parameters: []apiParameter{idPathParameter, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/encrypt", operationID: "encrypt", summary: "Encrypt data with the data key of an id",
+		operation: OperationEncrypt, request: encryptRequest{}, responses: []interface{}{encryptResponse{}},
+		parameters: []apiParameter{idQueryParameter, formatQueryParameter, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/decrypt", operationID: "decrypt", summary: "Decrypt data with the data key its ciphertext names",
+		operation: OperationDecrypt, request: decryptRequest{}, responses: []interface{}{decryptResponse{}, decryptESDKResponse{}},
+		parameters: []apiParameter{formatQueryParameter, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/encrypt/stream", operationID: "encryptStream", summary: "Stream the encryption of the raw body with the data key of an id",
+		operation: OperationEncrypt, stream: true, parameters: []apiParameter{idQueryParameter, encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/decrypt/stream", operationID: "decryptStream", summary: "Stream the decryption of a raw encrypted stream",
+		operation: OperationDecrypt, stream: true, parameters: []apiParameter{encryptionContextQueryParameter}},
+	{method: http.MethodPost, path: "/grants", operationID: "createGrant", summary: "Mint a grant token delegating operations on an id",
+		operation: OperationCreateGrants, request: createGrantRequest{}, responses: []interface{}{grantResponse{}}, status: http.StatusCreated},
+	{method: http.MethodGet, path: "/approvals", operationID: "listApprovals", summary: "List the pending approvals of the actions under dual control",
+		operation: OperationManageKeys, responses: []interface{}{listApprovalsResponse{}}},
+	{method: http.MethodPost, path: "/approvals/{approval_id}/approve", operationID: "approveAction", summary: "Approve a pending action, applying it",
+		operation: OperationManageKeys, responses: []interface{}{keyMetadataResponse{}},
+		parameters: []apiParameter{{"approval_id", "path", "string", "the id of the approval", true}}},
+	{method: http.MethodPost, path: "/approvals/{approval_id}/reject", operationID: "rejectAction", summary: "Reject a pending action",
+		operation: OperationManageKeys, status: http.StatusNoContent,
+		parameters: []apiParameter{{"approval_id", "path", "string", "the id of the approval", true}}},
+	{method: http.MethodGet, path: "/healthz", absolute: true, operationID: "getLiveness", summary: "Tell if rkms is alive",
+		responses: []interface{}{livenessResponse{}}},
+	{method: http.MethodGet, path: "/readyz", absolute: true, operationID: "getReadiness", summary: "Tell if rkms can serve data keys, 503 when it can't",
+		responses: []interface{}{readinessResponse{}}},
+	{method: http.MethodGet, path: "/healthz/providers", absolute: true, operationID: "getProviderHealth", summary: "Report the health of the key providers",
+		responses: []interface{}{providerHealthResponse{}}},
+}
+
+// openAPISchemas builds the schemas of the components of a specification, a named struct being described once and
+// referenced by its name
+type openAPISchemas map[string]interface{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPIFieldAlternatives are the bodies of the fields of interface{} elements, by type and JSON name
+var openAPIFieldAlternatives = map[string][]interface{}{
+	"batchResponse.keys":      {getKeyResponse{}, wrappedKeyResponse{}},
+	"batchResultResponse.key": {getKeyResponse{}, wrappedKeyResponse{}},
+}
+
+// schemaName is the name of the component of a struct type, e.g. GetKeyResponse for getKeyResponse
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// schemaOf returns the schema of the JSON encoding of t, the way encoding/json marshals it
+func (schemas openAPISchemas) schemaOf(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == reflect.TypeOf(secretRef(0)):
+		return map[string]interface{}{"type": "string", "format": "byte", "description": "the base64 plaintext key, or its ciphertext when the request gave an " + RecipientPublicKeyHeader}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemas.schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemas.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.schemaOf(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			//the name is taken first, for the recursive types to reference themselves
+			schemas[name] = nil
+			schemas[name] = schemas.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	//interface{}, any JSON value
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of the JSON object of a struct, its fields being required unless omitempty
+func (schemas openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		if alternatives, ok := openAPIFieldAlternatives[t.Name()+"."+name]; ok && field.Type.Kind() == reflect.Slice {
+			properties[name] = map[string]interface{}{"type": "array", "items": schemas.oneOf(alternatives)}
+		} else if ok {
+			properties[name] = schemas.oneOf(alternatives)
+		} else {
+			properties[name] = schemas.schemaOf(field.Type)
+		}
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// oneOf returns the schema of the given alternative bodies
+func (schemas openAPISchemas) oneOf(bodies []interface{}) map[string]interface{} {
+	if len(bodies) == 1 {
+		return schemas.schemaOf(reflect.TypeOf(bodies[0]))
+	}
+
+	alternatives := make([]interface{}, 0, len(bodies))
+	for _, body := range bodies {
+		alternatives = append(alternatives, schemas.schemaOf(reflect.TypeOf(body)))
+	}
+	return map[string]interface{}{"oneOf": alternatives}
+}
+
+// jsonContent is the content of a JSON body of the given schema
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// streamContent is the content of a raw body
+var streamContent = map[string]interface{}{"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+
+// the headers of the decorator every endpoint but the probes takes
+var decoratorParameters = []interface{}{
+	map[string]interface{}{"$ref": "#/components/parameters/RequestID"},
+	map[string]interface{}{"$ref": "#/components/parameters/ReadConsistency"},
+	map[string]interface{}{"$ref": "#/components/parameters/KMSGrantTokens"},
+	map[string]interface{}{"$ref": "#/components/parameters/KMSAssumeRoleArn"},
+}
+
+// openAPIOperation returns the OpenAPI operation of the endpoint under the given API version, adding the schemas of
+// its bodies to schemas
+func (e apiEndpoint) openAPIOperation(schemas openAPISchemas, apiVersion string) map[string]interface{} {
+	parameters := append([]interface{}(nil), decoratorParameters...)
+	if e.secret {
+		parameters = append(parameters, map[string]interface{}{"$ref": "#/components/parameters/RecipientPublicKey"})
+	}
+	for _, p := range e.parameters {
+		parameters = append(parameters, map[string]interface{}{
+			"name": p.name, "in": p.in, "description": p.description, "required": p.required,
+			"schema": map[string]interface{}{"type": p.schema},
+		})
+	}
+
+	status := e.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case e.stream:
+		success["content"] = streamContent
+	case len(e.versionResponses[apiVersion]) > 0:
+		success["content"] = jsonContent(schemas.oneOf(e.versionResponses[apiVersion]))
+	case len(e.responses) > 0:
+		success["content"] = jsonContent(schemas.oneOf(e.responses))
+	}
+	if e.secret {
+		success["headers"] = map[string]interface{}{KeyEncryptionAlgorithmHeader: map[string]interface{}{
+			"description": "the algorithm the keys were encrypted to the recipient public key with, " + KeyEncryptionAlgorithmHPKE + " or " + KeyEncryptionAlgorithmRSAAES,
+			"schema":      map[string]interface{}{"type": "string"},
+		}}
+	}
+
+	responses := map[string]interface{}{strconv.Itoa(status): success, "default": map[string]interface{}{"$ref": "#/components/responses/Error"}}
+	if e.dualControl {
+		responses[strconv.Itoa(http.StatusAccepted)] = map[string]interface{}{
+			"description": "the action is under dual control, and waits for its approval",
+			"content":     jsonContent(schemas.schemaOf(reflect.TypeOf(approvalResponse{}))),
+		}
+	}
+
+	operation := map[string]interface{}{"operationId": e.operationID, "summary": e.summary, "parameters": parameters, "responses": responses}
+	if e.request != nil {
+		operation["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(schemas.schemaOf(reflect.TypeOf(e.request)))}
+	} else if e.stream {
+		operation["requestBody"] = map[string]interface{}{"required": true, "content": streamContent}
+	}
+
+	if e.operation == "" {
+		operation["security"] = []interface{}{}
+		return operation
+	}
+	operation["x-rkms-operation"] = e.operation
+	operation["description"] = fmt.Sprintf("When the API is authenticated, the caller has to be permitted %s.", e.operation)
+	if e.dualControl {
+		operation["description"] = operation["description"].(string) + " The action answers 202 Accepted when it is under dual control."
+	}
+	return operation
+}
+
+// newOpenAPISpec generates the OpenAPI 3 specification of the HTTP API of the given version, as JSON
+func newOpenAPISpec(apiVersion string) []byte {
+	schemas := make(openAPISchemas)
+	paths := make(map[string]map[string]interface{})
+	for _, e := range apiEndpoints {
+		path := e.path
+		if !e.absolute {
+			path = apiPath(apiVersion, path)
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(e.method)] = e.openAPIOperation(schemas, apiVersion)
+	}
+
+	headerParameter := func(name string, description string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "in": "header", "description": description, "required": false, "schema": map[string]interface{}{"type": "string"}}
+	}
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "RKMS",
+			"version": apiVersion,
+			"description": "The HTTP API of RKMS (Reliable Key Management Service), which generates, stores and serves data keys " +
+				"encrypted by key providers in many regions.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"parameters": map[string]interface{}{
+				"RequestID":          headerParameter(RequestIDHeader, "the id of the request, generated when it has none, logged and answered in the same header"),
+				"ReadConsistency":    headerParameter(ReadConsistencyHeader, "the consistency of the reads of the store, eventual or strong"),
+				"KMSGrantTokens":     headerParameter(KMSGrantTokensHeader, "the KMS grant tokens the calls to AWS KMS are made with, separated by commas"),
+				"KMSAssumeRoleArn":   headerParameter(KMSAssumeRoleARNHeader, "the IAM role the calls to AWS KMS are made by"),
+				"RecipientPublicKey": headerParameter(RecipientPublicKeyHeader, "the base64 X25519 or RSA public key the keys of the response are encrypted to"),
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "the request failed, with the type and the message of its error",
+					"content":     jsonContent(schemas.schemaOf(reflect.TypeOf(errorResponse{}))),
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey":        map[string]interface{}{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer":        map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"authorization": map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization", "description": "an " + IAMAuthScheme + " signed IAM request, or a " + GrantAuthScheme + " token"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{},
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"authorization": []string{}},
+		},
+	}
+
+	b, _ := json.MarshalIndent(spec, "", "  ")
+	return b
+}
+
+// serveOpenAPISpec serves the OpenAPI specification of the HTTP API, generated once
+func serveOpenAPISpec(apiVersion string) func(http.ResponseWriter, *http.Request) {
+	spec := newOpenAPISpec(apiVersion)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(spec)
+	}
+}
+
+// swaggerUIPage is the Swagger UI of the OpenAPI specification, its assets being loaded from the jsDelivr CDN
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>RKMS API</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "` + OpenAPIPath + `", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// serveSwaggerUI serves the Swagger UI of the OpenAPI specification
+func serveSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, swaggerUIPage)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpecDescribesTheRoutes(t *testing.T) {
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	b := newOpenAPISpec("v2")
+	if err := json.Unmarshal(b, &spec); err != nil || spec.OpenAPI != "3.0.3" {
+		t.Fatalf("the specification should have been OpenAPI 3 JSON, got %v", err)
+	}
+
+	mux := newServeMux(nil, 0, false)
+	for path, operations := range spec.Paths {
+		if !strings.HasPrefix(path, "/api/v2/") && !strings.HasPrefix(path, "/healthz") && path != "/readyz" {
+			t.Errorf("%s should have been under the API version", path)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, strings.NewReplacer("{id}", "team/id", "{approval_id}", "approval").Replace(path), nil)
+		if _, pattern := mux.Handler(r); pattern == "" {
+			t.Errorf("%s isn't routed by the mux", path)
+		}
+		for method, operation := range operations {
+			if operation["operationId"] == "" || operation["responses"] == nil {
+				t.Errorf("%s %s should have had an operationId and responses", method, path)
+			}
+		}
+	}
+	if len(spec.Paths["/api/v2/keys/{id}"]) != 1 || spec.Paths["/api/v2/keys/{id}"]["delete"] == nil {
+		t.Fatalf("the deletion of the keys should have been described")
+	}
+
+	//every reference is to a component of the specification
+	for _, ref := range strings.Split(string(b), `"$ref": "#/components/schemas/`)[1:] {
+		name := ref[:strings.IndexByte(ref, '"')]
+		if spec.Components.Schemas[name] == nil {
+			t.Errorf("the schema %s is referenced but not described", name)
+		}
+	}
+
+	getKey, _ := json.Marshal(spec.Components.Schemas["GetKeyResponse"])
+	if !strings.Contains(string(getKey), `"key":{"description"`) || !strings.Contains(string(getKey), `"required":["id","key","version"]`) {
+		t.Fatalf("the schema of a key should have been the one of its JSON encoding, got %s", getKey)
+	}
+
+	if v1 := newOpenAPISpec(APIVersion1); !strings.Contains(string(v1), `"$ref": "#/components/schemas/BatchResponse"`) || strings.Contains(string(b), `"$ref": "#/components/schemas/BatchResponse"`) {
+		t.Fatalf("the batches should have been described with the response of their API version")
+	}
+}
+
+func TestServeMuxServesOpenAPISpec(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	newServeMux(nil, 0, false).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" || !json.Valid(recorder.Body.Bytes()) {
+		t.Fatalf("the specification should have been served, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	newServeMux(nil, 0, false).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, SwaggerUIPath, nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("the Swagger UI shouldn't have been served unless enabled, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	newServeMux(nil, 0, true).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, SwaggerUIPath, nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), OpenAPIPath) {
+		t.Fatalf("the Swagger UI of the specification should have been served, got %d", recorder.Code)
+	}
+}
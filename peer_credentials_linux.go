@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// connPeerCredentials reads the credentials of the process at the other end of conn with SO_PEERCRED, those it
+// had when it connected
+func connPeerCredentials(conn *net.UnixConn) (*peerCredentials, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var sockoptErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, sockoptErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		return nil, sockoptErr
+	}
+	return &peerCredentials{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// connPeerCredentials reads the credentials of the process at the other end of conn. SO_PEERCRED is only read on
+// Linux: elsewhere the callers of the Unix domain socket are only authenticated by their credentials.
+func connPeerCredentials(conn *net.UnixConn) (*peerCredentials, error) {
+	return nil, errors.New("peer credentials are only read on Linux")
+}
@@ -0,0 +1,200 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11GCMNonceSize and pkcs11GCMTagBits are the AES-GCM parameters data keys are wrapped with
+const (
+	pkcs11GCMNonceSize = 12
+	pkcs11GCMTagBits   = 128
+)
+
+// PKCS11Provider - a KeyProvider wrapping data keys with an AES key held in a PKCS#11 HSM
+// (SoftHSM, Luna, the CloudHSM client...). The key id is the label of the key in the configured token,
+// the region is only a name for it in the redundancy set.
+//
+// Data keys are encrypted with AES-GCM, the ciphertexts being the nonce followed by the encrypted key,
+// and the encryption context being the additional authenticated data.
+// PKCS#11 sessions can't be shared by concurrent operations, so the provider serializes them on its session.
+type PKCS11Provider struct {
+	module  *pkcs11.Ctx
+	mutex   sync.Mutex
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	label   string
+}
+
+func init() {
+	RegisterKeyProvider("pkcs11", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return NewPKCS11Provider(keyID, kmsConfig.PKCS11)
+	})
+}
+
+// NewPKCS11Provider creates a new PKCS11Provider instance for the key with the given label,
+// logging in the token as the user
+func NewPKCS11Provider(label string, pkcs11Config PKCS11Config) (*PKCS11Provider, error) {
+	module := pkcs11.New(pkcs11Config.Module)
+	if module == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", pkcs11Config.Module)
+	}
+
+	//the module is shared by the providers of every region using it, so it may already be initialized
+	if err := module.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, err
+	}
+
+	slot, err := findPKCS11Slot(module, pkcs11Config.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := module.Login(session, pkcs11.CKU_USER, pkcs11Config.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return nil, err
+	}
+
+	key, err := findPKCS11Key(module, session, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PKCS11Provider{module: module, session: session, key: key, label: label}, nil
+}
+
+// findPKCS11Slot returns the slot of the token with the given label
+func findPKCS11Slot(module *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		info, err := module.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+
+		if info.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no PKCS#11 token is labeled %s", tokenLabel)
+}
+
+// findPKCS11Key returns the secret key with the given label
+func findPKCS11Key(module *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	if err := module.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+
+	keys, _, err := module.FindObjects(session, 2)
+	if finalErr := module.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(keys) != 1 {
+		return 0, fmt.Errorf("found %d PKCS#11 secret keys labeled %s, expected one", len(keys), label)
+	}
+
+	return keys[0], nil
+}
+
+// GenerateDataKey creates a new data key of the given size.
+// The data key is generated locally and encrypted, as it has to leave the HSM anyway.
+func (p *PKCS11Provider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with AES-GCM in the HSM
+func (p *PKCS11Provider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	nonce := make([]byte, pkcs11GCMNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	params := pkcs11.NewGCMParams(nonce, encryptionContext.AAD(), pkcs11GCMTagBits)
+	defer params.Free()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.module.EncryptInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, p.key); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := p.module.Encrypt(p.session, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, ciphertext...), nil
+}
+
+// Decrypt unwraps the given data key with AES-GCM in the HSM
+func (p *PKCS11Provider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	if len(ciphertext) < pkcs11GCMNonceSize {
+		return nil, fmt.Errorf("the ciphertext is too short to have been encrypted by PKCS#11 key %s", p.label)
+	}
+
+	params := pkcs11.NewGCMParams(ciphertext[:pkcs11GCMNonceSize], encryptionContext.AAD(), pkcs11GCMTagBits)
+	defer params.Free()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.module.DecryptInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, p.key); err != nil {
+		return nil, err
+	}
+
+	return p.module.Decrypt(p.session, ciphertext[pkcs11GCMNonceSize:])
+}
+
+// DescribeKey tells about the key, which is enabled as long as it can encrypt
+func (p *PKCS11Provider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	attributes, err := p.module.GetAttributeValue(p.session, p.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, nil),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := len(attributes) == 1 && len(attributes[0].Value) == 1 && attributes[0].Value[0] != 0
+	return &KeyDescription{ID: p.label, Enabled: enabled}, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *PKCS11Provider) ProviderType() string {
+	return "pkcs11"
+}
+
+// WrappingAlgorithm is the algorithm the HSM wraps with
+func (p *PKCS11Provider) WrappingAlgorithm() string {
+	return "AES_GCM"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxPlaintextCacheTTLInSeconds bounds how long a plaintext data key can be cached for
+const MaxPlaintextCacheTTLInSeconds = 3600
+
+// plaintextCache - caches the plaintext data keys decrypted for the requests, for the hot ids not to need a
+// decryption by a key provider on every request, the way the caching CMM of the AWS Encryption SDK does.
+// A plaintext is cached for its TTL and served maxUses times at most, 0 leaving it unbounded, the least recently
+// used ones being evicted past maxEntries. The cached plaintexts are SecureBytes in locked memory, destroyed on
+// eviction, every request being handed its own copy. A nil plaintextCache caches nothing.
+type plaintextCache struct {
+	maxUses int
+
+	mutex   sync.Mutex
+	entries *lruCache
+}
+
+type cachedPlaintext struct {
+	data *SecureBytes
+	uses int
+}
+
+// newPlaintextCache creates the plaintext cache config sets, nil when it is disabled
+func newPlaintextCache(config PlaintextCacheConfig) *plaintextCache {
+	if config.MaxEntries <= 0 {
+		return nil
+	}
+
+	ttl := time.Duration(config.TTLInSeconds) * time.Second
+	c := &plaintextCache{maxUses: config.MaxUses, entries: newLRUCache("plaintext", config.MaxEntries, 0, ttl, ttl, nil)}
+	c.entries.onEvict = func(key string, value interface{}) {
+		value.(*cachedPlaintext).data.Destroy()
+	}
+	return c
+}
+
+// plaintextCacheKey is the key the plaintext of the given encrypted data keys is cached under: a digest of their
+// ciphertexts and of the encryption context they are bound to, for a data key rotated, rewrapped or bound to another
+// encryption context never to be served from the plaintext of another
+func plaintextCacheKey(encryptedDataKeys map[string]string, encryptionContext EncryptionContext) string {
+	regions := make([]string, 0, len(encryptedDataKeys))
+	for region := range encryptedDataKeys {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	digest := sha256.New()
+	for _, region := range regions {
+		digest.Write([]byte(region + "\x00" + encryptedDataKeys[region] + "\x00"))
+	}
+	digest.Write(encryptionContext.AAD())
+	return string(digest.Sum(nil))
+}
+
+// get returns a copy of the plaintext cached under key, for the caller to destroy, counting the use
+func (c *plaintextCache) get(key string) (*SecureBytes, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, found := c.entries.Get(key)
+	observeCache("plaintext", found)
+	if !found {
+		return nil, false
+	}
+
+	cached := value.(*cachedPlaintext)
+	cached.uses++
+	plaintext := cached.data.Clone()
+	if c.maxUses > 0 && cached.uses >= c.maxUses {
+		c.entries.Delete(key)
+		cacheEvictionsTotal.inc("plaintext", "max_uses")
+	}
+	return plaintext, true
+}
+
+// put caches a copy of plaintext under key, the request which decrypted it being its first use. It isn't cached
+// when locked memory can't be allocated for it.
+func (c *plaintextCache) put(key string, plaintext *SecureBytes) {
+	if c == nil || (c.maxUses > 0 && c.maxUses <= 1) {
+		return
+	}
+
+	data := plaintext.Clone()
+	if !data.locked {
+		data.Destroy()
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Set(key, &cachedPlaintext{data: data, uses: 1}, 0)
+}
+
+// purgePlaintextCache zeroes and evicts the plaintexts r cached, if there is an r
+func (r *RKMS) purgePlaintextCache() {
+	if r != nil {
+		r.plaintextCache.purge()
+	}
+}
+
+// purge zeroes and evicts every cached plaintext
+func (c *plaintextCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Purge()
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func getPlaintextCachingRKMS(config PlaintextCacheConfig) (*RKMS, *delayedKeyProvider) {
+	r := getRKMS([]bool{true})
+	r.store.(*mockStore).dataShouldExist = true
+	provider := &delayedKeyProvider{}
+	r.providers["region-0"] = provider
+	r.plaintextCache = newPlaintextCache(config)
+	return r, provider
+}
+
+func TestPlaintextCacheServesHotIDs(t *testing.T) {
+	r, provider := getPlaintextCachingRKMS(PlaintextCacheConfig{MaxEntries: 10, TTLInSeconds: 60})
+	defer r.purgePlaintextCache()
+
+	for i := 0; i < 3; i++ {
+		dataKey, err := r.GetDataKey(context.Background(), "id", 0, nil)
+		if err != nil || string(dataKey.Plaintext.Bytes()) != "ciphertext" {
+			t.Fatalf("failed to get the data key: %v", err)
+		}
+	}
+	if provider.calls != 1 {
+		t.Fatalf("the data key should have been decrypted once, got %d decryptions", provider.calls)
+	}
+
+	//the encryption context is checked before the cache is
+	if _, err := r.GetDataKey(context.Background(), "id", 0, EncryptionContext{"tenant": "a"}); err == nil || provider.calls != 1 {
+		t.Fatalf("the data key shouldn't have been served for another encryption context, got %d decryptions: %v", provider.calls, err)
+	}
+}
+
+func TestPlaintextCacheMaxUses(t *testing.T) {
+	r, provider := getPlaintextCachingRKMS(PlaintextCacheConfig{MaxEntries: 10, TTLInSeconds: 60, MaxUses: 2})
+	defer r.purgePlaintextCache()
+
+	for i := 0; i < 4; i++ {
+		if _, err := r.GetDataKey(context.Background(), "id", 0, nil); err != nil {
+			t.Fatalf("failed to get the data key: %s", err)
+		}
+	}
+	if provider.calls != 2 {
+		t.Fatalf("the data key should have been decrypted again once used twice, got %d decryptions", provider.calls)
+	}
+}
+
+func TestPlaintextCacheExpires(t *testing.T) {
+	c := newPlaintextCache(PlaintextCacheConfig{MaxEntries: 10, TTLInSeconds: 60})
+	defer c.purge()
+	c.entries.defaultExpiration = time.Millisecond
+
+	c.put("key", secureBytesOf([]byte("plaintext")))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("key"); ok || c.entries.Len() != 0 {
+		t.Fatalf("the expired plaintext should have been evicted")
+	}
+}
+
+func TestPlaintextCacheDisabled(t *testing.T) {
+	if c := newPlaintextCache(PlaintextCacheConfig{TTLInSeconds: 60}); c != nil {
+		t.Fatalf("the plaintext cache should be disabled without max_entries")
+	}
+
+	var c *plaintextCache
+	c.put("key", secureBytesOf([]byte("plaintext")))
+	if _, ok := c.get("key"); ok {
+		t.Fatalf("a disabled cache should cache nothing")
+	}
+}
+
+func TestLockedBytesAreZeroed(t *testing.T) {
+	b, err := allocLockedBytes(16)
+	if err != nil {
+		t.Skipf("memory can't be locked here: %s", err)
+	}
+	copy(b, "plaintext")
+	zeroBytes(b)
+	for _, c := range b {
+		if c != 0 {
+			t.Fatalf("the bytes should have been zeroed")
+		}
+	}
+	freeLockedBytes(b)
+}
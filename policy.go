@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// IDNotPermittedError is returned when the caller of a request isn't permitted its operation on one of its ids
+type IDNotPermittedError struct {
+	Identity  string
+	Operation string
+	ID        string
+}
+
+func (e IDNotPermittedError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("%s is not permitted %s on messages of no id", e.Identity, e.Operation)
+	}
+	return fmt.Sprintf("%s is not permitted %s on %s", e.Identity, e.Operation, e.ID)
+}
+
+// ReservedIDError is returned for an id starting with a prefix the store keeps its own records under, which the
+// data key of the id would otherwise be read from and overwritten by
+type ReservedIDError struct {
+	ID     string
+	Prefix string
+}
+
+func (e ReservedIDError) Error() string {
+	return fmt.Sprintf("id %q is reserved, ids can't start with %q", e.ID, e.Prefix)
+}
+
+// reservedIDPrefixes are the prefixes of the ids of the records stored along with the data keys, e.g. the
+// idempotency and the approval records of DynamoDB
+var reservedIDPrefixes = []string{dynamoDBIdempotencyRecordPrefix, dynamoDBApprovalRecordPrefix}
+
+// checkReservedID returns a ReservedIDError when id starts with one of reservedIDPrefixes
+func checkReservedID(id string) error {
+	for _, prefix := range reservedIDPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return ReservedIDError{ID: id, Prefix: prefix}
+		}
+	}
+	return nil
+}
+
+// permissionRule - operations an identity is permitted, on the ids matching one of the patterns of ids, on every
+// id when there is none
+type permissionRule struct {
+	operations map[string]bool
+	ids        []string
+}
+
+func (rule permissionRule) permits(operation string) bool {
+	return rule.operations[operation] || rule.operations[OperationAll]
+}
+
+func (rule permissionRule) permitsID(id string) bool {
+	if len(rule.ids) == 0 {
+		return true
+	}
+
+	for _, pattern := range rule.ids {
+		if id != "" && matchIDPattern(pattern, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIDPattern tells if id matches pattern, "*" matching any sequence of characters, "/" included
+func matchIDPattern(pattern string, id string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == id
+	}
+
+	if !strings.HasPrefix(id, parts[0]) {
+		return false
+	}
+	id = id[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(id, part)
+		if i < 0 {
+			return false
+		}
+		id = id[i+len(part):]
+	}
+	return len(id) >= len(last) && strings.HasSuffix(id, last)
+}
+
+// authorizeID returns an IDNotPermittedError when the caller of ctx isn't permitted the operation of its request
+// on id, or when id is out of the namespace of its tenant. It is called before the data key of an id is read,
+// created, rotated or decrypted, whatever the API the request came from. Without a caller, for the background jobs
+// or when the API isn't authenticated, every id is permitted but the reserved ones, which are a ReservedIDError
+// whatever the caller.
+func authorizeID(ctx context.Context, id string) error {
+	if err := checkReservedID(id); err != nil {
+		return err
+	}
+
+	c, ok := ctx.Value(callerContextKey{}).(caller)
+	if !ok {
+		return nil
+	}
+
+	if c.grant != nil && (c.grant.KeyID != id || !c.grant.permits(c.operation)) {
+		return IDNotPermittedError{Identity: c.identity, Operation: c.operation, ID: id}
+	}
+	if c.tenant != "" && !inTenantNamespace(c.tenant, id) {
+		return IDNotPermittedError{Identity: c.identity, Operation: c.operation, ID: id}
+	}
+	if !c.authenticator.PermittedID(c.identity, c.operation, id) {
+		return IDNotPermittedError{Identity: c.identity, Operation: c.operation, ID: id}
+	}
+	return nil
+}
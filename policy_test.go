@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMatchIDPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		id      string
+		matches bool
+	}{
+		{"team-a/*", "team-a/user-1", true},
+		{"team-a/*", "team-a/users/1", true},
+		{"team-a/*", "team-b/user-1", false},
+		{"team-a/*", "team-a", false},
+		{"*/shared", "team-a/shared", true},
+		{"*/shared", "team-a/shared/1", false},
+		{"team-*/keys/*", "team-a/keys/1", true},
+		{"team-*/keys/*", "team-a/other/1", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"*", "anything", true},
+	}
+
+	for _, test := range tests {
+		if matches := matchIDPattern(test.pattern, test.id); matches != test.matches {
+			t.Errorf("expected %q matching %q to be %t", test.pattern, test.id, test.matches)
+		}
+	}
+}
+
+func getTestPolicyAuthenticator(t *testing.T) *Authenticator {
+	a, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{{Identity: "team-a", KeySHA256: apiKeySHA256("secret")}},
+		Permissions: []PermissionConfig{
+			{Identity: "team-a", Operations: []string{OperationGetKeys, OperationRotateKeys}, IDs: []string{"team-a/*"}},
+			{Identity: "team-a", Operations: []string{OperationGetKeys}, IDs: []string{"shared/*"}},
+			{Identity: "admin", Operations: []string{OperationAll}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	return a
+}
+
+func TestPermittedID(t *testing.T) {
+	a := getTestPolicyAuthenticator(t)
+
+	if !a.PermittedID("team-a", OperationRotateKeys, "team-a/1") || a.PermittedID("team-a", OperationRotateKeys, "shared/1") {
+		t.Fatalf("team-a should only be permitted to rotate its own keys")
+	}
+
+	if !a.PermittedID("team-a", OperationGetKeys, "shared/1") || a.PermittedID("team-a", OperationGetKeys, "team-b/1") {
+		t.Fatalf("team-a should be permitted to get its own and the shared keys only")
+	}
+
+	if a.PermittedID("team-a", OperationGetKeys, "") || !a.PermittedID("admin", OperationDecrypt, "") {
+		t.Fatalf("only the rules without ids should permit the operations on no id")
+	}
+}
+
+func TestAuthorizeIDBeforeTheStore(t *testing.T) {
+	beforeTest()
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := withCaller(context.Background(), getTestPolicyAuthenticator(t), "team-a", OperationGetKeys)
+
+	if _, err := r.GetDataKey(ctx, "team-a/1", 0, nil); err != nil {
+		t.Fatalf("team-a should have been able to create its key: %s", err)
+	}
+
+	if _, err := r.GetDataKey(ctx, "team-b/1", 0, nil); err != (IDNotPermittedError{"team-a", OperationGetKeys, "team-b/1"}) {
+		t.Fatalf("team-a shouldn't have been able to create a key of team-b, got %v", err)
+	}
+	if keys, _ := r.store.GetEncryptedDataKeys(context.Background(), "team-b/1"); keys != nil {
+		t.Fatalf("the key of team-b shouldn't have been created")
+	}
+
+	dataKeys, errs := r.GetDataKeys(ctx, []string{"team-a/1", "shared/1", "team-b/1"}, nil)
+	if dataKeys["team-a/1"] == nil || dataKeys["shared/1"] == nil {
+		t.Fatalf("the permitted keys should have been returned, got errors %v", errs)
+	}
+	if _, ok := errs["team-b/1"].(IDNotPermittedError); !ok || len(errs) != 1 {
+		t.Fatalf("the key of team-b should have failed with an IDNotPermittedError, got %v", errs)
+	}
+
+	rotateCtx := withCaller(context.Background(), getTestPolicyAuthenticator(t), "team-a", OperationRotateKeys)
+	if _, err := r.RotateDataKey(rotateCtx, "shared/1", nil); err == nil {
+		t.Fatalf("team-a shouldn't have been able to rotate a shared key")
+	}
+
+	if _, err := r.GetDataKey(context.Background(), "team-b/1", 0, nil); err != nil {
+		t.Fatalf("a call without caller should be permitted every id: %s", err)
+	}
+}
@@ -0,0 +1,331 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	logger "github.com/sirupsen/logrus"
+)
+
+// PostgresStore - a PostgreSQL implementation of a key/value store for KMS-related data.
+// Every id is a row of the configured table and the primary key on the id column
+// is what makes SetEncryptedDataKeysConditionally a first write wins operation.
+type PostgresStore struct {
+	db        *sql.DB
+	tableName string
+}
+
+// postgresMigrations are applied in order and recorded in the <table>_schema_migrations table.
+// Existing entries must never be modified, new schema changes are appended.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s (
+		id         TEXT PRIMARY KEY,
+		keys       JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE %[1]s ADD COLUMN deleted_at TIMESTAMPTZ`,
+	`ALTER TABLE %[1]s ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+}
+
+func init() {
+	RegisterStore("postgres", func(config *Configuration) (Store, error) {
+		return NewPostgresStore(config.Postgres)
+	})
+}
+
+// NewPostgresStore creates a new PostgresStore instance and brings the schema up to date
+func NewPostgresStore(postgresConfig PostgresConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", postgresConfig.URL)
+	if err != nil {
+		logStoreError(context.Background(), "postgres", "NewPostgresStore", "", err)
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(postgresConfig.MaxOpenConnections)
+	db.SetMaxIdleConns(postgresConfig.MaxIdleConnections)
+	db.SetConnMaxLifetime(time.Duration(postgresConfig.ConnectionLifetimeInMinutes) * time.Minute)
+
+	store := &PostgresStore{db, quoteIdentifier(postgresConfig.TableName)}
+	if !postgresConfig.SkipMigrations {
+		if err := store.migrate(context.Background(), postgresConfig.TableName); err != nil {
+			logger.Errorf("failed to migrate the postgres schema: %s", err)
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *PostgresStore) migrate(ctx context.Context, tableName string) error {
+	migrationsTable := quoteIdentifier(tableName + "_schema_migrations")
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY)", migrationsTable))
+	if err != nil {
+		return err
+	}
+
+	for version, migration := range postgresMigrations {
+		err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+			//the version row is locked by the insert, so concurrent rkms servers apply every migration only once
+			result, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version) VALUES ($1) ON CONFLICT DO NOTHING", migrationsTable), version)
+			if err != nil {
+				return err
+			}
+
+			if applied, err := result.RowsAffected(); err != nil || applied == 0 {
+				return err
+			}
+
+			logger.Infof("applying postgres schema migration %d", version)
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(migration, s.tableName))
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *PostgresStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *PostgresStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	var value []byte
+	var deletedAt pq.NullTime
+	var version int64
+	query := fmt.Sprintf("SELECT keys, deleted_at, version FROM %s WHERE id = $1", s.tableName)
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&value, &deletedAt, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "postgres", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	if deletedAt.Valid {
+		return nil, 0, IDDeletedStoreError{ID: id, DeletedAt: deletedAt.Time}
+	}
+
+	keys := make(map[string]string)
+	if err := json.Unmarshal(value, &keys); err != nil {
+		logStoreError(ctx, "postgres", "GetVersionedEncryptedDataKeys", id, err)
+		return nil, 0, err
+	}
+
+	return keys, version, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids with a single query
+func (s *PostgresStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	query := fmt.Sprintf("SELECT id, keys FROM %s WHERE id = ANY($1) AND deleted_at IS NULL", s.tableName)
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		logStoreError(ctx, "postgres", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]map[string]string, len(ids))
+	for rows.Next() {
+		var id string
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			logStoreError(ctx, "postgres", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+
+		encryptedKeys := make(map[string]string)
+		if err := json.Unmarshal(value, &encryptedKeys); err != nil {
+			logStoreError(ctx, "postgres", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+		keys[id] = encryptedKeys
+	}
+
+	return keys, rows.Err()
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *PostgresStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	value, err := json.Marshal(encryptedKeysMap)
+	if err != nil {
+		logStoreError(ctx, "postgres", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, keys) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", s.tableName), id, value)
+	if err != nil {
+		logStoreError(ctx, "postgres", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		logStoreError(ctx, "postgres", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	if inserted == 0 {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *PostgresStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	value, err := json.Marshal(encryptedKeysMap)
+	if err != nil {
+		logStoreError(ctx, "postgres", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET keys = $2, version = version + 1 WHERE id = $1 AND version = $3 AND deleted_at IS NULL", s.tableName)
+	result, err := s.db.ExecContext(ctx, query, id, value, expectedVersion)
+	if err != nil {
+		logStoreError(ctx, "postgres", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		logStoreError(ctx, "postgres", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if updated > 0 {
+		return nil
+	}
+
+	//the row tells why it wasn't updated
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if keys == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *PostgresStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL", s.tableName), id)
+	if err != nil {
+		logStoreError(ctx, "postgres", "DeleteEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *PostgresStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE id = $1", s.tableName), id)
+	if err != nil {
+		logStoreError(ctx, "postgres", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		logStoreError(ctx, "postgres", "RestoreEncryptedDataKeys", id, err)
+		return err
+	} else if updated == 0 {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *PostgresStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", s.tableName), id)
+	if err != nil {
+		logStoreError(ctx, "postgres", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored in the table that are not deleted, in id order
+func (s *PostgresStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	//one more id than the limit is read to know whether there is a next page
+	ids, err := s.queryIDs(ctx, fmt.Sprintf("SELECT id FROM %s WHERE deleted_at IS NULL AND id > $1 ORDER BY id LIMIT $2", s.tableName), cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) > limit {
+		return ids[:limit], ids[limit-1], nil
+	}
+
+	return ids, "", nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *PostgresStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.queryIDs(ctx, fmt.Sprintf("SELECT id FROM %s WHERE deleted_at < $1 ORDER BY id", s.tableName), deletedBefore)
+}
+
+func (s *PostgresStore) queryIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logStoreError(ctx, "postgres", "queryIDs", "", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			logStoreError(ctx, "postgres", "queryIDs", "", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// quoteIdentifier quotes a table name so it can be safely used in a statement
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
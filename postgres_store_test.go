@@ -0,0 +1,18 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPostgresStoreConformance(t *testing.T) {
+	url := testStoreEnv(t, "RKMS_TEST_POSTGRES_URL")
+	s, err := NewPostgresStore(PostgresConfig{URL: url, TableName: "rkms_keys", MaxOpenConnections: 2, MaxIdleConnections: 1, ConnectionLifetimeInMinutes: 30})
+	if err != nil {
+		t.Fatalf("failed to create the postgres store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
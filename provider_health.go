@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// providerHealthProbe is the plaintext encrypted by every health check
+var providerHealthProbe = []byte("rkms-health-check")
+
+// ProviderHealth - the outcome of the last health check of the key provider of a region
+type ProviderHealth struct {
+	Region        string    `json:"region"`
+	Healthy       bool      `json:"healthy"`
+	LastCheckedAt time.Time `json:"last_checked_at"`
+	LatencyMillis int64     `json:"latency_ms"`
+	Error         string    `json:"error,omitempty"`
+	Circuit       string    `json:"circuit,omitempty"`
+}
+
+// ProviderHealthChecker - keeps track of which key providers are healthy.
+// A provider is unhealthy when its key can't be described, is disabled, or when describing it and
+// encrypting with it doesn't succeed within the timeout: a slow region is as bad as a failing one
+// when creating data keys. Every provider is healthy until it was checked.
+type ProviderHealthChecker struct {
+	regions   []string
+	providers map[string]KeyProvider
+	timeout   time.Duration
+
+	mutex  sync.RWMutex
+	health map[string]ProviderHealth
+}
+
+// NewProviderHealthChecker creates a new ProviderHealthChecker instance for the providers of the given regions
+func NewProviderHealthChecker(regions []string, providers map[string]KeyProvider, timeout time.Duration) *ProviderHealthChecker {
+	health := make(map[string]ProviderHealth, len(regions))
+	for _, region := range regions {
+		health[region] = ProviderHealth{Region: region, Healthy: true}
+	}
+
+	return &ProviderHealthChecker{regions: regions, providers: providers, timeout: timeout, health: health}
+}
+
+// Healthy tells if the provider of the region passed its last health check
+func (c *ProviderHealthChecker) Healthy(region string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.health[region].Healthy
+}
+
+// Checked tells if the provider of every region was checked at least once
+func (c *ProviderHealthChecker) Checked() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, region := range c.regions {
+		if c.health[region].LastCheckedAt.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// Health returns the health of the provider of every region, in the order of the regions
+func (c *ProviderHealthChecker) Health() []ProviderHealth {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	health := make([]ProviderHealth, 0, len(c.regions))
+	for _, region := range c.regions {
+		health = append(health, c.health[region])
+	}
+	return health
+}
+
+// CheckAll checks the provider of every region concurrently
+func (c *ProviderHealthChecker) CheckAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, region := range c.regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			c.check(ctx, region)
+		}(region)
+	}
+	wg.Wait()
+}
+
+func (c *ProviderHealthChecker) check(ctx context.Context, region string) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := checkKeyProvider(ctx, c.providers[region])
+	health := ProviderHealth{
+		Region:        region,
+		Healthy:       err == nil,
+		LastCheckedAt: start,
+		LatencyMillis: int64(time.Since(start) / time.Millisecond),
+	}
+
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.health[region].Healthy && !health.Healthy {
+		logger.WithField("region", region).Warnf("the key provider is unhealthy, leaving it out of key creation: %s", err)
+	} else if !c.health[region].Healthy && health.Healthy {
+		logger.WithField("region", region).Infoln("the key provider is healthy again")
+	}
+	c.health[region] = health
+}
+
+func checkKeyProvider(ctx context.Context, provider KeyProvider) error {
+	description, err := provider.DescribeKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !description.Enabled {
+		return fmt.Errorf("key %s is disabled", description.ID)
+	}
+
+	_, err = provider.Encrypt(ctx, providerHealthProbe, nil)
+	return err
+}
+
+// runProviderHealthChecks checks the provider of every region every interval, until ctx is done
+func runProviderHealthChecks(ctx context.Context, checker *ProviderHealthChecker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checker.CheckAll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type providerHealthResponse struct {
+	Providers []ProviderHealth `json:"providers"`
+}
+
+// ConstructProviderHealthResponse creates a server response for GET /healthz/providers endpoint
+func ConstructProviderHealthResponse(health []ProviderHealth) string {
+	resp := providerHealthResponse{health}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
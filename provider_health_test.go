@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUnhealthyProvidersAreLeftOutOfKeyCreation(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, false, true})
+	if _, err := r.GetPlaintextDataKey(context.Background(), "id"); err == nil {
+		t.Fatalf("creating a data key should have failed while a region is down and not health checked")
+	}
+
+	r.health = NewProviderHealthChecker(r.regions, r.providers, time.Second)
+	r.health.CheckAll(context.Background())
+
+	if r.health.Healthy(getTestRegionName(1)) || !r.health.Healthy(getTestRegionName(0)) {
+		t.Fatalf("only the region that is down should be unhealthy: %+v", r.health.Health())
+	}
+
+	if _, err := r.GetPlaintextDataKey(context.Background(), "id"); err != nil {
+		t.Fatalf("the unhealthy region should have been left out of key creation: %s", err)
+	}
+
+	regions := r.encryptionRegions()
+	if len(regions) != 2 || regions[0] != getTestRegionName(0) || regions[1] != getTestRegionName(2) {
+		t.Fatalf("data keys should be encrypted in the healthy regions only, got: %v", regions)
+	}
+}
+
+func TestEveryRegionIsTriedWhenNoProviderIsHealthy(t *testing.T) {
+	r := getRKMS([]bool{false, false, false})
+	r.health = NewProviderHealthChecker(r.regions, r.providers, time.Second)
+	r.health.CheckAll(context.Background())
+
+	if regions := r.encryptionRegions(); len(regions) != len(r.regions) {
+		t.Fatalf("every region should be tried when none is healthy, got: %v", regions)
+	}
+}
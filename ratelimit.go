@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the keys the requests can be rate limited by, in RateLimitConfig.By
+const (
+	// RateLimitByIdentity limits the requests of every authenticated identity, and of every IP address when the
+	// API isn't authenticated
+	RateLimitByIdentity = "identity"
+	RateLimitByIP       = "ip"
+)
+
+// maxRateLimitBuckets is the number of buckets above which the ones of the clients idle long enough to be full
+// again are dropped, not to grow without bounds with the IP addresses seen
+const maxRateLimitBuckets = 10000
+
+// rateLimiter holds nil when the requests aren't rate limited, replaced when the configuration is reloaded
+var rateLimiter atomic.Pointer[RateLimiter]
+
+// tokenBucket - the tokens left to a client, refilled at the rate of its limit up to its burst
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     rateLimit
+}
+
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// RateLimiter rate limits the requests of every client with a token bucket, so that a misbehaving client can't
+// use up the KMS request quotas and the capacity of the store, and the requests of every tenant with a quota
+// with a bucket of the tenant
+type RateLimiter struct {
+	by         string
+	limit      rateLimit
+	identities map[string]rateLimit
+	tenants    map[string]rateLimit
+	mutex      sync.Mutex
+	buckets    map[string]*tokenBucket
+}
+
+// NewRateLimiter returns the rate limiter of the given config and tenant quotas, nil when none of them sets a
+// rate. Only the tenants are rate limited when the config doesn't set a rate.
+func NewRateLimiter(config RateLimitConfig, tenants []TenantConfig) (*RateLimiter, error) {
+	tenantLimits := make(map[string]rateLimit)
+	for _, tenant := range tenants {
+		if tenant.RequestsPerSecond > 0 {
+			tenantLimits[tenant.Name] = newRateLimit(tenant.RequestsPerSecond, tenant.Burst)
+		}
+	}
+
+	if config.RequestsPerSecond <= 0 && len(tenantLimits) == 0 {
+		return nil, nil
+	}
+
+	switch config.By {
+	case "", RateLimitByIdentity:
+		config.By = RateLimitByIdentity
+	case RateLimitByIP:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q, expected %q or %q", config.By, RateLimitByIdentity, RateLimitByIP)
+	}
+
+	l := &RateLimiter{
+		by:         config.By,
+		limit:      newRateLimit(config.RequestsPerSecond, config.Burst),
+		identities: make(map[string]rateLimit),
+		tenants:    tenantLimits,
+		buckets:    make(map[string]*tokenBucket),
+	}
+	for _, identity := range config.Identities {
+		if identity.RequestsPerSecond <= 0 {
+			return nil, fmt.Errorf("the rate limit of %q must be greater than 0", identity.Identity)
+		}
+		l.identities[identity.Identity] = newRateLimit(identity.RequestsPerSecond, identity.Burst)
+	}
+	return l, nil
+}
+
+// newRateLimit returns the limit of the given rate and burst, the burst being a second of requests when not set,
+// no rate being no limit
+func newRateLimit(requestsPerSecond float64, burst int) rateLimit {
+	if requestsPerSecond <= 0 {
+		return rateLimit{}
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(requestsPerSecond))
+	}
+	return rateLimit{requestsPerSecond, float64(burst)}
+}
+
+// key returns the key the requests of a client are limited by, its identity or its IP address, and its limit
+func (l *RateLimiter) key(identity string, ip string) (string, rateLimit) {
+	if l.by == RateLimitByIdentity && identity != "" {
+		if limit, ok := l.identities[identity]; ok {
+			return "identity:" + identity, limit
+		}
+		return "identity:" + identity, l.limit
+	}
+	return "ip:" + ip, l.limit
+}
+
+// allow takes a token from the bucket of the given client, telling how long it has to wait before retrying when
+// its bucket is empty
+func (l *RateLimiter) allow(identity string, ip string, now time.Time) (bool, time.Duration) {
+	key, limit := l.key(identity, ip)
+	return l.take(key, limit, now)
+}
+
+// allowTenant takes a token from the bucket of the given tenant, every request being allowed to a tenant without
+// a quota
+func (l *RateLimiter) allowTenant(tenant string, now time.Time) (bool, time.Duration) {
+	return l.take("tenant:"+tenant, l.tenants[tenant], now)
+}
+
+// take takes a token from the bucket of key, created full for the given limit
+func (l *RateLimiter) take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	if limit.rate <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.dropFullBuckets(now)
+		}
+		bucket = &tokenBucket{tokens: limit.burst, updatedAt: now, limit: limit}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(bucket.limit.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*bucket.limit.rate)
+	bucket.updatedAt = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / bucket.limit.rate * float64(time.Second))
+}
+
+// dropFullBuckets drops the buckets which would be full by now, their clients being allowed their burst again
+// anyway
+func (l *RateLimiter) dropFullBuckets(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*bucket.limit.rate >= bucket.limit.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowRequest is allowTenant and allow for the caller of ctx, counting and logging the requests which aren't
+// allowed
+func (l *RateLimiter) allowRequest(ctx context.Context, ip string) (bool, time.Duration) {
+	identity := identityFromContext(ctx)
+	now := time.Now()
+
+	by := RateLimitByIP
+	if l.by == RateLimitByIdentity && identity != "" {
+		by = RateLimitByIdentity
+	}
+	allowed, retryAfter := l.allow(identity, ip, now)
+	if tenant := tenantFromContext(ctx); allowed && tenant != "" {
+		by = "tenant"
+		allowed, retryAfter = l.allowTenant(tenant, now)
+	}
+
+	if !allowed {
+		rateLimitedTotal.inc(by)
+		contextLogger(ctx).WithField("ip", ip).Warnf("rate limited request, retry after %s", retryAfter)
+	}
+	return allowed, retryAfter
+}
+
+// remoteIP returns the IP address of a remote address, the address itself if it has no port
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// limitRate answers 429 Too Many Requests to the clients above their rate limit, with the seconds they have to
+// wait before retrying in the Retry-After header, when the requests are rate limited. It goes after authorize
+// for the requests to be limited by identity.
+func limitRate(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := rateLimiter.Load()
+		if limiter == nil {
+			handler(w, r)
+			return
+		}
+
+		if allowed, retryAfter := limiter.allowRequest(r.Context(), remoteIP(r.RemoteAddr)); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			resp := ConstructErrorResponse("TooManyRequests", "rate limit exceeded")
+			fmt.Fprintln(w, resp)
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	l, err := NewRateLimiter(RateLimitConfig{RequestsPerSecond: 2, Burst: 3}, nil)
+	if err != nil {
+		t.Fatalf("was not able to create the rate limiter: %s", err)
+	}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow("billing", "10.0.0.1", now); !allowed {
+			t.Fatalf("the burst should have been allowed, request %d wasn't", i)
+		}
+	}
+
+	allowed, retryAfter := l.allow("billing", "10.0.0.1", now)
+	if allowed || retryAfter != 500*time.Millisecond {
+		t.Fatalf("the request above the burst should have waited for a token, got %t, %s", allowed, retryAfter)
+	}
+
+	if allowed, _ := l.allow("payments", "10.0.0.1", now); !allowed {
+		t.Fatalf("another identity should have a bucket of its own")
+	}
+
+	if allowed, _ := l.allow("billing", "10.0.0.1", now.Add(500*time.Millisecond)); !allowed {
+		t.Fatalf("the bucket should have been refilled at the sustained rate")
+	}
+	if allowed, _ := l.allow("billing", "10.0.0.1", now.Add(500*time.Millisecond)); allowed {
+		t.Fatalf("the bucket should have been refilled with a single token")
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	l, err := NewRateLimiter(RateLimitConfig{
+		RequestsPerSecond: 1,
+		Identities:        []IdentityRateLimitConfig{{Identity: "batch-job", RequestsPerSecond: 100, Burst: 50}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("was not able to create the rate limiter: %s", err)
+	}
+
+	if key, limit := l.key("batch-job", "10.0.0.1"); key != "identity:batch-job" || limit.burst != 50 {
+		t.Fatalf("batch-job should have its own limit, got %s %+v", key, limit)
+	}
+	if key, limit := l.key("", "10.0.0.1"); key != "ip:10.0.0.1" || limit.burst != 1 {
+		t.Fatalf("the unauthenticated requests should be limited by IP address, got %s %+v", key, limit)
+	}
+
+	byIP, _ := NewRateLimiter(RateLimitConfig{RequestsPerSecond: 1, By: RateLimitByIP}, nil)
+	if key, _ := byIP.key("billing", "10.0.0.1"); key != "ip:10.0.0.1" {
+		t.Fatalf("the requests should have been limited by IP address, got %s", key)
+	}
+
+	if _, err := NewRateLimiter(RateLimitConfig{RequestsPerSecond: 1, By: "user_agent"}, nil); err == nil {
+		t.Fatalf("an unknown key should have been rejected")
+	}
+	if l, err := NewRateLimiter(RateLimitConfig{}, nil); l != nil || err != nil {
+		t.Fatalf("the requests shouldn't be rate limited without a rate, got %v, %v", l, err)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	defer rateLimiter.Store(nil)
+	limiter, _ := NewRateLimiter(RateLimitConfig{RequestsPerSecond: 0.5, Burst: 1}, nil)
+	rateLimiter.Store(limiter)
+	handler := limitRate(func(w http.ResponseWriter, r *http.Request) {})
+
+	codes := make([]int, 0, 2)
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/key?id=1", nil).WithContext(context.Background())
+		handler(w, r)
+		codes = append(codes, w.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Fatalf("the second request should have been rate limited, got %v", codes)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Fatalf("the client should have been told to retry in 2 seconds, got %q", retryAfter)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// the consistencies of the reads of the store: eventually consistent reads cost half as much, strongly consistent
+// reads see every write made before them
+const (
+	ReadConsistencyEventual = "eventual"
+	ReadConsistencyStrong   = "strong"
+)
+
+// ReadConsistencyHeader is the header a request asks for the consistency of its reads with, like the consistency
+// query parameter
+const ReadConsistencyHeader = "X-Read-Consistency"
+
+// InvalidReadConsistencyError is returned when a request asks for a consistency which isn't one of the read
+// consistencies
+type InvalidReadConsistencyError struct {
+	Consistency string
+}
+
+func (e InvalidReadConsistencyError) Error() string {
+	return fmt.Sprintf("unknown read consistency %q, the read consistencies are %s and %s", e.Consistency, ReadConsistencyEventual, ReadConsistencyStrong)
+}
+
+type readConsistencyContextKey struct{}
+
+// withReadConsistency returns a copy of ctx whose reads of the store have the given consistency
+func withReadConsistency(ctx context.Context, consistency string) context.Context {
+	return context.WithValue(ctx, readConsistencyContextKey{}, consistency)
+}
+
+// readConsistencyFromContext returns the read consistency of ctx, an empty string when the consistency the store
+// is configured with applies
+func readConsistencyFromContext(ctx context.Context) string {
+	consistency, _ := ctx.Value(readConsistencyContextKey{}).(string)
+	return consistency
+}
+
+// validReadConsistency tells if the given consistency is one of the read consistencies
+func validReadConsistency(consistency string) bool {
+	return consistency == ReadConsistencyEventual || consistency == ReadConsistencyStrong
+}
+
+// requestWithReadConsistency returns the request with the read consistency of its consistency query parameter, or
+// else of its X-Read-Consistency header, in its context, the request as is when it asks for none
+func requestWithReadConsistency(r *http.Request) (*http.Request, error) {
+	consistency := r.URL.Query().Get("consistency")
+	if consistency == "" {
+		consistency = r.Header.Get(ReadConsistencyHeader)
+	}
+
+	if consistency == "" {
+		return r, nil
+	}
+	if !validReadConsistency(consistency) {
+		return nil, InvalidReadConsistencyError{consistency}
+	}
+	return r.WithContext(withReadConsistency(r.Context(), consistency)), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestWithReadConsistency(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?consistency=strong", nil)
+	r.Header.Set(ReadConsistencyHeader, ReadConsistencyEventual)
+	r, err := requestWithReadConsistency(r)
+	if err != nil || readConsistencyFromContext(r.Context()) != ReadConsistencyStrong {
+		t.Fatalf("the consistency query parameter should have been used over the header, got %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(ReadConsistencyHeader, ReadConsistencyEventual)
+	if r, err = requestWithReadConsistency(r); err != nil || readConsistencyFromContext(r.Context()) != ReadConsistencyEventual {
+		t.Fatalf("the consistency of the header should have been used, got %v", err)
+	}
+
+	r, err = requestWithReadConsistency(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || readConsistencyFromContext(r.Context()) != "" {
+		t.Fatalf("the request shouldn't have asked for a read consistency, got %v", err)
+	}
+}
+
+func TestDecoratorRejectsUnknownReadConsistency(t *testing.T) {
+	handled := false
+	handler := decorator(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+	})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/?consistency=linearizable", nil))
+	if handled || recorder.Code != http.StatusBadRequest {
+		t.Fatalf("an unknown read consistency should have been answered with 400, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReadinessStoreTimeout is how long the store has to answer the read of a readiness check
+const ReadinessStoreTimeout = 2 * time.Second
+
+// readinessProbeID is the id read from the store by the readiness checks, whether it exists or not
+const readinessProbeID = "rkms-readiness-probe"
+
+// the names of the readiness checks
+const (
+	ReadinessCheckStore        = "store"
+	ReadinessCheckProviders    = "providers"
+	ReadinessCheckHealthChecks = "provider_health_checks"
+	ReadinessCheckWarmUp       = "cache_warm_up"
+)
+
+// ReadinessCheck - the outcome of one of the checks of Readiness
+type ReadinessCheck struct {
+	Name          string `json:"name"`
+	Ready         bool   `json:"ready"`
+	LatencyMillis int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Readiness tells if rkms can serve data keys: the store answers a read, a quorum of the key providers is healthy,
+// and, when requireHealthChecks is set, the provider of every region was health checked since rkms started so
+// that a quorum isn't assumed before being known. The quorum is min_successful_regions when set, a majority of
+// the regions otherwise. While warmingUp, the caches are still being warmed up on startup. The outcome of every check
+// is returned, in order.
+func (r *RKMS) Readiness(ctx context.Context, requireHealthChecks bool, warmingUp bool) (bool, []ReadinessCheck) {
+	checks := []ReadinessCheck{r.checkStoreReadiness(ctx), r.checkProvidersReadiness()}
+	if requireHealthChecks {
+		check := ReadinessCheck{Name: ReadinessCheckHealthChecks, Ready: r.health != nil && r.health.Checked()}
+		if !check.Ready {
+			check.Error = "the key providers weren't health checked yet"
+		}
+		checks = append(checks, check)
+	}
+	if warmingUp {
+		checks = append(checks, ReadinessCheck{Name: ReadinessCheckWarmUp, Ready: false, Error: "the caches are being warmed up"})
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Ready
+	}
+	return ready, checks
+}
+
+func (r *RKMS) checkStoreReadiness(ctx context.Context) ReadinessCheck {
+	ctx, cancel := context.WithTimeout(ctx, ReadinessStoreTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.store.GetEncryptedDataKeys(ctx, readinessProbeID)
+	check := ReadinessCheck{Name: ReadinessCheckStore, Ready: err == nil, LatencyMillis: int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+func (r *RKMS) checkProvidersReadiness() ReadinessCheck {
+	required := r.minSuccessfulRegions
+	if required == 0 {
+		required = len(r.regions)/2 + 1
+	}
+
+	healthy := len(r.regions)
+	if r.health != nil {
+		healthy = 0
+		for _, region := range r.regions {
+			if r.health.Healthy(region) {
+				healthy++
+			}
+		}
+	}
+
+	check := ReadinessCheck{Name: ReadinessCheckProviders, Ready: healthy >= required}
+	if !check.Ready {
+		check.Error = fmt.Sprintf("the key providers of %d regions are healthy, %d are required", healthy, required)
+	}
+	return check
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	r := getRKMS([]bool{true, false, true})
+	r.store = NewMemoryStore()
+	r.health = NewProviderHealthChecker(r.regions, r.providers, time.Second)
+	ctx := context.Background()
+
+	if ready, checks := r.Readiness(ctx, true, false); ready || len(checks) != 3 || checks[2].Ready {
+		t.Fatalf("rkms shouldn't be ready before the providers were health checked, got %+v", checks)
+	}
+
+	r.health.CheckAll(ctx)
+	if ready, checks := r.Readiness(ctx, true, false); !ready {
+		t.Fatalf("2 healthy providers out of 3 should be a quorum, got %+v", checks)
+	}
+
+	r.minSuccessfulRegions = 3
+	if ready, checks := r.Readiness(ctx, true, false); ready || checks[1].Name != ReadinessCheckProviders || checks[1].Ready {
+		t.Fatalf("2 healthy providers shouldn't be enough when 3 regions are required, got %+v", checks)
+	}
+
+	r.minSuccessfulRegions = 0
+	r.store = &unavailableStore{}
+	if ready, checks := r.Readiness(ctx, false, false); ready || len(checks) != 2 || checks[0].Name != ReadinessCheckStore || checks[0].Ready {
+		t.Fatalf("rkms shouldn't be ready while the store is unreachable, got %+v", checks)
+	}
+}
+
+func TestReadinessWithoutHealthChecks(t *testing.T) {
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+
+	if ready, checks := r.Readiness(context.Background(), false, false); !ready || len(checks) != 2 {
+		t.Fatalf("rkms should be ready when the providers aren't health checked, got %+v", checks)
+	}
+}
+
+func TestReadinessWhileWarmingUp(t *testing.T) {
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+
+	if ready, checks := r.Readiness(context.Background(), false, true); ready || len(checks) != 3 || checks[2].Name != ReadinessCheckWarmUp {
+		t.Fatalf("rkms shouldn't be ready while the caches are warmed up, got %+v", checks)
+	}
+}
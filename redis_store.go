@@ -0,0 +1,351 @@
+//go:build redis
+// +build redis
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStore - a Redis implementation of a key/value store for KMS-related data.
+// It works with a standalone server, a Redis Cluster or a Sentinel-managed master.
+type RedisStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+func init() {
+	RegisterStore("redis", func(config *Configuration) (Store, error) {
+		return NewRedisStore(config.Redis)
+	})
+}
+
+// NewRedisStore creates a new RedisStore instance
+func NewRedisStore(redisConfig RedisConfig) (*RedisStore, error) {
+	tlsConfig, err := newClientTLSConfig(redisConfig.TLS)
+	if err != nil {
+		logStoreError(context.Background(), "redis", "NewRedisStore", "", err)
+		return nil, err
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      redisConfig.Addrs,
+		MasterName: redisConfig.MasterName,
+		Password:   redisConfig.Password,
+		DB:         redisConfig.DB,
+		TLSConfig:  tlsConfig,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		logStoreError(context.Background(), "redis", "NewRedisStore", "", err)
+		return nil, err
+	}
+
+	return &RedisStore{client, redisConfig.KeyPrefix}, nil
+}
+
+// withContext returns a client bound to ctx, so cancelled requests stop waiting on Redis
+func (s *RedisStore) withContext(ctx context.Context) redis.Cmdable {
+	switch client := s.client.(type) {
+	case *redis.Client:
+		return client.WithContext(ctx)
+	case *redis.ClusterClient:
+		return client.WithContext(ctx)
+	default:
+		return s.client
+	}
+}
+
+func (s *RedisStore) key(id string) string {
+	return s.keyPrefix + id
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *RedisStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// getItem reads the item of the given id, nil if it does not exist
+func (s *RedisStore) getItem(ctx context.Context, id string) (*item, error) {
+	value, err := s.withContext(ctx).Get(s.key(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		logStoreError(ctx, "redis", "getItem", id, err)
+		return nil, err
+	}
+
+	item := &item{}
+	if err := json.Unmarshal(value, item); err != nil {
+		logStoreError(ctx, "redis", "getItem", id, err)
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids.
+// The GETs are pipelined, a cluster client splits the pipeline by node.
+func (s *RedisStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	cmds := make([]*redis.StringCmd, len(ids))
+	_, err := s.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.Get(s.key(id))
+		}
+		return nil
+	})
+
+	//a missing key fails its GET, and the pipeline, with redis.Nil
+	if err != nil && err != redis.Nil {
+		logStoreError(ctx, "redis", "GetEncryptedDataKeysBatch", "", err)
+		return nil, err
+	}
+
+	keys := make(map[string]map[string]string, len(ids))
+	for i, cmd := range cmds {
+		value, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			logStoreError(ctx, "redis", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+
+		item := item{}
+		if err := json.Unmarshal(value, &item); err != nil {
+			logStoreError(ctx, "redis", "GetEncryptedDataKeysBatch", "", err)
+			return nil, err
+		}
+
+		if !item.deleted() {
+			keys[ids[i]] = item.Keys
+		}
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *RedisStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	value, err := json.Marshal(item{ID: id, Keys: encryptedKeysMap})
+	if err != nil {
+		logStoreError(ctx, "redis", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	created, err := s.withContext(ctx).SetNX(s.key(id), value, 0).Result()
+	if err != nil {
+		logStoreError(ctx, "redis", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	if !created {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// updateScript replaces the keys of the item of KEYS[1] and increments its version if it is at
+// version ARGV[2], it returns -1 if the item is missing, -2 if it is deleted and -3 on a version mismatch
+var updateScript = redis.NewScript(`
+local value = redis.call('GET', KEYS[1])
+if not value then return -1 end
+local item = cjson.decode(value)
+if item['deleted_at'] then return -2 end
+local version = item['version'] or 0
+if version ~= tonumber(ARGV[2]) then return -3 end
+item['keys'] = cjson.decode(ARGV[1])
+item['version'] = version + 1
+redis.call('SET', KEYS[1], cjson.encode(item))
+return 1
+`)
+
+// deleteScript sets deleted_at on the item of KEYS[1] unless it is missing or already deleted
+var deleteScript = redis.NewScript(`
+local value = redis.call('GET', KEYS[1])
+if not value then return 0 end
+local item = cjson.decode(value)
+if item['deleted_at'] then return 0 end
+item['deleted_at'] = tonumber(ARGV[1])
+redis.call('SET', KEYS[1], cjson.encode(item))
+return 1
+`)
+
+// restoreScript removes deleted_at from the item of KEYS[1], it returns -1 if the item is missing
+var restoreScript = redis.NewScript(`
+local value = redis.call('GET', KEYS[1])
+if not value then return -1 end
+local item = cjson.decode(value)
+item['deleted_at'] = nil
+redis.call('SET', KEYS[1], cjson.encode(item))
+return 1
+`)
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *RedisStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	item, err := s.getItem(ctx, id)
+	if err != nil || item == nil {
+		return nil, 0, err
+	}
+
+	if item.deleted() {
+		return nil, 0, item.deletedError()
+	}
+
+	return item.Keys, item.Version, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *RedisStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	keys, err := json.Marshal(encryptedKeysMap)
+	if err != nil {
+		logStoreError(ctx, "redis", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	result, err := updateScript.Run(s.withContext(ctx), []string{s.key(id)}, keys, expectedVersion).Int()
+	if err != nil {
+		logStoreError(ctx, "redis", "UpdateEncryptedDataKeys", id, err)
+		return err
+	}
+
+	switch result {
+	case -1:
+		return IDNotFoundStoreError{ID: id}
+	case -2:
+		//the deletion time is only known from the item
+		_, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+		if err == nil {
+			err = IDNotFoundStoreError{ID: id}
+		}
+		return err
+	case -3:
+		return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+	}
+
+	return nil
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *RedisStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	err := deleteScript.Run(s.withContext(ctx), []string{s.key(id)}, time.Now().Unix()).Err()
+	if err != nil {
+		logStoreError(ctx, "redis", "DeleteEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *RedisStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	result, err := restoreScript.Run(s.withContext(ctx), []string{s.key(id)}).Int64()
+	if err != nil {
+		logStoreError(ctx, "redis", "RestoreEncryptedDataKeys", id, err)
+		return err
+	}
+
+	if result < 0 {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *RedisStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	if err := s.withContext(ctx).Del(s.key(id)).Err(); err != nil {
+		logStoreError(ctx, "redis", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored under the configured key prefix that are not deleted.
+// SCAN cursors can't be resumed across the nodes of a cluster, so every page scans the whole
+// keyspace and pages through the sorted ids.
+func (s *RedisStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	ids, err := s.listIDs(ctx, func(item *item) bool {
+		return !item.deleted()
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(ids)
+	page, nextCursor := pageSortedIDs(ids, cursor, limit)
+	return page, nextCursor, nil
+}
+
+// ListDeletedIDs returns every id stored under the configured key prefix that was deleted before the given time
+func (s *RedisStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(ctx, func(item *item) bool {
+		return item.deletedBefore(deletedBefore)
+	})
+}
+
+// listIDs scans the keys under the configured key prefix and returns the ids of the items to include.
+// In a Redis Cluster every master is scanned (concurrently) since keys are spread across them.
+func (s *RedisStore) listIDs(ctx context.Context, include func(item *item) bool) ([]string, error) {
+	var mutex sync.Mutex
+	ids := make([]string, 0)
+	scan := func(client redis.Cmdable) error {
+		iter := client.Scan(0, s.keyPrefix+"*", 0).Iterator()
+		for iter.Next() {
+			value, err := client.Get(iter.Val()).Bytes()
+			if err == redis.Nil {
+				//purged while scanning
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			item := item{}
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+
+			if include(&item) {
+				mutex.Lock()
+				ids = append(ids, strings.TrimPrefix(iter.Val(), s.keyPrefix))
+				mutex.Unlock()
+			}
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := s.client.(*redis.ClusterClient); ok {
+		err = cluster.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+			return scan(master.WithContext(ctx))
+		})
+	} else {
+		err = scan(s.withContext(ctx))
+	}
+
+	if err != nil {
+		logStoreError(ctx, "redis", "listIDs", "", err)
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,18 @@
+//go:build redis
+// +build redis
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRedisStoreConformance(t *testing.T) {
+	addr := testStoreEnv(t, "RKMS_TEST_REDIS_ADDR")
+	s, err := NewRedisStore(RedisConfig{Addrs: []string{addr}, KeyPrefix: "rkms-test:"})
+	if err != nil {
+		t.Fatalf("failed to create the redis store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
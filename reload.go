@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// configReloader reloads the configuration file on SIGHUP: the regions and keys of [kms], the rate limits, the
+// retries of the store and the log level are replaced without a restart, the in-flight requests completing with
+// the previous ones. The other settings, e.g. of the servers, the store or the authentication, are only applied
+// on restart.
+type configReloader struct {
+	path      string
+	storeType string
+	store     Store
+	config    *Configuration
+	// stops the background jobs of the current RKMS
+	stopJobs context.CancelFunc
+}
+
+// startKMSJobs starts the health checks and the backfill of r every interval of kmsConfig, until ctx is done or
+// the returned function is called
+func startKMSJobs(ctx context.Context, r *RKMS, kmsConfig KMSConfig) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	healthChecksEnabled.Store(kmsConfig.HealthCheckIntervalInSeconds > 0)
+
+	if kmsConfig.HealthCheckIntervalInSeconds > 0 {
+		interval := time.Duration(kmsConfig.HealthCheckIntervalInSeconds) * time.Second
+		go runProviderHealthChecks(ctx, r.health, interval)
+	}
+
+	if kmsConfig.BackfillIntervalInMinutes > 0 {
+		interval := time.Duration(kmsConfig.BackfillIntervalInMinutes) * time.Minute
+		go runCiphertextBackfill(ctx, r, interval)
+	}
+	return cancel
+}
+
+// reload loads and validates the configuration file again and applies it, keeping the current configuration when
+// it is invalid
+func (c *configReloader) reload(ctx context.Context) error {
+	config, err := LoadConfiguration(c.path)
+	if err != nil {
+		return err
+	}
+	if c.storeType != "" {
+		config.Store.Type = c.storeType
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r, err := NewRKMS(config.KMS, c.store, config.Store.Retry)
+	if err != nil {
+		return err
+	}
+
+	limiter, err := NewRateLimiter(config.RateLimit, config.Tenants)
+	if err != nil {
+		return err
+	}
+
+	//the new providers are checked before serving, not to be assumed healthy, nor /readyz to fail meanwhile
+	if config.KMS.HealthCheckIntervalInSeconds > 0 {
+		r.health.CheckAll(ctx)
+	}
+
+	level, _ := logger.ParseLevel(config.Logger.Level)
+	stopJobs := startKMSJobs(ctx, r, config.KMS)
+	//the plaintexts cached by the previous instance are zeroed rather than left to the garbage collector
+	rkmsHandler.Swap(r).purgePlaintextCache()
+	rateLimiter.Store(limiter)
+	logger.SetLevel(level)
+
+	if c.stopJobs != nil {
+		c.stopJobs()
+	}
+	c.stopJobs = stopJobs
+
+	if c.config != nil && !reflect.DeepEqual(restartSettings(c.config), restartSettings(config)) {
+		logger.Warnln("the settings of the servers, the store, the authentication, the tenants, the tracing and the log format changed, they are only applied on restart")
+	}
+	c.config = config
+	return nil
+}
+
+// restartSettings returns the settings of config which aren't reloaded
+func restartSettings(config *Configuration) Configuration {
+	settings := *config
+	settings.KMS = KMSConfig{}
+	settings.RateLimit = RateLimitConfig{}
+	settings.Logger.Level = ""
+	settings.Store.Retry = RetryConfig{}
+	//the quotas of the tenants are reloaded, not their identities
+	settings.Tenants = make([]TenantConfig, len(config.Tenants))
+	for i, tenant := range config.Tenants {
+		settings.Tenants[i] = TenantConfig{Name: tenant.Name, Identities: tenant.Identities}
+	}
+	return settings
+}
+
+// runConfigReloads reloads the configuration on every SIGHUP, until ctx is done
+func runConfigReloads(ctx context.Context, c *configReloader) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-hangups:
+			if err := c.reload(ctx); err != nil {
+				logger.Errorf("was not able to reload the configuration file %s, the current configuration is kept: %s", c.path, err)
+				continue
+			}
+			logger.Infof("reloaded the configuration file %s", c.path)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const testReloadConfig = `
+[server]
+  port = "8080"
+  api_version = "v1"
+
+[logger]
+  level = %q
+
+[kms]
+  regions = [%s]
+  key_ids = { %s }
+  providers = { %s }
+  health_check_interval_in_seconds = 0
+  backfill_interval_in_minutes = 0
+
+[rate_limit]
+  requests_per_second = %g
+`
+
+// writeTestReloadConfig writes a configuration of the given regions, of the local provider
+func writeTestReloadConfig(t *testing.T, path string, level string, regions []string, requestsPerSecond float64) {
+	names, keyIDs, providers := make([]string, len(regions)), make([]string, len(regions)), make([]string, len(regions))
+	for i, region := range regions {
+		names[i] = fmt.Sprintf("%q", region)
+		keyIDs[i] = region + ` = "env:RKMS_TEST_RELOAD_KEY"`
+		providers[i] = region + ` = "local"`
+	}
+	content := fmt.Sprintf(testReloadConfig, level, strings.Join(names, ", "), strings.Join(keyIDs, ", "), strings.Join(providers, ", "), requestsPerSecond)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("was not able to write the configuration file: %s", err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	t.Setenv("RKMS_TEST_RELOAD_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, LocalMasterKeySize)))
+	level := logger.GetLevel()
+	t.Cleanup(func() {
+		rkmsHandler.Store(nil)
+		rateLimiter.Store(nil)
+		logger.SetLevel(level)
+	})
+
+	path := writeTestConfigFile(t, "config.toml", "")
+	writeTestReloadConfig(t, path, "info", []string{"region-0", "region-1", "region-2"}, 0)
+	reloader := &configReloader{path: path, storeType: "memory", store: NewMemoryStore()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := reloader.reload(ctx); err != nil {
+		t.Fatalf("was not able to load the configuration: %s", err)
+	}
+	first := rkmsHandler.Load()
+	if _, err := first.GetDataKey(ctx, "user-1", 0, nil); err != nil {
+		t.Fatalf("was not able to create a data key: %s", err)
+	}
+	if rateLimiter.Load() != nil || logger.GetLevel() != logger.InfoLevel {
+		t.Fatalf("the requests shouldn't have been rate limited, with the info log level")
+	}
+
+	writeTestReloadConfig(t, path, "warn", []string{"region-0", "region-1", "region-2", "region-3"}, 10)
+	if err := reloader.reload(ctx); err != nil {
+		t.Fatalf("was not able to reload the configuration: %s", err)
+	}
+
+	reloaded := rkmsHandler.Load()
+	if reloaded == first || len(reloaded.regions) != 4 {
+		t.Fatalf("the RKMS should have been replaced by one of the 4 regions")
+	}
+	if rateLimiter.Load() == nil || logger.GetLevel() != logger.WarnLevel {
+		t.Fatalf("the rate limit and the log level should have been reloaded")
+	}
+	if _, err := reloaded.GetDataKey(ctx, "user-1", 0, nil); err != nil {
+		t.Fatalf("the data keys should have been kept, with the store: %s", err)
+	}
+
+	writeTestReloadConfig(t, path, "debug", []string{"region-0", "region-1"}, 10)
+	if err := reloader.reload(ctx); err == nil {
+		t.Fatalf("an invalid configuration should have been rejected")
+	}
+	if rkmsHandler.Load() != reloaded || logger.GetLevel() != logger.WarnLevel {
+		t.Fatalf("the current configuration should have been kept")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// ReplicatedStore - a store that replicates the encrypted data keys to several other stores,
+// so the keys survive the loss of a whole backend the same way they survive the loss of a KMS region.
+//
+// Writes go to every store and succeed once writeQuorum stores acknowledged them.
+// Reads go to the stores in order and return the first keys found.
+type ReplicatedStore struct {
+	stores      []Store
+	writeQuorum int
+}
+
+func init() {
+	RegisterStore("replicated", func(config *Configuration) (Store, error) {
+		stores, err := newStores(config, config.Replicated.Stores, "replicated")
+		if err != nil {
+			return nil, err
+		}
+
+		return NewReplicatedStore(stores, config.Replicated.WriteQuorum)
+	})
+}
+
+// NewReplicatedStore creates a new ReplicatedStore instance.
+// A writeQuorum of 0 means every store has to acknowledge a write.
+func NewReplicatedStore(stores []Store, writeQuorum int) (*ReplicatedStore, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("a replicated store needs at least one store")
+	}
+
+	if writeQuorum == 0 {
+		writeQuorum = len(stores)
+	}
+
+	if writeQuorum < 0 || writeQuorum > len(stores) {
+		return nil, fmt.Errorf("write quorum must be between 1 and the number of stores (%d), got %d", len(stores), writeQuorum)
+	}
+
+	return &ReplicatedStore{stores, writeQuorum}, nil
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id from the first store that has them.
+// A store missing the id doesn't end the lookup, as a write only needs a quorum of stores to succeed.
+func (s *ReplicatedStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	var lastErr error
+	healthyStores := 0
+
+	for i, store := range s.stores {
+		keys, err := store.GetEncryptedDataKeys(ctx, id)
+		if _, ok := err.(IDDeletedStoreError); ok {
+			return nil, err
+		}
+
+		if err != nil {
+			contextLogger(ctx).Infof("failed to read from replicated store #%d: %s", i, err)
+			lastErr = err
+			continue
+		}
+
+		healthyStores++
+		if keys != nil {
+			return keys, nil
+		}
+	}
+
+	if healthyStores == 0 {
+		return nil, fmt.Errorf("failed to read from every replicated store: %s", lastErr)
+	}
+
+	return nil, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids from the first store
+// in a batch. Ids it doesn't return are read one by one, since a batch can't tell a deleted id from
+// a missing one, and a deleted id must not be read from the stores after it.
+func (s *ReplicatedStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	return getEncryptedDataKeysBatchThenEach(ctx, s, s.stores[0], ids)
+}
+
+type storeWriteResult struct {
+	index int
+	err   error
+}
+
+// writeToAll calls write for every store concurrently and returns the error of each store by index
+func (s *ReplicatedStore) writeToAll(write func(store Store) error) []error {
+	resultsChannel := make(chan storeWriteResult, len(s.stores))
+	for i, store := range s.stores {
+		go func(index int, store Store) {
+			resultsChannel <- storeWriteResult{index, write(store)}
+		}(i, store)
+	}
+
+	errs := make([]error, len(s.stores))
+	for range s.stores {
+		result := <-resultsChannel
+		errs[result.index] = result.err
+	}
+
+	return errs
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id in every store,
+// only if id does not exist in the stores already.
+// If the id already exists in any of them, the keys written by this call are removed again,
+// so they can't diverge from the winner's, and an IDAlreadyExistsStoreError error is returned.
+func (s *ReplicatedStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	errs := s.writeToAll(func(store Store) error {
+		return store.SetEncryptedDataKeysConditionally(ctx, id, encryptedKeysMap)
+	})
+
+	succeeded := make([]Store, 0, len(s.stores))
+	alreadyExists := false
+	var lastErr error
+	for i, err := range errs {
+		if err == nil {
+			succeeded = append(succeeded, s.stores[i])
+			continue
+		}
+
+		if _, ok := err.(IDAlreadyExistsStoreError); ok {
+			alreadyExists = true
+			continue
+		}
+
+		contextLogger(ctx).Errorf("failed to write to replicated store #%d: %s", i, err)
+		lastErr = err
+	}
+
+	if alreadyExists {
+		for _, store := range succeeded {
+			if err := store.PurgeEncryptedDataKeys(ctx, id); err != nil {
+				contextLogger(ctx).Errorf("failed to remove encrypted data keys that lost the write race: %s", err)
+			}
+		}
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	if len(succeeded) < s.writeQuorum {
+		return fmt.Errorf("only %d of %d replicated stores acknowledged the write, %d needed: %s", len(succeeded), len(s.stores), s.writeQuorum, lastErr)
+	}
+
+	return nil
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+// from the first store, which decides on the versions
+func (s *ReplicatedStore) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	return s.stores[0].GetVersionedEncryptedDataKeys(ctx, id)
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id in the first store if they are
+// at expectedVersion, and then copies them to the other stores at whatever version they are at there.
+// The first store counts towards the write quorum.
+func (s *ReplicatedStore) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	first := s.stores[0]
+	if err := first.UpdateEncryptedDataKeys(ctx, id, encryptedKeysMap, expectedVersion); err != nil {
+		return err
+	}
+
+	return s.writeToQuorum("update", func(store Store) error {
+		if store == first {
+			return nil
+		}
+
+		keys, version, err := store.GetVersionedEncryptedDataKeys(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		//the id may have missed this store when it was created
+		if keys == nil {
+			return store.SetEncryptedDataKeysConditionally(ctx, id, encryptedKeysMap)
+		}
+
+		return store.UpdateEncryptedDataKeys(ctx, id, encryptedKeysMap, version)
+	})
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id in every store
+func (s *ReplicatedStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.writeToQuorum("delete", func(store Store) error {
+		return store.DeleteEncryptedDataKeys(ctx, id)
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again in every store.
+// Stores that never received the id are not counted against the quorum.
+func (s *ReplicatedStore) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	var mutex sync.Mutex
+	found := false
+	err := s.writeToQuorum("restore", func(store Store) error {
+		err := store.RestoreEncryptedDataKeys(ctx, id)
+		if _, ok := err.(IDNotFoundStoreError); ok {
+			return nil
+		}
+
+		if err == nil {
+			mutex.Lock()
+			found = true
+			mutex.Unlock()
+		}
+		return err
+	})
+
+	if err == nil && !found {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return err
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id from every store
+func (s *ReplicatedStore) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.writeToQuorum("purge", func(store Store) error {
+		return store.PurgeEncryptedDataKeys(ctx, id)
+	})
+}
+
+// writeToQuorum calls write for every store and fails if less than writeQuorum stores succeeded
+func (s *ReplicatedStore) writeToQuorum(operation string, write func(store Store) error) error {
+	errs := s.writeToAll(write)
+
+	succeeded := 0
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			logger.Errorf("failed to %s in replicated store #%d: %s", operation, i, err)
+			lastErr = err
+			continue
+		}
+		succeeded++
+	}
+
+	if succeeded < s.writeQuorum {
+		return fmt.Errorf("only %d of %d replicated stores acknowledged the %s, %d needed: %s", succeeded, len(s.stores), operation, s.writeQuorum, lastErr)
+	}
+
+	return nil
+}
+
+// ListIDs pages through the ids of every store, one store after the other. The cursor is the index
+// of the store being listed followed by the cursor of that store. An id is only listed from the first
+// store that has it. Unlike reads, a store that can't be listed fails the page, to not skip its ids.
+func (s *ReplicatedStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	index, storeCursor, err := parseReplicatedCursor(cursor, len(s.stores))
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids, storeCursor, err := s.stores[index].ListIDs(ctx, storeCursor, limit)
+	if err != nil {
+		contextLogger(ctx).Infof("failed to list ids of replicated store #%d: %s", index, err)
+		return nil, "", err
+	}
+
+	//ids already listed from a previous store are left out
+	for i, store := range s.stores[:index] {
+		previous, err := getEncryptedDataKeysBatch(ctx, store, ids)
+		if err != nil {
+			contextLogger(ctx).Infof("failed to read from replicated store #%d: %s", i, err)
+			return nil, "", err
+		}
+
+		unique := ids[:0]
+		for _, id := range ids {
+			if _, found := previous[id]; !found {
+				unique = append(unique, id)
+			}
+		}
+		ids = unique
+	}
+
+	if storeCursor == "" {
+		if index++; index == len(s.stores) {
+			return ids, "", nil
+		}
+	}
+
+	return ids, strconv.Itoa(index) + ":" + storeCursor, nil
+}
+
+// parseReplicatedCursor splits a ReplicatedStore.ListIDs cursor into a store index and a store cursor
+func parseReplicatedCursor(cursor string, stores int) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+
+	parts := strings.SplitN(cursor, ":", 2)
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || index < 0 || index >= stores {
+		return 0, "", fmt.Errorf("invalid replicated store cursor %q", cursor)
+	}
+
+	return index, parts[1], nil
+}
+
+// ListDeletedIDs returns the sorted union of the ids deleted before the given time in every reachable store
+func (s *ReplicatedStore) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(func(store Store) ([]string, error) {
+		return store.ListDeletedIDs(ctx, deletedBefore)
+	})
+}
+
+func (s *ReplicatedStore) listIDs(list func(store Store) ([]string, error)) ([]string, error) {
+	unique := make(map[string]bool)
+	healthyStores := 0
+	var lastErr error
+
+	for i, store := range s.stores {
+		ids, err := list(store)
+		if err != nil {
+			logger.Infof("failed to list ids of replicated store #%d: %s", i, err)
+			lastErr = err
+			continue
+		}
+
+		healthyStores++
+		for _, id := range ids {
+			unique[id] = true
+		}
+	}
+
+	if healthyStores == 0 {
+		return nil, fmt.Errorf("failed to list ids of every replicated store: %s", lastErr)
+	}
+
+	ids := make([]string, 0, len(unique))
+	for id := range unique {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
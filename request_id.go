@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// RequestIDHeader is the header a request id is accepted from, and returned in
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength is the longest request id accepted from a client, longer ones being replaced by a generated id
+const MaxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// withRequestID returns a copy of ctx carrying the given request id
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext returns the request id of ctx, an empty string outside of a request
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// newRequestID generates a random request id of 32 hexadecimal characters
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID tells if a request id given by a client can be used as is: printable ASCII, no longer than
+// MaxRequestIDLength, so that it can't forge log lines or user agents
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > MaxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < '!' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestWithID returns the request with its request id in its context, the one of its X-Request-ID header
+// if valid, a generated one otherwise
+func requestWithID(r *http.Request) (*http.Request, string) {
+	requestID := r.Header.Get(RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+	}
+	return r.WithContext(withRequestID(r.Context(), requestID)), requestID
+}
+
+// addRequestIDToUserAgent appends the request id of the context of every AWS request made with the given stack to
+// its user agent, for the CloudTrail events of KMS and DynamoDB to be correlated with the request of rkms
+func addRequestIDToUserAgent(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("RKMSRequestID", func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+		if r, ok := in.Request.(*smithyhttp.Request); ok {
+			if requestID := requestIDFromContext(ctx); requestID != "" {
+				r.Header.Set("User-Agent", strings.TrimSpace(r.Header.Get("User-Agent")+" rkms-request-id/"+requestID))
+			}
+		}
+		return next.HandleBuild(ctx, in)
+	}), middleware.After)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestRequestWithID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, "given-id")
+	r, requestID := requestWithID(r)
+	if requestID != "given-id" || requestIDFromContext(r.Context()) != "given-id" {
+		t.Fatalf("the request id of the header should have been kept, got %q", requestID)
+	}
+
+	for _, invalid := range []string{"", "with space", "line\nbreak", strings.Repeat("a", MaxRequestIDLength+1)} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(RequestIDHeader, invalid)
+		r, requestID := requestWithID(r)
+		if requestID == invalid || len(requestID) != 32 || requestIDFromContext(r.Context()) != requestID {
+			t.Fatalf("a request id should have been generated instead of %q, got %q", invalid, requestID)
+		}
+	}
+}
+
+func TestDecoratorReturnsRequestID(t *testing.T) {
+	var handledRequestID string
+	handler := decorator(func(w http.ResponseWriter, r *http.Request) {
+		handledRequestID = requestIDFromContext(r.Context())
+	})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if handledRequestID == "" || recorder.Header().Get(RequestIDHeader) != handledRequestID {
+		t.Fatalf("the handled request id %q should have been returned, got %q", handledRequestID, recorder.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestContextLogger(t *testing.T) {
+	if _, ok := contextLogger(context.Background()).Data["request_id"]; ok {
+		t.Fatalf("no request id should be logged outside of a request")
+	}
+
+	if requestID := contextLogger(withRequestID(context.Background(), "id")).Data["request_id"]; requestID != "id" {
+		t.Fatalf("the request id should have been logged, got %v", requestID)
+	}
+}
+
+func TestAddRequestIDToUserAgent(t *testing.T) {
+	stack := middleware.NewStack("test", smithyhttp.NewStackRequest)
+	if err := addRequestIDToUserAgent(stack); err != nil {
+		t.Fatalf("failed to add the request id to the stack: %s", err)
+	}
+
+	var userAgent string
+	client := smithyhttp.ClientDoFunc(func(r *http.Request) (*http.Response, error) {
+		userAgent = r.Header.Get("User-Agent")
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	})
+	handler := middleware.DecorateHandler(smithyhttp.NewClientHandler(client), stack)
+	if _, _, err := handler.Handle(withRequestID(context.Background(), "id"), struct{}{}); err != nil {
+		t.Fatalf("failed to send the request: %s", err)
+	}
+	if !strings.Contains(userAgent, "rkms-request-id/id") {
+		t.Fatalf("the request id should have been added to the user agent, got %q", userAgent)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// the headers a request gives the public key the keys of its response are encrypted to, and its response tells the
+// algorithm they were encrypted with in
+const (
+	RecipientPublicKeyHeader     = "X-RKMS-Recipient-Public-Key"
+	KeyEncryptionAlgorithmHeader = "X-RKMS-Key-Encryption-Algorithm"
+)
+
+// the algorithms the keys of a response are encrypted to its recipient with: HPKE (RFC 9180) in base mode for an
+// X25519 public key, and for an RSA one an AES-256-GCM key of its own, wrapped with RSAES-OAEP-SHA-256, sealing the
+// key with a zero nonce
+const (
+	KeyEncryptionAlgorithmHPKE   = "HPKE_X25519_SHA256_AES_256_GCM"
+	KeyEncryptionAlgorithmRSAAES = "RSAES_OAEP_SHA_256_AES_256_GCM"
+)
+
+// MinRecipientRSAKeySizeInBits is the size of the smallest RSA public key the keys of a response are encrypted to
+const MinRecipientRSAKeySizeInBits = 2048
+
+// responseRecipient - the public key of the caller of a request, which the plaintext keys of its response are
+// encrypted to, for them to travel and be logged as ciphertexts, even past a proxy terminating TLS
+type responseRecipient struct {
+	algorithm string
+	hpkeKey   hpke.PublicKey
+	rsaKey    *rsa.PublicKey
+}
+
+// InvalidRecipientPublicKeyError is returned when a request gives a public key the keys of its response can't be
+// encrypted to
+type InvalidRecipientPublicKeyError struct {
+	Reason string
+}
+
+func (e InvalidRecipientPublicKeyError) Error() string {
+	return "invalid recipient public key: " + e.Reason
+}
+
+type responseRecipientContextKey struct{}
+
+// withResponseRecipient returns a copy of ctx whose response keys are encrypted to the given recipient
+func withResponseRecipient(ctx context.Context, recipient *responseRecipient) context.Context {
+	return context.WithValue(ctx, responseRecipientContextKey{}, recipient)
+}
+
+// responseRecipientFromContext returns the recipient of the keys of the response of ctx, nil when they are
+// returned in plaintext
+func responseRecipientFromContext(ctx context.Context) *responseRecipient {
+	recipient, _ := ctx.Value(responseRecipientContextKey{}).(*responseRecipient)
+	return recipient
+}
+
+// parseResponseRecipient parses the base64 public key of a recipient: the 32 bytes of an X25519 key, or the DER
+// SubjectPublicKeyInfo of an X25519 or an RSA key. It returns nil for an empty key.
+func parseResponseRecipient(encoded string) (*responseRecipient, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, InvalidRecipientPublicKeyError{"the public key isn't base64"}
+	}
+
+	var publicKey interface{}
+	if len(der) == 32 {
+		publicKey, err = ecdh.X25519().NewPublicKey(der)
+	} else {
+		publicKey, err = x509.ParsePKIXPublicKey(der)
+	}
+	if err != nil {
+		return nil, InvalidRecipientPublicKeyError{"the public key is neither an X25519 key nor a DER SubjectPublicKeyInfo: " + err.Error()}
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdh.PublicKey:
+		if key.Curve() != ecdh.X25519() {
+			return nil, InvalidRecipientPublicKeyError{"only X25519 and RSA public keys are supported"}
+		}
+		//X25519 isn't a FIPS approved key agreement
+		if _, fips := fipsCryptoModule(); fips {
+			return nil, InvalidRecipientPublicKeyError{"X25519 public keys aren't FIPS approved, an RSA public key is required in FIPS mode"}
+		}
+		hpkeKey, err := hpke.NewDHKEMPublicKey(key)
+		if err != nil {
+			return nil, InvalidRecipientPublicKeyError{err.Error()}
+		}
+		return &responseRecipient{algorithm: KeyEncryptionAlgorithmHPKE, hpkeKey: hpkeKey}, nil
+	case *rsa.PublicKey:
+		if key.N.BitLen() < MinRecipientRSAKeySizeInBits {
+			return nil, InvalidRecipientPublicKeyError{fmt.Sprintf("RSA public keys of less than %d bits aren't supported", MinRecipientRSAKeySizeInBits)}
+		}
+		return &responseRecipient{algorithm: KeyEncryptionAlgorithmRSAAES, rsaKey: key}, nil
+	}
+	return nil, InvalidRecipientPublicKeyError{"only X25519 and RSA public keys are supported"}
+}
+
+// responseKeyInfo is the HPKE info, and the OAEP label and the AAD for RSA, the keys of id are encrypted under,
+// binding the ciphertext to the id
+func responseKeyInfo(id string) []byte {
+	return []byte("rkms/v1/key/" + id)
+}
+
+// seal encrypts the plaintext key of id to the recipient
+func (rc *responseRecipient) seal(id string, plaintext *SecureBytes) ([]byte, error) {
+	info := responseKeyInfo(id)
+	if rc.hpkeKey != nil {
+		return hpke.Seal(rc.hpkeKey, hpke.HKDFSHA256(), hpke.AES256GCM(), info, plaintext.Bytes())
+	}
+
+	//the content encryption key only ever seals this plaintext, so a zero nonce can't repeat
+	contentKey := newSecureBytes(32)
+	defer contentKey.Destroy()
+	if _, err := rand.Read(contentKey.Bytes()); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rc.rsaKey, contentKey.Bytes(), info)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(wrappedKey, make([]byte, aead.NonceSize()), plaintext.Bytes(), info), nil
+}
+
+// sealResponseKey encrypts the key of id to the recipient of ctx, if its request gave one, replacing it with its
+// ciphertext, the plaintext being destroyed
+func sealResponseKey(ctx context.Context, id string, key **SecureBytes) error {
+	recipient := responseRecipientFromContext(ctx)
+	if recipient == nil || *key == nil {
+		return nil
+	}
+
+	ciphertext, err := recipient.seal(id, *key)
+	if err != nil {
+		return err
+	}
+	(*key).Destroy()
+	*key = secureBytesOf(ciphertext)
+	return nil
+}
+
+// sealHTTPResponseKey is sealResponseKey for a handler, telling the algorithm the key was encrypted with in the
+// X-RKMS-Key-Encryption-Algorithm header
+func sealHTTPResponseKey(w http.ResponseWriter, r *http.Request, id string, key **SecureBytes) error {
+	if recipient := responseRecipientFromContext(r.Context()); recipient != nil {
+		w.Header().Set(KeyEncryptionAlgorithmHeader, recipient.algorithm)
+	}
+	return sealResponseKey(r.Context(), id, key)
+}
+
+// requestWithResponseRecipient returns the request with the recipient of its X-RKMS-Recipient-Public-Key header in
+// its context, the request as is when it has none
+func requestWithResponseRecipient(r *http.Request) (*http.Request, error) {
+	recipient, err := parseResponseRecipient(r.Header.Get(RecipientPublicKeyHeader))
+	if err != nil || recipient == nil {
+		return r, err
+	}
+	return r.WithContext(withResponseRecipient(r.Context(), recipient)), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseResponseRecipient(t *testing.T) {
+	x25519Key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	spki, _ := x509.MarshalPKIXPublicKey(x25519Key.PublicKey())
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaSPKI, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	p256Key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	p256SPKI, _ := x509.MarshalPKIXPublicKey(p256Key.PublicKey())
+
+	recipients := map[string]string{
+		base64.StdEncoding.EncodeToString(x25519Key.PublicKey().Bytes()): KeyEncryptionAlgorithmHPKE,
+		base64.StdEncoding.EncodeToString(spki):                          KeyEncryptionAlgorithmHPKE,
+		base64.StdEncoding.EncodeToString(rsaSPKI):                       KeyEncryptionAlgorithmRSAAES,
+	}
+	for encoded, algorithm := range recipients {
+		if recipient, err := parseResponseRecipient(encoded); err != nil || recipient.algorithm != algorithm {
+			t.Errorf("the public key should have been encrypted to with %s, got %v", algorithm, err)
+		}
+	}
+
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("not a key")), base64.StdEncoding.EncodeToString(p256SPKI)} {
+		if _, err := parseResponseRecipient(encoded); err == nil {
+			t.Errorf("%s should have been rejected", encoded)
+		}
+	}
+
+	if recipient, err := parseResponseRecipient(""); recipient != nil || err != nil {
+		t.Fatalf("no public key shouldn't have given a recipient, got %v", err)
+	}
+
+	defer func() { fipsCryptoModule = cryptoModule }()
+	fipsCryptoModule = func() (string, bool) { return "test module", true }
+	if _, err := parseResponseRecipient(base64.StdEncoding.EncodeToString(spki)); err == nil {
+		t.Fatalf("an X25519 public key should have been rejected in FIPS mode")
+	}
+	if _, err := parseResponseRecipient(base64.StdEncoding.EncodeToString(rsaSPKI)); err != nil {
+		t.Fatalf("an RSA public key should have been accepted in FIPS mode, got %s", err)
+	}
+}
+
+func TestSealResponseKeyWithHPKE(t *testing.T) {
+	privateKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	recipient, err := parseResponseRecipient(base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := decorator(func(w http.ResponseWriter, r *http.Request) {
+		key := secureBytesOf([]byte("data-key"))
+		defer func() { key.Destroy() }()
+		if err := sealHTTPResponseKey(w, r, "id", &key); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(key.Bytes())
+	})
+	r := httptest.NewRequest(http.MethodGet, "/keys?id=id", nil)
+	r.Header.Set(RecipientPublicKeyHeader, base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()))
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	if recorder.Header().Get(KeyEncryptionAlgorithmHeader) != recipient.algorithm {
+		t.Fatalf("the algorithm of the key should have been told, got %q", recorder.Header().Get(KeyEncryptionAlgorithmHeader))
+	}
+
+	hpkeKey, _ := hpke.NewDHKEMPrivateKey(privateKey)
+	if _, err := hpke.Open(hpkeKey, hpke.HKDFSHA256(), hpke.AES256GCM(), responseKeyInfo("other-id"), recorder.Body.Bytes()); err == nil {
+		t.Fatalf("the key shouldn't have opened for another id")
+	}
+	plaintext, err := hpke.Open(hpkeKey, hpke.HKDFSHA256(), hpke.AES256GCM(), responseKeyInfo("id"), recorder.Body.Bytes())
+	if err != nil || string(plaintext) != "data-key" {
+		t.Fatalf("the key should have been encrypted to the recipient, got %q: %v", plaintext, err)
+	}
+}
+
+func TestSealResponseKeyWithRSA(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	spki, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	recipient, err := parseResponseRecipient(base64.StdEncoding.EncodeToString(spki))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := secureBytesOf([]byte("data-key"))
+	plaintextKey := key
+	if err := sealResponseKey(withResponseRecipient(t.Context(), recipient), "id", &key); err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+	if plaintextKey.Len() != 0 {
+		t.Fatalf("the plaintext key should have been destroyed")
+	}
+
+	ciphertext := key.Bytes()
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, ciphertext[:privateKey.Size()], responseKeyInfo("id"))
+	if err != nil {
+		t.Fatalf("the content key should have been wrapped to the recipient, got %s", err)
+	}
+	block, _ := aes.NewCipher(contentKey)
+	aead, _ := cipher.NewGCM(block)
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[privateKey.Size():], responseKeyInfo("id"))
+	if err != nil || string(plaintext) != "data-key" {
+		t.Fatalf("the key should have been sealed with the content key, got %q: %v", plaintext, err)
+	}
+}
+
+func TestDecoratorRejectsInvalidRecipientPublicKey(t *testing.T) {
+	handled := false
+	handler := decorator(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RecipientPublicKeyHeader, base64.StdEncoding.EncodeToString([]byte("not a key")))
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	if handled || recorder.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid recipient public key should have been answered with 400, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// throttlingErrorCodes are the AWS error codes of the requests rejected for exceeding a rate or a capacity,
+// which weren't applied
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"LimitExceededException":                 true,
+	"SlowDown":                               true,
+}
+
+// transientErrorCodes are the AWS error codes of the requests which failed on a transient condition, and may
+// have been applied
+var transientErrorCodes = map[string]bool{
+	"KMSInternalException":       true,
+	"DependencyTimeoutException": true,
+	"InternalServerError":        true,
+	"InternalFailure":            true,
+	"ServiceUnavailable":         true,
+	"RequestTimeout":             true,
+	"RequestTimeoutException":    true,
+}
+
+// retryPolicy - retries the calls failing with a retryable error up to maxAttempts calls in all, waiting a random
+// backoff between 0 and initialBackoff doubled on every retry, up to maxBackoff (exponential backoff with full
+// jitter, for the retries of many clients not to be synchronized). Every call is given attemptTimeout at most, a
+// call timing out being retried while the deadline of the request allows. The zero value calls once.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	attemptTimeout time.Duration
+}
+
+func newRetryPolicy(config RetryConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: time.Duration(config.InitialBackoffInMilliseconds) * time.Millisecond,
+		maxBackoff:     time.Duration(config.MaxBackoffInMilliseconds) * time.Millisecond,
+		attemptTimeout: time.Duration(config.AttemptTimeoutInMilliseconds) * time.Millisecond,
+	}
+}
+
+// do calls f with the context of every attempt until it succeeds, fails with an error which isn't retryable,
+// maxAttempts calls were made or ctx is done, returning the error of the last call. The calls which may have been
+// applied although they failed, e.g. on a timeout, are only retried when f is idempotent. No retry is made when
+// its backoff would pass the deadline of ctx. onRetry is called before every retry.
+func (p retryPolicy) do(ctx context.Context, idempotent bool, onRetry func(), f func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := attemptContext(ctx, p.attemptTimeout)
+		err := f(attemptCtx)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if err == nil || attempt >= p.maxAttempts {
+			return err
+		}
+
+		retryable, rejected := classifyError(err)
+		if timedOut {
+			retryable, rejected = true, false
+		}
+		if !retryable || (!idempotent && !rejected) {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			return err
+		}
+
+		onRetry()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff returns how long to wait before the given retry, the first one being retry 1
+func (p retryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.maxBackoff
+	if shift := uint(retry - 1); shift < 32 && p.initialBackoff<<shift < ceiling {
+		ceiling = p.initialBackoff << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// classifyError tells if the call which failed with err may succeed when retried, and if it was rejected without
+// being applied. The throttling errors, the server errors and the timeouts of the AWS services are retryable, as
+// are the errors with a Temporary method returning true, e.g. of the other key providers and stores.
+func classifyError(err error) (retryable bool, rejected bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, false
+	}
+
+	if code := awsErrorCode(err); code != "" {
+		if throttlingErrorCodes[code] {
+			return true, true
+		}
+		if transientErrorCodes[code] {
+			return true, false
+		}
+		if statusCode := awsStatusCode(err); statusCode != 0 {
+			if statusCode == 429 {
+				return true, true
+			}
+			return statusCode >= 500, false
+		}
+		return false, false
+	}
+	//the request couldn't be sent, e.g. on a connection reset
+	if isAWSRequestError(err) {
+		return true, false
+	}
+
+	if temporary, ok := err.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+		return true, false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true, false
+	}
+	return false, false
+}
+
+// awsErrorCode returns the error code an AWS service answered with, "" when err isn't the error of an AWS service
+func awsErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// awsStatusCode returns the HTTP status code an AWS service answered with, 0 when err isn't the error of an answer
+func awsStatusCode(err error) int {
+	var responseErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &responseErr) {
+		return responseErr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// isAWSRequestError tells if the request to an AWS service failed to be sent, e.g. on a connection reset
+func isAWSRequestError(err error) bool {
+	var sendErr *smithyhttp.RequestSendError
+	return errors.As(err, &sendErr)
+}
+
+// retryKeyProvider calls f, an operation of the key provider of region, with the retry policy of the key providers,
+// every call going through the circuit breaker of the region
+func (r *RKMS) retryKeyProvider(ctx context.Context, region string, operation string, f func(ctx context.Context) error) error {
+	breaker := r.kmsBreakers[region]
+	return r.kmsRetry.do(ctx, true, func() { keyProviderRetriesTotal.inc(region, operation) }, func(ctx context.Context) error {
+		return breaker.call(ctx, isKeyProviderFailure, func() error { return f(ctx) })
+	})
+}
+
+// isKeyProviderFailure tells if err is a failure of the key provider itself, as opposed to e.g. a ciphertext
+// it can't decrypt
+func isKeyProviderFailure(err error) bool {
+	retryable, _ := classifyError(err)
+	return retryable
+}
+
+// retryStore calls f, an operation of the store, with the retry policy of the store. The conditional writes aren't
+// idempotent: applied before failing, e.g. on a timeout, their retry would fail on the version they changed.
+func (r *RKMS) retryStore(ctx context.Context, operation string, idempotent bool, f func(ctx context.Context) error) error {
+	return r.storeRetry.do(ctx, idempotent, func() { storeRetriesTotal.inc(operation) }, f)
+}
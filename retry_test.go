@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// flakyKeyProvider fails the first failures calls to Decrypt with err
+type flakyKeyProvider struct {
+	KeyProvider
+	err      error
+	failures int
+	calls    int
+}
+
+func (p *flakyKeyProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return nil, p.err
+	}
+	return ciphertext, nil
+}
+
+// newTestAWSResponseError returns the error of an AWS service answering with the given error code and status code
+func newTestAWSResponseError(code string, statusCode int) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: statusCode}},
+		Err:      &smithy.GenericAPIError{Code: code, Message: http.StatusText(statusCode)},
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+		rejected  bool
+	}{
+		{&smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}, true, true},
+		{&smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException", Message: "capacity exceeded"}, true, true},
+		{&smithy.GenericAPIError{Code: "KMSInternalException", Message: "internal error"}, true, false},
+		{newTestAWSResponseError("Unknown", http.StatusBadGateway), true, false},
+		{newTestAWSResponseError("Unknown", http.StatusTooManyRequests), true, true},
+		{&smithyhttp.RequestSendError{Err: errors.New("connection reset by peer")}, true, false},
+		{&smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not allowed"}, false, false},
+		{&smithy.GenericAPIError{Code: "ConditionalCheckFailedException", Message: "version mismatch"}, false, false},
+		{context.DeadlineExceeded, false, false},
+		{errors.New("invalid ciphertext"), false, false},
+	} {
+		retryable, rejected := classifyError(test.err)
+		if retryable != test.retryable || rejected != test.rejected {
+			t.Errorf("%v should have been retryable %t and rejected %t, got %t and %t", test.err, test.retryable, test.rejected, retryable, rejected)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, initialBackoff: 10 * time.Millisecond, maxBackoff: 50 * time.Millisecond}
+	for retry, ceiling := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 40: 50 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			if backoff := p.backoff(retry); backoff < 0 || backoff >= ceiling {
+				t.Fatalf("the backoff of retry %d should have been less than %s, got %s", retry, ceiling, backoff)
+			}
+		}
+	}
+
+	if backoff := (retryPolicy{}).backoff(1); backoff != 0 {
+		t.Fatalf("no backoff should have been waited without a backoff, got %s", backoff)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3}
+	throttled, timedOut := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}, &smithy.GenericAPIError{Code: "RequestTimeout", Message: "timed out"}
+
+	for _, test := range []struct {
+		name       string
+		idempotent bool
+		errs       []error
+		calls      int
+	}{
+		{"succeeds once retried", true, []error{throttled, nil}, 2},
+		{"stops after the last attempt", true, []error{throttled, throttled, throttled, nil}, 3},
+		{"stops on an error which isn't retryable", true, []error{errors.New("invalid"), nil}, 1},
+		{"retries the throttled calls which aren't idempotent", false, []error{throttled, nil}, 2},
+		{"doesn't retry the calls which aren't idempotent and may have been applied", false, []error{timedOut, nil}, 1},
+	} {
+		calls, retries := 0, 0
+		err := p.do(context.Background(), test.idempotent, func() { retries++ }, func(context.Context) error {
+			calls++
+			return test.errs[calls-1]
+		})
+
+		if calls != test.calls || retries != calls-1 || err != test.errs[calls-1] {
+			t.Errorf("%s: expected %d calls, got %d calls, %d retries and %v", test.name, test.calls, calls, retries, err)
+		}
+	}
+}
+
+func TestRetryPolicyDoStopsOnCancel(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Hour, maxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := p.do(ctx, true, cancel, func(context.Context) error {
+		calls++
+		return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	})
+
+	if calls != 1 || err == nil {
+		t.Fatalf("the backoff should have been stopped by the cancellation, got %d calls and %v", calls, err)
+	}
+}
+
+func TestDecryptDataKeyRetriesThrottledRegion(t *testing.T) {
+	provider := &flakyKeyProvider{err: &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}, failures: 2}
+	r := &RKMS{regions: []string{"region-0"}, providers: map[string]KeyProvider{"region-0": provider}, kmsRetry: retryPolicy{maxAttempts: 3}}
+	retries := keyProviderRetriesTotal.value([]string{"region-0", "Decrypt"}).count
+
+	plaintext, region, err := r.decryptDataKeyInRegion(context.Background(), r.providers, map[string]string{"region-0": "ZGF0YS1rZXk="}, nil)
+	if err != nil || plaintext == nil || region != "region-0" {
+		t.Fatalf("the data key should have been decrypted once retried, got %v", err)
+	}
+
+	if provider.calls != 3 || keyProviderRetriesTotal.value([]string{"region-0", "Decrypt"}).count != retries+2 {
+		t.Fatalf("the 2 throttled calls should have been retried and counted, got %d calls", provider.calls)
+	}
+}
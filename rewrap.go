@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// MaxNumberOfRewrapTries is the number of attempts to rewrap the data key of an id updated concurrently
+const MaxNumberOfRewrapTries = 3
+
+// rewrapDataKeys encrypts the data key of every id again with the keys currently configured for each region,
+// e.g. once the key ids point to new KMS keys, and updates them at the version they were read at.
+// The ciphertexts of a region that fails to encrypt are left as they were, and the id counted as failed.
+// It returns the number of ids rewrapped and the number of ids that failed.
+func rewrapDataKeys(ctx context.Context, r *RKMS) (int, int, error) {
+	rewrapped, failed := 0, 0
+	cursor := ""
+	for {
+		var ids []string
+		var nextCursor string
+		err := r.retryStore(ctx, "list", true, func(ctx context.Context) (err error) {
+			ids, nextCursor, err = r.store.ListIDs(ctx, cursor, DefaultListIDsLimit)
+			return err
+		})
+		if err != nil {
+			logger.Errorf("failed to list ids to rewrap: %s", err)
+			return rewrapped, failed, err
+		}
+
+		for _, id := range ids {
+			if err := r.rewrapID(ctx, id); err != nil {
+				if ctx.Err() != nil {
+					return rewrapped, failed, err
+				}
+
+				logger.WithField("id", id).Errorf("failed to rewrap the data key: %s", err)
+				failed++
+				continue
+			}
+			rewrapped++
+		}
+
+		if nextCursor == "" {
+			return rewrapped, failed, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// RewrapKey encrypts the data key of the given id again with the keys currently configured for each region, as
+// `rkms rewrap` does for every id, once approved when rewrapping is under dual control
+func (r *RKMS) RewrapKey(ctx context.Context, id string) (*KeyMetadata, error) {
+	ctx = withLogID(ctx, id)
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, err
+	}
+	if err := r.requireApproval(ctx, ApprovalActionRewrap, id, 0); err != nil {
+		return nil, err
+	}
+
+	if err := r.rewrapID(ctx, id); err != nil {
+		contextLogger(ctx).Errorf("failed to rewrap the data key: %s", err)
+		return nil, err
+	}
+	return r.GetKeyMetadata(ctx, id)
+}
+
+// rewrapID encrypts the data key of the given id again in every region, retrying when it is updated concurrently
+func (r *RKMS) rewrapID(ctx context.Context, id string) error {
+	var err error
+	for i := 0; i < MaxNumberOfRewrapTries; i++ {
+		var encryptedDataKeys map[string]string
+		var version int64
+		err = r.retryStore(ctx, "get", true, func(ctx context.Context) (err error) {
+			encryptedDataKeys, version, err = r.store.GetVersionedEncryptedDataKeys(ctx, id)
+			return err
+		})
+		if _, ok := err.(IDDeletedStoreError); ok || (err == nil && encryptedDataKeys == nil) {
+			//deleted, purged or expired since it was listed
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		encryptionContext, err := storedEncryptionContext(encryptedDataKeys)
+		if err != nil {
+			return err
+		}
+
+		versions := splitDataKeyVersions(encryptedDataKeys)
+		failedRegions := make([]string, 0)
+		for _, regions := range versions {
+			failed, err := r.rewrapDataKeyVersion(ctx, r.providersFor(id), regions, encryptionContext)
+			if err != nil {
+				return err
+			}
+			failedRegions = append(failedRegions, failed...)
+		}
+
+		rewrappedDataKeys := joinDataKeyVersions(versions)
+		copyMetadataEntries(rewrappedDataKeys, encryptedDataKeys)
+
+		err = r.retryStore(ctx, "update", false, func(ctx context.Context) error {
+			return r.store.UpdateEncryptedDataKeys(ctx, id, rewrappedDataKeys, version)
+		})
+		if _, ok := err.(VersionMismatchStoreError); ok {
+			logger.Debugf("id %q was updated while being rewrapped, retrying", id)
+			continue
+		}
+
+		if err == nil && len(failedRegions) > 0 {
+			err = fmt.Errorf("failed to encrypt the data key in regions %v, their previous ciphertexts were kept", failedRegions)
+		}
+		return err
+	}
+
+	return err
+}
+
+// rewrapDataKeyVersion encrypts the data key of a data key version again in every region with the given providers,
+// split into shares or whole as new data keys are, returning the regions that failed to
+func (r *RKMS) rewrapDataKeyVersion(ctx context.Context, providers map[string]KeyProvider, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) ([]string, error) {
+	plaintextDataKey, err := r.decryptDataKey(ctx, providers, encryptedDataKeys, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintextDataKey.Destroy()
+
+	ciphertexts, failedRegions := r.encryptDataKeyVersion(ctx, providers, plaintextDataKey, encryptionContext)
+	for region, ciphertext := range ciphertexts {
+		encryptedDataKeys[region] = ciphertext
+	}
+
+	return failedRegions, nil
+}
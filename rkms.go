@@ -2,16 +2,10 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
-	"strings"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
-	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"sync"
+	"time"
+
 	logger "github.com/sirupsen/logrus"
 )
 
@@ -23,274 +17,760 @@ const MaxNumberOfGetPlaintextDataKeyTries = 3
 
 // RKMS - Implementation of reliable KMS logic
 type RKMS struct {
-	regions []string
-	keyIds  map[string]*string
-	clients map[string]kmsiface.KMSAPI
-	store   Store
+	regions   []string
+	providers map[string]KeyProvider
+	health    *ProviderHealthChecker
+	store     Store
 
 	// the length of the data encryption key in bytes
 	dataKeySizeInBytes int64
+
+	// the number of regions a new data key has to be encrypted in to be saved, 0 for every region it is encrypted in
+	minSuccessfulRegions int
+
+	// the providers of the ids of the key sets, used instead of providers, the longest prefixes first
+	keySets []keySet
+
+	// the retries of the calls to the key providers and of the requests to the store
+	kmsRetry   retryPolicy
+	storeRetry retryPolicy
+
+	// the circuit breakers of the key providers of the regions
+	kmsBreakers map[string]*circuitBreaker
+
+	// how long a decryption is given before being hedged to the next region, 0 decrypting in every region at once
+	hedgeDelay time.Duration
+
+	// the number of regions a data key is encrypted in at the same time, 0 for every region
+	encryptConcurrency int
+
+	// the calls for the data keys of ids in flight, shared by the concurrent requests for the same id
+	flights *dataKeyFlights
+
+	// the plaintext data keys decrypted for the requests, nil when they aren't cached
+	plaintextCache *plaintextCache
+
+	// the format the ciphertexts of the new data keys are saved in, every format being read
+	wrappedKeyFormat int
+
+	// the number of the shares the new data keys are split into, one by region, that reconstruct them, 0 for the
+	// data keys to be encrypted whole in every region
+	shamirThreshold int
+
+	// how long after it was generated the latest version of a data key is released, 0 for the data keys of any age
+	maxDataKeyAge time.Duration
+
+	// the patterns of the IAM roles the requests can have their calls to AWS KMS made with
+	assumableRoleARNs []string
 }
 
-// NewRKMSWithDynamoDB creates a new RKMS instance with DynamoDB used as its key/value store
-func NewRKMSWithDynamoDB(kmsConfig KMSConfig, dynamoDBConfig DynamoDBConfig) (*RKMS, error) {
-	store, err := NewDynamoDBStore(dynamoDBConfig)
+// NewRKMS creates a new RKMS instance with the given store used as its key/value store, its requests being retried
+// as storeRetry sets
+func NewRKMS(kmsConfig KMSConfig, store Store, storeRetry RetryConfig) (*RKMS, error) {
+	providers, err := NewKeyProviders(kmsConfig)
 	if err != nil {
 		logger.Error(err)
 		return nil, err
 	}
 
-	clients, err := getKMSClientsForRegions(kmsConfig.Regions)
+	keySets, err := newKeySets(kmsConfig)
 	if err != nil {
 		logger.Error(err)
 		return nil, err
 	}
 
-	return &RKMS{kmsConfig.Regions, kmsConfig.KeyIds, clients, store, kmsConfig.DataKeySizeInBytes}, nil
+	breakers := make(map[string]*circuitBreaker, len(kmsConfig.Regions))
+	for _, region := range kmsConfig.Regions {
+		breakers[region] = newCircuitBreaker("kms:"+region, kmsConfig.CircuitBreaker)
+	}
+
+	timeout := time.Duration(kmsConfig.HealthCheckTimeoutInMilliseconds) * time.Millisecond
+	health := NewProviderHealthChecker(kmsConfig.Regions, providers, timeout)
+	return &RKMS{kmsConfig.Regions, providers, health, store, kmsConfig.DataKeySizeInBytes, kmsConfig.MinSuccessfulRegions, keySets,
+		newRetryPolicy(kmsConfig.Retry), newRetryPolicy(storeRetry), breakers, time.Duration(kmsConfig.HedgeDelayInMilliseconds) * time.Millisecond,
+		kmsConfig.EncryptConcurrency, newDataKeyFlights(), newPlaintextCache(kmsConfig.PlaintextCache), kmsConfig.WrappedKeyFormat,
+		kmsConfig.ShamirThreshold, time.Duration(kmsConfig.MaxDataKeyAgeInDays) * 24 * time.Hour, kmsConfig.AssumableRoleARNs}, nil
 }
 
-func getKMSClientsForRegions(regions []string) (map[string]kmsiface.KMSAPI, error) {
-	clients := make(map[string]kmsiface.KMSAPI)
+// ProviderHealth returns the health of the key provider of every region, with the state of its circuit breaker
+func (r *RKMS) ProviderHealth() []ProviderHealth {
+	if r.health == nil {
+		return nil
+	}
 
-	for _, region := range regions {
-		client, err := getKMSClientForRegion(region)
-		if err != nil {
-			return nil, err
+	health := r.health.Health()
+	for i := range health {
+		health[i].Circuit = r.kmsBreakers[health[i].Region].State()
+	}
+	return health
+}
+
+// encryptionRegions returns the regions new data keys are encrypted in: the regions whose provider is healthy
+// and whose circuit breaker isn't open. Data keys created while a region is left out have no ciphertext for it.
+// When no provider is healthy, every region is tried rather than failing right away.
+func (r *RKMS) encryptionRegions() []string {
+	regions := make([]string, 0, len(r.regions))
+	for _, region := range r.regions {
+		if (r.health == nil || r.health.Healthy(region)) && !r.kmsBreakers[region].open() {
+			regions = append(regions, region)
 		}
-		clients[region] = client
 	}
 
-	return clients, nil
+	if len(regions) == 0 {
+		return r.regions
+	}
+	return regions
+}
+
+// InsufficientRegionsError is returned when a new data key could not be encrypted in enough regions to be saved
+type InsufficientRegionsError struct {
+	Succeeded int
+	Required  int
 }
 
-func getKMSClientForRegion(region string) (kmsiface.KMSAPI, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
+func (e InsufficientRegionsError) Error() string {
+	return fmt.Sprintf("the data key was encrypted in %d regions, %d are required", e.Succeeded, e.Required)
+}
+
+// TTLNotSupportedError is returned when a data key with a TTL is requested from a store
+// that can't expire encrypted data keys
+type TTLNotSupportedError struct{}
+
+func (e TTLNotSupportedError) Error() string {
+	return "the store does not support data keys with a TTL"
+}
+
+// GetPlaintextDataKey retrieves the key assosicated with the given id.
+// If a key is not found in the store, a key is generated for the given id. The caller destroys the key.
+func (r *RKMS) GetPlaintextDataKey(ctx context.Context, id string) (*SecureBytes, error) {
+	dataKey, err := r.GetDataKey(ctx, id, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dataKey.Plaintext, nil
+}
+
+// GetDataKey retrieves the latest version of the key assosicated with the given id, generating it if there is none.
+// A key generated for ephemeral use expires after ttl, 0 meaning never; the TTL of an existing key is left as it is.
+// A generated key is bound to the given encryption context, which an existing key has to have been created with.
+func (r *RKMS) GetDataKey(ctx context.Context, id string, ttl time.Duration, encryptionContext EncryptionContext) (*DataKey, error) {
+	ctx = withLogID(ctx, id)
+	//the caller is authorized before sharing the data key another request is getting
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	//the requests calling KMS on behalf of their caller don't share the calls of the others
+	flights := r.flights
+	if kmsAttributionFromContext(ctx) != nil {
+		flights = nil
+	}
+	return flights.do(ctx, dataKeyFlightKey(id, ttl, encryptionContext), func(ctx context.Context) (*DataKey, error) {
+		expiresAt, err := r.expiresAt(ttl)
+		if err != nil {
+			return nil, err
+		}
+		return r.getDataKey(ctx, id, expiresAt, encryptionContext, MaxNumberOfGetPlaintextDataKeyTries, nil)
 	})
+}
 
+// CreateDataKey generates the data key of a new id, failing with an IDAlreadyExistsStoreError if the id exists.
+// The key expires after ttl, 0 meaning never, and is bound to the given encryption context.
+func (r *RKMS) CreateDataKey(ctx context.Context, id string, ttl time.Duration, encryptionContext EncryptionContext) (*DataKey, error) {
+	ctx = withLogID(ctx, id)
+	expiresAt, err := r.expiresAt(ttl)
 	if err != nil {
 		return nil, err
 	}
 
-	return kms.New(sess), nil
+	plaintextDataKey, err := r.createDataKeyForID(ctx, id, expiresAt, encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{ID: id, Plaintext: plaintextDataKey, Version: FirstDataKeyVersion, ExpiresAt: expiresAt}, nil
 }
 
-// GetPlaintextDataKey retrieves the key assosicated with the given id.
-// If a key is not found in the store, a key is generated for the given id.
-func (r *RKMS) GetPlaintextDataKey(ctx context.Context, id string) (*string, error) {
-	return r.getPlaintextDataKey(ctx, id, MaxNumberOfGetPlaintextDataKeyTries, nil)
+// expiresAt is the time a key generated now with the given TTL expires at, the zero time for a TTL of 0
+func (r *RKMS) expiresAt(ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+
+	if _, ok := r.store.(ExpiringStore); !ok {
+		return time.Time{}, TTLNotSupportedError{}
+	}
+	return time.Now().Add(ttl), nil
 }
 
-func (r *RKMS) getPlaintextDataKey(ctx context.Context, id string, triesLeft int, lastErr error) (*string, error) {
+func (r *RKMS) getDataKey(ctx context.Context, id string, expiresAt time.Time, encryptionContext EncryptionContext, triesLeft int, lastErr error) (*DataKey, error) {
 	if triesLeft == 0 {
 		return nil, lastErr
 	}
 
-	plaintextDataKey, err := r.lookInStoreForDataKey(ctx, id)
+	dataKey, err := r.lookInStoreForDataKey(ctx, id, 0, encryptionContext)
 	if err != nil {
-		logger.Error(err)
+		contextLogger(ctx).Error(err)
 		return nil, err
 	}
 
-	if plaintextDataKey != nil {
-		logger.Debugln("a data key was found in the store for the given id")
-		return plaintextDataKey, nil
+	if dataKey != nil {
+		contextLogger(ctx).Debugln("a data key was found in the store for the given id")
+		return dataKey, nil
 	}
 
-	plaintextDataKey, err = r.createDataKeyForID(ctx, id)
+	plaintextDataKey, err := r.createDataKeyForID(ctx, id, expiresAt, encryptionContext)
 	if err != nil {
 		if _, ok := err.(IDAlreadyExistsStoreError); ok {
-			//retry the whole process which will retry fetching data from store
-			return r.getPlaintextDataKey(ctx, id, triesLeft-1, err)
+			//another request created the data key first: its key is read back, strongly for the read to see it,
+			//and returned, the whole process being retried only when it can't be read, e.g. it was deleted or
+			//expired since
+			contextLogger(ctx).Debugln("the data key of the id was created by another request first, reading it back")
+			strongCtx := withReadConsistency(ctx, ReadConsistencyStrong)
+			if dataKey, err := r.lookInStoreForDataKey(strongCtx, id, 0, encryptionContext); err != nil || dataKey != nil {
+				return dataKey, err
+			}
+			return r.getDataKey(ctx, id, expiresAt, encryptionContext, triesLeft-1, err)
 		}
 
-		logger.Error(err)
+		contextLogger(ctx).Error(err)
 		return nil, err
 	}
 
 	//return the data key
-	return plaintextDataKey, nil
+	return &DataKey{ID: id, Plaintext: plaintextDataKey, Version: FirstDataKeyVersion, ExpiresAt: expiresAt}, nil
 }
 
-func (r *RKMS) lookInStoreForDataKey(ctx context.Context, id string) (*string, error) {
-	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
+// lookInStoreForDataKey decrypts the given version of the data key of id, the latest one for version 0.
+// It returns nil if the id doesn't exist, a DataKeyVersionNotFoundError if the version doesn't
+// and an EncryptionContextMismatchError if the id was created with another encryption context.
+func (r *RKMS) lookInStoreForDataKey(ctx context.Context, id string, version int64, encryptionContext EncryptionContext) (*DataKey, error) {
+	//the read leaves as much time to decrypt the data key, or to create it
+	storeCtx, cancel := budgetContext(ctx, 2)
+	encryptedDataKeys, expiresAt, err := r.getEncryptedDataKeys(storeCtx, id)
+	cancel()
 	if err != nil {
-		logger.Error(err)
+		contextLogger(ctx).Error(err)
 		return nil, err
 	}
 
 	if encryptedDataKeys == nil {
-		logger.Debugln("no data key exists in the store for the given id")
+		contextLogger(ctx).Debugln("no data key exists in the store for the given id")
 		return nil, nil
 	}
 
-	plaintextDataKey, err := r.decryptDataKey(ctx, encryptedDataKeys)
+	return r.decryptDataKeyVersion(ctx, id, encryptedDataKeys, version, encryptionContext, expiresAt)
+}
+
+// decryptDataKeyVersion decrypts the given version of the encrypted data keys of id, the latest one for version 0
+func (r *RKMS) decryptDataKeyVersion(ctx context.Context, id string, encryptedDataKeys map[string]string, version int64, encryptionContext EncryptionContext, expiresAt time.Time) (*DataKey, error) {
+	if err := checkEncryptionContext(id, encryptedDataKeys, encryptionContext); err != nil {
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+
+	if err := checkKeyState(id, encryptedDataKeys); err != nil {
+		return nil, err
+	}
+
+	if err := checkSymmetricDataKey(id, encryptedDataKeys); err != nil {
+		return nil, err
+	}
+
+	if err := r.checkCryptoperiod(id, encryptedDataKeys, version); err != nil {
+		return nil, err
+	}
+
+	return r.decryptCheckedDataKeyVersion(ctx, id, encryptedDataKeys, version, encryptionContext, expiresAt)
+}
+
+// decryptCheckedDataKeyVersion decrypts the given version of the encrypted data keys of id, the latest one for
+// version 0, through the plaintext cache, once their encryption context, state and usage were checked
+func (r *RKMS) decryptCheckedDataKeyVersion(ctx context.Context, id string, encryptedDataKeys map[string]string, version int64, encryptionContext EncryptionContext, expiresAt time.Time) (*DataKey, error) {
+	versions := splitDataKeyVersions(encryptedDataKeys)
+	if version == 0 {
+		version = latestDataKeyVersion(versions)
+	}
+
+	if _, ok := versions[version]; !ok {
+		return nil, DataKeyVersionNotFoundError{ID: id, Version: version}
+	}
+
+	//the requests calling KMS on behalf of their caller decrypt in KMS every time, for CloudTrail to show them all
+	cacheKey := plaintextCacheKey(versions[version], encryptionContext)
+	if kmsAttributionFromContext(ctx) == nil {
+		if plaintextDataKey, ok := r.plaintextCache.get(cacheKey); ok {
+			return &DataKey{ID: id, Plaintext: plaintextDataKey, Version: version, ExpiresAt: expiresAt}, nil
+		}
+	}
+
+	plaintextDataKey, err := r.decryptDataKey(ctx, r.providersFor(id), versions[version], encryptionContext)
 	if err != nil {
 		err := fmt.Errorf("failed to decrypt data key in every region: %s", err)
-		logger.Error(err)
+		contextLogger(ctx).Error(err)
 		return nil, err
 	}
 
-	return plaintextDataKey, err
+	r.plaintextCache.put(cacheKey, plaintextDataKey)
+	return &DataKey{ID: id, Plaintext: plaintextDataKey, Version: version, ExpiresAt: expiresAt}, nil
 }
 
-type encryptDataKeyResult struct {
-	region     string
-	ciphertext *string
-	err        error
+// getEncryptedDataKeys reads the encrypted data keys of the given id along with the time they expire at,
+// if the store can expire them. Every data key is read, or looked for before being created, through it, so it
+// returns an IDNotPermittedError when the caller isn't permitted the id.
+func (r *RKMS) getEncryptedDataKeys(ctx context.Context, id string) (map[string]string, time.Time, error) {
+	if err := authorizeID(ctx, id); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ctx, endSpan := startStoreSpan(ctx, "get", id)
+	var encryptedDataKeys map[string]string
+	var expiresAt time.Time
+	err := r.retryStore(ctx, "get", true, func(ctx context.Context) (err error) {
+		if store, ok := r.store.(ExpiringStore); ok {
+			encryptedDataKeys, expiresAt, err = store.GetExpiringEncryptedDataKeys(ctx, id)
+			return err
+		}
+		encryptedDataKeys, err = r.store.GetEncryptedDataKeys(ctx, id)
+		return err
+	})
+	endSpan(err)
+	return encryptedDataKeys, expiresAt, err
 }
 
-func (r *RKMS) createDataKeyForID(ctx context.Context, id string) (*string, error) {
-	logger.Debugln("creating data key...")
-	firstRegion, plaintextDataKey, firstRegionCiphertext, err := r.createDataKey(ctx)
+func (r *RKMS) createDataKeyForID(ctx context.Context, id string, expiresAt time.Time, encryptionContext EncryptionContext) (*SecureBytes, error) {
+	if err := checkReservedID(id); err != nil {
+		return nil, err
+	}
+
+	encryptCtx, cancel := budgetContext(ctx, 2)
+	plaintextDataKey, encryptedDataKeys, err := r.encryptNewDataKey(encryptCtx, r.providersFor(id), encryptionContext)
+	cancel()
 	if err != nil {
-		logger.Errorf("failed to create a data key: %s", err)
 		return nil, err
 	}
+	setEncryptionContextEntry(encryptedDataKeys, encryptionContext)
+	setMetadataEntry(encryptedDataKeys, &KeyMetadata{CreatedAt: time.Now(), CreatedBy: identityFromContext(ctx), KeySpec: keySpec(r.dataKeySizeInBytes), State: KeyStateEnabled})
+
+	contextLogger(ctx).Debugln("saving encrypted data keys in store...")
+	storeCtx, endSpan := startStoreSpan(ctx, "set", id)
+	err = r.retryStore(storeCtx, "set", false, func(ctx context.Context) error {
+		if expiresAt.IsZero() {
+			return r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
+		}
+		return r.store.(ExpiringStore).SetExpiringEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys, expiresAt)
+	})
+	endSpan(err)
 
-	encryptedDataKeys := make(map[string]string)
-	encryptedDataKeys[*firstRegion] = *firstRegionCiphertext
+	if err != nil {
+		//losing the race to create the data key of the id isn't a failure of the store
+		if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+			contextLogger(ctx).Errorf("failed to save encrypted data keys in key/value store: %s", err)
+		}
+		plaintextDataKey.Destroy()
+		return nil, err
+	}
 
-	resultsChannel := make(chan encryptDataKeyResult, len(r.regions)-1)
-	childCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	contextLogger(ctx).Debugln("done creating and saving encrypted data keys")
+	return plaintextDataKey, nil
+}
 
-	logger.Debugln("encrypting generated data key in every region...")
-	for _, region := range r.regions {
-		if strings.Compare(region, *firstRegion) == 0 { //we have already encrypted in this region and have the ciphertext
-			continue
+// createGeneratedKeyForID saves a key generated by rkms rather than by a key provider, e.g. the private key of a
+// data key pair, as the first version of the key of id, wrapped in every region, with the given metadata entries and
+// its spec. It fails with IDAlreadyExistsStoreError if the id exists.
+func (r *RKMS) createGeneratedKeyForID(ctx context.Context, id string, plaintext []byte, keySpec string, entries map[string]string, encryptionContext EncryptionContext) error {
+	if err := checkReservedID(id); err != nil {
+		return err
+	}
+
+	encryptCtx, cancel := budgetContext(ctx, 2)
+	encryptedDataKeys, err := r.encryptGeneratedDataKey(encryptCtx, r.providersFor(id), plaintext, encryptionContext)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for entry, value := range entries {
+		encryptedDataKeys[entry] = value
+	}
+	setEncryptionContextEntry(encryptedDataKeys, encryptionContext)
+	setMetadataEntry(encryptedDataKeys, &KeyMetadata{CreatedAt: time.Now(), CreatedBy: identityFromContext(ctx), KeySpec: keySpec, State: KeyStateEnabled})
+
+	storeCtx, endSpan := startStoreSpan(ctx, "set", id)
+	err = r.retryStore(storeCtx, "set", false, func(ctx context.Context) error {
+		return r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
+	})
+	endSpan(err)
+	if err != nil {
+		if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+			contextLogger(ctx).Errorf("failed to save the encrypted %s key in key/value store: %s", keySpec, err)
 		}
+		return err
+	}
 
-		go func(ctx context.Context, resultsChannel chan<- encryptDataKeyResult, plaintextDataKey string, region string) {
-			logger.Debugf("encrypting data key in %s region", region)
-			ciphertext, err := r.encryptDataKey(ctx, plaintextDataKey, region)
-			resultsChannel <- encryptDataKeyResult{region, ciphertext, err}
-		}(childCtx, resultsChannel, *plaintextDataKey, region)
+	contextLogger(ctx).Debugf("done creating and saving the %s key", keySpec)
+	return nil
+}
+
+// encryptNewDataKey generates a data key and encrypts it with the given providers in the encryption regions under
+// the given encryption context
+func (r *RKMS) encryptNewDataKey(ctx context.Context, providers map[string]KeyProvider, encryptionContext EncryptionContext) (*SecureBytes, map[string]string, error) {
+	if r.shamirThreshold > 0 {
+		return r.encryptNewDataKeyShares(ctx, providers, encryptionContext)
 	}
 
-	for i := 0; i < len(r.regions)-1; i++ {
-		select {
-		case result := <-resultsChannel:
-			if result.err != nil {
-				logger.Errorf("failed to encrypt data key in %s region: %s", result.region, result.err)
-				return nil, result.err
-			}
+	contextLogger(ctx).Debugln("creating data key...")
+	regions := r.encryptionRegions()
+	if len(regions) < r.minSuccessfulRegions {
+		err := InsufficientRegionsError{Succeeded: 0, Required: r.minSuccessfulRegions}
+		contextLogger(ctx).Errorf("only %d regions are healthy: %s", len(regions), err)
+		return nil, nil, err
+	}
 
-			encryptedDataKeys[result.region] = *result.ciphertext
-		case <-ctx.Done():
-			return nil, fmt.Errorf("cancelled while encrypting data key in all regions")
+	//the data key is generated in a region, then encrypted in the other ones at the same time
+	generateCtx, cancelGenerate := budgetContext(ctx, 2)
+	firstRegion, plaintextDataKey, firstRegionCiphertext, err := r.createDataKey(generateCtx, providers, regions, encryptionContext)
+	cancelGenerate()
+	if err != nil {
+		contextLogger(ctx).Errorf("failed to create a data key: %s", err)
+		return nil, nil, err
+	}
+
+	otherRegions := make([]string, 0, len(regions)-1)
+	for _, region := range regions {
+		if region != *firstRegion { //we have already encrypted in this region and have the ciphertext
+			otherRegions = append(otherRegions, region)
 		}
 	}
 
-	logger.Debugln("saving encrypted data keys in store...")
-	err = r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
-	if err != nil {
-		logger.Errorf("failed to save encrypted data keys in key/value store: %s", err)
-		return nil, err
+	contextLogger(ctx).Debugln("encrypting generated data key in every region...")
+	encryptedDataKeys, errs := r.encryptDataKeyInRegions(ctx, providers, plaintextDataKey, otherRegions, encryptionContext, r.minSuccessfulRegions == 0)
+	if ctx.Err() != nil {
+		plaintextDataKey.Destroy()
+		return nil, nil, fmt.Errorf("cancelled while encrypting data key in all regions")
 	}
+	if r.minSuccessfulRegions == 0 {
+		for _, region := range otherRegions {
+			if err, ok := errs[region]; ok {
+				plaintextDataKey.Destroy()
+				return nil, nil, err
+			}
+		}
+	}
+	encryptedDataKeys[*firstRegion] = *firstRegionCiphertext
 
-	logger.Debugln("done creating and saving encrypted data keys")
-	return plaintextDataKey, nil
+	if len(encryptedDataKeys) < r.minSuccessfulRegions {
+		err := InsufficientRegionsError{Succeeded: len(encryptedDataKeys), Required: r.minSuccessfulRegions}
+		contextLogger(ctx).Error(err)
+		plaintextDataKey.Destroy()
+		return nil, nil, err
+	}
+
+	return plaintextDataKey, encryptedDataKeys, nil
 }
 
-func (r *RKMS) createDataKey(ctx context.Context) (*string, *string, *string, error) {
-	for _, region := range r.regions {
-		input := &kms.GenerateDataKeyInput{
-			KeyId:         r.keyIds[region],
-			NumberOfBytes: aws.Int64(r.dataKeySizeInBytes),
+// encryptGeneratedDataKey encrypts a data key generated by rkms rather than by a key provider in every encryption
+// region under the given encryption context, split into shares with a shamirThreshold. It only succeeds with
+// minSuccessfulRegions ciphertexts, and shamirThreshold shares, at least, 0 requiring every region to succeed.
+func (r *RKMS) encryptGeneratedDataKey(ctx context.Context, providers map[string]KeyProvider, plaintext []byte, encryptionContext EncryptionContext) (map[string]string, error) {
+	regions := r.encryptionRegions()
+	required := r.minSuccessfulRegions
+	if required < r.shamirThreshold {
+		required = r.shamirThreshold
+	}
+	if len(regions) < required {
+		err := InsufficientRegionsError{Succeeded: 0, Required: required}
+		contextLogger(ctx).Errorf("only %d regions are healthy: %s", len(regions), err)
+		return nil, err
+	}
+
+	contextLogger(ctx).Debugln("encrypting the generated data key in every region...")
+	var encryptedDataKeys map[string]string
+	var errs map[string]error
+	if r.shamirThreshold > 0 {
+		encryptedDataKeys, errs = r.encryptDataKeyShares(ctx, providers, plaintext, regions, encryptionContext, r.minSuccessfulRegions == 0)
+	} else {
+		//the plaintext stays the caller's to zero
+		encryptedDataKeys, errs = r.encryptDataKeyInRegions(ctx, providers, &SecureBytes{data: plaintext}, regions, encryptionContext, r.minSuccessfulRegions == 0)
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("cancelled while encrypting data key in all regions")
+	}
+	if r.minSuccessfulRegions == 0 {
+		for _, region := range regions {
+			if err, ok := errs[region]; ok {
+				return nil, err
+			}
 		}
+	}
+
+	if len(encryptedDataKeys) < required {
+		err := InsufficientRegionsError{Succeeded: len(encryptedDataKeys), Required: required}
+		contextLogger(ctx).Error(err)
+		return nil, err
+	}
+	return encryptedDataKeys, nil
+}
 
-		result, err := r.clients[region].GenerateDataKeyWithContext(ctx, input)
+// createDataKey generates a data key in the first of the regions that succeeds to, every region being given an
+// equal share of the time left to the ones not tried yet
+func (r *RKMS) createDataKey(ctx context.Context, providers map[string]KeyProvider, regions []string, encryptionContext EncryptionContext) (*string, *SecureBytes, *string, error) {
+	for i, region := range regions {
+		start := time.Now()
+		regionCtx, cancel := budgetContext(ctx, len(regions)-i)
+		spanCtx, endSpan := startKeyProviderSpan(regionCtx, region, "GenerateDataKey")
+		var plaintextBlob, ciphertextBlob []byte
+		err := r.retryKeyProvider(spanCtx, region, "GenerateDataKey", func(ctx context.Context) (err error) {
+			plaintextBlob, ciphertextBlob, err = providers[region].GenerateDataKey(ctx, r.dataKeySizeInBytes, encryptionContext)
+			return err
+		})
+		endSpan(err)
+		cancel()
+		observeKeyProvider(region, "GenerateDataKey", start, err)
 		if err != nil { //failed to create data key in this region
-			logger.Error(err)
+			contextLogger(ctx).Error(err)
 			continue
 		}
 
-		plaintext := base64.StdEncoding.EncodeToString(result.Plaintext)
-		ciphertext := base64.StdEncoding.EncodeToString(result.CiphertextBlob)
-		return &region, &plaintext, &ciphertext, nil
+		ciphertext := newWrappedKey(r.wrappedKeyFormat, providers[region], len(plaintextBlob), ciphertextBlob).String()
+		return &region, secureBytesOf(plaintextBlob), &ciphertext, nil
 	}
 
 	return nil, nil, nil, fmt.Errorf("failed to create a data key in every region")
 }
 
-func (r *RKMS) encryptDataKey(ctx context.Context, dataKey string, region string) (*string, error) {
-	plaintext, err := base64.StdEncoding.DecodeString(dataKey)
+func (r *RKMS) encryptDataKey(ctx context.Context, providers map[string]KeyProvider, dataKey *SecureBytes, region string, encryptionContext EncryptionContext) (*string, error) {
+	plaintext := dataKey.Bytes()
+	ciphertextBlob, err := r.encryptInRegion(ctx, providers, plaintext, region, encryptionContext)
 	if err != nil {
-		logger.Error(err)
 		return nil, err
 	}
 
-	input := &kms.EncryptInput{
-		KeyId:     r.keyIds[region],
-		Plaintext: plaintext,
-	}
+	ciphertext := newWrappedKey(r.wrappedKeyFormat, providers[region], len(plaintext), ciphertextBlob).String()
+	return &ciphertext, nil
+}
 
-	result, err := r.clients[region].EncryptWithContext(ctx, input)
+// encryptInRegion wraps the given plaintext with the provider of region, returning the ciphertext of the provider
+func (r *RKMS) encryptInRegion(ctx context.Context, providers map[string]KeyProvider, plaintext []byte, region string, encryptionContext EncryptionContext) ([]byte, error) {
+	start := time.Now()
+	spanCtx, endSpan := startKeyProviderSpan(ctx, region, "Encrypt")
+	var ciphertextBlob []byte
+	err := r.retryKeyProvider(spanCtx, region, "Encrypt", func(ctx context.Context) (err error) {
+		ciphertextBlob, err = providers[region].Encrypt(ctx, plaintext, encryptionContext)
+		return err
+	})
+	endSpan(err)
+	observeKeyProvider(region, "Encrypt", start, err)
 	if err != nil { //failed to create data key in this region
-		logger.Error(err)
+		contextLogger(ctx).Error(err)
 		return nil, err
 	}
+	return ciphertextBlob, nil
+}
 
-	ciphertext := base64.StdEncoding.EncodeToString(result.CiphertextBlob)
-	return &ciphertext, nil
+// encryptDataKeyInRegions encrypts the data key in the given regions with the given providers, encryptConcurrency
+// regions at a time (every region at once for 0), returning the ciphertexts and the errors of the regions which
+// failed to. With failFast, the encryptions left are cancelled once a region failed.
+func (r *RKMS) encryptDataKeyInRegions(ctx context.Context, providers map[string]KeyProvider, dataKey *SecureBytes, regions []string, encryptionContext EncryptionContext, failFast bool) (map[string]string, map[string]error) {
+	return r.encryptInRegions(ctx, regions, failFast, func(ctx context.Context, region string) (*string, error) {
+		return r.encryptDataKey(ctx, providers, dataKey, region, encryptionContext)
+	})
+}
+
+// encryptInRegions calls encrypt for every one of the given regions, encryptConcurrency regions at a time, returning
+// the ciphertexts and the errors of the regions which failed to, as encryptDataKeyInRegions does
+func (r *RKMS) encryptInRegions(ctx context.Context, regions []string, failFast bool, encrypt func(ctx context.Context, region string) (*string, error)) (map[string]string, map[string]error) {
+	ciphertexts := make(map[string]string, len(regions))
+	errs := make(map[string]error)
+	var mutex sync.Mutex
+
+	concurrency := r.encryptConcurrency
+	if concurrency <= 0 || concurrency > len(regions) {
+		concurrency = len(regions)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	forEachConcurrently(regions, concurrency, func(region string) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		regionLogger(ctx, region, "Encrypt").Debugln("encrypting data key")
+		ciphertext, err := encrypt(ctx, region)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			//the encryptions cancelled once another region failed didn't fail of their own
+			if ctx.Err() == nil {
+				regionLogger(ctx, region, "Encrypt").Errorf("failed to encrypt data key: %s", err)
+				errs[region] = err
+			}
+			if failFast {
+				cancel()
+			}
+			return
+		}
+		ciphertexts[region] = *ciphertext
+	})
+
+	return ciphertexts, errs
 }
 
 type decryptDataKeyResult struct {
 	region    string
-	plaintext *string
+	plaintext *SecureBytes
 	err       error
-}
 
-func (r *RKMS) decryptDataKey(ctx context.Context, encryptedDataKeys map[string]string) (*string, error) {
-	resultsChannel := make(chan decryptDataKeyResult, len(r.regions))
-	childCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// the x coordinate and the threshold of the share the plaintext is, 0 for a whole data key
+	share     byte
+	threshold int
+}
 
-	//TODO(enhancement): add config param to run this serially if wanted
-	for _, region := range r.regions {
-		go func(ctx context.Context, resultsChannel chan<- decryptDataKeyResult, ciphertext string, region string) {
-			ciphertextBlob, err := base64.StdEncoding.DecodeString(ciphertext)
-			if err != nil {
-				//TODO(enhancement): fix it asyncrounously
-				logger.Errorf("ciphertext value is corrupted in the store for %s region: %s", region, err)
-				resultsChannel <- decryptDataKeyResult{region, nil, err}
-				return
-			}
+// decryptDataKey decrypts the data key of the given encrypted data keys, for the caller to destroy
+func (r *RKMS) decryptDataKey(ctx context.Context, providers map[string]KeyProvider, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) (*SecureBytes, error) {
+	plaintext, _, err := r.decryptDataKeyInRegion(ctx, providers, encryptedDataKeys, encryptionContext)
+	return plaintext, err
+}
 
-			input := &kms.DecryptInput{
-				CiphertextBlob: ciphertextBlob,
-			}
+// decryptDataKeyInRegion is decryptDataKey telling the region that decrypted the data key.
+// The data key is decrypted in the first region, the regions which are healthy and whose circuit breaker isn't open
+// coming first, and hedged to the next region every hedgeDelay until one of them succeeds, right away when a region
+// fails. The decryptions still running are then cancelled. A hedgeDelay of 0 decrypts it in every region at once.
+// A data key split into shares is decrypted in as many regions as its threshold at once, the next regions being
+// hedged to until that many shares are decrypted and combined, the regions being then told separated by commas.
+func (r *RKMS) decryptDataKeyInRegion(ctx context.Context, providers map[string]KeyProvider, encryptedDataKeys map[string]string, encryptionContext EncryptionContext) (*SecureBytes, string, error) {
+	regions := r.decryptionRegions(encryptedDataKeys)
+	if len(regions) == 0 {
+		return nil, "", fmt.Errorf("failed to decrypt data key in all regions")
+	}
 
-			logger.Debugf("decrypting data key in %s region", region)
-			result, err := r.clients[region].DecryptWithContext(ctx, input)
-			if err != nil { //failed to decrypt in this region
-				if aerr, ok := err.(awserr.Error); ok && aerr.Code() != request.CanceledErrorCode {
-					logger.Errorf("failed to decrypt in %s region: %s", region, err)
-				}
-				resultsChannel <- decryptDataKeyResult{region, nil, err}
-				return
-			}
+	resultsChannel := make(chan decryptDataKeyResult, len(regions))
+	childCtx, cancel := context.WithCancel(ctx)
+	var shares []decryptDataKeyResult
+	started, pending := 0, 0
+	defer func() {
+		cancel()
+		//the shares were combined, and the plaintexts of the decryptions still running are zeroed once they end
+		for _, share := range shares {
+			share.plaintext.Destroy()
+		}
+		go destroyDecryptDataKeyResults(resultsChannel, pending)
+	}()
+
+	//hedge fires hedgeDelay after the last decryption was started, while a region is left to start
+	var hedge <-chan time.Time
+	startNext := func() {
+		region := regions[started]
+		go r.decryptInRegion(childCtx, resultsChannel, providers, region, encryptedDataKeys[region], encryptionContext)
+		started++
+		pending++
+		hedge = nil
+		if started < len(regions) {
+			hedge = time.After(r.hedgeDelay)
+		}
+	}
 
-			dataKey := base64.StdEncoding.EncodeToString(result.Plaintext)
-			resultsChannel <- decryptDataKeyResult{region, &dataKey, nil}
-		}(childCtx, resultsChannel, encryptedDataKeys[region], region)
+	//the shares of a data key are decrypted in as many regions as it takes at once
+	threshold := sharesThreshold(encryptedDataKeys)
+	startNext()
+	for (r.hedgeDelay <= 0 || started < threshold) && started < len(regions) {
+		startNext()
 	}
 
-	for i := 0; i < len(r.regions); i++ {
+	for pending > 0 {
 		select {
 		case result := <-resultsChannel:
+			pending--
 			if result.err != nil {
-				logger.Infof("failed to decrypt data key in %s region: %s", result.region, result.err)
+				regionLogger(ctx, result.region, "Decrypt").Infof("failed to decrypt data key: %s", result.err)
+				if started < len(regions) {
+					startNext()
+				}
 				continue
 			}
 
-			logger.Debugf("successfully decrypted data key in %s region", result.region)
-			return result.plaintext, nil
+			if result.threshold == 0 {
+				regionLogger(ctx, result.region, "Decrypt").Debugln("successfully decrypted data key")
+				return result.plaintext, result.region, nil
+			}
+
+			regionLogger(ctx, result.region, "Decrypt").Debugln("successfully decrypted a share of the data key")
+			if shares = append(shares, result); len(shares) >= result.threshold {
+				return combineDataKeyShares(shares)
+			}
+			if pending+len(shares) < result.threshold && started < len(regions) {
+				startNext()
+			}
+		case <-hedge:
+			regionLogger(ctx, regions[started], "Decrypt").Debugf("no region decrypted the data key within %s, hedging", r.hedgeDelay)
+			hedgedDecryptsTotal.inc(regions[started])
+			startNext()
 		case <-ctx.Done():
-			return nil, fmt.Errorf("cancelled while decrypting data key in all regions")
+			return nil, "", fmt.Errorf("cancelled while decrypting data key in all regions")
+		}
+	}
+
+	return nil, "", fmt.Errorf("failed to decrypt data key in all regions")
+}
+
+// destroyDecryptDataKeyResults destroys the plaintexts of the given number of results of decryptions left when
+// decryptDataKeyInRegion returned
+func destroyDecryptDataKeyResults(resultsChannel <-chan decryptDataKeyResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-resultsChannel
+		result.plaintext.Destroy()
+	}
+}
+
+// decryptionRegions returns the regions the encrypted data keys have a ciphertext for, in the order they are
+// decrypted in: the regions whose provider is healthy and whose circuit breaker isn't open first.
+// Data keys created while a region was unavailable have no ciphertext for it.
+func (r *RKMS) decryptionRegions(encryptedDataKeys map[string]string) []string {
+	preferred := make([]string, 0, len(r.regions))
+	others := make([]string, 0)
+	for _, region := range r.regions {
+		if _, ok := encryptedDataKeys[region]; !ok {
+			continue
+		}
+
+		if (r.health == nil || r.health.Healthy(region)) && !r.kmsBreakers[region].open() {
+			preferred = append(preferred, region)
+		} else {
+			others = append(others, region)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// decryptInRegion decrypts the ciphertext of the data key of region, sending the result to resultsChannel
+func (r *RKMS) decryptInRegion(ctx context.Context, resultsChannel chan<- decryptDataKeyResult, providers map[string]KeyProvider, region string, ciphertext string, encryptionContext EncryptionContext) {
+	wrapped, err := parseWrappedKey(ciphertext)
+	if err != nil {
+		//TODO(enhancement): fix it asyncrounously
+		regionLogger(ctx, region, "Decrypt").Errorf("ciphertext value is corrupted in the store: %s", err)
+		resultsChannel <- decryptDataKeyResult{region, nil, err, 0, 0}
+		return
+	}
+
+	regionLogger(ctx, region, "Decrypt").Debugln("decrypting data key")
+	start := time.Now()
+	spanCtx, endSpan := startKeyProviderSpan(ctx, region, "Decrypt")
+	var plaintext []byte
+	err = r.retryKeyProvider(spanCtx, region, "Decrypt", func(ctx context.Context) (err error) {
+		plaintext, err = wrapped.decrypt(ctx, providers[region], encryptionContext)
+		return err
+	})
+	endSpan(err)
+	if err != nil { //failed to decrypt in this region
+		//the other decryptions are cancelled once one of them succeeded
+		if ctx.Err() == nil {
+			observeKeyProvider(region, "Decrypt", start, err)
+			regionLogger(ctx, region, "Decrypt").Errorf("failed to decrypt: %s", err)
 		}
+		resultsChannel <- decryptDataKeyResult{region, nil, err, 0, 0}
+		return
 	}
 
-	return nil, fmt.Errorf("failed to decrypt data key in all regions")
+	observeKeyProvider(region, "Decrypt", start, nil)
+	resultsChannel <- decryptDataKeyResult{region, secureBytesOf(plaintext), nil, byte(wrapped.Share), wrapped.Threshold}
 }
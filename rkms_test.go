@@ -5,36 +5,40 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/kms"
-	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
 	logger "github.com/sirupsen/logrus"
 )
 
 type unavailableKMSClient struct {
-	kmsiface.KMSAPI
+	kmsAPI
 }
 
-func (c *unavailableKMSClient) GenerateDataKeyWithContext(aws.Context, *kms.GenerateDataKeyInput, ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+func (c *unavailableKMSClient) GenerateDataKey(context.Context, *kms.GenerateDataKeyInput, ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
 	return nil, fmt.Errorf("server is unavailable")
 }
 
-func (c *unavailableKMSClient) EncryptWithContext(aws.Context, *kms.EncryptInput, ...request.Option) (*kms.EncryptOutput, error) {
+func (c *unavailableKMSClient) Encrypt(context.Context, *kms.EncryptInput, ...func(*kms.Options)) (*kms.EncryptOutput, error) {
 	return nil, fmt.Errorf("server is unavailable")
 }
 
-func (c *unavailableKMSClient) DecryptWithContext(aws.Context, *kms.DecryptInput, ...request.Option) (*kms.DecryptOutput, error) {
+func (c *unavailableKMSClient) Decrypt(context.Context, *kms.DecryptInput, ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return nil, fmt.Errorf("server is unavailable")
+}
+
+func (c *unavailableKMSClient) DescribeKey(context.Context, *kms.DescribeKeyInput, ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
 	return nil, fmt.Errorf("server is unavailable")
 }
 
 type availableKMSClient struct {
-	kmsiface.KMSAPI
+	kmsAPI
 }
 
-func (c *availableKMSClient) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+func (c *availableKMSClient) GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
 	return &kms.GenerateDataKeyOutput{
 		KeyId:          input.KeyId,
 		Plaintext:      []byte("plaintext"),
@@ -42,14 +46,14 @@ func (c *availableKMSClient) GenerateDataKeyWithContext(ctx aws.Context, input *
 	}, nil
 }
 
-func (c *availableKMSClient) EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, opts ...request.Option) (*kms.EncryptOutput, error) {
+func (c *availableKMSClient) Encrypt(ctx context.Context, input *kms.EncryptInput, opts ...func(*kms.Options)) (*kms.EncryptOutput, error) {
 	return &kms.EncryptOutput{
 		KeyId:          input.KeyId,
 		CiphertextBlob: []byte("ciphertext"),
 	}, nil
 }
 
-func (c *availableKMSClient) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+func (c *availableKMSClient) Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error) {
 	keyID := "keyId"
 	return &kms.DecryptOutput{
 		KeyId:     &keyID,
@@ -57,6 +61,12 @@ func (c *availableKMSClient) DecryptWithContext(ctx aws.Context, input *kms.Decr
 	}, nil
 }
 
+func (c *availableKMSClient) DescribeKey(ctx context.Context, input *kms.DescribeKeyInput, opts ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	return &kms.DescribeKeyOutput{
+		KeyMetadata: &types.KeyMetadata{Arn: input.KeyId, Enabled: true},
+	}, nil
+}
+
 type mockStore struct {
 	Store
 	numberOfRegions                     int
@@ -94,26 +104,23 @@ func (s *mockStore) SetEncryptedDataKeysConditionally(ctx context.Context, id st
 // Otherwise, the mock client will fail on every call.
 func getRKMS(regionsAvailable []bool) *RKMS {
 	regions := make([]string, len(regionsAvailable))
-	keyIds := make(map[string]*string)
-	clients := make(map[string]kmsiface.KMSAPI)
+	providers := make(map[string]KeyProvider)
 
 	for i, regionAvailable := range regionsAvailable {
 		regionName := getTestRegionName(i)
 		regions[i] = regionName
 
 		keyID := getTestKeyID(regionName)
-		keyIds[regionName] = &keyID
-
 		if regionAvailable {
-			clients[regionName] = &availableKMSClient{}
+			providers[regionName] = &AWSKMSProvider{&availableKMSClient{}, &keyID, nil, nil}
 		} else {
-			clients[regionName] = &unavailableKMSClient{}
+			providers[regionName] = &AWSKMSProvider{&unavailableKMSClient{}, &keyID, nil, nil}
 		}
 	}
 
 	store := new(mockStore)
 	store.numberOfRegions = len(regionsAvailable)
-	return &RKMS{regions, keyIds, clients, store, int64(32)}
+	return &RKMS{regions, providers, nil, store, int64(32), 0, nil, retryPolicy{}, retryPolicy{}, nil, 0, 0, nil, nil, WrappedKeyFormatBare, 0, 0, nil}
 }
 
 func getTestRegionName(regionIndex int) string {
@@ -141,10 +148,7 @@ func TestServersUpEmptyStore(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -165,10 +169,7 @@ func TestServersUpFilledStore(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -204,10 +205,7 @@ func TestFirstServerDownFilledStore(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -243,10 +241,7 @@ func TestFirstTwoServersDownFilledStore(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -298,10 +293,7 @@ func TestConditionalWriteToStore(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -323,10 +315,7 @@ func TestGetPLaintextDataKeyRetrySuccess(t *testing.T) {
 		t.Fatalf("was not able to get plaintext: %s", err)
 	}
 
-	plaintext, err := base64.StdEncoding.DecodeString(*base64Plaintext)
-	if err != nil {
-		t.Fatalf("failed to decode base64 plaintext: %s", err)
-	}
+	plaintext := base64Plaintext.Bytes()
 
 	if strings.Compare(string(plaintext), "plaintext") != 0 {
 		t.Fatalf("returned plaintext data key is wrong: %s", plaintext)
@@ -340,7 +329,8 @@ func TestGetPLaintextDataKeyRetryFail(t *testing.T) {
 	r := getRKMS(regionsAvailable)
 	if mockStore, ok := r.store.(*mockStore); ok {
 		mockStore.dataShouldExist = false
-		mockStore.numberOfTimesToFailSetConditionally = MaxNumberOfGetPlaintextDataKeyTries
+		//the data keys saved by the other requests never read back
+		mockStore.numberOfTimesToFailSetConditionally = MaxNumberOfGetPlaintextDataKeyTries + 1
 	}
 
 	_, err := r.GetPlaintextDataKey(context.Background(), "id")
@@ -348,3 +338,336 @@ func TestGetPLaintextDataKeyRetryFail(t *testing.T) {
 		t.Fatalf("should not have received a data key back")
 	}
 }
+
+func TestGetDataKeyReturnsWinnerOfLastTry(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	if mockStore, ok := r.store.(*mockStore); ok {
+		//the data key saved by another request first reads back after the last try
+		mockStore.numberOfTimesToFailSetConditionally = MaxNumberOfGetPlaintextDataKeyTries
+	}
+
+	dataKey, err := r.GetDataKey(context.Background(), "id", 0, nil)
+	if err != nil || string(dataKey.Plaintext.Bytes()) != "plaintext" {
+		t.Fatalf("the data key of the request which won the race should have been returned, got %v", err)
+	}
+}
+
+func TestGetDataKeyWithTTL(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	if _, err := r.GetDataKey(context.Background(), "id", time.Minute, nil); err != (TTLNotSupportedError{}) {
+		t.Fatalf("a store that can't expire keys should have failed with TTLNotSupportedError, got: %v", err)
+	}
+
+	r.store = NewMemoryStore()
+	created, err := r.GetDataKey(context.Background(), "id", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("was not able to get plaintext: %s", err)
+	}
+
+	stored, err := r.GetDataKey(context.Background(), "id", time.Hour, nil)
+	if err != nil || created.ExpiresAt.IsZero() || stored.ExpiresAt.Unix() != created.ExpiresAt.Unix() {
+		t.Fatalf("the key should keep the TTL it was created with, got %+v instead of %+v: %v", stored, created, err)
+	}
+}
+
+func TestMinSuccessfulRegions(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, false, true})
+	r.minSuccessfulRegions = 2
+	if _, err := r.GetPlaintextDataKey(context.Background(), "id"); err != nil {
+		t.Fatalf("the data key should have been saved once encrypted in 2 regions: %s", err)
+	}
+
+	r = getRKMS([]bool{false, false, true})
+	r.minSuccessfulRegions = 2
+	_, err := r.GetPlaintextDataKey(context.Background(), "id")
+	if insufficientErr, ok := err.(InsufficientRegionsError); !ok || insufficientErr.Succeeded != 1 {
+		t.Fatalf("a data key encrypted in a single region should not have been saved, got: %v", err)
+	}
+}
+
+func TestBackfillMissingCiphertexts(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	r.store.SetEncryptedDataKeysConditionally(ctx, "partial", map[string]string{getTestRegionName(0): ciphertext})
+	r.store.SetEncryptedDataKeysConditionally(ctx, "complete", map[string]string{
+		getTestRegionName(0): ciphertext,
+		getTestRegionName(1): ciphertext,
+		getTestRegionName(2): ciphertext,
+	})
+
+	backfilled, err := backfillMissingCiphertexts(ctx, r)
+	if err != nil || backfilled != 1 {
+		t.Fatalf("only the partial id should have been backfilled, got %d: %v", backfilled, err)
+	}
+
+	keys, version, _ := r.store.GetVersionedEncryptedDataKeys(ctx, "partial")
+	if len(keys) != 3 || version != 1 {
+		t.Fatalf("the partial id should have a ciphertext for every region, got %v at version %d", keys, version)
+	}
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	r.store.SetEncryptedDataKeysConditionally(ctx, "id", map[string]string{
+		getTestRegionName(0): base64.StdEncoding.EncodeToString([]byte("old-ciphertext")),
+		getTestRegionName(1): base64.StdEncoding.EncodeToString([]byte("old-ciphertext")),
+	})
+
+	rewrapped, failed, err := rewrapDataKeys(ctx, r)
+	if err != nil || rewrapped != 1 || failed != 0 {
+		t.Fatalf("the id should have been rewrapped, got %d rewrapped and %d failed: %v", rewrapped, failed, err)
+	}
+
+	keys, version, _ := r.store.GetVersionedEncryptedDataKeys(ctx, "id")
+	expected := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	if len(keys) != 3 || keys[getTestRegionName(0)] != expected || version != 1 {
+		t.Fatalf("every region should have a new ciphertext, got %v at version %d", keys, version)
+	}
+}
+
+func TestRotateDataKey(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	if _, err := r.RotateDataKey(ctx, "id", nil); err != (IDNotFoundStoreError{ID: "id"}) {
+		t.Fatalf("rotating a missing id should have failed with IDNotFoundStoreError, got: %v", err)
+	}
+
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err != nil {
+		t.Fatalf("was not able to get plaintext: %s", err)
+	}
+
+	rotated, err := r.RotateDataKey(ctx, "id", nil)
+	if err != nil || rotated.Version != 2 {
+		t.Fatalf("the data key should have been rotated to version 2, got %+v: %v", rotated, err)
+	}
+
+	latest, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil || latest.Version != 2 {
+		t.Fatalf("the latest version should be the rotated one, got %+v: %v", latest, err)
+	}
+
+	if first, err := r.GetDataKeyVersion(ctx, "id", 1, nil); err != nil || first.Version != 1 {
+		t.Fatalf("the first version should have been kept, got %+v: %v", first, err)
+	}
+
+	if _, err := r.GetDataKeyVersion(ctx, "id", 3, nil); err != (DataKeyVersionNotFoundError{ID: "id", Version: 3}) {
+		t.Fatalf("a version that doesn't exist should have failed with DataKeyVersionNotFoundError, got: %v", err)
+	}
+}
+
+func TestGetDataKeyWithEncryptionContext(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+	encryptionContext := EncryptionContext{"tenant": "a"}
+
+	created, err := r.GetDataKey(ctx, "id", 0, encryptionContext)
+	if err != nil {
+		t.Fatalf("was not able to get plaintext: %s", err)
+	}
+
+	for _, other := range []EncryptionContext{nil, {"tenant": "b"}, {"tenant": "a", "other": "a"}} {
+		if _, err := r.GetDataKey(ctx, "id", 0, other); err != (EncryptionContextMismatchError{ID: "id"}) {
+			t.Fatalf("getting the data key with encryption context %v should have failed with EncryptionContextMismatchError, got: %v", other, err)
+		}
+	}
+
+	stored, err := r.GetDataKey(ctx, "id", 0, EncryptionContext{"tenant": "a"})
+	if err != nil || !stored.Plaintext.Equal(created.Plaintext) {
+		t.Fatalf("the stored data key should have been returned for the same encryption context, got %+v: %v", stored, err)
+	}
+
+	rotated, err := r.RotateDataKey(ctx, "id", encryptionContext)
+	if err != nil || rotated.Version != 2 {
+		t.Fatalf("the data key should have been rotated to version 2, got %+v: %v", rotated, err)
+	}
+
+	if _, err := r.GetDataKeyVersion(ctx, "id", 2, nil); err != (EncryptionContextMismatchError{ID: "id"}) {
+		t.Fatalf("the rotated data key should have kept its encryption context, got: %v", err)
+	}
+}
+
+func TestCreateDataKey(t *testing.T) {
+	beforeTest()
+
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	ctx := context.Background()
+
+	created, err := r.CreateDataKey(ctx, "id", 0, nil)
+	if err != nil || created.Version != FirstDataKeyVersion {
+		t.Fatalf("the data key should have been created, got %+v: %v", created, err)
+	}
+
+	if _, err := r.CreateDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("creating an existing id should have failed")
+	} else if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("creating an existing id should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+}
+
+// delayedKeyProvider decrypts the ciphertexts as they are after delay, or fails with err
+type delayedKeyProvider struct {
+	KeyProvider
+	delay time.Duration
+	err   error
+	calls int32
+}
+
+func (p *delayedKeyProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	atomic.AddInt32(&p.calls, 1)
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ciphertext, nil
+}
+
+func getHedgingRKMS(hedgeDelay time.Duration, providers ...*delayedKeyProvider) (*RKMS, map[string]string) {
+	r := getRKMS(make([]bool, len(providers)))
+	r.hedgeDelay = hedgeDelay
+	encryptedDataKeys := make(map[string]string, len(providers))
+	for i, provider := range providers {
+		r.providers[getTestRegionName(i)] = provider
+		encryptedDataKeys[getTestRegionName(i)] = base64.StdEncoding.EncodeToString([]byte(getTestRegionName(i)))
+	}
+	return r, encryptedDataKeys
+}
+
+func TestDecryptDataKeyHedgesSlowRegion(t *testing.T) {
+	slow, fast := &delayedKeyProvider{delay: time.Hour}, &delayedKeyProvider{}
+	r, encryptedDataKeys := getHedgingRKMS(10*time.Millisecond, slow, fast)
+
+	_, region, err := r.decryptDataKeyInRegion(context.Background(), r.providers, encryptedDataKeys, nil)
+	if err != nil || region != "region-1" {
+		t.Fatalf("the decryption should have been hedged to the second region, got %q: %v", region, err)
+	}
+}
+
+func TestDecryptDataKeyWithoutHedging(t *testing.T) {
+	primary, secondary := &delayedKeyProvider{}, &delayedKeyProvider{}
+	r, encryptedDataKeys := getHedgingRKMS(time.Hour, primary, secondary)
+
+	_, region, err := r.decryptDataKeyInRegion(context.Background(), r.providers, encryptedDataKeys, nil)
+	if err != nil || region != "region-0" || atomic.LoadInt32(&secondary.calls) != 0 {
+		t.Fatalf("only the first region should have been called, got %q: %v", region, err)
+	}
+}
+
+func TestDecryptDataKeyFailsOverRightAway(t *testing.T) {
+	failing, secondary := &delayedKeyProvider{err: fmt.Errorf("server is unavailable")}, &delayedKeyProvider{}
+	r, encryptedDataKeys := getHedgingRKMS(time.Hour, failing, secondary)
+
+	_, region, err := r.decryptDataKeyInRegion(context.Background(), r.providers, encryptedDataKeys, nil)
+	if err != nil || region != "region-1" {
+		t.Fatalf("the failed decryption should have been failed over without waiting, got %q: %v", region, err)
+	}
+}
+
+func TestDecryptDataKeyInEveryRegionAtOnce(t *testing.T) {
+	slow, failing := &delayedKeyProvider{delay: 10 * time.Millisecond}, &delayedKeyProvider{err: fmt.Errorf("server is unavailable")}
+	r, encryptedDataKeys := getHedgingRKMS(0, slow, failing, &delayedKeyProvider{delay: time.Hour})
+
+	_, region, err := r.decryptDataKeyInRegion(context.Background(), r.providers, encryptedDataKeys, nil)
+	if err != nil || region != "region-0" || atomic.LoadInt32(&failing.calls) != 1 {
+		t.Fatalf("every region should have been called at once, got %q: %v", region, err)
+	}
+}
+
+// concurrentKeyProvider encrypts the data keys as they are after a delay, counting the encryptions running at once
+type concurrentKeyProvider struct {
+	KeyProvider
+	running    *int32
+	maxRunning *int32
+	err        error
+}
+
+func (p *concurrentKeyProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	running := atomic.AddInt32(p.running, 1)
+	defer atomic.AddInt32(p.running, -1)
+	for {
+		maxRunning := atomic.LoadInt32(p.maxRunning)
+		if running <= maxRunning || atomic.CompareAndSwapInt32(p.maxRunning, maxRunning, running) {
+			break
+		}
+	}
+
+	select {
+	case <-time.After(50 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return plaintext, nil
+}
+
+func TestEncryptDataKeyInRegionsConcurrently(t *testing.T) {
+	for _, concurrency := range []int{0, 2} {
+		var running, maxRunning int32
+		r := getRKMS(make([]bool, 6))
+		r.encryptConcurrency = concurrency
+		for _, region := range r.regions {
+			r.providers[region] = &concurrentKeyProvider{running: &running, maxRunning: &maxRunning}
+		}
+
+		ciphertexts, errs := r.encryptDataKeyInRegions(context.Background(), r.providers, secureBytesOf([]byte("data-key")), r.regions, nil, false)
+		if len(ciphertexts) != 6 || len(errs) != 0 {
+			t.Fatalf("the data key should have been encrypted in every region, got %v and %v", ciphertexts, errs)
+		}
+
+		expected := int32(concurrency)
+		if concurrency == 0 {
+			expected = 6
+		}
+		if maxRunning != expected {
+			t.Errorf("%d regions should have encrypted the data key at once with a concurrency of %d, got %d", expected, concurrency, maxRunning)
+		}
+	}
+}
+
+func TestEncryptDataKeyInRegionsFailFast(t *testing.T) {
+	var running, maxRunning int32
+	r := getRKMS(make([]bool, 4))
+	r.encryptConcurrency = 1
+	for i, region := range r.regions {
+		provider := &concurrentKeyProvider{running: &running, maxRunning: &maxRunning}
+		if i == 1 {
+			provider.err = fmt.Errorf("server is unavailable")
+		}
+		r.providers[region] = provider
+	}
+
+	ciphertexts, errs := r.encryptDataKeyInRegions(context.Background(), r.providers, secureBytesOf([]byte("data-key")), r.regions, nil, true)
+	if len(ciphertexts) != 1 || len(errs) != 1 || errs["region-1"] == nil {
+		t.Fatalf("the regions after the failed one shouldn't have been encrypted in, got %v and %v", ciphertexts, errs)
+	}
+}
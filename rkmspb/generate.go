@@ -0,0 +1,4 @@
+// Package rkmspb holds the gRPC code generated from api/rkms.proto, with protoc-gen-go and protoc-gen-go-grpc.
+package rkmspb
+
+//go:generate protoc --proto_path=../api --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rkms.proto
@@ -0,0 +1,267 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: rkms.proto
+
+package rkmspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	RKMS_GetKey_FullMethodName    = "/rkms.v1.RKMS/GetKey"
+	RKMS_CreateKey_FullMethodName = "/rkms.v1.RKMS/CreateKey"
+	RKMS_RotateKey_FullMethodName = "/rkms.v1.RKMS/RotateKey"
+	RKMS_Encrypt_FullMethodName   = "/rkms.v1.RKMS/Encrypt"
+	RKMS_Decrypt_FullMethodName   = "/rkms.v1.RKMS/Decrypt"
+)
+
+// RKMSClient is the client API for RKMS service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RKMSClient interface {
+	// GetKey returns the latest data key of an id, generating it if there is none, or the given version.
+	GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*Key, error)
+	// CreateKey generates the data key of a new id, failing with ALREADY_EXISTS if the id exists.
+	CreateKey(ctx context.Context, in *CreateKeyRequest, opts ...grpc.CallOption) (*Key, error)
+	// RotateKey generates a new version of the data key of an existing id.
+	RotateKey(ctx context.Context, in *RotateKeyRequest, opts ...grpc.CallOption) (*Key, error)
+	// Encrypt encrypts data server-side with the latest data key of an id.
+	Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error)
+	// Decrypt decrypts data encrypted by Encrypt.
+	Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error)
+}
+
+type rKMSClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRKMSClient(cc grpc.ClientConnInterface) RKMSClient {
+	return &rKMSClient{cc}
+}
+
+func (c *rKMSClient) GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, RKMS_GetKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rKMSClient) CreateKey(ctx context.Context, in *CreateKeyRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, RKMS_CreateKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rKMSClient) RotateKey(ctx context.Context, in *RotateKeyRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, RKMS_RotateKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rKMSClient) Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error) {
+	out := new(EncryptResponse)
+	err := c.cc.Invoke(ctx, RKMS_Encrypt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rKMSClient) Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error) {
+	out := new(DecryptResponse)
+	err := c.cc.Invoke(ctx, RKMS_Decrypt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RKMSServer is the server API for RKMS service.
+// All implementations must embed UnimplementedRKMSServer
+// for forward compatibility
+type RKMSServer interface {
+	// GetKey returns the latest data key of an id, generating it if there is none, or the given version.
+	GetKey(context.Context, *GetKeyRequest) (*Key, error)
+	// CreateKey generates the data key of a new id, failing with ALREADY_EXISTS if the id exists.
+	CreateKey(context.Context, *CreateKeyRequest) (*Key, error)
+	// RotateKey generates a new version of the data key of an existing id.
+	RotateKey(context.Context, *RotateKeyRequest) (*Key, error)
+	// Encrypt encrypts data server-side with the latest data key of an id.
+	Encrypt(context.Context, *EncryptRequest) (*EncryptResponse, error)
+	// Decrypt decrypts data encrypted by Encrypt.
+	Decrypt(context.Context, *DecryptRequest) (*DecryptResponse, error)
+	mustEmbedUnimplementedRKMSServer()
+}
+
+// UnimplementedRKMSServer must be embedded to have forward compatible implementations.
+type UnimplementedRKMSServer struct {
+}
+
+func (UnimplementedRKMSServer) GetKey(context.Context, *GetKeyRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetKey not implemented")
+}
+func (UnimplementedRKMSServer) CreateKey(context.Context, *CreateKeyRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateKey not implemented")
+}
+func (UnimplementedRKMSServer) RotateKey(context.Context, *RotateKeyRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateKey not implemented")
+}
+func (UnimplementedRKMSServer) Encrypt(context.Context, *EncryptRequest) (*EncryptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Encrypt not implemented")
+}
+func (UnimplementedRKMSServer) Decrypt(context.Context, *DecryptRequest) (*DecryptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Decrypt not implemented")
+}
+func (UnimplementedRKMSServer) mustEmbedUnimplementedRKMSServer() {}
+
+// UnsafeRKMSServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RKMSServer will
+// result in compilation errors.
+type UnsafeRKMSServer interface {
+	mustEmbedUnimplementedRKMSServer()
+}
+
+func RegisterRKMSServer(s grpc.ServiceRegistrar, srv RKMSServer) {
+	s.RegisterService(&RKMS_ServiceDesc, srv)
+}
+
+func _RKMS_GetKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RKMSServer).GetKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RKMS_GetKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RKMSServer).GetKey(ctx, req.(*GetKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RKMS_CreateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RKMSServer).CreateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RKMS_CreateKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RKMSServer).CreateKey(ctx, req.(*CreateKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RKMS_RotateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RKMSServer).RotateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RKMS_RotateKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RKMSServer).RotateKey(ctx, req.(*RotateKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RKMS_Encrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EncryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RKMSServer).Encrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RKMS_Encrypt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RKMSServer).Encrypt(ctx, req.(*EncryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RKMS_Decrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DecryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RKMSServer).Decrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RKMS_Decrypt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RKMSServer).Decrypt(ctx, req.(*DecryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RKMS_ServiceDesc is the grpc.ServiceDesc for RKMS service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RKMS_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rkms.v1.RKMS",
+	HandlerType: (*RKMSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetKey",
+			Handler:    _RKMS_GetKey_Handler,
+		},
+		{
+			MethodName: "CreateKey",
+			Handler:    _RKMS_CreateKey_Handler,
+		},
+		{
+			MethodName: "RotateKey",
+			Handler:    _RKMS_RotateKey_Handler,
+		},
+		{
+			MethodName: "Encrypt",
+			Handler:    _RKMS_Encrypt_Handler,
+		},
+		{
+			MethodName: "Decrypt",
+			Handler:    _RKMS_Decrypt_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rkms.proto",
+}
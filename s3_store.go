@@ -0,0 +1,361 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3BatchConcurrency is the number of objects GetEncryptedDataKeysBatch gets at the same time
+const s3BatchConcurrency = 16
+
+// S3Store - an S3 implementation of a key/value store for KMS-related data.
+// Every id is stored as its own object, which makes it a cheap option for low write workloads.
+type S3Store struct {
+	bucket               *string
+	prefix               string
+	serverSideEncryption types.ServerSideEncryption
+	sseKMSKeyID          *string
+	client               *s3.Client
+}
+
+func init() {
+	RegisterStore("s3", func(config *Configuration) (Store, error) {
+		return NewS3Store(config.S3)
+	})
+}
+
+// NewS3Store creates a new S3Store instance
+func NewS3Store(s3Config S3Config) (*S3Store, error) {
+	awsConfig, err := loadAWSConfig(s3Config.Region)
+	if err != nil {
+		logStoreError(context.Background(), "s3", "NewS3Store", "", err)
+		return nil, err
+	}
+
+	store := &S3Store{
+		bucket:               aws.String(s3Config.Bucket),
+		prefix:               s3Config.Prefix,
+		serverSideEncryption: types.ServerSideEncryption(s3Config.ServerSideEncryption),
+		client:               s3.NewFromConfig(awsConfig),
+	}
+
+	if s3Config.SSEKMSKeyID != "" {
+		store.sseKMSKeyID = aws.String(s3Config.SSEKMSKeyID)
+	}
+
+	return store, nil
+}
+
+func (s *S3Store) objectKey(id string) *string {
+	return aws.String(s.prefix + id)
+}
+
+// ifNoneMatch makes a PutObject request fail if an object already exists under the same key
+func ifNoneMatch(input *s3.PutObjectInput) {
+	input.IfNoneMatch = aws.String("*")
+}
+
+// ifMatch makes a PutObject request fail if the object was modified since it was read
+func ifMatch(etag *string) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		input.IfMatch = etag
+	}
+}
+
+// getItem reads the item of the given id along with the ETag of its object.
+// A nil item is returned if the object does not exist.
+func (s *S3Store) getItem(ctx context.Context, key *string) (*item, *string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: s.bucket,
+		Key:    key,
+	}
+
+	result, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchKey" {
+			return nil, nil, nil
+		}
+
+		logStoreError(ctx, "s3", "getItem", "", err)
+		return nil, nil, err
+	}
+	defer result.Body.Close()
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		logStoreError(ctx, "s3", "getItem", "", err)
+		return nil, nil, err
+	}
+
+	item := &item{}
+	if err := json.Unmarshal(body, item); err != nil {
+		logStoreError(ctx, "s3", "getItem", "", err)
+		return nil, nil, err
+	}
+
+	return item, result.ETag, nil
+}
+
+func (s *S3Store) putItem(ctx context.Context, item *item, condition func(*s3.PutObjectInput)) error {
+	body, err := json.Marshal(item)
+	if err != nil {
+		logStoreError(ctx, "s3", "putItem", "", err)
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               s.bucket,
+		Key:                  s.objectKey(item.ID),
+		Body:                 bytes.NewReader(body),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: s.serverSideEncryption,
+		SSEKMSKeyId:          s.sseKMSKeyID,
+	}
+
+	condition(input)
+	_, err = s.client.PutObject(ctx, input)
+	return err
+}
+
+// isPreconditionFailed reports whether a conditional PutObject request was rejected
+func isPreconditionFailed(err error) bool {
+	//PreconditionFailed: the condition does not hold, ConditionalRequestConflict: another conditional write is in flight
+	code := awsErrorCode(err)
+	return code == "PreconditionFailed" || code == "ConditionalRequestConflict"
+}
+
+// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+func (s *S3Store) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	keys, _, err := s.GetVersionedEncryptedDataKeys(ctx, id)
+	return keys, err
+}
+
+// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids. S3 has no batch read, so the objects
+// are got s3BatchConcurrency at a time, the first error cancelling the others.
+func (s *S3Store) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys := make(map[string]map[string]string, len(ids))
+	var mutex sync.Mutex
+	var firstErr error
+
+	forEachConcurrently(ids, s3BatchConcurrency, func(id string) {
+		encryptedKeys, err := s.GetEncryptedDataKeys(ctx, id)
+		if _, deleted := err.(IDDeletedStoreError); deleted {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+			return
+		}
+
+		if encryptedKeys != nil {
+			keys[id] = encryptedKeys
+		}
+	})
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return keys, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// only if id does not exist in the store already.
+// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+func (s *S3Store) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
+	err := s.putItem(ctx, &item{ID: id, Keys: encryptedKeysMap}, ifNoneMatch)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		logStoreError(ctx, "s3", "SetEncryptedDataKeysConditionally", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// updateItem applies update to the item of the given id, retrying when the object
+// is modified concurrently. A nil item is passed to update if the object does not exist.
+// update returns false if there is nothing to write.
+func (s *S3Store) updateItem(ctx context.Context, id string, update func(item *item) (bool, error)) error {
+	for {
+		item, etag, err := s.getItem(ctx, s.objectKey(id))
+		if err != nil {
+			return err
+		}
+
+		write, err := update(item)
+		if err != nil || !write {
+			return err
+		}
+
+		err = s.putItem(ctx, item, ifMatch(etag))
+		if err == nil {
+			return nil
+		}
+
+		if !isPreconditionFailed(err) {
+			logStoreError(ctx, "s3", "updateItem", id, err)
+			return err
+		}
+	}
+}
+
+// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with their version
+func (s *S3Store) GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error) {
+	item, _, err := s.getItem(ctx, s.objectKey(id))
+	if err != nil || item == nil {
+		return nil, 0, err
+	}
+
+	if item.deleted() {
+		return nil, 0, item.deletedError()
+	}
+
+	return item.Keys, item.Version, nil
+}
+
+// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id if they are at expectedVersion
+func (s *S3Store) UpdateEncryptedDataKeys(ctx context.Context, id string, encryptedKeysMap map[string]string, expectedVersion int64) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if err := checkVersion(id, item, expectedVersion); err != nil {
+			return false, err
+		}
+
+		item.Keys = encryptedKeysMap
+		item.Version++
+		return true, nil
+	})
+}
+
+// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id
+func (s *S3Store) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if item == nil || item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = time.Now().Unix()
+		return true, nil
+	})
+}
+
+// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again
+func (s *S3Store) RestoreEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.updateItem(ctx, id, func(item *item) (bool, error) {
+		if item == nil {
+			return false, IDNotFoundStoreError{ID: id}
+		}
+
+		if !item.deleted() {
+			return false, nil
+		}
+
+		item.DeletedAt = 0
+		return true, nil
+	})
+}
+
+// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id
+func (s *S3Store) PurgeEncryptedDataKeys(ctx context.Context, id string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: s.bucket,
+		Key:    s.objectKey(id),
+	}
+
+	if _, err := s.client.DeleteObject(ctx, input); err != nil {
+		logStoreError(ctx, "s3", "PurgeEncryptedDataKeys", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListIDs returns a page of the ids stored under the configured prefix that are not deleted, in key order
+func (s *S3Store) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	limit = listIDsLimit(limit)
+	//one more id than the limit is read to know whether there is a next page
+	ids, err := s.listIDs(ctx, cursor, limit+1, func(item *item) bool {
+		return !item.deleted()
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) > limit {
+		return ids[:limit], ids[limit-1], nil
+	}
+
+	return ids, "", nil
+}
+
+// ListDeletedIDs returns every id that was deleted before the given time
+func (s *S3Store) ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	return s.listIDs(ctx, "", 0, func(item *item) bool {
+		return item.deletedBefore(deletedBefore)
+	})
+}
+
+// listIDs reads the objects under the configured prefix following the startAfter id until
+// max ids are included, or every object if max is 0. The deletion state is only known from
+// the object body, so every object is read.
+func (s *S3Store) listIDs(ctx context.Context, startAfter string, max int, include func(item *item) bool) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: s.bucket,
+		Prefix: aws.String(s.prefix),
+	}
+
+	if startAfter != "" {
+		input.StartAfter = s.objectKey(startAfter)
+	}
+
+	ids := make([]string, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			logStoreError(ctx, "s3", "listIDs", "", err)
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			item, _, err := s.getItem(ctx, object.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			if item != nil && include(item) {
+				ids = append(ids, strings.TrimPrefix(*object.Key, s.prefix))
+				if len(ids) == max {
+					return ids, nil
+				}
+			}
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,19 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestS3StoreConformance(t *testing.T) {
+	bucket := testStoreEnv(t, "RKMS_TEST_S3_BUCKET")
+	s, err := NewS3Store(S3Config{Region: os.Getenv("AWS_REGION"), Bucket: bucket, Prefix: "rkms-test/"})
+	if err != nil {
+		t.Fatalf("failed to create the s3 store: %s", err)
+	}
+
+	testStoreConformance(t, s)
+}
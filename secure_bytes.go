@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// redactedSecureBytes is what SecureBytes show of themselves when formatted, logged or marshalled
+const redactedSecureBytes = "[REDACTED]"
+
+// the size classes of the locked arena, the larger SecureBytes being mapped on their own
+const (
+	minLockedArenaClass  = 64
+	maxLockedArenaClass  = 4096
+	lockedArenaChunkSize = 64 << 10
+)
+
+// SecureBytes - key material, e.g. a plaintext data key or private key, held out of the Go heap in the locked
+// arena, never to be swapped nor copied around by the garbage collector, and zeroed by its owner with Destroy once
+// done with it, e.g. once its response was written. Formatting, logging or marshalling SecureBytes to JSON never
+// shows their bytes, which only Bytes reveals, nor does a panic of them; the responses carrying them are serialized
+// by marshalSecretResponse. SecureBytes aren't safe for concurrent use, each owner gets its own copy with Clone. The
+// copies made by the key providers, the HTTP and TLS buffers of the responses and the gRPC messages aren't zeroed.
+// A nil SecureBytes is empty.
+type SecureBytes struct {
+	data []byte
+	// allocated in the locked arena rather than on the heap, which the memory lock limit can force
+	locked bool
+}
+
+// newSecureBytes allocates size zero bytes in the locked arena, on the heap when memory can't be locked
+func newSecureBytes(size int) *SecureBytes {
+	if size <= 0 {
+		return &SecureBytes{}
+	}
+
+	data, err := secureArena.alloc(size)
+	if err != nil {
+		secureArena.lockFailed.Do(func() {
+			logger.Warnf("failed to lock memory for the key material, it is kept on the heap: %s", err)
+		})
+		return &SecureBytes{data: make([]byte, size)}
+	}
+	return &SecureBytes{data: data, locked: true}
+}
+
+// secureBytesOf copies b into new SecureBytes and zeroes b, e.g. the plaintext returned by a key provider
+func secureBytesOf(b []byte) *SecureBytes {
+	s := newSecureBytes(len(b))
+	copy(s.data, b)
+	zeroBytes(b)
+	return s
+}
+
+// Bytes returns the key material, which is zeroed when s is destroyed
+func (s *SecureBytes) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.data
+}
+
+// Len returns the number of bytes of the key material
+func (s *SecureBytes) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.data)
+}
+
+// Clone returns a copy of s in new SecureBytes, for another owner to destroy
+func (s *SecureBytes) Clone() *SecureBytes {
+	if s == nil {
+		return nil
+	}
+	clone := newSecureBytes(len(s.data))
+	copy(clone.data, s.data)
+	return clone
+}
+
+// Equal tells, in constant time, if s and other hold the same key material
+func (s *SecureBytes) Equal(other *SecureBytes) bool {
+	return subtle.ConstantTimeCompare(s.Bytes(), other.Bytes()) == 1 || (s.Len() == 0 && other.Len() == 0)
+}
+
+// Destroy zeroes the key material and frees its memory, s being empty from then on
+func (s *SecureBytes) Destroy() {
+	if s == nil || s.data == nil {
+		return
+	}
+
+	if s.locked {
+		secureArena.free(s.data)
+	} else {
+		zeroBytes(s.data)
+	}
+	s.data, s.locked = nil, false
+}
+
+// String redacts the key material
+func (s *SecureBytes) String() string {
+	return redactedSecureBytes
+}
+
+// GoString redacts the key material from %#v
+func (s *SecureBytes) GoString() string {
+	return redactedSecureBytes
+}
+
+// Format redacts the key material whatever the verb, e.g. %x or %q
+func (s *SecureBytes) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redactedSecureBytes)
+}
+
+// MarshalJSON redacts the key material, e.g. from the fields of the JSON logs
+func (s *SecureBytes) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(redactedSecureBytes)), nil
+}
+
+// lockedArena - the locked memory of SecureBytes, handed out in size classes of powers of two carved out of locked
+// chunks mapped lockedArenaChunkSize bytes at a time, the freed slots being zeroed and handed out again. The chunks
+// stay mapped, the arena growing to the most key material held at once; the SecureBytes larger than the largest
+// class are mapped on their own.
+type lockedArena struct {
+	mutex      sync.Mutex
+	slots      map[int][][]byte
+	lockFailed sync.Once
+}
+
+var secureArena = &lockedArena{slots: make(map[int][][]byte)}
+
+// lockedArenaClass is the size class of the slots of size bytes
+func lockedArenaClass(size int) int {
+	if size <= minLockedArenaClass {
+		return minLockedArenaClass
+	}
+	return 1 << bits.Len(uint(size-1))
+}
+
+// alloc returns size zero bytes of locked memory
+func (a *lockedArena) alloc(size int) ([]byte, error) {
+	class := lockedArenaClass(size)
+	if class > maxLockedArenaClass {
+		return allocLockedBytes(size)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.slots[class]) == 0 {
+		chunk, err := allocLockedBytes(lockedArenaChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		for offset := 0; offset < len(chunk); offset += class {
+			a.slots[class] = append(a.slots[class], chunk[offset:offset+class:offset+class])
+		}
+	}
+
+	slots := a.slots[class]
+	slot := slots[len(slots)-1]
+	a.slots[class] = slots[:len(slots)-1]
+	return slot[:size], nil
+}
+
+// free zeroes bytes returned by alloc and hands their slot out again
+func (a *lockedArena) free(b []byte) {
+	b = b[:cap(b)]
+	if len(b) > maxLockedArenaClass {
+		freeLockedBytes(b)
+		return
+	}
+
+	zeroBytes(b)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.slots[len(b)] = append(a.slots[len(b)], b)
+}
+
+// secretRef is the field of a response carrying key material, serialized by marshalSecretResponse as the base64 of
+// the SecureBytes of its index in its secrets
+type secretRef int
+
+// secretRefPrefix starts the JSON string json.Marshal writes for a secretRef, replaced by marshalSecretResponse.
+// It is random, for no string of a request, e.g. an id, to be taken for a secretRef.
+var secretRefPrefix = func() []byte {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return []byte(`"rkms-secret-` + hex.EncodeToString(nonce) + "-")
+}()
+
+func (ref secretRef) MarshalJSON() ([]byte, error) {
+	return append(append(append([]byte(nil), secretRefPrefix...), strconv.Itoa(int(ref))...), '"'), nil
+}
+
+// marshalSecretResponse serializes resp to JSON into new SecureBytes, writing the base64 of secrets[i] in place of
+// every secretRef(i) of resp, so that the key material is only ever encoded in locked memory
+func marshalSecretResponse(resp interface{}, secrets []*SecureBytes) *SecureBytes {
+	b, _ := json.Marshal(resp)
+
+	size := len(b)
+	for _, secret := range secrets {
+		size += base64.StdEncoding.EncodedLen(secret.Len())
+	}
+	out := newSecureBytes(size)
+	out.data = out.data[:0]
+
+	for len(b) > 0 {
+		start := bytes.Index(b, secretRefPrefix)
+		if start < 0 {
+			out.data = append(out.data, b...)
+			break
+		}
+		end := start + len(secretRefPrefix) + bytes.IndexByte(b[start+len(secretRefPrefix):], '"') + 1
+		ref, _ := strconv.Atoi(string(b[start+len(secretRefPrefix) : end-1]))
+
+		out.data = append(out.data, b[:start]...)
+		out.data = append(out.data, '"')
+		if ref >= 0 && ref < len(secrets) {
+			n := len(out.data)
+			out.data = out.data[:n+base64.StdEncoding.EncodedLen(secrets[ref].Len())]
+			base64.StdEncoding.Encode(out.data[n:], secrets[ref].Bytes())
+		}
+		out.data = append(out.data, '"')
+		b = b[end:]
+	}
+	return out
+}
+
+// writeSecretResponse writes a response serialized by marshalSecretResponse with the given status, and destroys it
+func writeSecretResponse(w http.ResponseWriter, status int, resp *SecureBytes) {
+	defer resp.Destroy()
+	w.WriteHeader(status)
+	w.Write(resp.Bytes())
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+func TestSecureBytesAreRedacted(t *testing.T) {
+	s := secureBytesOf([]byte("data-key"))
+	defer s.Destroy()
+
+	dataKey := &DataKey{ID: "id", Plaintext: s, Version: 1}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%x", "%q"} {
+		if formatted := fmt.Sprintf(format, dataKey); strings.Contains(formatted, "data-key") || strings.Contains(formatted, "646174612d6b6579") {
+			t.Errorf("%s should have redacted the key, got %s", format, formatted)
+		}
+	}
+
+	if b, _ := json.Marshal(dataKey); !bytes.Contains(b, []byte(`"Plaintext":"[REDACTED]"`)) {
+		t.Errorf("the JSON of the data key should have redacted the key, got %s", b)
+	}
+
+	var logged bytes.Buffer
+	log := logger.New()
+	log.Out = &logged
+	log.Formatter = &logger.JSONFormatter{}
+	log.WithField("key", s).Info("logging a key")
+	if strings.Contains(logged.String(), "data-key") {
+		t.Errorf("the logs should have redacted the key, got %s", logged.String())
+	}
+}
+
+func TestSecureBytesDestroy(t *testing.T) {
+	s := secureBytesOf([]byte("data-key"))
+	b := s.Bytes()
+	clone := s.Clone()
+
+	s.Destroy()
+	if s.Len() != 0 || !bytes.Equal(b, make([]byte, len(b))) {
+		t.Fatalf("the key should have been zeroed")
+	}
+	s.Destroy()
+
+	if string(clone.Bytes()) != "data-key" {
+		t.Fatalf("the clone shouldn't have been destroyed with the key")
+	}
+	clone.Destroy()
+}
+
+func TestLockedArenaReusesSlots(t *testing.T) {
+	a := &lockedArena{slots: make(map[int][][]byte)}
+	b, err := a.alloc(32)
+	if err != nil {
+		t.Skipf("memory can't be locked here: %s", err)
+	}
+	if len(b) != 32 || cap(b) != minLockedArenaClass {
+		t.Fatalf("32 bytes should have been allocated in the smallest class, got %d of %d", len(b), cap(b))
+	}
+	copy(b, "data-key")
+	free := len(a.slots[minLockedArenaClass])
+
+	a.free(b)
+	if len(a.slots[minLockedArenaClass]) != free+1 || !bytes.Equal(b[:cap(b)], make([]byte, cap(b))) {
+		t.Fatalf("the freed slot should have been zeroed and handed out again")
+	}
+
+	large, err := a.alloc(maxLockedArenaClass + 1)
+	if err != nil || len(large) != maxLockedArenaClass+1 {
+		t.Fatalf("the bytes larger than the largest class should have been mapped on their own, got %v", err)
+	}
+	a.free(large)
+}
+
+func TestMarshalSecretResponse(t *testing.T) {
+	first, second := secureBytesOf([]byte("first-key")), secureBytesOf([]byte("second-key"))
+	defer first.Destroy()
+	defer second.Destroy()
+
+	dataKeys := map[string]*DataKey{
+		"id-1": {ID: "id-1", Plaintext: first, Version: 1},
+		"id-2": {ID: "id-2", Plaintext: second, Version: 2, ExpiresAt: time.Unix(1700000000, 0)},
+	}
+	resp := ConstructBatchResponse(APIVersion1, []string{"id-1", "id-2", "id-3"}, dataKeys, map[string]error{"id-3": IDNotFoundStoreError{ID: "id-3"}})
+	defer resp.Destroy()
+
+	var batch struct {
+		Keys []struct {
+			ID        string `json:"id"`
+			Key       []byte `json:"key"`
+			Version   int64  `json:"version"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"keys"`
+		Errors []batchErrorResponse `json:"errors"`
+	}
+	if err := json.Unmarshal(resp.Bytes(), &batch); err != nil {
+		t.Fatalf("the response should have been JSON, got %s: %s", resp.Bytes(), err)
+	}
+	if len(batch.Keys) != 2 || string(batch.Keys[0].Key) != "first-key" || string(batch.Keys[1].Key) != "second-key" || batch.Keys[1].ExpiresAt != 1700000000 {
+		t.Fatalf("every key should have been written in place of its reference, got %s", resp.Bytes())
+	}
+	if len(batch.Errors) != 1 || batch.Errors[0].ID != "id-3" {
+		t.Fatalf("the errors should have been kept, got %s", resp.Bytes())
+	}
+
+	pair := ConstructDataKeyPairResponse(&DataKeyPair{ID: "id", KeySpec: KeyPairSpecECCNISTP256, PublicKey: "cHVibGlj"})
+	defer pair.Destroy()
+	if bytes.Contains(pair.Bytes(), []byte("private_key")) {
+		t.Fatalf("the private key should have been left out when it wasn't unwrapped, got %s", pair.Bytes())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// MaxShamirShares is the number of shares a secret can be split into, every share being given a distinct non-zero
+// x coordinate of GF(256)
+const MaxShamirShares = 255
+
+// gf256Mul multiplies in GF(256) with the polynomial of AES, x^8 + x^4 + x^3 + x + 1, in constant time
+func gf256Mul(a byte, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+		b >>= 1
+	}
+	return product
+}
+
+// gf256Inverse is the multiplicative inverse of a non-zero element of GF(256), a^254, in constant time
+func gf256Inverse(a byte) byte {
+	inverse, square := byte(1), a
+	for i := 0; i < 7; i++ {
+		square = gf256Mul(square, square)
+		inverse = gf256Mul(inverse, square)
+	}
+	return inverse
+}
+
+// shamirSplit splits secret with Shamir's scheme into the given number of shares, any threshold of which
+// reconstruct it while fewer tell nothing about it. The share of the x coordinate x is shares[x-1], as long as
+// the secret.
+func shamirSplit(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > shares || shares > MaxShamirShares {
+		return nil, fmt.Errorf("can't split a secret into %d shares with a threshold of %d", shares, threshold)
+	}
+
+	//a random polynomial of degree threshold-1 by byte of the secret, whose constant term is the byte
+	coefficients := make([]byte, (threshold-1)*len(secret))
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range coefficients {
+			coefficients[i] = 0
+		}
+	}()
+
+	split := make([][]byte, shares)
+	for i := range split {
+		x := byte(i + 1)
+		split[i] = make([]byte, len(secret))
+		for j := range secret {
+			//Horner's method, from the highest degree down to the secret
+			y := byte(0)
+			for k := threshold - 2; k >= 0; k-- {
+				y = gf256Mul(y, x) ^ coefficients[k*len(secret)+j]
+			}
+			split[i][j] = gf256Mul(y, x) ^ secret[j]
+		}
+	}
+	return split, nil
+}
+
+// shamirCombine reconstructs the secret of the given shares, the share of xs[i] being shares[i], by Lagrange
+// interpolation at 0. Fewer shares than the threshold of the split reconstruct another secret.
+func shamirCombine(xs []byte, shares [][]byte) ([]byte, error) {
+	if len(xs) == 0 || len(xs) != len(shares) {
+		return nil, fmt.Errorf("can't combine %d shares of %d x coordinates", len(shares), len(xs))
+	}
+
+	seen := make(map[byte]bool, len(xs))
+	for i, x := range xs {
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("the x coordinates of the shares must be distinct and non-zero")
+		}
+		if len(shares[i]) != len(shares[0]) {
+			return nil, fmt.Errorf("the shares aren't of the same length")
+		}
+		seen[x] = true
+	}
+
+	secret := make([]byte, len(shares[0]))
+	for i, x := range xs {
+		//the Lagrange basis polynomial of x at 0
+		basis := byte(1)
+		for j, other := range xs {
+			if j != i {
+				basis = gf256Mul(basis, gf256Mul(other, gf256Inverse(other^x)))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= gf256Mul(shares[i][k], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret := []byte("a data key of thirty-two bytes..")
+	shares, err := shamirSplit(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("failed to split the secret: %s", err)
+	}
+
+	for _, xs := range [][]byte{{1, 2, 3}, {5, 3, 1}, {2, 4, 5}, {1, 2, 3, 4, 5}} {
+		subset := make([][]byte, len(xs))
+		for i, x := range xs {
+			subset[i] = shares[x-1]
+		}
+		combined, err := shamirCombine(xs, subset)
+		if err != nil || !bytes.Equal(combined, secret) {
+			t.Fatalf("shares %v should have reconstructed the secret, got %v", xs, err)
+		}
+	}
+
+	combined, err := shamirCombine([]byte{1, 2}, [][]byte{shares[0], shares[1]})
+	if err == nil && bytes.Equal(combined, secret) {
+		t.Fatalf("fewer shares than the threshold shouldn't have reconstructed the secret")
+	}
+
+	if _, err := shamirCombine([]byte{1, 1}, [][]byte{shares[0], shares[0]}); err == nil {
+		t.Fatalf("the same share twice should have failed")
+	}
+	if _, err := shamirSplit(secret, 3, 4); err == nil {
+		t.Fatalf("a threshold above the number of shares should have failed")
+	}
+}
+
+// failingDecryptProvider encrypts with its provider and fails to decrypt
+type failingDecryptProvider struct {
+	KeyProvider
+}
+
+func (p *failingDecryptProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	return nil, fmt.Errorf("unavailable")
+}
+
+func getSharesRKMS(t *testing.T, regions int, threshold int) *RKMS {
+	r := getEnvelopeRKMS(t)
+	r.regions = make([]string, regions)
+	r.providers = make(map[string]KeyProvider, regions)
+	r.shamirThreshold = threshold
+	for i := range r.regions {
+		os.Setenv("RKMS_TEST_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, LocalMasterKeySize)))
+		provider, err := NewLocalKeyProvider("env:RKMS_TEST_MASTER_KEY")
+		os.Unsetenv("RKMS_TEST_MASTER_KEY")
+		if err != nil {
+			t.Fatalf("failed to create local key provider: %s", err)
+		}
+		r.regions[i] = getTestRegionName(i)
+		r.providers[r.regions[i]] = provider
+	}
+	return r
+}
+
+func TestDataKeyShares(t *testing.T) {
+	r := getSharesRKMS(t, 3, 2)
+	ctx := context.Background()
+
+	dataKey, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to read the encrypted data keys: %s", err)
+	}
+	for _, region := range r.regions {
+		wrapped, err := parseWrappedKey(encryptedDataKeys[region])
+		if err != nil || wrapped.Threshold != 2 || wrapped.Share == 0 {
+			t.Fatalf("region %s should have saved a share of the data key, got %v", region, err)
+		}
+		share, err := wrapped.decrypt(ctx, r.providers[region], nil)
+		if err != nil || bytes.Equal(share, dataKey.Plaintext.Bytes()) {
+			t.Fatalf("the share of region %s shouldn't have been the data key, got %v", region, err)
+		}
+	}
+
+	//any 2 of the 3 regions reconstruct the data key
+	r.providers[r.regions[0]] = &failingDecryptProvider{r.providers[r.regions[0]]}
+	read, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil || !read.Plaintext.Equal(dataKey.Plaintext) {
+		t.Fatalf("2 of the 3 shares should have reconstructed the data key, got %v", err)
+	}
+
+	share := wrappedKeyCiphertext(encryptedDataKeys[r.regions[1]])
+	plaintext, _, err := r.DecryptCiphertext(ctx, "id", r.regions[1], share, nil)
+	if err != nil || !plaintext.Equal(dataKey.Plaintext) {
+		t.Fatalf("a share should have been combined with the other shares of its version, got %v", err)
+	}
+
+	if _, err := r.GetWrappedDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("the shares shouldn't have been given to the clients")
+	} else if _, ok := err.(DataKeySplitError); !ok {
+		t.Fatalf("the shares should have failed with DataKeySplitError, got %v", err)
+	}
+
+	r.providers[r.regions[1]] = &failingDecryptProvider{r.providers[r.regions[1]]}
+	if _, err := r.GetDataKey(ctx, "id", 0, nil); err == nil {
+		t.Fatalf("a single share shouldn't have reconstructed the data key")
+	}
+}
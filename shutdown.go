@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// serveUntilDone serves HTTP with server on listener until it fails or ctx is done. It then stops accepting
+// connections and waits up to timeout for the in-flight requests to complete, closing the connections still
+// active after it.
+func serveUntilDone(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Infof("shutting down, waiting up to %s for the in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Infof("requests still in flight after %s, closing their connections: %s", timeout, err)
+		return server.Close()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeUntilDoneDrainsInFlightRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("was not able to listen: %s", err)
+	}
+
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("drained"))
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilDone(ctx, server, listener, time.Second)
+	}()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(b)
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-served; err != nil {
+		t.Fatalf("the server should have shut down cleanly: %s", err)
+	}
+	if response := <-responses; response != "drained" {
+		t.Fatalf("the in-flight request should have completed, got %q", response)
+	}
+
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Fatalf("no request should be accepted after the shutdown")
+	}
+}
+
+func TestServeUntilDoneClosesRequestsPastTheTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("was not able to listen: %s", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilDone(ctx, server, listener, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("the server should have given up on the request after the timeout")
+	}
+}
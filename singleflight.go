@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dataKeyFlight is a call in flight for the data key of an id, which the concurrent requests for it wait for
+type dataKeyFlight struct {
+	done    chan struct{}
+	dataKey *DataKey
+	err     error
+
+	// the requests waiting for the flight or copying its data key, the last one to leave once it landed
+	// destroying it
+	waiters int
+	landed  bool
+}
+
+// dataKeyFlights - de-duplicates the concurrent calls for the data key of the same id, for a burst of requests for
+// a missing id to read the store, generate a data key and save it once, rather than every request racing to save
+// its own and all but one failing their conditional put. A nil dataKeyFlights makes every call.
+type dataKeyFlights struct {
+	mutex   sync.Mutex
+	flights map[string]*dataKeyFlight
+}
+
+func newDataKeyFlights() *dataKeyFlights {
+	return &dataKeyFlights{flights: map[string]*dataKeyFlight{}}
+}
+
+// do calls f unless a call of the same key is in flight, in which case its result is waited for and shared. The
+// call is detached from the cancellation of the request which made it, keeping its deadline, for the requests
+// waiting for it not to fail when that one went away; a request giving up waiting gets the error of its own ctx.
+// Every request gets its own copy of the data key, to destroy.
+func (g *dataKeyFlights) do(ctx context.Context, key string, f func(ctx context.Context) (*DataKey, error)) (*DataKey, error) {
+	if g == nil {
+		return f(ctx)
+	}
+
+	g.mutex.Lock()
+	flight, ok := g.flights[key]
+	if !ok {
+		flight = &dataKeyFlight{done: make(chan struct{})}
+		g.flights[key] = flight
+		go g.fly(ctx, key, flight, f)
+	}
+	flight.waiters++
+	g.mutex.Unlock()
+	defer g.leave(flight)
+
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	dataKey := *flight.dataKey
+	dataKey.Plaintext = flight.dataKey.Plaintext.Clone()
+	return &dataKey, nil
+}
+
+// leave is called by a request done with the flight, the last one destroying its data key once it landed
+func (g *dataKeyFlights) leave(flight *dataKeyFlight) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	flight.waiters--
+	if flight.landed && flight.waiters == 0 {
+		flight.dataKey.Destroy()
+	}
+}
+
+func (g *dataKeyFlights) fly(ctx context.Context, key string, flight *dataKeyFlight, f func(ctx context.Context) (*DataKey, error)) {
+	flightCtx, cancel := detachedContext(ctx)
+	defer cancel()
+
+	flight.dataKey, flight.err = f(flightCtx)
+
+	g.mutex.Lock()
+	delete(g.flights, key)
+	flight.landed = true
+	if flight.waiters == 0 {
+		flight.dataKey.Destroy()
+	}
+	g.mutex.Unlock()
+	close(flight.done)
+}
+
+// dataKeyFlightKey is the key of the calls for the data key of id which can share their result: the ones with the
+// same TTL and encryption context
+func dataKeyFlightKey(id string, ttl time.Duration, encryptionContext EncryptionContext) string {
+	return fmt.Sprintf("%s\x00%d\x00%s", id, ttl, encryptionContext.AAD())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// countingKMSClient counts the data keys it generates
+type countingKMSClient struct {
+	availableKMSClient
+	generated int32
+}
+
+func (c *countingKMSClient) GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	atomic.AddInt32(&c.generated, 1)
+	return c.availableKMSClient.GenerateDataKey(ctx, input, opts...)
+}
+
+// countingStore counts its reads and writes, its reads being slow for the concurrent requests to overlap
+type countingStore struct {
+	Store
+	gets int32
+	sets int32
+}
+
+func (s *countingStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(100 * time.Millisecond)
+	return s.Store.GetEncryptedDataKeys(ctx, id)
+}
+
+func (s *countingStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string) error {
+	atomic.AddInt32(&s.sets, 1)
+	return s.Store.SetEncryptedDataKeysConditionally(ctx, id, keys)
+}
+
+func getFlightsRKMS() (*RKMS, *countingStore, *countingKMSClient) {
+	r := getRKMS([]bool{true, true, true})
+	store := &countingStore{Store: NewMemoryStore()}
+	client := &countingKMSClient{}
+	r.store = store
+	r.providers[r.regions[0]].(*AWSKMSProvider).client = client
+	r.flights = newDataKeyFlights()
+	return r, store, client
+}
+
+func TestGetDataKeySharedByConcurrentRequests(t *testing.T) {
+	r, store, client := getFlightsRKMS()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dataKey, err := r.GetDataKey(context.Background(), "id-1", 0, nil)
+			if err != nil || dataKey.Plaintext.Len() == 0 {
+				t.Errorf("every request should have got the data key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if store.gets != 1 || store.sets != 1 || client.generated != 1 {
+		t.Fatalf("the data key should have been read, generated and saved once, got %d reads, %d generations and %d writes", store.gets, client.generated, store.sets)
+	}
+}
+
+func TestGetDataKeyFlightOutlivesFirstRequest(t *testing.T) {
+	r, store, _ := getFlightsRKMS()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := r.GetDataKey(ctx, "id-1", 0, nil)
+		first <- err
+	}()
+	//the second request joins the flight of the first one, which then goes away
+	time.Sleep(20 * time.Millisecond)
+	second := make(chan error)
+	go func() {
+		_, err := r.GetDataKey(context.Background(), "id-1", 0, nil)
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("the cancelled request should have stopped waiting, got %v", err)
+	}
+	if err := <-second; err != nil || store.gets != 1 {
+		t.Fatalf("the request left waiting should have got the data key of the flight, got %d reads: %v", store.gets, err)
+	}
+}
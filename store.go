@@ -3,17 +3,256 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
 )
 
+// DefaultStoreType is the store used when store.type is not set in the configuration
+const DefaultStoreType = "dynamodb"
+
+// DefaultListIDsLimit is the page size of ListIDs when no limit is given
+const DefaultListIDsLimit = 1000
+
 // Store - abstract definition of a key/value store for KMS-related data
 type Store interface {
-	// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
+	// GetEncryptedDataKeys retrieves the encrypted data keys for the given id.
+	// If the id has been deleted, an IDDeletedStoreError error is returned.
 	GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error)
 
 	// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
 	// only if id does not exist in the store already.
-	// If the id already exists, an IDAlreadyExistsStoreError error is returned.
+	// If the id already exists, deleted or not, an IDAlreadyExistsStoreError error is returned.
 	SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string) error
+
+	// GetVersionedEncryptedDataKeys retrieves the encrypted data keys for the given id along with
+	// their version, to be passed to UpdateEncryptedDataKeys. Keys that were never updated are at version 0.
+	// If the id has been deleted, an IDDeletedStoreError error is returned.
+	GetVersionedEncryptedDataKeys(ctx context.Context, id string) (map[string]string, int64, error)
+
+	// UpdateEncryptedDataKeys replaces the encrypted data keys for the given id only if they are
+	// still at expectedVersion, and moves them to the next version.
+	// If they are at another version, a VersionMismatchStoreError error is returned.
+	// If the id does not exist, an IDNotFoundStoreError error is returned,
+	// and if it has been deleted, an IDDeletedStoreError error.
+	UpdateEncryptedDataKeys(ctx context.Context, id string, keys map[string]string, expectedVersion int64) error
+
+	// DeleteEncryptedDataKeys soft deletes the encrypted data keys for the given id:
+	// they are kept as a tombstone until purged, and can be restored until then.
+	// Deleting an id that does not exist or is already deleted is not an error.
+	DeleteEncryptedDataKeys(ctx context.Context, id string) error
+
+	// RestoreEncryptedDataKeys makes the encrypted data keys of a deleted id available again.
+	// If the id does not exist, an IDNotFoundStoreError error is returned.
+	RestoreEncryptedDataKeys(ctx context.Context, id string) error
+
+	// PurgeEncryptedDataKeys permanently removes the encrypted data keys for the given id,
+	// whether they are deleted or not. Purging an id that does not exist is not an error.
+	PurgeEncryptedDataKeys(ctx context.Context, id string) error
+
+	// ListIDs returns a page of up to limit ids that have encrypted data keys in the store,
+	// deleted ids excluded. The page starts after cursor, "" being the beginning, and the
+	// returned cursor is the one of the next page, "" after the last page. A page may hold
+	// fewer than limit ids before the last one. A limit of 0 or less is DefaultListIDsLimit.
+	// Cursors are opaque and only valid for the store that returned them.
+	ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error)
+
+	// ListDeletedIDs returns every id that was deleted before the given time
+	ListDeletedIDs(ctx context.Context, deletedBefore time.Time) ([]string, error)
+}
+
+// BatchStore is implemented by the stores that can retrieve the encrypted data keys
+// of many ids in fewer round trips than one per id
+type BatchStore interface {
+	// GetEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids.
+	// Ids that do not exist or are deleted are left out of the returned map.
+	GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]map[string]string, error)
+}
+
+// RecentIDsStore is implemented by the stores which cache the ids they read, those most recently used being the
+// ones the caches are warmed up with on the next start
+type RecentIDsStore interface {
+	// RecentIDs returns up to limit ids of the cache, the most recently used first
+	RecentIDs(limit int) []string
+}
+
+// ExpiringStore is implemented by the stores that can keep encrypted data keys for a limited time
+type ExpiringStore interface {
+	// SetExpiringEncryptedDataKeysConditionally is SetEncryptedDataKeysConditionally for keys that expire
+	// at expiresAt. Once expired, the id reads as missing and can be set again until the store removes it.
+	SetExpiringEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, expiresAt time.Time) error
+
+	// GetExpiringEncryptedDataKeys retrieves the encrypted data keys for the given id along with
+	// the time they expire at, the zero time if they never expire
+	GetExpiringEncryptedDataKeys(ctx context.Context, id string) (map[string]string, time.Time, error)
+}
+
+// IdempotencyStore is implemented by the stores that can persist the idempotency records of the write requests
+type IdempotencyStore interface {
+	// SetIdempotencyRecordConditionally saves the given record under its key only if the key has no record yet,
+	// or an expired one. If it has one, an IDAlreadyExistsStoreError error is returned.
+	SetIdempotencyRecordConditionally(ctx context.Context, record *IdempotencyRecord) error
+
+	// SetIdempotencyRecord saves the given record under its key, replacing the record the key has
+	SetIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error
+
+	// GetIdempotencyRecord retrieves the record of the given key, nil if it has none or an expired one
+	GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error)
+
+	// DeleteIdempotencyRecord removes the record of the given key. Deleting a key without record is not an error.
+	DeleteIdempotencyRecord(ctx context.Context, key string) error
+}
+
+// ApprovalStore is implemented by the stores that can persist the approval records of the actions under dual control
+type ApprovalStore interface {
+	// SetApprovalRecord saves the given record under its approval id
+	SetApprovalRecord(ctx context.Context, record *ApprovalRecord) error
+
+	// GetApprovalRecord retrieves the record of the given approval id, nil if it has none or an expired one
+	GetApprovalRecord(ctx context.Context, approvalID string) (*ApprovalRecord, error)
+
+	// ListApprovalRecords retrieves every unexpired approval record
+	ListApprovalRecords(ctx context.Context) ([]*ApprovalRecord, error)
+
+	// DeleteApprovalRecord removes the record of the given approval id, failing with an IDNotFoundStoreError if it
+	// has none, for an approval to be taken once
+	DeleteApprovalRecord(ctx context.Context, approvalID string) error
+}
+
+// getEncryptedDataKeysBatch retrieves the encrypted data keys for the given ids in a batch
+// if the store supports it, and with one GetEncryptedDataKeys call per id otherwise
+func getEncryptedDataKeysBatch(ctx context.Context, store Store, ids []string) (map[string]map[string]string, error) {
+	if batchStore, ok := store.(BatchStore); ok {
+		return batchStore.GetEncryptedDataKeysBatch(ctx, ids)
+	}
+
+	keys := make(map[string]map[string]string, len(ids))
+	if err := getMissingEncryptedDataKeys(ctx, store, ids, keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// getEncryptedDataKeysBatchThenEach is the batch read of the composite stores: the ids are read
+// in a batch from first, and the ids first doesn't have are read one by one from the composite store.
+// If the batch fails, every id is read one by one.
+func getEncryptedDataKeysBatchThenEach(ctx context.Context, composite Store, first Store, ids []string) (map[string]map[string]string, error) {
+	keys, err := getEncryptedDataKeysBatch(ctx, first, ids)
+	if err != nil {
+		logger.Infof("failed to batch read from the first store: %s", err)
+		keys = make(map[string]map[string]string, len(ids))
+	}
+
+	if err := getMissingEncryptedDataKeys(ctx, composite, ids, keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// getMissingEncryptedDataKeys reads the ids that are not in keys yet one by one, skipping deleted ids
+func getMissingEncryptedDataKeys(ctx context.Context, store Store, ids []string, keys map[string]map[string]string) error {
+	for _, id := range ids {
+		if _, found := keys[id]; found {
+			continue
+		}
+
+		encryptedKeys, err := store.GetEncryptedDataKeys(ctx, id)
+		if _, deleted := err.(IDDeletedStoreError); deleted {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if encryptedKeys != nil {
+			keys[id] = encryptedKeys
+		}
+	}
+
+	return nil
+}
+
+// listIDsLimit returns the page size to use for the limit given to ListIDs
+func listIDsLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListIDsLimit
+	}
+
+	return limit
+}
+
+// pageSortedIDs returns the page of up to limit ids following cursor out of sorted ids,
+// for the stores whose cursor is the last id of the previous page
+func pageSortedIDs(ids []string, cursor string, limit int) ([]string, string) {
+	start := sort.Search(len(ids), func(i int) bool {
+		return ids[i] > cursor
+	})
+
+	end := start + listIDsLimit(limit)
+	if end >= len(ids) {
+		return ids[start:], ""
+	}
+
+	return ids[start:end], ids[end-1]
+}
+
+// item is the record persisted by the stores for every id.
+// DeletedAt is the unix time the id was deleted at, 0 while the id is not deleted.
+// Version is incremented by every UpdateEncryptedDataKeys.
+// ExpiresAt is the unix time the keys expire at, 0 if they never expire.
+type item struct {
+	ID        string            `json:"id"`
+	Keys      map[string]string `json:"keys"`
+	DeletedAt int64             `json:"deleted_at,omitempty"`
+	Version   int64             `json:"version,omitempty"`
+	ExpiresAt int64             `json:"expires_at,omitempty"`
+}
+
+func (i *item) deleted() bool {
+	return i.DeletedAt != 0
+}
+
+func (i *item) deletedBefore(t time.Time) bool {
+	return i.deleted() && i.DeletedAt < t.Unix()
+}
+
+func (i *item) expired(now time.Time) bool {
+	return i.ExpiresAt != 0 && i.ExpiresAt <= now.Unix()
+}
+
+func (i *item) expiresAt() time.Time {
+	if i.ExpiresAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(i.ExpiresAt, 0)
+}
+
+func (i *item) deletedError() error {
+	return IDDeletedStoreError{ID: i.ID, DeletedAt: time.Unix(i.DeletedAt, 0)}
+}
+
+// checkVersion returns the error UpdateEncryptedDataKeys fails with for the current item of id,
+// nil if the item exists and is at expectedVersion
+func checkVersion(id string, current *item, expectedVersion int64) error {
+	if current == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	if current.deleted() {
+		return current.deletedError()
+	}
+
+	if current.Version != expectedVersion {
+		return VersionMismatchStoreError{ID: id, ExpectedVersion: expectedVersion}
+	}
+
+	return nil
 }
 
 // IDAlreadyExistsStoreError represents an error type that SetEncryptedDataKeysConditionally
@@ -25,3 +264,97 @@ type IDAlreadyExistsStoreError struct {
 func (e IDAlreadyExistsStoreError) Error() string {
 	return fmt.Sprintf("id %q already exists in the store", e.ID)
 }
+
+// IDDeletedStoreError represents an error type that GetEncryptedDataKeys
+// returns when the id being read has been deleted
+type IDDeletedStoreError struct {
+	ID        string
+	DeletedAt time.Time
+}
+
+func (e IDDeletedStoreError) Error() string {
+	return fmt.Sprintf("id %q was deleted at %s", e.ID, e.DeletedAt.UTC().Format(time.RFC3339))
+}
+
+// IDNotFoundStoreError represents an error type that is returned when the id
+// being modified does not exist in the store
+type IDNotFoundStoreError struct {
+	ID string
+}
+
+func (e IDNotFoundStoreError) Error() string {
+	return fmt.Sprintf("id %q does not exist in the store", e.ID)
+}
+
+// VersionMismatchStoreError represents an error type that UpdateEncryptedDataKeys
+// returns when the keys being updated are not at the expected version anymore
+type VersionMismatchStoreError struct {
+	ID              string
+	ExpectedVersion int64
+}
+
+func (e VersionMismatchStoreError) Error() string {
+	return fmt.Sprintf("encrypted data keys of id %q are not at version %d", e.ID, e.ExpectedVersion)
+}
+
+// StoreFactory creates a Store out of the application configuration
+type StoreFactory func(config *Configuration) (Store, error)
+
+var storeFactories = make(map[string]StoreFactory)
+
+// RegisterStore makes a Store implementation selectable through the store.type config value.
+// It is meant to be called from the init function of the file implementing the store,
+// so a backend is available as soon as it is compiled in.
+func RegisterStore(storeType string, factory StoreFactory) {
+	if factory == nil {
+		panic("RegisterStore: factory is nil")
+	}
+
+	if _, exists := storeFactories[storeType]; exists {
+		panic(fmt.Sprintf("RegisterStore: store type %q is registered twice", storeType))
+	}
+
+	storeFactories[storeType] = factory
+}
+
+// RegisteredStoreTypes returns the sorted names of every store compiled into the binary
+func RegisteredStoreTypes() []string {
+	storeTypes := make([]string, 0, len(storeFactories))
+	for storeType := range storeFactories {
+		storeTypes = append(storeTypes, storeType)
+	}
+
+	sort.Strings(storeTypes)
+	return storeTypes
+}
+
+// NewStore creates the Store selected by the store.type config value
+func NewStore(config *Configuration) (Store, error) {
+	factory, ok := storeFactories[config.Store.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown store type %q, available store types are: %s", config.Store.Type, strings.Join(RegisteredStoreTypes(), ", "))
+	}
+
+	return factory(config)
+}
+
+// newStores creates a store for every given store type, for stores that are composed of other stores.
+// wrapperType can't be one of the store types, as it would make the composition infinite.
+func newStores(config *Configuration, storeTypes []string, wrapperType string) ([]Store, error) {
+	stores := make([]Store, 0, len(storeTypes))
+	for _, storeType := range storeTypes {
+		if storeType == wrapperType {
+			return nil, fmt.Errorf("a %s store can't be composed of another %s store", wrapperType, wrapperType)
+		}
+
+		storeConfig := *config
+		storeConfig.Store.Type = storeType
+		store, err := NewStore(&storeConfig)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+
+	return stores, nil
+}
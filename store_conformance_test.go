@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStoreConformance checks that a store keeps the contract of the Store interface: conditional creates, versioned
+// updates, soft deletes with their restore and purge, the paging of ListIDs and the batch reads. The ids have a prefix
+// of their own and are purged at the end, so the network stores can run it against a shared test server.
+func testStoreConformance(t *testing.T, s Store) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("conformance-%d-", time.Now().UnixNano())
+	id := func(name string) string {
+		return prefix + name
+	}
+
+	ids := []string{id("a"), id("b"), id("c"), id("d"), id("e"), id("deleted")}
+	t.Cleanup(func() {
+		for _, id := range ids {
+			s.PurgeEncryptedDataKeys(ctx, id)
+		}
+	})
+
+	//conditional create
+	keys := map[string]string{"region-0": "ciphertext-0", "region-1": "ciphertext-1"}
+	if err := s.SetEncryptedDataKeysConditionally(ctx, id("a"), keys); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	err := s.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("second write should have failed with IDAlreadyExistsStoreError, got: %v", err)
+	}
+
+	if storedKeys, err := s.GetEncryptedDataKeys(ctx, id("a")); err != nil || !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("first write should have won, got: %v, %v", storedKeys, err)
+	}
+
+	if storedKeys, err := s.GetEncryptedDataKeys(ctx, id("missing")); err != nil || storedKeys != nil {
+		t.Fatalf("a missing id should read as nil keys, got: %v, %v", storedKeys, err)
+	}
+
+	//versions
+	storedKeys, version, err := s.GetVersionedEncryptedDataKeys(ctx, id("a"))
+	if err != nil || !reflect.DeepEqual(storedKeys, keys) || version != 0 {
+		t.Fatalf("new keys should be at version 0, got %d: %v, %v", version, storedKeys, err)
+	}
+
+	rewrapped := map[string]string{"region-0": "rewrapped-0", "region-1": "rewrapped-1"}
+	if err := s.UpdateEncryptedDataKeys(ctx, id("a"), rewrapped, version); err != nil {
+		t.Fatalf("failed to update encrypted data keys: %s", err)
+	}
+
+	err = s.UpdateEncryptedDataKeys(ctx, id("a"), map[string]string{"region-0": "clobbered"}, version)
+	if _, ok := err.(VersionMismatchStoreError); !ok {
+		t.Fatalf("an update at a stale version should fail with VersionMismatchStoreError, got: %v", err)
+	}
+
+	storedKeys, version, err = s.GetVersionedEncryptedDataKeys(ctx, id("a"))
+	if err != nil || !reflect.DeepEqual(storedKeys, rewrapped) || version != 1 {
+		t.Fatalf("updated keys should be at version 1, got %d: %v, %v", version, storedKeys, err)
+	}
+
+	err = s.UpdateEncryptedDataKeys(ctx, id("missing"), rewrapped, 0)
+	if _, ok := err.(IDNotFoundStoreError); !ok {
+		t.Fatalf("updating a missing id should fail with IDNotFoundStoreError, got: %v", err)
+	}
+
+	//delete, restore and purge
+	if err := s.SetEncryptedDataKeysConditionally(ctx, id("deleted"), keys); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	if err := s.DeleteEncryptedDataKeys(ctx, id("deleted")); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	if err := s.DeleteEncryptedDataKeys(ctx, id("deleted")); err != nil {
+		t.Fatalf("deleting an id twice should not fail: %s", err)
+	}
+
+	if _, err := s.GetEncryptedDataKeys(ctx, id("deleted")); err == nil {
+		t.Fatalf("should not have returned keys of a deleted id")
+	} else if _, ok := err.(IDDeletedStoreError); !ok {
+		t.Fatalf("reading a deleted id should fail with IDDeletedStoreError, got: %v", err)
+	}
+
+	err = s.UpdateEncryptedDataKeys(ctx, id("deleted"), rewrapped, 0)
+	if _, ok := err.(IDDeletedStoreError); !ok {
+		t.Fatalf("updating a deleted id should fail with IDDeletedStoreError, got: %v", err)
+	}
+
+	err = s.SetEncryptedDataKeysConditionally(ctx, id("deleted"), map[string]string{"region-0": "other"})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("a deleted id should not be recreated, got: %v", err)
+	}
+
+	if err := s.RestoreEncryptedDataKeys(ctx, id("deleted")); err != nil {
+		t.Fatalf("failed to restore encrypted data keys: %s", err)
+	}
+
+	if storedKeys, err := s.GetEncryptedDataKeys(ctx, id("deleted")); err != nil || !reflect.DeepEqual(storedKeys, keys) {
+		t.Fatalf("restored keys are wrong: %v, %v", storedKeys, err)
+	}
+
+	if _, ok := s.RestoreEncryptedDataKeys(ctx, id("missing")).(IDNotFoundStoreError); !ok {
+		t.Fatalf("restoring a missing id should fail with IDNotFoundStoreError")
+	}
+
+	s.DeleteEncryptedDataKeys(ctx, id("deleted"))
+	if err := s.PurgeEncryptedDataKeys(ctx, id("deleted")); err != nil {
+		t.Fatalf("failed to purge encrypted data keys: %s", err)
+	}
+
+	if storedKeys, err := s.GetEncryptedDataKeys(ctx, id("deleted")); err != nil || storedKeys != nil {
+		t.Fatalf("a purged id should read as missing, got: %v, %v", storedKeys, err)
+	}
+
+	if err := s.SetEncryptedDataKeysConditionally(ctx, id("deleted"), keys); err != nil {
+		t.Fatalf("a purged id should be set again: %s", err)
+	}
+
+	if err := s.PurgeEncryptedDataKeys(ctx, id("missing")); err != nil {
+		t.Fatalf("purging a missing id should not fail: %s", err)
+	}
+
+	//ListIDs pages, the deleted ids left out
+	for _, name := range []string{"e", "b", "d", "c"} {
+		if err := s.SetEncryptedDataKeysConditionally(ctx, id(name), keys); err != nil {
+			t.Fatalf("failed to set encrypted data keys: %s", err)
+		}
+	}
+	s.DeleteEncryptedDataKeys(ctx, id("deleted"))
+
+	listed := map[string]int{}
+	for cursor, pages := "", 0; ; pages++ {
+		if pages > 10000 {
+			t.Fatalf("ListIDs should have reached its last page")
+		}
+
+		page, next, err := s.ListIDs(ctx, cursor, 2)
+		if err != nil {
+			t.Fatalf("failed to list ids: %s", err)
+		}
+
+		if len(page) > 2 {
+			t.Fatalf("a page should hold up to limit ids, got: %v", page)
+		}
+
+		for _, listedID := range page {
+			if strings.HasPrefix(listedID, prefix) {
+				listed[listedID]++
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	names := []string{}
+	for listedID, count := range listed {
+		if count != 1 {
+			t.Fatalf("%s should have been listed once, was listed %d times", listedID, count)
+		}
+		names = append(names, strings.TrimPrefix(listedID, prefix))
+	}
+	sort.Strings(names)
+
+	if !reflect.DeepEqual(names, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("the pages should list every live id once, got: %v", names)
+	}
+
+	//batch reads, the deleted and missing ids left out
+	if batchStore, ok := s.(BatchStore); ok {
+		batch, err := batchStore.GetEncryptedDataKeysBatch(ctx, []string{id("a"), id("b"), id("deleted"), id("missing")})
+		if err != nil {
+			t.Fatalf("failed to batch get encrypted data keys: %s", err)
+		}
+
+		expected := map[string]map[string]string{id("a"): rewrapped, id("b"): keys}
+		if !reflect.DeepEqual(batch, expected) {
+			t.Fatalf("deleted and missing ids should have been left out of the batch, got: %v", batch)
+		}
+	}
+}
+
+// testStoreEnv returns the environment variable naming the test server of a network store, skipping the test when
+// it is not set
+func testStoreEnv(t *testing.T, name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		t.Skipf("%s is not set", name)
+	}
+
+	return value
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testStoreConformance(t, NewMemoryStore())
+}
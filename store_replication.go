@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// MaxNumberOfReplicationTries is the number of attempts to mirror an id updated concurrently in the target store
+const MaxNumberOfReplicationTries = 3
+
+// replicationResult counts what a replication pass did to the target store
+type replicationResult struct {
+	Created int
+	Updated int
+	Deleted int
+	Failed  int
+}
+
+// newReplicationTarget creates the store the encrypted data keys are mirrored to, out of the store settings of the
+// configuration file of the given path, e.g. a DynamoDB table of another region or account
+func newReplicationTarget(path string) (Store, error) {
+	config, err := loadReplicationTargetConfiguration(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(config)
+}
+
+// loadReplicationTargetConfiguration loads the configuration file of the target store, only its store settings
+// being validated
+func loadReplicationTargetConfiguration(path string) (*Configuration, error) {
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]string, 0)
+	config.validateStore(func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	})
+	if len(problems) > 0 {
+		return nil, ConfigurationError{problems}
+	}
+	return config, nil
+}
+
+// replicateStore mirrors the encrypted data keys of every id of source into target, the ids missing from target being
+// created, the ids differing updated and the ids target has but source doesn't, deleted or purged, deleted. The ids
+// that fail to be mirrored are counted as failed, for the next pass to mirror them.
+func replicateStore(ctx context.Context, source Store, target Store) (replicationResult, error) {
+	var result replicationResult
+	listed := make(map[string]bool)
+	cursor := ""
+	for {
+		ids, next, err := source.ListIDs(ctx, cursor, DefaultListIDsLimit)
+		if err != nil {
+			logger.Errorf("failed to list the ids to replicate: %s", err)
+			return result, err
+		}
+
+		sourceKeys, err := getEncryptedDataKeysBatch(ctx, source, ids)
+		if err != nil {
+			logger.Errorf("failed to read the ids to replicate: %s", err)
+			return result, err
+		}
+		targetKeys, err := getEncryptedDataKeysBatch(ctx, target, ids)
+		if err != nil {
+			logger.Errorf("failed to read the replicated ids: %s", err)
+			return result, err
+		}
+
+		for _, id := range ids {
+			listed[id] = true
+			encryptedDataKeys, ok := sourceKeys[id]
+			if !ok || reflect.DeepEqual(encryptedDataKeys, targetKeys[id]) {
+				continue
+			}
+
+			created, err := mirrorID(ctx, target, id, encryptedDataKeys)
+			if err != nil {
+				if ctx.Err() != nil {
+					return result, err
+				}
+
+				logger.WithField("id", id).Errorf("failed to replicate the id: %s", err)
+				storeReplicatedIDsTotal.inc("failed")
+				result.Failed++
+				continue
+			}
+
+			if created {
+				storeReplicatedIDsTotal.inc("create")
+				result.Created++
+			} else {
+				storeReplicatedIDsTotal.inc("update")
+				result.Updated++
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	deleted, failed, err := deleteUnlistedIDs(ctx, source, target, listed)
+	result.Deleted, result.Failed = deleted, result.Failed+failed
+	return result, err
+}
+
+// mirrorID saves the encrypted data keys of id in target, telling if the id was created rather than updated.
+// A deleted id is restored to be updated.
+func mirrorID(ctx context.Context, target Store, id string, encryptedDataKeys map[string]string) (bool, error) {
+	var err error
+	for i := 0; i < MaxNumberOfReplicationTries; i++ {
+		var existing map[string]string
+		var version int64
+		existing, version, err = target.GetVersionedEncryptedDataKeys(ctx, id)
+		if _, ok := err.(IDDeletedStoreError); ok {
+			if err = target.RestoreEncryptedDataKeys(ctx, id); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if existing == nil {
+			err = target.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
+			if _, ok := err.(IDAlreadyExistsStoreError); ok {
+				continue
+			}
+			return err == nil, err
+		}
+
+		err = target.UpdateEncryptedDataKeys(ctx, id, encryptedDataKeys, version)
+		if _, ok := err.(VersionMismatchStoreError); ok {
+			continue
+		}
+		return false, err
+	}
+
+	return false, err
+}
+
+// deleteUnlistedIDs deletes the ids of target that weren't listed in source, once source confirms they are deleted or
+// purged, rather than created since they were listed
+func deleteUnlistedIDs(ctx context.Context, source Store, target Store, listed map[string]bool) (int, int, error) {
+	deleted, failed := 0, 0
+	cursor := ""
+	for {
+		ids, next, err := target.ListIDs(ctx, cursor, DefaultListIDsLimit)
+		if err != nil {
+			logger.Errorf("failed to list the replicated ids: %s", err)
+			return deleted, failed, err
+		}
+
+		for _, id := range ids {
+			if listed[id] {
+				continue
+			}
+
+			encryptedDataKeys, err := source.GetEncryptedDataKeys(ctx, id)
+			if _, ok := err.(IDDeletedStoreError); !ok && (err != nil || encryptedDataKeys != nil) {
+				//created since it was listed, or unreadable: left for the next pass
+				continue
+			}
+
+			if err := target.DeleteEncryptedDataKeys(ctx, id); err != nil {
+				if ctx.Err() != nil {
+					return deleted, failed, err
+				}
+
+				logger.WithField("id", id).Errorf("failed to delete the replicated id: %s", err)
+				storeReplicatedIDsTotal.inc("failed")
+				failed++
+				continue
+			}
+			storeReplicatedIDsTotal.inc("delete")
+			deleted++
+		}
+
+		if next == "" {
+			return deleted, failed, nil
+		}
+		cursor = next
+	}
+}
+
+// runStoreReplication mirrors source into target every interval, until ctx is done
+func runStoreReplication(ctx context.Context, source Store, target Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		started := time.Now()
+		result, err := replicateStore(ctx, source, target)
+		storeReplicationDuration.observe(time.Since(started).Seconds())
+		if err == nil && result != (replicationResult{}) {
+			logger.Infof("replicated the store: %d ids created, %d updated, %d deleted, %d failed", result.Created, result.Updated, result.Deleted, result.Failed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestReplicateStore(t *testing.T) {
+	ctx := context.Background()
+	source, target := NewMemoryStore(), NewMemoryStore()
+	for _, id := range []string{"created", "updated", "unchanged", "deleted", "restored"} {
+		if err := source.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id}); err != nil {
+			t.Fatalf("failed to set the id: %s", err)
+		}
+	}
+	for _, id := range []string{"updated", "unchanged", "deleted", "restored", "purged"} {
+		if err := target.SetEncryptedDataKeysConditionally(ctx, id, map[string]string{"region-0": id}); err != nil {
+			t.Fatalf("failed to set the id: %s", err)
+		}
+	}
+	if err := source.UpdateEncryptedDataKeys(ctx, "updated", map[string]string{"region-0": "rotated"}, 0); err != nil {
+		t.Fatalf("failed to update the id: %s", err)
+	}
+	if err := source.DeleteEncryptedDataKeys(ctx, "deleted"); err != nil {
+		t.Fatalf("failed to delete the id: %s", err)
+	}
+	if err := target.DeleteEncryptedDataKeys(ctx, "restored"); err != nil {
+		t.Fatalf("failed to delete the id: %s", err)
+	}
+
+	result, err := replicateStore(ctx, source, target)
+	if err != nil || result != (replicationResult{Created: 1, Updated: 2, Deleted: 2}) {
+		t.Fatalf("the target should have been mirrored, got %+v: %v", result, err)
+	}
+
+	for _, id := range []string{"created", "updated", "unchanged", "restored"} {
+		expected, _ := source.GetEncryptedDataKeys(ctx, id)
+		if keys, err := target.GetEncryptedDataKeys(ctx, id); err != nil || !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("%s should have been mirrored, got %v: %v", id, keys, err)
+		}
+	}
+	for _, id := range []string{"deleted", "purged"} {
+		if _, err := target.GetEncryptedDataKeys(ctx, id); err == nil {
+			t.Fatalf("%s should have been deleted from the target", id)
+		}
+	}
+
+	if result, err := replicateStore(ctx, source, target); err != nil || result != (replicationResult{}) {
+		t.Fatalf("a second pass should have had nothing to mirror, got %+v: %v", result, err)
+	}
+}
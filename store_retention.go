@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// purgeDeletedEncryptedDataKeys permanently removes the encrypted data keys of every id
+// that has been deleted for longer than the retention window
+func purgeDeletedEncryptedDataKeys(ctx context.Context, store Store, retention time.Duration) (int, error) {
+	ids, err := store.ListDeletedIDs(ctx, time.Now().Add(-retention))
+	if err != nil {
+		logger.Errorf("failed to list deleted ids: %s", err)
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		if err := store.PurgeEncryptedDataKeys(ctx, id); err != nil {
+			logger.Errorf("failed to purge deleted id %q: %s", id, err)
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// runDeletedEncryptedDataKeysPurger purges the ids deleted for longer than the retention window
+// every interval, until ctx is done
+func runDeletedEncryptedDataKeysPurger(ctx context.Context, store Store, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := purgeDeletedEncryptedDataKeys(ctx, store, retention)
+		if err == nil && purged > 0 {
+			logger.Infof("purged %d deleted ids", purged)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deleteScheduledKeys deletes the data keys of every id whose scheduled deletion is due at now, leaving their
+// encrypted data keys in the store as deleted until they are purged
+func deleteScheduledKeys(ctx context.Context, store Store, now time.Time) (int, error) {
+	deleted := 0
+	cursor := ""
+	for {
+		ids, next, err := store.ListIDs(ctx, cursor, DefaultListIDsLimit)
+		if err != nil {
+			logger.Errorf("failed to list ids: %s", err)
+			return deleted, err
+		}
+
+		keys, err := getEncryptedDataKeysBatch(ctx, store, ids)
+		if err != nil {
+			logger.Errorf("failed to read the ids pending deletion: %s", err)
+			return deleted, err
+		}
+
+		for _, id := range ids {
+			if encryptedDataKeys, ok := keys[id]; !ok || !deletionDue(id, encryptedDataKeys, now) {
+				continue
+			}
+
+			//read again right before the deletion, for a deletion cancelled since not to be applied
+			current, _, err := store.GetVersionedEncryptedDataKeys(ctx, id)
+			if err != nil || current == nil || !deletionDue(id, current, now) {
+				continue
+			}
+
+			if err := store.DeleteEncryptedDataKeys(ctx, id); err != nil {
+				logger.Errorf("failed to delete id %q pending deletion: %s", id, err)
+				return deleted, err
+			}
+			logger.WithField("id", id).Info("deleted the data key whose deletion was scheduled")
+			deleted++
+		}
+
+		if next == "" {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// runScheduledKeyDeletions deletes the data keys whose scheduled deletion is due every interval, until ctx is done
+func runScheduledKeyDeletions(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := deleteScheduledKeys(ctx, store, time.Now())
+		if err == nil && deleted > 0 {
+			logger.Infof("deleted %d ids pending deletion", deleted)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+type nopStore struct {
+	Store
+}
+
+func TestNewStoreUsesRegisteredFactory(t *testing.T) {
+	RegisterStore("nop-test", func(config *Configuration) (Store, error) {
+		return &nopStore{}, nil
+	})
+	defer delete(storeFactories, "nop-test")
+
+	config := &Configuration{Store: StoreConfig{Type: "nop-test"}}
+	store, err := NewStore(config)
+	if err != nil {
+		t.Fatalf("failed to create registered store: %s", err)
+	}
+
+	if _, ok := store.(*nopStore); !ok {
+		t.Fatalf("store has the wrong type: %T", store)
+	}
+}
+
+func TestNewStoreUnknownType(t *testing.T) {
+	config := &Configuration{Store: StoreConfig{Type: "does-not-exist"}}
+	if _, err := NewStore(config); err == nil {
+		t.Fatalf("should not have created a store for an unknown type")
+	}
+}
+
+func TestDynamoDBStoreIsRegistered(t *testing.T) {
+	found := false
+	for _, storeType := range RegisteredStoreTypes() {
+		if storeType == DefaultStoreType {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("%s store should be registered by default", DefaultStoreType)
+	}
+}
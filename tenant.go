@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TenantNamespaceSeparator separates the name of a tenant from the rest of the ids of its namespace
+const TenantNamespaceSeparator = "/"
+
+// inTenantNamespace tells if id is in the namespace of tenant, "<tenant>/..."
+func inTenantNamespace(tenant string, id string) bool {
+	return strings.HasPrefix(id, tenant+TenantNamespaceSeparator) && len(id) > len(tenant)+len(TenantNamespaceSeparator)
+}
+
+// assignTenants maps the identities of the tenants to their tenant, an identity belonging to one tenant at most
+func (a *Authenticator) assignTenants(tenants []TenantConfig) error {
+	a.tenants = make(map[string]string)
+	names := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		if tenant.Name == "" || strings.Contains(tenant.Name, TenantNamespaceSeparator) {
+			return fmt.Errorf("the name of tenant %q must be set, without %q", tenant.Name, TenantNamespaceSeparator)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenant %q is configured twice", tenant.Name)
+		}
+		names[tenant.Name] = true
+
+		for _, identity := range tenant.Identities {
+			if other, ok := a.tenants[identity]; ok {
+				return fmt.Errorf("%q belongs to tenants %q and %q", identity, other, tenant.Name)
+			}
+			a.tenants[identity] = tenant.Name
+		}
+	}
+	return nil
+}
+
+// NewTenantAuthenticator is NewAuthenticator for a deployment serving the given tenants, which requires the API
+// to be authenticated for the callers to be mapped to their tenant
+func NewTenantAuthenticator(config AuthConfig, tenants []TenantConfig) (*Authenticator, error) {
+	a, err := NewAuthenticator(config)
+	if err != nil || len(tenants) == 0 {
+		return a, err
+	}
+
+	if a == nil {
+		return nil, errors.New("tenants require the API to be authenticated")
+	}
+	return a, a.assignTenants(tenants)
+}
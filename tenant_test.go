@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func getTestTenantAuthenticator(t *testing.T) *Authenticator {
+	a, err := NewTenantAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{{Identity: "billing", KeySHA256: apiKeySHA256("secret")}},
+		Permissions: []PermissionConfig{
+			{Identity: "billing", Operations: []string{OperationAll}},
+			{Identity: "admin", Operations: []string{OperationAll}},
+		},
+	}, []TenantConfig{
+		{Name: "team-a", Identities: []string{"billing"}, RequestsPerSecond: 1, Burst: 2},
+		{Name: "team-b", Identities: []string{"payments", "refunds"}},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+	return a
+}
+
+func TestNewTenantAuthenticator(t *testing.T) {
+	tenants := []TenantConfig{{Name: "team-a", Identities: []string{"billing"}}}
+	if _, err := NewTenantAuthenticator(AuthConfig{}, tenants); err == nil {
+		t.Fatalf("tenants should require the API to be authenticated")
+	}
+
+	config := AuthConfig{APIKeys: []APIKeyConfig{{Identity: "billing", KeySHA256: apiKeySHA256("secret")}}}
+	if _, err := NewTenantAuthenticator(config, append(tenants, TenantConfig{Name: "team-b", Identities: []string{"billing"}})); err == nil {
+		t.Fatalf("an identity shouldn't belong to two tenants")
+	}
+
+	if _, err := NewTenantAuthenticator(config, []TenantConfig{{Name: "team/a"}}); err == nil {
+		t.Fatalf("a tenant name with the namespace separator should have been rejected")
+	}
+}
+
+func TestTenantNamespaceIsolation(t *testing.T) {
+	beforeTest()
+	r := getRKMS([]bool{true, true, true})
+	r.store = NewMemoryStore()
+	a := getTestTenantAuthenticator(t)
+	teamA := withCaller(context.Background(), a, "billing", OperationGetKeys)
+
+	if tenantFromContext(teamA) != "team-a" || contextLogger(teamA).Data["tenant"] != "team-a" {
+		t.Fatalf("billing should have been mapped to team-a")
+	}
+
+	if _, err := r.GetDataKey(teamA, "team-a/user-1", 0, nil); err != nil {
+		t.Fatalf("team-a should have been able to create a key of its namespace: %s", err)
+	}
+
+	for _, id := range []string{"team-b/user-1", "user-1", "team-a", "team-ab/user-1"} {
+		if _, err := r.GetDataKey(teamA, id, 0, nil); err == nil {
+			t.Fatalf("team-a shouldn't have been able to create %s, out of its namespace", id)
+		}
+	}
+
+	admin := withCaller(context.Background(), a, "admin", OperationGetKeys)
+	if _, err := r.GetDataKey(admin, "team-b/user-1", 0, nil); err != nil {
+		t.Fatalf("an identity of no tenant should only be restricted by its permissions: %s", err)
+	}
+
+	if _, err := r.GetDataKey(teamA, "team-b/user-1", 0, nil); err == nil {
+		t.Fatalf("team-a shouldn't have been able to read an existing key of team-b")
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	l, err := NewRateLimiter(RateLimitConfig{}, []TenantConfig{{Name: "team-a", RequestsPerSecond: 1, Burst: 2}, {Name: "team-b"}})
+	if err != nil {
+		t.Fatalf("was not able to create the rate limiter: %s", err)
+	}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := l.allowTenant("team-a", now); !allowed {
+			t.Fatalf("the burst of team-a should have been allowed")
+		}
+	}
+	if allowed, retryAfter := l.allowTenant("team-a", now); allowed || retryAfter != time.Second {
+		t.Fatalf("team-a should have been over its quota, got %t, %s", allowed, retryAfter)
+	}
+
+	if allowed, _ := l.allow("billing", "10.0.0.1", now); !allowed {
+		t.Fatalf("the identities shouldn't be rate limited without a rate")
+	}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := l.allowTenant("team-b", now); !allowed {
+			t.Fatalf("team-b has no quota")
+		}
+	}
+}
@@ -10,4 +10,9 @@ resource "aws_dynamodb_table" "rkms_keys" {
     name = "id"
     type = "S"
   }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
 }
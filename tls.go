@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// newClientTLSConfig builds the tls.Config used to connect to a backend.
+// nil is returned when TLS is not enabled.
+func newClientTLSConfig(config TLSClientConfig) (*tls.Config, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate could be parsed from %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// serverCertificates - the certificate of the server and the CAs of its clients, read again from their files
+// when they change
+type serverCertificates struct {
+	config TLSServerConfig
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+// newServerTLSConfig builds the tls.Config of the HTTP API, along with the certificates it reads,
+// to be reloaded by runCertificateReloads. nil is returned when TLS is not enabled.
+func newServerTLSConfig(config TLSServerConfig) (*tls.Config, *serverCertificates, error) {
+	if config.CertFile == "" {
+		return nil, nil, nil
+	}
+
+	certificates := &serverCertificates{config: config}
+	if _, err := certificates.reload(); err != nil {
+		return nil, nil, err
+	}
+
+	allowed := make(map[string]bool, len(config.AllowedClientCommonNames))
+	for _, commonName := range config.AllowedClientCommonNames {
+		allowed[commonName] = true
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.ClientCAFile != "" {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(allowed) > 0 {
+		base.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !allowed[state.PeerCertificates[0].Subject.CommonName] {
+				return fmt.Errorf("the client certificate has no allowed common name")
+			}
+			return nil
+		}
+	}
+
+	tlsConfig := base.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		certificates.mutex.RLock()
+		defer certificates.mutex.RUnlock()
+
+		clientConfig := base.Clone()
+		clientConfig.Certificates = []tls.Certificate{*certificates.certificate}
+		clientConfig.ClientCAs = certificates.clientCAs
+		return clientConfig, nil
+	}
+	return tlsConfig, certificates, nil
+}
+
+// reload reads the files again if any of them changed since they were last read, telling if they did.
+// The certificates in use are kept when the new files can't be read.
+func (c *serverCertificates) reload() (bool, error) {
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCAFile != "" {
+		files = append(files, c.config.ClientCAFile)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	changed := false
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(c.modTimes[file])
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificate could be parsed from %s", c.config.ClientCAFile)
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.certificate, c.clientCAs, c.modTimes = &certificate, clientCAs, modTimes
+	return true, nil
+}
+
+// runCertificateReloads reloads the certificates every interval, until ctx is done
+func runCertificateReloads(ctx context.Context, certificates *serverCertificates, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if reloaded, err := certificates.reload(); err != nil {
+			logger.Errorf("failed to reload the TLS certificates, keeping the current ones: %s", err)
+		} else if reloaded {
+			logger.Infoln("reloaded the TLS certificates")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate issues a certificate for commonName, signed by parent or self-signed for a nil parent
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("was not able to generate a key: %s", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("was not able to create a certificate: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(c.pem, c.keyPEM)
+	if err != nil {
+		t.Fatalf("was not able to load the certificate: %s", err)
+	}
+	return certificate
+}
+
+func writeTestFile(t *testing.T, path string, b []byte) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("was not able to write %s: %s", path, err)
+	}
+}
+
+// serveTestTLS serves an empty response over TLS with the given config, returning the address of the server
+func serveTestTLS(t *testing.T, tlsConfig *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("was not able to listen: %s", err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func getTestTLS(address string, ca *testCertificate, clientCertificates ...tls.Certificate) error {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: clientCertificates}}}
+
+	resp, err := client.Get("https://" + address)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "rkms", ca)
+	config := TLSServerConfig{
+		CertFile:                 filepath.Join(dir, "server.pem"),
+		KeyFile:                  filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:             filepath.Join(dir, "ca.pem"),
+		AllowedClientCommonNames: []string{"billing"},
+	}
+	writeTestFile(t, config.CertFile, server.pem)
+	writeTestFile(t, config.KeyFile, server.keyPEM)
+	writeTestFile(t, config.ClientCAFile, ca.pem)
+
+	tlsConfig, _, err := newServerTLSConfig(config)
+	if err != nil {
+		t.Fatalf("was not able to build the TLS config: %s", err)
+	}
+	address := serveTestTLS(t, tlsConfig)
+
+	if err := getTestTLS(address, ca, newTestCertificate(t, "billing", ca).tlsCertificate(t)); err != nil {
+		t.Fatalf("an allowed client should have been served: %s", err)
+	}
+
+	if err := getTestTLS(address, ca, newTestCertificate(t, "payments", ca).tlsCertificate(t)); err == nil {
+		t.Fatalf("a client with another common name shouldn't have been served")
+	}
+
+	if err := getTestTLS(address, ca); err == nil {
+		t.Fatalf("a client without a certificate shouldn't have been served")
+	}
+
+	otherCA := newTestCertificate(t, "other-ca", nil)
+	if err := getTestTLS(address, ca, newTestCertificate(t, "billing", otherCA).tlsCertificate(t)); err == nil {
+		t.Fatalf("a client certificate signed by another CA shouldn't have been accepted")
+	}
+}
+
+func TestServerCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	config := TLSServerConfig{CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server-key.pem")}
+	server := newTestCertificate(t, "rkms", ca)
+	writeTestFile(t, config.CertFile, server.pem)
+	writeTestFile(t, config.KeyFile, server.keyPEM)
+
+	tlsConfig, certificates, err := newServerTLSConfig(config)
+	if err != nil {
+		t.Fatalf("was not able to build the TLS config: %s", err)
+	}
+	address := serveTestTLS(t, tlsConfig)
+
+	if reloaded, err := certificates.reload(); reloaded || err != nil {
+		t.Fatalf("unchanged files shouldn't have been reloaded: %t, %v", reloaded, err)
+	}
+
+	otherCA := newTestCertificate(t, "other-ca", nil)
+	renewed := newTestCertificate(t, "rkms", otherCA)
+	writeTestFile(t, config.CertFile, renewed.pem)
+	writeTestFile(t, config.KeyFile, renewed.keyPEM)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(config.CertFile, later, later)
+
+	if reloaded, err := certificates.reload(); !reloaded || err != nil {
+		t.Fatalf("the renewed certificate should have been reloaded: %t, %v", reloaded, err)
+	}
+
+	if err := getTestTLS(address, otherCA); err != nil {
+		t.Fatalf("the renewed certificate should have been served: %s", err)
+	}
+
+	writeTestFile(t, config.KeyFile, []byte("not a key"))
+	os.Chtimes(config.KeyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := certificates.reload(); err == nil {
+		t.Fatalf("reloading an invalid key should have failed")
+	}
+
+	if err := getTestTLS(address, otherCA); err != nil {
+		t.Fatalf("the current certificate should have been kept: %s", err)
+	}
+}
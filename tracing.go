@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+)
+
+// spanAttribute - a string attribute of a tracing span, e.g. the region of a KMS call
+type spanAttribute struct {
+	key   string
+	value string
+}
+
+// the attribute keys of the spans
+const (
+	spanAttributeID        = "rkms.id"
+	spanAttributeRegion    = "rkms.region"
+	spanAttributeOperation = "rkms.operation"
+)
+
+// startKeyProviderSpan starts the span of a call to the key provider of a region
+func startKeyProviderSpan(ctx context.Context, region string, operation string) (context.Context, func(error)) {
+	return startSpan(ctx, "kms."+operation,
+		spanAttribute{spanAttributeRegion, region}, spanAttribute{spanAttributeOperation, operation})
+}
+
+// startStoreSpan starts the span of a read or a write of the store for an id
+func startStoreSpan(ctx context.Context, operation string, id string) (context.Context, func(error)) {
+	return startSpan(ctx, "store."+operation,
+		spanAttribute{spanAttributeOperation, operation}, spanAttribute{spanAttributeID, id})
+}
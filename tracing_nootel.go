@@ -0,0 +1,28 @@
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// setupTracing fails when an OTLP endpoint is configured, as tracing is only compiled in with the otel build tag
+func setupTracing(config TracingConfig) (func(context.Context) error, error) {
+	if config.Endpoint != "" {
+		return nil, fmt.Errorf("tracing.endpoint is set but rkms was built without OpenTelemetry support, rebuild it with -tags otel")
+	}
+	return func(context.Context) error { return nil }, nil
+}
+
+// startSpan doesn't trace anything without the otel build tag
+func startSpan(ctx context.Context, name string, attributes ...spanAttribute) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+// startHTTPSpan doesn't trace anything without the otel build tag
+func startHTTPSpan(r *http.Request, endpoint string) (*http.Request, func(status int)) {
+	return r, func(int) {}
+}
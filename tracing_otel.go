@@ -0,0 +1,86 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of rkms, through the tracer provider set by setupTracing
+var tracer = otel.Tracer("github.com/JEEN/rkms")
+
+// setupTracing exports the spans to the configured OTLP/gRPC endpoint, sampling the traces started by rkms
+// with the configured ratio and following the sampling decision of the incoming W3C traceparent headers.
+// Nothing is exported when no endpoint is configured. The returned function flushes the pending spans.
+func setupTracing(config TracingConfig) (func(context.Context) error, error) {
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span as a child of the span of ctx, the returned function ending it with the error of the operation
+func startSpan(ctx context.Context, name string, attributes ...spanAttribute) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(spanAttributes(attributes)...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// startHTTPSpan starts the server span of a request, continuing the trace of its traceparent header if any,
+// the returned function ending it with the status code of the response
+func startHTTPSpan(r *http.Request, endpoint string) (*http.Request, func(status int)) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.route", endpoint)))
+
+	return r.WithContext(ctx), func(status int) {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+func spanAttributes(attributes []spanAttribute) []attribute.KeyValue {
+	keyValues := make([]attribute.KeyValue, len(attributes))
+	for i, a := range attributes {
+		keyValues[i] = attribute.String(a.key, a.value)
+	}
+	return keyValues
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// peerCredentials - the process at the other end of a connection to the Unix domain socket, as told by the kernel
+type peerCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+type peerCredentialsContextKey struct{}
+
+// withPeerCredentials returns a copy of ctx carrying the peer credentials of the connection of its request, the uid
+// and the gid being logged as the peer_uid and peer_gid fields
+func withPeerCredentials(ctx context.Context, credentials *peerCredentials) context.Context {
+	ctx = withLogFields(ctx, logger.Fields{"peer_uid": credentials.UID, "peer_gid": credentials.GID})
+	return context.WithValue(ctx, peerCredentialsContextKey{}, credentials)
+}
+
+// peerCredentialsFromContext returns the peer credentials of the connection of the request of ctx, nil when it
+// didn't come through the Unix domain socket
+func peerCredentialsFromContext(ctx context.Context) *peerCredentials {
+	credentials, _ := ctx.Value(peerCredentialsContextKey{}).(*peerCredentials)
+	return credentials
+}
+
+// parseUnixSocketMode parses the octal file mode of the Unix domain socket
+func parseUnixSocketMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// listenUnixSocket listens on the Unix domain socket of config, given its file mode. The file left behind by a
+// previous run is removed, unless it isn't a socket; the listener removes it again when closed.
+func listenUnixSocket(config UnixSocketConfig) (net.Listener, error) {
+	mode, err := parseUnixSocketMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Lstat(config.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", config.Path)
+		}
+		if err := os.Remove(config.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(config.Path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// unixSocketConnContext gives the requests of a connection to the Unix domain socket its peer credentials, the
+// ConnContext of its server. The connections whose credentials can't be read carry none, and are only let through
+// by their API key or Authorization header.
+func unixSocketConnContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	credentials, err := connPeerCredentials(unixConn)
+	if err != nil {
+		logger.Debugf("failed to read the peer credentials of a connection to the Unix domain socket: %s", err)
+		return ctx
+	}
+	return withPeerCredentials(ctx, credentials)
+}
+
+// serveUnixSocket serves the HTTP API with handler on the Unix domain socket of config until ctx is done, see
+// serveUntilDone
+func serveUnixSocket(ctx context.Context, config UnixSocketConfig, handler http.Handler, shutdownTimeout time.Duration) error {
+	listener, err := listenUnixSocket(config)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("serving the API on the Unix domain socket %s", config.Path)
+	server := &http.Server{Handler: handler, ConnContext: unixSocketConnContext}
+	return serveUntilDone(ctx, server, listener, shutdownTimeout)
+}
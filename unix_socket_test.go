@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseUnixSocketMode(t *testing.T) {
+	if mode, err := parseUnixSocketMode("0660"); err != nil || mode != 0660 {
+		t.Fatalf("0660 should have been parsed, got %o, %v", mode, err)
+	}
+	for _, mode := range []string{"", "rw-rw----", "0999", "7777"} {
+		if _, err := parseUnixSocketMode(mode); err == nil {
+			t.Errorf("%q should have been rejected", mode)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rkms.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnixSocket(UnixSocketConfig{Path: path, Mode: "0660"}); err == nil {
+		t.Fatalf("a file which isn't a socket shouldn't have been removed")
+	}
+	os.Remove(path)
+
+	//the socket of a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnixSocket(UnixSocketConfig{Path: path, Mode: "0600"})
+	if err != nil {
+		t.Fatalf("the stale socket should have been replaced, got %s", err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the socket should have been given its mode, got %v", info.Mode())
+	}
+}
+
+func TestUnixSocketPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only read on Linux")
+	}
+
+	defer func() { authenticator = nil }()
+	uid := os.Getuid()
+	var err error
+	authenticator, err = NewAuthenticator(AuthConfig{
+		Peers:       []PeerConfig{{Identity: "sidecar", UID: &uid}},
+		Permissions: []PermissionConfig{{Identity: "sidecar", Operations: []string{OperationGetKeys}}},
+	})
+	if err != nil {
+		t.Fatalf("was not able to create the authenticator: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "rkms.sock")
+	listener, err := listenUnixSocket(UnixSocketConfig{Path: path, Mode: "0660"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{ConnContext: unixSocketConnContext, Handler: http.HandlerFunc(authorize(OperationGetKeys, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, identityFromContext(r.Context()))
+	}))}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	resp, err := client.Get("http://rkms/api/v1/key?id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "sidecar" {
+		t.Fatalf("the caller should have been authenticated by its uid, got %d: %s", resp.StatusCode, body)
+	}
+
+	other := uid + 1
+	authenticator.peers = []PeerConfig{{Identity: "sidecar", UID: &other}}
+	resp, err = client.Get("http://rkms/api/v1/key?id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("a caller of another uid shouldn't have been authenticated, got %d", resp.StatusCode)
+	}
+}
+
+func TestNewAuthenticatorPeers(t *testing.T) {
+	if _, err := NewAuthenticator(AuthConfig{Peers: []PeerConfig{{Identity: "sidecar"}}}); err == nil {
+		t.Fatalf("a peer without uid nor gid should have been rejected")
+	}
+
+	gid := 50
+	a, err := NewAuthenticator(AuthConfig{Peers: []PeerConfig{{Identity: "ops", GID: &gid}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, err := a.authenticatePeer(&peerCredentials{UID: 1001, GID: 50}); err != nil || identity != "ops" {
+		t.Fatalf("the caller should have been authenticated by its gid, got %q, %v", identity, err)
+	}
+	if _, err := a.authenticatePeer(&peerCredentials{UID: 1001, GID: 51}); err == nil {
+		t.Fatalf("a caller of another gid shouldn't have been authenticated")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// VaultTransitProvider - a KeyProvider wrapping data keys with a key of the HashiCorp Vault Transit secrets engine.
+// The key id is the name of the transit key, the region is only a name for it in the redundancy set.
+// Vault authenticates with the configured token or, when a role id is configured, with an AppRole login
+// that is renewed whenever Vault stops accepting its token.
+// The encryption context is sent as the associated data of the transit key, which needs an AEAD key type
+// (e.g. aes256-gcm96, the default).
+type VaultTransitProvider struct {
+	client  *http.Client
+	keyName string
+	config  VaultTransitConfig
+
+	mutex sync.Mutex
+	token string
+}
+
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Auth   *vaultAuth             `json:"auth"`
+	Errors []string               `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken string `json:"client_token"`
+}
+
+func init() {
+	RegisterKeyProvider("vault", func(region string, keyID string, kmsConfig KMSConfig) (KeyProvider, error) {
+		return NewVaultTransitProvider(keyID, kmsConfig.Vault)
+	})
+}
+
+// NewVaultTransitProvider creates a new VaultTransitProvider instance for the given transit key
+func NewVaultTransitProvider(keyName string, vaultConfig VaultTransitConfig) (*VaultTransitProvider, error) {
+	if vaultConfig.Token == "" && vaultConfig.RoleID == "" {
+		return nil, fmt.Errorf("either a token or an AppRole role id is required to authenticate with Vault")
+	}
+
+	tlsConfig, err := newClientTLSConfig(vaultConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+	return &VaultTransitProvider{client: client, keyName: keyName, config: vaultConfig, token: vaultConfig.Token}, nil
+}
+
+// GenerateDataKey creates a new data key of the given size.
+// Transit only generates keys of a few sizes, so it is generated locally and encrypted.
+func (p *VaultTransitProvider) GenerateDataKey(ctx context.Context, sizeInBytes int64, encryptionContext EncryptionContext) ([]byte, []byte, error) {
+	return generateDataKey(ctx, p, sizeInBytes, encryptionContext)
+}
+
+// Encrypt wraps the given data key with the latest version of the transit key.
+// The ciphertext is the one returned by Vault, e.g. vault:v1:...
+func (p *VaultTransitProvider) Encrypt(ctx context.Context, plaintext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	body := map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	setVaultAssociatedData(body, encryptionContext)
+	data, err := p.request(ctx, http.MethodPost, p.transitPath("encrypt"), body)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, ok := data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault returned no ciphertext for transit key %s", p.keyName)
+	}
+
+	return []byte(ciphertext), nil
+}
+
+// Decrypt unwraps the given data key. The key version is found in the ciphertext by Vault.
+func (p *VaultTransitProvider) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error) {
+	body := map[string]interface{}{"ciphertext": string(ciphertext)}
+	setVaultAssociatedData(body, encryptionContext)
+	data, err := p.request(ctx, http.MethodPost, p.transitPath("decrypt"), body)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault returned no plaintext for transit key %s", p.keyName)
+	}
+
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func setVaultAssociatedData(body map[string]interface{}, encryptionContext EncryptionContext) {
+	if aad := encryptionContext.AAD(); aad != nil {
+		body["associated_data"] = base64.StdEncoding.EncodeToString(aad)
+	}
+}
+
+// DescribeKey tells about the transit key, which is enabled as long as it supports encryption
+func (p *VaultTransitProvider) DescribeKey(ctx context.Context) (*KeyDescription, error) {
+	data, err := p.request(ctx, http.MethodGet, p.transitPath("keys"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, _ := data["supports_encryption"].(bool)
+	return &KeyDescription{ID: p.config.Mount + "/" + p.keyName, Enabled: enabled}, nil
+}
+
+// ProviderType is the type the provider is registered as
+func (p *VaultTransitProvider) ProviderType() string {
+	return "vault"
+}
+
+// WrappingAlgorithm is the algorithm the transit key wraps with, its key type deciding the cipher
+func (p *VaultTransitProvider) WrappingAlgorithm() string {
+	return "VAULT_TRANSIT"
+}
+
+func (p *VaultTransitProvider) transitPath(operation string) string {
+	return "/v1/" + p.config.Mount + "/" + operation + "/" + p.keyName
+}
+
+// request sends an authenticated request to Vault and returns the data of its response.
+// With AppRole, a rejected token is renewed with a new login and the request sent once more.
+func (p *VaultTransitProvider) request(ctx context.Context, method string, path string, body interface{}) (map[string]interface{}, error) {
+	token, err := p.getToken(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	status, response, err := p.send(ctx, method, path, token, body)
+	if err == nil && status == http.StatusForbidden && p.config.RoleID != "" {
+		if token, err = p.getToken(ctx, token); err != nil {
+			return nil, err
+		}
+		status, response, err = p.send(ctx, method, path, token, body)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("Vault answered %d to %s %s: %s", status, method, path, strings.Join(response.Errors, ", "))
+	}
+
+	return response.Data, nil
+}
+
+// getToken returns the token to authenticate with, logging in with AppRole if there is none
+// or if the token is the rejected one
+func (p *VaultTransitProvider) getToken(ctx context.Context, rejected string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.token != "" && p.token != rejected {
+		return p.token, nil
+	}
+
+	body := map[string]interface{}{"role_id": p.config.RoleID, "secret_id": p.config.SecretID}
+	status, response, err := p.send(ctx, http.MethodPost, "/v1/auth/"+p.config.AppRoleMount+"/login", "", body)
+	if err != nil {
+		return "", err
+	}
+
+	if status != http.StatusOK || response.Auth == nil {
+		return "", fmt.Errorf("Vault AppRole login failed with %d: %s", status, strings.Join(response.Errors, ", "))
+	}
+
+	p.token = response.Auth.ClientToken
+	return p.token, nil
+}
+
+func (p *VaultTransitProvider) send(ctx context.Context, method string, path string, token string, body interface{}) (int, *vaultResponse, error) {
+	var requestBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&requestBody).Encode(body); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	request, err := http.NewRequest(method, strings.TrimSuffix(p.config.Address, "/")+path, &requestBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	request = request.WithContext(ctx)
+
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	if p.config.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+
+	vaultResponse := &vaultResponse{}
+	if err := json.NewDecoder(response.Body).Decode(vaultResponse); err != nil {
+		return 0, nil, fmt.Errorf("failed to read the response of Vault to %s %s (%d): %s", method, path, response.StatusCode, err)
+	}
+
+	return response.StatusCode, vaultResponse, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestVaultServer serves an AppRole login and a transit engine that "encrypts" by prefixing
+// the plaintext. Tokens are rejected once expireTokens() has been called.
+func newTestVaultServer() (*httptest.Server, *int, func()) {
+	logins := 0
+	validToken := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid role or secret id"]}`))
+				return
+			}
+			logins++
+			validToken = fmt.Sprintf("token-%d", logins)
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": validToken}})
+			return
+		}
+
+		if r.Header.Get("X-Vault-Token") != validToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/rkms":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]}})
+		case "/v1/transit/decrypt/rkms":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": body["ciphertext"][len("vault:v1:"):]}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+
+	return server, &logins, func() { validToken = "expired" }
+}
+
+func TestVaultTransitProviderRenewsAppRoleLogin(t *testing.T) {
+	server, logins, expireTokens := newTestVaultServer()
+	defer server.Close()
+
+	p, err := NewVaultTransitProvider("rkms", VaultTransitConfig{Address: server.URL, Mount: "transit", RoleID: "role", SecretID: "secret", AppRoleMount: "approle"})
+	if err != nil {
+		t.Fatalf("failed to create Vault provider: %s", err)
+	}
+
+	ctx := context.Background()
+	plaintext, ciphertext, err := p.GenerateDataKey(ctx, 32, nil)
+	if err != nil || len(plaintext) != 32 {
+		t.Fatalf("failed to generate a data key: %v", err)
+	}
+
+	expireTokens()
+	decrypted, err := p.Decrypt(ctx, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt after the token expired: %s", err)
+	}
+
+	if string(decrypted) != string(plaintext) {
+		t.Fatalf("decrypted data key is wrong")
+	}
+
+	if *logins != 2 {
+		t.Fatalf("a rejected token should have been renewed with one more login, got %d logins", *logins)
+	}
+}
+
+func TestVaultTransitProviderRequiresCredentials(t *testing.T) {
+	if _, err := NewVaultTransitProvider("rkms", VaultTransitConfig{Address: "http://localhost:8200"}); err == nil {
+		t.Fatalf("should not have created a Vault provider without credentials")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// vsockAddr - the address of an AF_VSOCK socket, the context id (CID) of its virtual machine or Nitro Enclave and
+// its port; its string is CID:port, for the callers to be rate limited by CID
+type vsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+var _ net.Addr = vsockAddr{}
@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener - accepts the connections to an AF_VSOCK port, e.g. of the Nitro Enclaves of the instance, which
+// the net package doesn't know of. Its socket and those of its connections are non-blocking files, waited on by the
+// poller of the runtime like the sockets of the net package.
+type vsockListener struct {
+	file *os.File
+	addr vsockAddr
+}
+
+// listenVsock listens on the given AF_VSOCK port of every CID of the host
+func listenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return &vsockListener{file: os.NewFile(uintptr(fd), "vsock"), addr: vsockAddr{CID: unix.VMADDR_CID_ANY, Port: port}}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rawConn, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var fd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	if err := rawConn.Read(func(listenerFD uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(listenerFD), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept4", acceptErr)
+	}
+
+	conn := &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), local: l.addr}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		conn.remote = vsockAddr{CID: vm.CID, Port: vm.Port}
+	}
+	if local, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := local.(*unix.SockaddrVM); ok {
+			conn.local = vsockAddr{CID: vm.CID, Port: vm.Port}
+		}
+	}
+	return conn, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn - a connection accepted by a vsockListener
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// vmaddrCIDLocal is VMADDR_CID_LOCAL, the CID looping back to the host
+const vmaddrCIDLocal = 1
+
+func TestVsockListener(t *testing.T) {
+	listener, err := listenVsock(52000)
+	if err != nil {
+		t.Skipf("can't listen on a vsock port here: %s", err)
+	}
+	defer listener.Close()
+
+	//the local CID loops back to the host, when the vsock_loopback module is loaded
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: vmaddrCIDLocal, Port: 52000}); err != nil {
+		unix.Close(fd)
+		t.Skipf("can't connect to the local CID here: %s", err)
+	}
+	client := os.NewFile(uintptr(fd), "vsock")
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("the connection should have been accepted, got %s", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().Network() != "vsock" || conn.RemoteAddr().(vsockAddr).CID != vmaddrCIDLocal || remoteIP(conn.RemoteAddr().String()) != "1" {
+		t.Fatalf("the peer should have been the local CID, got %s", conn.RemoteAddr())
+	}
+
+	client.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("the bytes of the client should have been read, got %q: %v", b, err)
+	}
+}
+
+func TestVsockAddr(t *testing.T) {
+	addr := vsockAddr{CID: 16, Port: 5000}
+	if addr.Network() != "vsock" || addr.String() != "16:5000" || remoteIP(addr.String()) != "16" {
+		t.Fatalf("the enclaves should have been told apart by CID, got %s", addr)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenVsock fails, AF_VSOCK sockets only being supported on Linux
+func listenVsock(port uint32) (net.Listener, error) {
+	return nil, errors.New("vsock is only supported on Linux")
+}
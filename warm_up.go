@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// warmUpBatchSize is the number of ids read from the store at a time to warm the caches up
+const warmUpBatchSize = 100
+
+// warmUpIDs returns up to config.MaxIDs ids to warm the caches up with: those of the ids file saved on the last
+// shutdown, or, without ids file or before it was first saved, the first ids of the store
+func warmUpIDs(ctx context.Context, store Store, config CacheWarmUpConfig) ([]string, error) {
+	if config.IDsFile != "" {
+		content, err := ioutil.ReadFile(config.IDsFile)
+		if err == nil {
+			ids := make([]string, 0, config.MaxIDs)
+			for _, id := range strings.Split(string(content), "\n") {
+				if id != "" && len(ids) < config.MaxIDs {
+					ids = append(ids, id)
+				}
+			}
+			return ids, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	ids := make([]string, 0, config.MaxIDs)
+	cursor := ""
+	for len(ids) < config.MaxIDs {
+		page, next, err := store.ListIDs(ctx, cursor, config.MaxIDs-len(ids))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return ids, nil
+}
+
+// warmUpCaches reads the encrypted data keys of the given ids, for the store to cache them, and decrypts them
+// when the plaintext data keys are cached, BatchConcurrency at a time. It returns the number of ids read.
+func (r *RKMS) warmUpCaches(ctx context.Context, ids []string) int {
+	warmed := 0
+	for start := 0; start < len(ids) && ctx.Err() == nil; start += warmUpBatchSize {
+		end := start + warmUpBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		stored := r.getEncryptedDataKeysBatch(ctx, ids[start:end])
+		warmed += len(stored)
+		if r.plaintextCache == nil {
+			continue
+		}
+
+		forEachConcurrently(ids[start:end], BatchConcurrency, func(id string) {
+			encryptedDataKeys, ok := stored[id]
+			if !ok {
+				return
+			}
+
+			//the data keys are decrypted with the encryption context they are bound to
+			encryptionContext, err := storedEncryptionContext(encryptedDataKeys)
+			if err == nil {
+				_, err = r.decryptDataKeyVersion(withLogID(ctx, id), id, encryptedDataKeys, 0, encryptionContext, time.Time{})
+			}
+			if err != nil {
+				contextLogger(withLogID(ctx, id)).Infof("failed to warm the plaintext cache up: %s", err)
+			}
+		})
+	}
+	return warmed
+}
+
+// runCacheWarmUp warms the caches up with the ids config sets, /readyz failing until they are warm or the warm-up
+// runs out of time
+func runCacheWarmUp(ctx context.Context, r *RKMS, config CacheWarmUpConfig) {
+	defer warmingUp.Store(false)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.TimeoutInSeconds)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	ids, err := warmUpIDs(ctx, r.store, config)
+	if err != nil {
+		logger.Warnf("failed to list the ids to warm the caches up with: %s", err)
+		return
+	}
+
+	warmed := r.warmUpCaches(ctx, ids)
+	logger.Infof("warmed the caches up with %d of %d ids in %s", warmed, len(ids), time.Since(start))
+}
+
+// saveWarmUpIDs saves the ids the store used most recently to the ids file, for the next start to warm the caches
+// up with them. The stores which don't cache the ids they read save none.
+func saveWarmUpIDs(store Store, config CacheWarmUpConfig) error {
+	recent, ok := store.(RecentIDsStore)
+	if !ok || config.IDsFile == "" {
+		return nil
+	}
+
+	var content strings.Builder
+	for _, id := range recent.RecentIDs(config.MaxIDs) {
+		//the file has an id per line
+		if !strings.Contains(id, "\n") {
+			content.WriteString(id + "\n")
+		}
+	}
+
+	//written aside and renamed, for a crash not to leave half a file behind
+	path := config.IDsFile + ".tmp"
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path, config.IDsFile)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWarmUpIDs(t *testing.T) {
+	store := NewMemoryStore()
+	for _, id := range []string{"id-0", "id-1", "id-2"} {
+		store.SetEncryptedDataKeysConditionally(context.Background(), id, map[string]string{"region-0": "Y2lwaGVydGV4dA=="})
+	}
+	config := CacheWarmUpConfig{MaxIDs: 2, IDsFile: filepath.Join(t.TempDir(), "ids")}
+
+	//before the ids file was first saved, the first ids of the store are warmed up
+	ids, err := warmUpIDs(context.Background(), store, config)
+	if err != nil || len(ids) != 2 || ids[0] != "id-0" || ids[1] != "id-1" {
+		t.Fatalf("the first ids of the store should have been listed, got %v: %v", ids, err)
+	}
+
+	ioutil.WriteFile(config.IDsFile, []byte("id-2\nid-0\nid-1\n"), 0600)
+	ids, err = warmUpIDs(context.Background(), store, config)
+	if err != nil || len(ids) != 2 || ids[0] != "id-2" || ids[1] != "id-0" {
+		t.Fatalf("the ids of the file should have been listed, got %v: %v", ids, err)
+	}
+}
+
+func TestSaveWarmUpIDs(t *testing.T) {
+	s := getTestDynamoDBStore(&missingItemDynamoDBClient{})
+	s.negativeCacheExpiration = time.Minute
+	s.keysCache.Set("id-0", &item{ID: "id-0"}, 0)
+	s.keysCache.Set("id-1", &item{ID: "id-1"}, 0)
+	s.cacheMissingItem("id-2")
+	s.keysCache.Get("id-0")
+
+	config := CacheWarmUpConfig{MaxIDs: 10, IDsFile: filepath.Join(t.TempDir(), "ids")}
+	if err := saveWarmUpIDs(s, config); err != nil {
+		t.Fatalf("failed to save the ids: %s", err)
+	}
+
+	content, _ := ioutil.ReadFile(config.IDsFile)
+	if string(content) != "id-0\nid-1\n" {
+		t.Fatalf("the cached ids should have been saved, the most recently used first and the missing ones left out, got %q", content)
+	}
+}
+
+func TestWarmUpCachesDecryptsDataKeys(t *testing.T) {
+	r, provider := getPlaintextCachingRKMS(PlaintextCacheConfig{MaxEntries: 10, TTLInSeconds: 60})
+	defer r.purgePlaintextCache()
+	r.store = NewMemoryStore()
+	r.store.SetEncryptedDataKeysConditionally(context.Background(), "id", map[string]string{"region-0": "Y2lwaGVydGV4dA=="})
+
+	if warmed := r.warmUpCaches(context.Background(), []string{"id", "missing"}); warmed != 1 || provider.calls != 1 {
+		t.Fatalf("the existing id should have been warmed up, got %d ids and %d decryptions", warmed, provider.calls)
+	}
+
+	if _, err := r.GetDataKey(context.Background(), "id", 0, nil); err != nil || provider.calls != 1 {
+		t.Fatalf("the data key should have been served from the warm cache, got %d decryptions: %v", provider.calls, err)
+	}
+}
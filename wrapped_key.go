@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the formats the ciphertexts of the data keys are saved in: bare, the base64 ciphertext of the key provider alone
+// as it was before ciphertexts described themselves, or described, a JSON object telling how the data key was wrapped
+// along with the ciphertext
+const (
+	WrappedKeyFormatBare      = 0
+	WrappedKeyFormatDescribed = 1
+)
+
+// LatestWrappedKeyFormat is the latest format of the ciphertexts this version of rkms reads
+const LatestWrappedKeyFormat = WrappedKeyFormatDescribed
+
+// WrappingDescriber - the key providers telling how they wrap the data keys, for their ciphertexts to describe it
+type WrappingDescriber interface {
+	// ProviderType is the type the provider is registered as, e.g. aws
+	ProviderType() string
+
+	// WrappingAlgorithm is the algorithm the provider wraps the data keys with, e.g. SYMMETRIC_DEFAULT
+	WrappingAlgorithm() string
+}
+
+// AlgorithmDecrypter - the key providers able to unwrap the data keys wrapped with another algorithm than the one
+// they wrap with, e.g. since a configurable algorithm was changed
+type AlgorithmDecrypter interface {
+	// DecryptWithAlgorithm unwraps a data key wrapped with the given algorithm under the same encryption context
+	DecryptWithAlgorithm(ctx context.Context, algorithm string, ciphertext []byte, encryptionContext EncryptionContext) ([]byte, error)
+}
+
+// UnsupportedWrappedKeyError is returned when a ciphertext of a data key was wrapped in a way the key provider of
+// its region can't unwrap, e.g. by a newer version of rkms or by another type of provider
+type UnsupportedWrappedKeyError struct {
+	Reason string
+}
+
+func (e UnsupportedWrappedKeyError) Error() string {
+	return "unsupported wrapped data key: " + e.Reason
+}
+
+// wrappedKey - a ciphertext of a data key as it is saved in the store. The bare ciphertexts only have Ciphertext,
+// the others telling the spec of the data key, the algorithm it was wrapped with and the type of the provider which
+// wrapped it, empty when the provider doesn't tell. The ciphertext of a share of a data key split with Shamir's
+// scheme has the x coordinate of the share, and the number of shares reconstructing the data key as Threshold.
+type wrappedKey struct {
+	Format     int    `json:"format"`
+	KeySpec    string `json:"key_spec,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	Share      int    `json:"share,omitempty"`
+	Threshold  int    `json:"threshold,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+
+	// the decoded Ciphertext
+	blob []byte
+}
+
+// newWrappedKey describes the ciphertext of a data key of the given size wrapped by provider, in the given format
+func newWrappedKey(format int, provider KeyProvider, dataKeySizeInBytes int, ciphertext []byte) *wrappedKey {
+	wrapped := &wrappedKey{Format: format, Ciphertext: base64.StdEncoding.EncodeToString(ciphertext), blob: ciphertext}
+	if format == WrappedKeyFormatBare {
+		return wrapped
+	}
+
+	wrapped.KeySpec = keySpec(int64(dataKeySizeInBytes))
+	if describer, ok := provider.(WrappingDescriber); ok {
+		wrapped.Provider = describer.ProviderType()
+		wrapped.Algorithm = describer.WrappingAlgorithm()
+	}
+	return wrapped
+}
+
+// parseWrappedKey reads a ciphertext of a data key saved in the store, or given by a client, in any format: base64
+// never starting with a brace, the described ciphertexts can't be mistaken for bare ones
+func parseWrappedKey(saved string) (*wrappedKey, error) {
+	wrapped := wrappedKey{Format: WrappedKeyFormatBare, Ciphertext: saved}
+	if strings.HasPrefix(saved, "{") {
+		if err := json.Unmarshal([]byte(saved), &wrapped); err != nil {
+			return nil, fmt.Errorf("the wrapped data key is corrupted: %s", err)
+		}
+		if wrapped.Format > LatestWrappedKeyFormat {
+			return nil, UnsupportedWrappedKeyError{fmt.Sprintf("format %d is newer than the latest one, %d", wrapped.Format, LatestWrappedKeyFormat)}
+		}
+	}
+
+	var err error
+	if wrapped.blob, err = base64.StdEncoding.DecodeString(wrapped.Ciphertext); err != nil {
+		return nil, err
+	}
+	return &wrapped, nil
+}
+
+// wrappedKeyCiphertext returns the base64 ciphertext of the key provider of a saved ciphertext, the saved one when
+// it can't be parsed
+func wrappedKeyCiphertext(saved string) string {
+	wrapped, err := parseWrappedKey(saved)
+	if err != nil {
+		return saved
+	}
+	return wrapped.Ciphertext
+}
+
+// String is the wrapped key as it is saved in the store
+func (w *wrappedKey) String() string {
+	if w.Format == WrappedKeyFormatBare {
+		return w.Ciphertext
+	}
+
+	b, _ := json.Marshal(w)
+	return string(b)
+}
+
+// decrypt unwraps the data key with provider the way the wrapped key tells it was wrapped, failing when the
+// provider is of another type or can't unwrap its algorithm, and checking the unwrapped data key is of its spec.
+// The bare ciphertexts are unwrapped the way provider wraps.
+func (w *wrappedKey) decrypt(ctx context.Context, provider KeyProvider, encryptionContext EncryptionContext) ([]byte, error) {
+	describer, described := provider.(WrappingDescriber)
+	if w.Provider != "" && described && w.Provider != describer.ProviderType() {
+		return nil, UnsupportedWrappedKeyError{fmt.Sprintf("the data key was wrapped by a %s key provider, not a %s one", w.Provider, describer.ProviderType())}
+	}
+
+	var plaintext []byte
+	var err error
+	if w.Algorithm != "" && described && w.Algorithm != describer.WrappingAlgorithm() {
+		decrypter, ok := provider.(AlgorithmDecrypter)
+		if !ok {
+			return nil, UnsupportedWrappedKeyError{fmt.Sprintf("the key provider can't unwrap the data keys wrapped with %s", w.Algorithm)}
+		}
+		plaintext, err = decrypter.DecryptWithAlgorithm(ctx, w.Algorithm, w.blob, encryptionContext)
+	} else {
+		plaintext, err = provider.Decrypt(ctx, w.blob, encryptionContext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if w.KeySpec != "" && keySpec(int64(len(plaintext))) != w.KeySpec {
+		return nil, fmt.Errorf("the unwrapped data key is not of its spec %s", w.KeySpec)
+	}
+	return plaintext, nil
+}
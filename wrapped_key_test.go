@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDescribedWrappedKeys(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	r.wrappedKeyFormat = WrappedKeyFormatDescribed
+	ctx := context.Background()
+
+	dataKey, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create the data key: %s", err)
+	}
+
+	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to read the encrypted data keys: %s", err)
+	}
+	wrapped, err := parseWrappedKey(encryptedDataKeys["local"])
+	if err != nil {
+		t.Fatalf("failed to parse the saved ciphertext: %s", err)
+	}
+	if wrapped.Format != WrappedKeyFormatDescribed || wrapped.Provider != "local" || wrapped.Algorithm != "AES_GCM" || wrapped.KeySpec != "AES_256" {
+		t.Fatalf("the saved ciphertext should have described how it was wrapped, got %+v", wrapped)
+	}
+
+	read, err := r.GetDataKey(ctx, "id", 0, nil)
+	if err != nil || !read.Plaintext.Equal(dataKey.Plaintext) {
+		t.Fatalf("the described ciphertext should have been decrypted, got %v", err)
+	}
+
+	wrappedDataKey, err := r.GetWrappedDataKey(ctx, "id", 0, nil)
+	if err != nil || wrappedDataKey.Ciphertexts["local"] != wrapped.Ciphertext {
+		t.Fatalf("the clients should have been given the bare ciphertexts, got %v", err)
+	}
+
+	plaintext, _, err := r.DecryptCiphertext(ctx, "id", "local", wrapped.Ciphertext, nil)
+	if err != nil || !plaintext.Equal(dataKey.Plaintext) {
+		t.Fatalf("the bare ciphertext of a described one should have been decrypted, got %v", err)
+	}
+}
+
+func TestWrappedKeyDispatch(t *testing.T) {
+	r := getEnvelopeRKMS(t)
+	provider := r.providers["local"]
+	ctx := context.Background()
+
+	plaintext, ciphertext, err := provider.GenerateDataKey(ctx, 32, nil)
+	if err != nil {
+		t.Fatalf("failed to generate a data key: %s", err)
+	}
+
+	bare, err := parseWrappedKey(newWrappedKey(WrappedKeyFormatBare, provider, len(plaintext), ciphertext).String())
+	if err != nil || bare.Format != WrappedKeyFormatBare {
+		t.Fatalf("the bare ciphertext should have been parsed as such, got %v", err)
+	}
+	if decrypted, err := bare.decrypt(ctx, provider, nil); err != nil || string(decrypted) != string(plaintext) {
+		t.Fatalf("the bare ciphertext should have been decrypted the way the provider wraps, got %v", err)
+	}
+
+	for _, wrapped := range []*wrappedKey{
+		{Format: WrappedKeyFormatDescribed, Provider: "aws", blob: ciphertext},
+		{Format: WrappedKeyFormatDescribed, Provider: "local", Algorithm: "RSA_OAEP", blob: ciphertext},
+	} {
+		if _, err := wrapped.decrypt(ctx, provider, nil); err == nil {
+			t.Fatalf("%+v should have failed to be decrypted", wrapped)
+		} else if _, ok := err.(UnsupportedWrappedKeyError); !ok {
+			t.Fatalf("%+v should have been unsupported, got %v", wrapped, err)
+		}
+	}
+
+	wrongSpec := &wrappedKey{Format: WrappedKeyFormatDescribed, KeySpec: "AES_128", blob: ciphertext}
+	if _, err := wrongSpec.decrypt(ctx, provider, nil); err == nil {
+		t.Fatalf("a data key of another spec than its ciphertext's should have failed")
+	}
+
+	if _, err := parseWrappedKey(`{"format":2,"ciphertext":"AA=="}`); err == nil {
+		t.Fatalf("a newer format should have been unsupported")
+	}
+}